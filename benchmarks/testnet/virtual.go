@@ -9,11 +9,15 @@ import (
 
 	delay "github.com/ipfs/go-ipfs-delay"
 	mockrouting "github.com/ipfs/go-ipfs-routing/mock"
+	"github.com/libp2p/go-libp2p-core/connmgr"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
 	tnet "github.com/libp2p/go-libp2p-testing/net"
 	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	ma "github.com/multiformats/go-multiaddr"
 	"google.golang.org/protobuf/proto"
 
+	"github.com/ipfs/go-graphsync"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	gsnet "github.com/ipfs/go-graphsync/network"
 )
@@ -208,10 +212,52 @@ func (nc *networkClient) NewMessageSender(ctx context.Context, p peer.ID) (gsnet
 	}, nil
 }
 
+// ProtocolVersion always returns false, as messages on the virtual network are
+// passed in memory rather than over a negotiated protocol
+func (nc *networkClient) ProtocolVersion(p peer.ID) (protocol.ID, bool) {
+	return "", false
+}
+
+// AddDialHints does nothing, as peers on the virtual network are reached without
+// addresses
+func (nc *networkClient) AddDialHints(p peer.ID, addrs []ma.Multiaddr) {}
+
+// WireStats always returns empty stats, as messages on the virtual network are
+// passed without being encoded
+func (nc *networkClient) WireStats(p peer.ID) gsnet.WireStats {
+	return gsnet.WireStats{}
+}
+
+// IsRelayed always returns false, as peers on the virtual network are
+// connected directly
+func (nc *networkClient) IsRelayed(p peer.ID) bool {
+	return false
+}
+
+// SupportedExtensions always returns false, as peers on the virtual network do
+// not advertise extensions
+func (nc *networkClient) SupportedExtensions(p peer.ID) ([]graphsync.ExtensionName, bool) {
+	return nil, false
+}
+
+// ConnectionManager returns a connection manager that does nothing, as
+// connections on the virtual network are never pruned
+func (nc *networkClient) ConnectionManager() gsnet.ConnManager {
+	return connmgr.NullConnMgr{}
+}
+
 func (nc *networkClient) SetDelegate(r gsnet.Receiver) {
 	nc.Receiver = r
 }
 
+// Stop removes the client from the network, so messages are no longer
+// delivered to it
+func (nc *networkClient) Stop() {
+	nc.network.mu.Lock()
+	defer nc.network.mu.Unlock()
+	delete(nc.network.clients, nc.local)
+}
+
 func (nc *networkClient) ConnectTo(_ context.Context, p peer.ID) error {
 	nc.network.mu.Lock()
 	otherClient, ok := nc.network.clients[p]
@@ -0,0 +1,153 @@
+package blockcache
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+)
+
+// BlockCache is an in memory cache of recently verified blocks, bounded by
+// total block size, that evicts the least recently used blocks first
+type BlockCache struct {
+	lk       sync.Mutex
+	maxBytes uint64
+	size     uint64
+	entries  map[cid.Cid]*list.Element
+	order    *list.List
+}
+
+type entry struct {
+	c    cid.Cid
+	data []byte
+}
+
+// New initializes a block cache holding up to maxBytes of block data
+func New(maxBytes uint64) *BlockCache {
+	return &BlockCache{
+		maxBytes: maxBytes,
+		entries:  make(map[cid.Cid]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Get returns the data for the given cid if it is cached
+func (bc *BlockCache) Get(c cid.Cid) ([]byte, bool) {
+	bc.lk.Lock()
+	defer bc.lk.Unlock()
+	elem, ok := bc.entries[c]
+	if !ok {
+		return nil, false
+	}
+	bc.order.MoveToFront(elem)
+	return elem.Value.(*entry).data, true
+}
+
+// Put adds the data for the given cid to the cache, evicting older blocks as
+// needed. Blocks larger than the cache are not stored
+func (bc *BlockCache) Put(c cid.Cid, data []byte) {
+	bc.lk.Lock()
+	defer bc.lk.Unlock()
+	if uint64(len(data)) > bc.maxBytes {
+		return
+	}
+	if elem, ok := bc.entries[c]; ok {
+		bc.order.MoveToFront(elem)
+		return
+	}
+	bc.entries[c] = bc.order.PushFront(&entry{c, data})
+	bc.size += uint64(len(data))
+	for bc.size > bc.maxBytes {
+		oldest := bc.order.Back()
+		evicted := bc.order.Remove(oldest).(*entry)
+		delete(bc.entries, evicted.c)
+		bc.size -= uint64(len(evicted.data))
+	}
+}
+
+// Size returns the total size of block data currently cached
+func (bc *BlockCache) Size() uint64 {
+	bc.lk.Lock()
+	defer bc.lk.Unlock()
+	return bc.size
+}
+
+// WrapLoader returns a loader that serves blocks from the cache when present,
+// and otherwise falls back to the given loader
+func (bc *BlockCache) WrapLoader(loader ipld.Loader) ipld.Loader {
+	return func(lnk ipld.Link, lnkCtx ipld.LinkContext) (io.Reader, error) {
+		if asCidLink, ok := lnk.(cidlink.Link); ok {
+			if data, ok := bc.Get(asCidLink.Cid); ok {
+				return bytes.NewReader(data), nil
+			}
+		}
+		return loader(lnk, lnkCtx)
+	}
+}
+
+// WrapStorer returns a storer that writes blocks with the given storer and
+// adds them to the cache once they are committed
+func (bc *BlockCache) WrapStorer(storer ipld.Storer) ipld.Storer {
+	return func(lnkCtx ipld.LinkContext) (io.Writer, ipld.StoreCommitter, error) {
+		writer, committer, err := storer(lnkCtx)
+		if err != nil {
+			return nil, nil, err
+		}
+		cw := &cachingWriter{writer: writer}
+		return cw, func(lnk ipld.Link) error {
+			err := committer(lnk)
+			if err != nil {
+				return err
+			}
+			if asCidLink, ok := lnk.(cidlink.Link); ok {
+				bc.Put(asCidLink.Cid, cw.Bytes())
+			}
+			return nil
+		}, nil
+	}
+}
+
+type settableWriter interface {
+	SetBytes([]byte) error
+}
+
+// cachingWriter records the bytes written to the underlying writer, while
+// preserving its ability to have bytes set directly
+type cachingWriter struct {
+	writer     io.Writer
+	buffer     bytes.Buffer
+	didSetData bool
+	data       []byte
+}
+
+func (cw *cachingWriter) Write(p []byte) (int, error) {
+	n, err := cw.writer.Write(p)
+	cw.buffer.Write(p[:n])
+	return n, err
+}
+
+func (cw *cachingWriter) SetBytes(data []byte) error {
+	var err error
+	if settable, ok := cw.writer.(settableWriter); ok {
+		err = settable.SetBytes(data)
+	} else {
+		_, err = cw.writer.Write(data)
+	}
+	if err != nil {
+		return err
+	}
+	cw.didSetData = true
+	cw.data = data
+	return nil
+}
+
+func (cw *cachingWriter) Bytes() []byte {
+	if cw.didSetData {
+		return cw.data
+	}
+	return cw.buffer.Bytes()
+}
@@ -0,0 +1,63 @@
+package blockcache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	ipld "github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestEvictsLeastRecentlyUsed(t *testing.T) {
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	bc := New(200)
+	bc.Put(blks[0].Cid(), blks[0].RawData())
+	bc.Put(blks[1].Cid(), blks[1].RawData())
+	_, ok := bc.Get(blks[0].Cid())
+	require.True(t, ok)
+
+	bc.Put(blks[2].Cid(), blks[2].RawData())
+	require.Equal(t, uint64(200), bc.Size())
+	_, ok = bc.Get(blks[1].Cid())
+	require.False(t, ok)
+	data, ok := bc.Get(blks[0].Cid())
+	require.True(t, ok)
+	require.Equal(t, blks[0].RawData(), data)
+	_, ok = bc.Get(blks[2].Cid())
+	require.True(t, ok)
+
+	tooLarge := testutil.GenerateBlocksOfSize(1, 300)[0]
+	bc.Put(tooLarge.Cid(), tooLarge.RawData())
+	_, ok = bc.Get(tooLarge.Cid())
+	require.False(t, ok)
+}
+
+func TestWrapStorerAndLoader(t *testing.T) {
+	blk := testutil.GenerateBlocksOfSize(1, 100)[0]
+	link := cidlink.Link{Cid: blk.Cid()}
+	bc := New(1000)
+	stored := make(map[ipld.Link][]byte)
+	loader, storer := testutil.NewTestStore(stored)
+
+	cachingStorer := bc.WrapStorer(storer)
+	w, commit, err := cachingStorer(ipld.LinkContext{})
+	require.NoError(t, err)
+	_, err = w.Write(blk.RawData())
+	require.NoError(t, err)
+	err = commit(link)
+	require.NoError(t, err)
+	require.Equal(t, blk.RawData(), stored[link])
+
+	// remove from the underlying store, should still load from cache
+	delete(stored, link)
+	cachingLoader := bc.WrapLoader(loader)
+	r, err := cachingLoader(link, ipld.LinkContext{})
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(blk.RawData(), data))
+}
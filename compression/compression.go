@@ -0,0 +1,164 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/ipld/go-ipld-prime/fluent"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+
+	"github.com/ipfs/go-graphsync/ipldutil"
+)
+
+// Algorithm is the name of a block compression algorithm
+type Algorithm string
+
+// Gzip compresses block payloads with gzip
+const Gzip = Algorithm("gzip")
+
+// Snappy compresses block payloads with the snappy block format. It
+// compresses less than gzip, but is much cheaper to encode and decode
+const Snappy = Algorithm("snappy")
+
+// ErrDecompressedTooLarge means a compressed payload expanded past the allowed size
+var ErrDecompressedTooLarge = errors.New("decompressed block exceeds maximum size")
+
+// SupportedAlgorithms lists the compression algorithms this implementation can
+// encode and decode, in order of preference
+func SupportedAlgorithms() []Algorithm {
+	return []Algorithm{Gzip, Snappy}
+}
+
+// IsSupported returns true if the given algorithm can be encoded and decoded
+func IsSupported(algorithm Algorithm) bool {
+	for _, supported := range SupportedAlgorithms() {
+		if supported == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// Choose picks the first algorithm in offered that is supported, returning
+// false if there is none
+func Choose(offered []Algorithm) (Algorithm, bool) {
+	for _, algorithm := range offered {
+		if IsSupported(algorithm) {
+			return algorithm, true
+		}
+	}
+	return "", false
+}
+
+// Compress compresses data with the given algorithm
+func Compress(algorithm Algorithm, data []byte) ([]byte, error) {
+	switch algorithm {
+	case Gzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, err := w.Write(data)
+		if err != nil {
+			return nil, err
+		}
+		err = w.Close()
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Snappy:
+		return snappyEncode(data), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm: %s", algorithm)
+	}
+}
+
+// Decompress decompresses data with the given algorithm, erroring if the
+// result would be larger than maxSize
+func Decompress(algorithm Algorithm, data []byte, maxSize int) ([]byte, error) {
+	switch algorithm {
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		decompressed, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(decompressed) > maxSize {
+			return nil, ErrDecompressedTooLarge
+		}
+		return decompressed, nil
+	case Snappy:
+		return snappyDecode(data, maxSize)
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm: %s", algorithm)
+	}
+}
+
+// EncodeAlgorithms encodes the algorithms a requestor accepts for the
+// block compression extension on a request
+func EncodeAlgorithms(algorithms []Algorithm) ([]byte, error) {
+	list := fluent.MustBuildList(basicnode.Prototype.List, len(algorithms), func(la fluent.ListAssembler) {
+		for _, algorithm := range algorithms {
+			la.AssembleValue().AssignString(string(algorithm))
+		}
+	})
+	return ipldutil.EncodeNode(list)
+}
+
+// DecodeAlgorithms decodes the algorithms a requestor accepts from the
+// block compression extension on a request
+func DecodeAlgorithms(data []byte) ([]Algorithm, error) {
+	list, err := ipldutil.DecodeNode(data)
+	if err != nil {
+		return nil, err
+	}
+	var algorithms []Algorithm
+	iter := list.ListIterator()
+	if iter == nil {
+		return nil, errors.New("compression algorithms must be a list")
+	}
+	for !iter.Done() {
+		_, next, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		name, err := next.AsString()
+		if err != nil {
+			return nil, err
+		}
+		algorithms = append(algorithms, Algorithm(name))
+	}
+	return algorithms, nil
+}
+
+// EncodeAlgorithm encodes the algorithm a responder used for the block
+// compression extension on a response
+func EncodeAlgorithm(algorithm Algorithm) ([]byte, error) {
+	nb := basicnode.Prototype.String.NewBuilder()
+	err := nb.AssignString(string(algorithm))
+	if err != nil {
+		return nil, err
+	}
+	return ipldutil.EncodeNode(nb.Build())
+}
+
+// DecodeAlgorithm decodes the algorithm a responder used from the block
+// compression extension on a response
+func DecodeAlgorithm(data []byte) (Algorithm, error) {
+	nd, err := ipldutil.DecodeNode(data)
+	if err != nil {
+		return "", err
+	}
+	name, err := nd.AsString()
+	if err != nil {
+		return "", err
+	}
+	return Algorithm(name), nil
+}
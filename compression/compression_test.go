@@ -0,0 +1,76 @@
+package compression
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestCompressDecompress(t *testing.T) {
+	random := testutil.RandomBytes(1000)
+	repetitive := bytes.Repeat(testutil.RandomBytes(100), 100)
+	for _, algorithm := range SupportedAlgorithms() {
+		t.Run(string(algorithm), func(t *testing.T) {
+			for _, data := range [][]byte{random, repetitive} {
+				compressed, err := Compress(algorithm, data)
+				require.NoError(t, err)
+				decompressed, err := Decompress(algorithm, compressed, len(data))
+				require.NoError(t, err)
+				require.Equal(t, data, decompressed)
+
+				_, err = Decompress(algorithm, compressed, len(data)-1)
+				require.EqualError(t, err, ErrDecompressedTooLarge.Error())
+			}
+			compressed, err := Compress(algorithm, repetitive)
+			require.NoError(t, err)
+			require.Less(t, len(compressed), len(repetitive)/10)
+		})
+	}
+
+	_, err := Compress(Algorithm("unknown"), random)
+	require.Error(t, err)
+}
+
+func TestSnappyFormat(t *testing.T) {
+	// twenty a's, as encoded by the reference implementation: the length, a
+	// one byte literal, then a copy of nineteen bytes from one byte back
+	encoded := []byte{0x14, 0x00, 'a', 0x4a, 0x01, 0x00}
+	data := bytes.Repeat([]byte("a"), 20)
+	compressed, err := Compress(Snappy, data)
+	require.NoError(t, err)
+	require.Equal(t, encoded, compressed)
+	decompressed, err := Decompress(Snappy, encoded, len(data))
+	require.NoError(t, err)
+	require.Equal(t, data, decompressed)
+
+	// copies from before the start of the output are rejected
+	_, err = Decompress(Snappy, []byte{0x14, 0x00, 'a', 0x4a, 0x02, 0x00}, len(data))
+	require.Error(t, err)
+	// as is output shorter than the declared length
+	_, err = Decompress(Snappy, []byte{0x14, 0x00, 'a'}, len(data))
+	require.Error(t, err)
+}
+
+func TestEncodeDecodeAlgorithms(t *testing.T) {
+	offered := []Algorithm{Algorithm("zstd"), Gzip}
+	encoded, err := EncodeAlgorithms(offered)
+	require.NoError(t, err)
+	decoded, err := DecodeAlgorithms(encoded)
+	require.NoError(t, err)
+	require.Equal(t, offered, decoded)
+
+	chosen, ok := Choose(decoded)
+	require.True(t, ok)
+	require.Equal(t, Gzip, chosen)
+	_, ok = Choose([]Algorithm{Algorithm("zstd")})
+	require.False(t, ok)
+
+	encoded, err = EncodeAlgorithm(Gzip)
+	require.NoError(t, err)
+	algorithm, err := DecodeAlgorithm(encoded)
+	require.NoError(t, err)
+	require.Equal(t, Gzip, algorithm)
+}
@@ -0,0 +1,170 @@
+package compression
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// This file implements the snappy block format
+// (https://github.com/google/snappy/blob/master/format_description.txt), so
+// payloads can be exchanged with any snappy implementation without adding a
+// dependency. The encoder is a simple greedy matcher: it trades some ratio
+// for speed, which is the point of offering snappy next to gzip.
+
+var errCorruptSnappy = errors.New("corrupt snappy payload")
+
+const (
+	snappyTagLiteral = 0x00
+	snappyTagCopy1   = 0x01
+	snappyTagCopy2   = 0x02
+	snappyTagCopy4   = 0x03
+
+	snappyTableBits = 14
+	snappyMaxOffset = 1<<16 - 1
+)
+
+func snappyEncode(src []byte) []byte {
+	dst := make([]byte, 0, binary.MaxVarintLen64+len(src)+len(src)/6+1)
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(src)))
+	dst = append(dst, lenBuf[:n]...)
+
+	// table holds the position plus one of the last place each hashed four
+	// byte sequence was seen, so zero means not seen
+	var table [1 << snappyTableBits]int
+	literalStart := 0
+	s := 0
+	for s+4 <= len(src) {
+		current := binary.LittleEndian.Uint32(src[s:])
+		h := snappyHash(current)
+		candidate := table[h] - 1
+		table[h] = s + 1
+		if candidate < 0 || s-candidate > snappyMaxOffset || binary.LittleEndian.Uint32(src[candidate:]) != current {
+			s++
+			continue
+		}
+		dst = snappyEmitLiteral(dst, src[literalStart:s])
+		matchStart := s
+		s += 4
+		for matched := candidate + 4; s < len(src) && src[s] == src[matched]; matched++ {
+			s++
+		}
+		dst = snappyEmitCopy(dst, matchStart-candidate, s-matchStart)
+		literalStart = s
+	}
+	return snappyEmitLiteral(dst, src[literalStart:])
+}
+
+func snappyHash(u uint32) uint32 {
+	return (u * 0x1e35a7bd) >> (32 - snappyTableBits)
+}
+
+func snappyEmitLiteral(dst []byte, literal []byte) []byte {
+	if len(literal) == 0 {
+		return dst
+	}
+	n := uint32(len(literal) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|snappyTagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|snappyTagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|snappyTagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, literal...)
+}
+
+// snappyEmitCopy emits a copy of length bytes from offset bytes back. length
+// is at least four, and offset is at most snappyMaxOffset
+func snappyEmitCopy(dst []byte, offset, length int) []byte {
+	for length >= 68 {
+		dst = append(dst, 63<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		// leave at least four bytes, so the remainder can use a copy1 tag
+		dst = append(dst, 59<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 12 || offset >= 2048 {
+		return append(dst, byte(length-1)<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|snappyTagCopy1, byte(offset))
+}
+
+func snappyDecode(src []byte, maxSize int) ([]byte, error) {
+	decodedLen, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, errCorruptSnappy
+	}
+	if decodedLen > uint64(maxSize) {
+		return nil, ErrDecompressedTooLarge
+	}
+	dst := make([]byte, decodedLen)
+	s, d := n, 0
+	for s < len(src) {
+		tag := src[s]
+		var length, offset int
+		switch tag & 0x03 {
+		case snappyTagLiteral:
+			x := uint32(tag >> 2)
+			s++
+			if x >= 60 {
+				extra := int(x - 59)
+				if s+extra > len(src) {
+					return nil, errCorruptSnappy
+				}
+				x = 0
+				for i := extra - 1; i >= 0; i-- {
+					x = x<<8 | uint32(src[s+i])
+				}
+				s += extra
+			}
+			length = int(x) + 1
+			if length <= 0 || length > len(src)-s || length > len(dst)-d {
+				return nil, errCorruptSnappy
+			}
+			copy(dst[d:], src[s:s+length])
+			s += length
+			d += length
+			continue
+		case snappyTagCopy1:
+			if s+2 > len(src) {
+				return nil, errCorruptSnappy
+			}
+			length = 4 + int(tag>>2)&0x07
+			offset = int(tag&0xe0)<<3 | int(src[s+1])
+			s += 2
+		case snappyTagCopy2:
+			if s+3 > len(src) {
+				return nil, errCorruptSnappy
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[s+1:]))
+			s += 3
+		case snappyTagCopy4:
+			if s+5 > len(src) {
+				return nil, errCorruptSnappy
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[s+1:]))
+			s += 5
+		}
+		if offset <= 0 || offset > d || length > len(dst)-d {
+			return nil, errCorruptSnappy
+		}
+		// copies may overlap the bytes they produce, so go a byte at a time
+		for end := d + length; d < end; d++ {
+			dst[d] = dst[d-offset]
+		}
+	}
+	if d != len(dst) {
+		return nil, errCorruptSnappy
+	}
+	return dst, nil
+}
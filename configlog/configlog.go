@@ -0,0 +1,84 @@
+package configlog
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+)
+
+type key struct {
+	isResponse bool
+	p          peer.ID
+	requestID  graphsync.RequestID
+}
+
+type entry struct {
+	key    key
+	config graphsync.EffectiveConfig
+}
+
+// Log keeps the effective configuration of the most recent requests and
+// responses, so it can still be inspected after they finish
+type Log struct {
+	lk       sync.Mutex
+	capacity int
+	order    *list.List
+	entries  map[key]*list.Element
+}
+
+// New returns a log that keeps the given number of most recent configurations
+func New(capacity int) *Log {
+	return &Log{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[key]*list.Element),
+	}
+}
+
+// RecordRequest records the effective configuration of an outgoing request
+func (l *Log) RecordRequest(config graphsync.EffectiveConfig) {
+	l.record(key{false, "", config.RequestID}, config)
+}
+
+// RecordResponse records the effective configuration of a response to a peer
+func (l *Log) RecordResponse(config graphsync.EffectiveConfig) {
+	l.record(key{true, config.Peer, config.RequestID}, config)
+}
+
+// Request returns the effective configuration of an outgoing request
+func (l *Log) Request(requestID graphsync.RequestID) (graphsync.EffectiveConfig, bool) {
+	return l.get(key{false, "", requestID})
+}
+
+// Response returns the effective configuration of a response to a peer
+func (l *Log) Response(p peer.ID, requestID graphsync.RequestID) (graphsync.EffectiveConfig, bool) {
+	return l.get(key{true, p, requestID})
+}
+
+func (l *Log) record(k key, config graphsync.EffectiveConfig) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	if elem, ok := l.entries[k]; ok {
+		elem.Value.(*entry).config = config
+		l.order.MoveToFront(elem)
+		return
+	}
+	l.entries[k] = l.order.PushFront(&entry{k, config})
+	for l.order.Len() > l.capacity {
+		oldest := l.order.Remove(l.order.Back()).(*entry)
+		delete(l.entries, oldest.key)
+	}
+}
+
+func (l *Log) get(k key) (graphsync.EffectiveConfig, bool) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	elem, ok := l.entries[k]
+	if !ok {
+		return graphsync.EffectiveConfig{}, false
+	}
+	return elem.Value.(*entry).config, true
+}
@@ -0,0 +1,35 @@
+package configlog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestLog(t *testing.T) {
+	peers := testutil.GeneratePeers(2)
+	log := New(2)
+
+	log.RecordRequest(graphsync.EffectiveConfig{Peer: peers[0], RequestID: 1, PersistenceOption: "a"})
+	log.RecordResponse(graphsync.EffectiveConfig{Peer: peers[1], RequestID: 1, PersistenceOption: "b"})
+
+	config, ok := log.Request(1)
+	require.True(t, ok)
+	require.Equal(t, "a", config.PersistenceOption)
+	config, ok = log.Response(peers[1], 1)
+	require.True(t, ok)
+	require.Equal(t, "b", config.PersistenceOption)
+	_, ok = log.Response(peers[0], 1)
+	require.False(t, ok, "responses are keyed by peer")
+
+	log.RecordResponse(graphsync.EffectiveConfig{Peer: peers[0], RequestID: 2})
+	_, ok = log.Request(1)
+	require.False(t, ok, "oldest configuration is forgotten past capacity")
+	_, ok = log.Response(peers[1], 1)
+	require.True(t, ok)
+	_, ok = log.Response(peers[0], 2)
+	require.True(t, ok)
+}
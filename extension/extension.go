@@ -0,0 +1,140 @@
+/*
+Package extension lets requests and hooks work with the data of graphsync
+extensions as Go values rather than raw bytes.
+
+An extension is declared once with its name and a codec for its data:
+
+	var myExtension = extension.New("myapp/ext", extension.CBORGen)
+
+Requestors attach values to requests with Data, and hooks read them back with
+Get, from either request or response data.
+*/
+package extension
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	ipld "github.com/ipld/go-ipld-prime"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/ipldutil"
+)
+
+// Codec converts the data of an extension to and from Go values
+type Codec interface {
+	// Encode returns the encoded data for value
+	Encode(value interface{}) ([]byte, error)
+	// Decode decodes data into value, which is a pointer
+	Decode(data []byte, value interface{}) error
+}
+
+// Source is anything extension data can be read from, such as
+// graphsync.RequestData or graphsync.ResponseData
+type Source interface {
+	Extension(name graphsync.ExtensionName) ([]byte, bool)
+}
+
+// Extension is a graphsync extension along with the codec for its data
+type Extension struct {
+	Name  graphsync.ExtensionName
+	Codec Codec
+}
+
+// New returns an extension with the given name whose data is encoded with
+// the given codec
+func New(name graphsync.ExtensionName, codec Codec) Extension {
+	return Extension{Name: name, Codec: codec}
+}
+
+// Data encodes value as data for the extension, to send with a request or
+// from a hook
+func (e Extension) Data(value interface{}) (graphsync.ExtensionData, error) {
+	data, err := e.Codec.Encode(value)
+	if err != nil {
+		return graphsync.ExtensionData{}, fmt.Errorf("encoding extension %s: %w", e.Name, err)
+	}
+	return graphsync.ExtensionData{Name: e.Name, Data: data}, nil
+}
+
+// Get decodes the data for the extension from source into value, which is a
+// pointer. It returns false if source does not have the extension
+func (e Extension) Get(source Source, value interface{}) (bool, error) {
+	data, has := source.Extension(e.Name)
+	if !has {
+		return false, nil
+	}
+	if err := e.Codec.Decode(data, value); err != nil {
+		return true, fmt.Errorf("decoding extension %s: %w", e.Name, err)
+	}
+	return true, nil
+}
+
+type cborGenCodec struct{}
+
+// CBORGen encodes values of types generated by cbor-gen, which implement
+// cbg.CBORMarshaler, and decodes into pointers implementing
+// cbg.CBORUnmarshaler
+var CBORGen Codec = cborGenCodec{}
+
+func (cborGenCodec) Encode(value interface{}) ([]byte, error) {
+	marshaler, ok := value.(cbg.CBORMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("%T does not implement CBORMarshaler", value)
+	}
+	buf := new(bytes.Buffer)
+	if err := marshaler.MarshalCBOR(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (cborGenCodec) Decode(data []byte, value interface{}) error {
+	unmarshaler, ok := value.(cbg.CBORUnmarshaler)
+	if !ok {
+		return fmt.Errorf("%T does not implement CBORUnmarshaler", value)
+	}
+	return unmarshaler.UnmarshalCBOR(bytes.NewReader(data))
+}
+
+type nodeCodec struct{}
+
+// Node encodes ipld.Node values as dag-cbor, like graphsync's own extensions,
+// and decodes into *ipld.Node
+var Node Codec = nodeCodec{}
+
+func (nodeCodec) Encode(value interface{}) ([]byte, error) {
+	node, ok := value.(ipld.Node)
+	if !ok {
+		return nil, fmt.Errorf("%T is not an ipld.Node", value)
+	}
+	return ipldutil.EncodeNode(node)
+}
+
+func (nodeCodec) Decode(data []byte, value interface{}) error {
+	node, ok := value.(*ipld.Node)
+	if !ok {
+		return fmt.Errorf("%T is not an *ipld.Node", value)
+	}
+	decoded, err := ipldutil.DecodeNode(data)
+	if err != nil {
+		return err
+	}
+	*node = decoded
+	return nil
+}
+
+type jsonCodec struct{}
+
+// JSON encodes values with encoding/json
+var JSON Codec = jsonCodec{}
+
+func (jsonCodec) Encode(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonCodec) Decode(data []byte, value interface{}) error {
+	return json.Unmarshal(data, value)
+}
@@ -0,0 +1,94 @@
+package extension_test
+
+import (
+	"testing"
+
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/extension"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/metadata"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestExtensionRoundTrip(t *testing.T) {
+	root := testutil.GenerateCids(1)[0]
+	selector := basicnode.NewString("selector")
+
+	type jsonValue struct {
+		Count int
+		Label string
+	}
+	testCases := map[string]struct {
+		codec    extension.Codec
+		value    interface{}
+		decoded  func() interface{}
+		expected interface{}
+		read     func(interface{}) interface{}
+	}{
+		"cbor-gen": {
+			codec:    extension.CBORGen,
+			value:    &metadata.Item{Link: root, BlockPresent: true},
+			decoded:  func() interface{} { return &metadata.Item{} },
+			expected: &metadata.Item{Link: root, BlockPresent: true},
+			read:     func(v interface{}) interface{} { return v },
+		},
+		"node": {
+			codec:    extension.Node,
+			value:    basicnode.NewString("apples"),
+			decoded:  func() interface{} { return new(ipld.Node) },
+			expected: "apples",
+			read: func(v interface{}) interface{} {
+				str, err := (*v.(*ipld.Node)).AsString()
+				require.NoError(t, err)
+				return str
+			},
+		},
+		"json": {
+			codec:    extension.JSON,
+			value:    &jsonValue{Count: 3, Label: "apples"},
+			decoded:  func() interface{} { return &jsonValue{} },
+			expected: &jsonValue{Count: 3, Label: "apples"},
+			read:     func(v interface{}) interface{} { return v },
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ext := extension.New(graphsync.ExtensionName("test/"+testCase), data.codec)
+			extData, err := ext.Data(data.value)
+			require.NoError(t, err)
+			require.Equal(t, ext.Name, extData.Name)
+
+			request := gsmsg.NewRequest(graphsync.RequestID(1), root, selector, graphsync.Priority(0), extData)
+			decoded := data.decoded()
+			has, err := ext.Get(request, decoded)
+			require.NoError(t, err)
+			require.True(t, has)
+			require.Equal(t, data.expected, data.read(decoded))
+
+			missing := extension.New(graphsync.ExtensionName("test/missing"), data.codec)
+			has, err = missing.Get(request, data.decoded())
+			require.NoError(t, err)
+			require.False(t, has)
+		})
+	}
+}
+
+func TestExtensionWrongType(t *testing.T) {
+	ext := extension.New(graphsync.ExtensionName("test/wrong"), extension.CBORGen)
+	_, err := ext.Data("not generated")
+	require.Error(t, err)
+
+	nodeExt := extension.New(graphsync.ExtensionName("test/node"), extension.Node)
+	extData, err := nodeExt.Data(basicnode.NewLink(cidlink.Link{Cid: testutil.GenerateCids(1)[0]}))
+	require.NoError(t, err)
+	request := gsmsg.NewRequest(graphsync.RequestID(1), testutil.GenerateCids(1)[0], basicnode.NewString("selector"), graphsync.Priority(0), extData)
+	var notANode string
+	has, err := nodeExt.Get(request, &notANode)
+	require.True(t, has)
+	require.Error(t, err)
+}
@@ -3,16 +3,24 @@ package graphsync
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-ipld-prime"
 	"github.com/ipld/go-ipld-prime/traversal"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
 )
 
 // RequestID is a unique identifier for a GraphSync request.
 type RequestID int32
 
+// NoRequestID is the ID of a request handle for a request that failed before
+// it was assigned an ID
+const NoRequestID = RequestID(-1)
+
 // Priority a priority for a GraphSync request.
 type Priority int32
 
@@ -37,6 +45,12 @@ const (
 	// https://github.com/ipld/specs/blob/master/block-layer/graphsync/known_extensions.md
 	ExtensionMetadata = ExtensionName("graphsync/response-metadata")
 
+	// ExtensionMetadataV2 negotiates the versioned v2 metadata format, which also
+	// carries block sizes and traversal order. Requestors opt in by adding it to
+	// a request, with data that is ignored. Responses to such a request carry it
+	// alongside ExtensionMetadata, and its data is the encoded metadata
+	ExtensionMetadataV2 = ExtensionName("graphsync/response-metadata/2")
+
 	// ExtensionDoNotSendCIDs tells the responding peer not to send certain blocks if they
 	// are encountered in a traversal and is documented at
 	// https://github.com/ipld/specs/blob/master/block-layer/graphsync/known_extensions.md
@@ -46,6 +60,53 @@ const (
 	// for requests that have the same key. The data for the extension is a string key
 	ExtensionDeDupByKey = ExtensionName("graphsync/dedup-by-key")
 
+	// ExtensionStatusCategory lets a responder hint at how a status code should be
+	// handled by requestors that may not recognize it. The data for the extension
+	// is an encoded StatusCategory
+	ExtensionStatusCategory = ExtensionName("graphsync/status-category")
+
+	// ExtensionBlockCompression negotiates compression of block payloads. On a
+	// request, the data is a list of compression algorithms the requestor can
+	// decode. On a response, the data is the single algorithm the responder used
+	// to compress every block in the message carrying the response
+	ExtensionBlockCompression = ExtensionName("graphsync/block-compression")
+
+	// ExtensionMetadataOnly asks the responding peer to send only response metadata
+	// (which links were traversed and whether their blocks are present) and no
+	// block data. The data for the extension is ignored
+	ExtensionMetadataOnly = ExtensionName("graphsync/metadata-only")
+
+	// ExtensionDedupWithinRequest asks the responder to send every block the
+	// request traverses, even if it was already sent to the requestor for
+	// another request in progress. Blocks are still only sent once per request.
+	// The extension data is ignored
+	ExtensionDedupWithinRequest = ExtensionName("graphsync/dedup-within-request")
+
+	// ExtensionMessageCompression is a message level extension on the dag-cbor protocol
+	// that advertises the algorithms a peer accepts for compressing entire
+	// messages sent to it. The data is a list of compression algorithms
+	ExtensionMessageCompression = ExtensionName("graphsync/message-compression")
+
+	// ExtensionSupportedExtensions is a message level extension on the v2
+	// protocol that advertises the extensions a peer handles. It is sent on the
+	// first message to a peer on each connection. The data is a list of
+	// extension names
+	ExtensionSupportedExtensions = ExtensionName("graphsync/supported-extensions")
+
+	// ExtensionRootRedirect tells the requestor that the responder traversed
+	// from a different root than the one requested, such as the current target
+	// of a mutable pointer. The data is the original root and the root the
+	// response used, encoded with the rootredirect package. Requestors that
+	// follow redirects send the extension with no data on their requests, and
+	// responders only redirect requests that carry it
+	ExtensionRootRedirect = ExtensionName("graphsync/root-redirect")
+
+	// ExtensionSelectorNarrowed tells the requestor that the responder
+	// traversed with a different selector than the one requested, so the
+	// response may cover less than was asked for. The data is the selector the
+	// response used, encoded as dag-cbor
+	ExtensionSelectorNarrowed = ExtensionName("graphsync/selector-narrowed")
+
 	// GraphSync Response Status Codes
 
 	// Informational Response Codes (partial)
@@ -92,6 +153,24 @@ const (
 	RequestFailedContentNotFound = ResponseStatusCode(34)
 	// RequestCancelled means the responder was processing the request but decided to top, for whatever reason
 	RequestCancelled = ResponseStatusCode(35)
+	// RequestFailedMessageTooLarge means a message carrying the request, or
+	// responses to it, was larger than the receiving peer accepts
+	RequestFailedMessageTooLarge = ResponseStatusCode(36)
+)
+
+// StatusCategory is the broad class a response status code falls into, which
+// determines how a requestor handles it
+type StatusCategory int32
+
+const (
+	// StatusCategoryUnknown means the status code could not be classified
+	StatusCategoryUnknown = StatusCategory(iota)
+	// StatusCategoryInformational means the request is still in progress
+	StatusCategoryInformational
+	// StatusCategorySuccess means the request terminated successfully
+	StatusCategorySuccess
+	// StatusCategoryFailure means the request terminated in failure
+	StatusCategoryFailure
 )
 
 // RequestContextCancelledErr is an error message received on the error channel when the request context given by the user is cancelled/times out
@@ -136,11 +215,238 @@ func (e RequestCancelledErr) Error() string {
 	return "Request Failed - Responder Cancelled"
 }
 
+// RequestFailedRejectedErr is an error message received on the error channel when the responder
+// did not accept the request
+type RequestFailedRejectedErr struct{}
+
+func (e RequestFailedRejectedErr) Error() string {
+	return "Request Failed - Rejected"
+}
+
+// RequestFailedClosedErr is an error message received on the error channel when a request is made
+// after the graphsync instance began closing
+type RequestFailedClosedErr struct{}
+
+func (e RequestFailedClosedErr) Error() string {
+	return "Request Failed - Graphsync Closed"
+}
+
+// RequestFailedMessageTooLargeErr is an error message received on the error channel when a message for the
+// request exceeded the size the receiving peer accepts
+type RequestFailedMessageTooLargeErr struct{}
+
+func (e RequestFailedMessageTooLargeErr) Error() string {
+	return "Request Failed - Message Too Large"
+}
+
+// RequestFailedUnrecognizedStatusErr is an error message received on the error channel when the request fails
+// with a status code this version of graphsync does not know
+type RequestFailedUnrecognizedStatusErr struct {
+	Status ResponseStatusCode
+}
+
+func (e RequestFailedUnrecognizedStatusErr) Error() string {
+	return fmt.Sprintf("Request Failed - Unrecognized Status Code %d", e.Status)
+}
+
+// RequestFailedStoreWriteErr is an error message received on the error channel when a block
+// was verified but could not be written to the store, and the request was failed
+type RequestFailedStoreWriteErr struct {
+	Link ipld.Link
+	Err  error
+}
+
+func (e RequestFailedStoreWriteErr) Error() string {
+	return fmt.Sprintf("Request Failed - Could Not Store Block %s: %s", e.Link, e.Err)
+}
+
+// Unwrap returns the error the store write failed with
+func (e RequestFailedStoreWriteErr) Unwrap() error {
+	return e.Err
+}
+
+// StoreFullErr is the reason a block could not be written when writing it
+// would take a persistence option over its quota. It is returned wrapped in a
+// RequestFailedStoreWriteErr or RequestPausedStoreWriteErr
+type StoreFullErr struct {
+	PersistenceOption string
+	Quota             uint64
+}
+
+func (e StoreFullErr) Error() string {
+	return fmt.Sprintf("Store Full - Persistence Option %s Has Reached Its Quota Of %d Bytes", e.PersistenceOption, e.Quota)
+}
+
+// BlockRejectedErr is the error a load fails with when a block store hook
+// rejects a verified block before it is written to the store
+type BlockRejectedErr struct {
+	Link ipld.Link
+	Err  error
+}
+
+func (e BlockRejectedErr) Error() string {
+	return fmt.Sprintf("Block Rejected - Not Storing %s: %s", e.Link, e.Err)
+}
+
+// Unwrap returns the error the block was rejected with
+func (e BlockRejectedErr) Unwrap() error {
+	return e.Err
+}
+
+// HookPanicErr is the error a request or response fails with when one of
+// its hooks panics
+type HookPanicErr struct {
+	// Hook is the name of the function that panicked
+	Hook string
+	// Value is the value the hook panicked with
+	Value interface{}
+}
+
+func (e HookPanicErr) Error() string {
+	return fmt.Sprintf("Hook Panicked - %s: %v", e.Hook, e.Value)
+}
+
+// BlockHashMismatchErr describes a block received from a peer whose data does
+// not hash to the CID it was sent with. Blocks like this are dropped
+type BlockHashMismatchErr struct {
+	Expected cid.Cid
+	Actual   cid.Cid
+}
+
+func (e BlockHashMismatchErr) Error() string {
+	return fmt.Sprintf("Block Hash Mismatch - Received %s But Data Hashes To %s", e.Expected, e.Actual)
+}
+
+// UnexpectedBlockErr describes a block received from a peer that no request
+// in the same response announced in its metadata. Blocks like this are dropped
+// when strict block checking is on
+type UnexpectedBlockErr struct {
+	Cid cid.Cid
+}
+
+func (e UnexpectedBlockErr) Error() string {
+	return fmt.Sprintf("Unexpected Block - Received %s Without Metadata Referencing It", e.Cid)
+}
+
+// RequestPausedStoreWriteErr is an error message received on the error channel when a block
+// was verified but could not be written to the store, and the request was paused. Unpausing
+// the request retries the write
+type RequestPausedStoreWriteErr struct {
+	Link ipld.Link
+	Err  error
+}
+
+func (e RequestPausedStoreWriteErr) Error() string {
+	return fmt.Sprintf("Request Paused - Could Not Store Block %s: %s", e.Link, e.Err)
+}
+
+// StoreWriteFailurePolicy is what happens to an outgoing request when a block is
+// verified but cannot be written to the store
+type StoreWriteFailurePolicy int
+
+const (
+	// StoreWriteFailRequest fails the request with a RequestFailedStoreWriteErr
+	StoreWriteFailRequest = StoreWriteFailurePolicy(iota)
+
+	// StoreWritePauseRequest pauses the request with a RequestPausedStoreWriteErr
+	StoreWritePauseRequest
+
+	// StoreWriteFallback writes the block to the store of the fallback persistence
+	// option, and fails the request if that write fails too
+	StoreWriteFallback
+)
+
 var (
 	// ErrExtensionAlreadyRegistered means a user extension can be registered only once
 	ErrExtensionAlreadyRegistered = errors.New("extension already registered")
 )
 
+// EffectiveConfig is the configuration a request or response ran with, after
+// hooks were applied
+type EffectiveConfig struct {
+	// Peer is the peer on the other end of the request
+	Peer peer.ID
+	// RequestID is the ID of the request
+	RequestID RequestID
+	// Root is the root of the request
+	Root cid.Cid
+	// Priority is the priority of the request
+	Priority Priority
+	// Extensions are the names of the extensions on the request
+	Extensions []ExtensionName
+	// HookExtensions are the names of extensions hooks added to the response
+	HookExtensions []ExtensionName
+	// PersistenceOption is the loader/storer used, or "" for the default
+	PersistenceOption string
+	// CustomChooser is whether a hook set a custom node prototype chooser
+	CustomChooser bool
+	// CustomSelector is whether a hook replaced the selector of a response
+	CustomSelector bool
+	// StoreWriteFailurePolicy is the store write failure policy of a request
+	StoreWriteFailurePolicy StoreWriteFailurePolicy
+	// FallbackPersistenceOption is the store used when a write fails, if any
+	FallbackPersistenceOption string
+	// WritePersistenceOption is the store received blocks are written to, if it
+	// differs from the one links are loaded from
+	WritePersistenceOption string
+	// StartedPaused is whether a hook paused a response before it started
+	StartedPaused bool
+	// MaxMemoryPerPeer is the memory budget for responses to the peer
+	MaxMemoryPerPeer uint64
+	// TotalMaxMemory is the memory budget for responses to all peers
+	TotalMaxMemory uint64
+	// Relayed is whether the peer was only connected through a relay when data
+	// began to flow. For requests it is recorded as the first response arrives,
+	// before incoming response hooks run
+	Relayed bool
+}
+
+// RequestInfo describes an outgoing request in progress
+type RequestInfo struct {
+	// ID is the ID of the request
+	ID RequestID
+	// Peer is the peer the request was sent to
+	Peer peer.ID
+	// Root is the root of the request
+	Root cid.Cid
+	// Selector is the selector of the request
+	Selector ipld.Node
+	// Priority is the priority of the request
+	Priority Priority
+	// Extensions are the names of the extensions on the request
+	Extensions []ExtensionName
+	// Paused is whether the request is paused
+	Paused bool
+}
+
+// Stats are running totals for a graphsync instance since it started, along
+// with the memory it currently holds, suitable for periodic scraping
+type Stats struct {
+	// OutgoingRequests is the number of requests made to peers
+	OutgoingRequests uint64
+	// IncomingRequests is the number of new requests received from peers
+	IncomingRequests uint64
+	// BlocksSent is the number of blocks sent in responses, including those
+	// deduplicated
+	BlocksSent uint64
+	// BytesSent is the size of block data actually sent over the network
+	BytesSent uint64
+	// BlocksReceived is the number of blocks received from the network
+	BlocksReceived uint64
+	// BytesReceived is the size of blocks received from the network
+	BytesReceived uint64
+	// DeduplicatedBlocks is the number of blocks in responses that were not
+	// sent because the requestor already had them
+	DeduplicatedBlocks uint64
+	// DeduplicatedBytes is the size of the blocks counted by DeduplicatedBlocks
+	DeduplicatedBytes uint64
+	// QueuedResponseMemory is the memory held by blocks queued to send
+	QueuedResponseMemory uint64
+	// BufferedRequestMemory is the memory held by blocks received that are
+	// waiting to be verified
+	BufferedRequestMemory uint64
+}
+
 // ResponseProgress is the fundamental unit of responses making progress in Graphsync.
 type ResponseProgress struct {
 	Node      ipld.Node // a node which matched the graphsync query
@@ -151,6 +457,28 @@ type ResponseProgress struct {
 	}
 }
 
+// RequestHandle is an outgoing request in progress, with methods to follow
+// and control it
+type RequestHandle interface {
+	// ID returns the ID of the request, or NoRequestID if it failed to start
+	ID() RequestID
+
+	// Responses returns the channel of nodes traversed by the request
+	Responses() <-chan ResponseProgress
+
+	// Errors returns the channel of errors for the request
+	Errors() <-chan error
+
+	// Pause pauses the request (may take 1 or more blocks to process)
+	Pause() error
+
+	// Resume unpauses the request, sending the given extensions with the unpause
+	Resume(extensions ...ExtensionData) error
+
+	// Cancel cancels the request, as cancelling its context would
+	Cancel()
+}
+
 // RequestData describes a received graphsync request.
 type RequestData interface {
 	// ID Returns the request ID for this Request
@@ -194,59 +522,342 @@ type BlockData interface {
 	// BlockSize specifies the size of the block
 	BlockSize() uint64
 
-	// BlockSize specifies the amount of data actually transmitted over the network
+	// BlockSizeOnWire specifies the amount of data actually transmitted over the
+	// network, which is zero when the block is deduplicated
 	BlockSizeOnWire() uint64
+
+	// Cid is the CID of the block, or cid.Undef if the link is not a CID link
+	Cid() cid.Cid
+
+	// Index is the position of the block among all links traversed by the
+	// request, starting at zero
+	Index() int64
+
+	// Deduplicated is true if the block was present but not transmitted over the
+	// network because the receiving side already had it, or it was already sent
+	// for another request
+	Deduplicated() bool
+}
+
+// StoreTransaction stages the blocks written for a single outgoing request,
+// so they can be kept or discarded together once the request finishes
+type StoreTransaction interface {
+	// Loader loads blocks already in the store and blocks staged in the
+	// transaction
+	Loader() ipld.Loader
+	// Storer stages blocks in the transaction
+	Storer() ipld.Storer
+	// Commit writes the staged blocks to the store
+	Commit() error
+	// Rollback discards the staged blocks
+	Rollback() error
+}
+
+type persistenceOptionKey struct{}
+
+// WithPersistenceOption returns a context that makes requests started with it
+// load and store blocks with the named persistence option, unless an outgoing
+// request hook chooses another. It lets middleware route fetches to stores
+// without threading state through hooks
+func WithPersistenceOption(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, persistenceOptionKey{}, name)
+}
+
+// PersistenceOptionFromContext returns the persistence option set on the
+// context with WithPersistenceOption, if any
+func PersistenceOptionFromContext(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(persistenceOptionKey{}).(string)
+	return name, ok
+}
+
+type requestPriorityKey struct{}
+
+// WithRequestPriority returns a context that makes requests started with it
+// send the given priority in place of the exchange's default request priority
+func WithRequestPriority(ctx context.Context, priority Priority) context.Context {
+	return context.WithValue(ctx, requestPriorityKey{}, priority)
+}
+
+// RequestPriorityFromContext returns the request priority set on the context
+// with WithRequestPriority, if any
+func RequestPriorityFromContext(ctx context.Context) (Priority, bool) {
+	priority, ok := ctx.Value(requestPriorityKey{}).(Priority)
+	return priority, ok
+}
+
+// PersistenceOptionUsage describes a registered persistence option and how
+// outgoing requests are using it
+type PersistenceOptionUsage struct {
+	// Name is the name the option was registered with
+	Name string
+	// Transactional is whether writes are staged in a transaction per request
+	Transactional bool
+	// ActiveRequests is the number of outgoing requests currently using the option
+	ActiveRequests int
+	// BytesWritten is the size of all blocks written to the option's store,
+	// including those written when it is a fallback. For transactional options
+	// it includes blocks staged in transactions that were rolled back
+	BytesWritten uint64
+	// Quota is the most bytes that can be written to the option, or 0 if there
+	// is no limit
+	Quota uint64
+}
+
+// NewStoreTransaction begins a transaction for the given request
+type NewStoreTransaction func(RequestID) (StoreTransaction, error)
+
+// BlockProvenance records which peer and request delivered a block that was
+// written to the store
+type BlockProvenance struct {
+	Link      ipld.Link
+	Peer      peer.ID
+	RequestID RequestID
+	Stored    time.Time
+}
+
+// ProvenanceSink receives the provenance of each block received from the
+// network and written to the store, so the source of bad data can be traced
+// later. RecordProvenance is called as blocks are stored, so it should return
+// quickly
+type ProvenanceSink interface {
+	RecordProvenance(BlockProvenance) error
+}
+
+// StoreFactory opens the store for a persistence option registered with
+// RegisterPersistenceOptionFactory. The closer, if not nil, is called when the
+// store is idle or the option is unregistered
+type StoreFactory func() (ipld.Loader, ipld.Storer, io.Closer, error)
+
+// HookContext gives a hook the context of the request or response it runs
+// for. The context is cancelled when the request or response finishes, so
+// hooks doing I/O can stop early rather than hold up processing
+type HookContext interface {
+	Context() context.Context
 }
 
 // IncomingRequestHookActions are actions that a request hook can take to change
 // behavior for the response
 type IncomingRequestHookActions interface {
+	HookContext
+	// SetContextValue attaches a value to the context of the response, for
+	// this and later hooks for the response to read from Context()
+	SetContextValue(key, value interface{})
 	SendExtensionData(ExtensionData)
+	// SendExtensionDataPeriodically sends extension data made by the given
+	// function while the response runs: after every `blocks` blocks if blocks
+	// is non-zero, and every `interval` if interval is non-zero. The function
+	// is passed the number of blocks traversed so far, for protocols such as
+	// heartbeats or payment checkpoints
+	SendExtensionDataPeriodically(blocks uint64, interval time.Duration, data func(blocksTraversed uint64) ExtensionData)
 	UsePersistenceOption(name string)
 	UseLinkTargetNodePrototypeChooser(traversal.LinkTargetNodePrototypeChooser)
+	// UseNodeReifier reifies nodes loaded while executing the response with the
+	// given reifier. The requestor must reify with the same ADLs to verify the
+	// response
+	UseNodeReifier(NodeReifier)
+	// UseRoot runs the response from the given root in place of the one the
+	// requestor sent. The requestor is told of the new root with an
+	// ExtensionRootRedirect extension on the response. Requests that don't
+	// carry ExtensionRootRedirect can't follow the redirect, and fail instead
+	UseRoot(root cid.Cid)
+	// UseSelector runs the response with the given selector in place of the
+	// one the requestor sent, for example to limit recursion or skip fields.
+	// A selector that doesn't parse, or that the default selector validator
+	// rejects, terminates the response. The requestor is told of the new
+	// selector with an ExtensionSelectorNarrowed extension, and the response
+	// completes with RequestCompletedPartial
+	UseSelector(selector ipld.Node)
+	// LimitSendRate paces the response to at most bytesPerSecond, sent in
+	// bursts of at most a pacing interval's worth of data, so responses can be
+	// given different qualities of service. A zero pacing uses a default of
+	// 100ms
+	LimitSendRate(bytesPerSecond uint64, pacing time.Duration)
+	// TerminateWithError fails the response. Hooks after this one don't run,
+	// unless registered with RunAfterTermination
 	TerminateWithError(error)
+	// ValidateRequest accepts the request. Hooks after this one still run and
+	// can terminate the response, unless this hook was registered with
+	// StopAfterValidation
 	ValidateRequest()
+	// ValidateAndContinue accepts the request and always lets hooks after this
+	// one run, even if this hook was registered with StopAfterValidation
+	ValidateAndContinue()
 	PauseResponse()
 }
 
 // OutgoingBlockHookActions are actions that an outgoing block hook can take to
 // change the execution of a request
 type OutgoingBlockHookActions interface {
+	HookContext
 	SendExtensionData(ExtensionData)
 	TerminateWithError(error)
 	PauseResponse()
+	// SkipBlock omits the block from the response, marking it not present in
+	// the response metadata, without failing the response. The traversal does
+	// not descend into the links of a skipped block, and block sent listeners
+	// see it as not sent
+	SkipBlock()
 }
 
 // OutgoingRequestHookActions are actions that an outgoing request hook can take
 // to change the execution of a request
 type OutgoingRequestHookActions interface {
+	HookContext
+	// SetContextValue attaches a value to the context of the request, for
+	// this and later hooks for the request to read from Context()
+	SetContextValue(key, value interface{})
 	UsePersistenceOption(name string)
 	UseLinkTargetNodePrototypeChooser(traversal.LinkTargetNodePrototypeChooser)
+	// UseNodeReifier reifies nodes loaded while verifying the response with
+	// the given reifier. The responder must reify with the same ADLs
+	UseNodeReifier(NodeReifier)
+	UseStoreWriteFailurePolicy(policy StoreWriteFailurePolicy)
+	UseFallbackPersistenceOption(name string)
+	// UseWritePersistenceOption writes blocks received for the request with the
+	// named persistence option, while links are still loaded from the option set
+	// with UsePersistenceOption, or the default loader
+	UseWritePersistenceOption(name string)
+	// UsePeer sends the request to the given peer in place of the one it was
+	// made for, for example to pick a peer from a routing table. The peer's
+	// addresses must already be known to the host
+	UsePeer(p peer.ID)
 }
 
 // IncomingResponseHookActions are actions that incoming response hook can take
 // to change the execution of a request
 type IncomingResponseHookActions interface {
+	HookContext
 	TerminateWithError(error)
 	UpdateRequestWithExtensions(...ExtensionData)
+	// PauseRequest pauses the request, for example when the responder asks for
+	// payment in extension data. It is resumed with UnpauseRequest
+	PauseRequest()
 }
 
 // IncomingBlockHookActions are actions that incoming block hook can take
 // to change the execution of a request
 type IncomingBlockHookActions interface {
+	HookContext
 	TerminateWithError(error)
 	UpdateRequestWithExtensions(...ExtensionData)
 	PauseRequest()
 }
 
+// BlockStoreHookActions are actions a block store hook can take before a
+// verified block is written to the store
+type BlockStoreHookActions interface {
+	// RejectBlock keeps the block from being stored, and fails the load of its
+	// link with a BlockRejectedErr wrapping the given error
+	RejectBlock(error)
+}
+
 // RequestUpdatedHookActions are actions that can be taken in a request updated hook to
 // change execution of the response
 type RequestUpdatedHookActions interface {
+	HookContext
 	TerminateWithError(error)
 	SendExtensionData(ExtensionData)
 	UnpauseResponse()
 }
 
+// HookConfig is the configuration a hook is registered with
+type HookConfig struct {
+	// Priority orders hooks of the same kind. Hooks with a higher priority run
+	// first, and hooks with the same priority run in the order they were
+	// registered
+	Priority int
+	// Peers limits the hook to events for the given peers. A hook with no
+	// peers runs for every peer
+	Peers []peer.ID
+	// RunAfterTermination runs the hook even when a hook before it in the chain
+	// terminated with an error. The event still fails with the first error
+	RunAfterTermination bool
+	// StopAfterValidation stops hooks after this one in the chain from running
+	// when this hook calls ValidateRequest. It only applies to incoming request
+	// hooks
+	StopAfterValidation bool
+}
+
+// HookOption configures how a hook is registered
+type HookOption func(*HookConfig)
+
+// HookKind is a kind of hook, named for the Register method it is registered
+// with
+type HookKind string
+
+const (
+	// HookKindIncomingRequest is a hook registered with RegisterIncomingRequestHook
+	HookKindIncomingRequest = HookKind("IncomingRequest")
+	// HookKindIncomingResponse is a hook registered with RegisterIncomingResponseHook
+	HookKindIncomingResponse = HookKind("IncomingResponse")
+	// HookKindIncomingBlock is a hook registered with RegisterIncomingBlockHook
+	HookKindIncomingBlock = HookKind("IncomingBlock")
+	// HookKindBlockStore is a hook registered with RegisterBlockStoreHook
+	HookKindBlockStore = HookKind("BlockStore")
+	// HookKindOutgoingRequest is a hook registered with RegisterOutgoingRequestHook
+	HookKindOutgoingRequest = HookKind("OutgoingRequest")
+	// HookKindOutgoingBlock is a hook registered with RegisterOutgoingBlockHook
+	HookKindOutgoingBlock = HookKind("OutgoingBlock")
+	// HookKindRequestUpdated is a hook registered with RegisterRequestUpdatedHook
+	HookKindRequestUpdated = HookKind("RequestUpdated")
+)
+
+// HookInfo describes a registered hook, so the hooks a node runs can be
+// inspected at runtime
+type HookInfo struct {
+	Kind HookKind
+	// ID identifies the hook among hooks of its kind. IDs increase in the order
+	// hooks are registered
+	ID uint64
+	// Name is the name of the hook's function, as reported by the runtime
+	Name   string
+	Config HookConfig
+}
+
+// WithPriority sets the priority a hook runs with, so hooks registered by
+// independent subsystems run in a deterministic order. The default priority
+// is 0
+func WithPriority(priority int) HookOption {
+	return func(hc *HookConfig) {
+		hc.Priority = priority
+	}
+}
+
+// ForPeer limits a hook to events for the given peer, so it doesn't need to
+// filter by peer itself. It can be given more than once to run the hook for
+// several peers
+func ForPeer(p peer.ID) HookOption {
+	return func(hc *HookConfig) {
+		hc.Peers = append(hc.Peers, p)
+	}
+}
+
+// RunAfterTermination runs a hook even when a hook before it terminated with
+// an error, for hooks such as audit logs that must see every event. By default
+// a hook that terminates stops all hooks after it
+func RunAfterTermination() HookOption {
+	return func(hc *HookConfig) {
+		hc.RunAfterTermination = true
+	}
+}
+
+// StopAfterValidation makes an incoming request hook that validates a request
+// with ValidateRequest the last one to run for it, so validators later in the
+// chain can't reject a request it accepted. By default hooks after a validator
+// still run, and any of them can terminate the response
+func StopAfterValidation() HookOption {
+	return func(hc *HookConfig) {
+		hc.StopAfterValidation = true
+	}
+}
+
+// NodeReifier turns a node loaded during a traversal into an Advanced Data
+// Layout, such as a HAMT sharded directory, so selectors address the logical
+// structure rather than raw shards. It returns the substrate node unchanged
+// if it is not the root of an ADL. Loads the ADL makes with loader are part of
+// the traversal, so its blocks are sent and verified like any others
+type NodeReifier func(lnkCtx ipld.LinkContext, substrate ipld.Node, loader ipld.Loader) (ipld.Node, error)
+
 // OnIncomingRequestHook is a hook that runs each time a new request is received.
 // It receives the peer that sent the request and all data about the request.
 // It receives an interface for customizing the response to this request
@@ -259,13 +870,21 @@ type OnIncomingResponseHook func(p peer.ID, responseData ResponseData, hookActio
 
 // OnIncomingBlockHook is a hook that runs each time a new block is validated as
 // part of the response, regardless of whether it came locally or over the network
-// It receives that sent the response, the most recent response, a link for the block received,
+// It receives the peer that sent the response, the most recent response, a link for the block received,
 // and the size of the block received
-// The difference between BlockSize & BlockSizeOnWire can be used to determine
-// where the block came from (Local vs remote)
+// Blocks loaded from the local store have a BlockSizeOnWire of zero and are
+// Deduplicated, so the hook can tell where each block came from (Local vs remote),
+// e.g. to pay only for blocks received over the network
 // It receives an interface for customizing how we handle the ongoing execution of the request
 type OnIncomingBlockHook func(p peer.ID, responseData ResponseData, blockData BlockData, hookActions IncomingBlockHookActions)
 
+// OnBlockStoreHook is a hook that runs each time a block received from the
+// network is verified as part of a request, before it is written to the store.
+// It receives the peer that sent the block, the request it was verified for,
+// and the block's link and data
+// It receives an interface for rejecting the block
+type OnBlockStoreHook func(p peer.ID, requestID RequestID, link ipld.Link, data []byte, hookActions BlockStoreHookActions)
+
 // OnOutgoingRequestHook is a hook that runs immediately prior to sending a request
 // It receives the peer we're sending a request to and all the data aobut the request
 // It receives an interface for customizing how we handle executing this request
@@ -278,23 +897,121 @@ type OnOutgoingRequestHook func(p peer.ID, request RequestData, hookActions Outg
 // It receives an interface for taking further action on the response
 type OnOutgoingBlockHook func(p peer.ID, request RequestData, block BlockData, hookActions OutgoingBlockHookActions)
 
-// OnRequestUpdatedHook is a hook that runs when an update to a request is received
-// It receives the peer we're sending to, the original request, the request update
-// It receives an interface to taking further action on the response
+// OnRequestUpdatedHook is a hook that runs when an update to an in progress
+// request is received, whether the response is running or paused.
+// It receives the peer we're sending to, the original request, and the update
+// with its new extensions.
+// It receives an interface to take further action on the response -- unpause
+// it, send extension data back, or terminate it with an error
 type OnRequestUpdatedHook func(p peer.ID, request RequestData, updateRequest RequestData, hookActions RequestUpdatedHookActions)
 
 // OnBlockSentListener runs when a block is sent over the wire
 type OnBlockSentListener func(p peer.ID, request RequestData, block BlockData)
 
+// OnBlocksSentListener runs once for each message sent over the wire, with all
+// of the blocks for the given request that were included in the message
+type OnBlocksSentListener func(p peer.ID, request RequestData, blocks []BlockData)
+
+// OnOutgoingRequestSentListener runs when a request -- or an update or
+// cancellation of one -- is written to the network. The request has the final
+// set of extensions, after all outgoing request hooks ran
+type OnOutgoingRequestSentListener func(p peer.ID, request RequestData)
+
+// OnReceiverErrorListener runs when a message from a peer can't be read or
+// decoded, or is rejected for violating the protocol. The message is dropped
+type OnReceiverErrorListener func(p peer.ID, err error)
+
 // OnNetworkErrorListener runs when queued data is not able to be sent
 type OnNetworkErrorListener func(p peer.ID, request RequestData, err error)
 
+// OnPeerMisbehavingListener runs when a peer sends data that violates the
+// protocol, such as a block that does not match its CID, so callers can
+// disconnect from or ban the peer
+type OnPeerMisbehavingListener func(p peer.ID, err error)
+
 // OnResponseCompletedListener provides a way to listen for when responder has finished serving a response
 type OnResponseCompletedListener func(p peer.ID, request RequestData, status ResponseStatusCode)
 
+// RequestStats are counts for the blocks an outgoing request loaded
+type RequestStats struct {
+	// Blocks is the number of blocks loaded for the request
+	Blocks uint64
+	// BlockBytes is the total size of the blocks loaded for the request
+	BlockBytes uint64
+	// BytesOnWire is the total size of the blocks received over the network,
+	// excluding blocks that were already stored locally
+	BytesOnWire uint64
+}
+
+// OnRequestCompletedListener provides a way to listen for when an outgoing
+// request finishes, for any reason. It runs once per request with the last
+// status the responder sent, the error the request ended with, if any, and
+// stats for the request
+type OnRequestCompletedListener func(p peer.ID, request RequestData, status ResponseStatusCode, err error, stats RequestStats)
+
+// OnHookPanicListener runs when a hook panics. The request or response the
+// hook ran for fails with err
+type OnHookPanicListener func(p peer.ID, err HookPanicErr)
+
 // OnRequestorCancelledListener provides a way to listen for responses the requestor canncels
 type OnRequestorCancelledListener func(p peer.ID, request RequestData)
 
+// EventKind identifies what happened to a request in an Event
+type EventKind int
+
+const (
+	// EventRequestQueued means a request was made by this node, or received
+	// from a peer, and waits to be processed
+	EventRequestQueued = EventKind(iota)
+	// EventRequestStarted means a request was sent to the responder, or a
+	// response to it began
+	EventRequestStarted
+	// EventBlockSent means a block was sent in response to a request
+	EventBlockSent
+	// EventBlockReceived means a block was received for a request
+	EventBlockReceived
+	// EventRequestPaused means a request or response was paused
+	EventRequestPaused
+	// EventRequestCompleted means a request or response finished successfully
+	EventRequestCompleted
+	// EventRequestErrored means a request or response terminated in failure
+	// or was cancelled
+	EventRequestErrored
+	// EventNetworkError means sending a message or receiving one from a peer
+	// failed
+	EventNetworkError
+)
+
+// EventDirection tells which side of a request an Event comes from
+type EventDirection int
+
+const (
+	// Outgoing events concern requests this node made
+	Outgoing = EventDirection(iota)
+	// Incoming events concern requests this node is responding to
+	Incoming
+)
+
+// Event is something that happened to a request on either side, delivered to
+// subscribers of a GraphExchange
+type Event struct {
+	Kind EventKind
+	// Direction is meaningless for network errors, which may concern either
+	// side
+	Direction EventDirection
+	Peer      peer.ID
+	// RequestID is NoRequestID when the event concerns no particular request
+	RequestID RequestID
+	// Request is the request the event concerns, when known
+	Request RequestData
+	// Block is the block sent or received, for block events
+	Block BlockData
+	// Status is the final status of a completed or errored request, when known
+	Status ResponseStatusCode
+	// Err is the error for errored requests and network errors, when known
+	Err error
+}
+
 // UnregisterHookFunc is a function call to unregister a hook that was previously registered
 type UnregisterHookFunc func()
 
@@ -303,33 +1020,92 @@ type GraphExchange interface {
 	// Request initiates a new GraphSync request to the given peer using the given selector spec.
 	Request(ctx context.Context, p peer.ID, root ipld.Link, selector ipld.Node, extensions ...ExtensionData) (<-chan ResponseProgress, <-chan error)
 
+	// StartRequest initiates a new GraphSync request like Request, returning a
+	// handle with the request's ID and methods to pause, resume and cancel it
+	StartRequest(ctx context.Context, p peer.ID, root ipld.Link, selector ipld.Node, extensions ...ExtensionData) RequestHandle
+
+	// FetchToStore makes a request like Request, writing the blocks it receives
+	// with the given storer, and blocks until it finishes. The loader must read
+	// from the same store. It returns stats for the request, and the first
+	// error the request ended with, if any
+	FetchToStore(ctx context.Context, p peer.ID, root ipld.Link, selector ipld.Node, loader ipld.Loader, storer ipld.Storer, extensions ...ExtensionData) (RequestStats, error)
+
+	// FetchDAG makes a request like Request, building nodes with the given
+	// chooser, and blocks until it finishes. It returns the root node of the
+	// request, backed by the fetched blocks, or the first error the request
+	// ended with
+	FetchDAG(ctx context.Context, p peer.ID, root ipld.Link, selector ipld.Node, chooser traversal.LinkTargetNodePrototypeChooser, extensions ...ExtensionData) (ipld.Node, error)
+
+	// RequestWithAddrs initiates a new GraphSync request like Request, dialing
+	// the peer on the given addresses so it can be reached without adding them
+	// to the peerstore beforehand
+	RequestWithAddrs(ctx context.Context, p peer.AddrInfo, root ipld.Link, selector ipld.Node, extensions ...ExtensionData) (<-chan ResponseProgress, <-chan error)
+
+	// ReplaceDefaultStore swaps the default loader/storer combo used when no persistence option is chosen.
+	// Requests and responses already in progress keep using the previous one
+	ReplaceDefaultStore(loader ipld.Loader, storer ipld.Storer) error
+
 	// RegisterPersistenceOption registers an alternate loader/storer combo that can be substituted for the default
 	RegisterPersistenceOption(name string, loader ipld.Loader, storer ipld.Storer) error
 
 	// UnregisterPersistenceOption unregisters an alternate loader/storer combo
 	UnregisterPersistenceOption(name string) error
 
+	// RegisterTransactionalPersistenceOption registers a persistence option whose
+	// writes for each outgoing request are staged in a transaction, committed
+	// only if the request completes successfully. The loader serves the option
+	// for incoming requests
+	RegisterTransactionalPersistenceOption(name string, loader ipld.Loader, newTransaction NewStoreTransaction) error
+
+	// RegisterPersistenceOptionFactory registers a persistence option whose
+	// store is opened with the factory when first used, and closed again after
+	// idleTimeout without use
+	RegisterPersistenceOptionFactory(name string, factory StoreFactory, idleTimeout time.Duration) error
+
+	// ListPersistenceOptions returns the registered persistence options, sorted
+	// by name, with usage by outgoing requests
+	ListPersistenceOptions() []PersistenceOptionUsage
+
+	// SetPersistenceOptionQuota limits the bytes outgoing requests can write to
+	// a persistence option. Once reached, writes fail with a StoreFullErr. A
+	// quota of 0 removes the limit
+	SetPersistenceOptionQuota(name string, maxBytes uint64) error
+
 	// RegisterIncomingRequestHook adds a hook that runs when a request is received
-	RegisterIncomingRequestHook(hook OnIncomingRequestHook) UnregisterHookFunc
+	RegisterIncomingRequestHook(hook OnIncomingRequestHook, options ...HookOption) UnregisterHookFunc
 
 	// RegisterIncomingResponseHook adds a hook that runs when a response is received
-	RegisterIncomingResponseHook(OnIncomingResponseHook) UnregisterHookFunc
+	RegisterIncomingResponseHook(hook OnIncomingResponseHook, options ...HookOption) UnregisterHookFunc
 
 	// RegisterIncomingBlockHook adds a hook that runs when a block is received and validated (put in block store)
-	RegisterIncomingBlockHook(OnIncomingBlockHook) UnregisterHookFunc
+	RegisterIncomingBlockHook(hook OnIncomingBlockHook, options ...HookOption) UnregisterHookFunc
+
+	// RegisterBlockStoreHook adds a hook that runs when a block received from the network is verified,
+	// before it is written to the store
+	RegisterBlockStoreHook(hook OnBlockStoreHook, options ...HookOption) UnregisterHookFunc
 
 	// RegisterOutgoingRequestHook adds a hook that runs immediately prior to sending a new request
-	RegisterOutgoingRequestHook(hook OnOutgoingRequestHook) UnregisterHookFunc
+	RegisterOutgoingRequestHook(hook OnOutgoingRequestHook, options ...HookOption) UnregisterHookFunc
 
 	// RegisterOutgoingBlockHook adds a hook that runs every time a block is sent from a responder
-	RegisterOutgoingBlockHook(hook OnOutgoingBlockHook) UnregisterHookFunc
+	RegisterOutgoingBlockHook(hook OnOutgoingBlockHook, options ...HookOption) UnregisterHookFunc
 
 	// RegisterRequestUpdatedHook adds a hook that runs every time an update to a request is received
-	RegisterRequestUpdatedHook(hook OnRequestUpdatedHook) UnregisterHookFunc
+	RegisterRequestUpdatedHook(hook OnRequestUpdatedHook, options ...HookOption) UnregisterHookFunc
+
+	// RegisteredHooks lists the hooks currently registered, grouped by kind
+	// and in the order hooks of each kind run
+	RegisteredHooks() []HookInfo
 
 	// RegisterCompletedResponseListener adds a listener on the responder for completed responses
 	RegisterCompletedResponseListener(listener OnResponseCompletedListener) UnregisterHookFunc
 
+	// RegisterCompletedRequestListener adds a listener on the requestor for completed requests
+	RegisterCompletedRequestListener(listener OnRequestCompletedListener) UnregisterHookFunc
+
+	// RegisterHookPanicListener adds a listener for hooks that panic
+	RegisterHookPanicListener(listener OnHookPanicListener) UnregisterHookFunc
+
 	// RegisterRequestorCancelledListener adds a listener on the responder for
 	// responses cancelled by the requestor
 	RegisterRequestorCancelledListener(listener OnRequestorCancelledListener) UnregisterHookFunc
@@ -337,9 +1113,41 @@ type GraphExchange interface {
 	// RegisterBlockSentListener adds a listener for when blocks are actually sent over the wire
 	RegisterBlockSentListener(listener OnBlockSentListener) UnregisterHookFunc
 
+	// RegisterBlocksSentListener adds a listener that receives all blocks for a request
+	// sent in a single message at once, rather than being called for each block
+	RegisterBlocksSentListener(listener OnBlocksSentListener) UnregisterHookFunc
+
+	// RegisterReceiverErrorListener adds a listener for when messages from peers can't be decoded or are rejected
+	RegisterReceiverErrorListener(listener OnReceiverErrorListener) UnregisterHookFunc
+
+	// RegisterOutgoingRequestSentListener adds a listener for when requests are written to the network
+	RegisterOutgoingRequestSentListener(listener OnOutgoingRequestSentListener) UnregisterHookFunc
+
 	// RegisterNetworkErrorListener adds a listener for when errors occur sending data over the wire
 	RegisterNetworkErrorListener(listener OnNetworkErrorListener) UnregisterHookFunc
 
+	// RegisterPeerMisbehavingListener adds a listener for when a peer sends data
+	// that violates the protocol
+	RegisterPeerMisbehavingListener(listener OnPeerMisbehavingListener) UnregisterHookFunc
+
+	// ProtocolVersion returns the graphsync protocol negotiated with the given
+	// peer, so hooks can adjust which extensions they attach. It returns false
+	// if no protocol has been negotiated with the peer while connected
+	ProtocolVersion(p peer.ID) (protocol.ID, bool)
+
+	// SupportedExtensions returns the extensions the given peer advertised it
+	// handles, so hooks can avoid attaching extensions it would ignore. It
+	// returns false if the peer has not advertised its extensions while
+	// connected, as is always the case for peers on the v1 protocol
+	SupportedExtensions(p peer.ID) ([]ExtensionName, bool)
+
+	// IsRelayed returns true if the given peer is only connected through a
+	// relay, as happens when it could not be dialed directly. Bandwidth
+	// sensitive callers can check it, for instance from an incoming response
+	// hook, and cancel transfers they do not want to run over a relay. Whether
+	// each transfer started over a relay is kept on its EffectiveConfig
+	IsRelayed(p peer.ID) bool
+
 	// UnpauseRequest unpauses a request that was paused in a block hook based request ID
 	// Can also send extensions with unpause
 	UnpauseRequest(RequestID, ...ExtensionData) error
@@ -356,4 +1164,33 @@ type GraphExchange interface {
 
 	// CancelResponse cancels an in progress response
 	CancelResponse(peer.ID, RequestID) error
+
+	// PendingRequests returns information about the outgoing requests in
+	// progress, sorted by ID
+	PendingRequests() []RequestInfo
+
+	// RequestInfo returns information about an outgoing request in progress
+	RequestInfo(RequestID) (RequestInfo, bool)
+
+	// RequestConfig returns the effective configuration of a recent outgoing request
+	RequestConfig(RequestID) (EffectiveConfig, bool)
+
+	// ResponseConfig returns the effective configuration of a recent response to a peer
+	ResponseConfig(peer.ID, RequestID) (EffectiveConfig, bool)
+
+	// CancelResponsesToPeer cancels all queued and in progress responses to a peer
+	CancelResponsesToPeer(peer.ID) error
+
+	// Stats returns running totals for requests, blocks and bytes in both
+	// directions, and the memory currently held in queues
+	Stats() Stats
+
+	// Close stops accepting new requests, waits a grace period for requests
+	// and responses in progress to finish, then shuts down
+	Close() error
+
+	// Subscribe returns a channel of events for requests on both sides, which
+	// closes when the context is cancelled or the exchange shuts down. Events
+	// are dropped for subscribers that fall too far behind
+	Subscribe(ctx context.Context) <-chan Event
 }
@@ -0,0 +1,198 @@
+package hookset
+
+import (
+	"errors"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+)
+
+// ErrStop is returned by a dispatcher to stop an event from reaching hooks
+// that run later, without failing the event
+var ErrStop = errors.New("stop running hooks")
+
+// Dispatcher calls a single hook with an event, given the config the hook was
+// registered with. Returning an error stops the event from reaching hooks that
+// run later, except those registered to run after termination
+type Dispatcher func(event interface{}, hook interface{}, config graphsync.HookConfig) error
+
+// PanicListener is called when a hook panics, with the peer the hook ran for
+// and the error the panic was converted to
+type PanicListener func(p peer.ID, err graphsync.HookPanicErr)
+
+// Metrics receives measurements of hooks as they run, so slow hooks that
+// stall processing can be found
+type Metrics interface {
+	// HookRan records that a hook of the given kind, identified by the name of
+	// its function, ran once and took the given time
+	HookRan(kind graphsync.HookKind, name string, duration time.Duration)
+}
+
+type registeredHook struct {
+	id     uint64
+	name   string
+	hook   interface{}
+	config graphsync.HookConfig
+}
+
+// HookSet is a set of hooks of one kind that run in a deterministic order:
+// highest priority first, then in the order they were registered
+type HookSet struct {
+	dispatcher Dispatcher
+
+	lk            sync.RWMutex
+	nextID        uint64
+	hooks         []registeredHook
+	panicListener PanicListener
+	metrics       Metrics
+	metricsKind   graphsync.HookKind
+}
+
+// New returns a new, empty HookSet that calls hooks with the given dispatcher
+func New(dispatcher Dispatcher) *HookSet {
+	return &HookSet{dispatcher: dispatcher}
+}
+
+// Register adds a hook to the set, configured by the given options
+func (hs *HookSet) Register(hook interface{}, options ...graphsync.HookOption) graphsync.UnregisterHookFunc {
+	var config graphsync.HookConfig
+	for _, option := range options {
+		option(&config)
+	}
+	hs.lk.Lock()
+	id := hs.nextID
+	hs.nextID++
+	hooks := append(hs.hooks[:len(hs.hooks):len(hs.hooks)], registeredHook{id, hookName(hook), hook, config})
+	sort.SliceStable(hooks, func(i, j int) bool {
+		return hooks[i].config.Priority > hooks[j].config.Priority
+	})
+	hs.hooks = hooks
+	hs.lk.Unlock()
+	return func() {
+		hs.unregister(id)
+	}
+}
+
+// Hooks describes the hooks in the set in the order they run, as hooks of the
+// given kind
+func (hs *HookSet) Hooks(kind graphsync.HookKind) []graphsync.HookInfo {
+	hs.lk.RLock()
+	hooks := hs.hooks
+	hs.lk.RUnlock()
+	infos := make([]graphsync.HookInfo, 0, len(hooks))
+	for _, rh := range hooks {
+		config := rh.config
+		config.Peers = append([]peer.ID(nil), config.Peers...)
+		infos = append(infos, graphsync.HookInfo{Kind: kind, ID: rh.id, Name: rh.name, Config: config})
+	}
+	return infos
+}
+
+// UseMetrics reports each hook that runs to the given metrics, as a hook of
+// the given kind
+func (hs *HookSet) UseMetrics(kind graphsync.HookKind, metrics Metrics) {
+	hs.lk.Lock()
+	hs.metrics = metrics
+	hs.metricsKind = kind
+	hs.lk.Unlock()
+}
+
+// OnPanic sets a listener that is told about hooks that panic
+func (hs *HookSet) OnPanic(listener PanicListener) {
+	hs.lk.Lock()
+	hs.panicListener = listener
+	hs.lk.Unlock()
+}
+
+func (hs *HookSet) unregister(id uint64) {
+	hs.lk.Lock()
+	defer hs.lk.Unlock()
+	hooks := make([]registeredHook, 0, len(hs.hooks))
+	for _, rh := range hs.hooks {
+		if rh.id != id {
+			hooks = append(hooks, rh)
+		}
+	}
+	hs.hooks = hooks
+}
+
+// runsFor returns true if the hook was registered for events from the given
+// peer
+func (rh registeredHook) runsFor(p peer.ID) bool {
+	if len(rh.config.Peers) == 0 {
+		return true
+	}
+	for _, hookPeer := range rh.config.Peers {
+		if hookPeer == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Publish calls each hook for the given peer in order with the event. Once a
+// hook's dispatch returns an error, only hooks registered with
+// RunAfterTermination still run, and the first error is returned. A hook that
+// panics terminates the event the same way, with a graphsync.HookPanicErr. A
+// dispatch that returns ErrStop stops later hooks without an error
+func (hs *HookSet) Publish(p peer.ID, event interface{}) error {
+	hs.lk.RLock()
+	hooks := hs.hooks
+	panicListener := hs.panicListener
+	metrics := hs.metrics
+	metricsKind := hs.metricsKind
+	hs.lk.RUnlock()
+	var terminateErr error
+	for _, rh := range hooks {
+		if !rh.runsFor(p) {
+			continue
+		}
+		if terminateErr != nil && !rh.config.RunAfterTermination {
+			continue
+		}
+		start := time.Now()
+		err := hs.dispatch(p, event, rh, panicListener)
+		if metrics != nil {
+			metrics.HookRan(metricsKind, rh.name, time.Since(start))
+		}
+		if terminateErr != nil {
+			continue
+		}
+		if err == ErrStop {
+			return nil
+		}
+		terminateErr = err
+	}
+	return terminateErr
+}
+
+func (hs *HookSet) dispatch(p peer.ID, event interface{}, rh registeredHook, panicListener PanicListener) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicErr := graphsync.HookPanicErr{Hook: rh.name, Value: r}
+			if panicListener != nil {
+				panicListener(p, panicErr)
+			}
+			err = panicErr
+		}
+	}()
+	return hs.dispatcher(event, rh.hook, rh.config)
+}
+
+// hookName names a hook by its function, so a panic can be traced to it
+func hookName(hook interface{}) string {
+	value := reflect.ValueOf(hook)
+	if value.Kind() != reflect.Func {
+		return value.Type().String()
+	}
+	if fn := runtime.FuncForPC(value.Pointer()); fn != nil {
+		return fn.Name()
+	}
+	return value.Type().String()
+}
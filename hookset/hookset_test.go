@@ -0,0 +1,172 @@
+package hookset_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/hookset"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+type testHook func(calls *[]string) error
+
+func dispatch(event interface{}, hook interface{}, _ graphsync.HookConfig) error {
+	return hook.(testHook)(event.(*[]string))
+}
+
+func named(name string) testHook {
+	return func(calls *[]string) error {
+		*calls = append(*calls, name)
+		return nil
+	}
+}
+
+func TestHookSetOrdering(t *testing.T) {
+	hs := hookset.New(dispatch)
+	hs.Register(named("default a"))
+	hs.Register(named("low"), graphsync.WithPriority(-10))
+	unregister := hs.Register(named("removed"), graphsync.WithPriority(100))
+	hs.Register(named("high"), graphsync.WithPriority(10))
+	hs.Register(named("default b"))
+	unregister()
+
+	var calls []string
+	require.NoError(t, hs.Publish(testutil.GeneratePeers(1)[0], &calls))
+	require.Equal(t, []string{"high", "default a", "default b", "low"}, calls)
+}
+
+func TestHookSetShortCircuit(t *testing.T) {
+	hs := hookset.New(dispatch)
+	hs.Register(named("first"), graphsync.WithPriority(1))
+	hs.Register(func(calls *[]string) error {
+		return errors.New("stop")
+	})
+	hs.Register(named("never"), graphsync.WithPriority(-1))
+
+	var calls []string
+	require.EqualError(t, hs.Publish(testutil.GeneratePeers(1)[0], &calls), "stop")
+	require.Equal(t, []string{"first"}, calls)
+}
+
+func TestHookSetRunAfterTermination(t *testing.T) {
+	hs := hookset.New(dispatch)
+	hs.Register(func(calls *[]string) error {
+		return errors.New("stop")
+	}, graphsync.WithPriority(1))
+	hs.Register(named("skipped"))
+	hs.Register(named("audit"), graphsync.RunAfterTermination())
+
+	var calls []string
+	require.EqualError(t, hs.Publish(testutil.GeneratePeers(1)[0], &calls), "stop")
+	require.Equal(t, []string{"audit"}, calls)
+}
+
+func TestHookSetStop(t *testing.T) {
+	hs := hookset.New(dispatch)
+	hs.Register(func(calls *[]string) error {
+		*calls = append(*calls, "first")
+		return hookset.ErrStop
+	}, graphsync.WithPriority(1))
+	hs.Register(named("never"))
+
+	var calls []string
+	require.NoError(t, hs.Publish(testutil.GeneratePeers(1)[0], &calls))
+	require.Equal(t, []string{"first"}, calls)
+}
+
+func TestHookSetPanic(t *testing.T) {
+	p := testutil.GeneratePeers(1)[0]
+	hs := hookset.New(dispatch)
+	var panics []graphsync.HookPanicErr
+	hs.OnPanic(func(panicPeer peer.ID, err graphsync.HookPanicErr) {
+		require.Equal(t, p, panicPeer)
+		panics = append(panics, err)
+	})
+	hs.Register(named("first"), graphsync.WithPriority(1))
+	hs.Register(testHook(panickingHook))
+	hs.Register(named("never"), graphsync.WithPriority(-1))
+
+	var calls []string
+	err := hs.Publish(p, &calls)
+	var panicErr graphsync.HookPanicErr
+	require.True(t, errors.As(err, &panicErr))
+	require.Equal(t, "oops", panicErr.Value)
+	require.Contains(t, panicErr.Hook, "panickingHook")
+	require.Equal(t, []graphsync.HookPanicErr{panicErr}, panics)
+	require.Equal(t, []string{"first"}, calls)
+}
+
+func panickingHook(calls *[]string) error {
+	panic("oops")
+}
+
+func TestHookSetPeerScoped(t *testing.T) {
+	peers := testutil.GeneratePeers(3)
+	hs := hookset.New(dispatch)
+	hs.Register(named("everyone"))
+	hs.Register(named("partner"), graphsync.ForPeer(peers[0]))
+	hs.Register(named("partners"), graphsync.ForPeer(peers[0]), graphsync.ForPeer(peers[1]))
+
+	var calls []string
+	require.NoError(t, hs.Publish(peers[0], &calls))
+	require.Equal(t, []string{"everyone", "partner", "partners"}, calls)
+
+	calls = nil
+	require.NoError(t, hs.Publish(peers[1], &calls))
+	require.Equal(t, []string{"everyone", "partners"}, calls)
+
+	calls = nil
+	require.NoError(t, hs.Publish(peers[2], &calls))
+	require.Equal(t, []string{"everyone"}, calls)
+}
+
+func TestHookSetHooks(t *testing.T) {
+	p := testutil.GeneratePeers(1)[0]
+	hs := hookset.New(dispatch)
+	hs.Register(named("default"))
+	unregister := hs.Register(named("removed"))
+	hs.Register(panickingHook, graphsync.WithPriority(10), graphsync.ForPeer(p))
+	unregister()
+
+	hooks := hs.Hooks(graphsync.HookKindOutgoingBlock)
+	require.Len(t, hooks, 2)
+	require.Equal(t, graphsync.HookKindOutgoingBlock, hooks[0].Kind)
+	require.Equal(t, uint64(2), hooks[0].ID)
+	require.Contains(t, hooks[0].Name, "panickingHook")
+	require.Equal(t, graphsync.HookConfig{Priority: 10, Peers: []peer.ID{p}}, hooks[0].Config)
+	require.Equal(t, uint64(0), hooks[1].ID)
+	require.Equal(t, graphsync.HookConfig{}, hooks[1].Config)
+}
+
+type hookRun struct {
+	kind graphsync.HookKind
+	name string
+}
+
+type fakeMetrics struct {
+	runs []hookRun
+}
+
+func (fm *fakeMetrics) HookRan(kind graphsync.HookKind, name string, duration time.Duration) {
+	fm.runs = append(fm.runs, hookRun{kind, name})
+}
+
+func TestHookSetMetrics(t *testing.T) {
+	hs := hookset.New(dispatch)
+	metrics := &fakeMetrics{}
+	hs.UseMetrics(graphsync.HookKindIncomingRequest, metrics)
+	hs.Register(named("first"), graphsync.WithPriority(1))
+	hs.Register(panickingHook)
+
+	var calls []string
+	require.Error(t, hs.Publish(testutil.GeneratePeers(1)[0], &calls))
+	require.Len(t, metrics.runs, 2)
+	require.Equal(t, graphsync.HookKindIncomingRequest, metrics.runs[0].kind)
+	require.Contains(t, metrics.runs[0].name, "named")
+	require.Contains(t, metrics.runs[1].name, "panickingHook")
+}
@@ -0,0 +1,146 @@
+package graphsync
+
+import (
+	"context"
+	"math"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+)
+
+// eventBufferSize is how many events a subscriber may fall behind before
+// events are dropped for it
+const eventBufferSize = 256
+
+// eventSubscriptions fans events out from the hooks and listeners graphsync
+// registers on itself to every subscriber
+type eventSubscriptions struct {
+	lk          sync.RWMutex
+	subscribers map[chan graphsync.Event]struct{}
+}
+
+func newEventSubscriptions() *eventSubscriptions {
+	return &eventSubscriptions{subscribers: make(map[chan graphsync.Event]struct{})}
+}
+
+// subscribe adds a subscriber until either context is done
+func (es *eventSubscriptions) subscribe(ctx context.Context, gsCtx context.Context) <-chan graphsync.Event {
+	events := make(chan graphsync.Event, eventBufferSize)
+	es.lk.Lock()
+	es.subscribers[events] = struct{}{}
+	es.lk.Unlock()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-gsCtx.Done():
+		}
+		es.lk.Lock()
+		delete(es.subscribers, events)
+		close(events)
+		es.lk.Unlock()
+	}()
+	return events
+}
+
+func (es *eventSubscriptions) publish(event graphsync.Event) {
+	es.lk.RLock()
+	defer es.lk.RUnlock()
+	for events := range es.subscribers {
+		select {
+		case events <- event:
+		default:
+			log.Debugf("dropping event for subscriber that fell behind")
+		}
+	}
+}
+
+func (es *eventSubscriptions) publishRequest(kind graphsync.EventKind, direction graphsync.EventDirection, p peer.ID, request graphsync.RequestData) {
+	es.publish(graphsync.Event{Kind: kind, Direction: direction, Peer: p, RequestID: request.ID(), Request: request})
+}
+
+func (es *eventSubscriptions) outgoingRequest(p peer.ID, request graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+	es.publishRequest(graphsync.EventRequestQueued, graphsync.Outgoing, p, request)
+}
+
+func (es *eventSubscriptions) outgoingRequestSent(p peer.ID, request graphsync.RequestData) {
+	es.publishRequest(graphsync.EventRequestStarted, graphsync.Outgoing, p, request)
+}
+
+func (es *eventSubscriptions) incomingResponse(p peer.ID, response graphsync.ResponseData, hookActions graphsync.IncomingResponseHookActions) {
+	if response.Status() == graphsync.RequestPaused {
+		es.publish(graphsync.Event{Kind: graphsync.EventRequestPaused, Direction: graphsync.Outgoing, Peer: p, RequestID: response.RequestID(), Status: response.Status()})
+	}
+}
+
+func (es *eventSubscriptions) incomingBlock(p peer.ID, response graphsync.ResponseData, block graphsync.BlockData, hookActions graphsync.IncomingBlockHookActions) {
+	es.publish(graphsync.Event{Kind: graphsync.EventBlockReceived, Direction: graphsync.Outgoing, Peer: p, RequestID: response.RequestID(), Block: block})
+}
+
+func (es *eventSubscriptions) requestCompleted(p peer.ID, request graphsync.RequestData, status graphsync.ResponseStatusCode, err error, stats graphsync.RequestStats) {
+	kind := graphsync.EventRequestCompleted
+	if err != nil || !gsmsg.IsTerminalSuccessCode(status) {
+		kind = graphsync.EventRequestErrored
+	}
+	es.publish(graphsync.Event{Kind: kind, Direction: graphsync.Outgoing, Peer: p, RequestID: request.ID(), Request: request, Status: status, Err: err})
+}
+
+// incomingRequestQueued is called for new requests as they are received,
+// before they wait in the response queue
+func (es *eventSubscriptions) incomingRequestQueued(p peer.ID, request graphsync.RequestData) {
+	es.publishRequest(graphsync.EventRequestQueued, graphsync.Incoming, p, request)
+}
+
+func (es *eventSubscriptions) incomingRequest(p peer.ID, request graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+	es.publishRequest(graphsync.EventRequestStarted, graphsync.Incoming, p, request)
+}
+
+func (es *eventSubscriptions) blockSent(p peer.ID, request graphsync.RequestData, block graphsync.BlockData) {
+	es.publish(graphsync.Event{Kind: graphsync.EventBlockSent, Direction: graphsync.Incoming, Peer: p, RequestID: request.ID(), Request: request, Block: block})
+}
+
+func (es *eventSubscriptions) responseCompleted(p peer.ID, request graphsync.RequestData, status graphsync.ResponseStatusCode) {
+	kind := graphsync.EventRequestCompleted
+	if !gsmsg.IsTerminalSuccessCode(status) {
+		kind = graphsync.EventRequestErrored
+	}
+	es.publish(graphsync.Event{Kind: kind, Direction: graphsync.Incoming, Peer: p, RequestID: request.ID(), Request: request, Status: status})
+}
+
+func (es *eventSubscriptions) requestorCancelled(p peer.ID, request graphsync.RequestData) {
+	es.publish(graphsync.Event{Kind: graphsync.EventRequestErrored, Direction: graphsync.Incoming, Peer: p, RequestID: request.ID(), Request: request, Status: graphsync.RequestCancelled, Err: graphsync.RequestContextCancelledErr{}})
+}
+
+func (es *eventSubscriptions) paused(direction graphsync.EventDirection, p peer.ID, requestID graphsync.RequestID) {
+	es.publish(graphsync.Event{Kind: graphsync.EventRequestPaused, Direction: direction, Peer: p, RequestID: requestID})
+}
+
+func (es *eventSubscriptions) networkError(p peer.ID, request graphsync.RequestData, err error) {
+	requestID := graphsync.NoRequestID
+	if request != nil {
+		requestID = request.ID()
+	}
+	es.publish(graphsync.Event{Kind: graphsync.EventNetworkError, Peer: p, RequestID: requestID, Request: request, Err: err})
+}
+
+func (es *eventSubscriptions) receiverError(p peer.ID, err error) {
+	es.publish(graphsync.Event{Kind: graphsync.EventNetworkError, Peer: p, RequestID: graphsync.NoRequestID, Err: err})
+}
+
+// register subscribes to the hooks and listeners of gs that events come from
+func (es *eventSubscriptions) register(gs *GraphSync) {
+	gs.outgoingRequestHooks.Register(es.outgoingRequest)
+	gs.requestSentListeners.Register(es.outgoingRequestSent)
+	gs.incomingResponseHooks.Register(es.incomingResponse)
+	gs.incomingBlockHooks.Register(es.incomingBlock)
+	gs.completedRequestListeners.Register(es.requestCompleted)
+	// run after every other request hook, so requests they reject never start
+	gs.incomingRequestHooks.Register(es.incomingRequest, graphsync.WithPriority(math.MinInt32))
+	gs.blockSentListeners.Register(es.blockSent)
+	gs.completedResponseListeners.Register(es.responseCompleted)
+	gs.requestorCancelledListeners.Register(es.requestorCancelled)
+	gs.networkErrorListeners.Register(es.networkError)
+	gs.receiverErrorListeners.Register(es.receiverError)
+}
@@ -2,20 +2,36 @@ package graphsync
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/ipfs/go-datastore"
 	logging "github.com/ipfs/go-log"
 	"github.com/ipfs/go-peertaskqueue"
 	ipld "github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/traversal"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/blockcache"
+	"github.com/ipfs/go-graphsync/compression"
+	"github.com/ipfs/go-graphsync/configlog"
+	"github.com/ipfs/go-graphsync/hookset"
+	"github.com/ipfs/go-graphsync/linktracker"
 	"github.com/ipfs/go-graphsync/listeners"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/messagequeue"
 	gsnet "github.com/ipfs/go-graphsync/network"
 	"github.com/ipfs/go-graphsync/peermanager"
+	"github.com/ipfs/go-graphsync/peerprofile"
 	"github.com/ipfs/go-graphsync/requestmanager"
 	"github.com/ipfs/go-graphsync/requestmanager/asyncloader"
+	"github.com/ipfs/go-graphsync/requestmanager/asyncloader/batchstore"
+	"github.com/ipfs/go-graphsync/requestmanager/asyncloader/unverifiedblockstore"
 	requestorhooks "github.com/ipfs/go-graphsync/requestmanager/hooks"
 	"github.com/ipfs/go-graphsync/responsemanager"
 	"github.com/ipfs/go-graphsync/responsemanager/allocator"
@@ -23,14 +39,20 @@ import (
 	"github.com/ipfs/go-graphsync/responsemanager/peerresponsemanager"
 	"github.com/ipfs/go-graphsync/responsemanager/persistenceoptions"
 	"github.com/ipfs/go-graphsync/selectorvalidator"
+	"github.com/ipfs/go-graphsync/storeutil"
+	"github.com/ipfs/go-graphsync/telemetry"
 )
 
 var log = logging.Logger("graphsync")
 
-const maxRecursionDepth = 100
+const defaultMaxRecursionDepth = 100
 const defaultTotalMaxMemory = uint64(256 << 20)
 const defaultMaxMemoryPerPeer = uint64(16 << 20)
 const defaultMaxInProgressRequests = uint64(6)
+const defaultConfigHistory = 1024
+const defaultShutdownGracePeriod = 10 * time.Second
+const closePollInterval = 20 * time.Millisecond
+const shutdownTimeout = 5 * time.Second
 
 // GraphSync is an instance of a GraphSync exchange that implements
 // the graphsync protocol.
@@ -51,17 +73,68 @@ type GraphSync struct {
 	requestorCancelledListeners *listeners.RequestorCancelledListeners
 	blockSentListeners          *listeners.BlockSentListeners
 	networkErrorListeners       *listeners.NetworkErrorListeners
+	requestSentListeners        *listeners.OutgoingRequestSentListeners
+	receiverErrorListeners      *listeners.ReceiverErrorListeners
+	completedRequestListeners   *listeners.CompletedRequestListeners
+	hookPanicListeners          *listeners.HookPanicListeners
+	peerMisbehavingListeners    *listeners.PeerMisbehavingListeners
 	incomingResponseHooks       *requestorhooks.IncomingResponseHooks
 	outgoingRequestHooks        *requestorhooks.OutgoingRequestHooks
 	incomingBlockHooks          *requestorhooks.IncomingBlockHooks
+	blockStoreHooks             *requestorhooks.BlockStoreHooks
 	persistenceOptions          *persistenceoptions.PersistenceOptions
+	lazyStoresLk                sync.Mutex
+	lazyStores                  map[string]*storeutil.LazyStore
 	ctx                         context.Context
 	cancel                      context.CancelFunc
-	unregisterDefaultValidator  graphsync.UnregisterHookFunc
+	rejectAllRequestsByDefault  bool
+	maxRecursionDepth           int
+	defaultPriority             graphsync.Priority
+	defaultChooser              traversal.LinkTargetNodePrototypeChooser
+	responseBatchSize           uint64
+	completionBatchDelay        time.Duration
+	queueThawInterval           time.Duration
 	allocator                   *allocator.Allocator
 	totalMaxMemory              uint64
 	maxMemoryPerPeer            uint64
 	maxInProgressRequests       uint64
+	acceptBlockCompression      bool
+	suppressDuplicateCancels    bool
+	duplicateCancels            uint64
+	lastFetchStore              uint64
+	stats                       stats
+	responderQueueMetrics       peerresponsemanager.Metrics
+	hookMetrics                 hookset.Metrics
+	maxSendRetries              int
+	sendRetryBackoff            time.Duration
+	maxSendRetryBackoff         time.Duration
+	parallelStreams             int
+	sharedBlockCacheSize        uint64
+	blockCache                  *blockcache.BlockCache
+	maxTrackedLinks             int
+	linkTrackerStore            *linktracker.Store
+	peerProfiles                *peerprofile.Profiles
+	telemetry                   *telemetry.Collector
+	configHistory               int
+	configLog                   *configlog.Log
+	unverifiedMemoryLimit       uint64
+	unverifiedSpillDir          string
+	unverifiedEviction          unverifiedblockstore.NewEvictionPolicy
+	storeBatch                  batchstore.StoreBatch
+	batchMaxBlocks              int
+	batchMaxBytes               uint64
+	batchInterval               time.Duration
+	prefetchWorkers             int
+	prefetchMaxBytes            uint64
+	orphanTTL                   time.Duration
+	provenance                  graphsync.ProvenanceSink
+	strictBlocks                bool
+	verifyWorkers               int
+	shutdownGracePeriod         time.Duration
+	closing                     int32
+	closeOnce                   sync.Once
+	closeErr                    error
+	events                      *eventSubscriptions
 }
 
 // Option defines the functional option type that can be used to configure
@@ -72,7 +145,54 @@ type Option func(*GraphSync)
 // that perform their own request validation, all requests are rejected
 func RejectAllRequestsByDefault() Option {
 	return func(gs *GraphSync) {
-		gs.unregisterDefaultValidator()
+		gs.rejectAllRequestsByDefault = true
+	}
+}
+
+// MaxRecursionDepth sets the deepest recursion limit the default request
+// validator accepts in a selector (default 100). It has no effect with
+// RejectAllRequestsByDefault
+func MaxRecursionDepth(depth int) Option {
+	return func(gs *GraphSync) {
+		gs.maxRecursionDepth = depth
+	}
+}
+
+// DefaultRequestPriority sets the priority outgoing requests are sent with
+// (default 0)
+func DefaultRequestPriority(priority graphsync.Priority) Option {
+	return func(gs *GraphSync) {
+		gs.defaultPriority = priority
+	}
+}
+
+// DefaultNodePrototypeChooser sets the chooser used to build nodes for
+// requests and responses when no hook chooses one, such as one returning
+// prototypes for IPLD schema types so traversals validate the structure of
+// the data as they go. Hooks can still choose per request with
+// UseLinkTargetNodePrototypeChooser (default basicnode)
+func DefaultNodePrototypeChooser(chooser traversal.LinkTargetNodePrototypeChooser) Option {
+	return func(gs *GraphSync) {
+		gs.defaultChooser = chooser
+	}
+}
+
+// ResponseBatching sets the most block bytes batched into a single response
+// message (default 512KiB), and how long a message with only request
+// completions is held so completions for other requests can join it
+// (default 5ms)
+func ResponseBatching(maxBlockBytes uint64, completionDelay time.Duration) Option {
+	return func(gs *GraphSync) {
+		gs.responseBatchSize = maxBlockBytes
+		gs.completionBatchDelay = completionDelay
+	}
+}
+
+// ResponseQueueThawInterval sets how often peers that have had their turn in
+// the response queue are let back in (default 100ms)
+func ResponseQueueThawInterval(interval time.Duration) Option {
+	return func(gs *GraphSync) {
+		gs.queueThawInterval = interval
 	}
 }
 
@@ -100,22 +220,252 @@ func MaxInProgressRequests(maxInProgressRequests uint64) Option {
 	}
 }
 
+// AcceptBlockCompression advertises on outgoing requests that responders
+// may compress block payloads with any compression algorithm this node supports.
+// Responders that do not support compression will still send blocks uncompressed
+func AcceptBlockCompression() Option {
+	return func(gs *GraphSync) {
+		gs.acceptBlockCompression = true
+	}
+}
+
+// ShutdownGracePeriod sets how long Close waits for requests and responses
+// in progress to finish before shutting down (default 10s)
+func ShutdownGracePeriod(period time.Duration) Option {
+	return func(gs *GraphSync) {
+		gs.shutdownGracePeriod = period
+	}
+}
+
+// SuppressDuplicateCancels sets whether cancels for a request that already
+// has a cancel queued or sent to a peer are dropped (default true)
+func SuppressDuplicateCancels(suppress bool) Option {
+	return func(gs *GraphSync) {
+		gs.suppressDuplicateCancels = suppress
+	}
+}
+
+// ResponderQueueMetrics reports gauges for the backlog of responses queued
+// for each peer to the given metrics
+func ResponderQueueMetrics(metrics peerresponsemanager.Metrics) Option {
+	return func(gs *GraphSync) {
+		gs.responderQueueMetrics = metrics
+	}
+}
+
+// HookMetrics reports the run time of every hook, identified by kind and the
+// name of its function, to the given metrics
+func HookMetrics(metrics hookset.Metrics) Option {
+	return func(gs *GraphSync) {
+		gs.hookMetrics = metrics
+	}
+}
+
+// MaxSendRetries sets how many times sending a message to a peer is attempted,
+// reopening the stream after each failure, before the requests and responses
+// in it are failed with a network error (default 10)
+func MaxSendRetries(maxSendRetries int) Option {
+	return func(gs *GraphSync) {
+		gs.maxSendRetries = maxSendRetries
+	}
+}
+
+// SendRetryBackoff sets how long to wait before redialing a peer after sending
+// a message to it fails. The wait doubles after each consecutive failure, up
+// to max (default 100ms, doubling up to 10s)
+func SendRetryBackoff(initial time.Duration, max time.Duration) Option {
+	return func(gs *GraphSync) {
+		gs.sendRetryBackoff = initial
+		gs.maxSendRetryBackoff = max
+	}
+}
+
+// ParallelStreams sends messages to each peer over the given number of streams
+// at once, for higher throughput on links with a high bandwidth-delay product.
+// Messages for a single request are always sent on the same stream, so they
+// arrive in order (default 1)
+func ParallelStreams(count int) Option {
+	return func(gs *GraphSync) {
+		gs.parallelStreams = count
+	}
+}
+
+// SharedBlockCache keeps up to maxBytes of blocks verified by outgoing requests
+// in memory, and serves incoming requests from them before going to the
+// loader, so content that was just fetched can be served without a disk read
+func SharedBlockCache(maxBytes uint64) Option {
+	return func(gs *GraphSync) {
+		gs.sharedBlockCacheSize = maxBytes
+	}
+}
+
+// BoundedLinkTracking limits the links remembered for deduplicating blocks sent
+// to each peer to maxTrackedLinks, so very large responses use bounded memory.
+// Once the limit is hit, some blocks may be sent to a peer more than once.
+func BoundedLinkTracking(maxTrackedLinks int) Option {
+	return func(gs *GraphSync) {
+		gs.maxTrackedLinks = maxTrackedLinks
+	}
+}
+
+// PersistLinkTracking saves which blocks were sent to each peer for responses
+// still in progress to the given datastore when the responder stops sending to
+// the peer, on disconnect or Close, and restores it when sending to the peer
+// starts again. A request the peer sends again with the same ID and root then
+// skips the blocks it was already sent, so this assumes peers keep the blocks
+// they receive across restarts. It has no effect with BoundedLinkTracking
+func PersistLinkTracking(ds datastore.Datastore) Option {
+	return func(gs *GraphSync) {
+		gs.linkTrackerStore = linktracker.NewStore(ds, datastore.NewKey("/graphsync/linktracker"))
+	}
+}
+
+// PeerProfiles loads the given peer profiles when graphsync starts, keeps
+// learning them from requests and responses, and saves them on Close. Until a
+// protocol is negotiated with a peer, or the peer advertises its extensions,
+// ProtocolVersion and SupportedExtensions answer from its saved profile, so
+// hooks can tailor requests to a peer right after a restart
+func PeerProfiles(profiles *peerprofile.Profiles) Option {
+	return func(gs *GraphSync) {
+		gs.peerProfiles = profiles
+	}
+}
+
+// Telemetry collects anonymized, aggregate transfer statistics in the given
+// collector, for export with its Snapshot or NoisySnapshot. Nothing is
+// collected unless this option is set
+func Telemetry(collector *telemetry.Collector) Option {
+	return func(gs *GraphSync) {
+		gs.telemetry = collector
+	}
+}
+
+// EffectiveConfigHistory sets how many of the most recent requests and responses
+// have their effective configuration kept for inspection (default 1024)
+func EffectiveConfigHistory(configHistory int) Option {
+	return func(gs *GraphSync) {
+		gs.configHistory = configHistory
+	}
+}
+
+// UnverifiedBlockMemoryLimit caps the memory used by blocks received for
+// outgoing requests that have not yet been verified at maxBytes. Blocks beyond
+// the cap are written to a temporary directory inside spillDir, or the default
+// directory for temporary files if it is empty
+func UnverifiedBlockMemoryLimit(maxBytes uint64, spillDir string) Option {
+	return func(gs *GraphSync) {
+		gs.unverifiedMemoryLimit = maxBytes
+		gs.unverifiedSpillDir = spillDir
+	}
+}
+
+// UnverifiedBlockEviction picks blocks received for outgoing requests to move
+// from memory to disk with policies from newPolicy once the limit set with
+// UnverifiedBlockMemoryLimit is reached, rather than writing each new block
+// to disk. unverifiedblockstore.NewLRUPolicy and NewLargestFirstPolicy are
+// provided, or a custom policy can be used
+func UnverifiedBlockEviction(newPolicy unverifiedblockstore.NewEvictionPolicy) Option {
+	return func(gs *GraphSync) {
+		gs.unverifiedEviction = newPolicy
+	}
+}
+
+// BlockVerificationWorkers hashes blocks received for outgoing requests with
+// up to workers goroutines at once, so verification is not limited to a
+// single core on fast connections
+func BlockVerificationWorkers(workers int) Option {
+	return func(gs *GraphSync) {
+		gs.verifyWorkers = workers
+	}
+}
+
+// RejectUnexpectedBlocks drops blocks received for outgoing requests that the
+// response metadata does not announce, instead of holding them in case a
+// request asks for them later, and reports the sending peer to
+// PeerMisbehavingListeners with a graphsync.UnexpectedBlockErr
+func RejectUnexpectedBlocks() Option {
+	return func(gs *GraphSync) {
+		gs.strictBlocks = true
+	}
+}
+
+// OrphanedBlockTTL drops blocks received for outgoing requests that have not
+// been verified after ttl, even if their request is still in progress, so
+// requests that stall do not hold blocks in memory indefinitely
+func OrphanedBlockTTL(ttl time.Duration) Option {
+	return func(gs *GraphSync) {
+		gs.orphanTTL = ttl
+	}
+}
+
+// RecordProvenance records the peer and request that delivered each block
+// received for outgoing requests and written to the store in the given sink
+func RecordProvenance(sink graphsync.ProvenanceSink) Option {
+	return func(gs *GraphSync) {
+		gs.provenance = sink
+	}
+}
+
+// BatchedWrites writes blocks received for outgoing requests with storeBatch,
+// several at a time, instead of with the storer one at a time. A batch is
+// written once it holds maxBlocks blocks or maxBytes bytes, every interval,
+// and before a request with blocks in it completes. Requests whose blocks
+// can't be written fail rather than completing. Blocks written in batches are
+// not added to the SharedBlockCache
+func BatchedWrites(storeBatch batchstore.StoreBatch, maxBlocks int, maxBytes uint64, interval time.Duration) Option {
+	return func(gs *GraphSync) {
+		gs.storeBatch = storeBatch
+		gs.batchMaxBlocks = maxBlocks
+		gs.batchMaxBytes = maxBytes
+		gs.batchInterval = interval
+	}
+}
+
+// PrefetchLocalBlocks checks local storage for links announced in response
+// metadata without their blocks as soon as the metadata arrives, using up to
+// workers concurrent reads and holding up to maxBytes of prefetched data, so
+// the verifying traversal does not stall on the store when it reaches them.
+// It applies to requests using the default persistence option
+func PrefetchLocalBlocks(workers int, maxBytes uint64) Option {
+	return func(gs *GraphSync) {
+		gs.prefetchWorkers = workers
+		gs.prefetchMaxBytes = maxBytes
+	}
+}
+
 // New creates a new GraphSync Exchange on the given network,
 // and the given link loader+storer.
 func New(parent context.Context, network gsnet.GraphSyncNetwork,
 	loader ipld.Loader, storer ipld.Storer, options ...Option) graphsync.GraphExchange {
 	ctx, cancel := context.WithCancel(parent)
 
+	var graphSync *GraphSync
 	createMessageQueue := func(ctx context.Context, p peer.ID) peermanager.PeerQueue {
-		return messagequeue.New(ctx, p, network)
+		messageQueue := messagequeue.New(ctx, p, network)
+		if graphSync.suppressDuplicateCancels {
+			messageQueue.DedupCancels(&graphSync.duplicateCancels)
+		}
+		if graphSync.maxSendRetries > 0 {
+			messageQueue.SetMaxRetries(graphSync.maxSendRetries)
+		}
+		if graphSync.sendRetryBackoff > 0 {
+			messageQueue.SetRetryBackoff(graphSync.sendRetryBackoff, graphSync.maxSendRetryBackoff)
+		}
+		if graphSync.parallelStreams > 1 {
+			messageQueue.SetParallelStreams(graphSync.parallelStreams)
+		}
+		return messageQueue
 	}
 	peerManager := peermanager.NewMessageManager(ctx, createMessageQueue)
-	asyncLoader := asyncloader.New(ctx, loader, storer)
 	incomingResponseHooks := requestorhooks.NewResponseHooks()
 	outgoingRequestHooks := requestorhooks.NewRequestHooks()
 	incomingBlockHooks := requestorhooks.NewBlockHooks()
+	blockStoreHooks := requestorhooks.NewBlockStoreHooks()
 	networkErrorListeners := listeners.NewNetworkErrorListeners()
-	requestManager := requestmanager.New(ctx, asyncLoader, outgoingRequestHooks, incomingResponseHooks, incomingBlockHooks, networkErrorListeners)
+	requestSentListeners := listeners.NewOutgoingRequestSentListeners()
+	receiverErrorListeners := listeners.NewReceiverErrorListeners()
+	completedRequestListeners := listeners.NewCompletedRequestListeners()
+	peerMisbehavingListeners := listeners.NewPeerMisbehavingListeners()
 	peerTaskQueue := peertaskqueue.New()
 
 	persistenceOptions := persistenceoptions.New()
@@ -125,15 +475,21 @@ func New(parent context.Context, network gsnet.GraphSyncNetwork,
 	completedResponseListeners := listeners.NewCompletedResponseListeners()
 	requestorCancelledListeners := listeners.NewRequestorCancelledListeners()
 	blockSentListeners := listeners.NewBlockSentListeners()
-	unregisterDefaultValidator := incomingRequestHooks.Register(selectorvalidator.SelectorValidator(maxRecursionDepth))
-	graphSync := &GraphSync{
+	hookPanicListeners := listeners.NewHookPanicListeners()
+	incomingResponseHooks.OnPanic(hookPanicListeners.NotifyHookPanicListeners)
+	outgoingRequestHooks.OnPanic(hookPanicListeners.NotifyHookPanicListeners)
+	incomingBlockHooks.OnPanic(hookPanicListeners.NotifyHookPanicListeners)
+	blockStoreHooks.OnPanic(hookPanicListeners.NotifyHookPanicListeners)
+	incomingRequestHooks.OnPanic(hookPanicListeners.NotifyHookPanicListeners)
+	outgoingBlockHooks.OnPanic(hookPanicListeners.NotifyHookPanicListeners)
+	requestUpdatedHooks.OnPanic(hookPanicListeners.NotifyHookPanicListeners)
+	graphSync = &GraphSync{
 		network:                     network,
 		loader:                      loader,
 		storer:                      storer,
-		asyncLoader:                 asyncLoader,
-		requestManager:              requestManager,
 		peerManager:                 peerManager,
 		persistenceOptions:          persistenceOptions,
+		lazyStores:                  make(map[string]*storeutil.LazyStore),
 		incomingRequestHooks:        incomingRequestHooks,
 		outgoingBlockHooks:          outgoingBlockHooks,
 		requestUpdatedHooks:         requestUpdatedHooks,
@@ -141,30 +497,140 @@ func New(parent context.Context, network gsnet.GraphSyncNetwork,
 		requestorCancelledListeners: requestorCancelledListeners,
 		blockSentListeners:          blockSentListeners,
 		networkErrorListeners:       networkErrorListeners,
+		requestSentListeners:        requestSentListeners,
+		receiverErrorListeners:      receiverErrorListeners,
+		completedRequestListeners:   completedRequestListeners,
+		hookPanicListeners:          hookPanicListeners,
+		peerMisbehavingListeners:    peerMisbehavingListeners,
 		incomingResponseHooks:       incomingResponseHooks,
 		outgoingRequestHooks:        outgoingRequestHooks,
 		incomingBlockHooks:          incomingBlockHooks,
+		blockStoreHooks:             blockStoreHooks,
 		peerTaskQueue:               peerTaskQueue,
 		totalMaxMemory:              defaultTotalMaxMemory,
 		maxMemoryPerPeer:            defaultMaxMemoryPerPeer,
 		maxInProgressRequests:       defaultMaxInProgressRequests,
+		suppressDuplicateCancels:    true,
+		configHistory:               defaultConfigHistory,
 		ctx:                         ctx,
 		cancel:                      cancel,
-		unregisterDefaultValidator:  unregisterDefaultValidator,
+		maxRecursionDepth:           defaultMaxRecursionDepth,
+		shutdownGracePeriod:         defaultShutdownGracePeriod,
+		events:                      newEventSubscriptions(),
 	}
 
 	for _, option := range options {
 		option(graphSync)
 	}
+
+	blockSentListeners.Register(graphSync.stats.blockSent)
+
+	if !graphSync.rejectAllRequestsByDefault {
+		incomingRequestHooks.Register(selectorvalidator.SelectorValidator(graphSync.maxRecursionDepth))
+	}
+	graphSync.events.register(graphSync)
+
+	if graphSync.hookMetrics != nil {
+		incomingResponseHooks.UseMetrics(graphSync.hookMetrics)
+		outgoingRequestHooks.UseMetrics(graphSync.hookMetrics)
+		incomingBlockHooks.UseMetrics(graphSync.hookMetrics)
+		blockStoreHooks.UseMetrics(graphSync.hookMetrics)
+		incomingRequestHooks.UseMetrics(graphSync.hookMetrics)
+		outgoingBlockHooks.UseMetrics(graphSync.hookMetrics)
+		requestUpdatedHooks.UseMetrics(graphSync.hookMetrics)
+	}
+
+	responderLoader := loader
+	requestorStorer := storer
+	if graphSync.sharedBlockCacheSize > 0 {
+		graphSync.blockCache = blockcache.New(graphSync.sharedBlockCacheSize)
+		responderLoader = graphSync.blockCache.WrapLoader(loader)
+		requestorStorer = graphSync.blockCache.WrapStorer(storer)
+	}
+	asyncLoader := asyncloader.New(ctx, loader, requestorStorer)
+	graphSync.asyncLoader = asyncLoader
+	if graphSync.storeBatch != nil {
+		asyncLoader.SetBatchedWrites(graphSync.storeBatch, graphSync.batchMaxBlocks, graphSync.batchMaxBytes, graphSync.batchInterval)
+	}
+	asyncLoader.SetStrictBlockChecking(graphSync.strictBlocks)
+	asyncLoader.SetBlockStoreHook(blockStoreHooks.ProcessBlockStoreHooks)
+	if graphSync.provenance != nil {
+		asyncLoader.SetProvenanceSink(graphSync.provenance)
+	}
+	asyncLoader.SetVerifyWorkers(graphSync.verifyWorkers)
+	if graphSync.orphanTTL > 0 {
+		asyncLoader.SetOrphanTTL(graphSync.orphanTTL)
+	}
+	if graphSync.prefetchWorkers > 0 {
+		asyncLoader.SetLocalPrefetch(graphSync.prefetchWorkers, graphSync.prefetchMaxBytes)
+	}
+	if graphSync.unverifiedMemoryLimit > 0 {
+		if err := asyncLoader.SetMemoryLimit(graphSync.unverifiedMemoryLimit, graphSync.unverifiedSpillDir); err != nil {
+			log.Errorf("unable to create spill directory, unverified blocks will be kept in memory: %s", err)
+		} else if graphSync.unverifiedEviction != nil {
+			_ = asyncLoader.SetEvictionPolicy(graphSync.unverifiedEviction)
+		}
+	}
+	requestManager := requestmanager.New(ctx, asyncLoader, outgoingRequestHooks, incomingResponseHooks, incomingBlockHooks, networkErrorListeners)
+	graphSync.requestManager = requestManager
+	requestManager.DefaultPriority(graphSync.defaultPriority)
+	requestManager.DefaultNodePrototypeChooser(graphSync.defaultChooser)
+	requestManager.NotifyRequestsSent(requestSentListeners)
+	requestManager.NotifyRequestsCompleted(completedRequestListeners)
+	if graphSync.acceptBlockCompression {
+		requestManager.AcceptBlockCompression(compression.SupportedAlgorithms())
+	}
+	configLog := configlog.New(graphSync.configHistory)
+	graphSync.configLog = configLog
+	requestManager.RecordEffectiveConfigs(configLog)
+	requestManager.DetectRelayedPeers(network.IsRelayed)
+	requestManager.NotifyMisbehavingPeers(peerMisbehavingListeners)
+	requestManager.ProtectConnections(network.ConnectionManager())
 	allocator := allocator.NewAllocator(graphSync.totalMaxMemory, graphSync.maxMemoryPerPeer)
 	graphSync.allocator = allocator
 	createdResponseQueue := func(ctx context.Context, p peer.ID) peerresponsemanager.PeerResponseSender {
-		return peerresponsemanager.NewResponseSender(ctx, p, peerManager, allocator)
+		var newLinkTracker func() linktracker.Tracker
+		if graphSync.maxTrackedLinks > 0 {
+			newLinkTracker = func() linktracker.Tracker { return linktracker.NewBounded(graphSync.maxTrackedLinks) }
+		}
+		prs := peerresponsemanager.NewResponseSender(ctx, p, peerManager, allocator, graphSync.responderQueueMetrics, newLinkTracker)
+		if graphSync.linkTrackerStore != nil && graphSync.maxTrackedLinks == 0 {
+			graphSync.persistLinkTracker(p, prs)
+		}
+		if graphSync.parallelStreams > 1 {
+			prs.SeparateRequests()
+		}
+		if graphSync.responseBatchSize > 0 {
+			prs.BatchLimits(graphSync.responseBatchSize, graphSync.completionBatchDelay)
+		}
+		return prs
 	}
 	peerResponseManager := peerresponsemanager.New(ctx, createdResponseQueue)
 	graphSync.peerResponseManager = peerResponseManager
-	responseManager := responsemanager.New(ctx, loader, peerResponseManager, peerTaskQueue, incomingRequestHooks, outgoingBlockHooks, requestUpdatedHooks, completedResponseListeners, requestorCancelledListeners, blockSentListeners, networkErrorListeners, graphSync.maxInProgressRequests)
+	responseManager := responsemanager.New(ctx, responderLoader, peerResponseManager, peerTaskQueue, incomingRequestHooks, outgoingBlockHooks, requestUpdatedHooks, completedResponseListeners, requestorCancelledListeners, blockSentListeners, networkErrorListeners, graphSync.maxInProgressRequests)
 	graphSync.responseManager = responseManager
+	responseManager.RecordEffectiveConfigs(configLog)
+	responseManager.DetectRelayedPeers(network.IsRelayed)
+	responseManager.DefaultNodePrototypeChooser(graphSync.defaultChooser)
+	if !graphSync.rejectAllRequestsByDefault {
+		maxRecursionDepth := graphSync.maxRecursionDepth
+		responseManager.SetSelectorValidator(func(selector ipld.Node) error {
+			return selectorvalidator.ValidateMaxRecursionDepth(selector, maxRecursionDepth)
+		})
+	}
+	if graphSync.queueThawInterval > 0 {
+		responseManager.ThawInterval(graphSync.queueThawInterval)
+	}
+	responseManager.ProtectConnections(network.ConnectionManager())
+	if graphSync.peerProfiles != nil {
+		if err := graphSync.peerProfiles.Load(); err != nil {
+			log.Warnf("unable to load peer profiles: %s", err)
+		}
+		graphSync.peerProfiles.Register(graphSync)
+	}
+	if graphSync.telemetry != nil {
+		graphSync.telemetry.Register(graphSync)
+	}
 
 	asyncLoader.Startup()
 	requestManager.SetDelegate(peerManager)
@@ -174,27 +640,240 @@ func New(parent context.Context, network gsnet.GraphSyncNetwork,
 	return graphSync
 }
 
+// persistLinkTracker restores the link tracker state saved for the peer in the
+// link tracker store, and saves it there from then on
+func (gs *GraphSync) persistLinkTracker(p peer.ID, prs peerresponsemanager.PeerResponseSender) {
+	saved, err := gs.linkTrackerStore.Load(p)
+	if err != nil {
+		log.Warnf("unable to load link tracker for peer %s: %s", p, err)
+	}
+	save := func(data []byte) error {
+		return gs.linkTrackerStore.Save(p, data)
+	}
+	if err := prs.PersistLinkTracker(saved, save); err != nil {
+		log.Warnf("unable to restore link tracker for peer %s: %s", p, err)
+		_ = prs.PersistLinkTracker(nil, save)
+	}
+}
+
+// saveLinkTrackers saves the link tracker state for every peer being responded to
+func (gs *GraphSync) saveLinkTrackers() {
+	if gs.linkTrackerStore == nil {
+		return
+	}
+	for _, p := range gs.peerResponseManager.ConnectedPeers() {
+		if err := gs.peerResponseManager.SenderForPeer(p).SaveLinkTracker(); err != nil {
+			log.Warnf("unable to save link tracker for peer %s: %s", p, err)
+		}
+	}
+}
+
 // Request initiates a new GraphSync request to the given peer using the given selector spec.
 func (gs *GraphSync) Request(ctx context.Context, p peer.ID, root ipld.Link, selector ipld.Node, extensions ...graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan error) {
+	atomic.AddUint64(&gs.stats.outgoingRequests, 1)
 	return gs.requestManager.SendRequest(ctx, p, root, selector, extensions...)
 }
 
+// StartRequest initiates a new GraphSync request to the given peer, returning
+// a handle with the request's ID and methods to pause, resume and cancel it
+func (gs *GraphSync) StartRequest(ctx context.Context, p peer.ID, root ipld.Link, selector ipld.Node, extensions ...graphsync.ExtensionData) graphsync.RequestHandle {
+	atomic.AddUint64(&gs.stats.outgoingRequests, 1)
+	return gs.requestManager.StartRequest(ctx, p, root, selector, extensions...)
+}
+
+// FetchToStore makes a request to the given peer, writing the blocks it
+// receives with the given storer, and waits for it to finish
+func (gs *GraphSync) FetchToStore(ctx context.Context, p peer.ID, root ipld.Link, selector ipld.Node, loader ipld.Loader, storer ipld.Storer, extensions ...graphsync.ExtensionData) (graphsync.RequestStats, error) {
+	name := fmt.Sprintf("graphsync/fetch-to-store-%d", atomic.AddUint64(&gs.lastFetchStore, 1))
+	err := gs.asyncLoader.RegisterPersistenceOption(name, loader, storer)
+	if err != nil {
+		return graphsync.RequestStats{}, err
+	}
+	defer func() {
+		if err := gs.asyncLoader.UnregisterPersistenceOption(name); err != nil {
+			log.Warnf("unable to unregister store for fetch: %s", err)
+		}
+	}()
+	atomic.AddUint64(&gs.stats.outgoingRequests, 1)
+	return gs.requestManager.FetchToStore(ctx, p, root, selector, name, extensions...)
+}
+
+// FetchDAG makes a request to the given peer, building nodes with the given
+// chooser, and returns the root node once the request finishes
+func (gs *GraphSync) FetchDAG(ctx context.Context, p peer.ID, root ipld.Link, selector ipld.Node, chooser traversal.LinkTargetNodePrototypeChooser, extensions ...graphsync.ExtensionData) (ipld.Node, error) {
+	atomic.AddUint64(&gs.stats.outgoingRequests, 1)
+	return gs.requestManager.FetchDAG(ctx, p, root, selector, chooser, extensions...)
+}
+
+// RequestWithAddrs initiates a new GraphSync request to the given peer, dialing
+// it on the given addresses if it is not already connected
+func (gs *GraphSync) RequestWithAddrs(ctx context.Context, p peer.AddrInfo, root ipld.Link, selector ipld.Node, extensions ...graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan error) {
+	gs.network.AddDialHints(p.ID, p.Addrs)
+	atomic.AddUint64(&gs.stats.outgoingRequests, 1)
+	return gs.requestManager.SendRequest(ctx, p.ID, root, selector, extensions...)
+}
+
+// DuplicateCancelsSuppressed returns the number of cancels dropped because the
+// request already had a cancel queued or sent
+func (gs *GraphSync) DuplicateCancelsSuppressed() uint64 {
+	return atomic.LoadUint64(&gs.duplicateCancels)
+}
+
+// Stats returns running totals for requests, blocks and bytes in both
+// directions, and the memory currently held in queues
+func (gs *GraphSync) Stats() graphsync.Stats {
+	return graphsync.Stats{
+		OutgoingRequests:      atomic.LoadUint64(&gs.stats.outgoingRequests),
+		IncomingRequests:      atomic.LoadUint64(&gs.stats.incomingRequests),
+		BlocksSent:            atomic.LoadUint64(&gs.stats.blocksSent),
+		BytesSent:             atomic.LoadUint64(&gs.stats.bytesSent),
+		BlocksReceived:        atomic.LoadUint64(&gs.stats.blocksReceived),
+		BytesReceived:         atomic.LoadUint64(&gs.stats.bytesReceived),
+		DeduplicatedBlocks:    atomic.LoadUint64(&gs.stats.deduplicatedBlocks),
+		DeduplicatedBytes:     atomic.LoadUint64(&gs.stats.deduplicatedBytes),
+		QueuedResponseMemory:  gs.allocator.AllocatedMemory(),
+		BufferedRequestMemory: gs.asyncLoader.Stats().BufferedBytes,
+	}
+}
+
+// Close stops accepting new requests, then waits up to the shutdown grace
+// period for outgoing requests to finish and for responses to send their
+// remaining blocks and final status, before stopping all processing and
+// closing streams. Paused requests and responses are not waited for. New
+// outgoing requests fail with RequestFailedClosedErr and new incoming requests
+// are rejected once Close is called. Close stops receiving messages from the
+// network and returns once processing has stopped, with an error if the grace
+// period expired with work in progress or processing did not stop in time
+func (gs *GraphSync) Close() error {
+	gs.closeOnce.Do(func() {
+		atomic.StoreInt32(&gs.closing, 1)
+		gs.requestManager.RejectNewRequests()
+		gs.closeErr = gs.waitForIdle()
+		gs.saveLinkTrackers()
+		if gs.peerProfiles != nil {
+			if err := gs.peerProfiles.Save(); err != nil {
+				log.Warnf("unable to save peer profiles: %s", err)
+			}
+		}
+		gs.network.Stop()
+		gs.cancel()
+		if err := gs.waitForShutdown(); err != nil && gs.closeErr == nil {
+			gs.closeErr = err
+		}
+	})
+	return gs.closeErr
+}
+
+// waitForShutdown waits for the request manager, response manager and async
+// loader to stop processing after cancellation
+func (gs *GraphSync) waitForShutdown() error {
+	timeout := time.NewTimer(shutdownTimeout)
+	defer timeout.Stop()
+	for _, done := range []<-chan struct{}{
+		gs.requestManager.Done(),
+		gs.responseManager.Done(),
+		gs.asyncLoader.Done(),
+	} {
+		select {
+		case <-done:
+		case <-timeout.C:
+			return errors.New("timed out waiting for graphsync to stop")
+		}
+	}
+	return nil
+}
+
+// waitForIdle waits until no unpaused requests or responses are in progress
+// and no response data is queued, returning an error if the shutdown grace
+// period expires first
+func (gs *GraphSync) waitForIdle() error {
+	deadline := time.NewTimer(gs.shutdownGracePeriod)
+	defer deadline.Stop()
+	ticker := time.NewTicker(closePollInterval)
+	defer ticker.Stop()
+	for {
+		if gs.unpausedRequests() == 0 &&
+			gs.responseManager.InProgressResponses() == 0 &&
+			gs.allocator.AllocatedMemory() == 0 {
+			return nil
+		}
+		select {
+		case <-deadline.C:
+			return errors.New("shutdown grace period expired with requests or responses in progress")
+		case <-gs.ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (gs *GraphSync) unpausedRequests() int {
+	count := 0
+	for _, info := range gs.requestManager.PendingRequests() {
+		if !info.Paused {
+			count++
+		}
+	}
+	return count
+}
+
+// Subscribe returns a channel of events for requests on both sides, which
+// closes when the context is cancelled or graphsync shuts down. Events are
+// dropped for subscribers more than a few hundred events behind
+func (gs *GraphSync) Subscribe(ctx context.Context) <-chan graphsync.Event {
+	return gs.events.subscribe(ctx, gs.ctx)
+}
+
+// LoaderStats returns how links loaded for outgoing requests have been
+// satisfied, whether from local storage or the network, and how long loads
+// have waited on average
+func (gs *GraphSync) LoaderStats() asyncloader.Stats {
+	return gs.asyncLoader.Stats()
+}
+
+// LoaderSnapshot describes, for each outgoing request in progress, the links
+// it is waiting on, how its loads were satisfied, and the size of blocks
+// received for it awaiting verification -- useful to see why a request stalls
+func (gs *GraphSync) LoaderSnapshot() []asyncloader.RequestSnapshot {
+	return gs.asyncLoader.Snapshot()
+}
+
+// OrphanedBlockBytes returns the total size of blocks from each peer that were
+// dropped without being verified, because no request expected them, their
+// request finished without loading them, or they outlived OrphanedBlockTTL
+func (gs *GraphSync) OrphanedBlockBytes() map[peer.ID]uint64 {
+	return gs.asyncLoader.OrphanedBytes()
+}
+
+// UnverifiedBlockStats returns how much data from blocks received but not yet
+// verified is held in memory and spilled to disk, or false if
+// UnverifiedBlockMemoryLimit was not set
+func (gs *GraphSync) UnverifiedBlockStats() (unverifiedblockstore.SpillStats, bool) {
+	return gs.asyncLoader.SpillStats()
+}
+
 // RegisterIncomingRequestHook adds a hook that runs when a request is received
 // If overrideDefaultValidation is set to true, then if the hook does not error,
 // it is considered to have "validated" the request -- and that validation supersedes
 // the normal validation of requests Graphsync does (i.e. all selectors can be accepted)
-func (gs *GraphSync) RegisterIncomingRequestHook(hook graphsync.OnIncomingRequestHook) graphsync.UnregisterHookFunc {
-	return gs.incomingRequestHooks.Register(hook)
+func (gs *GraphSync) RegisterIncomingRequestHook(hook graphsync.OnIncomingRequestHook, options ...graphsync.HookOption) graphsync.UnregisterHookFunc {
+	return gs.incomingRequestHooks.Register(hook, options...)
 }
 
 // RegisterIncomingResponseHook adds a hook that runs when a response is received
-func (gs *GraphSync) RegisterIncomingResponseHook(hook graphsync.OnIncomingResponseHook) graphsync.UnregisterHookFunc {
-	return gs.incomingResponseHooks.Register(hook)
+func (gs *GraphSync) RegisterIncomingResponseHook(hook graphsync.OnIncomingResponseHook, options ...graphsync.HookOption) graphsync.UnregisterHookFunc {
+	return gs.incomingResponseHooks.Register(hook, options...)
+}
+
+// RegisterBlockStoreHook adds a hook that runs when a block received from the
+// network is verified, before it is written to the store
+func (gs *GraphSync) RegisterBlockStoreHook(hook graphsync.OnBlockStoreHook, options ...graphsync.HookOption) graphsync.UnregisterHookFunc {
+	return gs.blockStoreHooks.Register(hook, options...)
 }
 
 // RegisterOutgoingRequestHook adds a hook that runs immediately prior to sending a new request
-func (gs *GraphSync) RegisterOutgoingRequestHook(hook graphsync.OnOutgoingRequestHook) graphsync.UnregisterHookFunc {
-	return gs.outgoingRequestHooks.Register(hook)
+func (gs *GraphSync) RegisterOutgoingRequestHook(hook graphsync.OnOutgoingRequestHook, options ...graphsync.HookOption) graphsync.UnregisterHookFunc {
+	return gs.outgoingRequestHooks.Register(hook, options...)
 }
 
 // RegisterPersistenceOption registers an alternate loader/storer combo that can be substituted for the default
@@ -206,23 +885,95 @@ func (gs *GraphSync) RegisterPersistenceOption(name string, loader ipld.Loader,
 	return gs.persistenceOptions.Register(name, loader)
 }
 
+// ReplaceDefaultStore replaces the default loader and storer used by requests
+// and responses that do not choose a persistence option. Only requests and
+// responses that start afterwards use the new store -- those in progress
+// finish with the old one
+func (gs *GraphSync) ReplaceDefaultStore(loader ipld.Loader, storer ipld.Storer) error {
+	responderLoader := loader
+	requestorStorer := storer
+	if gs.blockCache != nil {
+		responderLoader = gs.blockCache.WrapLoader(loader)
+		requestorStorer = gs.blockCache.WrapStorer(storer)
+	}
+	err := gs.asyncLoader.SetDefaultStore(loader, requestorStorer)
+	if err != nil {
+		return err
+	}
+	gs.responseManager.SetDefaultLoader(responderLoader)
+	return nil
+}
+
+// RegisterTransactionalPersistenceOption registers a persistence option whose
+// writes for each outgoing request are staged in a transaction, committed only
+// if the request completes successfully and rolled back otherwise. The loader
+// serves the option for incoming requests
+func (gs *GraphSync) RegisterTransactionalPersistenceOption(name string, loader ipld.Loader, newTransaction graphsync.NewStoreTransaction) error {
+	err := gs.asyncLoader.RegisterTransactionalPersistenceOption(name, newTransaction)
+	if err != nil {
+		return err
+	}
+	return gs.persistenceOptions.Register(name, loader)
+}
+
+// RegisterPersistenceOptionFactory registers a persistence option whose store
+// is opened with the factory when first used, by outgoing or incoming
+// requests, and closed again after idleTimeout without use, or when the option
+// is unregistered
+func (gs *GraphSync) RegisterPersistenceOptionFactory(name string, factory graphsync.StoreFactory, idleTimeout time.Duration) error {
+	lazyStore := storeutil.NewLazyStore(factory, idleTimeout)
+	err := gs.RegisterPersistenceOption(name, lazyStore.Loader(), lazyStore.Storer())
+	if err != nil {
+		return err
+	}
+	gs.lazyStoresLk.Lock()
+	gs.lazyStores[name] = lazyStore
+	gs.lazyStoresLk.Unlock()
+	return nil
+}
+
+// ListPersistenceOptions returns the registered persistence options, sorted by
+// name, with the number of outgoing requests using each and the bytes written
+// to each
+func (gs *GraphSync) ListPersistenceOptions() []graphsync.PersistenceOptionUsage {
+	return gs.asyncLoader.ListPersistenceOptions()
+}
+
+// SetPersistenceOptionQuota limits the bytes outgoing requests can write to
+// a persistence option. Once reached, writes fail with a
+// graphsync.StoreFullErr. A quota of 0 removes the limit
+func (gs *GraphSync) SetPersistenceOptionQuota(name string, maxBytes uint64) error {
+	return gs.asyncLoader.SetPersistenceOptionQuota(name, maxBytes)
+}
+
 // UnregisterPersistenceOption unregisters an alternate loader/storer combo
 func (gs *GraphSync) UnregisterPersistenceOption(name string) error {
 	err := gs.asyncLoader.UnregisterPersistenceOption(name)
 	if err != nil {
 		return err
 	}
-	return gs.persistenceOptions.Unregister(name)
+	err = gs.persistenceOptions.Unregister(name)
+	if err != nil {
+		return err
+	}
+	gs.lazyStoresLk.Lock()
+	lazyStore, ok := gs.lazyStores[name]
+	delete(gs.lazyStores, name)
+	gs.lazyStoresLk.Unlock()
+	if ok {
+		return lazyStore.Close()
+	}
+	return nil
 }
 
 // RegisterOutgoingBlockHook registers a hook that runs after each block is sent in a response
-func (gs *GraphSync) RegisterOutgoingBlockHook(hook graphsync.OnOutgoingBlockHook) graphsync.UnregisterHookFunc {
-	return gs.outgoingBlockHooks.Register(hook)
+func (gs *GraphSync) RegisterOutgoingBlockHook(hook graphsync.OnOutgoingBlockHook, options ...graphsync.HookOption) graphsync.UnregisterHookFunc {
+	return gs.outgoingBlockHooks.Register(hook, options...)
 }
 
 // RegisterRequestUpdatedHook registers a hook that runs when an update to a request is received
-func (gs *GraphSync) RegisterRequestUpdatedHook(hook graphsync.OnRequestUpdatedHook) graphsync.UnregisterHookFunc {
-	return gs.requestUpdatedHooks.Register(hook)
+func (gs *GraphSync) RegisterRequestUpdatedHook(hook graphsync.OnRequestUpdatedHook, options ...graphsync.HookOption) graphsync.UnregisterHookFunc {
+	return gs.requestUpdatedHooks.Register(hook, options...)
 }
 
 // RegisterCompletedResponseListener adds a listener on the responder for completed responses
@@ -231,8 +982,32 @@ func (gs *GraphSync) RegisterCompletedResponseListener(listener graphsync.OnResp
 }
 
 // RegisterIncomingBlockHook adds a hook that runs when a block is received and validated (put in block store)
-func (gs *GraphSync) RegisterIncomingBlockHook(hook graphsync.OnIncomingBlockHook) graphsync.UnregisterHookFunc {
-	return gs.incomingBlockHooks.Register(hook)
+func (gs *GraphSync) RegisterIncomingBlockHook(hook graphsync.OnIncomingBlockHook, options ...graphsync.HookOption) graphsync.UnregisterHookFunc {
+	return gs.incomingBlockHooks.Register(hook, options...)
+}
+
+// RegisteredHooks lists the hooks currently registered, grouped by kind and in
+// the order hooks of each kind run
+func (gs *GraphSync) RegisteredHooks() []graphsync.HookInfo {
+	var hooks []graphsync.HookInfo
+	hooks = append(hooks, gs.outgoingRequestHooks.Hooks()...)
+	hooks = append(hooks, gs.incomingResponseHooks.Hooks()...)
+	hooks = append(hooks, gs.incomingBlockHooks.Hooks()...)
+	hooks = append(hooks, gs.blockStoreHooks.Hooks()...)
+	hooks = append(hooks, gs.incomingRequestHooks.Hooks()...)
+	hooks = append(hooks, gs.outgoingBlockHooks.Hooks()...)
+	hooks = append(hooks, gs.requestUpdatedHooks.Hooks()...)
+	return hooks
+}
+
+// RegisterCompletedRequestListener adds a listener on the requestor for completed requests
+func (gs *GraphSync) RegisterCompletedRequestListener(listener graphsync.OnRequestCompletedListener) graphsync.UnregisterHookFunc {
+	return gs.completedRequestListeners.Register(listener)
+}
+
+// RegisterHookPanicListener adds a listener for hooks that panic
+func (gs *GraphSync) RegisterHookPanicListener(listener graphsync.OnHookPanicListener) graphsync.UnregisterHookFunc {
+	return gs.hookPanicListeners.Register(listener)
 }
 
 // RegisterRequestorCancelledListener adds a listener on the responder for
@@ -246,11 +1021,66 @@ func (gs *GraphSync) RegisterBlockSentListener(listener graphsync.OnBlockSentLis
 	return gs.blockSentListeners.Register(listener)
 }
 
+// RegisterBlocksSentListener adds a listener that receives all blocks for a request
+// sent in a single message at once, rather than being called for each block
+func (gs *GraphSync) RegisterBlocksSentListener(listener graphsync.OnBlocksSentListener) graphsync.UnregisterHookFunc {
+	return gs.blockSentListeners.RegisterBatch(listener)
+}
+
+// RegisterReceiverErrorListener adds a listener for when messages from peers can't be decoded or are rejected
+func (gs *GraphSync) RegisterReceiverErrorListener(listener graphsync.OnReceiverErrorListener) graphsync.UnregisterHookFunc {
+	return gs.receiverErrorListeners.Register(listener)
+}
+
+// RegisterOutgoingRequestSentListener adds a listener for when requests are written to the network
+func (gs *GraphSync) RegisterOutgoingRequestSentListener(listener graphsync.OnOutgoingRequestSentListener) graphsync.UnregisterHookFunc {
+	return gs.requestSentListeners.Register(listener)
+}
+
 // RegisterNetworkErrorListener adds a listener for when errors occur sending data over the wire
 func (gs *GraphSync) RegisterNetworkErrorListener(listener graphsync.OnNetworkErrorListener) graphsync.UnregisterHookFunc {
 	return gs.networkErrorListeners.Register(listener)
 }
 
+// RegisterPeerMisbehavingListener adds a listener for when a peer sends data
+// that violates the protocol, such as a block that does not match its CID
+func (gs *GraphSync) RegisterPeerMisbehavingListener(listener graphsync.OnPeerMisbehavingListener) graphsync.UnregisterHookFunc {
+	return gs.peerMisbehavingListeners.Register(listener)
+}
+
+// ProtocolVersion returns the graphsync protocol negotiated with the given
+// peer, or the one last negotiated with it in its profile if PeerProfiles is set
+func (gs *GraphSync) ProtocolVersion(p peer.ID) (protocol.ID, bool) {
+	version, ok := gs.network.ProtocolVersion(p)
+	if ok || gs.peerProfiles == nil {
+		return version, ok
+	}
+	profile, ok := gs.peerProfiles.Get(p)
+	if !ok || profile.Protocol == "" {
+		return "", false
+	}
+	return profile.Protocol, true
+}
+
+// SupportedExtensions returns the extensions the given peer advertised it
+// handles, or the ones in its profile if PeerProfiles is set
+func (gs *GraphSync) SupportedExtensions(p peer.ID) ([]graphsync.ExtensionName, bool) {
+	names, ok := gs.network.SupportedExtensions(p)
+	if ok || gs.peerProfiles == nil {
+		return names, ok
+	}
+	profile, ok := gs.peerProfiles.Get(p)
+	if !ok || len(profile.Extensions) == 0 {
+		return nil, false
+	}
+	return profile.Extensions, true
+}
+
+// IsRelayed returns true if the given peer is only connected through a relay
+func (gs *GraphSync) IsRelayed(p peer.ID) bool {
+	return gs.network.IsRelayed(p)
+}
+
 // UnpauseRequest unpauses a request that was paused in a block hook based request ID
 // Can also send extensions with unpause
 func (gs *GraphSync) UnpauseRequest(requestID graphsync.RequestID, extensions ...graphsync.ExtensionData) error {
@@ -259,7 +1089,12 @@ func (gs *GraphSync) UnpauseRequest(requestID graphsync.RequestID, extensions ..
 
 // PauseRequest pauses an in progress request (may take 1 or more blocks to process)
 func (gs *GraphSync) PauseRequest(requestID graphsync.RequestID) error {
-	return gs.requestManager.PauseRequest(requestID)
+	if err := gs.requestManager.PauseRequest(requestID); err != nil {
+		return err
+	}
+	info, _ := gs.requestManager.RequestInfo(requestID)
+	gs.events.paused(graphsync.Outgoing, info.Peer, requestID)
+	return nil
 }
 
 // UnpauseResponse unpauses a response that was paused in a block hook based on peer ID and request ID
@@ -269,7 +1104,11 @@ func (gs *GraphSync) UnpauseResponse(p peer.ID, requestID graphsync.RequestID, e
 
 // PauseResponse pauses an in progress response (may take 1 or more blocks to process)
 func (gs *GraphSync) PauseResponse(p peer.ID, requestID graphsync.RequestID) error {
-	return gs.responseManager.PauseResponse(p, requestID)
+	if err := gs.responseManager.PauseResponse(p, requestID); err != nil {
+		return err
+	}
+	gs.events.paused(graphsync.Incoming, p, requestID)
+	return nil
 }
 
 // CancelResponse cancels an in progress response
@@ -277,6 +1116,71 @@ func (gs *GraphSync) CancelResponse(p peer.ID, requestID graphsync.RequestID) er
 	return gs.responseManager.CancelResponse(p, requestID)
 }
 
+// PendingRequests returns information about the outgoing requests in progress,
+// sorted by ID
+func (gs *GraphSync) PendingRequests() []graphsync.RequestInfo {
+	return gs.requestManager.PendingRequests()
+}
+
+// RequestInfo returns information about an outgoing request in progress
+func (gs *GraphSync) RequestInfo(requestID graphsync.RequestID) (graphsync.RequestInfo, bool) {
+	return gs.requestManager.RequestInfo(requestID)
+}
+
+// RequestConfig returns the effective configuration of a recent outgoing request
+func (gs *GraphSync) RequestConfig(requestID graphsync.RequestID) (graphsync.EffectiveConfig, bool) {
+	return gs.configLog.Request(requestID)
+}
+
+// ResponseConfig returns the effective configuration of a recent response to a peer
+func (gs *GraphSync) ResponseConfig(p peer.ID, requestID graphsync.RequestID) (graphsync.EffectiveConfig, bool) {
+	config, ok := gs.configLog.Response(p, requestID)
+	if !ok {
+		return config, false
+	}
+	config.MaxMemoryPerPeer = gs.maxMemoryPerPeer
+	config.TotalMaxMemory = gs.totalMaxMemory
+	return config, true
+}
+
+// CancelResponsesToPeer cancels all queued and in progress responses to the given peer
+func (gs *GraphSync) CancelResponsesToPeer(p peer.ID) error {
+	return gs.responseManager.CancelResponsesToPeer(p)
+}
+
+// stats counts the running totals reported by Stats
+type stats struct {
+	outgoingRequests   uint64
+	incomingRequests   uint64
+	blocksSent         uint64
+	bytesSent          uint64
+	blocksReceived     uint64
+	bytesReceived      uint64
+	deduplicatedBlocks uint64
+	deduplicatedBytes  uint64
+}
+
+func (s *stats) blockSent(p peer.ID, request graphsync.RequestData, block graphsync.BlockData) {
+	atomic.AddUint64(&s.blocksSent, 1)
+	atomic.AddUint64(&s.bytesSent, block.BlockSizeOnWire())
+	if block.Deduplicated() {
+		atomic.AddUint64(&s.deduplicatedBlocks, 1)
+		atomic.AddUint64(&s.deduplicatedBytes, block.BlockSize())
+	}
+}
+
+func (s *stats) messageReceived(incoming gsmsg.GraphSyncMessage) {
+	for _, request := range incoming.Requests() {
+		if !request.IsCancel() && !request.IsUpdate() {
+			atomic.AddUint64(&s.incomingRequests, 1)
+		}
+	}
+	for _, block := range incoming.Blocks() {
+		atomic.AddUint64(&s.blocksReceived, 1)
+		atomic.AddUint64(&s.bytesReceived, uint64(len(block.RawData())))
+	}
+}
+
 type graphSyncReceiver GraphSync
 
 func (gsr *graphSyncReceiver) graphSync() *GraphSync {
@@ -289,7 +1193,17 @@ func (gsr *graphSyncReceiver) ReceiveMessage(
 	ctx context.Context,
 	sender peer.ID,
 	incoming gsmsg.GraphSyncMessage) {
-	gsr.graphSync().responseManager.ProcessRequests(ctx, sender, incoming.Requests())
+	gsr.graphSync().stats.messageReceived(incoming)
+	requests := incoming.Requests()
+	if atomic.LoadInt32(&gsr.graphSync().closing) != 0 {
+		requests = gsr.rejectNewRequests(sender, requests)
+	}
+	for _, request := range requests {
+		if !request.IsCancel() && !request.IsUpdate() {
+			gsr.graphSync().events.incomingRequestQueued(sender, request)
+		}
+	}
+	gsr.graphSync().responseManager.ProcessRequests(ctx, sender, requests)
 	gsr.graphSync().requestManager.ProcessResponses(sender, incoming.Responses(), incoming.Blocks())
 }
 
@@ -297,8 +1211,57 @@ func (gsr *graphSyncReceiver) ReceiveMessage(
 // errors from the network.
 func (gsr *graphSyncReceiver) ReceiveError(err error) {
 	log.Infof("Graphsync ReceiveError: %s", err)
-	// TODO log the network error
-	// TODO bubble the network error up to the parent context/error logger
+	var tooLarge *gsnet.MessageTooLargeError
+	if errors.As(err, &tooLarge) {
+		gsr.graphSync().receiverErrorListeners.NotifyReceiverErrorListeners(tooLarge.Peer, tooLarge)
+		gsr.rejectMessage(tooLarge)
+		return
+	}
+	var receiveErr *gsnet.MessageReceiveError
+	if errors.As(err, &receiveErr) {
+		gsr.graphSync().receiverErrorListeners.NotifyReceiverErrorListeners(receiveErr.Peer, receiveErr.Err)
+	}
+}
+
+// rejectNewRequests rejects the new requests in a message received while
+// closing, returning the cancels and updates for responses in progress
+func (gsr *graphSyncReceiver) rejectNewRequests(p peer.ID, requests []gsmsg.GraphSyncRequest) []gsmsg.GraphSyncRequest {
+	remaining := make([]gsmsg.GraphSyncRequest, 0, len(requests))
+	for _, request := range requests {
+		if request.IsCancel() || request.IsUpdate() {
+			remaining = append(remaining, request)
+			continue
+		}
+		gsr.graphSync().peerResponseManager.SenderForPeer(p).FinishWithError(request.ID(), graphsync.RequestRejected)
+	}
+	return remaining
+}
+
+// rejectMessage fails the requests and responses in a message that was too
+// large to accept, telling the peer why rather than silently dropping it
+func (gsr *graphSyncReceiver) rejectMessage(tooLarge *gsnet.MessageTooLargeError) {
+	gs := gsr.graphSync()
+	p := tooLarge.Peer
+	for _, request := range tooLarge.Message.Requests() {
+		if request.IsCancel() {
+			continue
+		}
+		gs.networkErrorListeners.NotifyNetworkErrorListeners(p, request, tooLarge)
+		if request.IsUpdate() {
+			// the response is already in progress, so stop it
+			_ = gs.responseManager.CancelResponse(p, request.ID())
+			continue
+		}
+		gs.peerResponseManager.SenderForPeer(p).FinishWithError(request.ID(), graphsync.RequestFailedMessageTooLarge)
+	}
+	var failures []gsmsg.GraphSyncResponse
+	for _, response := range tooLarge.Message.Responses() {
+		failures = append(failures, gsmsg.NewResponse(response.RequestID(), graphsync.RequestFailedMessageTooLarge))
+		gs.peerManager.SendRequest(p, gsmsg.CancelRequest(response.RequestID()))
+	}
+	if len(failures) > 0 {
+		gs.requestManager.ProcessResponses(p, failures, nil)
+	}
 }
 
 // Connected is part of the networks 's Receiver interface and handles peers connecting
@@ -37,6 +37,7 @@ import (
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/peer"
 	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/libp2p/go-msgio"
 	"github.com/stretchr/testify/require"
 
 	"github.com/ipfs/go-graphsync"
@@ -45,6 +46,7 @@ import (
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	gsnet "github.com/ipfs/go-graphsync/network"
 	"github.com/ipfs/go-graphsync/testutil"
+	"github.com/ipfs/go-graphsync/testutil/chaintypes"
 )
 
 func TestMakeRequestToNetwork(t *testing.T) {
@@ -230,6 +232,82 @@ func TestGraphsyncRoundTrip(t *testing.T) {
 	var finalResponseStatus graphsync.ResponseStatusCode
 	testutil.AssertReceive(ctx, t, finalResponseStatusChan, &finalResponseStatus, "should receive status")
 	require.Equal(t, graphsync.RequestCompletedFull, finalResponseStatus)
+
+	// verify stats
+	var chainSize uint64
+	for _, blk := range blockChain.AllBlocks() {
+		chainSize += uint64(len(blk.RawData()))
+	}
+	requestorStats := requestor.Stats()
+	require.Equal(t, uint64(1), requestorStats.OutgoingRequests)
+	require.Equal(t, uint64(blockChainLength), requestorStats.BlocksReceived)
+	require.Equal(t, chainSize, requestorStats.BytesReceived)
+	responderStats := responder.Stats()
+	require.Equal(t, uint64(1), responderStats.IncomingRequests)
+	require.Equal(t, uint64(blockChainLength), responderStats.BlocksSent)
+	require.Equal(t, chainSize, responderStats.BytesSent)
+	require.Zero(t, responderStats.DeduplicatedBlocks)
+}
+
+func TestFetchToStore(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// setup receiving peer to just record message coming in
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 100, blockChainLength)
+
+	// initialize graphsync on second node to response to requests
+	td.GraphSyncHost2()
+
+	// store to fetch into on the requestor
+	fetchStore := make(map[ipld.Link][]byte)
+	fetchLoader, fetchStorer := testutil.NewTestStore(fetchStore)
+
+	stats, err := requestor.FetchToStore(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), fetchLoader, fetchStorer)
+	require.NoError(t, err)
+	require.Len(t, fetchStore, blockChainLength, "did not store all blocks")
+	require.Len(t, td.blockStore1, 0, "should not store blocks in the default store")
+	require.Equal(t, uint64(blockChainLength), stats.Blocks)
+
+	var chainSize uint64
+	for _, blk := range blockChain.AllBlocks() {
+		chainSize += uint64(len(blk.RawData()))
+	}
+	require.Equal(t, chainSize, stats.BlockBytes)
+}
+
+func TestFetchDAG(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// setup receiving peer to just record message coming in
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 100, blockChainLength)
+
+	// initialize graphsync on second node to response to requests
+	td.GraphSyncHost2()
+
+	rootNode, err := requestor.FetchDAG(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), blockChain.Chooser)
+	require.NoError(t, err)
+	require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+	_, ok := rootNode.(chaintypes.Block)
+	require.True(t, ok, "root node should be built with the chooser")
+	parents, err := rootNode.LookupByString("Parents")
+	require.NoError(t, err)
+	require.Equal(t, 1, parents.Length())
 }
 
 func TestGraphsyncRoundTripPartial(t *testing.T) {
@@ -646,6 +724,39 @@ func TestConnectFail(t *testing.T) {
 	require.EqualError(t, err, graphsync.RequestContextCancelledErr{}.Error())
 }
 
+func TestReceiverErrorListeners(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	responder := td.GraphSyncHost1()
+
+	type receiverError struct {
+		p   peer.ID
+		err error
+	}
+	receiverErrors := make(chan receiverError, 1)
+	responder.RegisterReceiverErrorListener(func(p peer.ID, err error) {
+		select {
+		case receiverErrors <- receiverError{p, err}:
+		default:
+		}
+	})
+
+	// send a message graphsync can't decode
+	s, err := td.host2.NewStream(ctx, td.host1.ID(), gsnet.ProtocolGraphsync)
+	require.NoError(t, err)
+	err = msgio.NewVarintWriter(s).WriteMsg([]byte("not a graphsync message"))
+	require.NoError(t, err)
+
+	var received receiverError
+	testutil.AssertReceive(ctx, t, receiverErrors, &received, "should receive receiver error")
+	require.Equal(t, td.host2.ID(), received.p)
+	require.Error(t, received.err)
+}
+
 func TestGraphsyncRoundTripAlternatePersistenceAndNodes(t *testing.T) {
 	// create network
 	ctx := context.Background()
@@ -709,6 +820,110 @@ func TestGraphsyncRoundTripAlternatePersistenceAndNodes(t *testing.T) {
 	require.Len(t, altStore1, blockChainLength, "did not store all blocks in alternate store")
 }
 
+func TestGraphsyncRoundTripDefaultNodePrototypeChooser(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 100, blockChainLength)
+
+	// both sides build typed nodes without any hooks choosing them
+	requestor := td.GraphSyncHost1(DefaultNodePrototypeChooser(blockChain.Chooser))
+	td.GraphSyncHost2(DefaultNodePrototypeChooser(blockChain.Chooser))
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+
+	blockChain.VerifyWholeChainWithTypes(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+}
+
+func TestClose(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 100, blockChainLength)
+
+	requestor := td.GraphSyncHost1(ShutdownGracePeriod(time.Second))
+	responder := td.GraphSyncHost2(ShutdownGracePeriod(time.Second))
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+
+	// with nothing in progress, both sides close without waiting out the
+	// grace period
+	start := time.Now()
+	require.NoError(t, responder.Close())
+	require.NoError(t, requestor.Close())
+	require.True(t, time.Since(start) < time.Second, "should not wait out the grace period")
+
+	// a closed requestor fails new requests immediately
+	require.NoError(t, requestor.Close())
+	progressChan, errChan = requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+	testutil.VerifyEmptyResponse(ctx, t, progressChan)
+	var err error
+	testutil.AssertReceive(ctx, t, errChan, &err, "should receive an error")
+	require.Equal(t, graphsync.RequestFailedClosedErr{}, err)
+}
+
+func TestSubscribe(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.loader2, td.storer2, 100, blockChainLength)
+
+	requestor := td.GraphSyncHost1()
+	responder := td.GraphSyncHost2()
+
+	subscribeCtx, subscribeCancel := context.WithCancel(ctx)
+	requestorEvents := requestor.Subscribe(subscribeCtx)
+	responderEvents := responder.Subscribe(subscribeCtx)
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+
+	collectEvents := func(events <-chan graphsync.Event, p peer.ID, blockKind graphsync.EventKind) map[graphsync.EventKind]int {
+		counts := make(map[graphsync.EventKind]int)
+		for counts[graphsync.EventRequestCompleted] == 0 || counts[blockKind] < blockChainLength {
+			var event graphsync.Event
+			testutil.AssertReceive(ctx, t, events, &event, "should receive events")
+			require.Equal(t, p, event.Peer)
+			counts[event.Kind]++
+		}
+		return counts
+	}
+
+	requestorCounts := collectEvents(requestorEvents, td.host2.ID(), graphsync.EventBlockReceived)
+	require.Equal(t, 1, requestorCounts[graphsync.EventRequestQueued])
+	require.Equal(t, 1, requestorCounts[graphsync.EventRequestStarted])
+	require.Equal(t, blockChainLength, requestorCounts[graphsync.EventBlockReceived])
+	require.Equal(t, 0, requestorCounts[graphsync.EventRequestErrored])
+
+	responderCounts := collectEvents(responderEvents, td.host1.ID(), graphsync.EventBlockSent)
+	require.Equal(t, 1, responderCounts[graphsync.EventRequestQueued])
+	require.Equal(t, 1, responderCounts[graphsync.EventRequestStarted])
+	require.Equal(t, blockChainLength, responderCounts[graphsync.EventBlockSent])
+	require.Equal(t, 0, responderCounts[graphsync.EventRequestErrored])
+
+	// cancelling the subscription closes the channel
+	subscribeCancel()
+	for range requestorEvents {
+	}
+}
+
 func TestGraphsyncRoundTripMultipleAlternatePersistence(t *testing.T) {
 	// create network
 	ctx := context.Background()
@@ -984,8 +1199,16 @@ func TestGraphsyncBlockListeners(t *testing.T) {
 	blocksSent := 0
 	blocksOutgoing := 0
 	blocksIncoming := 0
+	var bytesSent, bytesSentOnWire, batchedBytesOnWire uint64
 	responder.RegisterBlockSentListener(func(p peer.ID, request graphsync.RequestData, block graphsync.BlockData) {
 		blocksSent++
+		bytesSent += block.BlockSize()
+		bytesSentOnWire += block.BlockSizeOnWire()
+	})
+	responder.RegisterBlocksSentListener(func(p peer.ID, request graphsync.RequestData, blocks []graphsync.BlockData) {
+		for _, block := range blocks {
+			batchedBytesOnWire += block.BlockSizeOnWire()
+		}
 	})
 	requestor.RegisterIncomingBlockHook(func(p peer.ID, r graphsync.ResponseData, b graphsync.BlockData, h graphsync.IncomingBlockHookActions) {
 		blocksIncoming++
@@ -1041,6 +1264,15 @@ func TestGraphsyncBlockListeners(t *testing.T) {
 	require.Equal(t, blockChainLength, blocksOutgoing)
 	require.Equal(t, blockChainLength, blocksIncoming)
 	require.Equal(t, blockChainLength, blocksSent)
+
+	// every block in the chain is unique, so all of it goes over the wire
+	var chainSize uint64
+	for _, blk := range blockChain.AllBlocks() {
+		chainSize += uint64(len(blk.RawData()))
+	}
+	require.Equal(t, chainSize, bytesSent)
+	require.Equal(t, chainSize, bytesSentOnWire)
+	require.Equal(t, chainSize, batchedBytesOnWire)
 }
 
 type gsTestData struct {
@@ -0,0 +1,22 @@
+package ipldutil
+
+import (
+	ipld "github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// IdentityData returns the block data inlined in the given link, if it is a
+// CID using the identity multihash. Such blocks never need to be sent over the
+// wire, as their data can be recovered from the CID alone
+func IdentityData(link ipld.Link) ([]byte, bool) {
+	cidLink, ok := link.(cidlink.Link)
+	if !ok || !cidLink.Cid.Defined() || cidLink.Cid.Prefix().MhType != mh.IDENTITY {
+		return nil, false
+	}
+	decoded, err := mh.Decode(cidLink.Cid.Hash())
+	if err != nil {
+		return nil, false
+	}
+	return decoded.Digest, true
+}
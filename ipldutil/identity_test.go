@@ -0,0 +1,24 @@
+package ipldutil
+
+import (
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestIdentityData(t *testing.T) {
+	block := testutil.GenerateIdentityBlocks(1, 32)[0]
+
+	inlined, ok := IdentityData(cidlink.Link{Cid: block.Cid()})
+	require.True(t, ok)
+	require.Equal(t, block.RawData(), inlined)
+
+	_, ok = IdentityData(testutil.NewTestLink())
+	require.False(t, ok)
+	_, ok = IdentityData(cidlink.Link{Cid: cid.Undef})
+	require.False(t, ok)
+}
@@ -0,0 +1,38 @@
+package ipldutil
+
+import (
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/traversal"
+)
+
+// reifyingChooser wraps a chooser so nodes it builds are passed to reify once
+// built, letting an Advanced Data Layout stand in for the substrate node
+func reifyingChooser(chooser traversal.LinkTargetNodePrototypeChooser, reify func(ipld.LinkContext, ipld.Node) ipld.Node) traversal.LinkTargetNodePrototypeChooser {
+	return func(lnk ipld.Link, lnkCtx ipld.LinkContext) (ipld.NodePrototype, error) {
+		np, err := chooser(lnk, lnkCtx)
+		if err != nil {
+			return nil, err
+		}
+		return reifyingPrototype{np, lnkCtx, reify}, nil
+	}
+}
+
+type reifyingPrototype struct {
+	ipld.NodePrototype
+	lnkCtx ipld.LinkContext
+	reify  func(ipld.LinkContext, ipld.Node) ipld.Node
+}
+
+func (rp reifyingPrototype) NewBuilder() ipld.NodeBuilder {
+	return &reifyingBuilder{rp.NodePrototype.NewBuilder(), rp.lnkCtx, rp.reify}
+}
+
+type reifyingBuilder struct {
+	ipld.NodeBuilder
+	lnkCtx ipld.LinkContext
+	reify  func(ipld.LinkContext, ipld.Node) ipld.Node
+}
+
+func (rb *reifyingBuilder) Build() ipld.Node {
+	return rb.reify(rb.lnkCtx, rb.NodeBuilder.Build())
+}
@@ -8,6 +8,8 @@ import (
 	"github.com/ipld/go-ipld-prime"
 	"github.com/ipld/go-ipld-prime/traversal"
 	"github.com/ipld/go-ipld-prime/traversal/selector"
+
+	"github.com/ipfs/go-graphsync"
 )
 
 var defaultVisitor traversal.AdvVisitFn = func(traversal.Progress, ipld.Node, traversal.VisitReason) error { return nil }
@@ -26,6 +28,7 @@ type TraversalBuilder struct {
 	Selector ipld.Node
 	Visitor  traversal.AdvVisitFn
 	Chooser  traversal.LinkTargetNodePrototypeChooser
+	Reifier  graphsync.NodeReifier
 }
 
 // Traverser is an interface for performing a selector traversal that operates iteratively --
@@ -67,6 +70,7 @@ func (tb TraversalBuilder) Start(parentCtx context.Context) Traverser {
 		selector:     tb.Selector,
 		visitor:      defaultVisitor,
 		chooser:      defaultChooser,
+		reifier:      tb.Reifier,
 		awaitRequest: make(chan struct{}, 1),
 		stateChan:    make(chan state, 1),
 		responses:    make(chan nextResponse),
@@ -92,6 +96,7 @@ type traverser struct {
 	selector       ipld.Node
 	visitor        traversal.AdvVisitFn
 	chooser        traversal.LinkTargetNodePrototypeChooser
+	reifier        graphsync.NodeReifier
 	currentLink    ipld.Link
 	currentContext ipld.LinkContext
 	isDone         bool
@@ -134,7 +139,11 @@ func (t *traverser) start() {
 	}
 	go func() {
 		defer close(t.stopped)
+		var reifyErr error
 		loader := func(lnk ipld.Link, lnkCtx ipld.LinkContext) (io.Reader, error) {
+			if reifyErr != nil {
+				return nil, reifyErr
+			}
 			select {
 			case <-t.ctx.Done():
 				return nil, ContextCancelError{}
@@ -147,7 +156,20 @@ func (t *traverser) start() {
 				return response.input, response.err
 			}
 		}
-		ns, err := t.chooser(t.root, ipld.LinkContext{})
+		chooser := t.chooser
+		if t.reifier != nil {
+			chooser = reifyingChooser(t.chooser, func(lnkCtx ipld.LinkContext, substrate ipld.Node) ipld.Node {
+				reified, err := t.reifier(lnkCtx, substrate, loader)
+				if err != nil {
+					if reifyErr == nil {
+						reifyErr = err
+					}
+					return substrate
+				}
+				return reified
+			})
+		}
+		ns, err := chooser(t.root, ipld.LinkContext{})
 		if err != nil {
 			t.writeDone(err)
 			return
@@ -159,6 +181,10 @@ func (t *traverser) start() {
 			return
 		}
 		nd := nb.Build()
+		if reifyErr != nil {
+			t.writeDone(reifyErr)
+			return
+		}
 
 		sel, err := selector.ParseSelector(t.selector)
 		if err != nil {
@@ -169,9 +195,12 @@ func (t *traverser) start() {
 			Cfg: &traversal.Config{
 				Ctx:                            t.ctx,
 				LinkLoader:                     loader,
-				LinkTargetNodePrototypeChooser: t.chooser,
+				LinkTargetNodePrototypeChooser: chooser,
 			},
 		}.WalkAdv(nd, sel, t.visitor)
+		if reifyErr != nil {
+			err = reifyErr
+		}
 		t.writeDone(err)
 	}()
 }
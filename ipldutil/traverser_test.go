@@ -3,10 +3,12 @@ package ipldutil
 import (
 	"bytes"
 	"context"
+	"errors"
 	"testing"
 
 	blocks "github.com/ipfs/go-block-format"
 	ipld "github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
 	"github.com/ipld/go-ipld-prime/traversal"
@@ -72,6 +74,55 @@ func TestTraverser(t *testing.T) {
 		close(inProgressChan)
 		testutil.AssertDoesReceive(ctx, t, done, "should have completed verification but did not")
 	})
+
+	t.Run("reifies nodes", func(t *testing.T) {
+		testdata := testutil.NewTestIPLDTree()
+		ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+		sel := ssb.ExploreRecursive(selector.RecursionLimitNone(), ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+		// stands in for an ADL: the root loads a "shard" with the traversal's
+		// loader, then presents a logical map linking only to the beta leaf
+		reifier := func(lnkCtx ipld.LinkContext, substrate ipld.Node, loader ipld.Loader) (ipld.Node, error) {
+			if lnkCtx.LinkPath.String() != "" {
+				return substrate, nil
+			}
+			if _, err := loader(testdata.LeafAlphaLnk, ipld.LinkContext{}); err != nil {
+				return nil, err
+			}
+			return fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+				na.AssembleEntry("beta").AssignLink(testdata.LeafBetaLnk)
+			}), nil
+		}
+		traverser := TraversalBuilder{
+			Root:     testdata.RootNodeLnk,
+			Selector: sel,
+			Reifier:  reifier,
+		}.Start(ctx)
+		checkTraverseSequence(ctx, t, traverser, []blocks.Block{
+			testdata.RootBlock,
+			testdata.LeafAlphaBlock,
+			testdata.LeafBetaBlock,
+		})
+	})
+
+	t.Run("fails when reifying fails", func(t *testing.T) {
+		testdata := testutil.NewTestIPLDTree()
+		ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+		sel := ssb.ExploreRecursive(selector.RecursionLimitNone(), ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+		reifyErr := errors.New("not a valid ADL")
+		traverser := TraversalBuilder{
+			Root:     testdata.RootNodeLnk,
+			Selector: sel,
+			Reifier: func(ipld.LinkContext, ipld.Node, ipld.Loader) (ipld.Node, error) {
+				return nil, reifyErr
+			},
+		}.Start(ctx)
+		lnk, _ := traverser.CurrentRequest()
+		require.Equal(t, testdata.RootNodeLnk, lnk)
+		require.NoError(t, traverser.Advance(bytes.NewBuffer(testdata.RootBlock.RawData())))
+		isComplete, err := traverser.IsComplete()
+		require.True(t, isComplete)
+		require.Equal(t, reifyErr, err)
+	})
 }
 
 func checkTraverseSequence(ctx context.Context, t *testing.T, traverser Traverser, expectedBlks []blocks.Block) {
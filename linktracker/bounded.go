@@ -0,0 +1,176 @@
+package linktracker
+
+import (
+	"container/list"
+
+	"github.com/ipld/go-ipld-prime"
+
+	"github.com/ipfs/go-graphsync"
+)
+
+// Tracker is the interface shared by link tracker implementations
+type Tracker interface {
+	BlockRefCount(link ipld.Link) int
+	IsKnownMissingLink(requestID graphsync.RequestID, link ipld.Link) bool
+	RecordLinkTraversal(requestID graphsync.RequestID, link ipld.Link, hasBlock bool)
+	UndoBlockTraversal(requestID graphsync.RequestID, link ipld.Link)
+	FinishRequest(requestID graphsync.RequestID) (hasAllBlocks bool)
+	Empty() bool
+}
+
+var _ Tracker = (*LinkTracker)(nil)
+var _ Tracker = (*BoundedLinkTracker)(nil)
+
+// BoundedLinkTracker is a link tracker that remembers at most a fixed number
+// of links, so memory use does not grow with the size of responses. When full,
+// the least recently traversed link with a block is forgotten, and its block
+// may be sent again by another in progress request. Missing links past the
+// limit are not remembered individually, though a request is still known to
+// be missing blocks.
+type BoundedLinkTracker struct {
+	maxLinks       int
+	order          *list.List
+	links          map[ipld.Link]*list.Element
+	traversedLinks map[graphsync.RequestID]map[ipld.Link]struct{}
+	missingBlocks  map[graphsync.RequestID]map[ipld.Link]struct{}
+	missingCount   int
+}
+
+type trackedLink struct {
+	link       ipld.Link
+	refCount   int
+	traversals map[graphsync.RequestID]int
+}
+
+// NewBounded makes a new link tracker that remembers at most maxLinks links
+// with blocks, and maxLinks missing links
+func NewBounded(maxLinks int) *BoundedLinkTracker {
+	return &BoundedLinkTracker{
+		maxLinks:       maxLinks,
+		order:          list.New(),
+		links:          make(map[ipld.Link]*list.Element),
+		traversedLinks: make(map[graphsync.RequestID]map[ipld.Link]struct{}),
+		missingBlocks:  make(map[graphsync.RequestID]map[ipld.Link]struct{}),
+	}
+}
+
+// BlockRefCount returns the number of times a present block has been traversed
+// by in progress requests, or zero if the link has been forgotten
+func (blt *BoundedLinkTracker) BlockRefCount(link ipld.Link) int {
+	elem, ok := blt.links[link]
+	if !ok {
+		return 0
+	}
+	return elem.Value.(*trackedLink).refCount
+}
+
+// IsKnownMissingLink returns whether the given request recorded the given link as missing
+func (blt *BoundedLinkTracker) IsKnownMissingLink(requestID graphsync.RequestID, link ipld.Link) bool {
+	missingBlocks, ok := blt.missingBlocks[requestID]
+	if !ok {
+		return false
+	}
+	_, ok = missingBlocks[link]
+	return ok
+}
+
+// RecordLinkTraversal records that we traversed a link during a request, and
+// whether we had the block when we did it.
+func (blt *BoundedLinkTracker) RecordLinkTraversal(requestID graphsync.RequestID, link ipld.Link, hasBlock bool) {
+	if !hasBlock {
+		missingBlocks, ok := blt.missingBlocks[requestID]
+		if !ok {
+			missingBlocks = make(map[ipld.Link]struct{})
+			blt.missingBlocks[requestID] = missingBlocks
+		}
+		if _, ok := missingBlocks[link]; !ok && blt.missingCount < blt.maxLinks {
+			missingBlocks[link] = struct{}{}
+			blt.missingCount++
+		}
+		return
+	}
+	elem, ok := blt.links[link]
+	if ok {
+		blt.order.MoveToFront(elem)
+	} else {
+		elem = blt.order.PushFront(&trackedLink{link: link, traversals: make(map[graphsync.RequestID]int)})
+		blt.links[link] = elem
+		if blt.order.Len() > blt.maxLinks {
+			blt.forget(blt.order.Back())
+		}
+	}
+	tracked := elem.Value.(*trackedLink)
+	tracked.refCount++
+	tracked.traversals[requestID]++
+	traversedLinks, ok := blt.traversedLinks[requestID]
+	if !ok {
+		traversedLinks = make(map[ipld.Link]struct{})
+		blt.traversedLinks[requestID] = traversedLinks
+	}
+	traversedLinks[link] = struct{}{}
+}
+
+// UndoBlockTraversal removes one traversal of a link with its block present
+// recorded by the given request, as if the block was never sent
+func (blt *BoundedLinkTracker) UndoBlockTraversal(requestID graphsync.RequestID, link ipld.Link) {
+	elem, ok := blt.links[link]
+	if !ok {
+		return
+	}
+	tracked := elem.Value.(*trackedLink)
+	if tracked.traversals[requestID] == 0 {
+		return
+	}
+	tracked.traversals[requestID]--
+	if tracked.traversals[requestID] == 0 {
+		delete(tracked.traversals, requestID)
+		blt.untrack(requestID, link)
+	}
+	tracked.refCount--
+	if tracked.refCount <= 0 {
+		blt.forget(elem)
+	}
+}
+
+// FinishRequest records that we have completed the given request, and returns
+// true if all links traversed had blocks present.
+func (blt *BoundedLinkTracker) FinishRequest(requestID graphsync.RequestID) (hasAllBlocks bool) {
+	missingBlocks, ok := blt.missingBlocks[requestID]
+	hasAllBlocks = !ok
+	blt.missingCount -= len(missingBlocks)
+	delete(blt.missingBlocks, requestID)
+	for link := range blt.traversedLinks[requestID] {
+		elem := blt.links[link]
+		tracked := elem.Value.(*trackedLink)
+		tracked.refCount -= tracked.traversals[requestID]
+		delete(tracked.traversals, requestID)
+		if tracked.refCount <= 0 {
+			blt.forget(elem)
+		}
+	}
+	delete(blt.traversedLinks, requestID)
+	return
+}
+
+// forget removes a link with its block present, along with the record of
+// which requests traversed it
+func (blt *BoundedLinkTracker) forget(elem *list.Element) {
+	tracked := blt.order.Remove(elem).(*trackedLink)
+	delete(blt.links, tracked.link)
+	for requestID := range tracked.traversals {
+		blt.untrack(requestID, tracked.link)
+	}
+}
+
+func (blt *BoundedLinkTracker) untrack(requestID graphsync.RequestID, link ipld.Link) {
+	traversedLinks := blt.traversedLinks[requestID]
+	delete(traversedLinks, link)
+	if len(traversedLinks) == 0 {
+		delete(blt.traversedLinks, requestID)
+	}
+}
+
+// Empty returns true if the link tracker is empty
+func (blt *BoundedLinkTracker) Empty() bool {
+	return len(blt.missingBlocks) == 0 && len(blt.links) == 0
+}
@@ -0,0 +1,102 @@
+package linktracker
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestBoundedEvictsLeastRecentlyTraversed(t *testing.T) {
+	linkTracker := NewBounded(2)
+	requestID := graphsync.RequestID(rand.Int31())
+	link1 := testutil.NewTestLink()
+	link2 := testutil.NewTestLink()
+	link3 := testutil.NewTestLink()
+
+	linkTracker.RecordLinkTraversal(requestID, link1, true)
+	linkTracker.RecordLinkTraversal(requestID, link2, true)
+	linkTracker.RecordLinkTraversal(requestID, link1, true)
+	linkTracker.RecordLinkTraversal(requestID, link3, true)
+
+	require.Equal(t, 2, linkTracker.BlockRefCount(link1))
+	require.Equal(t, 0, linkTracker.BlockRefCount(link2), "least recently traversed link is forgotten")
+	require.Equal(t, 1, linkTracker.BlockRefCount(link3))
+
+	require.True(t, linkTracker.FinishRequest(requestID))
+	require.True(t, linkTracker.Empty())
+}
+
+func TestBoundedMissingLinks(t *testing.T) {
+	linkTracker := NewBounded(1)
+	requestID := graphsync.RequestID(rand.Int31())
+	link1 := testutil.NewTestLink()
+	link2 := testutil.NewTestLink()
+
+	linkTracker.RecordLinkTraversal(requestID, link1, false)
+	linkTracker.RecordLinkTraversal(requestID, link2, false)
+
+	require.True(t, linkTracker.IsKnownMissingLink(requestID, link1))
+	require.False(t, linkTracker.IsKnownMissingLink(requestID, link2), "missing links past the limit are not remembered")
+	require.False(t, linkTracker.FinishRequest(requestID), "request is still known to be missing blocks")
+	require.True(t, linkTracker.Empty())
+
+	otherRequestID := graphsync.RequestID(rand.Int31())
+	linkTracker.RecordLinkTraversal(otherRequestID, link2, false)
+	require.True(t, linkTracker.IsKnownMissingLink(otherRequestID, link2), "finishing a request frees capacity")
+}
+
+func TestBoundedMatchesUnboundedUnderLimit(t *testing.T) {
+	bounded := NewBounded(100)
+	unbounded := New()
+	links := make([]linkTraversed, 0, 20)
+	for i := 0; i < 20; i++ {
+		links = append(links, linkTraversed{testutil.NewTestLink(), rand.Intn(4) != 0})
+	}
+	requestIDs := []graphsync.RequestID{graphsync.RequestID(rand.Int31()), graphsync.RequestID(rand.Int31())}
+	for i := 0; i < 50; i++ {
+		requestID := requestIDs[rand.Intn(len(requestIDs))]
+		lt := links[rand.Intn(len(links))]
+		bounded.RecordLinkTraversal(requestID, lt.link, lt.blockPresent)
+		unbounded.RecordLinkTraversal(requestID, lt.link, lt.blockPresent)
+	}
+	for _, lt := range links {
+		require.Equal(t, unbounded.BlockRefCount(lt.link), bounded.BlockRefCount(lt.link))
+		for _, requestID := range requestIDs {
+			require.Equal(t, unbounded.IsKnownMissingLink(requestID, lt.link), bounded.IsKnownMissingLink(requestID, lt.link))
+		}
+	}
+	for _, requestID := range requestIDs {
+		require.Equal(t, unbounded.FinishRequest(requestID), bounded.FinishRequest(requestID))
+	}
+	require.True(t, bounded.Empty())
+}
+
+func TestBoundedFinishRequestOnlyTouchesItsLinks(t *testing.T) {
+	linkTracker := NewBounded(2)
+	requestID1 := graphsync.RequestID(rand.Int31())
+	requestID2 := requestID1 + 1
+	link1 := testutil.NewTestLink()
+	link2 := testutil.NewTestLink()
+	link3 := testutil.NewTestLink()
+
+	linkTracker.RecordLinkTraversal(requestID1, link1, true)
+	linkTracker.RecordLinkTraversal(requestID2, link1, true)
+	linkTracker.RecordLinkTraversal(requestID1, link2, true)
+	linkTracker.RecordLinkTraversal(requestID2, link3, true)
+	require.Len(t, linkTracker.traversedLinks[requestID1], 1, "evicted links are no longer tracked for the request")
+
+	require.Len(t, linkTracker.traversedLinks[requestID2], 1)
+
+	require.True(t, linkTracker.FinishRequest(requestID1))
+	require.Equal(t, 0, linkTracker.BlockRefCount(link2))
+	require.Equal(t, 1, linkTracker.BlockRefCount(link3))
+	linkTracker.UndoBlockTraversal(requestID2, link3)
+	require.Equal(t, 0, linkTracker.BlockRefCount(link3))
+	require.True(t, linkTracker.FinishRequest(requestID2))
+	require.True(t, linkTracker.Empty())
+	require.Empty(t, linkTracker.traversedLinks)
+}
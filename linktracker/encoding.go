@@ -0,0 +1,147 @@
+package linktracker
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/ipldutil"
+)
+
+// Encode serializes the state of the link tracker -- the links traversed
+// by each in progress request and whether their blocks were present -- so it
+// can be restored with Decode, for example after a responder restarts
+func (lt *LinkTracker) Encode() ([]byte, error) {
+	requestIDs := make([]graphsync.RequestID, 0, len(lt.linksWithBlocksTraversedByRequest)+len(lt.missingBlocks))
+	for requestID := range lt.linksWithBlocksTraversedByRequest {
+		requestIDs = append(requestIDs, requestID)
+	}
+	for requestID := range lt.missingBlocks {
+		if _, ok := lt.linksWithBlocksTraversedByRequest[requestID]; !ok {
+			requestIDs = append(requestIDs, requestID)
+		}
+	}
+	sort.Slice(requestIDs, func(i, j int) bool { return requestIDs[i] < requestIDs[j] })
+	for _, links := range lt.linksWithBlocksTraversedByRequest {
+		if err := checkCidLinks(links); err != nil {
+			return nil, err
+		}
+	}
+	for _, missingBlocks := range lt.missingBlocks {
+		if err := checkCidLinks(linkSet(missingBlocks)); err != nil {
+			return nil, err
+		}
+	}
+	list := fluent.MustBuildList(basicnode.Prototype.List, len(requestIDs), func(la fluent.ListAssembler) {
+		for _, requestID := range requestIDs {
+			traversed := lt.linksWithBlocksTraversedByRequest[requestID]
+			missing := linkSet(lt.missingBlocks[requestID])
+			la.AssembleValue().CreateMap(3, func(ma fluent.MapAssembler) {
+				ma.AssembleEntry("id").AssignInt(int(requestID))
+				ma.AssembleEntry("traversed").CreateList(len(traversed), assembleLinks(traversed))
+				ma.AssembleEntry("missing").CreateList(len(missing), assembleLinks(missing))
+			})
+		}
+	})
+	return ipldutil.EncodeNode(list)
+}
+
+// Decode restores a link tracker from state serialized with Encode
+func Decode(data []byte) (*LinkTracker, error) {
+	list, err := ipldutil.DecodeNode(data)
+	if err != nil {
+		return nil, err
+	}
+	lt := New()
+	iter := list.ListIterator()
+	if iter == nil {
+		return nil, errors.New("link tracker state is not a list")
+	}
+	for !iter.Done() {
+		_, request, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		idNode, err := request.LookupByString("id")
+		if err != nil {
+			return nil, err
+		}
+		id, err := idNode.AsInt()
+		if err != nil {
+			return nil, err
+		}
+		requestID := graphsync.RequestID(id)
+		traversed, err := decodeLinks(request, "traversed")
+		if err != nil {
+			return nil, err
+		}
+		missing, err := decodeLinks(request, "missing")
+		if err != nil {
+			return nil, err
+		}
+		for _, link := range traversed {
+			lt.RecordLinkTraversal(requestID, link, true)
+		}
+		for _, link := range missing {
+			lt.RecordLinkTraversal(requestID, link, false)
+		}
+	}
+	return lt, nil
+}
+
+func linkSet(links map[ipld.Link]struct{}) []ipld.Link {
+	list := make([]ipld.Link, 0, len(links))
+	for link := range links {
+		list = append(list, link)
+	}
+	return list
+}
+
+func checkCidLinks(links []ipld.Link) error {
+	for _, link := range links {
+		if _, ok := link.(cidlink.Link); !ok {
+			return errors.New("can only encode CID links")
+		}
+	}
+	return nil
+}
+
+func assembleLinks(links []ipld.Link) func(fluent.ListAssembler) {
+	return func(la fluent.ListAssembler) {
+		for _, link := range links {
+			la.AssembleValue().AssignLink(link)
+		}
+	}
+}
+
+func decodeLinks(request ipld.Node, key string) ([]ipld.Link, error) {
+	list, err := request.LookupByString(key)
+	if err != nil {
+		return nil, err
+	}
+	var links []ipld.Link
+	iter := list.ListIterator()
+	if iter == nil {
+		return nil, errors.New("link tracker links are not a list")
+	}
+	for !iter.Done() {
+		_, next, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		link, err := next.AsLink()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := link.(cidlink.Link); !ok {
+			return nil, errors.New("contained non CID link")
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
@@ -0,0 +1,95 @@
+package linktracker
+
+import (
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	link1 := testutil.NewTestLink()
+	link2 := testutil.NewTestLink()
+	link3 := testutil.NewTestLink()
+	requestID1 := graphsync.RequestID(1)
+	requestID2 := graphsync.RequestID(2)
+	requestID3 := graphsync.RequestID(3)
+
+	linkTracker := New()
+	linkTracker.RecordLinkTraversal(requestID1, link1, true)
+	linkTracker.RecordLinkTraversal(requestID1, link2, false)
+	linkTracker.RecordLinkTraversal(requestID2, link1, true)
+	linkTracker.RecordLinkTraversal(requestID2, link3, true)
+	linkTracker.RecordLinkTraversal(requestID3, link3, false)
+
+	data, err := linkTracker.Encode()
+	require.NoError(t, err)
+	restored, err := Decode(data)
+	require.NoError(t, err)
+
+	require.Equal(t, 2, restored.BlockRefCount(link1))
+	require.Equal(t, 0, restored.BlockRefCount(link2))
+	require.Equal(t, 1, restored.BlockRefCount(link3))
+	require.True(t, restored.IsKnownMissingLink(requestID1, link2))
+	require.True(t, restored.IsKnownMissingLink(requestID3, link3))
+	require.False(t, restored.IsKnownMissingLink(requestID2, link3))
+
+	require.False(t, restored.FinishRequest(requestID1))
+	require.True(t, restored.FinishRequest(requestID2))
+	require.False(t, restored.FinishRequest(requestID3))
+	require.True(t, restored.Empty())
+}
+
+func TestDecodeEmpty(t *testing.T) {
+	data, err := New().Encode()
+	require.NoError(t, err)
+	restored, err := Decode(data)
+	require.NoError(t, err)
+	require.True(t, restored.Empty())
+
+	_, err = Decode([]byte("not a link tracker"))
+	require.Error(t, err)
+}
+
+func TestMoveRequest(t *testing.T) {
+	link1 := testutil.NewTestLink()
+	link2 := testutil.NewTestLink()
+	requestID1 := graphsync.RequestID(1)
+	requestID2 := graphsync.RequestID(2)
+
+	linkTracker := New()
+	linkTracker.RecordLinkTraversal(requestID1, link1, true)
+	linkTracker.RecordLinkTraversal(requestID1, link2, false)
+	linkTracker.RecordLinkTraversal(requestID2, link1, true)
+
+	moved := New()
+	linkTracker.MoveRequest(requestID1, moved)
+	require.Equal(t, 1, moved.BlockRefCount(link1))
+	require.True(t, moved.IsKnownMissingLink(requestID1, link2))
+	require.Equal(t, 1, linkTracker.BlockRefCount(link1))
+	require.False(t, linkTracker.IsKnownMissingLink(requestID1, link2))
+	require.Empty(t, linkTracker.LinksWithBlocks(requestID1))
+}
+
+func TestStore(t *testing.T) {
+	p := testutil.GeneratePeers(1)[0]
+	store := NewStore(datastore.NewMapDatastore(), datastore.NewKey("/linktracker"))
+
+	data, err := store.Load(p)
+	require.NoError(t, err)
+	require.Nil(t, data)
+
+	require.NoError(t, store.Save(p, []byte("state")))
+	data, err = store.Load(p)
+	require.NoError(t, err)
+	require.Equal(t, []byte("state"), data)
+
+	require.NoError(t, store.Save(p, nil))
+	require.NoError(t, store.Save(p, nil))
+	data, err = store.Load(p)
+	require.NoError(t, err)
+	require.Nil(t, data)
+}
@@ -58,6 +58,28 @@ func (lt *LinkTracker) RecordLinkTraversal(requestID graphsync.RequestID, link i
 	}
 }
 
+// UndoBlockTraversal removes one traversal of a link with its block present
+// recorded by the given request, as if the block was never sent
+func (lt *LinkTracker) UndoBlockTraversal(requestID graphsync.RequestID, link ipld.Link) {
+	links := lt.linksWithBlocksTraversedByRequest[requestID]
+	for i := len(links) - 1; i >= 0; i-- {
+		if links[i] != link {
+			continue
+		}
+		links = append(links[:i], links[i+1:]...)
+		if len(links) == 0 {
+			delete(lt.linksWithBlocksTraversedByRequest, requestID)
+		} else {
+			lt.linksWithBlocksTraversedByRequest[requestID] = links
+		}
+		lt.traversalsWithBlocksInProgress[link]--
+		if lt.traversalsWithBlocksInProgress[link] <= 0 {
+			delete(lt.traversalsWithBlocksInProgress, link)
+		}
+		return
+	}
+}
+
 // FinishRequest records that we have completed the given request, and returns
 // true if all links traversed had blocks present.
 func (lt *LinkTracker) FinishRequest(requestID graphsync.RequestID) (hasAllBlocks bool) {
@@ -79,6 +101,24 @@ func (lt *LinkTracker) FinishRequest(requestID graphsync.RequestID) (hasAllBlock
 	return
 }
 
+// MoveRequest records the links traversed by the given request in another
+// tracker, then finishes the request in this one
+func (lt *LinkTracker) MoveRequest(requestID graphsync.RequestID, to Tracker) {
+	for _, link := range lt.linksWithBlocksTraversedByRequest[requestID] {
+		to.RecordLinkTraversal(requestID, link, true)
+	}
+	for link := range lt.missingBlocks[requestID] {
+		to.RecordLinkTraversal(requestID, link, false)
+	}
+	lt.FinishRequest(requestID)
+}
+
+// LinksWithBlocks returns the links the given request traversed with blocks
+// present, in the order they were traversed
+func (lt *LinkTracker) LinksWithBlocks(requestID graphsync.RequestID) []ipld.Link {
+	return lt.linksWithBlocksTraversedByRequest[requestID]
+}
+
 // Empty returns true if the link tracker is empty
 func (lt *LinkTracker) Empty() bool {
 	return len(lt.missingBlocks) == 0 && len(lt.traversalsWithBlocksInProgress) == 0
@@ -125,6 +125,36 @@ func TestFinishRequest(t *testing.T) {
 	}
 }
 
+func TestUndoBlockTraversal(t *testing.T) {
+	trackers := map[string]func() Tracker{
+		"unbounded": func() Tracker { return New() },
+		"bounded":   func() Tracker { return NewBounded(10) },
+	}
+	for name, newTracker := range trackers {
+		t.Run(name, func(t *testing.T) {
+			linkTracker := newTracker()
+			requestID := graphsync.RequestID(rand.Int31())
+			otherRequestID := graphsync.RequestID(rand.Int31())
+			link := testutil.NewTestLink()
+
+			linkTracker.RecordLinkTraversal(requestID, link, true)
+			linkTracker.RecordLinkTraversal(otherRequestID, link, true)
+			require.Equal(t, 2, linkTracker.BlockRefCount(link))
+
+			linkTracker.UndoBlockTraversal(requestID, link)
+			require.Equal(t, 1, linkTracker.BlockRefCount(link))
+			// undoing a traversal the request never made does nothing
+			linkTracker.UndoBlockTraversal(requestID, link)
+			require.Equal(t, 1, linkTracker.BlockRefCount(link))
+
+			require.True(t, linkTracker.FinishRequest(requestID))
+			require.Equal(t, 1, linkTracker.BlockRefCount(link))
+			require.True(t, linkTracker.FinishRequest(otherRequestID))
+			require.True(t, linkTracker.Empty())
+		})
+	}
+}
+
 func TestIsKnownMissingLink(t *testing.T) {
 	testCases := map[string]struct {
 		traversals         []bool
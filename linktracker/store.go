@@ -0,0 +1,42 @@
+package linktracker
+
+import (
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Store saves the encoded link tracker state for each peer in a datastore
+type Store struct {
+	ds     datastore.Datastore
+	prefix datastore.Key
+}
+
+// NewStore returns a store saving state in the given datastore under the given prefix
+func NewStore(ds datastore.Datastore, prefix datastore.Key) *Store {
+	return &Store{ds, prefix}
+}
+
+// Load returns the state saved for the given peer, or nil if none was saved
+func (s *Store) Load(p peer.ID) ([]byte, error) {
+	data, err := s.ds.Get(s.key(p))
+	if err == datastore.ErrNotFound {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Save saves state for the given peer, or removes saved state if data is nil
+func (s *Store) Save(p peer.ID, data []byte) error {
+	if data == nil {
+		err := s.ds.Delete(s.key(p))
+		if err == datastore.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	return s.ds.Put(s.key(p), data)
+}
+
+func (s *Store) key(p peer.ID) datastore.Key {
+	return s.prefix.ChildString(peer.Encode(p))
+}
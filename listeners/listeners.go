@@ -40,6 +40,73 @@ func (crl *CompletedResponseListeners) NotifyCompletedListeners(p peer.ID, reque
 	_ = crl.pubSub.Publish(internalCompletedResponseEvent{p, request, status})
 }
 
+// CompletedRequestListeners is a set of listeners for completed requests
+type CompletedRequestListeners struct {
+	pubSub *pubsub.PubSub
+}
+
+type internalCompletedRequestEvent struct {
+	p       peer.ID
+	request graphsync.RequestData
+	status  graphsync.ResponseStatusCode
+	err     error
+	stats   graphsync.RequestStats
+}
+
+func completedRequestDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
+	ie := event.(internalCompletedRequestEvent)
+	listener := subscriberFn.(graphsync.OnRequestCompletedListener)
+	listener(ie.p, ie.request, ie.status, ie.err, ie.stats)
+	return nil
+}
+
+// NewCompletedRequestListeners returns a new list of listeners for when requests complete
+func NewCompletedRequestListeners() *CompletedRequestListeners {
+	return &CompletedRequestListeners{pubSub: pubsub.New(completedRequestDispatcher)}
+}
+
+// Register registers a listener for completed requests
+func (crl *CompletedRequestListeners) Register(listener graphsync.OnRequestCompletedListener) graphsync.UnregisterHookFunc {
+	return graphsync.UnregisterHookFunc(crl.pubSub.Subscribe(listener))
+}
+
+// NotifyCompletedListeners notifies all listeners that a request has completed
+func (crl *CompletedRequestListeners) NotifyCompletedListeners(p peer.ID, request graphsync.RequestData, status graphsync.ResponseStatusCode, err error, stats graphsync.RequestStats) {
+	_ = crl.pubSub.Publish(internalCompletedRequestEvent{p, request, status, err, stats})
+}
+
+// HookPanicListeners is a set of listeners for hooks that panic
+type HookPanicListeners struct {
+	pubSub *pubsub.PubSub
+}
+
+type internalHookPanicEvent struct {
+	p   peer.ID
+	err graphsync.HookPanicErr
+}
+
+func hookPanicDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
+	ie := event.(internalHookPanicEvent)
+	listener := subscriberFn.(graphsync.OnHookPanicListener)
+	listener(ie.p, ie.err)
+	return nil
+}
+
+// NewHookPanicListeners returns a new list of listeners for hooks that panic
+func NewHookPanicListeners() *HookPanicListeners {
+	return &HookPanicListeners{pubSub: pubsub.New(hookPanicDispatcher)}
+}
+
+// Register registers a listener for hooks that panic
+func (hpl *HookPanicListeners) Register(listener graphsync.OnHookPanicListener) graphsync.UnregisterHookFunc {
+	return graphsync.UnregisterHookFunc(hpl.pubSub.Subscribe(listener))
+}
+
+// NotifyHookPanicListeners notifies all listeners that a hook panicked
+func (hpl *HookPanicListeners) NotifyHookPanicListeners(p peer.ID, err graphsync.HookPanicErr) {
+	_ = hpl.pubSub.Publish(internalHookPanicEvent{p, err})
+}
+
 // RequestorCancelledListeners is a set of listeners for when requestors cancel
 type RequestorCancelledListeners struct {
 	pubSub *pubsub.PubSub
@@ -72,9 +139,11 @@ func (rcl *RequestorCancelledListeners) NotifyCancelledListeners(p peer.ID, requ
 	_ = rcl.pubSub.Publish(internalRequestorCancelledEvent{p, request})
 }
 
-// BlockSentListeners is a set of listeners for when requestors cancel
+// BlockSentListeners is a set of listeners for when blocks are sent over the wire,
+// either individually or in batches per message
 type BlockSentListeners struct {
-	pubSub *pubsub.PubSub
+	pubSub      *pubsub.PubSub
+	batchPubSub *pubsub.PubSub
 }
 
 type internalBlockSentEvent struct {
@@ -90,9 +159,25 @@ func blockSentDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) e
 	return nil
 }
 
-// NewBlockSentListeners returns a new list of listeners for when requestors cancel
+type internalBlocksSentEvent struct {
+	p       peer.ID
+	request graphsync.RequestData
+	blocks  []graphsync.BlockData
+}
+
+func blocksSentDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
+	ie := event.(internalBlocksSentEvent)
+	listener := subscriberFn.(graphsync.OnBlocksSentListener)
+	listener(ie.p, ie.request, ie.blocks)
+	return nil
+}
+
+// NewBlockSentListeners returns a new list of listeners for when blocks are sent
 func NewBlockSentListeners() *BlockSentListeners {
-	return &BlockSentListeners{pubSub: pubsub.New(blockSentDispatcher)}
+	return &BlockSentListeners{
+		pubSub:      pubsub.New(blockSentDispatcher),
+		batchPubSub: pubsub.New(blocksSentDispatcher),
+	}
 }
 
 // Register registers an listener for completed responses
@@ -100,12 +185,24 @@ func (bsl *BlockSentListeners) Register(listener graphsync.OnBlockSentListener)
 	return graphsync.UnregisterHookFunc(bsl.pubSub.Subscribe(listener))
 }
 
-// NotifyBlockSentListeners notifies all listeners that a requestor cancelled a response
+// RegisterBatch registers a listener for all blocks sent for a request in a single message
+func (bsl *BlockSentListeners) RegisterBatch(listener graphsync.OnBlocksSentListener) graphsync.UnregisterHookFunc {
+	return graphsync.UnregisterHookFunc(bsl.batchPubSub.Subscribe(listener))
+}
+
+// NotifyBlockSentListeners notifies all listeners that a block was sent
 func (bsl *BlockSentListeners) NotifyBlockSentListeners(p peer.ID, request graphsync.RequestData, block graphsync.BlockData) {
 	_ = bsl.pubSub.Publish(internalBlockSentEvent{p, request, block})
 }
 
-// NetworkErrorListeners is a set of listeners for when requestors cancel
+// NotifyBlocksSentListeners notifies all batch listeners that a message
+// containing the given blocks was sent
+func (bsl *BlockSentListeners) NotifyBlocksSentListeners(p peer.ID, request graphsync.RequestData, blocks []graphsync.BlockData) {
+	_ = bsl.batchPubSub.Publish(internalBlocksSentEvent{p, request, blocks})
+}
+
+// NetworkErrorListeners is a set of listeners for when requests or responses
+// fail to send over the network
 type NetworkErrorListeners struct {
 	pubSub *pubsub.PubSub
 }
@@ -123,17 +220,116 @@ func networkErrorDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn
 	return nil
 }
 
-// NewNetworkErrorListeners returns a new list of listeners for when requestors cancel
+// NewNetworkErrorListeners returns a new list of listeners for network errors
 func NewNetworkErrorListeners() *NetworkErrorListeners {
 	return &NetworkErrorListeners{pubSub: pubsub.New(networkErrorDispatcher)}
 }
 
-// Register registers an listener for completed responses
+// Register registers a listener for network errors
 func (nel *NetworkErrorListeners) Register(listener graphsync.OnNetworkErrorListener) graphsync.UnregisterHookFunc {
 	return graphsync.UnregisterHookFunc(nel.pubSub.Subscribe(listener))
 }
 
-// NotifyNetworkErrorListeners notifies all listeners that a requestor cancelled a response
+// NotifyNetworkErrorListeners notifies all listeners that data for a request failed to send
 func (nel *NetworkErrorListeners) NotifyNetworkErrorListeners(p peer.ID, request graphsync.RequestData, err error) {
 	_ = nel.pubSub.Publish(internalNetworkErrorEvent{p, request, err})
 }
+
+// ReceiverErrorListeners is a set of listeners for when incoming messages
+// can't be decoded or are rejected
+type ReceiverErrorListeners struct {
+	pubSub *pubsub.PubSub
+}
+
+type internalReceiverErrorEvent struct {
+	p   peer.ID
+	err error
+}
+
+func receiverErrorDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
+	ie := event.(internalReceiverErrorEvent)
+	listener := subscriberFn.(graphsync.OnReceiverErrorListener)
+	listener(ie.p, ie.err)
+	return nil
+}
+
+// NewReceiverErrorListeners returns a new list of listeners for receiver errors
+func NewReceiverErrorListeners() *ReceiverErrorListeners {
+	return &ReceiverErrorListeners{pubSub: pubsub.New(receiverErrorDispatcher)}
+}
+
+// Register registers a listener for receiver errors
+func (rel *ReceiverErrorListeners) Register(listener graphsync.OnReceiverErrorListener) graphsync.UnregisterHookFunc {
+	return graphsync.UnregisterHookFunc(rel.pubSub.Subscribe(listener))
+}
+
+// NotifyReceiverErrorListeners notifies all listeners that a message from a peer was dropped
+func (rel *ReceiverErrorListeners) NotifyReceiverErrorListeners(p peer.ID, err error) {
+	_ = rel.pubSub.Publish(internalReceiverErrorEvent{p, err})
+}
+
+// OutgoingRequestSentListeners is a set of listeners for when requests are
+// written to the network
+type OutgoingRequestSentListeners struct {
+	pubSub *pubsub.PubSub
+}
+
+type internalOutgoingRequestSentEvent struct {
+	p       peer.ID
+	request graphsync.RequestData
+}
+
+func outgoingRequestSentDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
+	ie := event.(internalOutgoingRequestSentEvent)
+	listener := subscriberFn.(graphsync.OnOutgoingRequestSentListener)
+	listener(ie.p, ie.request)
+	return nil
+}
+
+// NewOutgoingRequestSentListeners returns a new list of listeners for when requests are sent
+func NewOutgoingRequestSentListeners() *OutgoingRequestSentListeners {
+	return &OutgoingRequestSentListeners{pubSub: pubsub.New(outgoingRequestSentDispatcher)}
+}
+
+// Register registers a listener for sent requests
+func (orsl *OutgoingRequestSentListeners) Register(listener graphsync.OnOutgoingRequestSentListener) graphsync.UnregisterHookFunc {
+	return graphsync.UnregisterHookFunc(orsl.pubSub.Subscribe(listener))
+}
+
+// NotifyOutgoingRequestSentListeners notifies all listeners that a request was sent
+func (orsl *OutgoingRequestSentListeners) NotifyOutgoingRequestSentListeners(p peer.ID, request graphsync.RequestData) {
+	_ = orsl.pubSub.Publish(internalOutgoingRequestSentEvent{p, request})
+}
+
+// PeerMisbehavingListeners is a set of listeners for when peers send data that
+// violates the protocol
+type PeerMisbehavingListeners struct {
+	pubSub *pubsub.PubSub
+}
+
+type internalPeerMisbehavingEvent struct {
+	p   peer.ID
+	err error
+}
+
+func peerMisbehavingDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
+	ie := event.(internalPeerMisbehavingEvent)
+	listener := subscriberFn.(graphsync.OnPeerMisbehavingListener)
+	listener(ie.p, ie.err)
+	return nil
+}
+
+// NewPeerMisbehavingListeners returns a new list of listeners for when peers misbehave
+func NewPeerMisbehavingListeners() *PeerMisbehavingListeners {
+	return &PeerMisbehavingListeners{pubSub: pubsub.New(peerMisbehavingDispatcher)}
+}
+
+// Register registers a listener for misbehaving peers
+func (pml *PeerMisbehavingListeners) Register(listener graphsync.OnPeerMisbehavingListener) graphsync.UnregisterHookFunc {
+	return graphsync.UnregisterHookFunc(pml.pubSub.Subscribe(listener))
+}
+
+// NotifyPeerMisbehavingListeners notifies all listeners that a peer misbehaved
+func (pml *PeerMisbehavingListeners) NotifyPeerMisbehavingListeners(p peer.ID, err error) {
+	_ = pml.pubSub.Publish(internalPeerMisbehavingEvent{p, err})
+}
@@ -0,0 +1,468 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-msgio"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/compression"
+	"github.com/ipfs/go-graphsync/ipldutil"
+)
+
+// The dag-cbor protocol encodes messages as dag-cbor IPLD data rather than protobuf.
+// A message has the following shape, with optional keys omitted when empty:
+//
+//   type Message struct {
+//     req optional [Request]
+//     rsp optional [Response]
+//     blk optional [Block]
+//   }
+//
+//   type Request struct {
+//     id     Int
+//     root   optional Link
+//     sel    optional Any
+//     pri    Int
+//     cancel Bool
+//     update Bool
+//     ext    optional {String:Bytes}
+//   }
+//
+//   type Response struct {
+//     id   Int
+//     stat Int
+//     ext  optional {String:Bytes}
+//   }
+//
+//   type Block struct {
+//     prefix Bytes
+//     data   Bytes
+//   }
+
+// ToIPLD converts the message to its IPLD representation for the dag-cbor protocol
+func (gsm *graphSyncMessage) ToIPLD() (ipld.Node, error) {
+	algorithm, compressed, err := blockCompression(gsm.responses)
+	if err != nil {
+		return nil, err
+	}
+	blks := gsm.Blocks()
+	blockData := make([][]byte, 0, len(blks))
+	for _, b := range blks {
+		data := b.RawData()
+		if compressed {
+			data, err = compression.Compress(algorithm, data)
+			if err != nil {
+				return nil, err
+			}
+		}
+		blockData = append(blockData, data)
+	}
+	requests := gsm.sortedRequests()
+	responses := gsm.sortedResponses()
+	entries := 0
+	for _, length := range []int{len(requests), len(responses), len(blks)} {
+		if length > 0 {
+			entries++
+		}
+	}
+	return fluent.Build(basicnode.Prototype.Map, func(na fluent.NodeAssembler) {
+		na.CreateMap(entries, func(ma fluent.MapAssembler) {
+			if len(requests) > 0 {
+				ma.AssembleEntry("req").CreateList(len(requests), func(la fluent.ListAssembler) {
+					for _, request := range requests {
+						assembleRequest(la.AssembleValue(), request)
+					}
+				})
+			}
+			if len(responses) > 0 {
+				ma.AssembleEntry("rsp").CreateList(len(responses), func(la fluent.ListAssembler) {
+					for _, response := range responses {
+						la.AssembleValue().CreateMap(mapSize(2, response.extensions), func(ma fluent.MapAssembler) {
+							ma.AssembleEntry("id").AssignInt(int(response.requestID))
+							ma.AssembleEntry("stat").AssignInt(int(response.status))
+							assembleExtensions(ma, response.extensions)
+						})
+					}
+				})
+			}
+			if len(blks) > 0 {
+				ma.AssembleEntry("blk").CreateList(len(blks), func(la fluent.ListAssembler) {
+					for i, b := range blks {
+						la.AssembleValue().CreateMap(2, func(ma fluent.MapAssembler) {
+							ma.AssembleEntry("prefix").AssignBytes(b.Cid().Prefix().Bytes())
+							ma.AssembleEntry("data").AssignBytes(blockData[i])
+						})
+					}
+				})
+			}
+		})
+	})
+}
+
+func (gsm *graphSyncMessage) sortedRequests() []GraphSyncRequest {
+	requests := gsm.Requests()
+	sort.Slice(requests, func(i, j int) bool { return requests[i].id < requests[j].id })
+	return requests
+}
+
+func (gsm *graphSyncMessage) sortedResponses() []GraphSyncResponse {
+	responses := gsm.Responses()
+	sort.Slice(responses, func(i, j int) bool { return responses[i].requestID < responses[j].requestID })
+	return responses
+}
+
+func mapSize(fields int, extensions map[string][]byte) int {
+	if len(extensions) > 0 {
+		return fields + 1
+	}
+	return fields
+}
+
+func assembleRequest(na fluent.NodeAssembler, request GraphSyncRequest) {
+	fields := 4
+	hasRoot := request.root.Defined()
+	if hasRoot {
+		fields++
+	}
+	if request.selector != nil {
+		fields++
+	}
+	na.CreateMap(mapSize(fields, request.extensions), func(ma fluent.MapAssembler) {
+		ma.AssembleEntry("id").AssignInt(int(request.id))
+		if hasRoot {
+			ma.AssembleEntry("root").AssignLink(cidlink.Link{Cid: request.root})
+		}
+		if request.selector != nil {
+			ma.AssembleEntry("sel").AssignNode(request.selector)
+		}
+		ma.AssembleEntry("pri").AssignInt(int(request.priority))
+		ma.AssembleEntry("cancel").AssignBool(request.isCancel)
+		ma.AssembleEntry("update").AssignBool(request.isUpdate)
+		assembleExtensions(ma, request.extensions)
+	})
+}
+
+func assembleExtensions(ma fluent.MapAssembler, extensions map[string][]byte) {
+	if len(extensions) == 0 {
+		return
+	}
+	names := make([]string, 0, len(extensions))
+	for name := range extensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ma.AssembleEntry("ext").CreateMap(len(names), func(ma fluent.MapAssembler) {
+		for _, name := range names {
+			ma.AssembleEntry(name).AssignBytes(extensions[name])
+		}
+	})
+}
+
+// FromIPLD reads a message from its IPLD representation in the dag-cbor protocol
+func FromIPLD(node ipld.Node) (GraphSyncMessage, error) {
+	return FromIPLDWithLimits(node, DefaultDecodeLimits)
+}
+
+// FromIPLDWithLimits reads a message from its IPLD representation in the dag-cbor
+// protocol, returning a DecodeLimitError if the message exceeds the given
+// limits
+func FromIPLDWithLimits(node ipld.Node, limits DecodeLimits) (GraphSyncMessage, error) {
+	if node.ReprKind() != ipld.ReprKind_Map {
+		return nil, errors.New("message is not a map")
+	}
+	for _, list := range []struct {
+		key   string
+		limit string
+		max   int
+	}{
+		{"req", "MaxRequests", limits.MaxRequests},
+		{"rsp", "MaxResponses", limits.MaxResponses},
+		{"blk", "MaxBlocks", limits.MaxBlocks},
+	} {
+		if err := checkListLimit(node, list.key, list.limit, list.max); err != nil {
+			return nil, err
+		}
+	}
+	gsm := newMsg()
+	err := forEachInList(node, "req", func(req ipld.Node) error {
+		request, err := requestFromIPLD(req, limits)
+		if err != nil {
+			return err
+		}
+		gsm.AddRequest(request)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = forEachInList(node, "rsp", func(rsp ipld.Node) error {
+		id, err := lookupInt32(rsp, "id")
+		if err != nil {
+			return err
+		}
+		status, err := lookupInt32(rsp, "stat")
+		if err != nil {
+			return err
+		}
+		exts, err := extensionsFromIPLD(rsp, limits)
+		if err != nil {
+			return err
+		}
+		gsm.AddResponse(newResponse(graphsync.RequestID(id), graphsync.ResponseStatusCode(status), exts))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	algorithm, compressed, err := blockCompression(gsm.responses)
+	if err != nil {
+		return nil, err
+	}
+	err = forEachInList(node, "blk", func(blk ipld.Node) error {
+		prefix, err := lookupBytes(blk, "prefix")
+		if err != nil {
+			return err
+		}
+		pref, err := cid.PrefixFromBytes(prefix)
+		if err != nil {
+			return err
+		}
+		data, err := lookupBytes(blk, "data")
+		if err != nil {
+			return err
+		}
+		if compressed {
+			data, err = compression.Decompress(algorithm, data, network.MessageSizeMax)
+			if err != nil {
+				return err
+			}
+		}
+		c, err := pref.Sum(data)
+		if err != nil {
+			return err
+		}
+		b, err := blocks.NewBlockWithCid(data, c)
+		if err != nil {
+			return err
+		}
+		gsm.AddBlock(b)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return gsm, nil
+}
+
+func requestFromIPLD(req ipld.Node, limits DecodeLimits) (GraphSyncRequest, error) {
+	id, err := lookupInt32(req, "id")
+	if err != nil {
+		return GraphSyncRequest{}, err
+	}
+	priority, err := lookupInt32(req, "pri")
+	if err != nil {
+		return GraphSyncRequest{}, err
+	}
+	isCancel, err := lookupBool(req, "cancel")
+	if err != nil {
+		return GraphSyncRequest{}, err
+	}
+	isUpdate, err := lookupBool(req, "update")
+	if err != nil {
+		return GraphSyncRequest{}, err
+	}
+	var root cid.Cid
+	var selector ipld.Node
+	if !isCancel && !isUpdate {
+		rootNode, err := req.LookupByString("root")
+		if err != nil {
+			return GraphSyncRequest{}, err
+		}
+		rootLink, err := rootNode.AsLink()
+		if err != nil {
+			return GraphSyncRequest{}, err
+		}
+		cidLink, ok := rootLink.(cidlink.Link)
+		if !ok {
+			return GraphSyncRequest{}, errors.New("request root is not a CID")
+		}
+		root = cidLink.Cid
+		selector, err = req.LookupByString("sel")
+		if err != nil {
+			return GraphSyncRequest{}, err
+		}
+	}
+	exts, err := extensionsFromIPLD(req, limits)
+	if err != nil {
+		return GraphSyncRequest{}, err
+	}
+	return newRequest(graphsync.RequestID(id), root, selector, graphsync.Priority(priority), isCancel, isUpdate, exts), nil
+}
+
+func extensionsFromIPLD(node ipld.Node, limits DecodeLimits) (map[string][]byte, error) {
+	exts := make(map[string][]byte)
+	extNode, err := node.LookupByString("ext")
+	if err != nil {
+		if _, notFound := err.(ipld.ErrNotExists); notFound {
+			return exts, nil
+		}
+		return nil, err
+	}
+	if err := checkLimit("MaxExtensions", limits.MaxExtensions, int(extNode.Length())); err != nil {
+		return nil, err
+	}
+	iter := extNode.MapIterator()
+	if iter == nil {
+		return nil, errors.New("extensions are not a map")
+	}
+	for !iter.Done() {
+		k, v, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		name, err := k.AsString()
+		if err != nil {
+			return nil, err
+		}
+		data, err := v.AsBytes()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkLimit("MaxExtensionSize", limits.MaxExtensionSize, len(data)); err != nil {
+			return nil, err
+		}
+		exts[name] = data
+	}
+	return exts, nil
+}
+
+func checkListLimit(node ipld.Node, key string, limit string, max int) error {
+	list, err := node.LookupByString(key)
+	if err != nil {
+		if _, notFound := err.(ipld.ErrNotExists); notFound {
+			return nil
+		}
+		return err
+	}
+	return checkLimit(limit, max, int(list.Length()))
+}
+
+func forEachInList(node ipld.Node, key string, fn func(ipld.Node) error) error {
+	list, err := node.LookupByString(key)
+	if err != nil {
+		if _, notFound := err.(ipld.ErrNotExists); notFound {
+			return nil
+		}
+		return err
+	}
+	iter := list.ListIterator()
+	if iter == nil {
+		return fmt.Errorf("%s is not a list", key)
+	}
+	for !iter.Done() {
+		_, next, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		if err := fn(next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupInt32 reads an integer field that must fit in 32 bits, like request
+// IDs, priorities and status codes
+func lookupInt32(node ipld.Node, key string) (int32, error) {
+	n, err := node.LookupByString(key)
+	if err != nil {
+		return 0, err
+	}
+	value, err := n.AsInt()
+	if err != nil {
+		return 0, err
+	}
+	if value < math.MinInt32 || value > math.MaxInt32 {
+		return 0, fmt.Errorf("%s %d out of range", key, value)
+	}
+	return int32(value), nil
+}
+
+func lookupBool(node ipld.Node, key string) (bool, error) {
+	n, err := node.LookupByString(key)
+	if err != nil {
+		return false, err
+	}
+	return n.AsBool()
+}
+
+func lookupBytes(node ipld.Node, key string) ([]byte, error) {
+	n, err := node.LookupByString(key)
+	if err != nil {
+		return nil, err
+	}
+	return n.AsBytes()
+}
+
+// ToNetDagCBOR writes the message as a length prefixed dag-cbor message for the
+// dag-cbor protocol
+func (gsm *graphSyncMessage) ToNetDagCBOR(w io.Writer) error {
+	node, err := gsm.ToIPLD()
+	if err != nil {
+		return err
+	}
+	data, err := ipldutil.EncodeNode(node)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(data) + binary.MaxVarintLen64)
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(data)))
+	buf.Write(lenBuf[:n])
+	buf.Write(data)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// FromNetDagCBOR can read a network stream to deserialize a GraphSyncMessage on the dag-cbor protocol
+func FromNetDagCBOR(r io.Reader) (GraphSyncMessage, error) {
+	reader := msgio.NewVarintReaderSize(r, network.MessageSizeMax)
+	return FromMsgReaderDagCBOR(reader)
+}
+
+// FromMsgReaderDagCBOR can deserialize a dag-cbor message into a GraphSyncMessage
+func FromMsgReaderDagCBOR(r msgio.Reader) (GraphSyncMessage, error) {
+	return FromMsgReaderDagCBORWithLimits(r, DefaultDecodeLimits)
+}
+
+// FromMsgReaderDagCBORWithLimits deserializes a dag-cbor message into a
+// GraphSyncMessage, returning a DecodeLimitError if the message exceeds the
+// given limits
+func FromMsgReaderDagCBORWithLimits(r msgio.Reader, limits DecodeLimits) (GraphSyncMessage, error) {
+	msg, err := r.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	node, err := ipldutil.DecodeNode(msg)
+	r.ReleaseMsg(msg)
+	if err != nil {
+		return nil, err
+	}
+	return FromIPLDWithLimits(node, limits)
+}
@@ -0,0 +1,61 @@
+package message
+
+import "fmt"
+
+// DecodeLimits bounds the contents of a message decoded from the network, to
+// protect against peers sending pathological messages. A limit of zero means
+// no limit
+type DecodeLimits struct {
+	// MaxRequests is the most requests a message may contain
+	MaxRequests int
+	// MaxResponses is the most responses a message may contain
+	MaxResponses int
+	// MaxBlocks is the most blocks a message may contain
+	MaxBlocks int
+	// MaxExtensions is the most extensions a single request or response may have
+	MaxExtensions int
+	// MaxExtensionSize is the largest size in bytes of the data for a single
+	// extension
+	MaxExtensionSize int
+}
+
+// DefaultDecodeLimits are the limits used when decoding messages unless
+// others are specified
+var DefaultDecodeLimits = DecodeLimits{
+	MaxRequests:      1024,
+	MaxResponses:     1024,
+	MaxBlocks:        16384,
+	MaxExtensions:    64,
+	MaxExtensionSize: 1 << 20,
+}
+
+// DecodeLimitError is returned when a decoded message exceeds one of its
+// DecodeLimits
+type DecodeLimitError struct {
+	Limit  string
+	Max    int
+	Actual int
+}
+
+func (e DecodeLimitError) Error() string {
+	return fmt.Sprintf("message exceeds decode limit %s: %d > %d", e.Limit, e.Actual, e.Max)
+}
+
+func checkLimit(limit string, max int, actual int) error {
+	if max > 0 && actual > max {
+		return DecodeLimitError{Limit: limit, Max: max, Actual: actual}
+	}
+	return nil
+}
+
+func (dl DecodeLimits) checkExtensions(extensions map[string][]byte) error {
+	if err := checkLimit("MaxExtensions", dl.MaxExtensions, len(extensions)); err != nil {
+		return err
+	}
+	for _, data := range extensions {
+		if err := checkLimit("MaxExtensionSize", dl.MaxExtensionSize, len(data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -5,35 +5,33 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sort"
 
 	blocks "github.com/ipfs/go-block-format"
 	cid "github.com/ipfs/go-cid"
 	"github.com/ipld/go-ipld-prime"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
 	pool "github.com/libp2p/go-buffer-pool"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-msgio"
 	"google.golang.org/protobuf/proto"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/compression"
 	"github.com/ipfs/go-graphsync/ipldutil"
 	pb "github.com/ipfs/go-graphsync/message/pb"
 )
 
-// IsTerminalSuccessCode returns true if the response code indicates the
-// request terminated successfully.
+// IsTerminalSuccessCode returns true if the response code is a known code in
+// the success category, meaning the request terminated successfully.
 func IsTerminalSuccessCode(status graphsync.ResponseStatusCode) bool {
-	return status == graphsync.RequestCompletedFull ||
-		status == graphsync.RequestCompletedPartial
+	return IsKnownStatusCode(status) && StatusCategoryForCode(status) == graphsync.StatusCategorySuccess
 }
 
-// IsTerminalFailureCode returns true if the response code indicates the
-// request terminated in failure.
+// IsTerminalFailureCode returns true if the response code is a known code in
+// the failure category, meaning the request terminated in failure.
 func IsTerminalFailureCode(status graphsync.ResponseStatusCode) bool {
-	return status == graphsync.RequestFailedBusy ||
-		status == graphsync.RequestFailedContentNotFound ||
-		status == graphsync.RequestFailedLegal ||
-		status == graphsync.RequestFailedUnknown ||
-		status == graphsync.RequestCancelled
+	return IsKnownStatusCode(status) && StatusCategoryForCode(status) == graphsync.StatusCategoryFailure
 }
 
 // IsTerminalResponseCode returns true if the response code signals
@@ -42,6 +40,69 @@ func IsTerminalResponseCode(status graphsync.ResponseStatusCode) bool {
 	return IsTerminalSuccessCode(status) || IsTerminalFailureCode(status)
 }
 
+// IsKnownStatusCode returns true if the response code is one defined in this
+// version of graphsync
+func IsKnownStatusCode(status graphsync.ResponseStatusCode) bool {
+	switch status {
+	case graphsync.RequestAcknowledged,
+		graphsync.AdditionalPeers,
+		graphsync.NotEnoughGas,
+		graphsync.OtherProtocol,
+		graphsync.PartialResponse,
+		graphsync.RequestPaused,
+		graphsync.RequestCompletedFull,
+		graphsync.RequestCompletedPartial,
+		graphsync.RequestRejected,
+		graphsync.RequestFailedBusy,
+		graphsync.RequestFailedUnknown,
+		graphsync.RequestFailedLegal,
+		graphsync.RequestFailedContentNotFound,
+		graphsync.RequestCancelled,
+		graphsync.RequestFailedMessageTooLarge:
+		return true
+	}
+	return false
+}
+
+// StatusCategoryForCode returns the category of a response code based on the
+// range it falls in, as laid out in the graphsync spec
+func StatusCategoryForCode(status graphsync.ResponseStatusCode) graphsync.StatusCategory {
+	switch {
+	case status >= 10 && status < 20:
+		return graphsync.StatusCategoryInformational
+	case status >= 20 && status < 30:
+		return graphsync.StatusCategorySuccess
+	case status >= 30 && status < 40:
+		return graphsync.StatusCategoryFailure
+	default:
+		return graphsync.StatusCategoryUnknown
+	}
+}
+
+// EncodeStatusCategory returns encoded cbor data for a status category hint
+func EncodeStatusCategory(category graphsync.StatusCategory) ([]byte, error) {
+	nb := basicnode.Prototype.Int.NewBuilder()
+	err := nb.AssignInt(int(category))
+	if err != nil {
+		return nil, err
+	}
+	nd := nb.Build()
+	return ipldutil.EncodeNode(nd)
+}
+
+// DecodeStatusCategory returns a status category decoded from cbor data
+func DecodeStatusCategory(data []byte) (graphsync.StatusCategory, error) {
+	nd, err := ipldutil.DecodeNode(data)
+	if err != nil {
+		return graphsync.StatusCategoryUnknown, err
+	}
+	category, err := nd.AsInt()
+	if err != nil {
+		return graphsync.StatusCategoryUnknown, err
+	}
+	return graphsync.StatusCategory(category), nil
+}
+
 // GraphSyncMessage is interface that can be serialized and deserialized to send
 // over the GraphSync network
 type GraphSyncMessage interface {
@@ -66,10 +127,13 @@ type GraphSyncMessage interface {
 	Clone() GraphSyncMessage
 }
 
-// Exportable is an interface that can serialize to a protobuf
+// Exportable is an interface that can serialize to a protobuf, or to IPLD for
+// the dag-cbor protocol
 type Exportable interface {
 	ToProto() (*pb.Message, error)
 	ToNet(w io.Writer) error
+	ToIPLD() (ipld.Node, error)
+	ToNetDagCBOR(w io.Writer) error
 }
 
 // GraphSyncRequest is a struct to capture data on a request contained in a
@@ -174,7 +238,16 @@ func newResponse(requestID graphsync.RequestID,
 		extensions: extensions,
 	}
 }
-func newMessageFromProto(pbm *pb.Message) (GraphSyncMessage, error) {
+func newMessageFromProto(pbm *pb.Message, limits DecodeLimits) (GraphSyncMessage, error) {
+	if err := checkLimit("MaxRequests", limits.MaxRequests, len(pbm.Requests)); err != nil {
+		return nil, err
+	}
+	if err := checkLimit("MaxResponses", limits.MaxResponses, len(pbm.Responses)); err != nil {
+		return nil, err
+	}
+	if err := checkLimit("MaxBlocks", limits.MaxBlocks, len(pbm.Data)); err != nil {
+		return nil, err
+	}
 	gsm := newMsg()
 	for _, req := range pbm.Requests {
 		if req == nil {
@@ -197,6 +270,9 @@ func newMessageFromProto(pbm *pb.Message) (GraphSyncMessage, error) {
 			}
 		}
 		exts := req.GetExtensions()
+		if err := limits.checkExtensions(exts); err != nil {
+			return nil, err
+		}
 		if exts == nil {
 			exts = make(map[string][]byte)
 		}
@@ -208,12 +284,20 @@ func newMessageFromProto(pbm *pb.Message) (GraphSyncMessage, error) {
 			return nil, errors.New("response is nil")
 		}
 		exts := res.GetExtensions()
+		if err := limits.checkExtensions(exts); err != nil {
+			return nil, err
+		}
 		if exts == nil {
 			exts = make(map[string][]byte)
 		}
 		gsm.AddResponse(newResponse(graphsync.RequestID(res.Id), graphsync.ResponseStatusCode(res.Status), exts))
 	}
 
+	algorithm, compressed, err := blockCompression(gsm.responses)
+	if err != nil {
+		return nil, err
+	}
+
 	for _, b := range pbm.GetData() {
 		if b == nil {
 			return nil, errors.New("block is nil")
@@ -224,12 +308,20 @@ func newMessageFromProto(pbm *pb.Message) (GraphSyncMessage, error) {
 			return nil, err
 		}
 
-		c, err := pref.Sum(b.GetData())
+		data := b.GetData()
+		if compressed {
+			data, err = compression.Decompress(algorithm, data, network.MessageSizeMax)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		c, err := pref.Sum(data)
 		if err != nil {
 			return nil, err
 		}
 
-		blk, err := blocks.NewBlockWithCid(b.GetData(), c)
+		blk, err := blocks.NewBlockWithCid(data, c)
 		if err != nil {
 			return nil, err
 		}
@@ -288,6 +380,13 @@ func FromNet(r io.Reader) (GraphSyncMessage, error) {
 
 // FromMsgReader can deserialize a protobuf message into a GraphySyncMessage.
 func FromMsgReader(r msgio.Reader) (GraphSyncMessage, error) {
+	return FromMsgReaderWithLimits(r, DefaultDecodeLimits)
+}
+
+// FromMsgReaderWithLimits deserializes a protobuf message into a
+// GraphSyncMessage, returning a DecodeLimitError if the message exceeds the
+// given limits
+func FromMsgReaderWithLimits(r msgio.Reader, limits DecodeLimits) (GraphSyncMessage, error) {
 	msg, err := r.ReadMsg()
 	if err != nil {
 		return nil, err
@@ -300,7 +399,7 @@ func FromMsgReader(r msgio.Reader) (GraphSyncMessage, error) {
 		return nil, err
 	}
 
-	return newMessageFromProto(&pb)
+	return newMessageFromProto(&pb, limits)
 }
 
 func (gsm *graphSyncMessage) ToProto() (*pb.Message, error) {
@@ -335,17 +434,49 @@ func (gsm *graphSyncMessage) ToProto() (*pb.Message, error) {
 		})
 	}
 
+	algorithm, compressed, err := blockCompression(gsm.responses)
+	if err != nil {
+		return nil, err
+	}
+
 	blocks := gsm.Blocks()
 	pbm.Data = make([]*pb.Message_Block, 0, len(blocks))
 	for _, b := range blocks {
+		data := b.RawData()
+		if compressed {
+			data, err = compression.Compress(algorithm, data)
+			if err != nil {
+				return nil, err
+			}
+		}
 		pbm.Data = append(pbm.Data, &pb.Message_Block{
-			Data:   b.RawData(),
+			Data:   data,
 			Prefix: b.Cid().Prefix().Bytes(),
 		})
 	}
 	return pbm, nil
 }
 
+// blockCompression returns the algorithm block payloads in a message are
+// compressed with, if any response in the message declares one
+func blockCompression(responses map[graphsync.RequestID]GraphSyncResponse) (compression.Algorithm, bool, error) {
+	for _, response := range responses {
+		data, ok := response.Extension(graphsync.ExtensionBlockCompression)
+		if !ok {
+			continue
+		}
+		algorithm, err := compression.DecodeAlgorithm(data)
+		if err != nil {
+			return "", false, err
+		}
+		if !compression.IsSupported(algorithm) {
+			return "", false, fmt.Errorf("unsupported compression algorithm: %s", algorithm)
+		}
+		return algorithm, true, nil
+	}
+	return "", false, nil
+}
+
 func (gsm *graphSyncMessage) ToNet(w io.Writer) error {
 	msg, err := gsm.ToProto()
 	size := proto.Size(msg)
@@ -416,6 +547,16 @@ func (gsr GraphSyncRequest) Extension(name graphsync.ExtensionName) ([]byte, boo
 	return val, true
 }
 
+// ExtensionNames returns the names of all extensions on a request, in sorted order
+func (gsr GraphSyncRequest) ExtensionNames() []graphsync.ExtensionName {
+	names := make([]graphsync.ExtensionName, 0, len(gsr.extensions))
+	for name := range gsr.extensions {
+		names = append(names, graphsync.ExtensionName(name))
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
+
 // IsCancel returns true if this particular request is being cancelled
 func (gsr GraphSyncRequest) IsCancel() bool { return gsr.isCancel }
 
@@ -442,6 +583,24 @@ func (gsr GraphSyncResponse) Extension(name graphsync.ExtensionName) ([]byte, bo
 
 }
 
+// StatusCategory classifies the status of this response. Known status codes
+// are classified directly. Status codes from newer versions of the protocol are
+// classified by the responder's category hint if present, and otherwise by the
+// range they fall in
+func (gsr GraphSyncResponse) StatusCategory() graphsync.StatusCategory {
+	if IsKnownStatusCode(gsr.status) {
+		return StatusCategoryForCode(gsr.status)
+	}
+	hintData, ok := gsr.Extension(graphsync.ExtensionStatusCategory)
+	if ok {
+		category, err := DecodeStatusCategory(hintData)
+		if err == nil && category >= graphsync.StatusCategoryInformational && category <= graphsync.StatusCategoryFailure {
+			return category
+		}
+	}
+	return StatusCategoryForCode(gsr.status)
+}
+
 // ReplaceExtensions merges the extensions given extensions into the request to create a new request,
 // but always uses new data
 func (gsr GraphSyncRequest) ReplaceExtensions(extensions []graphsync.ExtensionData) GraphSyncRequest {
@@ -8,11 +8,15 @@ import (
 
 	blocks "github.com/ipfs/go-block-format"
 	cid "github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/fluent"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
 	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-msgio"
 	"github.com/stretchr/testify/require"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/compression"
 	"github.com/ipfs/go-graphsync/ipldutil"
 	"github.com/ipfs/go-graphsync/testutil"
 )
@@ -57,7 +61,7 @@ func TestAppendingRequests(t *testing.T) {
 	require.Equal(t, selectorEncoded, pbRequest.Selector)
 	require.Equal(t, map[string][]byte{"graphsync/awesome": extension.Data}, pbRequest.Extensions)
 
-	deserialized, err := newMessageFromProto(pbMessage)
+	deserialized, err := newMessageFromProto(pbMessage, DefaultDecodeLimits)
 	require.NoError(t, err, "deserializing protobuf message errored")
 	deserializedRequests := deserialized.Requests()
 	require.Len(t, deserializedRequests, 1, "did not add request to deserialized message")
@@ -101,7 +105,7 @@ func TestAppendingResponses(t *testing.T) {
 	require.Equal(t, int32(status), pbResponse.Status)
 	require.Equal(t, map[string][]byte{"graphsync/awesome": extension.Data}, pbResponse.Extensions)
 
-	deserialized, err := newMessageFromProto(pbMessage)
+	deserialized, err := newMessageFromProto(pbMessage, DefaultDecodeLimits)
 	require.NoError(t, err, "deserializing protobuf message errored")
 	deserializedResponses := deserialized.Responses()
 	require.Len(t, deserializedResponses, 1, "did not add response to deserialized message")
@@ -283,6 +287,203 @@ func TestToNetFromNetEquivalency(t *testing.T) {
 	}
 }
 
+func TestToNetFromNetCompressedBlocks(t *testing.T) {
+	id := graphsync.RequestID(rand.Int31())
+	compressionData, err := compression.EncodeAlgorithm(compression.Gzip)
+	require.NoError(t, err)
+
+	gsm := New()
+	gsm.AddResponse(NewResponse(id, graphsync.PartialResponse, graphsync.ExtensionData{
+		Name: graphsync.ExtensionBlockCompression,
+		Data: compressionData,
+	}))
+	blks := testutil.GenerateBlocksOfSize(3, 1000)
+	for _, blk := range blks {
+		gsm.AddBlock(blk)
+	}
+
+	pbm, err := gsm.ToProto()
+	require.NoError(t, err)
+	for _, b := range pbm.GetData() {
+		for _, blk := range blks {
+			require.NotEqual(t, blk.RawData(), b.GetData())
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	err = gsm.ToNet(buf)
+	require.NoError(t, err, "did not serialize protobuf message")
+	deserialized, err := FromNet(buf)
+	require.NoError(t, err, "did not deserialize protobuf message")
+
+	deserializedBlocks := make(map[cid.Cid][]byte)
+	for _, b := range deserialized.Blocks() {
+		deserializedBlocks[b.Cid()] = b.RawData()
+	}
+	require.Len(t, deserializedBlocks, len(blks))
+	for _, blk := range blks {
+		require.Equal(t, blk.RawData(), deserializedBlocks[blk.Cid()])
+	}
+}
+
+func TestToNetDagCBORFromNetDagCBOREquivalency(t *testing.T) {
+	root := testutil.GenerateCids(1)[0]
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	selector := ssb.Matcher().Node()
+	extensionName := graphsync.ExtensionName("graphsync/awesome")
+	extension := graphsync.ExtensionData{
+		Name: extensionName,
+		Data: testutil.RandomBytes(100),
+	}
+	id := graphsync.RequestID(rand.Int31())
+	priority := graphsync.Priority(rand.Int31())
+	status := graphsync.RequestAcknowledged
+
+	gsm := New()
+	gsm.AddRequest(NewRequest(id, root, selector, priority, extension))
+	gsm.AddRequest(CancelRequest(id + 1))
+	gsm.AddRequest(UpdateRequest(id+2, extension))
+	gsm.AddResponse(NewResponse(id, status, extension))
+	gsm.AddResponse(NewResponse(id+1, graphsync.RequestCompletedFull))
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	for _, blk := range blks {
+		gsm.AddBlock(blk)
+	}
+
+	buf := new(bytes.Buffer)
+	err := gsm.ToNetDagCBOR(buf)
+	require.NoError(t, err, "did not serialize dag-cbor message")
+	deserialized, err := FromNetDagCBOR(buf)
+	require.NoError(t, err, "did not deserialize dag-cbor message")
+
+	deserializedRequests := make(map[graphsync.RequestID]GraphSyncRequest)
+	for _, request := range deserialized.Requests() {
+		deserializedRequests[request.ID()] = request
+	}
+	require.Len(t, deserializedRequests, 3)
+	request := deserializedRequests[id]
+	require.False(t, request.IsCancel())
+	require.False(t, request.IsUpdate())
+	require.Equal(t, priority, request.Priority())
+	require.Equal(t, root.String(), request.Root().String())
+	require.Equal(t, selector, request.Selector())
+	extensionData, found := request.Extension(extensionName)
+	require.True(t, found)
+	require.Equal(t, extension.Data, extensionData)
+	require.True(t, deserializedRequests[id+1].IsCancel())
+	require.True(t, deserializedRequests[id+2].IsUpdate())
+	extensionData, found = deserializedRequests[id+2].Extension(extensionName)
+	require.True(t, found)
+	require.Equal(t, extension.Data, extensionData)
+
+	deserializedResponses := make(map[graphsync.RequestID]GraphSyncResponse)
+	for _, response := range deserialized.Responses() {
+		deserializedResponses[response.RequestID()] = response
+	}
+	require.Len(t, deserializedResponses, 2)
+	require.Equal(t, status, deserializedResponses[id].Status())
+	extensionData, found = deserializedResponses[id].Extension(extensionName)
+	require.True(t, found)
+	require.Equal(t, extension.Data, extensionData)
+	require.Equal(t, graphsync.RequestCompletedFull, deserializedResponses[id+1].Status())
+
+	require.ElementsMatch(t, blks, deserialized.Blocks())
+}
+
+func TestFromIPLDOutOfRange(t *testing.T) {
+	for _, key := range []string{"id", "stat"} {
+		node := fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+			na.AssembleEntry("rsp").CreateList(1, func(na fluent.ListAssembler) {
+				na.AssembleValue().CreateMap(2, func(na fluent.MapAssembler) {
+					values := map[string]int{"id": 1, "stat": int(graphsync.RequestCompletedFull)}
+					values[key] = 1 << 40
+					na.AssembleEntry("id").AssignInt(values["id"])
+					na.AssembleEntry("stat").AssignInt(values["stat"])
+				})
+			})
+		})
+		_, err := FromIPLD(node)
+		require.Error(t, err, key)
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	root := testutil.GenerateCids(1)[0]
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	selector := ssb.Matcher().Node()
+	extension := graphsync.ExtensionData{
+		Name: graphsync.ExtensionName("graphsync/awesome"),
+		Data: testutil.RandomBytes(100),
+	}
+	otherExtension := graphsync.ExtensionData{
+		Name: graphsync.ExtensionName("graphsync/other"),
+		Data: testutil.RandomBytes(10),
+	}
+	gsm := New()
+	gsm.AddRequest(NewRequest(graphsync.RequestID(1), root, selector, graphsync.Priority(0), extension, otherExtension))
+	gsm.AddRequest(NewRequest(graphsync.RequestID(2), root, selector, graphsync.Priority(0)))
+	gsm.AddResponse(NewResponse(graphsync.RequestID(1), graphsync.PartialResponse))
+	gsm.AddResponse(NewResponse(graphsync.RequestID(2), graphsync.PartialResponse))
+	for _, blk := range testutil.GenerateBlocksOfSize(3, 100) {
+		gsm.AddBlock(blk)
+	}
+
+	testCases := map[string]struct {
+		limits      DecodeLimits
+		expectedErr error
+	}{
+		"within limits": {
+			limits: DefaultDecodeLimits,
+		},
+		"no limits": {
+			limits: DecodeLimits{},
+		},
+		"too many requests": {
+			limits:      DecodeLimits{MaxRequests: 1},
+			expectedErr: DecodeLimitError{Limit: "MaxRequests", Max: 1, Actual: 2},
+		},
+		"too many responses": {
+			limits:      DecodeLimits{MaxResponses: 1},
+			expectedErr: DecodeLimitError{Limit: "MaxResponses", Max: 1, Actual: 2},
+		},
+		"too many blocks": {
+			limits:      DecodeLimits{MaxBlocks: 2},
+			expectedErr: DecodeLimitError{Limit: "MaxBlocks", Max: 2, Actual: 3},
+		},
+		"too many extensions": {
+			limits:      DecodeLimits{MaxExtensions: 1},
+			expectedErr: DecodeLimitError{Limit: "MaxExtensions", Max: 1, Actual: 2},
+		},
+		"extension too large": {
+			limits:      DecodeLimits{MaxExtensionSize: 50},
+			expectedErr: DecodeLimitError{Limit: "MaxExtensionSize", Max: 50, Actual: 100},
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			for version, toNet := range map[string]func(*bytes.Buffer) error{
+				"v1":       func(buf *bytes.Buffer) error { return gsm.ToNet(buf) },
+				"dag-cbor": func(buf *bytes.Buffer) error { return gsm.ToNetDagCBOR(buf) },
+			} {
+				buf := new(bytes.Buffer)
+				require.NoError(t, toNet(buf))
+				reader := msgio.NewVarintReaderSize(buf, network.MessageSizeMax)
+				var err error
+				if version == "v1" {
+					_, err = FromMsgReaderWithLimits(reader, data.limits)
+				} else {
+					_, err = FromMsgReaderDagCBORWithLimits(reader, data.limits)
+				}
+				if data.expectedErr == nil {
+					require.NoError(t, err, version)
+				} else {
+					require.Equal(t, data.expectedErr, err, version)
+				}
+			}
+		})
+	}
+}
+
 func TestMergeExtensions(t *testing.T) {
 	extensionName1 := graphsync.ExtensionName("graphsync/1")
 	extensionName2 := graphsync.ExtensionName("graphsync/2")
@@ -406,3 +607,67 @@ func TestKnownFuzzIssues(t *testing.T) {
 		require.Equal(t, msg1, msg2)
 	}
 }
+
+func TestResponseStatusCategory(t *testing.T) {
+	requestID := graphsync.RequestID(rand.Int31())
+	hint := func(category graphsync.StatusCategory) graphsync.ExtensionData {
+		data, err := EncodeStatusCategory(category)
+		require.NoError(t, err)
+		return graphsync.ExtensionData{Name: graphsync.ExtensionStatusCategory, Data: data}
+	}
+	testCases := map[string]struct {
+		response         GraphSyncResponse
+		expectedCategory graphsync.StatusCategory
+	}{
+		"known informational": {
+			response:         NewResponse(requestID, graphsync.PartialResponse),
+			expectedCategory: graphsync.StatusCategoryInformational,
+		},
+		"known success": {
+			response:         NewResponse(requestID, graphsync.RequestCompletedFull),
+			expectedCategory: graphsync.StatusCategorySuccess,
+		},
+		"known failure": {
+			response:         NewResponse(requestID, graphsync.RequestFailedContentNotFound),
+			expectedCategory: graphsync.StatusCategoryFailure,
+		},
+		"known code ignores hint": {
+			response:         NewResponse(requestID, graphsync.PartialResponse, hint(graphsync.StatusCategoryFailure)),
+			expectedCategory: graphsync.StatusCategoryInformational,
+		},
+		"unknown code in failure range": {
+			response:         NewResponse(requestID, graphsync.ResponseStatusCode(39)),
+			expectedCategory: graphsync.StatusCategoryFailure,
+		},
+		"unknown code with hint": {
+			response:         NewResponse(requestID, graphsync.ResponseStatusCode(39), hint(graphsync.StatusCategoryInformational)),
+			expectedCategory: graphsync.StatusCategoryInformational,
+		},
+		"unknown code outside ranges": {
+			response:         NewResponse(requestID, graphsync.ResponseStatusCode(50)),
+			expectedCategory: graphsync.StatusCategoryUnknown,
+		},
+		"unknown code outside ranges with hint": {
+			response:         NewResponse(requestID, graphsync.ResponseStatusCode(50), hint(graphsync.StatusCategorySuccess)),
+			expectedCategory: graphsync.StatusCategorySuccess,
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			require.Equal(t, data.expectedCategory, data.response.StatusCategory())
+		})
+	}
+}
+
+func TestTerminalCodesMatchStatusCategories(t *testing.T) {
+	for status := graphsync.ResponseStatusCode(0); status < 50; status++ {
+		if !IsKnownStatusCode(status) {
+			require.False(t, IsTerminalResponseCode(status), "unknown code %d is classified by its response", status)
+			continue
+		}
+		category := NewResponse(graphsync.RequestID(rand.Int31()), status).StatusCategory()
+		require.Equal(t, category == graphsync.StatusCategorySuccess, IsTerminalSuccessCode(status), "code %d", status)
+		require.Equal(t, category == graphsync.StatusCategoryFailure, IsTerminalFailureCode(status), "code %d", status)
+	}
+	require.True(t, IsTerminalFailureCode(graphsync.RequestRejected))
+}
@@ -5,12 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	blocks "github.com/ipfs/go-block-format"
 	logging "github.com/ipfs/go-log"
 	"github.com/libp2p/go-libp2p-core/peer"
 
+	"github.com/ipfs/go-graphsync"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	gsnet "github.com/ipfs/go-graphsync/network"
 	"github.com/ipfs/go-graphsync/notifications"
@@ -18,7 +20,21 @@ import (
 
 var log = logging.Logger("graphsync")
 
-const maxRetries = 10
+const defaultMaxRetries = 10
+
+const defaultRetryBackoff = 100 * time.Millisecond
+
+const defaultMaxRetryBackoff = 10 * time.Second
+
+// defaultDialTimeout bounds connecting to the peer and opening streams to it,
+// across all attempts to send one message, when the network does not set its
+// own timeout. It allows for looking the peer up in the dht, dialing it, and
+// handshaking
+const defaultDialTimeout = 10 * time.Minute
+
+// maxPendingCancels is the most cancels tracked for deduping at once. Cancels
+// past it are sent without being deduped
+const maxPendingCancels = 1024
 
 type EventName uint64
 
@@ -42,44 +58,142 @@ type MessageNetwork interface {
 	ConnectTo(context.Context, peer.ID) error
 }
 
+// dialTimeouter is implemented by networks that bound how long connecting to
+// a peer and opening streams to it may take while sending one message
+type dialTimeouter interface {
+	DialTimeout() time.Duration
+}
+
 // MessageQueue implements queue of want messages to send to peers.
 type MessageQueue struct {
 	p       peer.ID
 	network MessageNetwork
 	ctx     context.Context
 
-	outgoingWork chan struct{}
-	done         chan struct{}
+	done chan struct{}
 
 	// internal do not touch outside go routines
-	nextMessage        gsmsg.GraphSyncMessage
-	nextMessageTopic   Topic
+	streams            []*stream
 	nextMessageLk      sync.RWMutex
 	nextAvailableTopic Topic
 	processedNotifiers []chan struct{}
-	sender             gsnet.MessageSender
 	eventPublisher     notifications.Publisher
+	maxRetries         int
+	retryBackoff       time.Duration
+	maxRetryBackoff    time.Duration
+	dialTimeout        time.Duration
+
+	// protected by nextMessageLk
+	dedupCancels      bool
+	duplicateCancels  *uint64
+	cancelledRequests map[graphsync.RequestID]struct{}
+}
+
+// pendingMessage is a message being built that has not yet been sent
+type pendingMessage struct {
+	message gsmsg.GraphSyncMessage
+	topic   Topic
+}
+
+// stream is one of the streams messages to the peer are sent over, with the
+// messages being built for it. Control messages, which carry cancellations and
+// pause or terminal statuses but no blocks, are sent ahead of data messages
+type stream struct {
+	outgoingWork chan struct{}
+
+	// protected by nextMessageLk
+	data    pendingMessage
+	control pendingMessage
+
+	// internal do not touch outside the stream's go routine
+	sender gsnet.MessageSender
+}
+
+func newStream() *stream {
+	return &stream{outgoingWork: make(chan struct{}, 1)}
 }
 
 // New creats a new MessageQueue.
 func New(ctx context.Context, p peer.ID, network MessageNetwork) *MessageQueue {
+	dialTimeout := defaultDialTimeout
+	if timeouter, ok := network.(dialTimeouter); ok {
+		dialTimeout = timeouter.DialTimeout()
+	}
 	return &MessageQueue{
-		ctx:            ctx,
-		network:        network,
-		p:              p,
-		outgoingWork:   make(chan struct{}, 1),
-		done:           make(chan struct{}),
-		eventPublisher: notifications.NewPublisher(),
+		ctx:             ctx,
+		network:         network,
+		p:               p,
+		streams:         []*stream{newStream()},
+		done:            make(chan struct{}),
+		eventPublisher:  notifications.NewPublisher(),
+		maxRetries:      defaultMaxRetries,
+		retryBackoff:    defaultRetryBackoff,
+		maxRetryBackoff: defaultMaxRetryBackoff,
+		dialTimeout:     dialTimeout,
 	}
 }
 
+// SetMaxRetries sets how many times a message is sent, reopening the stream
+// to the peer after each failure, before the message is marked failed. Each
+// attempt dials the peer at most once, and all the dials for a message share
+// one deadline, so the message also fails once that runs out. It should be
+// called before Startup
+func (mq *MessageQueue) SetMaxRetries(maxRetries int) {
+	mq.maxRetries = maxRetries
+}
+
+// SetRetryBackoff sets how long to wait before redialing the peer after a
+// failed send. The wait doubles after each consecutive failure, up to max. It
+// should be called before Startup
+func (mq *MessageQueue) SetRetryBackoff(initial time.Duration, max time.Duration) {
+	mq.retryBackoff = initial
+	mq.maxRetryBackoff = max
+}
+
+// SetParallelStreams sets how many streams messages to the peer are sent over
+// at once. Requests and responses are assigned a stream by request ID, so
+// everything for one request is sent in order on the same stream. Responses
+// passed to AddResponses together are sent on the stream of the first one,
+// so callers should not mix requests in a single call when using more than
+// one stream. It should be called before Startup
+func (mq *MessageQueue) SetParallelStreams(count int) {
+	if count < 1 {
+		count = 1
+	}
+	mq.streams = make([]*stream, 0, count)
+	for i := 0; i < count; i++ {
+		mq.streams = append(mq.streams, newStream())
+	}
+}
+
+// DedupCancels drops cancels for requests that already have a cancel waiting
+// to be sent. Once the message with a cancel is sent, or fails for good, the
+// request may be cancelled again. Each dropped cancel increments the given
+// counter.
+func (mq *MessageQueue) DedupCancels(duplicateCancels *uint64) {
+	mq.nextMessageLk.Lock()
+	defer mq.nextMessageLk.Unlock()
+	mq.dedupCancels = true
+	mq.duplicateCancels = duplicateCancels
+	mq.cancelledRequests = make(map[graphsync.RequestID]struct{})
+}
+
 // AddRequest adds an outgoing request to the message queue.
 func (mq *MessageQueue) AddRequest(graphSyncRequest gsmsg.GraphSyncRequest, notifees ...notifications.Notifee) {
-
-	if mq.mutateNextMessage(func(nextMessage gsmsg.GraphSyncMessage) {
+	if mq.isDuplicateCancel(graphSyncRequest) {
+		return
+	}
+	stream := mq.streamFor(graphSyncRequest.ID())
+	var isControl func(gsmsg.GraphSyncMessage) bool
+	if graphSyncRequest.IsCancel() {
+		isControl = func(data gsmsg.GraphSyncMessage) bool {
+			return !hasRequest(data, graphSyncRequest.ID())
+		}
+	}
+	if mq.mutateNextMessage(stream, isControl, func(nextMessage gsmsg.GraphSyncMessage) {
 		nextMessage.AddRequest(graphSyncRequest)
 	}, notifees) {
-		mq.signalWork()
+		stream.signalWork()
 	}
 }
 
@@ -87,7 +201,22 @@ func (mq *MessageQueue) AddRequest(graphSyncRequest gsmsg.GraphSyncRequest, noti
 // returns a channel that sends a notification when sending initiates. If ignored by the consumer
 // sending will not block.
 func (mq *MessageQueue) AddResponses(responses []gsmsg.GraphSyncResponse, blks []blocks.Block, notifees ...notifications.Notifee) {
-	if mq.mutateNextMessage(func(nextMessage gsmsg.GraphSyncMessage) {
+	stream := mq.streams[0]
+	if len(responses) > 0 {
+		stream = mq.streamFor(responses[0].RequestID())
+	}
+	var isControl func(gsmsg.GraphSyncMessage) bool
+	if len(blks) == 0 && onlyControlStatuses(responses) {
+		isControl = func(data gsmsg.GraphSyncMessage) bool {
+			for _, response := range responses {
+				if hasResponse(data, response.RequestID()) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	if mq.mutateNextMessage(stream, isControl, func(nextMessage gsmsg.GraphSyncMessage) {
 		for _, response := range responses {
 			nextMessage.AddResponse(response)
 		}
@@ -95,14 +224,73 @@ func (mq *MessageQueue) AddResponses(responses []gsmsg.GraphSyncResponse, blks [
 			nextMessage.AddBlock(block)
 		}
 	}, notifees) {
-		mq.signalWork()
+		stream.signalWork()
+	}
+}
+
+// onlyControlStatuses returns true if every response is a pause or ends its
+// request, which may be sent ahead of data already queued for other requests
+func onlyControlStatuses(responses []gsmsg.GraphSyncResponse) bool {
+	if len(responses) == 0 {
+		return false
+	}
+	for _, response := range responses {
+		if response.Status() != graphsync.RequestPaused &&
+			!gsmsg.IsTerminalResponseCode(response.Status()) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasRequest(message gsmsg.GraphSyncMessage, requestID graphsync.RequestID) bool {
+	if message == nil {
+		return false
+	}
+	for _, request := range message.Requests() {
+		if request.ID() == requestID {
+			return true
+		}
+	}
+	return false
+}
+
+func hasResponse(message gsmsg.GraphSyncMessage, requestID graphsync.RequestID) bool {
+	if message == nil {
+		return false
+	}
+	for _, response := range message.Responses() {
+		if response.RequestID() == requestID {
+			return true
+		}
 	}
+	return false
+}
+
+func (mq *MessageQueue) streamFor(requestID graphsync.RequestID) *stream {
+	index := int(requestID) % len(mq.streams)
+	if index < 0 {
+		index += len(mq.streams)
+	}
+	return mq.streams[index]
 }
 
 // Startup starts the processing of messages, and creates an initial message
 // based on the given initial wantlist.
 func (mq *MessageQueue) Startup() {
-	go mq.runQueue()
+	mq.eventPublisher.Startup()
+	var wg sync.WaitGroup
+	wg.Add(len(mq.streams))
+	for _, stream := range mq.streams {
+		go func(stream *stream) {
+			defer wg.Done()
+			mq.runQueue(stream)
+		}(stream)
+	}
+	go func() {
+		wg.Wait()
+		mq.eventPublisher.Shutdown()
+	}()
 }
 
 // Shutdown stops the processing of messages for a message queue.
@@ -110,106 +298,194 @@ func (mq *MessageQueue) Shutdown() {
 	close(mq.done)
 }
 
-func (mq *MessageQueue) runQueue() {
-	defer mq.eventPublisher.Shutdown()
-	mq.eventPublisher.Startup()
+func (mq *MessageQueue) runQueue(stream *stream) {
 	for {
 		select {
-		case <-mq.outgoingWork:
-			mq.sendMessage()
+		case <-stream.outgoingWork:
+			mq.sendMessage(stream)
 		case <-mq.done:
-			if mq.sender != nil {
-				mq.sender.Close()
+			if stream.sender != nil {
+				stream.sender.Close()
 			}
 			return
 		case <-mq.ctx.Done():
-			if mq.sender != nil {
-				_ = mq.sender.Reset()
+			if stream.sender != nil {
+				_ = stream.sender.Reset()
 			}
 			return
 		}
 	}
 }
 
-func (mq *MessageQueue) mutateNextMessage(mutator func(gsmsg.GraphSyncMessage), notifees []notifications.Notifee) bool {
+func (mq *MessageQueue) isDuplicateCancel(graphSyncRequest gsmsg.GraphSyncRequest) bool {
 	mq.nextMessageLk.Lock()
 	defer mq.nextMessageLk.Unlock()
-	if mq.nextMessage == nil {
-		mq.nextMessage = gsmsg.New()
-		mq.nextMessageTopic = mq.nextAvailableTopic
+	if !mq.dedupCancels {
+		return false
+	}
+	if graphSyncRequest.IsCancel() {
+		if _, ok := mq.cancelledRequests[graphSyncRequest.ID()]; ok {
+			atomic.AddUint64(mq.duplicateCancels, 1)
+			return true
+		}
+		if len(mq.cancelledRequests) < maxPendingCancels {
+			mq.cancelledRequests[graphSyncRequest.ID()] = struct{}{}
+		}
+		return false
+	}
+	if !graphSyncRequest.IsUpdate() {
+		delete(mq.cancelledRequests, graphSyncRequest.ID())
+	}
+	return false
+}
+
+// clearCancels stops deduping the cancels in a message once it is sent or
+// fails for good
+func (mq *MessageQueue) clearCancels(message gsmsg.GraphSyncMessage) {
+	mq.nextMessageLk.Lock()
+	defer mq.nextMessageLk.Unlock()
+	if !mq.dedupCancels {
+		return
+	}
+	for _, request := range message.Requests() {
+		if request.IsCancel() {
+			delete(mq.cancelledRequests, request.ID())
+		}
+	}
+}
+
+// mutateNextMessage applies the mutator to the next control message for the
+// stream if isControl returns true given the pending data message, and to the
+// next data message otherwise. Content for a request only goes in the control
+// message when no data for the request is pending, so it is never reordered
+// ahead of it
+func (mq *MessageQueue) mutateNextMessage(stream *stream, isControl func(gsmsg.GraphSyncMessage) bool, mutator func(gsmsg.GraphSyncMessage), notifees []notifications.Notifee) bool {
+	mq.nextMessageLk.Lock()
+	defer mq.nextMessageLk.Unlock()
+	pending := &stream.data
+	if isControl != nil && isControl(stream.data.message) {
+		pending = &stream.control
+	}
+	if pending.message == nil {
+		pending.message = gsmsg.New()
+		pending.topic = mq.nextAvailableTopic
 		mq.nextAvailableTopic++
 	}
-	mutator(mq.nextMessage)
+	mutator(pending.message)
 	for _, notifee := range notifees {
-		notifications.SubscribeWithData(mq.eventPublisher, mq.nextMessageTopic, notifee)
+		notifications.SubscribeWithData(mq.eventPublisher, pending.topic, notifee)
 	}
-	return !mq.nextMessage.Empty()
+	return !pending.message.Empty()
 }
 
-func (mq *MessageQueue) signalWork() {
+func (s *stream) signalWork() {
 	select {
-	case mq.outgoingWork <- struct{}{}:
+	case s.outgoingWork <- struct{}{}:
 	default:
 	}
 }
 
-func (mq *MessageQueue) extractOutgoingMessage() (gsmsg.GraphSyncMessage, Topic) {
+// extractOutgoingMessage takes the next message to send on the stream,
+// preferring the control message over the data message
+func (mq *MessageQueue) extractOutgoingMessage(stream *stream) (gsmsg.GraphSyncMessage, Topic) {
 	// grab outgoing message
 	mq.nextMessageLk.Lock()
-	message := mq.nextMessage
-	topic := mq.nextMessageTopic
-	mq.nextMessage = nil
-	mq.nextMessageLk.Unlock()
+	defer mq.nextMessageLk.Unlock()
+	pending := &stream.data
+	if stream.control.message != nil {
+		pending = &stream.control
+	}
+	message := pending.message
+	topic := pending.topic
+	pending.message = nil
+	if stream.data.message != nil {
+		// the data message is still waiting to go out after this one
+		stream.signalWork()
+	}
 	return message, topic
 }
 
-func (mq *MessageQueue) sendMessage() {
-	message, topic := mq.extractOutgoingMessage()
+func (mq *MessageQueue) sendMessage(stream *stream) {
+	message, topic := mq.extractOutgoingMessage(stream)
 	if message == nil || message.Empty() {
 		return
 	}
 	mq.eventPublisher.Publish(topic, Event{Name: Queued, Err: nil})
 	defer mq.eventPublisher.Close(topic)
+	defer mq.clearCancels(message)
 
-	err := mq.initializeSender()
-	if err != nil {
-		log.Infof("cant open message sender to peer %s: %s", mq.p, err)
-		// TODO: cant connect, what now?
-		mq.eventPublisher.Publish(topic, Event{Name: Error, Err: fmt.Errorf("cant open message sender to peer %s: %w", mq.p, err)})
-		return
-	}
+	// every dial and backoff for this message shares one deadline, so an
+	// unreachable peer holds up the stream for at most the dial timeout
+	dialCtx, cancel := context.WithTimeout(mq.ctx, mq.dialTimeout)
+	defer cancel()
 
-	for i := 0; i < maxRetries; i++ { // try to send this message until we fail.
-		if mq.attemptSendAndRecovery(message, topic) {
+	backoff := mq.retryBackoff
+	var lastErr error
+	for i := 0; i < mq.maxRetries; i++ { // try to send this message until we fail.
+		var sent bool
+		sent, lastErr = mq.attemptSend(dialCtx, stream, message, topic)
+		if sent {
 			return
 		}
+		if i == mq.maxRetries-1 || dialCtx.Err() != nil {
+			break
+		}
+		if mq.waitToRetry(dialCtx, topic, backoff) {
+			return
+		}
+		if dialCtx.Err() != nil {
+			break
+		}
+		backoff *= 2
+		if backoff > mq.maxRetryBackoff {
+			backoff = mq.maxRetryBackoff
+		}
 	}
-	mq.eventPublisher.Publish(topic, Event{Name: Error, Err: fmt.Errorf("expended retries on SendMsg(%s)", mq.p)})
+	mq.eventPublisher.Publish(topic, Event{Name: Error, Err: fmt.Errorf("expended retries on SendMsg(%s): %w", mq.p, lastErr)})
 }
 
-func (mq *MessageQueue) initializeSender() error {
-	if mq.sender != nil {
+func (mq *MessageQueue) initializeSender(dialCtx context.Context, stream *stream) error {
+	if stream.sender != nil {
 		return nil
 	}
-	nsender, err := openSender(mq.ctx, mq.network, mq.p)
+	nsender, err := openSender(dialCtx, mq.network, mq.p)
 	if err != nil {
 		return err
 	}
-	mq.sender = nsender
+	stream.sender = nsender
 	return nil
 }
 
-func (mq *MessageQueue) attemptSendAndRecovery(message gsmsg.GraphSyncMessage, topic Topic) bool {
-	err := mq.sender.SendMsg(mq.ctx, message)
-	if err == nil {
+// attemptSend returns true if the message was sent, or false with the error
+// it failed with. It dials the peer with the given context if there is no
+// open sender, and resets the sender if the send fails, leaving the redial to
+// the next attempt
+func (mq *MessageQueue) attemptSend(dialCtx context.Context, stream *stream, message gsmsg.GraphSyncMessage, topic Topic) (bool, error) {
+	err := mq.initializeSender(dialCtx, stream)
+	if err != nil {
+		log.Infof("cant open message sender to peer %s: %s", mq.p, err)
+		return false, fmt.Errorf("cant open message sender to peer %s: %w", mq.p, err)
+	}
+
+	sendErr := stream.sender.SendMsg(mq.ctx, message)
+	if sendErr == nil {
 		mq.eventPublisher.Publish(topic, Event{Name: Sent})
-		return true
+		return true, nil
 	}
 
-	log.Infof("graphsync send error: %s", err)
-	_ = mq.sender.Reset()
-	mq.sender = nil
+	log.Infof("graphsync send error: %s", sendErr)
+	_ = stream.sender.Reset()
+	stream.sender = nil
 
+	return false, sendErr
+}
+
+// waitToRetry waits for the given backoff before a message is retried,
+// returning true if the queue shut down in the meantime. It returns early if
+// the dial deadline passes, leaving the caller to give up on the message
+func (mq *MessageQueue) waitToRetry(dialCtx context.Context, topic Topic, backoff time.Duration) bool {
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
 	select {
 	case <-mq.done:
 		mq.eventPublisher.Publish(topic, Event{Name: Error, Err: errors.New("queue shutdown")})
@@ -217,32 +493,16 @@ func (mq *MessageQueue) attemptSendAndRecovery(message gsmsg.GraphSyncMessage, t
 	case <-mq.ctx.Done():
 		mq.eventPublisher.Publish(topic, Event{Name: Error, Err: errors.New("context cancelled")})
 		return true
-	case <-time.After(time.Millisecond * 100):
-		// wait 100ms in case disconnect notifications are still propogating
-		log.Warn("SendMsg errored but neither 'done' nor context.Done() were set")
+	case <-dialCtx.Done():
+		return false
+	case <-timer.C:
+		// wait in case disconnect notifications are still propogating
+		return false
 	}
-
-	err = mq.initializeSender()
-	if err != nil {
-		log.Infof("couldnt open sender again after SendMsg(%s) failed: %s", mq.p, err)
-		// TODO(why): what do we do now?
-		// I think the *right* answer is to probably put the message we're
-		// trying to send back, and then return to waiting for new work or
-		// a disconnect.
-		mq.eventPublisher.Publish(topic, Event{Name: Error, Err: fmt.Errorf("couldnt open sender again after SendMsg(%s) failed: %w", mq.p, err)})
-		return true
-	}
-
-	return false
 }
 
 func openSender(ctx context.Context, network MessageNetwork, p peer.ID) (gsnet.MessageSender, error) {
-	// allow ten minutes for connections this includes looking them up in the
-	// dht dialing them, and handshaking
-	conctx, cancel := context.WithTimeout(ctx, time.Minute*10)
-	defer cancel()
-
-	err := network.ConnectTo(conctx, p)
+	err := network.ConnectTo(ctx, p)
 	if err != nil {
 		return nil, err
 	}
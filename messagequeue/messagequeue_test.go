@@ -253,3 +253,456 @@ func TestDedupingMessages(t *testing.T) {
 		}
 	}
 }
+
+func TestDedupingCancels(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messagesSent := make(chan gsmsg.GraphSyncMessage)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	messageSender := &fakeMessageSender{nil, fullClosedChan, resetChan, messagesSent}
+	var waitGroup sync.WaitGroup
+	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
+
+	var duplicateCancels uint64
+	messageQueue := New(ctx, peer, messageNetwork)
+	messageQueue.DedupCancels(&duplicateCancels)
+	id := graphsync.RequestID(rand.Int31())
+
+	// a second cancel queued before the first is sent is dropped
+	notifee, verifier := testutil.NewTestNotifee("cancel", 5)
+	messageQueue.AddRequest(gsmsg.CancelRequest(id), notifee)
+	messageQueue.AddRequest(gsmsg.CancelRequest(id))
+	require.Equal(t, uint64(1), duplicateCancels)
+
+	waitGroup.Add(1)
+	messageQueue.Startup()
+	// wait for send attempt
+	waitGroup.Wait()
+	var message gsmsg.GraphSyncMessage
+	testutil.AssertReceive(ctx, t, messagesSent, &message, "message did not send")
+	require.Len(t, message.Requests(), 1)
+	require.True(t, message.Requests()[0].IsCancel())
+	verifier.ExpectEvents(ctx, t, []notifications.Event{
+		Event{Name: Queued},
+		Event{Name: Sent},
+	})
+	verifier.ExpectClose(ctx, t)
+
+	// once the cancel is sent, the request may be cancelled again
+	messageQueue.AddRequest(gsmsg.CancelRequest(id))
+	testutil.AssertReceive(ctx, t, messagesSent, &message, "message did not send")
+	require.Len(t, message.Requests(), 1)
+	require.True(t, message.Requests()[0].IsCancel())
+	require.Equal(t, uint64(1), duplicateCancels)
+}
+
+func TestControlMessagesSentFirst(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messagesSent := make(chan gsmsg.GraphSyncMessage)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	messageSender := &fakeMessageSender{nil, fullClosedChan, resetChan, messagesSent}
+	var waitGroup sync.WaitGroup
+	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
+
+	messageQueue := New(ctx, peer, messageNetwork)
+	messageQueue.Startup()
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	selector := ssb.Matcher().Node()
+	root := testutil.GenerateCids(1)[0]
+	priority := graphsync.Priority(rand.Int31())
+	id1 := graphsync.RequestID(1)
+	id2 := graphsync.RequestID(2)
+	id3 := graphsync.RequestID(3)
+	id4 := graphsync.RequestID(4)
+	id5 := graphsync.RequestID(5)
+	id6 := graphsync.RequestID(6)
+
+	// the first message is held in flight while the rest queue up
+	waitGroup.Add(1)
+	messageQueue.AddRequest(gsmsg.NewRequest(id1, root, selector, priority))
+	waitGroup.Wait()
+
+	messageQueue.AddResponses([]gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(id2, graphsync.PartialResponse),
+	}, testutil.GenerateBlocksOfSize(1, 100))
+	messageQueue.AddRequest(gsmsg.NewRequest(id5, root, selector, priority))
+	messageQueue.AddRequest(gsmsg.CancelRequest(id3))
+	messageQueue.AddResponses([]gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(id4, graphsync.RequestFailedUnknown),
+	}, nil)
+	messageQueue.AddResponses([]gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(id6, graphsync.RequestCompletedFull),
+	}, nil)
+	// a cancel for a request still waiting to be sent stays behind it, as does
+	// a completion for a request with blocks waiting to be sent
+	messageQueue.AddRequest(gsmsg.CancelRequest(id5))
+	messageQueue.AddResponses([]gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(id2, graphsync.RequestCompletedFull),
+	}, nil)
+
+	var message gsmsg.GraphSyncMessage
+	testutil.AssertReceive(ctx, t, messagesSent, &message, "message did not send")
+	require.Len(t, message.Requests(), 1)
+	require.Equal(t, id1, message.Requests()[0].ID())
+
+	testutil.AssertReceive(ctx, t, messagesSent, &message, "control message did not send")
+	require.Len(t, message.Requests(), 1)
+	require.Equal(t, id3, message.Requests()[0].ID())
+	require.True(t, message.Requests()[0].IsCancel())
+	statuses := make(map[graphsync.RequestID]graphsync.ResponseStatusCode)
+	for _, response := range message.Responses() {
+		statuses[response.RequestID()] = response.Status()
+	}
+	require.Equal(t, map[graphsync.RequestID]graphsync.ResponseStatusCode{
+		id4: graphsync.RequestFailedUnknown,
+		id6: graphsync.RequestCompletedFull,
+	}, statuses)
+	require.Empty(t, message.Blocks())
+
+	testutil.AssertReceive(ctx, t, messagesSent, &message, "data message did not send")
+	require.Len(t, message.Responses(), 1)
+	require.Equal(t, id2, message.Responses()[0].RequestID())
+	require.Equal(t, graphsync.RequestCompletedFull, message.Responses()[0].Status())
+	require.Len(t, message.Blocks(), 1)
+	require.Len(t, message.Requests(), 1)
+	require.Equal(t, id5, message.Requests()[0].ID())
+	require.True(t, message.Requests()[0].IsCancel())
+}
+
+func TestRetriesBeforeFailing(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messagesSent := make(chan gsmsg.GraphSyncMessage)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	sendErr := fmt.Errorf("Something went wrong")
+	messageSender := &fakeMessageSender{sendErr, fullClosedChan, resetChan, messagesSent}
+	var waitGroup sync.WaitGroup
+	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
+
+	messageQueue := New(ctx, peer, messageNetwork)
+	messageQueue.SetMaxRetries(2)
+	messageQueue.Startup()
+	// one sender opened for each attempt
+	waitGroup.Add(2)
+	id := graphsync.RequestID(rand.Int31())
+	expectedTopic := "testTopic"
+	notifee, verifier := testutil.NewTestNotifee(expectedTopic, 5)
+	messageQueue.AddRequest(gsmsg.CancelRequest(id), notifee)
+
+	for i := 0; i < 2; i++ {
+		testutil.AssertDoesReceive(ctx, t, messagesSent, "message send not attempted")
+		testutil.AssertDoesReceive(ctx, t, resetChan, "message sender was not reset")
+	}
+
+	verifier.ExpectEvents(ctx, t, []notifications.Event{
+		Event{Name: Queued},
+		Event{Name: Error, Err: fmt.Errorf("expended retries on SendMsg(%s): %w", peer, sendErr)},
+	})
+	verifier.ExpectClose(ctx, t)
+}
+
+type flakyMessageNetwork struct {
+	lk            sync.Mutex
+	failures      int
+	dialTimes     []time.Time
+	messageSender gsnet.MessageSender
+}
+
+func (fmn *flakyMessageNetwork) ConnectTo(context.Context, peer.ID) error {
+	fmn.lk.Lock()
+	defer fmn.lk.Unlock()
+	fmn.dialTimes = append(fmn.dialTimes, time.Now())
+	if fmn.failures > 0 {
+		fmn.failures--
+		return fmt.Errorf("dial failed")
+	}
+	return nil
+}
+
+func (fmn *flakyMessageNetwork) NewMessageSender(context.Context, peer.ID) (gsnet.MessageSender, error) {
+	return fmn.messageSender, nil
+}
+
+func TestRedialsWithBackoff(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messagesSent := make(chan gsmsg.GraphSyncMessage)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	messageSender := &fakeMessageSender{nil, fullClosedChan, resetChan, messagesSent}
+	messageNetwork := &flakyMessageNetwork{failures: 3, messageSender: messageSender}
+
+	messageQueue := New(ctx, peer, messageNetwork)
+	messageQueue.SetMaxRetries(5)
+	messageQueue.SetRetryBackoff(10*time.Millisecond, 40*time.Millisecond)
+	messageQueue.Startup()
+	id := graphsync.RequestID(rand.Int31())
+	expectedTopic := "testTopic"
+	notifee, verifier := testutil.NewTestNotifee(expectedTopic, 5)
+	messageQueue.AddRequest(gsmsg.CancelRequest(id), notifee)
+
+	// the message is delivered once a redial succeeds, without an error event
+	var message gsmsg.GraphSyncMessage
+	testutil.AssertReceive(ctx, t, messagesSent, &message, "message did not send")
+	require.Len(t, message.Requests(), 1)
+	verifier.ExpectEvents(ctx, t, []notifications.Event{
+		Event{Name: Queued},
+		Event{Name: Sent},
+	})
+	verifier.ExpectClose(ctx, t)
+
+	messageNetwork.lk.Lock()
+	defer messageNetwork.lk.Unlock()
+	require.Len(t, messageNetwork.dialTimes, 4)
+	// the wait between dials doubles after each failure
+	expectedBackoffs := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond}
+	for i, backoff := range expectedBackoffs {
+		require.True(t, messageNetwork.dialTimes[i+1].Sub(messageNetwork.dialTimes[i]) >= backoff)
+	}
+}
+
+func TestRetriesExhaustedWhenRedialsFail(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messagesSent := make(chan gsmsg.GraphSyncMessage)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	messageSender := &fakeMessageSender{nil, fullClosedChan, resetChan, messagesSent}
+	messageNetwork := &flakyMessageNetwork{failures: 10, messageSender: messageSender}
+
+	messageQueue := New(ctx, peer, messageNetwork)
+	messageQueue.SetMaxRetries(3)
+	messageQueue.SetRetryBackoff(time.Millisecond, 5*time.Millisecond)
+	messageQueue.Startup()
+	id := graphsync.RequestID(rand.Int31())
+	expectedTopic := "testTopic"
+	notifee, verifier := testutil.NewTestNotifee(expectedTopic, 5)
+	messageQueue.AddRequest(gsmsg.CancelRequest(id), notifee)
+
+	verifier.ExpectEvents(ctx, t, []notifications.Event{
+		Event{Name: Queued},
+		Event{Name: Error, Err: fmt.Errorf("expended retries on SendMsg(%s): %w", peer, fmt.Errorf("cant open message sender to peer %s: %w", peer, fmt.Errorf("dial failed")))},
+	})
+	verifier.ExpectClose(ctx, t)
+}
+
+func TestDialsOncePerAttempt(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messagesSent := make(chan gsmsg.GraphSyncMessage, 3)
+	resetChan := make(chan struct{}, 3)
+	fullClosedChan := make(chan struct{}, 1)
+	sendErr := fmt.Errorf("Something went wrong")
+	messageSender := &fakeMessageSender{sendErr, fullClosedChan, resetChan, messagesSent}
+	messageNetwork := &flakyMessageNetwork{messageSender: messageSender}
+
+	messageQueue := New(ctx, peer, messageNetwork)
+	messageQueue.SetMaxRetries(3)
+	messageQueue.SetRetryBackoff(time.Millisecond, 5*time.Millisecond)
+	messageQueue.Startup()
+	id := graphsync.RequestID(rand.Int31())
+	expectedTopic := "testTopic"
+	notifee, verifier := testutil.NewTestNotifee(expectedTopic, 5)
+	messageQueue.AddRequest(gsmsg.CancelRequest(id), notifee)
+
+	verifier.ExpectEvents(ctx, t, []notifications.Event{
+		Event{Name: Queued},
+		Event{Name: Error, Err: fmt.Errorf("expended retries on SendMsg(%s): %w", peer, sendErr)},
+	})
+	verifier.ExpectClose(ctx, t)
+
+	messageNetwork.lk.Lock()
+	defer messageNetwork.lk.Unlock()
+	require.Len(t, messageNetwork.dialTimes, 3)
+}
+
+func TestNoBackoffAfterLastAttempt(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messagesSent := make(chan gsmsg.GraphSyncMessage)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	messageSender := &fakeMessageSender{nil, fullClosedChan, resetChan, messagesSent}
+	messageNetwork := &flakyMessageNetwork{failures: 10, messageSender: messageSender}
+
+	messageQueue := New(ctx, peer, messageNetwork)
+	messageQueue.SetMaxRetries(1)
+	messageQueue.SetRetryBackoff(5*time.Second, 5*time.Second)
+	messageQueue.Startup()
+	id := graphsync.RequestID(rand.Int31())
+	expectedTopic := "testTopic"
+	notifee, verifier := testutil.NewTestNotifee(expectedTopic, 5)
+	messageQueue.AddRequest(gsmsg.CancelRequest(id), notifee)
+
+	// the failure is reported without waiting out a backoff no retry follows
+	verifier.ExpectEvents(ctx, t, []notifications.Event{
+		Event{Name: Queued},
+		Event{Name: Error, Err: fmt.Errorf("expended retries on SendMsg(%s): %w", peer, fmt.Errorf("cant open message sender to peer %s: %w", peer, fmt.Errorf("dial failed")))},
+	})
+	verifier.ExpectClose(ctx, t)
+}
+
+// hangingMessageNetwork never finishes connecting, until the dial is cut off
+type hangingMessageNetwork struct {
+	dialTimeout time.Duration
+}
+
+func (hmn *hangingMessageNetwork) ConnectTo(ctx context.Context, p peer.ID) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (hmn *hangingMessageNetwork) NewMessageSender(context.Context, peer.ID) (gsnet.MessageSender, error) {
+	return nil, fmt.Errorf("not connected")
+}
+
+func (hmn *hangingMessageNetwork) DialTimeout() time.Duration {
+	return hmn.dialTimeout
+}
+
+func TestDialBoundedByNetworkTimeout(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messageNetwork := &hangingMessageNetwork{dialTimeout: 10 * time.Millisecond}
+
+	messageQueue := New(ctx, peer, messageNetwork)
+	messageQueue.SetMaxRetries(5)
+	messageQueue.SetRetryBackoff(time.Millisecond, time.Millisecond)
+	messageQueue.Startup()
+	id := graphsync.RequestID(rand.Int31())
+	expectedTopic := "testTopic"
+	notifee, verifier := testutil.NewTestNotifee(expectedTopic, 5)
+	messageQueue.AddRequest(gsmsg.CancelRequest(id), notifee)
+
+	// the dial deadline is shared by every attempt, so the message fails once
+	// the first dial uses it up, well before the test context ends
+	verifier.ExpectEvents(ctx, t, []notifications.Event{
+		Event{Name: Queued},
+		Event{Name: Error, Err: fmt.Errorf("expended retries on SendMsg(%s): %w", peer, fmt.Errorf("cant open message sender to peer %s: %w", peer, context.DeadlineExceeded))},
+	})
+	verifier.ExpectClose(ctx, t)
+}
+
+type streamMessage struct {
+	stream  int
+	message gsmsg.GraphSyncMessage
+}
+
+type streamMessageSender struct {
+	stream       int
+	messagesSent chan<- streamMessage
+}
+
+func (sms *streamMessageSender) SendMsg(ctx context.Context, msg gsmsg.GraphSyncMessage) error {
+	sms.messagesSent <- streamMessage{sms.stream, msg}
+	return nil
+}
+func (sms *streamMessageSender) Close() error { return nil }
+func (sms *streamMessageSender) Reset() error { return nil }
+
+// streamMessageNetwork opens a new sender for each stream, recording which
+// stream each message was sent on
+type streamMessageNetwork struct {
+	lk           sync.Mutex
+	streams      int
+	messagesSent chan<- streamMessage
+}
+
+func (smn *streamMessageNetwork) ConnectTo(context.Context, peer.ID) error {
+	return nil
+}
+
+func (smn *streamMessageNetwork) NewMessageSender(context.Context, peer.ID) (gsnet.MessageSender, error) {
+	smn.lk.Lock()
+	defer smn.lk.Unlock()
+	sender := &streamMessageSender{smn.streams, smn.messagesSent}
+	smn.streams++
+	return sender, nil
+}
+
+func TestParallelStreams(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messagesSent := make(chan streamMessage)
+	messageNetwork := &streamMessageNetwork{messagesSent: messagesSent}
+
+	messageQueue := New(ctx, peer, messageNetwork)
+	messageQueue.SetParallelStreams(2)
+	messageQueue.Startup()
+	defer messageQueue.Shutdown()
+
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	selector := ssb.Matcher().Node()
+	root := testutil.GenerateCids(1)[0]
+	for i := 0; i < 4; i++ {
+		messageQueue.AddRequest(gsmsg.NewRequest(graphsync.RequestID(i), root, selector, graphsync.Priority(0)))
+	}
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	for i := 0; i < 4; i++ {
+		messageQueue.AddResponses([]gsmsg.GraphSyncResponse{
+			gsmsg.NewResponse(graphsync.RequestID(i), graphsync.PartialResponse, nil),
+		}, blks[i%2:i%2+1])
+	}
+
+	// every request and response for a request is sent on the same stream, and
+	// requests with different IDs are spread across both streams
+	requestStreams := make(map[graphsync.RequestID]int)
+	streamsUsed := make(map[int]struct{})
+	checkStream := func(stream int, requestID graphsync.RequestID) {
+		expected, ok := requestStreams[requestID]
+		if ok {
+			require.Equal(t, expected, stream, "request was sent on more than one stream")
+		}
+		requestStreams[requestID] = stream
+		streamsUsed[stream] = struct{}{}
+	}
+	receivedRequests := 0
+	receivedResponses := 0
+	for receivedRequests < 4 || receivedResponses < 4 {
+		var sent streamMessage
+		testutil.AssertReceive(ctx, t, messagesSent, &sent, "message did not send")
+		for _, request := range sent.message.Requests() {
+			checkStream(sent.stream, request.ID())
+			receivedRequests++
+		}
+		for _, response := range sent.message.Responses() {
+			checkStream(sent.stream, response.RequestID())
+			receivedResponses++
+		}
+	}
+	require.Len(t, streamsUsed, 2)
+	require.Equal(t, requestStreams[0], requestStreams[2])
+	require.Equal(t, requestStreams[1], requestStreams[3])
+	require.NotEqual(t, requestStreams[0], requestStreams[1])
+}
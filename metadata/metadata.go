@@ -13,6 +13,12 @@ import (
 type Item struct {
 	Link         cid.Cid
 	BlockPresent bool
+	// BlockSize is the size in bytes of the block, if it is present. It is only
+	// carried by the v2 encoding
+	BlockSize uint64
+	// Index is the position of the link in the traversal order of the request.
+	// It is only carried by the v2 encoding
+	Index int64
 }
 
 // Metadata is information about metadata contained in a response, which can be
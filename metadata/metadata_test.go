@@ -20,7 +20,7 @@ func TestDecodeEncodeMetadata(t *testing.T) {
 	nd := fluent.MustBuildList(basicnode.Prototype.List, 10, func(fla fluent.ListAssembler) {
 		for _, k := range cids {
 			blockPresent := rand.Int31()%2 == 0
-			initialMetadata = append(initialMetadata, Item{k, blockPresent})
+			initialMetadata = append(initialMetadata, Item{Link: k, BlockPresent: blockPresent})
 			fla.AssembleValue().CreateMap(2, func(fma fluent.MapAssembler) {
 				fma.AssembleEntry("link").AssignLink(cidlink.Link{Cid: k})
 				fma.AssembleEntry("blockPresent").AssignBool(blockPresent)
@@ -55,3 +55,68 @@ func TestDecodeEncodeMetadata(t *testing.T) {
 	decodedNodeFromMetadata := nb.Build()
 	require.Equal(t, decodedNode, decodedNodeFromMetadata, "deserialzed metadata does not match deserialized node")
 }
+
+func TestDecodeEncodeMetadataV2(t *testing.T) {
+	cids := testutil.GenerateCids(10)
+	initialMetadata := make(Metadata, 0, 10)
+	for i, k := range cids {
+		item := Item{Link: k, BlockPresent: rand.Int31()%2 == 0, Index: int64(i)}
+		if item.BlockPresent {
+			item.BlockSize = uint64(rand.Int31n(1 << 20))
+		}
+		initialMetadata = append(initialMetadata, item)
+	}
+
+	encoded, err := EncodeMetadataV2(initialMetadata)
+	require.NoError(t, err, "encode errored")
+
+	decodedMetadata, err := DecodeMetadataV2(encoded)
+	require.NoError(t, err, "decode errored")
+	require.Equal(t, initialMetadata, decodedMetadata, "metadata changed during encoding and decoding")
+
+	// v1 metadata is not mistaken for v2
+	v1Encoded, err := EncodeMetadata(initialMetadata)
+	require.NoError(t, err)
+	_, err = DecodeMetadataV2(v1Encoded)
+	require.Error(t, err)
+
+	// unknown versions are rejected
+	nd := fluent.MustBuildMap(basicnode.Prototype.Map, 2, func(fma fluent.MapAssembler) {
+		fma.AssembleEntry("version").AssignInt(3)
+		fma.AssembleEntry("items").CreateList(0, func(fluent.ListAssembler) {})
+	})
+	unknownVersion := new(bytes.Buffer)
+	err = dagcbor.Encoder(nd, unknownVersion)
+	require.NoError(t, err)
+	_, err = DecodeMetadataV2(unknownVersion.Bytes())
+	require.Error(t, err)
+}
+
+func TestMetadataV2PrefixTable(t *testing.T) {
+	v1Blocks := testutil.GenerateBlocksOfSize(5, 100)
+	identityBlocks := testutil.GenerateIdentityBlocks(2, 16)
+	v0Cid := testutil.GenerateCids(1)[0]
+	require.Equal(t, uint64(0), v0Cid.Version())
+	initialMetadata := make(Metadata, 0, 8)
+	for i, blk := range v1Blocks {
+		initialMetadata = append(initialMetadata, Item{Link: blk.Cid(), BlockPresent: true, BlockSize: 100, Index: int64(i)})
+	}
+	for _, blk := range identityBlocks {
+		initialMetadata = append(initialMetadata, Item{Link: blk.Cid(), Index: int64(len(initialMetadata))})
+	}
+	initialMetadata = append(initialMetadata, Item{Link: v0Cid, Index: int64(len(initialMetadata))})
+
+	encoded, err := EncodeMetadataV2(initialMetadata)
+	require.NoError(t, err)
+	decodedMetadata, err := DecodeMetadataV2(encoded)
+	require.NoError(t, err)
+	require.Equal(t, initialMetadata, decodedMetadata)
+
+	// links that share a prefix share an entry in the prefix table
+	nb := basicnode.Prototype.Map.NewBuilder()
+	err = dagcbor.Decoder(nb, bytes.NewReader(encoded))
+	require.NoError(t, err)
+	prefixes, err := nb.Build().LookupByString("prefixes")
+	require.NoError(t, err)
+	require.Equal(t, 3, prefixes.Length())
+}
@@ -0,0 +1,230 @@
+package metadata
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	mh "github.com/multiformats/go-multihash"
+
+	"github.com/ipfs/go-graphsync/ipldutil"
+)
+
+// Version2 is the version number carried by the v2 metadata encoding
+const Version2 = 2
+
+// The v2 metadata encoding is a dag-cbor map of the form:
+//
+//   {
+//     version: Int,
+//     prefixes: [ Bytes ],
+//     items: [ { prefix: Int, digest: Bytes, present: Bool, size: Int, index: Int } ]
+//   }
+//
+// Rather than repeating full CIDs, each item references an entry in the
+// prefixes table, holding the encoded CID prefix (version, codec and hash
+// type) it shares with other items, and carries only its multihash digest.
+// size is only present for items whose block is present
+
+// EncodeMetadataV2 encodes metadata in the versioned v2 format, which also
+// carries block sizes and traversal order
+func EncodeMetadataV2(entries Metadata) ([]byte, error) {
+	var prefixes []cid.Prefix
+	prefixIndexes := make(map[cid.Prefix]int)
+	itemPrefixes := make([]int, 0, len(entries))
+	digests := make([][]byte, 0, len(entries))
+	for _, item := range entries {
+		decoded, err := mh.Decode(item.Link.Hash())
+		if err != nil {
+			return nil, err
+		}
+		prefix := item.Link.Prefix()
+		prefixIndex, ok := prefixIndexes[prefix]
+		if !ok {
+			prefixIndex = len(prefixes)
+			prefixIndexes[prefix] = prefixIndex
+			prefixes = append(prefixes, prefix)
+		}
+		itemPrefixes = append(itemPrefixes, prefixIndex)
+		digests = append(digests, decoded.Digest)
+	}
+	node, err := fluent.Build(basicnode.Prototype.Map, func(na fluent.NodeAssembler) {
+		na.CreateMap(3, func(ma fluent.MapAssembler) {
+			ma.AssembleEntry("version").AssignInt(Version2)
+			ma.AssembleEntry("prefixes").CreateList(len(prefixes), func(la fluent.ListAssembler) {
+				for _, prefix := range prefixes {
+					la.AssembleValue().AssignBytes(prefix.Bytes())
+				}
+			})
+			ma.AssembleEntry("items").CreateList(len(entries), func(la fluent.ListAssembler) {
+				for i, item := range entries {
+					entryCount := 4
+					if item.BlockPresent {
+						entryCount++
+					}
+					la.AssembleValue().CreateMap(entryCount, func(ma fluent.MapAssembler) {
+						ma.AssembleEntry("prefix").AssignInt(itemPrefixes[i])
+						ma.AssembleEntry("digest").AssignBytes(digests[i])
+						ma.AssembleEntry("present").AssignBool(item.BlockPresent)
+						if item.BlockPresent {
+							ma.AssembleEntry("size").AssignInt(int(item.BlockSize))
+						}
+						ma.AssembleEntry("index").AssignInt(int(item.Index))
+					})
+				}
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ipldutil.EncodeNode(node)
+}
+
+// DecodeMetadataV2 decodes metadata in the v2 format
+func DecodeMetadataV2(data []byte) (Metadata, error) {
+	node, err := ipldutil.DecodeNode(data)
+	if err != nil {
+		return nil, err
+	}
+	versionNode, err := node.LookupByString("version")
+	if err != nil {
+		return nil, err
+	}
+	version, err := versionNode.AsInt()
+	if err != nil {
+		return nil, err
+	}
+	if version != Version2 {
+		return nil, fmt.Errorf("unsupported metadata version: %d", version)
+	}
+	prefixes, err := decodePrefixes(node)
+	if err != nil {
+		return nil, err
+	}
+	itemsNode, err := node.LookupByString("items")
+	if err != nil {
+		return nil, err
+	}
+	if itemsNode.ReprKind() != ipld.ReprKind_List {
+		return nil, errors.New("metadata items are not a list")
+	}
+	var metadata Metadata
+	if itemsNode.Length() > 0 {
+		metadata = make(Metadata, 0, itemsNode.Length())
+	}
+	iter := itemsNode.ListIterator()
+	for !iter.Done() {
+		_, itemNode, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		item, err := decodeItemV2(itemNode, prefixes)
+		if err != nil {
+			return nil, err
+		}
+		metadata = append(metadata, item)
+	}
+	return metadata, nil
+}
+
+func decodePrefixes(node ipld.Node) ([]cid.Prefix, error) {
+	prefixesNode, err := node.LookupByString("prefixes")
+	if err != nil {
+		return nil, err
+	}
+	if prefixesNode.ReprKind() != ipld.ReprKind_List {
+		return nil, errors.New("metadata prefixes are not a list")
+	}
+	prefixes := make([]cid.Prefix, 0, prefixesNode.Length())
+	iter := prefixesNode.ListIterator()
+	for !iter.Done() {
+		_, prefixNode, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		prefixBytes, err := prefixNode.AsBytes()
+		if err != nil {
+			return nil, err
+		}
+		prefix, err := cid.PrefixFromBytes(prefixBytes)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+func decodeLinkV2(node ipld.Node, prefixes []cid.Prefix) (cid.Cid, error) {
+	prefixNode, err := node.LookupByString("prefix")
+	if err != nil {
+		return cid.Undef, err
+	}
+	prefixIndex, err := prefixNode.AsInt()
+	if err != nil {
+		return cid.Undef, err
+	}
+	if prefixIndex < 0 || prefixIndex >= len(prefixes) {
+		return cid.Undef, fmt.Errorf("metadata prefix index out of range: %d", prefixIndex)
+	}
+	prefix := prefixes[prefixIndex]
+	digestNode, err := node.LookupByString("digest")
+	if err != nil {
+		return cid.Undef, err
+	}
+	digest, err := digestNode.AsBytes()
+	if err != nil {
+		return cid.Undef, err
+	}
+	if prefix.MhLength >= 0 && len(digest) != prefix.MhLength {
+		return cid.Undef, fmt.Errorf("metadata digest length %d does not match prefix length %d", len(digest), prefix.MhLength)
+	}
+	hash, err := mh.Encode(digest, prefix.MhType)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if prefix.Version == 0 {
+		return cid.NewCidV0(hash), nil
+	}
+	return cid.NewCidV1(prefix.Codec, hash), nil
+}
+
+func decodeItemV2(node ipld.Node, prefixes []cid.Prefix) (Item, error) {
+	link, err := decodeLinkV2(node, prefixes)
+	if err != nil {
+		return Item{}, err
+	}
+	presentNode, err := node.LookupByString("present")
+	if err != nil {
+		return Item{}, err
+	}
+	present, err := presentNode.AsBool()
+	if err != nil {
+		return Item{}, err
+	}
+	indexNode, err := node.LookupByString("index")
+	if err != nil {
+		return Item{}, err
+	}
+	index, err := indexNode.AsInt()
+	if err != nil {
+		return Item{}, err
+	}
+	item := Item{Link: link, BlockPresent: present, Index: int64(index)}
+	sizeNode, err := node.LookupByString("size")
+	if err == nil {
+		size, err := sizeNode.AsInt()
+		if err != nil {
+			return Item{}, err
+		}
+		if size < 0 {
+			return Item{}, fmt.Errorf("invalid block size in metadata: %d", size)
+		}
+		item.BlockSize = uint64(size)
+	}
+	return item, nil
+}
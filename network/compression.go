@@ -0,0 +1,195 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/compression"
+	"github.com/ipfs/go-graphsync/ipldutil"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+)
+
+// On the dag-cbor protocol, a frame is a dag-cbor message with two optional keys
+// added at the top level:
+//
+//   ext  - message level extensions: graphsync/message-compression,
+//          advertising the algorithms the sender accepts for messages sent to
+//          it, and graphsync/supported-extensions, advertising the extensions
+//          the sender handles
+//   cmp  - the algorithm the rest of the message is compressed with. When
+//          present, data holds the compressed dag-cbor encoding of the message
+//          and no other message keys are present
+
+// MessageCompression enables compressing entire messages on the dag-cbor protocol
+// with peers that accept it. The given algorithms are advertised to peers as
+// the ones this network accepts, in order of preference
+func MessageCompression(algorithms []compression.Algorithm) Option {
+	return func(gsnet *libp2pGraphSyncNetwork) {
+		gsnet.messageCompression = algorithms
+	}
+}
+
+// MaxDecompressedMessageSize sets the largest size a compressed message may
+// expand to before it is rejected
+func MaxDecompressedMessageSize(maxSize int) Option {
+	return func(gsnet *libp2pGraphSyncNetwork) {
+		gsnet.maxDecompressedSize = maxSize
+	}
+}
+
+// peerCompression returns the algorithm to compress messages to the given peer
+// with, if the peer has advertised one we support
+func (gsnet *libp2pGraphSyncNetwork) peerCompression(p peer.ID) (compression.Algorithm, bool) {
+	gsnet.compressionLk.RLock()
+	defer gsnet.compressionLk.RUnlock()
+	algorithm, ok := gsnet.compressionByPeer[p]
+	return algorithm, ok
+}
+
+func (gsnet *libp2pGraphSyncNetwork) setPeerCompression(p peer.ID, offered []compression.Algorithm) {
+	gsnet.compressionLk.Lock()
+	defer gsnet.compressionLk.Unlock()
+	algorithm, ok := compression.Choose(offered)
+	if !ok {
+		delete(gsnet.compressionByPeer, p)
+		return
+	}
+	gsnet.compressionByPeer[p] = algorithm
+}
+
+func (gsnet *libp2pGraphSyncNetwork) clearPeerCompression(p peer.ID) {
+	gsnet.compressionLk.Lock()
+	defer gsnet.compressionLk.Unlock()
+	delete(gsnet.compressionByPeer, p)
+}
+
+func (gsnet *libp2pGraphSyncNetwork) accepts(algorithm compression.Algorithm) bool {
+	for _, accepted := range gsnet.messageCompression {
+		if accepted == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeFrame encodes a message for the dag-cbor protocol, adding the given message
+// level extensions and compressing the message if algorithm is set
+func encodeFrame(msg gsmsg.GraphSyncMessage, fe frameExtensions, algorithm compression.Algorithm) ([]byte, error) {
+	node, err := msg.ToIPLD()
+	if err != nil {
+		return nil, err
+	}
+	var ext map[graphsync.ExtensionName][]byte
+	if !fe.empty() {
+		ext, err = fe.encode()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var compressed []byte
+	if algorithm != "" {
+		data, err := ipldutil.EncodeNode(node)
+		if err != nil {
+			return nil, err
+		}
+		compressed, err = compression.Compress(algorithm, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	frame, err := fluent.Build(basicnode.Prototype.Map, func(na fluent.NodeAssembler) {
+		entries := int(node.Length())
+		if compressed != nil {
+			entries = 2
+		}
+		if ext != nil {
+			entries++
+		}
+		na.CreateMap(entries, func(ma fluent.MapAssembler) {
+			if ext != nil {
+				ma.AssembleEntry("ext").CreateMap(len(ext), func(ma fluent.MapAssembler) {
+					for name, data := range ext {
+						ma.AssembleEntry(string(name)).AssignBytes(data)
+					}
+				})
+			}
+			if compressed != nil {
+				ma.AssembleEntry("cmp").AssignString(string(algorithm))
+				ma.AssembleEntry("data").AssignBytes(compressed)
+				return
+			}
+			iter := node.MapIterator()
+			for !iter.Done() {
+				k, v, err := iter.Next()
+				if err != nil {
+					panic(fluent.Error{Err: err})
+				}
+				key, err := k.AsString()
+				if err != nil {
+					panic(fluent.Error{Err: err})
+				}
+				ma.AssembleEntry(key).AssignNode(v)
+			}
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ipldutil.EncodeNode(frame)
+}
+
+// decodeFrame decodes a message on the dag-cbor protocol, returning the message level
+// extensions the sender included. Compressed messages are only accepted with
+// algorithms in accepted, and may not expand past maxSize. The decoded message
+// must be within the given limits
+func decodeFrame(node ipld.Node, accepted func(compression.Algorithm) bool, maxSize int, limits gsmsg.DecodeLimits) (gsmsg.GraphSyncMessage, frameExtensions, error) {
+	var fe frameExtensions
+	if node.ReprKind() != ipld.ReprKind_Map {
+		return nil, fe, errors.New("message is not a map")
+	}
+	extNode, err := node.LookupByString("ext")
+	if err == nil {
+		fe, err = decodeFrameExtensions(extNode)
+		if err != nil {
+			return nil, fe, err
+		}
+	}
+	cmpNode, err := node.LookupByString("cmp")
+	if err == nil {
+		name, err := cmpNode.AsString()
+		if err != nil {
+			return nil, fe, err
+		}
+		algorithm := compression.Algorithm(name)
+		if !accepted(algorithm) {
+			return nil, fe, fmt.Errorf("received message compressed with unaccepted algorithm: %s", algorithm)
+		}
+		dataNode, err := node.LookupByString("data")
+		if err != nil {
+			return nil, fe, err
+		}
+		compressed, err := dataNode.AsBytes()
+		if err != nil {
+			return nil, fe, err
+		}
+		decompressed, err := compression.Decompress(algorithm, compressed, maxSize)
+		if err != nil {
+			return nil, fe, err
+		}
+		node, err = ipldutil.DecodeNode(decompressed)
+		if err != nil {
+			return nil, fe, err
+		}
+	}
+	msg, err := gsmsg.FromIPLDWithLimits(node, limits)
+	if err != nil {
+		return nil, fe, err
+	}
+	return msg, fe, nil
+}
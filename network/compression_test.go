@@ -0,0 +1,106 @@
+package network
+
+import (
+	"math/rand"
+	"testing"
+
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/compression"
+	"github.com/ipfs/go-graphsync/ipldutil"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestMessageFrames(t *testing.T) {
+	root := testutil.GenerateCids(1)[0]
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	selector := ssb.Matcher().Node()
+	id := graphsync.RequestID(rand.Int31())
+	blks := testutil.GenerateBlocksOfSize(2, 1000)
+	msg := gsmsg.New()
+	msg.AddRequest(gsmsg.NewRequest(id, root, selector, graphsync.Priority(0)))
+	msg.AddResponse(gsmsg.NewResponse(id, graphsync.PartialResponse))
+	for _, blk := range blks {
+		msg.AddBlock(blk)
+	}
+	acceptGzip := func(algorithm compression.Algorithm) bool { return algorithm == compression.Gzip }
+	acceptNone := func(algorithm compression.Algorithm) bool { return false }
+
+	testCases := map[string]struct {
+		accepted          []compression.Algorithm
+		supported         []graphsync.ExtensionName
+		algorithm         compression.Algorithm
+		accepts           func(compression.Algorithm) bool
+		maxSize           int
+		expectedErr       error
+		expectedErrString string
+	}{
+		"uncompressed, no advertisement": {
+			accepts: acceptNone,
+			maxSize: 1 << 20,
+		},
+		"uncompressed, advertises algorithms": {
+			accepted: []compression.Algorithm{compression.Gzip},
+			accepts:  acceptNone,
+			maxSize:  1 << 20,
+		},
+		"uncompressed, advertises supported extensions": {
+			supported: []graphsync.ExtensionName{graphsync.ExtensionMetadata, "AppleSauce/McGee"},
+			accepts:   acceptNone,
+			maxSize:   1 << 20,
+		},
+		"compressed, advertises supported extensions": {
+			accepted:  []compression.Algorithm{compression.Gzip},
+			supported: []graphsync.ExtensionName{graphsync.ExtensionMetadata},
+			algorithm: compression.Gzip,
+			accepts:   acceptGzip,
+			maxSize:   1 << 20,
+		},
+		"compressed": {
+			accepted:  []compression.Algorithm{compression.Gzip},
+			algorithm: compression.Gzip,
+			accepts:   acceptGzip,
+			maxSize:   1 << 20,
+		},
+		"compressed with unaccepted algorithm": {
+			algorithm:         compression.Gzip,
+			accepts:           acceptNone,
+			maxSize:           1 << 20,
+			expectedErrString: "received message compressed with unaccepted algorithm: gzip",
+		},
+		"compressed past the maximum size": {
+			algorithm:   compression.Gzip,
+			accepts:     acceptGzip,
+			maxSize:     1000,
+			expectedErr: compression.ErrDecompressedTooLarge,
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			frame, err := encodeFrame(msg, frameExtensions{compression: data.accepted, supported: data.supported}, data.algorithm)
+			require.NoError(t, err)
+			node, err := ipldutil.DecodeNode(frame)
+			require.NoError(t, err)
+			decoded, fe, err := decodeFrame(node, data.accepts, data.maxSize, gsmsg.DefaultDecodeLimits)
+			if data.expectedErr != nil {
+				require.Equal(t, data.expectedErr, err)
+				return
+			}
+			if data.expectedErrString != "" {
+				require.EqualError(t, err, data.expectedErrString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, data.accepted, fe.compression)
+			require.Equal(t, data.supported, fe.supported)
+			require.Len(t, decoded.Requests(), 1)
+			require.Equal(t, id, decoded.Requests()[0].ID())
+			require.Len(t, decoded.Responses(), 1)
+			require.ElementsMatch(t, blks, decoded.Blocks())
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package network
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// AddDialHints adds the given addresses for a peer to the peerstore, and dials
+// them directly the next time a connection to the peer is needed. If an HTTP
+// transport is set, peers with HTTP(S) addresses are sent messages over it
+func (gsnet *libp2pGraphSyncNetwork) AddDialHints(p peer.ID, addrs []ma.Multiaddr) {
+	if gsnet.http != nil {
+		gsnet.http.AddDialHints(p, addrs)
+		libp2pAddrs := make([]ma.Multiaddr, 0, len(addrs))
+		for _, addr := range addrs {
+			if !IsHTTPAddr(addr) {
+				libp2pAddrs = append(libp2pAddrs, addr)
+			}
+		}
+		addrs = libp2pAddrs
+	}
+	if len(addrs) == 0 {
+		return
+	}
+	gsnet.host.Peerstore().AddAddrs(p, addrs, peerstore.TempAddrTTL)
+	gsnet.dialHintsLk.Lock()
+	defer gsnet.dialHintsLk.Unlock()
+	gsnet.dialHints[p] = append(gsnet.dialHints[p], addrs...)
+}
+
+func (gsnet *libp2pGraphSyncNetwork) ConnectTo(ctx context.Context, p peer.ID) error {
+	if gsnet.usesHTTP(p) {
+		return gsnet.http.ConnectTo(ctx, p)
+	}
+	gsnet.dialHintsLk.RLock()
+	addrs := gsnet.dialHints[p]
+	gsnet.dialHintsLk.RUnlock()
+	err := gsnet.host.Connect(ctx, peer.AddrInfo{ID: p, Addrs: addrs})
+	if err != nil && len(gsnet.relays) > 0 {
+		log.Infof("could not connect directly to %s, trying relays: %s", p, err)
+		if relayErr := gsnet.connectViaRelays(ctx, p); relayErr == nil {
+			err = nil
+		}
+	}
+	if err == nil && addrs != nil {
+		gsnet.clearDialHints(p)
+	}
+	return err
+}
+
+func (gsnet *libp2pGraphSyncNetwork) clearDialHints(p peer.ID) {
+	gsnet.dialHintsLk.Lock()
+	defer gsnet.dialHintsLk.Unlock()
+	delete(gsnet.dialHints, p)
+}
@@ -0,0 +1,165 @@
+package network
+
+import (
+	"errors"
+
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/compression"
+	"github.com/ipfs/go-graphsync/ipldutil"
+)
+
+// builtinExtensions are the extensions handled by graphsync itself, which are
+// always advertised to peers
+var builtinExtensions = []graphsync.ExtensionName{
+	graphsync.ExtensionMetadata,
+	graphsync.ExtensionMetadataV2,
+	graphsync.ExtensionDoNotSendCIDs,
+	graphsync.ExtensionDeDupByKey,
+	graphsync.ExtensionStatusCategory,
+	graphsync.ExtensionBlockCompression,
+	graphsync.ExtensionMetadataOnly,
+	graphsync.ExtensionDedupWithinRequest,
+}
+
+// AdvertiseExtensions adds extensions handled by the application, usually
+// through hooks, to those advertised to peers on the dag-cbor protocol
+func AdvertiseExtensions(names []graphsync.ExtensionName) Option {
+	return func(gsnet *libp2pGraphSyncNetwork) {
+		gsnet.advertisedExtensions = append(gsnet.advertisedExtensions, names...)
+	}
+}
+
+// frameExtensions are the message level extensions carried in the ext map of
+// a frame on the dag-cbor protocol
+type frameExtensions struct {
+	// compression is the algorithms the sender accepts for compressed messages
+	compression []compression.Algorithm
+	// supported is the extensions the sender handles, sent on the first message
+	// to a peer on each connection
+	supported []graphsync.ExtensionName
+}
+
+func (fe frameExtensions) empty() bool {
+	return len(fe.compression) == 0 && len(fe.supported) == 0
+}
+
+func (fe frameExtensions) encode() (map[graphsync.ExtensionName][]byte, error) {
+	ext := make(map[graphsync.ExtensionName][]byte)
+	if len(fe.compression) > 0 {
+		data, err := compression.EncodeAlgorithms(fe.compression)
+		if err != nil {
+			return nil, err
+		}
+		ext[graphsync.ExtensionMessageCompression] = data
+	}
+	if len(fe.supported) > 0 {
+		data, err := encodeExtensionNames(fe.supported)
+		if err != nil {
+			return nil, err
+		}
+		ext[graphsync.ExtensionSupportedExtensions] = data
+	}
+	return ext, nil
+}
+
+func decodeFrameExtensions(extNode ipld.Node) (frameExtensions, error) {
+	var fe frameExtensions
+	compressionNode, err := extNode.LookupByString(string(graphsync.ExtensionMessageCompression))
+	if err == nil {
+		compressionData, err := compressionNode.AsBytes()
+		if err != nil {
+			return fe, err
+		}
+		fe.compression, err = compression.DecodeAlgorithms(compressionData)
+		if err != nil {
+			return fe, err
+		}
+	}
+	supportedNode, err := extNode.LookupByString(string(graphsync.ExtensionSupportedExtensions))
+	if err == nil {
+		supportedData, err := supportedNode.AsBytes()
+		if err != nil {
+			return fe, err
+		}
+		fe.supported, err = decodeExtensionNames(supportedData)
+		if err != nil {
+			return fe, err
+		}
+	}
+	return fe, nil
+}
+
+func encodeExtensionNames(names []graphsync.ExtensionName) ([]byte, error) {
+	list := fluent.MustBuildList(basicnode.Prototype.List, len(names), func(la fluent.ListAssembler) {
+		for _, name := range names {
+			la.AssembleValue().AssignString(string(name))
+		}
+	})
+	return ipldutil.EncodeNode(list)
+}
+
+func decodeExtensionNames(data []byte) ([]graphsync.ExtensionName, error) {
+	list, err := ipldutil.DecodeNode(data)
+	if err != nil {
+		return nil, err
+	}
+	iter := list.ListIterator()
+	if iter == nil {
+		return nil, errors.New("supported extensions must be a list")
+	}
+	names := make([]graphsync.ExtensionName, 0, list.Length())
+	for !iter.Done() {
+		_, next, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		name, err := next.AsString()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, graphsync.ExtensionName(name))
+	}
+	return names, nil
+}
+
+// SupportedExtensions returns the extensions the given peer advertised it
+// handles, or false if the peer has not advertised any since it connected
+func (gsnet *libp2pGraphSyncNetwork) SupportedExtensions(p peer.ID) ([]graphsync.ExtensionName, bool) {
+	gsnet.extensionsLk.RLock()
+	defer gsnet.extensionsLk.RUnlock()
+	names, ok := gsnet.extensionsByPeer[p]
+	return names, ok
+}
+
+func (gsnet *libp2pGraphSyncNetwork) setSupportedExtensions(p peer.ID, names []graphsync.ExtensionName) {
+	gsnet.extensionsLk.Lock()
+	defer gsnet.extensionsLk.Unlock()
+	gsnet.extensionsByPeer[p] = names
+}
+
+// needsAdvertisement returns whether our supported extensions have yet to be
+// sent to the given peer on its current connection
+func (gsnet *libp2pGraphSyncNetwork) needsAdvertisement(p peer.ID) bool {
+	gsnet.extensionsLk.RLock()
+	defer gsnet.extensionsLk.RUnlock()
+	_, advertised := gsnet.advertisedTo[p]
+	return !advertised
+}
+
+func (gsnet *libp2pGraphSyncNetwork) markAdvertised(p peer.ID) {
+	gsnet.extensionsLk.Lock()
+	defer gsnet.extensionsLk.Unlock()
+	gsnet.advertisedTo[p] = struct{}{}
+}
+
+func (gsnet *libp2pGraphSyncNetwork) clearPeerExtensions(p peer.ID) {
+	gsnet.extensionsLk.Lock()
+	defer gsnet.extensionsLk.Unlock()
+	delete(gsnet.extensionsByPeer, p)
+	delete(gsnet.advertisedTo, p)
+}
@@ -0,0 +1,297 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-msgio"
+
+	"github.com/ipfs/go-graphsync/ipldutil"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+)
+
+// On the dag-cbor protocol, blocks too large to fit in a single message are sent
+// ahead of the message that carries them as a series of fragment frames on
+// the same stream:
+//
+//   { frag: { cid Link, offset Int, total Int, data Bytes } }
+//
+// Fragments for a block are sent in order, one block at a time. The receiver
+// reassembles each block, verifies it against its CID, and adds it to the
+// next message frame read from the stream.
+
+const defaultFragmentSize = network.MessageSizeMax / 2
+
+const defaultMaxReassembledBlockSize = 256 << 20
+
+const defaultMaxReassemblyMemoryPerPeer = 256 << 20
+
+const defaultMaxReassemblyMemory = 1 << 30
+
+// BlockFragmentSize sets the size above which blocks are split into fragments
+// sent ahead of the message that carries them, on the dag-cbor protocol
+func BlockFragmentSize(fragmentSize int) Option {
+	return func(gsnet *libp2pGraphSyncNetwork) {
+		gsnet.fragmentSize = fragmentSize
+	}
+}
+
+// MaxReassembledBlockSize sets the largest block that will be reassembled from
+// fragments received on the dag-cbor protocol
+func MaxReassembledBlockSize(maxSize int) Option {
+	return func(gsnet *libp2pGraphSyncNetwork) {
+		gsnet.maxReassembledSize = maxSize
+	}
+}
+
+// MaxReassemblyMemory sets how much data from fragments of blocks not yet
+// complete may be held for each peer, and across all peers. Streams that
+// send fragments beyond either limit are reset
+func MaxReassemblyMemory(maxPerPeer int, maxTotal int) Option {
+	return func(gsnet *libp2pGraphSyncNetwork) {
+		gsnet.maxReassemblyPerPeer = maxPerPeer
+		gsnet.maxReassemblyTotal = maxTotal
+	}
+}
+
+// reassemblyBudget bounds the memory held by reassemblers, for each peer and
+// across all peers
+type reassemblyBudget struct {
+	maxPerPeer int
+	maxTotal   int
+	lk         sync.Mutex
+	total      int
+	byPeer     map[peer.ID]int
+}
+
+func newReassemblyBudget(maxPerPeer int, maxTotal int) *reassemblyBudget {
+	return &reassemblyBudget{
+		maxPerPeer: maxPerPeer,
+		maxTotal:   maxTotal,
+		byPeer:     make(map[peer.ID]int),
+	}
+}
+
+func (rb *reassemblyBudget) reserve(p peer.ID, size int) error {
+	rb.lk.Lock()
+	defer rb.lk.Unlock()
+	if rb.byPeer[p]+size > rb.maxPerPeer {
+		return fmt.Errorf("fragments from %s exceed reassembly memory limit %d", p, rb.maxPerPeer)
+	}
+	if rb.total+size > rb.maxTotal {
+		return fmt.Errorf("fragments exceed total reassembly memory limit %d", rb.maxTotal)
+	}
+	rb.byPeer[p] += size
+	rb.total += size
+	return nil
+}
+
+func (rb *reassemblyBudget) release(p peer.ID, size int) {
+	rb.lk.Lock()
+	defer rb.lk.Unlock()
+	rb.total -= size
+	rb.byPeer[p] -= size
+	if rb.byPeer[p] <= 0 {
+		delete(rb.byPeer, p)
+	}
+}
+
+// splitLargeBlocks separates blocks larger than fragmentSize from the rest of
+// the message
+func splitLargeBlocks(msg gsmsg.GraphSyncMessage, fragmentSize int) (gsmsg.GraphSyncMessage, []blocks.Block) {
+	var large []blocks.Block
+	for _, blk := range msg.Blocks() {
+		if len(blk.RawData()) > fragmentSize {
+			large = append(large, blk)
+		}
+	}
+	if len(large) == 0 {
+		return msg, nil
+	}
+	rest := gsmsg.New()
+	for _, request := range msg.Requests() {
+		rest.AddRequest(request)
+	}
+	for _, response := range msg.Responses() {
+		rest.AddResponse(response)
+	}
+	for _, blk := range msg.Blocks() {
+		if len(blk.RawData()) <= fragmentSize {
+			rest.AddBlock(blk)
+		}
+	}
+	return rest, large
+}
+
+func writeFragments(w msgio.WriteCloser, blk blocks.Block, fragmentSize int) error {
+	data := blk.RawData()
+	for offset := 0; offset < len(data); offset += fragmentSize {
+		end := offset + fragmentSize
+		if end > len(data) {
+			end = len(data)
+		}
+		frame, err := encodeFragment(blk, offset, data[offset:end])
+		if err != nil {
+			return err
+		}
+		if err := w.WriteMsg(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeFragment(blk blocks.Block, offset int, data []byte) ([]byte, error) {
+	node, err := fluent.Build(basicnode.Prototype.Map, func(na fluent.NodeAssembler) {
+		na.CreateMap(1, func(ma fluent.MapAssembler) {
+			ma.AssembleEntry("frag").CreateMap(4, func(ma fluent.MapAssembler) {
+				ma.AssembleEntry("cid").AssignLink(cidlink.Link{Cid: blk.Cid()})
+				ma.AssembleEntry("offset").AssignInt(offset)
+				ma.AssembleEntry("total").AssignInt(len(blk.RawData()))
+				ma.AssembleEntry("data").AssignBytes(data)
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ipldutil.EncodeNode(node)
+}
+
+// reassembler rebuilds blocks from the fragments received on a single stream.
+// Memory is reserved from the budget as fragments arrive, rather than for the
+// size the peer declares, and released once the blocks are handed off with
+// their message or the stream ends
+type reassembler struct {
+	p         peer.ID
+	budget    *reassemblyBudget
+	reserved  int
+	maxSize   int
+	link      cidlink.Link
+	total     int
+	data      []byte
+	completed []blocks.Block
+}
+
+func newReassembler(p peer.ID, maxSize int, budget *reassemblyBudget) *reassembler {
+	return &reassembler{p: p, maxSize: maxSize, budget: budget}
+}
+
+// release returns all memory held by the reassembler to the budget
+func (ra *reassembler) release() {
+	if ra.budget != nil && ra.reserved > 0 {
+		ra.budget.release(ra.p, ra.reserved)
+	}
+	ra.reserved = 0
+}
+
+// drop discards any blocks being reassembled, for a message that is rejected
+func (ra *reassembler) drop() {
+	ra.data = nil
+	ra.completed = nil
+	ra.release()
+}
+
+func (ra *reassembler) addFragment(frag ipld.Node) error {
+	linkNode, err := frag.LookupByString("cid")
+	if err != nil {
+		return err
+	}
+	link, err := linkNode.AsLink()
+	if err != nil {
+		return err
+	}
+	cidLink, ok := link.(cidlink.Link)
+	if !ok {
+		return errors.New("fragment is not for a CID")
+	}
+	offsetNode, err := frag.LookupByString("offset")
+	if err != nil {
+		return err
+	}
+	offset, err := offsetNode.AsInt()
+	if err != nil {
+		return err
+	}
+	totalNode, err := frag.LookupByString("total")
+	if err != nil {
+		return err
+	}
+	total, err := totalNode.AsInt()
+	if err != nil {
+		return err
+	}
+	dataNode, err := frag.LookupByString("data")
+	if err != nil {
+		return err
+	}
+	data, err := dataNode.AsBytes()
+	if err != nil {
+		return err
+	}
+
+	if offset == 0 {
+		if ra.data != nil {
+			return fmt.Errorf("received new block %s before block %s was complete", cidLink.Cid, ra.link.Cid)
+		}
+		if total <= 0 || total > ra.maxSize {
+			return fmt.Errorf("fragmented block size %d exceeds maximum %d", total, ra.maxSize)
+		}
+		ra.link = cidLink
+		ra.total = total
+		ra.data = []byte{}
+	}
+	if ra.data == nil || cidLink.Cid != ra.link.Cid || total != ra.total || offset != len(ra.data) {
+		return fmt.Errorf("received out of order fragment for block %s", cidLink.Cid)
+	}
+	if len(ra.data)+len(data) > ra.total {
+		return fmt.Errorf("fragments for block %s exceed its size", cidLink.Cid)
+	}
+	if ra.budget != nil {
+		if err := ra.budget.reserve(ra.p, len(data)); err != nil {
+			return err
+		}
+	}
+	ra.reserved += len(data)
+	ra.data = append(ra.data, data...)
+	if len(ra.data) < ra.total {
+		return nil
+	}
+
+	c, err := ra.link.Cid.Prefix().Sum(ra.data)
+	if err != nil {
+		return err
+	}
+	if !c.Equals(ra.link.Cid) {
+		return fmt.Errorf("reassembled block does not match cid %s", ra.link.Cid)
+	}
+	blk, err := blocks.NewBlockWithCid(ra.data, c)
+	if err != nil {
+		return err
+	}
+	ra.completed = append(ra.completed, blk)
+	ra.data = nil
+	return nil
+}
+
+// completeMessage adds all reassembled blocks to the message they were sent
+// ahead of
+func (ra *reassembler) completeMessage(msg gsmsg.GraphSyncMessage) error {
+	if ra.data != nil {
+		return fmt.Errorf("received message before block %s was complete", ra.link.Cid)
+	}
+	for _, blk := range ra.completed {
+		msg.AddBlock(blk)
+	}
+	ra.completed = nil
+	ra.release()
+	return nil
+}
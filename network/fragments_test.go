@@ -0,0 +1,125 @@
+package network
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/libp2p/go-msgio"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestBlockFragments(t *testing.T) {
+	fragmentSize := 100
+	smallBlock := testutil.GenerateBlocksOfSize(1, 50)[0]
+	largeBlocks := testutil.GenerateBlocksOfSize(2, 250)
+	id := graphsync.RequestID(rand.Int31())
+
+	p := testutil.GeneratePeers(1)[0]
+	testCases := map[string]struct {
+		writeFragments func(w msgio.WriteCloser)
+		budget         *reassemblyBudget
+		expectedErr    string
+	}{
+		"reassembles blocks": {
+			writeFragments: func(w msgio.WriteCloser) {
+				for _, blk := range largeBlocks {
+					require.NoError(t, writeFragments(w, blk, fragmentSize))
+				}
+			},
+		},
+		"rejects corrupted blocks": {
+			writeFragments: func(w msgio.WriteCloser) {
+				corrupted := append([]byte{}, largeBlocks[0].RawData()...)
+				corrupted[0]++
+				blk, err := blocks.NewBlockWithCid(corrupted, largeBlocks[0].Cid())
+				require.NoError(t, err)
+				require.NoError(t, writeFragments(w, blk, fragmentSize))
+			},
+			expectedErr: "reassembled block does not match cid " + largeBlocks[0].Cid().String(),
+		},
+		"rejects incomplete blocks": {
+			writeFragments: func(w msgio.WriteCloser) {
+				frame, err := encodeFragment(largeBlocks[0], 0, largeBlocks[0].RawData()[:fragmentSize])
+				require.NoError(t, err)
+				require.NoError(t, w.WriteMsg(frame))
+			},
+			expectedErr: "received message before block " + largeBlocks[0].Cid().String() + " was complete",
+		},
+		"rejects fragments beyond the peer's memory budget": {
+			writeFragments: func(w msgio.WriteCloser) {
+				require.NoError(t, writeFragments(w, largeBlocks[0], fragmentSize))
+			},
+			budget:      newReassemblyBudget(200, 1000),
+			expectedErr: "fragments from " + p.String() + " exceed reassembly memory limit 200",
+		},
+		"rejects fragments beyond the total memory budget": {
+			writeFragments: func(w msgio.WriteCloser) {
+				require.NoError(t, writeFragments(w, largeBlocks[0], fragmentSize))
+			},
+			budget:      newReassemblyBudget(1000, 200),
+			expectedErr: "fragments exceed total reassembly memory limit 200",
+		},
+		"rejects out of order fragments": {
+			writeFragments: func(w msgio.WriteCloser) {
+				frame, err := encodeFragment(largeBlocks[0], fragmentSize, largeBlocks[0].RawData()[fragmentSize:])
+				require.NoError(t, err)
+				require.NoError(t, w.WriteMsg(frame))
+			},
+			expectedErr: "received out of order fragment for block " + largeBlocks[0].Cid().String(),
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			var buf bytes.Buffer
+			writer := msgio.NewVarintWriter(&buf)
+			data.writeFragments(writer)
+			msg := gsmsg.New()
+			msg.AddResponse(gsmsg.NewResponse(id, graphsync.PartialResponse))
+			msg.AddBlock(smallBlock)
+			require.NoError(t, msg.ToNetDagCBOR(&buf))
+
+			gsnet := &libp2pGraphSyncNetwork{maxDecompressedSize: 1 << 20}
+			reader := msgio.NewVarintReaderSize(&buf, 1<<20)
+			budget := data.budget
+			if budget == nil {
+				budget = newReassemblyBudget(1000, 1000)
+			}
+			ra := newReassembler(p, 1000, budget)
+			received, err := gsnet.msgFromReaderDagCBOR(p, reader, ra)
+			ra.release()
+			require.Zero(t, budget.total)
+			if data.expectedErr != "" {
+				require.EqualError(t, err, data.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, received.Responses(), 1)
+			require.ElementsMatch(t, append([]blocks.Block{smallBlock}, largeBlocks...), received.Blocks())
+		})
+	}
+}
+
+func TestSplitLargeBlocks(t *testing.T) {
+	smallBlock := testutil.GenerateBlocksOfSize(1, 50)[0]
+	largeBlock := testutil.GenerateBlocksOfSize(1, 250)[0]
+	id := graphsync.RequestID(rand.Int31())
+	msg := gsmsg.New()
+	msg.AddResponse(gsmsg.NewResponse(id, graphsync.PartialResponse))
+	msg.AddBlock(smallBlock)
+
+	rest, large := splitLargeBlocks(msg, 100)
+	require.Equal(t, msg, rest)
+	require.Empty(t, large)
+
+	msg.AddBlock(largeBlock)
+	rest, large = splitLargeBlocks(msg, 100)
+	require.Equal(t, []blocks.Block{largeBlock}, large)
+	require.Equal(t, []blocks.Block{smallBlock}, rest.Blocks())
+	require.Len(t, rest.Responses(), 1)
+}
@@ -0,0 +1,358 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/connmgr"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+)
+
+// HTTPPath is the path graphsync messages are posted to on a peer's HTTP(S)
+// address
+const HTTPPath = "/graphsync"
+
+// HTTPPeerHeader carries the ID of the peer that claims to have sent a message
+// over HTTP. It is not proof of the sender, but authenticators may check it
+// against the credentials on the request
+const HTTPPeerHeader = "Graphsync-Peer"
+
+// HTTPReturnAddressHeader carries the HTTP(S) multiaddr the sender of a message
+// receives messages on. Once the sender is authenticated, messages back to it
+// are posted to this address, so peers that cannot accept libp2p connections
+// still receive responses
+const HTTPReturnAddressHeader = "Graphsync-Return-Address"
+
+// HTTPAuthenticator returns the peer that sent a message over HTTP, once it
+// has established who sent the request -- for example from a client
+// certificate or a signed token. It returns an error if the request cannot be
+// authenticated. Messages to the returned peer are posted to the address in
+// the HTTPReturnAddressHeader, so authenticators that check a signature over
+// the request must cover that header too
+type HTTPAuthenticator func(r *http.Request) (peer.ID, error)
+
+// HTTPNetwork carries graphsync messages over HTTP(S), for environments where
+// libp2p connections are blocked. Each message is posted to the receiving
+// peer's HTTPPath encoded as on the v1 protocol. Peers are reached on
+// addresses added with AddDialHints that end in /http or /https, such as
+// /dns4/example.com/tcp/443/https, or on the return address they sent with
+// their last authenticated message.
+//
+// Messages are only received once an HTTPAuthenticator is set, which
+// establishes the peer that sent each one
+type HTTPNetwork struct {
+	self   peer.ID
+	client *http.Client
+
+	receiverLk   sync.RWMutex
+	receiver     Receiver
+	authenticate HTTPAuthenticator
+
+	decodeLimits   gsmsg.DecodeLimits
+	maxMessageSize int
+
+	returnAddr string
+
+	urlsLk sync.RWMutex
+	urls   map[peer.ID]string
+
+	wireCounters *wireCounters
+}
+
+// NewHTTPNetwork returns a GraphSyncNetwork that sends messages from the given
+// peer over HTTP with the given client, or http.DefaultClient if it is nil.
+// Incoming messages are received by mounting the network as an http.Handler
+// at HTTPPath
+func NewHTTPNetwork(self peer.ID, client *http.Client) *HTTPNetwork {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPNetwork{
+		self:           self,
+		client:         client,
+		decodeLimits:   gsmsg.DefaultDecodeLimits,
+		maxMessageSize: network.MessageSizeMax,
+		urls:           make(map[peer.ID]string),
+		wireCounters:   newWireCounters(),
+	}
+}
+
+// SetDecodeLimits sets the limits on the contents of messages received from
+// peers. It should be called before the handler is served
+func (hn *HTTPNetwork) SetDecodeLimits(limits gsmsg.DecodeLimits) {
+	hn.decodeLimits = limits
+}
+
+// SetMaxMessageSize sets the largest message accepted from peers, in bytes.
+// Larger messages are rejected as they are with the MaxMessageSize option,
+// which also sets this limit when the network is used as an HTTPTransport.
+// Messages over HTTP are always limited, so sizes of zero or less are ignored.
+// It should be called before the handler is served
+func (hn *HTTPNetwork) SetMaxMessageSize(maxSize int) {
+	if maxSize > 0 {
+		hn.maxMessageSize = maxSize
+	}
+}
+
+// SetAuthenticator sets how the peer that sent each message is established.
+// Until it is set, all messages are rejected. It should be called before the
+// handler is served
+func (hn *HTTPNetwork) SetAuthenticator(authenticate HTTPAuthenticator) {
+	hn.receiverLk.Lock()
+	defer hn.receiverLk.Unlock()
+	hn.authenticate = authenticate
+}
+
+// SetReturnAddress sets the HTTP(S) address this network is served on, which
+// is sent with every message so peers can reply over HTTP without a dial hint
+// for this peer. It should be called before messages are sent
+func (hn *HTTPNetwork) SetReturnAddress(addr ma.Multiaddr) error {
+	if _, err := httpURL(addr); err != nil {
+		return err
+	}
+	hn.returnAddr = addr.String()
+	return nil
+}
+
+// IsHTTPAddr returns true if the given address reaches a peer over HTTP(S)
+func IsHTTPAddr(addr ma.Multiaddr) bool {
+	_, err := httpURL(addr)
+	return err == nil
+}
+
+func httpURL(addr ma.Multiaddr) (string, error) {
+	scheme := ""
+	if _, err := addr.ValueForProtocol(ma.P_HTTPS); err == nil {
+		scheme = "https"
+	} else if _, err := addr.ValueForProtocol(ma.P_HTTP); err == nil {
+		scheme = "http"
+	} else {
+		return "", errors.New("address is not http or https")
+	}
+	port, err := addr.ValueForProtocol(ma.P_TCP)
+	if err != nil {
+		return "", err
+	}
+	for _, code := range []int{ma.P_DNS, ma.P_DNS4, ma.P_DNS6, ma.P_IP4, ma.P_IP6} {
+		host, err := addr.ValueForProtocol(code)
+		if err == nil {
+			return fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(host, port), HTTPPath), nil
+		}
+	}
+	return "", errors.New("address has no host")
+}
+
+// AddDialHints records the first HTTP(S) address among the given addresses
+// as the one to post messages to the peer on. Other addresses are ignored
+func (hn *HTTPNetwork) AddDialHints(p peer.ID, addrs []ma.Multiaddr) {
+	for _, addr := range addrs {
+		url, err := httpURL(addr)
+		if err != nil {
+			continue
+		}
+		hn.urlsLk.Lock()
+		hn.urls[p] = url
+		hn.urlsLk.Unlock()
+		return
+	}
+}
+
+func (hn *HTTPNetwork) peerURL(p peer.ID) (string, bool) {
+	hn.urlsLk.RLock()
+	defer hn.urlsLk.RUnlock()
+	url, ok := hn.urls[p]
+	return url, ok
+}
+
+// SendMessage posts a message to the given peer
+func (hn *HTTPNetwork) SendMessage(ctx context.Context, p peer.ID, outgoing gsmsg.GraphSyncMessage) error {
+	url, ok := hn.peerURL(p)
+	if !ok {
+		return fmt.Errorf("no http address for peer %s", p)
+	}
+	var buf bytes.Buffer
+	if err := outgoing.ToNet(&buf); err != nil {
+		return err
+	}
+	size := buf.Len()
+	req, err := http.NewRequest(http.MethodPost, url, &buf)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set(HTTPPeerHeader, peer.Encode(hn.self))
+	if hn.returnAddr != "" {
+		req.Header.Set(HTTPReturnAddressHeader, hn.returnAddr)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := hn.client.Do(req)
+	hn.wireCounters.sent(p, size, err)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("sending message to %s failed: %s", p, resp.Status)
+	}
+	return nil
+}
+
+// ServeHTTP receives messages posted by peers
+func (hn *HTTPNetwork) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hn.receiverLk.RLock()
+	receiver := hn.receiver
+	authenticate := hn.authenticate
+	hn.receiverLk.RUnlock()
+	if receiver == nil || authenticate == nil {
+		http.Error(w, "not accepting messages", http.StatusServiceUnavailable)
+		return
+	}
+	sender, err := authenticate(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if returnAddr := r.Header.Get(HTTPReturnAddressHeader); returnAddr != "" {
+		addr, err := ma.NewMultiaddr(returnAddr)
+		if err != nil || !IsHTTPAddr(addr) {
+			http.Error(w, "invalid return address", http.StatusBadRequest)
+			return
+		}
+		hn.AddDialHints(sender, []ma.Multiaddr{addr})
+	}
+	msgReader := newMsgReader(r.Body, math.MaxInt32)
+	reader := &sizeCountingReader{Reader: msgReader}
+	length, err := reader.NextMsgLen()
+	if err == nil && length > hn.maxMessageSize {
+		reader.size += length
+		reader.wireSize += uvarintSize(length) + length
+		err = rejectOversized(sender, msgReader, length, hn.maxMessageSize, hn.decodeLimits)
+		var tooLarge *MessageTooLargeError
+		if errors.As(err, &tooLarge) {
+			hn.wireCounters.received(sender, reader.wireSize)
+			go receiver.ReceiveError(tooLarge)
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+	var received gsmsg.GraphSyncMessage
+	if err == nil {
+		received, err = gsmsg.FromMsgReaderWithLimits(reader, hn.decodeLimits)
+	}
+	if err != nil {
+		go receiver.ReceiveError(&MessageReceiveError{Peer: sender, Err: err})
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hn.wireCounters.received(sender, reader.wireSize)
+	receiver.ReceiveMessage(context.Background(), sender, received)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetDelegate registers the Receiver to handle messages received over HTTP
+func (hn *HTTPNetwork) SetDelegate(r Receiver) {
+	hn.receiverLk.Lock()
+	defer hn.receiverLk.Unlock()
+	hn.receiver = r
+}
+
+// Stop stops passing messages received over HTTP to the receiver
+func (hn *HTTPNetwork) Stop() {
+	hn.receiverLk.Lock()
+	defer hn.receiverLk.Unlock()
+	hn.receiver = nil
+}
+
+// ConnectTo succeeds if an HTTP(S) address is known for the peer, as messages
+// are sent without a persistent connection
+func (hn *HTTPNetwork) ConnectTo(ctx context.Context, p peer.ID) error {
+	if _, ok := hn.peerURL(p); !ok {
+		return fmt.Errorf("no http address for peer %s", p)
+	}
+	return nil
+}
+
+// NewMessageSender returns a sender that posts each message to the peer
+func (hn *HTTPNetwork) NewMessageSender(ctx context.Context, p peer.ID) (MessageSender, error) {
+	if err := hn.ConnectTo(ctx, p); err != nil {
+		return nil, err
+	}
+	return &httpMessageSender{hn, p}, nil
+}
+
+// ProtocolVersion always returns false, as no protocol is negotiated over HTTP
+func (hn *HTTPNetwork) ProtocolVersion(p peer.ID) (protocol.ID, bool) {
+	return "", false
+}
+
+// SupportedExtensions always returns false, as peers do not advertise
+// extensions over HTTP
+func (hn *HTTPNetwork) SupportedExtensions(p peer.ID) ([]graphsync.ExtensionName, bool) {
+	return nil, false
+}
+
+// ConnectionManager returns a connection manager that does nothing, as there
+// are no connections to protect
+func (hn *HTTPNetwork) ConnectionManager() ConnManager {
+	return connmgr.NullConnMgr{}
+}
+
+// WireStats returns the messages and message bytes exchanged with the given
+// peer, not counting HTTP headers
+func (hn *HTTPNetwork) WireStats(p peer.ID) WireStats {
+	return hn.wireCounters.get(p)
+}
+
+// IsRelayed always returns false
+func (hn *HTTPNetwork) IsRelayed(p peer.ID) bool {
+	return false
+}
+
+type httpMessageSender struct {
+	hn *HTTPNetwork
+	p  peer.ID
+}
+
+func (s *httpMessageSender) SendMsg(ctx context.Context, msg gsmsg.GraphSyncMessage) error {
+	return s.hn.SendMessage(ctx, s.p, msg)
+}
+
+func (s *httpMessageSender) Close() error { return nil }
+func (s *httpMessageSender) Reset() error { return nil }
+
+// HTTPTransport sends messages over the given HTTP network to peers that have
+// an HTTP(S) address added with AddDialHints, and over libp2p to all others.
+// Messages the HTTP network receives are passed to the same receiver
+func HTTPTransport(hn *HTTPNetwork) Option {
+	return func(gsnet *libp2pGraphSyncNetwork) {
+		gsnet.http = hn
+	}
+}
+
+// usesHTTP returns true if messages to the given peer are sent over HTTP
+func (gsnet *libp2pGraphSyncNetwork) usesHTTP(p peer.ID) bool {
+	if gsnet.http == nil {
+		return false
+	}
+	_, ok := gsnet.http.peerURL(p)
+	return ok
+}
@@ -0,0 +1,198 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestHTTPURL(t *testing.T) {
+	url, err := httpURL(ma.StringCast("/dns4/example.com/tcp/443/https"))
+	require.NoError(t, err)
+	require.Equal(t, "https://example.com:443/graphsync", url)
+	url, err = httpURL(ma.StringCast("/ip6/::1/tcp/8080/http"))
+	require.NoError(t, err)
+	require.Equal(t, "http://[::1]:8080/graphsync", url)
+	require.False(t, IsHTTPAddr(ma.StringCast("/ip4/127.0.0.1/tcp/4001")))
+}
+
+func TestHTTPMessageSendAndReceive(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	peers := testutil.GeneratePeers(2)
+	token := "secret"
+	httpNet1 := NewHTTPNetwork(peers[0], &http.Client{Transport: &bearerTransport{&token}})
+	httpNet2 := NewHTTPNetwork(peers[1], nil)
+	r := &receiver{
+		messageReceived: make(chan struct{}),
+		connectedPeers:  make(chan peer.ID, 2),
+	}
+	httpNet2.SetDelegate(r)
+	server := httptest.NewServer(httpNet2)
+	defer server.Close()
+
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+	addr := ma.StringCast(fmt.Sprintf("/ip4/%s/tcp/%s/http", host, port))
+
+	require.Error(t, httpNet1.ConnectTo(ctx, peers[1]))
+	httpNet1.AddDialHints(peers[1], []ma.Multiaddr{addr})
+	require.NoError(t, httpNet1.ConnectTo(ctx, peers[1]))
+
+	root := testutil.GenerateCids(1)[0]
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	selector := ssb.Matcher().Node()
+	id := graphsync.RequestID(rand.Int31())
+	priority := graphsync.Priority(rand.Int31())
+	sent := gsmsg.New()
+	sent.AddRequest(gsmsg.NewRequest(id, root, selector, priority))
+
+	// messages are rejected until an authenticator is set
+	require.Error(t, httpNet1.SendMessage(ctx, peers[1], sent))
+	httpNet2.SetAuthenticator(func(r *http.Request) (peer.ID, error) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			return "", errors.New("invalid token")
+		}
+		return peers[0], nil
+	})
+
+	go func() {
+		_ = httpNet1.SendMessage(ctx, peers[1], sent)
+	}()
+	testutil.AssertDoesReceive(ctx, t, r.messageReceived, "message did not send")
+	require.Equal(t, peers[0], r.lastSender)
+	received := r.lastMessage
+	require.Len(t, received.Requests(), 1)
+	require.Equal(t, id, received.Requests()[0].ID())
+	require.Equal(t, root, received.Requests()[0].Root())
+
+	// messages that fail authentication are rejected
+	token = "wrong"
+	require.Error(t, httpNet1.SendMessage(ctx, peers[1], sent))
+}
+
+func TestHTTPRepliesToReturnAddress(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	peers := testutil.GeneratePeers(2)
+	httpNet1 := NewHTTPNetwork(peers[0], nil)
+	httpNet2 := NewHTTPNetwork(peers[1], nil)
+	r1 := &receiver{messageReceived: make(chan struct{})}
+	r2 := &receiver{messageReceived: make(chan struct{})}
+	httpNet1.SetDelegate(r1)
+	httpNet2.SetDelegate(r2)
+	authenticate := func(p peer.ID) HTTPAuthenticator {
+		return func(r *http.Request) (peer.ID, error) { return p, nil }
+	}
+	httpNet1.SetAuthenticator(authenticate(peers[1]))
+	httpNet2.SetAuthenticator(authenticate(peers[0]))
+	server1 := httptest.NewServer(httpNet1)
+	defer server1.Close()
+	server2 := httptest.NewServer(httpNet2)
+	defer server2.Close()
+
+	httpNet1.AddDialHints(peers[1], []ma.Multiaddr{serverAddr(t, server2)})
+	require.Error(t, httpNet1.SetReturnAddress(ma.StringCast("/ip4/127.0.0.1/tcp/4001")))
+	require.NoError(t, httpNet1.SetReturnAddress(serverAddr(t, server1)))
+
+	// the responder knows no address for the requestor until it sends one
+	require.Error(t, httpNet2.ConnectTo(ctx, peers[0]))
+	id := graphsync.RequestID(rand.Int31())
+	request := gsmsg.New()
+	request.AddRequest(gsmsg.CancelRequest(id))
+	go func() {
+		_ = httpNet1.SendMessage(ctx, peers[1], request)
+	}()
+	testutil.AssertDoesReceive(ctx, t, r2.messageReceived, "request did not send")
+
+	response := gsmsg.New()
+	response.AddResponse(gsmsg.NewResponse(id, graphsync.RequestCancelled))
+	go func() {
+		_ = httpNet2.SendMessage(ctx, peers[0], response)
+	}()
+	testutil.AssertDoesReceive(ctx, t, r1.messageReceived, "response did not send")
+	require.Equal(t, peers[1], r1.lastSender)
+	require.Len(t, r1.lastMessage.Responses(), 1)
+	require.Equal(t, id, r1.lastMessage.Responses()[0].RequestID())
+}
+
+func serverAddr(t *testing.T, server *httptest.Server) ma.Multiaddr {
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+	return ma.StringCast(fmt.Sprintf("/ip4/%s/tcp/%s/http", host, port))
+}
+
+type bearerTransport struct {
+	token *string
+}
+
+func (bt *bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+*bt.token)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestHTTPRejectsOversizedMessages(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	peers := testutil.GeneratePeers(2)
+	httpNet1 := NewHTTPNetwork(peers[0], nil)
+	httpNet2 := NewHTTPNetwork(peers[1], nil)
+	// the limit set on the libp2p network applies to messages over http
+	_ = NewFromLibp2pHost(nil, MaxMessageSize(2000), HTTPTransport(httpNet2))
+	r := &receiver{
+		messageReceived: make(chan struct{}),
+		errors:          make(chan error, 1),
+	}
+	httpNet2.SetDelegate(r)
+	httpNet2.SetAuthenticator(func(r *http.Request) (peer.ID, error) { return peers[0], nil })
+	server := httptest.NewServer(httpNet2)
+	defer server.Close()
+	httpNet1.AddDialHints(peers[1], []ma.Multiaddr{serverAddr(t, server)})
+
+	requestID := graphsync.RequestID(rand.Int31())
+	large := gsmsg.New()
+	large.AddResponse(gsmsg.NewResponse(requestID, graphsync.PartialResponse))
+	large.AddBlock(testutil.GenerateBlocksOfSize(1, 5000)[0])
+	require.Error(t, httpNet1.SendMessage(ctx, peers[1], large))
+
+	var received error
+	testutil.AssertReceive(ctx, t, r.errors, &received, "oversized message was not rejected")
+	var tooLarge *MessageTooLargeError
+	require.True(t, errors.As(received, &tooLarge))
+	require.Equal(t, peers[0], tooLarge.Peer)
+	require.Equal(t, 2000, tooLarge.Max)
+	require.Greater(t, tooLarge.Size, 2000)
+	require.Equal(t, requestID, tooLarge.Message.Responses()[0].RequestID())
+	require.Equal(t, uint64(1), httpNet2.WireStats(peers[0]).MessagesReceived)
+
+	small := gsmsg.New()
+	small.AddResponse(gsmsg.NewResponse(requestID, graphsync.RequestCompletedFull))
+	go func() {
+		_ = httpNet1.SendMessage(ctx, peers[1], small)
+	}()
+	testutil.AssertDoesReceive(ctx, t, r.messageReceived, "message did not send")
+	require.Equal(t, graphsync.RequestCompletedFull, r.lastMessage.Responses()[0].Status())
+}
@@ -5,13 +5,22 @@ import (
 
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
 
+	"github.com/ipfs/go-graphsync"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 )
 
 var (
 	// ProtocolGraphsync is the protocol identifier for graphsync messages
+	// encoded as protobuf
 	ProtocolGraphsync protocol.ID = "/ipfs/graphsync/1.0.0"
+
+	// ProtocolGraphsyncDagCBOR is the protocol identifier for graphsync messages
+	// encoded as dag-cbor IPLD data. The encoding is experimental and not the
+	// upstream graphsync v2 protocol, so it is only used when enabled with
+	// EnableDagCBORProtocol
+	ProtocolGraphsyncDagCBOR protocol.ID = "/ipfs/graphsync/x-dagcbor/0.1.0"
 )
 
 // GraphSyncNetwork provides network connectivity for GraphSync.
@@ -27,10 +36,42 @@ type GraphSyncNetwork interface {
 	// network.
 	SetDelegate(Receiver)
 
+	// Stop stops receiving messages from the network and removes the
+	// delegate, so nothing is passed to it once Stop returns
+	Stop()
+
 	// ConnectTo establishes a connection to the given peer
 	ConnectTo(context.Context, peer.ID) error
 
+	// AddDialHints adds addresses to dial the given peer on, in addition to
+	// any already known for it
+	AddDialHints(peer.ID, []ma.Multiaddr)
+
+	// IsRelayed returns true if the peer is only connected through a relay
+	IsRelayed(peer.ID) bool
+
+	// WireStats returns the messages and bytes exchanged with the given peer
+	WireStats(peer.ID) WireStats
+
 	NewMessageSender(context.Context, peer.ID) (MessageSender, error)
+
+	// ProtocolVersion returns the protocol last negotiated with the given peer,
+	// or false if no protocol has been negotiated with the peer while connected
+	ProtocolVersion(peer.ID) (protocol.ID, bool)
+
+	// SupportedExtensions returns the extensions the given peer advertised it
+	// handles, or false if it has not advertised any while connected
+	SupportedExtensions(peer.ID) ([]graphsync.ExtensionName, bool)
+
+	// ConnectionManager returns the connection manager used to protect
+	// connections to peers from being pruned
+	ConnectionManager() ConnManager
+}
+
+// ConnManager provides the methods needed to protect and unprotect connections
+type ConnManager interface {
+	Protect(peer.ID, string)
+	Unprotect(peer.ID, string) bool
 }
 
 // MessageSender is an interface to send messages to a peer
@@ -47,6 +88,8 @@ type Receiver interface {
 		sender peer.ID,
 		incoming gsmsg.GraphSyncMessage)
 
+	// ReceiveError is called with errors receiving messages. Errors from a
+	// specific peer are a *MessageReceiveError or *MessageTooLargeError
 	ReceiveError(error)
 
 	Connected(p peer.ID)
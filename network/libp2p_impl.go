@@ -2,28 +2,87 @@ package network
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"sync"
 	"time"
 
 	logging "github.com/ipfs/go-log"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
 	"github.com/libp2p/go-msgio"
 	ma "github.com/multiformats/go-multiaddr"
 
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/compression"
+	"github.com/ipfs/go-graphsync/ipldutil"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 )
 
 var log = logging.Logger("graphsync_network")
 
-var sendMessageTimeout = time.Minute * 10
+// Option is an option for configuring the libp2p network
+type Option func(*libp2pGraphSyncNetwork)
+
+// GraphsyncProtocols sets the protocols this network supports, in order of
+// preference. By default only v1 is supported, so that peers running
+// upstream graphsync, which does not know the dag-cbor protocol, are never
+// offered it
+func GraphsyncProtocols(protocols []protocol.ID) Option {
+	return func(gsnet *libp2pGraphSyncNetwork) {
+		gsnet.protocols = protocols
+	}
+}
+
+// EnableDagCBORProtocol prefers the experimental dag-cbor protocol, falling
+// back to v1 for peers that do not support it. The protocol is opt in on
+// purpose: its encoding is not the upstream graphsync v2 wire format, so it
+// is only worth enabling between peers that all run this implementation.
+// Message compression, block fragments and extension advertisement only work
+// on the dag-cbor protocol, and are unused on a network without this option
+func EnableDagCBORProtocol() Option {
+	return func(gsnet *libp2pGraphSyncNetwork) {
+		gsnet.protocols = []protocol.ID{ProtocolGraphsyncDagCBOR, ProtocolGraphsync}
+	}
+}
+
+// MessageDecodeLimits sets the limits on the contents of messages received
+// from peers. Messages that exceed them are rejected
+func MessageDecodeLimits(limits gsmsg.DecodeLimits) Option {
+	return func(gsnet *libp2pGraphSyncNetwork) {
+		gsnet.decodeLimits = limits
+	}
+}
 
 // NewFromLibp2pHost returns a GraphSyncNetwork supported by underlying Libp2p host.
-func NewFromLibp2pHost(host host.Host) GraphSyncNetwork {
+func NewFromLibp2pHost(host host.Host, options ...Option) GraphSyncNetwork {
 	graphSyncNetwork := libp2pGraphSyncNetwork{
-		host: host,
+		host:                 host,
+		protocols:            []protocol.ID{ProtocolGraphsync},
+		maxDecompressedSize:  network.MessageSizeMax,
+		fragmentSize:         defaultFragmentSize,
+		maxReassembledSize:   defaultMaxReassembledBlockSize,
+		maxReassemblyPerPeer: defaultMaxReassemblyMemoryPerPeer,
+		maxReassemblyTotal:   defaultMaxReassemblyMemory,
+		compressionByPeer:    make(map[peer.ID]compression.Algorithm),
+		protocolByPeer:       make(map[peer.ID]protocol.ID),
+		decodeLimits:         gsmsg.DefaultDecodeLimits,
+		sendMessageTimeout:   defaultSendMessageTimeout,
+		extensionsByPeer:     make(map[peer.ID][]graphsync.ExtensionName),
+		advertisedTo:         make(map[peer.ID]struct{}),
+		dialHints:            make(map[peer.ID][]ma.Multiaddr),
+		wireCounters:         newWireCounters(),
+	}
+	graphSyncNetwork.advertisedExtensions = append(graphSyncNetwork.advertisedExtensions, builtinExtensions...)
+	for _, option := range options {
+		option(&graphSyncNetwork)
+	}
+	graphSyncNetwork.reassemblyBudget = newReassemblyBudget(graphSyncNetwork.maxReassemblyPerPeer, graphSyncNetwork.maxReassemblyTotal)
+	if graphSyncNetwork.http != nil {
+		graphSyncNetwork.http.SetMaxMessageSize(graphSyncNetwork.maxMessageSize)
 	}
 
 	return &graphSyncNetwork
@@ -32,13 +91,50 @@ func NewFromLibp2pHost(host host.Host) GraphSyncNetwork {
 // libp2pGraphSyncNetwork transforms the libp2p host interface, which sends and receives
 // NetMessage objects, into the graphsync network interface.
 type libp2pGraphSyncNetwork struct {
-	host host.Host
+	host           host.Host
+	protocols      []protocol.ID
+	protocolLk     sync.RWMutex
+	protocolByPeer map[peer.ID]protocol.ID
 	// inbound messages from the network are forwarded to the receiver
-	receiver Receiver
+	receiverLk sync.RWMutex
+	receiver   Receiver
+
+	messageCompression  []compression.Algorithm
+	maxDecompressedSize int
+	compressionLk       sync.RWMutex
+	compressionByPeer   map[peer.ID]compression.Algorithm
+
+	fragmentSize         int
+	maxReassembledSize   int
+	maxReassemblyPerPeer int
+	maxReassemblyTotal   int
+	reassemblyBudget     *reassemblyBudget
+
+	decodeLimits   gsmsg.DecodeLimits
+	maxMessageSize int
+
+	sendMessageTimeout time.Duration
+	newStreamTimeout   time.Duration
+
+	advertisedExtensions []graphsync.ExtensionName
+	extensionsLk         sync.RWMutex
+	extensionsByPeer     map[peer.ID][]graphsync.ExtensionName
+	advertisedTo         map[peer.ID]struct{}
+
+	dialHintsLk sync.RWMutex
+	dialHints   map[peer.ID][]ma.Multiaddr
+
+	relays []peer.AddrInfo
+
+	http *HTTPNetwork
+
+	wireCounters *wireCounters
+	wireObserver WireObserver
 }
 
 type streamMessageSender struct {
-	s network.Stream
+	gsnet *libp2pGraphSyncNetwork
+	s     network.Stream
 }
 
 func (s *streamMessageSender) Close() error {
@@ -50,16 +146,25 @@ func (s *streamMessageSender) Reset() error {
 }
 
 func (s *streamMessageSender) SendMsg(ctx context.Context, msg gsmsg.GraphSyncMessage) error {
-	return msgToStream(ctx, s.s, msg)
+	return s.gsnet.msgToStream(ctx, s.s, msg)
+}
+
+func (gsnet *libp2pGraphSyncNetwork) msgToStream(ctx context.Context, s network.Stream, msg gsmsg.GraphSyncMessage) error {
+	cs := &countingStream{Stream: s}
+	err := gsnet.writeMsg(ctx, cs, msg)
+	gsnet.recordSent(s.Conn().RemotePeer(), cs.written, err)
+	return err
 }
 
-func msgToStream(ctx context.Context, s network.Stream, msg gsmsg.GraphSyncMessage) error {
+func (gsnet *libp2pGraphSyncNetwork) writeMsg(ctx context.Context, s network.Stream, msg gsmsg.GraphSyncMessage) error {
 	log.Debugf("Outgoing message with %d requests, %d responses, and %d blocks",
 		len(msg.Requests()), len(msg.Responses()), len(msg.Blocks()))
 
-	deadline := time.Now().Add(sendMessageTimeout)
+	timeout := gsnet.sendMessageTimeout
+	deadline := time.Now().Add(timeout)
 	if dl, ok := ctx.Deadline(); ok {
 		deadline = dl
+		timeout = time.Until(dl)
 	}
 	if err := s.SetWriteDeadline(deadline); err != nil {
 		log.Warnf("error setting deadline: %s", err)
@@ -69,7 +174,12 @@ func msgToStream(ctx context.Context, s network.Stream, msg gsmsg.GraphSyncMessa
 	case ProtocolGraphsync:
 		if err := msg.ToNet(s); err != nil {
 			log.Debugf("error: %s", err)
-			return err
+			return sendError(s.Conn().RemotePeer(), timeout, err)
+		}
+	case ProtocolGraphsyncDagCBOR:
+		if err := gsnet.msgToStreamDagCBOR(s, msg); err != nil {
+			log.Debugf("error: %s", err)
+			return sendError(s.Conn().RemotePeer(), timeout, err)
 		}
 	default:
 		return fmt.Errorf("unrecognized protocol on remote: %s", s.Protocol())
@@ -81,17 +191,151 @@ func msgToStream(ctx context.Context, s network.Stream, msg gsmsg.GraphSyncMessa
 	return nil
 }
 
+func (gsnet *libp2pGraphSyncNetwork) msgToStreamDagCBOR(s network.Stream, msg gsmsg.GraphSyncMessage) error {
+	writer := msgio.NewVarintWriter(s)
+	msg, largeBlocks := splitLargeBlocks(msg, gsnet.fragmentSize)
+	for _, blk := range largeBlocks {
+		if err := writeFragments(writer, blk, gsnet.fragmentSize); err != nil {
+			return err
+		}
+	}
+	p := s.Conn().RemotePeer()
+	fe := frameExtensions{compression: gsnet.messageCompression}
+	advertise := gsnet.needsAdvertisement(p)
+	if advertise {
+		fe.supported = gsnet.advertisedExtensions
+	}
+	if fe.empty() {
+		return msg.ToNetDagCBOR(s)
+	}
+	algorithm, _ := gsnet.peerCompression(p)
+	data, err := encodeFrame(msg, fe, algorithm)
+	if err != nil {
+		return err
+	}
+	if err := writer.WriteMsg(data); err != nil {
+		return err
+	}
+	if advertise {
+		gsnet.markAdvertised(p)
+	}
+	return nil
+}
+
+func (gsnet *libp2pGraphSyncNetwork) msgFromReaderDagCBOR(p peer.ID, r msgio.Reader, ra *reassembler) (gsmsg.GraphSyncMessage, error) {
+	size := 0
+	tooLarge := false
+	for {
+		if gsnet.maxMessageSize > 0 && !tooLarge {
+			length, err := r.NextMsgLen()
+			if err != nil {
+				return nil, err
+			}
+			if size+length > gsnet.maxMessageSize {
+				// blocks reassembled so far are dropped, and later fragments
+				// are discarded a frame at a time, so the message never takes
+				// more memory than a single frame
+				tooLarge = true
+				ra.drop()
+			}
+		}
+		data, err := r.ReadMsg()
+		if err != nil {
+			return nil, err
+		}
+		size += len(data)
+		node, err := ipldutil.DecodeNode(data)
+		r.ReleaseMsg(data)
+		if err != nil {
+			return nil, err
+		}
+		if frag, err := node.LookupByString("frag"); err == nil {
+			if tooLarge {
+				continue
+			}
+			if err := ra.addFragment(frag); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		msg, fe, err := decodeFrame(node, gsnet.accepts, gsnet.maxDecompressedSize, gsnet.decodeLimits)
+		if err != nil {
+			return nil, err
+		}
+		if tooLarge {
+			return nil, &MessageTooLargeError{Peer: p, Size: size, Max: gsnet.maxMessageSize, Message: msg}
+		}
+		if err := ra.completeMessage(msg); err != nil {
+			return nil, err
+		}
+		if len(gsnet.messageCompression) > 0 && fe.compression != nil {
+			gsnet.setPeerCompression(p, fe.compression)
+		}
+		if fe.supported != nil {
+			gsnet.setSupportedExtensions(p, fe.supported)
+		}
+		return msg, nil
+	}
+}
+
 func (gsnet *libp2pGraphSyncNetwork) NewMessageSender(ctx context.Context, p peer.ID) (MessageSender, error) {
+	if gsnet.usesHTTP(p) {
+		return gsnet.http.NewMessageSender(ctx, p)
+	}
 	s, err := gsnet.newStreamToPeer(ctx, p)
 	if err != nil {
 		return nil, err
 	}
 
-	return &streamMessageSender{s: s}, nil
+	return &streamMessageSender{gsnet: gsnet, s: s}, nil
+}
+
+// sendError surfaces a failed write that hit its deadline as a TimeoutError
+func sendError(p peer.ID, timeout time.Duration, err error) error {
+	if isTimeout(err) {
+		return &TimeoutError{Op: "send message", Peer: p, Timeout: timeout, Err: err}
+	}
+	return err
 }
 
 func (gsnet *libp2pGraphSyncNetwork) newStreamToPeer(ctx context.Context, p peer.ID) (network.Stream, error) {
-	return gsnet.host.NewStream(ctx, p, ProtocolGraphsync)
+	if gsnet.newStreamTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, gsnet.newStreamTimeout)
+		defer cancel()
+	}
+	s, err := gsnet.host.NewStream(ctx, p, gsnet.protocols...)
+	if err != nil {
+		if gsnet.newStreamTimeout > 0 && ctx.Err() == context.DeadlineExceeded {
+			return nil, &TimeoutError{Op: "open stream", Peer: p, Timeout: gsnet.newStreamTimeout, Err: err}
+		}
+		return nil, err
+	}
+	gsnet.setProtocolVersion(p, s.Protocol())
+	return s, nil
+}
+
+func (gsnet *libp2pGraphSyncNetwork) ConnectionManager() ConnManager {
+	return gsnet.host.ConnManager()
+}
+
+func (gsnet *libp2pGraphSyncNetwork) ProtocolVersion(p peer.ID) (protocol.ID, bool) {
+	gsnet.protocolLk.RLock()
+	defer gsnet.protocolLk.RUnlock()
+	version, ok := gsnet.protocolByPeer[p]
+	return version, ok
+}
+
+func (gsnet *libp2pGraphSyncNetwork) setProtocolVersion(p peer.ID, version protocol.ID) {
+	gsnet.protocolLk.Lock()
+	defer gsnet.protocolLk.Unlock()
+	gsnet.protocolByPeer[p] = version
+}
+
+func (gsnet *libp2pGraphSyncNetwork) clearProtocolVersion(p peer.ID) {
+	gsnet.protocolLk.Lock()
+	defer gsnet.protocolLk.Unlock()
+	delete(gsnet.protocolByPeer, p)
 }
 
 func (gsnet *libp2pGraphSyncNetwork) SendMessage(
@@ -99,12 +343,15 @@ func (gsnet *libp2pGraphSyncNetwork) SendMessage(
 	p peer.ID,
 	outgoing gsmsg.GraphSyncMessage) error {
 
+	if gsnet.usesHTTP(p) {
+		return gsnet.http.SendMessage(ctx, p, outgoing)
+	}
 	s, err := gsnet.newStreamToPeer(ctx, p)
 	if err != nil {
 		return err
 	}
 
-	if err = msgToStream(ctx, s, outgoing); err != nil {
+	if err = gsnet.msgToStream(ctx, s, outgoing); err != nil {
 		_ = s.Reset()
 		return err
 	}
@@ -113,40 +360,101 @@ func (gsnet *libp2pGraphSyncNetwork) SendMessage(
 }
 
 func (gsnet *libp2pGraphSyncNetwork) SetDelegate(r Receiver) {
+	gsnet.receiverLk.Lock()
 	gsnet.receiver = r
-	gsnet.host.SetStreamHandler(ProtocolGraphsync, gsnet.handleNewStream)
+	gsnet.receiverLk.Unlock()
+	if gsnet.http != nil {
+		gsnet.http.SetDelegate(r)
+	}
+	for _, p := range gsnet.protocols {
+		gsnet.host.SetStreamHandler(p, gsnet.handleNewStream)
+	}
 	gsnet.host.Network().Notify((*libp2pGraphSyncNotifee)(gsnet))
 }
 
-func (gsnet *libp2pGraphSyncNetwork) ConnectTo(ctx context.Context, p peer.ID) error {
-	return gsnet.host.Connect(ctx, peer.AddrInfo{ID: p})
+func (gsnet *libp2pGraphSyncNetwork) Stop() {
+	for _, p := range gsnet.protocols {
+		gsnet.host.RemoveStreamHandler(p)
+	}
+	gsnet.host.Network().StopNotify((*libp2pGraphSyncNotifee)(gsnet))
+	if gsnet.http != nil {
+		gsnet.http.Stop()
+	}
+	gsnet.receiverLk.Lock()
+	gsnet.receiver = nil
+	gsnet.receiverLk.Unlock()
+}
+
+func (gsnet *libp2pGraphSyncNetwork) getReceiver() Receiver {
+	gsnet.receiverLk.RLock()
+	defer gsnet.receiverLk.RUnlock()
+	return gsnet.receiver
 }
 
 // handleNewStream receives a new stream from the network.
 func (gsnet *libp2pGraphSyncNetwork) handleNewStream(s network.Stream) {
 	defer s.Close()
 
-	if gsnet.receiver == nil {
+	if gsnet.getReceiver() == nil {
 		_ = s.Reset()
 		return
 	}
 
-	reader := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+	p := s.Conn().RemotePeer()
+	gsnet.setProtocolVersion(p, s.Protocol())
+	msgReader := newMsgReader(s, network.MessageSizeMax)
+	reader := &sizeCountingReader{Reader: msgReader}
+	fromMsgReader := func(r msgio.Reader) (gsmsg.GraphSyncMessage, error) {
+		if gsnet.maxMessageSize > 0 {
+			length, err := r.NextMsgLen()
+			if err != nil {
+				return nil, err
+			}
+			if length > gsnet.maxMessageSize {
+				reader.size += length
+				reader.wireSize += uvarintSize(length) + length
+				return nil, rejectOversized(p, msgReader, length, gsnet.maxMessageSize, gsnet.decodeLimits)
+			}
+		}
+		return gsmsg.FromMsgReaderWithLimits(r, gsnet.decodeLimits)
+	}
+	if s.Protocol() == ProtocolGraphsyncDagCBOR {
+		ra := newReassembler(p, gsnet.maxReassembledSize, gsnet.reassemblyBudget)
+		defer ra.release()
+		fromMsgReader = func(r msgio.Reader) (gsmsg.GraphSyncMessage, error) {
+			return gsnet.msgFromReaderDagCBOR(p, r, ra)
+		}
+	}
 	for {
-		received, err := gsmsg.FromMsgReader(reader)
+		reader.reset()
+		received, err := fromMsgReader(reader)
+		// the network may have stopped while waiting for the message
+		receiver := gsnet.getReceiver()
+		if receiver == nil {
+			_ = s.Reset()
+			return
+		}
+		var tooLarge *MessageTooLargeError
+		if err == nil || errors.As(err, &tooLarge) {
+			gsnet.recordReceived(p, reader.wireSize)
+		}
+		if tooLarge != nil {
+			log.Debugf("graphsync net handleNewStream from %s rejected message of size %d", p, tooLarge.Size)
+			go receiver.ReceiveError(tooLarge)
+			continue
+		}
 		if err != nil {
 			if err != io.EOF {
 				_ = s.Reset()
-				go gsnet.receiver.ReceiveError(err)
+				go receiver.ReceiveError(&MessageReceiveError{Peer: p, Err: err})
 				log.Debugf("graphsync net handleNewStream from %s error: %s", s.Conn().RemotePeer(), err)
 			}
 			return
 		}
 
-		p := s.Conn().RemotePeer()
 		ctx := context.Background()
 		log.Debugf("graphsync net handleNewStream from %s", s.Conn().RemotePeer())
-		gsnet.receiver.ReceiveMessage(ctx, p, received)
+		receiver.ReceiveMessage(ctx, p, received)
 	}
 }
 
@@ -157,11 +465,18 @@ func (nn *libp2pGraphSyncNotifee) libp2pGraphSyncNetwork() *libp2pGraphSyncNetwo
 }
 
 func (nn *libp2pGraphSyncNotifee) Connected(n network.Network, v network.Conn) {
-	nn.libp2pGraphSyncNetwork().receiver.Connected(v.RemotePeer())
+	if receiver := nn.libp2pGraphSyncNetwork().getReceiver(); receiver != nil {
+		receiver.Connected(v.RemotePeer())
+	}
 }
 
 func (nn *libp2pGraphSyncNotifee) Disconnected(n network.Network, v network.Conn) {
-	nn.libp2pGraphSyncNetwork().receiver.Disconnected(v.RemotePeer())
+	nn.libp2pGraphSyncNetwork().clearPeerCompression(v.RemotePeer())
+	nn.libp2pGraphSyncNetwork().clearProtocolVersion(v.RemotePeer())
+	nn.libp2pGraphSyncNetwork().clearPeerExtensions(v.RemotePeer())
+	if receiver := nn.libp2pGraphSyncNetwork().getReceiver(); receiver != nil {
+		receiver.Disconnected(v.RemotePeer())
+	}
 }
 
 func (nn *libp2pGraphSyncNotifee) OpenedStream(n network.Network, v network.Stream) {}
@@ -2,17 +2,21 @@ package network
 
 import (
 	"context"
+	"errors"
 	"math/rand"
 	"testing"
 	"time"
 
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
 	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
 	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
 	"github.com/stretchr/testify/require"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/compression"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/testutil"
 )
@@ -23,6 +27,7 @@ type receiver struct {
 	lastMessage     gsmsg.GraphSyncMessage
 	lastSender      peer.ID
 	connectedPeers  chan peer.ID
+	errors          chan error
 }
 
 func (r *receiver) ReceiveMessage(
@@ -38,6 +43,9 @@ func (r *receiver) ReceiveMessage(
 }
 
 func (r *receiver) ReceiveError(err error) {
+	if r.errors != nil {
+		r.errors <- err
+	}
 }
 
 func (r *receiver) Connected(p peer.ID) {
@@ -60,8 +68,8 @@ func TestMessageSendAndReceive(t *testing.T) {
 	require.NoError(t, err)
 	err = mn.LinkAll()
 	require.NoError(t, err)
-	gsnet1 := NewFromLibp2pHost(host1)
-	gsnet2 := NewFromLibp2pHost(host2)
+	gsnet1 := NewFromLibp2pHost(host1, EnableDagCBORProtocol())
+	gsnet2 := NewFromLibp2pHost(host2, EnableDagCBORProtocol())
 	r := &receiver{
 		messageReceived: make(chan struct{}),
 		connectedPeers:  make(chan peer.ID, 2),
@@ -94,6 +102,12 @@ func TestMessageSendAndReceive(t *testing.T) {
 	testutil.AssertDoesReceive(ctx, t, r.messageReceived, "message did not send")
 
 	require.Equal(t, host1.ID(), r.lastSender, "incorrect host sent message")
+	version, ok := gsnet1.ProtocolVersion(host2.ID())
+	require.True(t, ok)
+	require.Equal(t, ProtocolGraphsyncDagCBOR, version)
+	version, ok = gsnet2.ProtocolVersion(host1.ID())
+	require.True(t, ok)
+	require.Equal(t, ProtocolGraphsyncDagCBOR, version)
 
 	received := r.lastMessage
 
@@ -126,3 +140,357 @@ func TestMessageSendAndReceive(t *testing.T) {
 	}
 
 }
+
+func TestMessageSendFallsBackToV1(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	mn := mocknet.New(ctx)
+
+	host1, err := mn.GenPeer()
+	require.NoError(t, err)
+	host2, err := mn.GenPeer()
+	require.NoError(t, err)
+	err = mn.LinkAll()
+	require.NoError(t, err)
+	gsnet1 := NewFromLibp2pHost(host1, EnableDagCBORProtocol())
+	gsnet2 := NewFromLibp2pHost(host2, GraphsyncProtocols([]protocol.ID{ProtocolGraphsync}))
+	r := &receiver{
+		messageReceived: make(chan struct{}),
+		connectedPeers:  make(chan peer.ID, 2),
+	}
+	gsnet1.SetDelegate(r)
+	gsnet2.SetDelegate(r)
+
+	root := testutil.GenerateCids(1)[0]
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	selector := ssb.Matcher().Node()
+	id := graphsync.RequestID(rand.Int31())
+	sent := gsmsg.New()
+	sent.AddRequest(gsmsg.NewRequest(id, root, selector, graphsync.Priority(0)))
+
+	err = gsnet1.ConnectTo(ctx, host2.ID())
+	require.NoError(t, err, "did not connect peers")
+
+	// the dag-cbor peer sends to the v1 only peer using v1
+	err = gsnet1.SendMessage(ctx, host2.ID(), sent)
+	require.NoError(t, err)
+	testutil.AssertDoesReceive(ctx, t, r.messageReceived, "message did not send")
+	require.Equal(t, host1.ID(), r.lastSender)
+	require.Len(t, r.lastMessage.Requests(), 1)
+	require.Equal(t, id, r.lastMessage.Requests()[0].ID())
+	version, ok := gsnet1.ProtocolVersion(host2.ID())
+	require.True(t, ok)
+	require.Equal(t, ProtocolGraphsync, version)
+
+	// and the v1 only peer can send to the dag-cbor peer
+	err = gsnet2.SendMessage(ctx, host1.ID(), sent)
+	require.NoError(t, err)
+	testutil.AssertDoesReceive(ctx, t, r.messageReceived, "message did not send")
+	require.Equal(t, host2.ID(), r.lastSender)
+	require.Len(t, r.lastMessage.Requests(), 1)
+}
+
+func TestSupportedExtensionsAdvertised(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	mn := mocknet.New(ctx)
+
+	host1, err := mn.GenPeer()
+	require.NoError(t, err)
+	host2, err := mn.GenPeer()
+	require.NoError(t, err)
+	err = mn.LinkAll()
+	require.NoError(t, err)
+	extensionName := graphsync.ExtensionName("graphsync/awesome")
+	gsnet1 := NewFromLibp2pHost(host1, EnableDagCBORProtocol(), AdvertiseExtensions([]graphsync.ExtensionName{extensionName}))
+	gsnet2 := NewFromLibp2pHost(host2, EnableDagCBORProtocol())
+	r := &receiver{
+		messageReceived: make(chan struct{}),
+		connectedPeers:  make(chan peer.ID, 2),
+	}
+	gsnet1.SetDelegate(r)
+	gsnet2.SetDelegate(r)
+
+	root := testutil.GenerateCids(1)[0]
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	selector := ssb.Matcher().Node()
+	id := graphsync.RequestID(rand.Int31())
+	sent := gsmsg.New()
+	sent.AddRequest(gsmsg.NewRequest(id, root, selector, graphsync.Priority(0)))
+
+	err = gsnet1.ConnectTo(ctx, host2.ID())
+	require.NoError(t, err, "did not connect peers")
+
+	_, ok := gsnet2.SupportedExtensions(host1.ID())
+	require.False(t, ok, "should not know extensions before any message")
+
+	err = gsnet1.SendMessage(ctx, host2.ID(), sent)
+	require.NoError(t, err)
+	testutil.AssertDoesReceive(ctx, t, r.messageReceived, "message did not send")
+
+	supported, ok := gsnet2.SupportedExtensions(host1.ID())
+	require.True(t, ok)
+	require.Contains(t, supported, extensionName)
+	require.Contains(t, supported, graphsync.ExtensionMetadata)
+	_, ok = gsnet1.SupportedExtensions(host2.ID())
+	require.False(t, ok, "peer that has not sent should not have advertised")
+
+	// the advertisement is only sent on the first message, and stays known after
+	err = gsnet1.SendMessage(ctx, host2.ID(), sent)
+	require.NoError(t, err)
+	testutil.AssertDoesReceive(ctx, t, r.messageReceived, "message did not send")
+	require.Len(t, r.lastMessage.Requests(), 1)
+	supported, ok = gsnet2.SupportedExtensions(host1.ID())
+	require.True(t, ok)
+	require.Contains(t, supported, extensionName)
+}
+
+func TestMessageSendWithCompression(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	mn := mocknet.New(ctx)
+
+	host1, err := mn.GenPeer()
+	require.NoError(t, err)
+	host2, err := mn.GenPeer()
+	require.NoError(t, err)
+	err = mn.LinkAll()
+	require.NoError(t, err)
+	algorithms := []compression.Algorithm{compression.Gzip}
+	gsnet1 := NewFromLibp2pHost(host1, EnableDagCBORProtocol(), MessageCompression(algorithms))
+	gsnet2 := NewFromLibp2pHost(host2, EnableDagCBORProtocol(), MessageCompression(algorithms))
+	r := &receiver{
+		messageReceived: make(chan struct{}),
+		connectedPeers:  make(chan peer.ID, 2),
+	}
+	gsnet1.SetDelegate(r)
+	gsnet2.SetDelegate(r)
+
+	blks := testutil.GenerateBlocksOfSize(2, 1000)
+	sent := gsmsg.New()
+	sent.AddResponse(gsmsg.NewResponse(graphsync.RequestID(rand.Int31()), graphsync.PartialResponse))
+	for _, blk := range blks {
+		sent.AddBlock(blk)
+	}
+
+	err = gsnet1.ConnectTo(ctx, host2.ID())
+	require.NoError(t, err, "did not connect peers")
+
+	// first message advertises compression support
+	err = gsnet1.SendMessage(ctx, host2.ID(), sent)
+	require.NoError(t, err)
+	testutil.AssertDoesReceive(ctx, t, r.messageReceived, "message did not send")
+	algorithm, ok := gsnet2.(*libp2pGraphSyncNetwork).peerCompression(host1.ID())
+	require.True(t, ok)
+	require.Equal(t, compression.Gzip, algorithm)
+
+	// so the reply is compressed
+	err = gsnet2.SendMessage(ctx, host1.ID(), sent)
+	require.NoError(t, err)
+	testutil.AssertDoesReceive(ctx, t, r.messageReceived, "message did not send")
+	require.Equal(t, host2.ID(), r.lastSender)
+	require.ElementsMatch(t, blks, r.lastMessage.Blocks())
+}
+
+func TestMessageSendWithFragmentedBlocks(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	mn := mocknet.New(ctx)
+
+	host1, err := mn.GenPeer()
+	require.NoError(t, err)
+	host2, err := mn.GenPeer()
+	require.NoError(t, err)
+	err = mn.LinkAll()
+	require.NoError(t, err)
+	gsnet1 := NewFromLibp2pHost(host1, EnableDagCBORProtocol(), BlockFragmentSize(1000))
+	gsnet2 := NewFromLibp2pHost(host2, EnableDagCBORProtocol())
+	r := &receiver{
+		messageReceived: make(chan struct{}),
+		connectedPeers:  make(chan peer.ID, 2),
+	}
+	gsnet1.SetDelegate(r)
+	gsnet2.SetDelegate(r)
+
+	blks := append(testutil.GenerateBlocksOfSize(2, 2500), testutil.GenerateBlocksOfSize(1, 100)...)
+	sent := gsmsg.New()
+	sent.AddResponse(gsmsg.NewResponse(graphsync.RequestID(rand.Int31()), graphsync.PartialResponse))
+	for _, blk := range blks {
+		sent.AddBlock(blk)
+	}
+
+	err = gsnet1.ConnectTo(ctx, host2.ID())
+	require.NoError(t, err, "did not connect peers")
+
+	err = gsnet1.SendMessage(ctx, host2.ID(), sent)
+	require.NoError(t, err)
+	testutil.AssertDoesReceive(ctx, t, r.messageReceived, "message did not send")
+	require.Equal(t, host1.ID(), r.lastSender)
+	require.Len(t, r.lastMessage.Responses(), 1)
+	require.ElementsMatch(t, blks, r.lastMessage.Blocks())
+}
+
+func TestConnectWithDialHints(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	mn := mocknet.New(ctx)
+
+	host1, err := mn.GenPeer()
+	require.NoError(t, err)
+	host2, err := mn.GenPeer()
+	require.NoError(t, err)
+	err = mn.LinkAll()
+	require.NoError(t, err)
+	gsnet1 := NewFromLibp2pHost(host1)
+	r := &receiver{
+		messageReceived: make(chan struct{}),
+		connectedPeers:  make(chan peer.ID, 2),
+	}
+	gsnet1.SetDelegate(r)
+
+	gsnet1.AddDialHints(host2.ID(), host2.Addrs())
+	for _, addr := range host2.Addrs() {
+		require.Contains(t, host1.Peerstore().Addrs(host2.ID()), addr)
+	}
+
+	require.NoError(t, gsnet1.ConnectTo(ctx, host2.ID()))
+	require.Equal(t, network.Connected, host1.Network().Connectedness(host2.ID()))
+
+	// hints are only kept until the peer is reached
+	libp2pNet := gsnet1.(*libp2pGraphSyncNetwork)
+	libp2pNet.dialHintsLk.RLock()
+	defer libp2pNet.dialHintsLk.RUnlock()
+	require.Empty(t, libp2pNet.dialHints)
+}
+
+func TestMessageSizeCap(t *testing.T) {
+	testCases := map[string][]Option{
+		"v1":                  nil,
+		"dag-cbor":            {EnableDagCBORProtocol()},
+		"dag-cbor fragmented": {EnableDagCBORProtocol(), BlockFragmentSize(1000)},
+	}
+	for testCase, options := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ctx := context.Background()
+			ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			mn := mocknet.New(ctx)
+
+			host1, err := mn.GenPeer()
+			require.NoError(t, err)
+			host2, err := mn.GenPeer()
+			require.NoError(t, err)
+			err = mn.LinkAll()
+			require.NoError(t, err)
+			gsnet1 := NewFromLibp2pHost(host1, options...)
+			gsnet2 := NewFromLibp2pHost(host2, append([]Option{MaxMessageSize(2000)}, options...)...)
+			r := &receiver{
+				messageReceived: make(chan struct{}),
+				connectedPeers:  make(chan peer.ID, 2),
+				errors:          make(chan error, 1),
+			}
+			gsnet1.SetDelegate(r)
+			gsnet2.SetDelegate(r)
+
+			err = gsnet1.ConnectTo(ctx, host2.ID())
+			require.NoError(t, err, "did not connect peers")
+			sender, err := gsnet1.NewMessageSender(ctx, host2.ID())
+			require.NoError(t, err)
+
+			requestID := graphsync.RequestID(rand.Int31())
+			large := gsmsg.New()
+			large.AddResponse(gsmsg.NewResponse(requestID, graphsync.PartialResponse))
+			large.AddBlock(testutil.GenerateBlocksOfSize(1, 5000)[0])
+			require.NoError(t, sender.SendMsg(ctx, large))
+
+			var received error
+			testutil.AssertReceive(ctx, t, r.errors, &received, "oversized message was not rejected")
+			var tooLarge *MessageTooLargeError
+			require.True(t, errors.As(received, &tooLarge))
+			require.Equal(t, host1.ID(), tooLarge.Peer)
+			require.Equal(t, 2000, tooLarge.Max)
+			require.Greater(t, tooLarge.Size, 2000)
+			require.Equal(t, requestID, tooLarge.Message.Responses()[0].RequestID())
+
+			// the stream remains usable for messages within the limit
+			small := gsmsg.New()
+			small.AddResponse(gsmsg.NewResponse(requestID, graphsync.RequestCompletedFull))
+			require.NoError(t, sender.SendMsg(ctx, small))
+			testutil.AssertDoesReceive(ctx, t, r.messageReceived, "message did not send")
+			require.Len(t, r.lastMessage.Responses(), 1)
+			require.Equal(t, graphsync.RequestCompletedFull, r.lastMessage.Responses()[0].Status())
+		})
+	}
+}
+
+type wireEvent struct {
+	p     peer.ID
+	bytes int
+}
+
+type fakeWireObserver struct {
+	sent     chan wireEvent
+	received chan wireEvent
+}
+
+func (fwo *fakeWireObserver) MessageSent(p peer.ID, bytes int, err error) {
+	fwo.sent <- wireEvent{p, bytes}
+}
+
+func (fwo *fakeWireObserver) MessageReceived(p peer.ID, bytes int) {
+	fwo.received <- wireEvent{p, bytes}
+}
+
+func TestWireStats(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	mn := mocknet.New(ctx)
+
+	host1, err := mn.GenPeer()
+	require.NoError(t, err)
+	host2, err := mn.GenPeer()
+	require.NoError(t, err)
+	err = mn.LinkAll()
+	require.NoError(t, err)
+	observer := &fakeWireObserver{
+		sent:     make(chan wireEvent, 1),
+		received: make(chan wireEvent, 1),
+	}
+	gsnet1 := NewFromLibp2pHost(host1, ObserveWire(observer))
+	gsnet2 := NewFromLibp2pHost(host2, ObserveWire(observer))
+	r := &receiver{
+		messageReceived: make(chan struct{}),
+		connectedPeers:  make(chan peer.ID, 2),
+	}
+	gsnet1.SetDelegate(r)
+	gsnet2.SetDelegate(r)
+
+	sent := gsmsg.New()
+	sent.AddResponse(gsmsg.NewResponse(graphsync.RequestID(rand.Int31()), graphsync.PartialResponse))
+	for _, blk := range testutil.GenerateBlocksOfSize(2, 100) {
+		sent.AddBlock(blk)
+	}
+
+	err = gsnet1.ConnectTo(ctx, host2.ID())
+	require.NoError(t, err, "did not connect peers")
+	err = gsnet1.SendMessage(ctx, host2.ID(), sent)
+	require.NoError(t, err)
+	testutil.AssertDoesReceive(ctx, t, r.messageReceived, "message did not send")
+
+	var sentEvent, receivedEvent wireEvent
+	testutil.AssertReceive(ctx, t, observer.sent, &sentEvent, "send was not observed")
+	testutil.AssertReceive(ctx, t, observer.received, &receivedEvent, "receive was not observed")
+	require.Equal(t, host2.ID(), sentEvent.p)
+	require.Equal(t, host1.ID(), receivedEvent.p)
+	require.Greater(t, sentEvent.bytes, 200)
+	require.Equal(t, sentEvent.bytes, receivedEvent.bytes)
+
+	require.Equal(t, WireStats{MessagesSent: 1, BytesSent: uint64(sentEvent.bytes)}, gsnet1.WireStats(host2.ID()))
+	require.Equal(t, WireStats{MessagesReceived: 1, BytesReceived: uint64(receivedEvent.bytes)}, gsnet2.WireStats(host1.ID()))
+}
@@ -0,0 +1,223 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-msgio"
+
+	gsmsg "github.com/ipfs/go-graphsync/message"
+)
+
+// MaxMessageSize sets the largest message accepted from peers, in bytes
+// including any block fragments it was sent in. Sizes are checked from each
+// frame's length prefix before it is read, so a larger message is never held
+// in memory: its blocks are discarded as they arrive, so the stream stays
+// usable, and the rest is passed to the receiver as a MessageTooLargeError
+// instead of being processed
+func MaxMessageSize(maxSize int) Option {
+	return func(gsnet *libp2pGraphSyncNetwork) {
+		gsnet.maxMessageSize = maxSize
+	}
+}
+
+// MessageTooLargeError is received in place of a message from a peer that
+// exceeds the maximum accepted message size. Message holds the requests and
+// responses in the rejected message, without its blocks, so they can be
+// failed. It is empty if they alone exceed the maximum size
+type MessageTooLargeError struct {
+	Peer    peer.ID
+	Size    int
+	Max     int
+	Message gsmsg.GraphSyncMessage
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("message from %s exceeds maximum size: %d > %d", e.Peer, e.Size, e.Max)
+}
+
+// blocksField is the field number of blocks in a v1 protobuf message
+const blocksField = 4
+
+// msgReader reads varint length prefixed messages like msgio's varint reader,
+// but can also pass over a message without reading it all into memory
+type msgReader struct {
+	r       *bufio.Reader
+	next    int
+	maxSize int
+}
+
+func newMsgReader(r io.Reader, maxSize int) *msgReader {
+	return &msgReader{r: bufio.NewReader(r), next: -1, maxSize: maxSize}
+}
+
+func (mr *msgReader) NextMsgLen() (int, error) {
+	if mr.next == -1 {
+		length, err := binary.ReadUvarint(mr.r)
+		if err != nil {
+			return 0, err
+		}
+		if length > uint64(mr.maxSize) {
+			return 0, msgio.ErrMsgTooLarge
+		}
+		mr.next = int(length)
+	}
+	return mr.next, nil
+}
+
+func (mr *msgReader) Read(msg []byte) (int, error) {
+	length, err := mr.NextMsgLen()
+	if err != nil {
+		return 0, err
+	}
+	if len(msg) < length {
+		return 0, io.ErrShortBuffer
+	}
+	mr.next = -1
+	return io.ReadFull(mr.r, msg[:length])
+}
+
+func (mr *msgReader) ReadMsg() ([]byte, error) {
+	length, err := mr.NextMsgLen()
+	if err != nil {
+		return nil, err
+	}
+	mr.next = -1
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(mr.r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (mr *msgReader) ReleaseMsg(msg []byte) {}
+
+// skimMsg reads the next message, a v1 protobuf message, discarding its blocks
+// as they are read. It returns the rest of the message, or nil if that is
+// larger than maxKept bytes
+func (mr *msgReader) skimMsg(maxKept int) ([]byte, error) {
+	length, err := mr.NextMsgLen()
+	if err != nil {
+		return nil, err
+	}
+	mr.next = -1
+	r := &limitedByteReader{r: mr.r, n: int64(length)}
+	var kept []byte
+	overflow := false
+	keep := func(data []byte) {
+		if overflow || len(kept)+len(data) > maxKept {
+			overflow = true
+			return
+		}
+		kept = append(kept, data...)
+	}
+	for r.n > 0 {
+		tag, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		field := appendUvarint(nil, tag)
+		switch tag & 7 {
+		case 0:
+			value, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, err
+			}
+			keep(appendUvarint(field, value))
+		case 1, 5:
+			size := 8
+			if tag&7 == 5 {
+				size = 4
+			}
+			value := make([]byte, size)
+			if _, err := io.ReadFull(r, value); err != nil {
+				return nil, err
+			}
+			keep(append(field, value...))
+		case 2:
+			fieldLength, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, err
+			}
+			if fieldLength > uint64(r.n) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			if tag>>3 == blocksField || overflow || len(kept)+int(fieldLength) > maxKept {
+				overflow = overflow || tag>>3 != blocksField
+				if _, err := io.CopyN(ioutil.Discard, r, int64(fieldLength)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			value := make([]byte, fieldLength)
+			if _, err := io.ReadFull(r, value); err != nil {
+				return nil, err
+			}
+			keep(append(appendUvarint(field, fieldLength), value...))
+		default:
+			return nil, errors.New("invalid protobuf wire type")
+		}
+	}
+	if overflow {
+		return nil, nil
+	}
+	return kept, nil
+}
+
+// rejectOversized reads a v1 message that exceeds the maximum size without
+// holding its blocks in memory, returning it as a MessageTooLargeError
+func rejectOversized(p peer.ID, mr *msgReader, length int, maxSize int, limits gsmsg.DecodeLimits) error {
+	kept, err := mr.skimMsg(maxSize)
+	if err != nil {
+		return err
+	}
+	tooLarge := &MessageTooLargeError{Peer: p, Size: length, Max: maxSize, Message: gsmsg.New()}
+	if kept != nil {
+		msg, err := gsmsg.FromMsgReaderWithLimits(newMsgReader(bytes.NewReader(append(appendUvarint(nil, uint64(len(kept))), kept...)), len(kept)), limits)
+		if err != nil {
+			return err
+		}
+		tooLarge.Message = msg
+	}
+	return tooLarge
+}
+
+// limitedByteReader reads at most n bytes
+type limitedByteReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (lr *limitedByteReader) Read(p []byte) (int, error) {
+	if lr.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > lr.n {
+		p = p[:lr.n]
+	}
+	n, err := lr.r.Read(p)
+	lr.n -= int64(n)
+	return n, err
+}
+
+func (lr *limitedByteReader) ReadByte() (byte, error) {
+	if lr.n <= 0 {
+		return 0, io.EOF
+	}
+	b, err := lr.r.ReadByte()
+	if err == nil {
+		lr.n--
+	}
+	return b, err
+}
+
+func appendUvarint(buf []byte, value uint64) []byte {
+	scratch := make([]byte, binary.MaxVarintLen64)
+	return append(buf, scratch[:binary.PutUvarint(scratch, value)]...)
+}
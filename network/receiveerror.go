@@ -0,0 +1,24 @@
+package network
+
+import (
+	"fmt"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// MessageReceiveError is received in place of a message from a peer that
+// could not be read or decoded, such as a malformed message or one that
+// violates the protocol
+type MessageReceiveError struct {
+	Peer peer.ID
+	Err  error
+}
+
+func (e *MessageReceiveError) Error() string {
+	return fmt.Sprintf("receiving message from %s: %s", e.Peer, e.Err)
+}
+
+// Unwrap returns the underlying read or decode error
+func (e *MessageReceiveError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,64 @@
+package network
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// RelayFallback dials peers through the given relays when they cannot be
+// reached directly. The host must have circuit relay enabled for relayed
+// connections to succeed
+func RelayFallback(relays []peer.AddrInfo) Option {
+	return func(gsnet *libp2pGraphSyncNetwork) {
+		gsnet.relays = relays
+	}
+}
+
+// connectViaRelays attempts a relayed connection to the given peer through each
+// configured relay in turn, returning the last error if none succeed
+func (gsnet *libp2pGraphSyncNetwork) connectViaRelays(ctx context.Context, p peer.ID) error {
+	var lastErr error
+	for _, relay := range gsnet.relays {
+		if relay.ID == p {
+			continue
+		}
+		if err := gsnet.host.Connect(ctx, relay); err != nil {
+			lastErr = err
+			continue
+		}
+		circuit, err := ma.NewMultiaddr(fmt.Sprintf("/p2p/%s/p2p-circuit", relay.ID.Pretty()))
+		if err != nil {
+			return err
+		}
+		err = gsnet.host.Connect(ctx, peer.AddrInfo{ID: p, Addrs: []ma.Multiaddr{circuit}})
+		if err == nil {
+			log.Infof("connected to %s through relay %s", p, relay.ID)
+			return nil
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+// IsRelayed returns true if every open connection to the given peer goes
+// through a relay, so transfers with it consume relay bandwidth
+func (gsnet *libp2pGraphSyncNetwork) IsRelayed(p peer.ID) bool {
+	conns := gsnet.host.Network().ConnsToPeer(p)
+	if len(conns) == 0 {
+		return false
+	}
+	for _, conn := range conns {
+		if !isRelayAddr(conn.RemoteMultiaddr()) {
+			return false
+		}
+	}
+	return true
+}
+
+func isRelayAddr(addr ma.Multiaddr) bool {
+	_, err := addr.ValueForProtocol(ma.P_CIRCUIT)
+	return err == nil
+}
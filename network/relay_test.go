@@ -0,0 +1,87 @@
+package network
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestIsRelayAddr(t *testing.T) {
+	relay := testutil.GeneratePeers(1)[0]
+	direct := ma.StringCast("/ip4/127.0.0.1/tcp/4001")
+	require.False(t, isRelayAddr(direct))
+	relayed := ma.StringCast("/ip4/127.0.0.1/tcp/4001/p2p/" + relay.Pretty() + "/p2p-circuit")
+	require.True(t, isRelayAddr(relayed))
+}
+
+// relayOnlyHost cannot dial the target peer directly. Mock networks have no
+// relay transport, so a dial over a circuit address links the peers instead,
+// and the target listens on a circuit address so its connections look relayed
+type relayOnlyHost struct {
+	host.Host
+	mn     mocknet.Mocknet
+	target peer.ID
+}
+
+func (h *relayOnlyHost) Connect(ctx context.Context, pi peer.AddrInfo) error {
+	if pi.ID == h.target {
+		if len(pi.Addrs) == 0 || !isRelayAddr(pi.Addrs[0]) {
+			return errors.New("no direct route to peer")
+		}
+		if _, err := h.mn.LinkPeers(h.ID(), h.target); err != nil {
+			return err
+		}
+	}
+	return h.Host.Connect(ctx, pi)
+}
+
+func TestConnectViaRelays(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	requestor, err := mn.GenPeer()
+	require.NoError(t, err)
+	unreachableRelay, err := mn.GenPeer()
+	require.NoError(t, err)
+	relay, err := mn.GenPeer()
+	require.NoError(t, err)
+	sk, _, err := ic.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	targetID, err := peer.IDFromPrivateKey(sk)
+	require.NoError(t, err)
+	circuit := ma.StringCast("/p2p/" + relay.ID().Pretty() + "/p2p-circuit")
+	_, err = mn.AddPeer(sk, circuit)
+	require.NoError(t, err)
+	_, err = mn.LinkPeers(requestor.ID(), relay.ID())
+	require.NoError(t, err)
+
+	h := &relayOnlyHost{Host: requestor, mn: mn, target: targetID}
+
+	// without relays the peer cannot be reached
+	gsnet := NewFromLibp2pHost(h)
+	require.Error(t, gsnet.ConnectTo(ctx, targetID))
+	require.False(t, gsnet.IsRelayed(targetID))
+
+	relays := []peer.AddrInfo{
+		{ID: unreachableRelay.ID(), Addrs: unreachableRelay.Addrs()},
+		{ID: relay.ID(), Addrs: relay.Addrs()},
+	}
+	gsnet = NewFromLibp2pHost(h, RelayFallback(relays))
+	require.NoError(t, gsnet.ConnectTo(ctx, targetID))
+	require.True(t, gsnet.IsRelayed(targetID))
+	require.False(t, gsnet.IsRelayed(relay.ID()), "the relay itself is connected directly")
+	require.False(t, gsnet.IsRelayed(unreachableRelay.ID()), "peers with no connection are not relayed")
+}
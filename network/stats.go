@@ -0,0 +1,140 @@
+package network
+
+import (
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-msgio"
+)
+
+// WireStats counts messages and bytes exchanged with a peer as written to and
+// read from the wire, including framing, fragments and retransmissions, so it
+// can be compared with higher level block accounting
+type WireStats struct {
+	MessagesSent     uint64
+	BytesSent        uint64
+	SendErrors       uint64
+	MessagesReceived uint64
+	BytesReceived    uint64
+}
+
+// WireObserver is called for every message sent to or received from a peer
+type WireObserver interface {
+	// MessageSent is called after a message is written to a peer, with the
+	// number of bytes written, or with the error if writing failed
+	MessageSent(p peer.ID, bytes int, err error)
+	// MessageReceived is called after a message is read from a peer, with the
+	// number of bytes read
+	MessageReceived(p peer.ID, bytes int)
+}
+
+// ObserveWire sets an observer called for every message sent or received
+func ObserveWire(observer WireObserver) Option {
+	return func(gsnet *libp2pGraphSyncNetwork) {
+		gsnet.wireObserver = observer
+	}
+}
+
+// wireCounters keeps WireStats for each peer
+type wireCounters struct {
+	lk    sync.Mutex
+	stats map[peer.ID]WireStats
+}
+
+func newWireCounters() *wireCounters {
+	return &wireCounters{stats: make(map[peer.ID]WireStats)}
+}
+
+func (wc *wireCounters) sent(p peer.ID, bytes int, err error) {
+	wc.lk.Lock()
+	defer wc.lk.Unlock()
+	stats := wc.stats[p]
+	stats.BytesSent += uint64(bytes)
+	if err != nil {
+		stats.SendErrors++
+	} else {
+		stats.MessagesSent++
+	}
+	wc.stats[p] = stats
+}
+
+func (wc *wireCounters) received(p peer.ID, bytes int) {
+	wc.lk.Lock()
+	defer wc.lk.Unlock()
+	stats := wc.stats[p]
+	stats.MessagesReceived++
+	stats.BytesReceived += uint64(bytes)
+	wc.stats[p] = stats
+}
+
+func (wc *wireCounters) get(p peer.ID) WireStats {
+	wc.lk.Lock()
+	defer wc.lk.Unlock()
+	return wc.stats[p]
+}
+
+// WireStats returns the messages and bytes exchanged with the given peer
+func (gsnet *libp2pGraphSyncNetwork) WireStats(p peer.ID) WireStats {
+	if gsnet.usesHTTP(p) {
+		return gsnet.http.WireStats(p)
+	}
+	return gsnet.wireCounters.get(p)
+}
+
+func (gsnet *libp2pGraphSyncNetwork) recordSent(p peer.ID, bytes int, err error) {
+	gsnet.wireCounters.sent(p, bytes, err)
+	if gsnet.wireObserver != nil {
+		gsnet.wireObserver.MessageSent(p, bytes, err)
+	}
+}
+
+func (gsnet *libp2pGraphSyncNetwork) recordReceived(p peer.ID, bytes int) {
+	gsnet.wireCounters.received(p, bytes)
+	if gsnet.wireObserver != nil {
+		gsnet.wireObserver.MessageReceived(p, bytes)
+	}
+}
+
+// countingStream counts the bytes written to a stream
+type countingStream struct {
+	network.Stream
+	written int
+}
+
+func (cs *countingStream) Write(p []byte) (int, error) {
+	n, err := cs.Stream.Write(p)
+	cs.written += n
+	return n, err
+}
+
+// sizeCountingReader counts the bytes of messages read since it was last
+// reset, both without and with their length prefixes
+type sizeCountingReader struct {
+	msgio.Reader
+	size     int
+	wireSize int
+}
+
+func (r *sizeCountingReader) ReadMsg() ([]byte, error) {
+	msg, err := r.Reader.ReadMsg()
+	r.size += len(msg)
+	if err == nil {
+		r.wireSize += uvarintSize(len(msg)) + len(msg)
+	}
+	return msg, err
+}
+
+func (r *sizeCountingReader) reset() {
+	r.size = 0
+	r.wireSize = 0
+}
+
+func uvarintSize(n int) int {
+	size := 1
+	for n >= 0x80 {
+		n >>= 7
+		size++
+	}
+	return size
+}
@@ -0,0 +1,73 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const defaultSendMessageTimeout = time.Minute * 10
+
+// SendMessageTimeout sets how long writing a single message to a peer may take
+// before the send fails with a TimeoutError (default 10 minutes). A deadline
+// on the context passed to the sender takes precedence
+func SendMessageTimeout(timeout time.Duration) Option {
+	return func(gsnet *libp2pGraphSyncNetwork) {
+		gsnet.sendMessageTimeout = timeout
+	}
+}
+
+// NewStreamTimeout sets how long opening a stream to a peer may take before it
+// fails with a TimeoutError. By default only the caller's context bounds it.
+// Message queues also bound connecting to the peer with it, falling back to
+// the send timeout when it is not set
+func NewStreamTimeout(timeout time.Duration) Option {
+	return func(gsnet *libp2pGraphSyncNetwork) {
+		gsnet.newStreamTimeout = timeout
+	}
+}
+
+// DialTimeout returns how long a message queue may spend connecting to a peer
+// and opening streams to it, across all its attempts to send one message: the
+// stream open timeout if one is set, or else the send timeout
+func (gsnet *libp2pGraphSyncNetwork) DialTimeout() time.Duration {
+	if gsnet.newStreamTimeout > 0 {
+		return gsnet.newStreamTimeout
+	}
+	return gsnet.sendMessageTimeout
+}
+
+// TimeoutError is returned when sending a message to a peer or opening a
+// stream to it does not complete within the configured timeout
+type TimeoutError struct {
+	// Op is the operation that timed out, "send message" or "open stream"
+	Op      string
+	Peer    peer.ID
+	Timeout time.Duration
+	// Err is the error the operation failed with when it timed out
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s to %s timed out after %s: %s", e.Op, e.Peer, e.Timeout, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout always returns true, matching the net.Error convention
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var timeoutErr interface{ Timeout() bool }
+	return errors.As(err, &timeoutErr) && timeoutErr.Timeout()
+}
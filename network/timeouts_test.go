@@ -0,0 +1,39 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+type deadlineError struct{}
+
+func (deadlineError) Error() string   { return "i/o deadline reached" }
+func (deadlineError) Timeout() bool   { return true }
+func (deadlineError) Temporary() bool { return true }
+
+func TestSendErrorTimeouts(t *testing.T) {
+	p := testutil.GeneratePeers(1)[0]
+
+	err := sendError(p, time.Second, deadlineError{})
+	var timeoutErr *TimeoutError
+	require.True(t, errors.As(err, &timeoutErr))
+	require.Equal(t, "send message", timeoutErr.Op)
+	require.Equal(t, p, timeoutErr.Peer)
+	require.Equal(t, time.Second, timeoutErr.Timeout)
+	require.Equal(t, deadlineError{}, errors.Unwrap(err))
+
+	// timeouts stay detectable once wrapped by the message queue
+	wrapped := fmt.Errorf("expended retries on SendMsg(%s): %w", p, sendError(p, time.Second, context.DeadlineExceeded))
+	require.True(t, errors.As(wrapped, &timeoutErr))
+	require.True(t, errors.Is(wrapped, context.DeadlineExceeded))
+
+	other := errors.New("stream reset")
+	require.Equal(t, other, sendError(p, time.Second, other))
+}
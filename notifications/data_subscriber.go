@@ -39,8 +39,12 @@ func (m *TopicDataSubscriber) getData(id Topic) []TopicData {
 }
 
 func (m *TopicDataSubscriber) OnNext(topic Topic, ev Event) {
-	for _, data := range m.getData(topic) {
-		m.Subscriber.OnNext(data, ev)
+	data := m.getData(topic)
+	for _, d := range data {
+		m.Subscriber.OnNext(d, ev)
+	}
+	if batchSubscriber, ok := m.Subscriber.(BatchSubscriber); ok && len(data) > 0 {
+		batchSubscriber.OnBatchEnd(ev)
 	}
 }
 
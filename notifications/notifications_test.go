@@ -5,6 +5,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/require"
+
 	"github.com/ipfs/go-graphsync/notifications"
 	"github.com/ipfs/go-graphsync/testutil"
 )
@@ -21,6 +23,21 @@ func TestSubscribeWithData(t *testing.T) {
 			verifier.ExpectEvents(ctx, t, []notifications.Event{"hi"})
 			verifier.ExpectClose(ctx, t)
 		},
+		"SubscribeWithData batch end": func(ctx context.Context, t *testing.T, ps notifications.Publisher) {
+			sub := &batchSubscriber{testutil.NewTestSubscriber(2), make(chan notifications.Event, 2)}
+			dataSubscriber := notifications.NewTopicDataSubscriber(sub)
+			notifications.SubscribeWithData(ps, "t1", notifications.Notifee{Data: "d1", Subscriber: dataSubscriber})
+			notifications.SubscribeWithData(ps, "t1", notifications.Notifee{Data: "d2", Subscriber: dataSubscriber})
+			ps.Publish("t1", "hi")
+			ps.Shutdown()
+			sub.ExpectEvents(ctx, t, []testutil.DispatchedEvent{
+				{Topic: "d1", Event: "hi"}, {Topic: "d2", Event: "hi"},
+			})
+			var batchEnd notifications.Event
+			testutil.AssertReceive(ctx, t, sub.batchEnds, &batchEnd, "should end batch")
+			require.Equal(t, "hi", batchEnd)
+			testutil.AssertChannelEmpty(t, sub.batchEnds, "should end batch once")
+		},
 		"Add subscriptions": func(ctx context.Context, t *testing.T, ps notifications.Publisher) {
 			sub1 := testutil.NewTestSubscriber(3)
 			sub2 := testutil.NewTestSubscriber(3)
@@ -150,3 +167,12 @@ func TestSubscribeWithData(t *testing.T) {
 	}
 
 }
+
+type batchSubscriber struct {
+	*testutil.TestSubscriber
+	batchEnds chan notifications.Event
+}
+
+func (bs *batchSubscriber) OnBatchEnd(ev notifications.Event) {
+	bs.batchEnds <- ev
+}
@@ -15,6 +15,13 @@ type Subscriber interface {
 	OnClose(Topic)
 }
 
+// BatchSubscriber is a subscriber that is also told when an event has been
+// passed to OnNext for all of the data attached to a topic
+type BatchSubscriber interface {
+	Subscriber
+	OnBatchEnd(Event)
+}
+
 // Subscribable is a stream that can be subscribed to
 type Subscribable interface {
 	Subscribe(topic Topic, sub Subscriber) bool
@@ -0,0 +1,330 @@
+/*
+Package peerprofile learns what each peer supports and how well transfers with
+it perform, and persists that to a datastore so it is known immediately after
+a restart rather than relearned from scratch.
+*/
+package peerprofile
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+)
+
+// knownExtensions are the extensions a peer is recorded as supporting once it
+// sends them
+var knownExtensions = []graphsync.ExtensionName{
+	graphsync.ExtensionMetadata,
+	graphsync.ExtensionDoNotSendCIDs,
+	graphsync.ExtensionDeDupByKey,
+	graphsync.ExtensionStatusCategory,
+	graphsync.ExtensionBlockCompression,
+	graphsync.ExtensionMetadataOnly,
+	graphsync.ExtensionDedupWithinRequest,
+}
+
+// Profile is what has been learned about a peer
+type Profile struct {
+	// Protocol is the graphsync protocol last negotiated with the peer
+	Protocol protocol.ID `json:"protocol,omitempty"`
+	// Extensions are the extensions the peer has sent or advertised
+	Extensions []graphsync.ExtensionName `json:"extensions"`
+	// BytesReceived is the total size of blocks received from the peer over the wire
+	BytesReceived uint64 `json:"bytesReceived"`
+	// TransferTime is the total time spent on requests to the peer that finished
+	TransferTime time.Duration `json:"transferTime"`
+	// Succeeded is the number of transfers with the peer that finished successfully
+	Succeeded uint64 `json:"succeeded"`
+	// Failed is the number of transfers with the peer that failed or hit network errors
+	Failed uint64 `json:"failed"`
+	// LastSeen is when the peer was last heard from or sent to
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// SupportsExtension returns whether the peer has sent the given extension
+func (p Profile) SupportsExtension(name graphsync.ExtensionName) bool {
+	for _, extension := range p.Extensions {
+		if extension == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Throughput is the historical rate in bytes per second blocks were received
+// from the peer, or zero if nothing has been received yet
+func (p Profile) Throughput() float64 {
+	if p.TransferTime <= 0 {
+		return 0
+	}
+	return float64(p.BytesReceived) / p.TransferTime.Seconds()
+}
+
+// Reliability is the fraction of transfers with the peer that succeeded. A
+// peer with no finished transfers is given the benefit of the doubt with a
+// score of 1
+func (p Profile) Reliability() float64 {
+	total := p.Succeeded + p.Failed
+	if total == 0 {
+		return 1
+	}
+	return float64(p.Succeeded) / float64(total)
+}
+
+func (p *Profile) addExtensions(extension func(graphsync.ExtensionName) ([]byte, bool)) {
+	for _, name := range knownExtensions {
+		if _, ok := extension(name); ok && !p.SupportsExtension(name) {
+			p.Extensions = append(p.Extensions, name)
+		}
+	}
+}
+
+func (p *Profile) addAdvertisedExtensions(names []graphsync.ExtensionName) {
+	for _, name := range names {
+		if !p.SupportsExtension(name) {
+			p.Extensions = append(p.Extensions, name)
+		}
+	}
+}
+
+// negotiator looks up what was negotiated with a peer on its connection
+type negotiator interface {
+	ProtocolVersion(p peer.ID) (protocol.ID, bool)
+	SupportedExtensions(p peer.ID) ([]graphsync.ExtensionName, bool)
+}
+
+type requestKey struct {
+	p         peer.ID
+	requestID graphsync.RequestID
+}
+
+// Profiles holds the profiles of all peers, backed by a datastore
+type Profiles struct {
+	ds     datastore.Datastore
+	prefix datastore.Key
+
+	lk            sync.Mutex
+	negotiator    negotiator
+	profiles      map[peer.ID]*Profile
+	dirty         map[peer.ID]struct{}
+	requestStarts map[requestKey]time.Time
+}
+
+// New returns peer profiles persisted in the given datastore under the given prefix
+func New(ds datastore.Datastore, prefix datastore.Key) *Profiles {
+	return &Profiles{
+		ds:            ds,
+		prefix:        prefix,
+		profiles:      make(map[peer.ID]*Profile),
+		dirty:         make(map[peer.ID]struct{}),
+		requestStarts: make(map[requestKey]time.Time),
+	}
+}
+
+// Load reads all profiles previously saved to the datastore
+func (ps *Profiles) Load() error {
+	results, err := ps.ds.Query(query.Query{Prefix: ps.prefix.String()})
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+	for result := range results.Next() {
+		if result.Error != nil {
+			return result.Error
+		}
+		p, err := peer.Decode(datastore.RawKey(result.Key).BaseNamespace())
+		if err != nil {
+			return err
+		}
+		var profile Profile
+		err = json.Unmarshal(result.Value, &profile)
+		if err != nil {
+			return err
+		}
+		ps.profiles[p] = &profile
+	}
+	return nil
+}
+
+// Save writes all profiles that have changed since the last save to the datastore
+func (ps *Profiles) Save() error {
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+	for p := range ps.dirty {
+		data, err := json.Marshal(ps.profiles[p])
+		if err != nil {
+			return err
+		}
+		err = ps.ds.Put(ps.prefix.ChildString(peer.Encode(p)), data)
+		if err != nil {
+			return err
+		}
+		delete(ps.dirty, p)
+	}
+	return nil
+}
+
+// Get returns the profile for the given peer, if anything is known about it
+func (ps *Profiles) Get(p peer.ID) (Profile, bool) {
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+	profile, ok := ps.profiles[p]
+	if !ok {
+		return Profile{}, false
+	}
+	cloned := *profile
+	cloned.Extensions = append([]graphsync.ExtensionName(nil), profile.Extensions...)
+	return cloned, true
+}
+
+// Register begins learning peer profiles from the given exchange, returning
+// a function that stops learning
+func (ps *Profiles) Register(exchange graphsync.GraphExchange) graphsync.UnregisterHookFunc {
+	ps.lk.Lock()
+	ps.negotiator = exchange
+	ps.lk.Unlock()
+	unregisters := []graphsync.UnregisterHookFunc{
+		exchange.RegisterOutgoingRequestHook(ps.onOutgoingRequest),
+		exchange.RegisterIncomingResponseHook(ps.onIncomingResponse),
+		exchange.RegisterIncomingBlockHook(ps.onIncomingBlock),
+		exchange.RegisterIncomingRequestHook(ps.onIncomingRequest),
+		exchange.RegisterCompletedResponseListener(ps.onResponseCompleted),
+		exchange.RegisterCompletedRequestListener(ps.onRequestCompleted),
+		exchange.RegisterNetworkErrorListener(ps.onNetworkError),
+	}
+	return func() {
+		for _, unregister := range unregisters {
+			unregister()
+		}
+		ps.lk.Lock()
+		ps.negotiator = nil
+		ps.lk.Unlock()
+	}
+}
+
+// negotiated is what the exchange knows about a peer from its connection
+type negotiated struct {
+	protocol   protocol.ID
+	extensions []graphsync.ExtensionName
+}
+
+// negotiated asks the exchange for the protocol negotiated with the peer and
+// the extensions it advertised. It must be called without the lock held, as
+// the exchange may look up profiles itself
+func (ps *Profiles) negotiated(p peer.ID) negotiated {
+	ps.lk.Lock()
+	negotiator := ps.negotiator
+	ps.lk.Unlock()
+	var n negotiated
+	if negotiator == nil {
+		return n
+	}
+	n.protocol, _ = negotiator.ProtocolVersion(p)
+	n.extensions, _ = negotiator.SupportedExtensions(p)
+	return n
+}
+
+// profile returns the profile for the peer, marking it seen and dirty. It must
+// be called with the lock held
+func (ps *Profiles) profile(p peer.ID) *Profile {
+	profile, ok := ps.profiles[p]
+	if !ok {
+		profile = &Profile{}
+		ps.profiles[p] = profile
+	}
+	profile.LastSeen = time.Now()
+	ps.dirty[p] = struct{}{}
+	return profile
+}
+
+// negotiatedProfile returns the profile for the peer like profile, updated
+// with what was negotiated with it. It must be called with the lock held
+func (ps *Profiles) negotiatedProfile(p peer.ID, n negotiated) *Profile {
+	profile := ps.profile(p)
+	if n.protocol != "" {
+		profile.Protocol = n.protocol
+	}
+	profile.addAdvertisedExtensions(n.extensions)
+	return profile
+}
+
+func (ps *Profiles) onOutgoingRequest(p peer.ID, request graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+	n := ps.negotiated(p)
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+	ps.negotiatedProfile(p, n)
+	ps.requestStarts[requestKey{p, request.ID()}] = time.Now()
+}
+
+func (ps *Profiles) onIncomingResponse(p peer.ID, response graphsync.ResponseData, hookActions graphsync.IncomingResponseHookActions) {
+	n := ps.negotiated(p)
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+	profile := ps.negotiatedProfile(p, n)
+	profile.addExtensions(response.Extension)
+	if !gsmsg.IsTerminalResponseCode(response.Status()) {
+		return
+	}
+	key := requestKey{p, response.RequestID()}
+	if start, ok := ps.requestStarts[key]; ok {
+		delete(ps.requestStarts, key)
+		profile.TransferTime += time.Since(start)
+	}
+	if gsmsg.IsTerminalSuccessCode(response.Status()) {
+		profile.Succeeded++
+	} else {
+		profile.Failed++
+	}
+}
+
+func (ps *Profiles) onIncomingBlock(p peer.ID, response graphsync.ResponseData, block graphsync.BlockData, hookActions graphsync.IncomingBlockHookActions) {
+	if block.BlockSizeOnWire() == 0 {
+		return
+	}
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+	ps.profile(p).BytesReceived += block.BlockSizeOnWire()
+}
+
+func (ps *Profiles) onIncomingRequest(p peer.ID, request graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+	n := ps.negotiated(p)
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+	ps.negotiatedProfile(p, n).addExtensions(request.Extension)
+}
+
+func (ps *Profiles) onResponseCompleted(p peer.ID, request graphsync.RequestData, status graphsync.ResponseStatusCode) {
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+	profile := ps.profile(p)
+	if gsmsg.IsTerminalSuccessCode(status) {
+		profile.Succeeded++
+	} else if gsmsg.IsTerminalFailureCode(status) {
+		profile.Failed++
+	}
+}
+
+// onRequestCompleted forgets when an outgoing request started once it
+// finishes for any reason, including requests cancelled or failed by errors
+// before the peer sent a final status
+func (ps *Profiles) onRequestCompleted(p peer.ID, request graphsync.RequestData, status graphsync.ResponseStatusCode, err error, stats graphsync.RequestStats) {
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+	delete(ps.requestStarts, requestKey{p, request.ID()})
+}
+
+func (ps *Profiles) onNetworkError(p peer.ID, request graphsync.RequestData, err error) {
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+	ps.profile(p).Failed++
+}
@@ -0,0 +1,136 @@
+package peerprofile
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+type blockData struct {
+	link       ipld.Link
+	size       uint64
+	sizeOnWire uint64
+}
+
+func (bd blockData) Link() ipld.Link         { return bd.link }
+func (bd blockData) BlockSize() uint64       { return bd.size }
+func (bd blockData) BlockSizeOnWire() uint64 { return bd.sizeOnWire }
+func (bd blockData) Cid() cid.Cid            { return bd.link.(cidlink.Link).Cid }
+func (bd blockData) Index() int64            { return 0 }
+func (bd blockData) Deduplicated() bool      { return false }
+
+func TestLearnSaveAndLoadProfiles(t *testing.T) {
+	peers := testutil.GeneratePeers(2)
+	root := testutil.GenerateCids(1)[0]
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	selector := ssb.Matcher().Node()
+	request := gsmsg.NewRequest(graphsync.RequestID(1), root, selector, graphsync.Priority(0),
+		graphsync.ExtensionData{Name: graphsync.ExtensionDeDupByKey, Data: nil})
+	link := cidlink.Link{Cid: root}
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	prefix := datastore.NewKey("/peerprofiles")
+
+	profiles := New(ds, prefix)
+	profiles.negotiator = fakeNegotiator{
+		protocols:  map[peer.ID]protocol.ID{peers[0]: "/ipfs/graphsync/1.0.0"},
+		extensions: map[peer.ID][]graphsync.ExtensionName{peers[1]: {graphsync.ExtensionMetadataOnly}},
+	}
+
+	// requestor side, first peer
+	profiles.onOutgoingRequest(peers[0], request, nil)
+	profiles.onIncomingBlock(peers[0], gsmsg.NewResponse(request.ID(), graphsync.PartialResponse), blockData{link, 2000, 2000}, nil)
+	profiles.onIncomingBlock(peers[0], gsmsg.NewResponse(request.ID(), graphsync.PartialResponse), blockData{link, 100, 0}, nil)
+	profiles.onIncomingResponse(peers[0], gsmsg.NewResponse(request.ID(), graphsync.RequestCompletedFull), nil)
+
+	// responder side, second peer
+	profiles.onIncomingRequest(peers[1], request, nil)
+	profiles.onResponseCompleted(peers[1], request, graphsync.RequestCompletedFull)
+	profiles.onNetworkError(peers[1], request, errors.New("something went wrong"))
+
+	profile, ok := profiles.Get(peers[0])
+	require.True(t, ok)
+	require.Equal(t, protocol.ID("/ipfs/graphsync/1.0.0"), profile.Protocol)
+	require.Equal(t, uint64(2000), profile.BytesReceived)
+	require.Equal(t, uint64(1), profile.Succeeded)
+	require.True(t, profile.TransferTime > 0)
+	require.True(t, profile.Throughput() > 0)
+	require.Equal(t, 1.0, profile.Reliability())
+
+	profile, ok = profiles.Get(peers[1])
+	require.True(t, ok)
+	require.True(t, profile.SupportsExtension(graphsync.ExtensionDeDupByKey))
+	require.True(t, profile.SupportsExtension(graphsync.ExtensionMetadataOnly))
+	require.False(t, profile.SupportsExtension(graphsync.ExtensionMetadata))
+	require.Equal(t, 0.5, profile.Reliability())
+
+	require.NoError(t, profiles.Save())
+
+	reloaded := New(ds, prefix)
+	require.NoError(t, reloaded.Load())
+	for _, p := range peers {
+		expected, _ := profiles.Get(p)
+		actual, ok := reloaded.Get(p)
+		require.True(t, ok)
+		require.Equal(t, expected.Protocol, actual.Protocol)
+		require.Equal(t, expected.Extensions, actual.Extensions)
+		require.Equal(t, expected.BytesReceived, actual.BytesReceived)
+		require.Equal(t, expected.TransferTime, actual.TransferTime)
+		require.Equal(t, expected.Succeeded, actual.Succeeded)
+		require.Equal(t, expected.Failed, actual.Failed)
+		require.True(t, expected.LastSeen.Equal(actual.LastSeen))
+	}
+}
+
+func TestForgetsStartsOfUnfinishedRequests(t *testing.T) {
+	p := testutil.GeneratePeers(1)[0]
+	root := testutil.GenerateCids(1)[0]
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	selector := ssb.Matcher().Node()
+	cancelled := gsmsg.NewRequest(graphsync.RequestID(1), root, selector, graphsync.Priority(0))
+	errored := gsmsg.NewRequest(graphsync.RequestID(2), root, selector, graphsync.Priority(0))
+
+	profiles := New(datastore.NewMapDatastore(), datastore.NewKey("/peerprofiles"))
+	profiles.onOutgoingRequest(p, cancelled, nil)
+	profiles.onOutgoingRequest(p, errored, nil)
+	require.Len(t, profiles.requestStarts, 2)
+
+	profiles.onRequestCompleted(p, cancelled, graphsync.PartialResponse, graphsync.RequestCancelledErr{}, graphsync.RequestStats{})
+	profiles.onRequestCompleted(p, errored, graphsync.PartialResponse, errors.New("something went wrong"), graphsync.RequestStats{})
+	require.Empty(t, profiles.requestStarts)
+}
+
+func TestUnknownPeer(t *testing.T) {
+	profiles := New(datastore.NewMapDatastore(), datastore.NewKey("/peerprofiles"))
+	require.NoError(t, profiles.Load())
+	_, ok := profiles.Get(testutil.GeneratePeers(1)[0])
+	require.False(t, ok)
+}
+
+type fakeNegotiator struct {
+	protocols  map[peer.ID]protocol.ID
+	extensions map[peer.ID][]graphsync.ExtensionName
+}
+
+func (fn fakeNegotiator) ProtocolVersion(p peer.ID) (protocol.ID, bool) {
+	version, ok := fn.protocols[p]
+	return version, ok
+}
+
+func (fn fakeNegotiator) SupportedExtensions(p peer.ID) ([]graphsync.ExtensionName, bool) {
+	names, ok := fn.extensions[p]
+	return names, ok
+}
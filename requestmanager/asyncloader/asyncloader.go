@@ -4,25 +4,65 @@ import (
 	"context"
 	"errors"
 	"io/ioutil"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log"
 	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/ipldutil"
 	"github.com/ipfs/go-graphsync/metadata"
+	"github.com/ipfs/go-graphsync/requestmanager/asyncloader/batchstore"
 	"github.com/ipfs/go-graphsync/requestmanager/asyncloader/loadattemptqueue"
 	"github.com/ipfs/go-graphsync/requestmanager/asyncloader/responsecache"
 	"github.com/ipfs/go-graphsync/requestmanager/asyncloader/unverifiedblockstore"
 	"github.com/ipfs/go-graphsync/requestmanager/types"
 )
 
+var log = logging.Logger("graphsync")
+
 type loaderMessage interface {
 	handle(al *AsyncLoader)
 }
 
 type alternateQueue struct {
+	loader           ipld.Loader
+	storer           ipld.Storer
+	responseCache    *responsecache.ResponseCache
+	loadAttemptQueue *loadattemptqueue.LoadAttemptQueue
+	newTransaction   graphsync.NewStoreTransaction
+	usage            *optionUsage
+}
+
+// transactionQueue loads and stores links for a single request using a
+// transactional persistence option
+type transactionQueue struct {
+	transaction      graphsync.StoreTransaction
 	responseCache    *responsecache.ResponseCache
 	loadAttemptQueue *loadattemptqueue.LoadAttemptQueue
+	finished         bool
+}
+
+// splitQueue loads and stores links for a single request apart from its
+// persistence option's shared queues -- either because it writes blocks to a
+// different persistence option, or because it uses the default store and
+// began before the default store was replaced
+type splitQueue struct {
+	writeOption      string
+	responseCache    *responsecache.ResponseCache
+	loadAttemptQueue *loadattemptqueue.LoadAttemptQueue
+}
+
+type storeWriteFailurePolicy struct {
+	policy   graphsync.StoreWriteFailurePolicy
+	fallback string
 }
 
 // AsyncLoader manages loading links asynchronously in as new responses
@@ -38,16 +78,125 @@ type AsyncLoader struct {
 	activeRequests   map[graphsync.RequestID]struct{}
 	requestQueues    map[graphsync.RequestID]string
 	alternateQueues  map[string]alternateQueue
+	transactions     map[graphsync.RequestID]*transactionQueue
+	splitQueues      map[graphsync.RequestID]*splitQueue
+	defaultRequests  map[graphsync.RequestID]struct{}
+	requestLoads     map[graphsync.RequestID]*requestLoads
+	failurePolicies  map[graphsync.RequestID]storeWriteFailurePolicy
+	pausedRequests   map[graphsync.RequestID]struct{}
 	responseCache    *responsecache.ResponseCache
 	loadAttemptQueue *loadattemptqueue.LoadAttemptQueue
+	spill            *unverifiedblockstore.Spill
+	batchStore       *batchstore.BatchStore
+	batchInterval    time.Duration
+	prefetcher       *prefetcher
+	orphanTTL        time.Duration
+	strictBlocks     bool
+	verifyWorkers    int
+	storeHook        responsecache.BlockInspector
+	provenance       graphsync.ProvenanceSink
+	orphans          *responsecache.OrphanCounter
+	counters         *loadCounters
+	done             chan struct{}
+}
+
+// Stats describes how links loaded by the AsyncLoader have been satisfied, for
+// performance tuning
+type Stats struct {
+	// LocalLoads is the number of loads satisfied from local storage
+	LocalLoads uint64
+	// NetworkLoads is the number of loads satisfied by blocks received from
+	// the network
+	NetworkLoads uint64
+	// FailedLoads is the number of loads that failed
+	FailedLoads uint64
+	// AverageWait is the average time from calling AsyncLoad to its result
+	AverageWait time.Duration
+	// BufferedBytes is the size of blocks received from the network that are
+	// waiting to be verified
+	BufferedBytes uint64
+}
+
+// RequestSnapshot describes the loads for a single request in progress, to
+// debug requests that stall
+type RequestSnapshot struct {
+	RequestID graphsync.RequestID
+	// PersistenceOption is the persistence option the request loads from, or
+	// empty for the default store
+	PersistenceOption string
+	// AwaitedLinks are the links the request is waiting for blocks for
+	AwaitedLinks []ipld.Link
+	// LocalLoads is the number of the request's loads satisfied from local
+	// storage
+	LocalLoads uint64
+	// NetworkLoads is the number of the request's loads satisfied by blocks
+	// received from the network
+	NetworkLoads uint64
+	// FailedLoads is the number of the request's loads that failed
+	FailedLoads uint64
+	// BufferedBytes is the size of blocks received for the request that are
+	// waiting to be verified
+	BufferedBytes uint64
+}
+
+type requestLoads struct {
+	local   uint64
+	network uint64
+	failed  uint64
+}
+
+func (rl *requestLoads) observe(result types.AsyncLoadResult) {
+	switch {
+	case result.Err != nil:
+		rl.failed++
+	case result.Local:
+		rl.local++
+	default:
+		rl.network++
+	}
+}
+
+type loadCounters struct {
+	localLoads    uint64
+	networkLoads  uint64
+	failedLoads   uint64
+	totalWait     uint64
+	bufferedBytes uint64
+}
+
+func (lc *loadCounters) observe(result types.AsyncLoadResult, wait time.Duration) {
+	switch {
+	case result.Err != nil:
+		atomic.AddUint64(&lc.failedLoads, 1)
+	case result.Local:
+		atomic.AddUint64(&lc.localLoads, 1)
+	default:
+		atomic.AddUint64(&lc.networkLoads, 1)
+	}
+	atomic.AddUint64(&lc.totalWait, uint64(wait))
+}
+
+// optionUsage tracks the bytes written to a persistence option, and the quota
+// they are limited to, if any
+type optionUsage struct {
+	name         string
+	bytesWritten uint64
+	quota        uint64
+}
+
+func (ou *optionUsage) checkQuota(size uint64) error {
+	quota := atomic.LoadUint64(&ou.quota)
+	if quota > 0 && atomic.LoadUint64(&ou.bytesWritten)+size > quota {
+		return graphsync.StoreFullErr{PersistenceOption: ou.name, Quota: quota}
+	}
+	return nil
 }
 
 // New initializes a new link loading manager for asynchronous loads from the given context
 // and local store loading and storing function
 func New(ctx context.Context, loader ipld.Loader, storer ipld.Storer) *AsyncLoader {
-	responseCache, loadAttemptQueue := setupAttemptQueue(loader, storer)
 	ctx, cancel := context.WithCancel(ctx)
-	return &AsyncLoader{
+	al := &AsyncLoader{
 		ctx:              ctx,
 		cancel:           cancel,
 		incomingMessages: make(chan loaderMessage),
@@ -57,15 +206,168 @@ func New(ctx context.Context, loader ipld.Loader, storer ipld.Storer) *AsyncLoad
 		activeRequests:   make(map[graphsync.RequestID]struct{}),
 		requestQueues:    make(map[graphsync.RequestID]string),
 		alternateQueues:  make(map[string]alternateQueue),
-		responseCache:    responseCache,
-		loadAttemptQueue: loadAttemptQueue,
+		transactions:     make(map[graphsync.RequestID]*transactionQueue),
+		splitQueues:      make(map[graphsync.RequestID]*splitQueue),
+		defaultRequests:  make(map[graphsync.RequestID]struct{}),
+		requestLoads:     make(map[graphsync.RequestID]*requestLoads),
+		failurePolicies:  make(map[graphsync.RequestID]storeWriteFailurePolicy),
+		pausedRequests:   make(map[graphsync.RequestID]struct{}),
+		orphans:          responsecache.NewOrphanCounter(),
+		counters:         &loadCounters{},
+		done:             make(chan struct{}),
 	}
+	al.responseCache, al.loadAttemptQueue = al.setupAttemptQueue(loader, storer, nil, nil, nil)
+	return al
 }
 
 // Startup starts processing of messages
 func (al *AsyncLoader) Startup() {
 	go al.messageQueueWorker()
 	go al.run()
+	if al.batchStore != nil {
+		go al.batchStore.Run(al.ctx, al.batchInterval)
+	}
+}
+
+// SetMemoryLimit caps the unverified blocks held in memory across all
+// persistence options at maxBytes, writing further blocks to a temporary
+// directory inside spillDir until they are verified or pruned. If spillDir is
+// empty, the default directory for temporary files is used. It should be
+// called before Startup
+func (al *AsyncLoader) SetMemoryLimit(maxBytes uint64, spillDir string) error {
+	spill, err := unverifiedblockstore.NewSpill(maxBytes, spillDir)
+	if err != nil {
+		return err
+	}
+	al.spill = spill
+	al.responseCache, al.loadAttemptQueue = al.setupAttemptQueue(al.defaultLoader, al.defaultStorer, al.batchStore, nil, al.prefetcher)
+	return nil
+}
+
+// SetEvictionPolicy picks blocks held in memory to move to disk with policies
+// from newPolicy, one for each persistence option, once the limit set with
+// SetMemoryLimit is reached, instead of writing new blocks to disk. It must be
+// called after SetMemoryLimit, and before Startup
+func (al *AsyncLoader) SetEvictionPolicy(newPolicy unverifiedblockstore.NewEvictionPolicy) error {
+	if al.spill == nil {
+		return errors.New("eviction policy requires a memory limit")
+	}
+	al.spill.EvictWith(newPolicy)
+	al.responseCache, al.loadAttemptQueue = al.setupAttemptQueue(al.defaultLoader, al.defaultStorer, al.batchStore, nil, al.prefetcher)
+	return nil
+}
+
+// SetBatchedWrites writes verified blocks for requests using the default
+// persistence option with storeBatch, several at a time, instead of with the
+// default storer one at a time. A batch is written once it holds maxBlocks
+// blocks or maxBytes bytes, every interval, and when a request finishes, so
+// blocks may reach storage shortly after a request completes. It should be
+// called before Startup
+func (al *AsyncLoader) SetBatchedWrites(storeBatch batchstore.StoreBatch, maxBlocks int, maxBytes uint64, interval time.Duration) {
+	al.batchStore = batchstore.New(storeBatch, maxBlocks, maxBytes)
+	al.batchInterval = interval
+	al.responseCache, al.loadAttemptQueue = al.setupAttemptQueue(al.defaultLoader, al.defaultStorer, al.batchStore, nil, al.prefetcher)
+}
+
+// SetLocalPrefetch checks the default local store for links announced in
+// response metadata whose blocks were not sent with it, as soon as the
+// metadata arrives, rather than when the traversal reaches them. Up to workers
+// reads run at once, and up to maxBytes of prefetched data is held until it is
+// loaded or the request finishes. Prefetching only applies to requests using
+// the default persistence option. It should be called before Startup
+func (al *AsyncLoader) SetLocalPrefetch(workers int, maxBytes uint64) {
+	al.prefetcher = newPrefetcher(al.defaultLoader, workers, maxBytes)
+	al.responseCache, al.loadAttemptQueue = al.setupAttemptQueue(al.defaultLoader, al.defaultStorer, al.batchStore, nil, al.prefetcher)
+}
+
+// SetVerifyWorkers hashes the blocks in each response with up to workers
+// goroutines at once, rather than one at a time, so verifying large responses
+// keeps up with fast links. Blocks are still handed to requests in the order
+// they were received. Verified blocks are written to the store as requests
+// load them; use SetBatchedWrites to take writes off the loading path. It
+// should be called before Startup
+func (al *AsyncLoader) SetVerifyWorkers(workers int) {
+	al.verifyWorkers = workers
+}
+
+// SetBlockStoreHook sets a function that inspects each block received from the
+// network before it is written to the store, and may reject it. Loads of
+// rejected blocks fail with a graphsync.BlockRejectedErr. It should be called
+// before Startup
+func (al *AsyncLoader) SetBlockStoreHook(hook responsecache.BlockInspector) {
+	al.storeHook = hook
+}
+
+// SetProvenanceSink records the peer and request that delivered each block
+// received from the network and written to the store in the given sink. It
+// should be called before Startup
+func (al *AsyncLoader) SetProvenanceSink(sink graphsync.ProvenanceSink) {
+	al.provenance = sink
+}
+
+// SetStrictBlockChecking drops blocks that are not announced as present in
+// the metadata of the response they arrive with, rather than holding them in
+// case a request asks for them later. It should be called before Startup
+func (al *AsyncLoader) SetStrictBlockChecking(strict bool) {
+	al.strictBlocks = strict
+}
+
+// SetOrphanTTL drops blocks received from the network that have not been
+// verified after ttl, even if the request they were sent for is still in
+// progress, so blocks for requests that stall are not held indefinitely.
+// Blocks expected by a paused request are kept until it resumes, and expire
+// ttl after that. Blocks are checked every ttl, so are dropped between ttl and
+// twice ttl after they arrive. If the request later loads a dropped block, the
+// load waits for the block to be sent again. It should be called before Startup
+func (al *AsyncLoader) SetOrphanTTL(ttl time.Duration) {
+	al.orphanTTL = ttl
+}
+
+// OrphanedBytes returns the total size of blocks from each peer that were
+// dropped without being verified -- because no request expected them, their
+// request finished without loading them, or they expired
+func (al *AsyncLoader) OrphanedBytes() map[peer.ID]uint64 {
+	return al.orphans.Bytes()
+}
+
+// SpillStats returns how much unverified block data is held in memory and on
+// disk, or false if no memory limit is set
+func (al *AsyncLoader) SpillStats() (unverifiedblockstore.SpillStats, bool) {
+	if al.spill == nil {
+		return unverifiedblockstore.SpillStats{}, false
+	}
+	return al.spill.Stats(), true
+}
+
+// Stats returns counts of how loads have been satisfied so far
+func (al *AsyncLoader) Stats() Stats {
+	stats := Stats{
+		LocalLoads:    atomic.LoadUint64(&al.counters.localLoads),
+		NetworkLoads:  atomic.LoadUint64(&al.counters.networkLoads),
+		FailedLoads:   atomic.LoadUint64(&al.counters.failedLoads),
+		BufferedBytes: atomic.LoadUint64(&al.counters.bufferedBytes),
+	}
+	if loads := stats.LocalLoads + stats.NetworkLoads + stats.FailedLoads; loads > 0 {
+		stats.AverageWait = time.Duration(atomic.LoadUint64(&al.counters.totalWait) / loads)
+	}
+	return stats
+}
+
+// Snapshot describes the loads for each request that has started and not
+// been cleaned up, sorted by request ID
+func (al *AsyncLoader) Snapshot() []RequestSnapshot {
+	response := make(chan []RequestSnapshot, 1)
+	select {
+	case <-al.ctx.Done():
+		return nil
+	case al.incomingMessages <- &snapshotMessage{response}:
+	}
+	select {
+	case <-al.ctx.Done():
+		return nil
+	case snapshot := <-response:
+		return snapshot
+	}
 }
 
 // Shutdown finishes processing of messages
@@ -73,13 +375,57 @@ func (al *AsyncLoader) Shutdown() {
 	al.cancel()
 }
 
+// Done returns a channel that closes once processing has stopped after
+// Shutdown
+func (al *AsyncLoader) Done() <-chan struct{} {
+	return al.done
+}
+
 // RegisterPersistenceOption registers a new loader/storer option for processing requests
 func (al *AsyncLoader) RegisterPersistenceOption(name string, loader ipld.Loader, storer ipld.Storer) error {
 	if name == "" {
 		return errors.New("Persistence option must have a name")
 	}
 	response := make(chan error, 1)
-	err := al.sendSyncMessage(&registerPersistenceOptionMessage{name, loader, storer, response}, response)
+	err := al.sendSyncMessage(&registerPersistenceOptionMessage{name: name, loader: loader, storer: storer, response: response}, response)
+	return err
+}
+
+// RegisterTransactionalPersistenceOption registers a new persistence option
+// that stages each request's writes in a transaction from newTransaction
+func (al *AsyncLoader) RegisterTransactionalPersistenceOption(name string, newTransaction graphsync.NewStoreTransaction) error {
+	if name == "" {
+		return errors.New("Persistence option must have a name")
+	}
+	response := make(chan error, 1)
+	err := al.sendSyncMessage(&registerPersistenceOptionMessage{name: name, newTransaction: newTransaction, response: response}, response)
+	return err
+}
+
+// ListPersistenceOptions returns the registered persistence options, sorted by
+// name, with the number of requests using each and the bytes written to each
+func (al *AsyncLoader) ListPersistenceOptions() []graphsync.PersistenceOptionUsage {
+	response := make(chan []graphsync.PersistenceOptionUsage, 1)
+	select {
+	case <-al.ctx.Done():
+		return nil
+	case al.incomingMessages <- &listPersistenceOptionsMessage{response}:
+	}
+	select {
+	case <-al.ctx.Done():
+		return nil
+	case usage := <-response:
+		return usage
+	}
+}
+
+// SetPersistenceOptionQuota limits the bytes that can be written to the named
+// persistence option. Writes that would exceed it fail with a
+// graphsync.StoreFullErr, which is handled by the request's store write
+// failure policy. A quota of 0 removes the limit
+func (al *AsyncLoader) SetPersistenceOptionQuota(name string, maxBytes uint64) error {
+	response := make(chan error, 1)
+	err := al.sendSyncMessage(&setPersistenceOptionQuotaMessage{name, maxBytes, response}, response)
 	return err
 }
 
@@ -101,14 +447,128 @@ func (al *AsyncLoader) StartRequest(requestID graphsync.RequestID, persistenceOp
 	return err
 }
 
-// ProcessResponse injests new responses and completes asynchronous loads as
-// neccesary
-func (al *AsyncLoader) ProcessResponse(responses map[graphsync.RequestID]metadata.Metadata,
-	blks []blocks.Block) {
+// SetDefaultStore replaces the default loader and storer. Requests already
+// started with the default store keep loading from and writing to the old one
+// until they finish. Blocks written with SetBatchedWrites still go to its
+// storeBatch function
+func (al *AsyncLoader) SetDefaultStore(loader ipld.Loader, storer ipld.Storer) error {
+	response := make(chan error, 1)
+	err := al.sendSyncMessage(&setDefaultStoreMessage{loader, storer, response}, response)
+	return err
+}
+
+// SetWritePersistenceOption writes blocks received for the given request with
+// the named persistence option's storer, while links are still loaded from the
+// persistence option the request was started with. It must be called right
+// after StartRequest, before any responses for the request are processed.
+// Neither option can be transactional
+func (al *AsyncLoader) SetWritePersistenceOption(requestID graphsync.RequestID, writePersistenceOption string) error {
+	response := make(chan error, 1)
+	err := al.sendSyncMessage(&setWritePersistenceOptionMessage{requestID, writePersistenceOption, response}, response)
+	return err
+}
+
+// SetStoreWriteFailurePolicy sets what happens when a block for the given request
+// is verified but cannot be written to the store. The fallback persistence option
+// is only used with graphsync.StoreWriteFallback
+func (al *AsyncLoader) SetStoreWriteFailurePolicy(requestID graphsync.RequestID, policy graphsync.StoreWriteFailurePolicy, fallbackPersistenceOption string) error {
+	response := make(chan error, 1)
+	err := al.sendSyncMessage(&setStoreWriteFailurePolicyMessage{requestID, storeWriteFailurePolicy{policy, fallbackPersistenceOption}, response}, response)
+	return err
+}
+
+// ProcessResponse injests new responses from the given peer and completes
+// asynchronous loads as neccesary. Blocks whose data does not hash to their
+// CID are dropped, and a graphsync.BlockHashMismatchErr is returned for each.
+// With strict block checking, blocks not announced in the metadata are also
+// dropped, and a graphsync.UnexpectedBlockErr is returned for each
+func (al *AsyncLoader) ProcessResponse(p peer.ID, responses map[graphsync.RequestID]metadata.Metadata,
+	blks []blocks.Block) []error {
+	verified, errs := verifyBlocks(blks, al.verifyWorkers)
+	if al.strictBlocks {
+		var unexpected []error
+		verified, unexpected = expectedBlocks(responses, verified)
+		errs = append(errs, unexpected...)
+	}
 	select {
 	case <-al.ctx.Done():
-	case al.incomingMessages <- &newResponsesAvailableMessage{responses, blks}:
+	case al.incomingMessages <- &newResponsesAvailableMessage{p, responses, verified}:
+	}
+	return errs
+}
+
+// expectedBlocks separates blocks whose links appear as present in the
+// response metadata from errors for those that do not
+func expectedBlocks(responses map[graphsync.RequestID]metadata.Metadata, blks []blocks.Block) ([]blocks.Block, []error) {
+	announced := make(map[cid.Cid]struct{})
+	for _, md := range responses {
+		for _, item := range md {
+			if item.BlockPresent {
+				announced[item.Link] = struct{}{}
+			}
+		}
+	}
+	var unexpected []error
+	expected := blks[:0:0]
+	for _, blk := range blks {
+		if _, ok := announced[blk.Cid()]; ok {
+			expected = append(expected, blk)
+			continue
+		}
+		unexpected = append(unexpected, graphsync.UnexpectedBlockErr{Cid: blk.Cid()})
+	}
+	return expected, unexpected
+}
+
+// verifyBlocks re-hashes each block's data with its CID's hash function,
+// using up to workers goroutines, and separates the blocks that match from
+// errors for those that do not. Both keep the order blocks were received in
+func verifyBlocks(blks []blocks.Block, workers int) ([]blocks.Block, []error) {
+	results := make([]error, len(blks))
+	if workers <= 1 || len(blks) < 2 {
+		for i, blk := range blks {
+			results[i] = verifyBlock(blk)
+		}
+	} else {
+		if workers > len(blks) {
+			workers = len(blks)
+		}
+		next := int64(-1)
+		var wg sync.WaitGroup
+		wg.Add(workers)
+		for w := 0; w < workers; w++ {
+			go func() {
+				defer wg.Done()
+				for {
+					i := int(atomic.AddInt64(&next, 1))
+					if i >= len(blks) {
+						return
+					}
+					results[i] = verifyBlock(blks[i])
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	var mismatches []error
+	verified := blks[:0:0]
+	for i, blk := range blks {
+		if results[i] == nil {
+			verified = append(verified, blk)
+			continue
+		}
+		log.Warnf("dropping block %s whose data does not match its CID", blk.Cid())
+		mismatches = append(mismatches, results[i])
+	}
+	return verified, mismatches
+}
+
+func verifyBlock(blk blocks.Block) error {
+	actual, err := blk.Cid().Prefix().Sum(blk.RawData())
+	if err == nil && actual.Equals(blk.Cid()) {
+		return nil
 	}
+	return graphsync.BlockHashMismatchErr{Expected: blk.Cid(), Actual: actual}
 }
 
 // AsyncLoad asynchronously loads the given link for the given request ID. It returns a channel for data and a channel
@@ -131,6 +591,25 @@ func (al *AsyncLoader) CompleteResponsesFor(requestID graphsync.RequestID) {
 	}
 }
 
+// SetRequestPaused records whether the given request is paused, so blocks it
+// expects are not dropped by the orphan TTL while it waits to resume
+func (al *AsyncLoader) SetRequestPaused(requestID graphsync.RequestID, paused bool) {
+	select {
+	case <-al.ctx.Done():
+	case al.incomingMessages <- &setRequestPausedMessage{requestID, paused}:
+	}
+}
+
+// CompleteTransaction commits the writes staged for the given request if commit
+// is true, or rolls them back otherwise. For requests with batched writes,
+// committing writes the batched blocks the request loaded, returning the error
+// if they could not be written
+func (al *AsyncLoader) CompleteTransaction(requestID graphsync.RequestID, commit bool) error {
+	response := make(chan error, 1)
+	err := al.sendSyncMessage(&completeTransactionMessage{requestID, commit, response}, response)
+	return err
+}
+
 // CleanupRequest indicates the given request is complete on the client side,
 // and no further attempts will be made to load links for this request,
 // so any cached response data is invalid can be cleaned
@@ -162,14 +641,22 @@ type loadRequestMessage struct {
 }
 
 type newResponsesAvailableMessage struct {
+	p         peer.ID
 	responses map[graphsync.RequestID]metadata.Metadata
 	blks      []blocks.Block
 }
 
 type registerPersistenceOptionMessage struct {
+	name           string
+	loader         ipld.Loader
+	storer         ipld.Storer
+	newTransaction graphsync.NewStoreTransaction
+	response       chan error
+}
+
+type setPersistenceOptionQuotaMessage struct {
 	name     string
-	loader   ipld.Loader
-	storer   ipld.Storer
+	maxBytes uint64
 	response chan error
 }
 
@@ -184,18 +671,69 @@ type startRequestMessage struct {
 	response          chan error
 }
 
+type setDefaultStoreMessage struct {
+	loader   ipld.Loader
+	storer   ipld.Storer
+	response chan error
+}
+
+type setWritePersistenceOptionMessage struct {
+	requestID   graphsync.RequestID
+	writeOption string
+	response    chan error
+}
+
+type setStoreWriteFailurePolicyMessage struct {
+	requestID graphsync.RequestID
+	policy    storeWriteFailurePolicy
+	response  chan error
+}
+
 type finishRequestMessage struct {
 	requestID graphsync.RequestID
 }
 
+type snapshotMessage struct {
+	response chan []RequestSnapshot
+}
+
+type listPersistenceOptionsMessage struct {
+	response chan []graphsync.PersistenceOptionUsage
+}
+
+type completeTransactionMessage struct {
+	requestID graphsync.RequestID
+	commit    bool
+	response  chan error
+}
+
+type setRequestPausedMessage struct {
+	requestID graphsync.RequestID
+	paused    bool
+}
+
 type cleanupRequestMessage struct {
 	requestID graphsync.RequestID
 }
 
 func (al *AsyncLoader) run() {
+	defer close(al.done)
+	var expire <-chan time.Time
+	if al.orphanTTL > 0 {
+		ticker := time.NewTicker(al.orphanTTL)
+		defer ticker.Stop()
+		expire = ticker.C
+	}
 	for {
 		select {
+		case <-expire:
+			al.pruneExpired()
 		case <-al.ctx.Done():
+			if al.spill != nil {
+				if err := al.spill.Close(); err != nil {
+					log.Warnf("unable to remove spilled blocks: %s", err)
+				}
+			}
 			return
 		case message := <-al.outgoingMessages:
 			message.handle(al)
@@ -243,9 +781,22 @@ func (al *AsyncLoader) getResponseCache(queue string) *responsecache.ResponseCac
 	return al.alternateQueues[queue].responseCache
 }
 
+// queuesFor returns the response cache and load attempt queue for the given
+// request
+func (al *AsyncLoader) queuesFor(requestID graphsync.RequestID) (*responsecache.ResponseCache, *loadattemptqueue.LoadAttemptQueue) {
+	if tq, ok := al.transactions[requestID]; ok {
+		return tq.responseCache, tq.loadAttemptQueue
+	}
+	if sq, ok := al.splitQueues[requestID]; ok {
+		return sq.responseCache, sq.loadAttemptQueue
+	}
+	queue := al.requestQueues[requestID]
+	return al.getResponseCache(queue), al.getLoadAttemptQueue(queue)
+}
+
 func (lrm *loadRequestMessage) handle(al *AsyncLoader) {
 	_, retry := al.activeRequests[lrm.requestID]
-	loadAttemptQueue := al.getLoadAttemptQueue(al.requestQueues[lrm.requestID])
+	_, loadAttemptQueue := al.queuesFor(lrm.requestID)
 	loadAttemptQueue.AttemptLoad(lrm.loadRequest, retry)
 	select {
 	case <-al.ctx.Done():
@@ -258,8 +809,13 @@ func (rpom *registerPersistenceOptionMessage) register(al *AsyncLoader) error {
 	if existing {
 		return errors.New("already registerd a persistence option with this name")
 	}
-	responseCache, loadAttemptQueue := setupAttemptQueue(rpom.loader, rpom.storer)
-	al.alternateQueues[rpom.name] = alternateQueue{responseCache, loadAttemptQueue}
+	usage := &optionUsage{name: rpom.name}
+	if rpom.newTransaction != nil {
+		al.alternateQueues[rpom.name] = alternateQueue{newTransaction: rpom.newTransaction, usage: usage}
+		return nil
+	}
+	responseCache, loadAttemptQueue := al.setupAttemptQueue(rpom.loader, rpom.storer, nil, usage, nil)
+	al.alternateQueues[rpom.name] = alternateQueue{loader: rpom.loader, storer: rpom.storer, responseCache: responseCache, loadAttemptQueue: loadAttemptQueue, usage: usage}
 	return nil
 }
 
@@ -271,6 +827,20 @@ func (rpom *registerPersistenceOptionMessage) handle(al *AsyncLoader) {
 	}
 }
 
+func (spqm *setPersistenceOptionQuotaMessage) handle(al *AsyncLoader) {
+	var err error
+	aq, ok := al.alternateQueues[spqm.name]
+	if ok {
+		atomic.StoreUint64(&aq.usage.quota, spqm.maxBytes)
+	} else {
+		err = errors.New("Unknown persistence option")
+	}
+	select {
+	case <-al.ctx.Done():
+	case spqm.response <- err:
+	}
+}
+
 func (upom *unregisterPersistenceOptionMessage) unregister(al *AsyncLoader) error {
 	_, ok := al.alternateQueues[upom.name]
 	if !ok {
@@ -281,6 +851,16 @@ func (upom *unregisterPersistenceOptionMessage) unregister(al *AsyncLoader) erro
 			return errors.New("cannot unregister while requests are in progress")
 		}
 	}
+	for _, sq := range al.splitQueues {
+		if upom.name == sq.writeOption {
+			return errors.New("cannot unregister while requests are in progress")
+		}
+	}
+	for _, failurePolicy := range al.failurePolicies {
+		if failurePolicy.policy == graphsync.StoreWriteFallback && upom.name == failurePolicy.fallback {
+			return errors.New("cannot unregister while requests are in progress")
+		}
+	}
 	delete(al.alternateQueues, upom.name)
 	return nil
 }
@@ -295,13 +875,28 @@ func (upom *unregisterPersistenceOptionMessage) handle(al *AsyncLoader) {
 
 func (srm *startRequestMessage) startRequest(al *AsyncLoader) error {
 	if srm.persistenceOption != "" {
-		_, ok := al.alternateQueues[srm.persistenceOption]
+		aq, ok := al.alternateQueues[srm.persistenceOption]
 		if !ok {
 			return errors.New("Unknown persistence option")
 		}
+		if aq.newTransaction != nil {
+			transaction, err := aq.newTransaction(srm.requestID)
+			if err != nil {
+				return err
+			}
+			responseCache, loadAttemptQueue := al.setupAttemptQueue(transaction.Loader(), transaction.Storer(), nil, aq.usage, nil)
+			al.transactions[srm.requestID] = &transactionQueue{
+				transaction:      transaction,
+				responseCache:    responseCache,
+				loadAttemptQueue: loadAttemptQueue,
+			}
+		}
 		al.requestQueues[srm.requestID] = srm.persistenceOption
+	} else {
+		al.defaultRequests[srm.requestID] = struct{}{}
 	}
 	al.activeRequests[srm.requestID] = struct{}{}
+	al.requestLoads[srm.requestID] = &requestLoads{}
 	return nil
 }
 
@@ -313,31 +908,263 @@ func (srm *startRequestMessage) handle(al *AsyncLoader) {
 	}
 }
 
+func (sdsm *setDefaultStoreMessage) handle(al *AsyncLoader) {
+	// requests in progress keep the queue for the old store to themselves
+	for requestID := range al.defaultRequests {
+		if _, ok := al.splitQueues[requestID]; ok {
+			continue
+		}
+		al.splitQueues[requestID] = &splitQueue{
+			responseCache:    al.responseCache,
+			loadAttemptQueue: al.loadAttemptQueue,
+		}
+	}
+	al.defaultLoader = sdsm.loader
+	al.defaultStorer = sdsm.storer
+	if al.prefetcher != nil {
+		al.prefetcher = newPrefetcher(sdsm.loader, cap(al.prefetcher.workers), al.prefetcher.maxBytes)
+	}
+	al.responseCache, al.loadAttemptQueue = al.setupAttemptQueue(sdsm.loader, sdsm.storer, al.batchStore, nil, al.prefetcher)
+	select {
+	case <-al.ctx.Done():
+	case sdsm.response <- nil:
+	}
+}
+
+func (swpm *setWritePersistenceOptionMessage) setWriteOption(al *AsyncLoader) error {
+	if _, ok := al.transactions[swpm.requestID]; ok {
+		return errors.New("cannot split reads and writes for a transactional persistence option")
+	}
+	storer := al.defaultStorer
+	var usage *optionUsage
+	if swpm.writeOption != "" {
+		aq, ok := al.alternateQueues[swpm.writeOption]
+		if !ok {
+			return errors.New("Unknown write persistence option")
+		}
+		if aq.newTransaction != nil {
+			return errors.New("Write persistence option cannot be transactional")
+		}
+		storer = aq.storer
+		usage = aq.usage
+	}
+	loader := al.defaultLoader
+	if readOption, ok := al.requestQueues[swpm.requestID]; ok {
+		loader = al.alternateQueues[readOption].loader
+	}
+	responseCache, loadAttemptQueue := al.setupAttemptQueue(loader, storer, nil, usage, nil)
+	al.splitQueues[swpm.requestID] = &splitQueue{
+		writeOption:      swpm.writeOption,
+		responseCache:    responseCache,
+		loadAttemptQueue: loadAttemptQueue,
+	}
+	return nil
+}
+
+func (swpm *setWritePersistenceOptionMessage) handle(al *AsyncLoader) {
+	err := swpm.setWriteOption(al)
+	select {
+	case <-al.ctx.Done():
+	case swpm.response <- err:
+	}
+}
+
+func (sfpm *setStoreWriteFailurePolicyMessage) setPolicy(al *AsyncLoader) error {
+	if sfpm.policy.policy == graphsync.StoreWriteFallback {
+		aq, ok := al.alternateQueues[sfpm.policy.fallback]
+		if !ok {
+			return errors.New("Unknown fallback persistence option")
+		}
+		if aq.newTransaction != nil {
+			return errors.New("Fallback persistence option cannot be transactional")
+		}
+	}
+	al.failurePolicies[sfpm.requestID] = sfpm.policy
+	return nil
+}
+
+func (sfpm *setStoreWriteFailurePolicyMessage) handle(al *AsyncLoader) {
+	err := sfpm.setPolicy(al)
+	select {
+	case <-al.ctx.Done():
+	case sfpm.response <- err:
+	}
+}
+
 func (frm *finishRequestMessage) handle(al *AsyncLoader) {
 	delete(al.activeRequests, frm.requestID)
-	loadAttemptQueue := al.getLoadAttemptQueue(al.requestQueues[frm.requestID])
+	_, loadAttemptQueue := al.queuesFor(frm.requestID)
 	loadAttemptQueue.ClearRequest(frm.requestID)
 }
 
 func (nram *newResponsesAvailableMessage) handle(al *AsyncLoader) {
-	byQueue := make(map[string][]graphsync.RequestID)
-	for requestID := range nram.responses {
-		queue := al.requestQueues[requestID]
-		byQueue[queue] = append(byQueue[queue], requestID)
+	type queueResponses struct {
+		loadAttemptQueue *loadattemptqueue.LoadAttemptQueue
+		responses        map[graphsync.RequestID]metadata.Metadata
+	}
+	byQueue := make(map[*responsecache.ResponseCache]*queueResponses)
+	for requestID, md := range nram.responses {
+		responseCache, loadAttemptQueue := al.queuesFor(requestID)
+		qr, ok := byQueue[responseCache]
+		if !ok {
+			qr = &queueResponses{loadAttemptQueue, make(map[graphsync.RequestID]metadata.Metadata)}
+			byQueue[responseCache] = qr
+		}
+		qr.responses[requestID] = md
+	}
+	// a block is orphaned on arrival if no queue it was given to kept it
+	prunedCount := make(map[cid.Cid]int)
+	for responseCache, qr := range byQueue {
+		for _, blk := range responseCache.ProcessResponse(nram.p, qr.responses, nram.blks) {
+			prunedCount[blk.Cid()]++
+		}
+		qr.loadAttemptQueue.RetryLoads()
+	}
+	for _, blk := range nram.blks {
+		if prunedCount[blk.Cid()] == len(byQueue) {
+			al.orphans.Add(nram.p, uint64(len(blk.RawData())))
+		}
+	}
+	if al.prefetcher != nil {
+		al.prefetchMissingBlocks(nram.responses, nram.blks)
+	}
+}
+
+// prefetchMissingBlocks starts local reads for links in the metadata for
+// default persistence requests whose blocks were not in the same response
+func (al *AsyncLoader) prefetchMissingBlocks(responses map[graphsync.RequestID]metadata.Metadata, blks []blocks.Block) {
+	received := make(map[cid.Cid]struct{}, len(blks))
+	for _, blk := range blks {
+		received[blk.Cid()] = struct{}{}
+	}
+	for requestID, md := range responses {
+		if _, ok := al.requestQueues[requestID]; ok {
+			continue
+		}
+		if _, ok := al.splitQueues[requestID]; ok {
+			continue
+		}
+		for _, item := range md {
+			if _, ok := received[item.Link]; ok {
+				continue
+			}
+			link := cidlink.Link{Cid: item.Link}
+			if _, ok := ipldutil.IdentityData(link); ok {
+				continue
+			}
+			al.prefetcher.prefetch(requestID, link, item.BlockSize)
+		}
+	}
+}
+
+func (sm *snapshotMessage) handle(al *AsyncLoader) {
+	snapshot := make([]RequestSnapshot, 0, len(al.requestLoads))
+	for requestID, loads := range al.requestLoads {
+		responseCache, loadAttemptQueue := al.queuesFor(requestID)
+		snapshot = append(snapshot, RequestSnapshot{
+			RequestID:         requestID,
+			PersistenceOption: al.requestQueues[requestID],
+			AwaitedLinks:      loadAttemptQueue.PausedLinks(requestID),
+			LocalLoads:        loads.local,
+			NetworkLoads:      loads.network,
+			FailedLoads:       loads.failed,
+			BufferedBytes:     responseCache.BufferedBytes(requestID),
+		})
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].RequestID < snapshot[j].RequestID })
+	select {
+	case <-al.ctx.Done():
+	case sm.response <- snapshot:
+	}
+}
+
+func (lpom *listPersistenceOptionsMessage) handle(al *AsyncLoader) {
+	activeRequests := make(map[string]int)
+	for _, name := range al.requestQueues {
+		activeRequests[name]++
 	}
-	for queue, requestIDs := range byQueue {
-		loadAttemptQueue := al.getLoadAttemptQueue(queue)
-		responseCache := al.getResponseCache(queue)
-		responses := make(map[graphsync.RequestID]metadata.Metadata, len(requestIDs))
-		for _, requestID := range requestIDs {
-			responses[requestID] = nram.responses[requestID]
+	for requestID, sq := range al.splitQueues {
+		if sq.writeOption != al.requestQueues[requestID] {
+			activeRequests[sq.writeOption]++
 		}
-		responseCache.ProcessResponse(responses, nram.blks)
-		loadAttemptQueue.RetryLoads()
+	}
+	usage := make([]graphsync.PersistenceOptionUsage, 0, len(al.alternateQueues))
+	for name, aq := range al.alternateQueues {
+		usage = append(usage, graphsync.PersistenceOptionUsage{
+			Name:           name,
+			Transactional:  aq.newTransaction != nil,
+			ActiveRequests: activeRequests[name],
+			BytesWritten:   atomic.LoadUint64(&aq.usage.bytesWritten),
+			Quota:          atomic.LoadUint64(&aq.usage.quota),
+		})
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Name < usage[j].Name })
+	select {
+	case <-al.ctx.Done():
+	case lpom.response <- usage:
 	}
 }
 
+func (ctm *completeTransactionMessage) complete(al *AsyncLoader) error {
+	tq, ok := al.transactions[ctm.requestID]
+	if !ok {
+		// make sure batched blocks the request loaded are written before it
+		// reports success
+		if ctm.commit && al.batchStore != nil {
+			return al.batchStore.FinishRequest(ctm.requestID)
+		}
+		return nil
+	}
+	if tq.finished {
+		return nil
+	}
+	tq.finished = true
+	if ctm.commit {
+		return tq.transaction.Commit()
+	}
+	return tq.transaction.Rollback()
+}
+
+func (ctm *completeTransactionMessage) handle(al *AsyncLoader) {
+	err := ctm.complete(al)
+	select {
+	case <-al.ctx.Done():
+	case ctm.response <- err:
+	}
+}
+
+func (srpm *setRequestPausedMessage) handle(al *AsyncLoader) {
+	if !srpm.paused {
+		delete(al.pausedRequests, srpm.requestID)
+		// blocks held while paused get a full ttl once the request resumes
+		al.resetExpiry(srpm.requestID)
+		return
+	}
+	al.pausedRequests[srpm.requestID] = struct{}{}
+}
+
 func (crm *cleanupRequestMessage) handle(al *AsyncLoader) {
+	delete(al.failurePolicies, crm.requestID)
+	delete(al.pausedRequests, crm.requestID)
+	delete(al.requestLoads, crm.requestID)
+	delete(al.defaultRequests, crm.requestID)
+	if tq, ok := al.transactions[crm.requestID]; ok {
+		tq.responseCache.FinishRequest(crm.requestID)
+		if !tq.finished {
+			if err := tq.transaction.Rollback(); err != nil {
+				log.Warnf("unable to roll back writes for request %d: %s", crm.requestID, err)
+			}
+		}
+		delete(al.transactions, crm.requestID)
+		delete(al.requestQueues, crm.requestID)
+		return
+	}
+	if sq, ok := al.splitQueues[crm.requestID]; ok {
+		sq.responseCache.FinishRequest(crm.requestID)
+		delete(al.splitQueues, crm.requestID)
+		delete(al.requestQueues, crm.requestID)
+		return
+	}
 	aq, ok := al.requestQueues[crm.requestID]
 	if ok {
 		al.alternateQueues[aq].responseCache.FinishRequest(crm.requestID)
@@ -345,15 +1172,168 @@ func (crm *cleanupRequestMessage) handle(al *AsyncLoader) {
 		return
 	}
 	al.responseCache.FinishRequest(crm.requestID)
+	if al.prefetcher != nil {
+		al.prefetcher.finishRequest(crm.requestID)
+	}
+	if al.batchStore != nil {
+		al.batchStore.ReleaseRequest(crm.requestID)
+	}
+}
+
+// observeResult counts a load result towards the loader's stats and the
+// stats for the request it was for
+func (al *AsyncLoader) observeResult(requestID graphsync.RequestID, result types.AsyncLoadResult, wait time.Duration) {
+	al.counters.observe(result, wait)
+	if loads, ok := al.requestLoads[requestID]; ok {
+		loads.observe(result)
+	}
+}
+
+// inspectBlock runs the block store hook, if one is set
+func (al *AsyncLoader) inspectBlock(p peer.ID, requestID graphsync.RequestID, link ipld.Link, data []byte) error {
+	if al.storeHook == nil {
+		return nil
+	}
+	return al.storeHook(p, requestID, link, data)
+}
+
+// recordProvenance passes where a stored block came from to the provenance
+// sink, if one is set
+func (al *AsyncLoader) recordProvenance(p peer.ID, requestID graphsync.RequestID, link ipld.Link) {
+	if al.provenance == nil {
+		return
+	}
+	err := al.provenance.RecordProvenance(graphsync.BlockProvenance{
+		Link:      link,
+		Peer:      p,
+		RequestID: requestID,
+		Stored:    time.Now(),
+	})
+	if err != nil {
+		log.Warnf("unable to record provenance of block %s: %s", link, err)
+	}
 }
 
-func setupAttemptQueue(loader ipld.Loader, storer ipld.Storer) (*responsecache.ResponseCache, *loadattemptqueue.LoadAttemptQueue) {
+// pruneExpired drops blocks held longer than the orphan TTL from every
+// response cache, other than blocks expected by paused requests
+func (al *AsyncLoader) pruneExpired() {
+	al.responseCache.PruneExpired(al.orphanTTL, al.pausedRequests)
+	for _, aq := range al.alternateQueues {
+		if aq.responseCache != nil {
+			aq.responseCache.PruneExpired(al.orphanTTL, al.pausedRequests)
+		}
+	}
+	for _, tq := range al.transactions {
+		tq.responseCache.PruneExpired(al.orphanTTL, al.pausedRequests)
+	}
+	for _, sq := range al.splitQueues {
+		sq.responseCache.PruneExpired(al.orphanTTL, al.pausedRequests)
+	}
+}
 
-	unverifiedBlockStore := unverifiedblockstore.New(storer)
+// resetExpiry restarts the orphan TTL for blocks the given request expects
+func (al *AsyncLoader) resetExpiry(requestID graphsync.RequestID) {
+	responseCache, _ := al.queuesFor(requestID)
+	if responseCache != nil {
+		responseCache.ResetExpiry(requestID)
+	}
+}
+
+// handleStoreWriteFailure applies the store write failure policy for a request
+// to a block that was verified but could not be written
+func (al *AsyncLoader) handleStoreWriteFailure(requestID graphsync.RequestID, data []byte, storeErr graphsync.RequestFailedStoreWriteErr) types.AsyncLoadResult {
+	failurePolicy := al.failurePolicies[requestID]
+	switch failurePolicy.policy {
+	case graphsync.StoreWritePauseRequest:
+		return types.AsyncLoadResult{Err: graphsync.RequestPausedStoreWriteErr{Link: storeErr.Link, Err: storeErr.Err}}
+	case graphsync.StoreWriteFallback:
+		fallback, ok := al.alternateQueues[failurePolicy.fallback]
+		if !ok {
+			return types.AsyncLoadResult{Err: storeErr}
+		}
+		err := fallback.usage.checkQuota(uint64(len(data)))
+		if err == nil {
+			err = unverifiedblockstore.WriteBlock(fallback.storer, storeErr.Link, data)
+		}
+		if err != nil {
+			return types.AsyncLoadResult{Err: graphsync.RequestFailedStoreWriteErr{Link: storeErr.Link, Err: err}}
+		}
+		atomic.AddUint64(&fallback.usage.bytesWritten, uint64(len(data)))
+		return types.AsyncLoadResult{Data: data}
+	default:
+		return types.AsyncLoadResult{Err: storeErr}
+	}
+}
+
+func (al *AsyncLoader) setupAttemptQueue(loader ipld.Loader, storer ipld.Storer, batch *batchstore.BatchStore, usage *optionUsage, prefetch *prefetcher) (*responsecache.ResponseCache, *loadattemptqueue.LoadAttemptQueue) {
+	var unverifiedBlockStore *unverifiedblockstore.UnverifiedBlockStore
+	if al.spill != nil {
+		unverifiedBlockStore = unverifiedblockstore.NewWithSpill(storer, al.spill)
+	} else {
+		unverifiedBlockStore = unverifiedblockstore.New(storer)
+	}
+	unverifiedBlockStore.CountBufferedBytes(&al.counters.bufferedBytes)
+	if usage != nil {
+		unverifiedBlockStore.CountWrittenBytes(&usage.bytesWritten)
+		unverifiedBlockStore.CheckWritesWith(usage.checkQuota)
+	}
+	if batch != nil {
+		unverifiedBlockStore.WriteWith(func(lnk ipld.Link, data []byte) error {
+			cidLink, ok := lnk.(cidlink.Link)
+			if !ok {
+				return unverifiedblockstore.WriteBlock(storer, lnk, data)
+			}
+			blk, err := blocks.NewBlockWithCid(data, cidLink.Cid)
+			if err != nil {
+				return err
+			}
+			return batch.Put(blk)
+		})
+	}
 	responseCache := responsecache.New(unverifiedBlockStore)
+	responseCache.CountOrphanedBytes(al.orphans)
+	responseCache.InspectBlocksWith(al.inspectBlock)
+	responseCache.RecordStoredBlocksWith(al.recordProvenance)
 	loadAttemptQueue := loadattemptqueue.New(func(requestID graphsync.RequestID, link ipld.Link) types.AsyncLoadResult {
+		// blocks inlined in identity CIDs are never sent, so synthesize them
+		if data, ok := ipldutil.IdentityData(link); ok {
+			return types.AsyncLoadResult{
+				Data:  data,
+				Err:   nil,
+				Local: true,
+			}
+		}
 		// load from response cache
 		data, err := responseCache.AttemptLoad(requestID, link)
+		if storeErr, ok := err.(graphsync.RequestFailedStoreWriteErr); ok {
+			return al.handleStoreWriteFailure(requestID, data, storeErr)
+		}
+		if batch != nil && err == nil {
+			// blocks verified earlier, or just now, may not be written yet
+			if cidLink, ok := link.(cidlink.Link); ok {
+				batch.Claim(requestID, cidLink.Cid)
+			}
+		}
+		if data == nil && err == nil && batch != nil {
+			if cidLink, ok := link.(cidlink.Link); ok {
+				if batchData, ok := batch.Get(cidLink.Cid); ok {
+					return types.AsyncLoadResult{
+						Data:  batchData,
+						Err:   nil,
+						Local: true,
+					}
+				}
+			}
+		}
+		if data == nil && err == nil && prefetch != nil {
+			if prefetched, ok := prefetch.take(link); ok {
+				return types.AsyncLoadResult{
+					Data:  prefetched,
+					Err:   nil,
+					Local: true,
+				}
+			}
+		}
 		if data == nil && err == nil {
 			// fall back to local store
 			stream, loadErr := loader(link, ipld.LinkContext{})
@@ -375,5 +1355,7 @@ func setupAttemptQueue(loader ipld.Loader, storer ipld.Storer) (*responsecache.R
 		}
 	})
 
+	loadAttemptQueue.ObserveResults(al.observeResult)
+
 	return responseCache, loadAttemptQueue
 }
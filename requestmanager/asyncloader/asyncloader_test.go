@@ -2,6 +2,7 @@ package asyncloader
 
 import (
 	"context"
+	"errors"
 	"io"
 	"math/rand"
 	"testing"
@@ -10,11 +11,13 @@ import (
 	blocks "github.com/ipfs/go-block-format"
 	ipld "github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/stretchr/testify/require"
 
 	"github.com/ipfs/go-graphsync"
 	"github.com/ipfs/go-graphsync/metadata"
 	"github.com/ipfs/go-graphsync/requestmanager/types"
+	"github.com/ipfs/go-graphsync/storeutil"
 	"github.com/ipfs/go-graphsync/testutil"
 )
 
@@ -46,7 +49,7 @@ func TestAsyncLoadInitialLoadSucceedsResponsePresent(t *testing.T) {
 				},
 			},
 		}
-		asyncLoader.ProcessResponse(responses, blocks)
+		asyncLoader.ProcessResponse(remotePeer, responses, blocks)
 		resultChan := asyncLoader.AsyncLoad(requestID, link)
 
 		assertSuccessResponse(ctx, t, resultChan)
@@ -55,6 +58,519 @@ func TestAsyncLoadInitialLoadSucceedsResponsePresent(t *testing.T) {
 	})
 }
 
+func TestAsyncLoadIdentityBlock(t *testing.T) {
+	block := testutil.GenerateIdentityBlocks(1, 32)[0]
+	link := cidlink.Link{Cid: block.Cid()}
+
+	st := newStore()
+	withLoader(st, func(ctx context.Context, asyncLoader *AsyncLoader) {
+		requestID := graphsync.RequestID(rand.Int31())
+		err := asyncLoader.StartRequest(requestID, "")
+		require.NoError(t, err)
+		responses := map[graphsync.RequestID]metadata.Metadata{
+			requestID: metadata.Metadata{
+				metadata.Item{
+					Link:         link.Cid,
+					BlockPresent: true,
+				},
+			},
+		}
+		// the block is marked present but not sent
+		asyncLoader.ProcessResponse(remotePeer, responses, nil)
+		resultChan := asyncLoader.AsyncLoad(requestID, link)
+
+		var result types.AsyncLoadResult
+		testutil.AssertReceive(ctx, t, resultChan, &result, "should close response channel with response")
+		require.NoError(t, result.Err)
+		require.Equal(t, block.RawData(), result.Data)
+		require.True(t, result.Local)
+		st.AssertLocalLoads(t, 0)
+	})
+}
+
+func TestAsyncLoadDropsBlocksNotMatchingCid(t *testing.T) {
+	generated := testutil.GenerateBlocksOfSize(2, 100)
+	link := cidlink.Link{Cid: generated[0].Cid()}
+	forged, err := blocks.NewBlockWithCid(generated[1].RawData(), generated[0].Cid())
+	require.NoError(t, err)
+
+	st := newStore()
+	withLoader(st, func(ctx context.Context, asyncLoader *AsyncLoader) {
+		requestID := graphsync.RequestID(rand.Int31())
+		err := asyncLoader.StartRequest(requestID, "")
+		require.NoError(t, err)
+		responses := map[graphsync.RequestID]metadata.Metadata{
+			requestID: metadata.Metadata{
+				metadata.Item{
+					Link:         link.Cid,
+					BlockPresent: true,
+				},
+			},
+		}
+		mismatches := asyncLoader.ProcessResponse(remotePeer, responses, []blocks.Block{forged})
+		require.Equal(t, []error{graphsync.BlockHashMismatchErr{Expected: generated[0].Cid(), Actual: generated[1].Cid()}}, mismatches)
+
+		// the forged block is never cached, so the load waits for more responses
+		resultChan := asyncLoader.AsyncLoad(requestID, link)
+		st.AssertAttemptLoadWithoutResult(ctx, t, resultChan)
+
+		mismatches = asyncLoader.ProcessResponse(remotePeer, responses, generated[:1])
+		require.Empty(t, mismatches)
+		assertSuccessResponse(ctx, t, resultChan)
+		st.AssertBlockStored(t, generated[0])
+	})
+}
+
+func TestVerifyBlocksWithWorkers(t *testing.T) {
+	generated := testutil.GenerateBlocksOfSize(10, 100)
+	blks := append([]blocks.Block{}, generated...)
+	var expectedMismatches []error
+	for _, i := range []int{2, 7} {
+		forged, err := blocks.NewBlockWithCid(generated[i+1].RawData(), generated[i].Cid())
+		require.NoError(t, err)
+		blks[i] = forged
+		expectedMismatches = append(expectedMismatches, graphsync.BlockHashMismatchErr{Expected: generated[i].Cid(), Actual: generated[i+1].Cid()})
+	}
+	var expectedVerified []blocks.Block
+	for i, blk := range generated {
+		if i != 2 && i != 7 {
+			expectedVerified = append(expectedVerified, blk)
+		}
+	}
+
+	for _, workers := range []int{0, 1, 4, 20} {
+		verified, mismatches := verifyBlocks(blks, workers)
+		require.Equal(t, expectedVerified, verified)
+		require.Equal(t, expectedMismatches, mismatches)
+	}
+}
+
+func TestAsyncLoadStrictBlockChecking(t *testing.T) {
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	st := newStore()
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	asyncLoader := New(ctx, st.loader, st.storer)
+	asyncLoader.SetStrictBlockChecking(true)
+	asyncLoader.Startup()
+
+	requestID := graphsync.RequestID(rand.Int31())
+	err := asyncLoader.StartRequest(requestID, "")
+	require.NoError(t, err)
+	responses := map[graphsync.RequestID]metadata.Metadata{
+		requestID: metadata.Metadata{
+			metadata.Item{Link: blks[0].Cid(), BlockPresent: true},
+			metadata.Item{Link: blks[1].Cid(), BlockPresent: false},
+		},
+	}
+	errs := asyncLoader.ProcessResponse(remotePeer, responses, blks)
+	require.Equal(t, []error{
+		graphsync.UnexpectedBlockErr{Cid: blks[1].Cid()},
+		graphsync.UnexpectedBlockErr{Cid: blks[2].Cid()},
+	}, errs)
+	assertSuccessResponse(ctx, t, asyncLoader.AsyncLoad(requestID, cidlink.Link{Cid: blks[0].Cid()}))
+	assertFailResponse(ctx, t, asyncLoader.AsyncLoad(requestID, cidlink.Link{Cid: blks[1].Cid()}))
+}
+
+func TestAsyncLoadBlockStoreHook(t *testing.T) {
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	st := newStore()
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	asyncLoader := New(ctx, st.loader, st.storer)
+	asyncLoader.SetBlockStoreHook(func(p peer.ID, requestID graphsync.RequestID, link ipld.Link, data []byte) error {
+		require.Equal(t, remotePeer, p)
+		if link.(cidlink.Link).Cid == blks[1].Cid() {
+			return errors.New("not allowed")
+		}
+		return nil
+	})
+	asyncLoader.Startup()
+
+	requestID := graphsync.RequestID(rand.Int31())
+	err := asyncLoader.StartRequest(requestID, "")
+	require.NoError(t, err)
+	responses := map[graphsync.RequestID]metadata.Metadata{
+		requestID: metadata.Metadata{
+			metadata.Item{Link: blks[0].Cid(), BlockPresent: true},
+			metadata.Item{Link: blks[1].Cid(), BlockPresent: true},
+		},
+	}
+	asyncLoader.ProcessResponse(remotePeer, responses, blks)
+	assertSuccessResponse(ctx, t, asyncLoader.AsyncLoad(requestID, cidlink.Link{Cid: blks[0].Cid()}))
+	st.AssertBlockStored(t, blks[0])
+
+	var result types.AsyncLoadResult
+	testutil.AssertReceive(ctx, t, asyncLoader.AsyncLoad(requestID, cidlink.Link{Cid: blks[1].Cid()}), &result, "should send response")
+	require.Nil(t, result.Data)
+	require.EqualError(t, errors.Unwrap(result.Err), "not allowed")
+	_, stored := st.blockstore[cidlink.Link{Cid: blks[1].Cid()}]
+	require.False(t, stored)
+}
+
+type provenanceRecords []graphsync.BlockProvenance
+
+func (pr *provenanceRecords) RecordProvenance(bp graphsync.BlockProvenance) error {
+	*pr = append(*pr, bp)
+	return nil
+}
+
+func TestAsyncLoadProvenance(t *testing.T) {
+	blks := testutil.GenerateBlocksOfSize(1, 100)
+	link := cidlink.Link{Cid: blks[0].Cid()}
+	st := newStore()
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	asyncLoader := New(ctx, st.loader, st.storer)
+	var records provenanceRecords
+	asyncLoader.SetProvenanceSink(&records)
+	asyncLoader.Startup()
+
+	requestID := graphsync.RequestID(rand.Int31())
+	err := asyncLoader.StartRequest(requestID, "")
+	require.NoError(t, err)
+	responses := map[graphsync.RequestID]metadata.Metadata{
+		requestID: metadata.Metadata{
+			metadata.Item{Link: link.Cid, BlockPresent: true},
+		},
+	}
+	asyncLoader.ProcessResponse(remotePeer, responses, blks)
+	assertSuccessResponse(ctx, t, asyncLoader.AsyncLoad(requestID, link))
+	st.AssertBlockStored(t, blks[0])
+
+	// loading the stored block locally records nothing further
+	asyncLoader.CleanupRequest(requestID)
+	otherRequestID := graphsync.RequestID(rand.Int31())
+	err = asyncLoader.StartRequest(otherRequestID, "")
+	require.NoError(t, err)
+	assertSuccessResponse(ctx, t, asyncLoader.AsyncLoad(otherRequestID, link))
+
+	require.Len(t, records, 1)
+	require.Equal(t, link, records[0].Link)
+	require.Equal(t, remotePeer, records[0].Peer)
+	require.Equal(t, requestID, records[0].RequestID)
+}
+
+func TestAsyncLoaderSnapshot(t *testing.T) {
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	st := newStore()
+	localLink := st.Store(t, blks[0])
+	withLoader(st, func(ctx context.Context, asyncLoader *AsyncLoader) {
+		requestID := graphsync.RequestID(rand.Int31())
+		err := asyncLoader.StartRequest(requestID, "")
+		require.NoError(t, err)
+		assertSuccessResponse(ctx, t, asyncLoader.AsyncLoad(requestID, localLink))
+
+		responses := map[graphsync.RequestID]metadata.Metadata{
+			requestID: metadata.Metadata{
+				metadata.Item{Link: blks[1].Cid(), BlockPresent: true},
+				metadata.Item{Link: blks[2].Cid(), BlockPresent: true},
+			},
+		}
+		asyncLoader.ProcessResponse(remotePeer, responses, blks[1:2])
+		assertSuccessResponse(ctx, t, asyncLoader.AsyncLoad(requestID, cidlink.Link{Cid: blks[1].Cid()}))
+		awaited := cidlink.Link{Cid: blks[2].Cid()}
+		resultChan := asyncLoader.AsyncLoad(requestID, awaited)
+
+		require.Equal(t, []RequestSnapshot{{
+			RequestID:    requestID,
+			AwaitedLinks: []ipld.Link{awaited},
+			LocalLoads:   1,
+			NetworkLoads: 1,
+		}}, asyncLoader.Snapshot())
+
+		responses = map[graphsync.RequestID]metadata.Metadata{
+			requestID: metadata.Metadata{
+				metadata.Item{Link: blks[2].Cid(), BlockPresent: true},
+			},
+		}
+		asyncLoader.ProcessResponse(remotePeer, responses, blks[2:])
+		assertSuccessResponse(ctx, t, resultChan)
+		asyncLoader.CleanupRequest(requestID)
+		require.Empty(t, asyncLoader.Snapshot())
+	})
+}
+
+func TestAsyncLoadBatchedWrites(t *testing.T) {
+	blks := testutil.GenerateBlocksOfSize(1, 100)
+	link := cidlink.Link{Cid: blks[0].Cid()}
+	batches := make(chan []blocks.Block, 1)
+	storeBatch := func(batch []blocks.Block) error {
+		batches <- batch
+		return nil
+	}
+
+	st := newStore()
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	asyncLoader := New(ctx, st.loader, st.storer)
+	asyncLoader.SetBatchedWrites(storeBatch, 10, 0, 0)
+	asyncLoader.Startup()
+
+	requestID := graphsync.RequestID(rand.Int31())
+	responses := map[graphsync.RequestID]metadata.Metadata{
+		requestID: metadata.Metadata{
+			metadata.Item{
+				Link:         link.Cid,
+				BlockPresent: true,
+			},
+		},
+	}
+	asyncLoader.ProcessResponse(remotePeer, responses, blks)
+	assertSuccessResponse(ctx, t, asyncLoader.AsyncLoad(requestID, link))
+
+	// the block is held in the batch rather than stored, but can still be loaded
+	_, stored := st.blockstore[link]
+	require.False(t, stored)
+	otherRequestID := graphsync.RequestID(rand.Int31())
+	var result types.AsyncLoadResult
+	testutil.AssertReceive(ctx, t, asyncLoader.AsyncLoad(otherRequestID, link), &result, "should load block")
+	require.Equal(t, blks[0].RawData(), result.Data)
+	require.True(t, result.Local)
+
+	// completing the request writes the batch before it reports success
+	require.NoError(t, asyncLoader.CompleteTransaction(requestID, true))
+	var batch []blocks.Block
+	testutil.AssertReceive(ctx, t, batches, &batch, "should write batch")
+	require.Equal(t, blks, batch)
+}
+
+func TestAsyncLoadStats(t *testing.T) {
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	st := newStore()
+	localLink := st.Store(t, blks[0])
+	withLoader(st, func(ctx context.Context, asyncLoader *AsyncLoader) {
+		requestID := graphsync.RequestID(rand.Int31())
+		err := asyncLoader.StartRequest(requestID, "")
+		require.NoError(t, err)
+		assertSuccessResponse(ctx, t, asyncLoader.AsyncLoad(requestID, localLink))
+
+		networkLink := cidlink.Link{Cid: blks[1].Cid()}
+		responses := map[graphsync.RequestID]metadata.Metadata{
+			requestID: metadata.Metadata{
+				metadata.Item{Link: blks[1].Cid(), BlockPresent: true},
+				metadata.Item{Link: blks[2].Cid(), BlockPresent: true},
+			},
+		}
+		asyncLoader.ProcessResponse(remotePeer, responses, blks[1:])
+		assertSuccessResponse(ctx, t, asyncLoader.AsyncLoad(requestID, networkLink))
+
+		// the second block is still buffered until it is loaded
+		stats := asyncLoader.Stats()
+		require.Equal(t, uint64(1), stats.LocalLoads)
+		require.Equal(t, uint64(1), stats.NetworkLoads)
+		require.Equal(t, uint64(0), stats.FailedLoads)
+		require.Equal(t, uint64(100), stats.BufferedBytes)
+
+		asyncLoader.CompleteResponsesFor(requestID)
+		assertFailResponse(ctx, t, asyncLoader.AsyncLoad(requestID, testutil.NewTestLink()))
+		stats = asyncLoader.Stats()
+		require.Equal(t, uint64(1), stats.FailedLoads)
+	})
+}
+
+func TestAsyncLoadLocalPrefetch(t *testing.T) {
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	st := newStore()
+	localLink := st.Store(t, blks[0])
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	asyncLoader := New(ctx, st.loader, st.storer)
+	asyncLoader.SetLocalPrefetch(1, 1000)
+	asyncLoader.Startup()
+
+	requestID := graphsync.RequestID(rand.Int31())
+	err := asyncLoader.StartRequest(requestID, "")
+	require.NoError(t, err)
+	responses := map[graphsync.RequestID]metadata.Metadata{
+		requestID: metadata.Metadata{
+			metadata.Item{Link: blks[0].Cid(), BlockPresent: false, BlockSize: 100},
+			metadata.Item{Link: blks[1].Cid(), BlockPresent: true},
+		},
+	}
+	asyncLoader.ProcessResponse(remotePeer, responses, blks[1:])
+	require.Eventually(t, func() bool {
+		asyncLoader.prefetcher.lk.Lock()
+		defer asyncLoader.prefetcher.lk.Unlock()
+		_, ok := asyncLoader.prefetcher.blocks[localLink]
+		return ok
+	}, time.Second, 10*time.Millisecond)
+
+	// the load is served from the prefetched data without reading the store
+	delete(st.blockstore, localLink)
+	var result types.AsyncLoadResult
+	testutil.AssertReceive(ctx, t, asyncLoader.AsyncLoad(requestID, localLink), &result, "should load block")
+	require.Equal(t, blks[0].RawData(), result.Data)
+	require.True(t, result.Local)
+	st.AssertLocalLoads(t, 1)
+	assertSuccessResponse(ctx, t, asyncLoader.AsyncLoad(requestID, cidlink.Link{Cid: blks[1].Cid()}))
+}
+
+func TestAsyncLoadOrphanedBlocks(t *testing.T) {
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	st := newStore()
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	asyncLoader := New(ctx, st.loader, st.storer)
+	asyncLoader.SetOrphanTTL(50 * time.Millisecond)
+	asyncLoader.Startup()
+
+	requestID := graphsync.RequestID(rand.Int31())
+	err := asyncLoader.StartRequest(requestID, "")
+	require.NoError(t, err)
+	responses := map[graphsync.RequestID]metadata.Metadata{
+		requestID: metadata.Metadata{
+			metadata.Item{Link: blks[0].Cid(), BlockPresent: true},
+			metadata.Item{Link: blks[1].Cid(), BlockPresent: true},
+		},
+	}
+	// the third block is not expected by any request
+	asyncLoader.ProcessResponse(remotePeer, responses, blks)
+	assertSuccessResponse(ctx, t, asyncLoader.AsyncLoad(requestID, cidlink.Link{Cid: blks[0].Cid()}))
+	require.Equal(t, uint64(100), asyncLoader.OrphanedBytes()[remotePeer])
+
+	// the second block expires without being loaded
+	require.Eventually(t, func() bool {
+		return asyncLoader.OrphanedBytes()[remotePeer] == 200
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, uint64(0), asyncLoader.Stats().BufferedBytes)
+
+	// blocks for a paused request are kept until it resumes
+	pausedBlks := testutil.GenerateBlocksOfSize(1, 100)
+	asyncLoader.SetRequestPaused(requestID, true)
+	responses = map[graphsync.RequestID]metadata.Metadata{
+		requestID: metadata.Metadata{
+			metadata.Item{Link: pausedBlks[0].Cid(), BlockPresent: true},
+		},
+	}
+	asyncLoader.ProcessResponse(remotePeer, responses, pausedBlks)
+	time.Sleep(150 * time.Millisecond)
+	require.Equal(t, uint64(200), asyncLoader.OrphanedBytes()[remotePeer])
+	asyncLoader.SetRequestPaused(requestID, false)
+	assertSuccessResponse(ctx, t, asyncLoader.AsyncLoad(requestID, cidlink.Link{Cid: pausedBlks[0].Cid()}))
+}
+
+func TestAsyncLoadTransactionalPersistence(t *testing.T) {
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	st := newStore()
+	transactionStore := newStore()
+	withLoader(st, func(ctx context.Context, asyncLoader *AsyncLoader) {
+		err := asyncLoader.RegisterTransactionalPersistenceOption("transactional", storeutil.StagedTransactions(transactionStore.loader, transactionStore.storer))
+		require.NoError(t, err)
+
+		load := func(blk blocks.Block) graphsync.RequestID {
+			requestID := graphsync.RequestID(rand.Int31())
+			err := asyncLoader.StartRequest(requestID, "transactional")
+			require.NoError(t, err)
+			link := cidlink.Link{Cid: blk.Cid()}
+			responses := map[graphsync.RequestID]metadata.Metadata{
+				requestID: metadata.Metadata{
+					metadata.Item{Link: blk.Cid(), BlockPresent: true},
+				},
+			}
+			asyncLoader.ProcessResponse(remotePeer, responses, []blocks.Block{blk})
+			assertSuccessResponse(ctx, t, asyncLoader.AsyncLoad(requestID, link))
+			return requestID
+		}
+
+		committed := load(blks[0])
+		rolledBack := load(blks[1])
+		require.Empty(t, transactionStore.blockstore)
+
+		require.NoError(t, asyncLoader.CompleteTransaction(committed, true))
+		require.NoError(t, asyncLoader.CompleteTransaction(rolledBack, false))
+		transactionStore.AssertBlockStored(t, blks[0])
+		_, stored := transactionStore.blockstore[cidlink.Link{Cid: blks[1].Cid()}]
+		require.False(t, stored)
+		require.Empty(t, st.blockstore)
+
+		// transactional options cannot be fallbacks, as they have no store outside a request
+		err = asyncLoader.SetStoreWriteFailurePolicy(rolledBack, graphsync.StoreWriteFallback, "transactional")
+		require.Error(t, err)
+	})
+}
+
+func TestListPersistenceOptions(t *testing.T) {
+	blks := testutil.GenerateBlocksOfSize(1, 100)
+	st := newStore()
+	otherStore := newStore()
+	withLoader(st, func(ctx context.Context, asyncLoader *AsyncLoader) {
+		require.Empty(t, asyncLoader.ListPersistenceOptions())
+		err := asyncLoader.RegisterPersistenceOption("other", otherStore.loader, otherStore.storer)
+		require.NoError(t, err)
+		err = asyncLoader.RegisterTransactionalPersistenceOption("another", storeutil.StagedTransactions(otherStore.loader, otherStore.storer))
+		require.NoError(t, err)
+
+		requestID := graphsync.RequestID(rand.Int31())
+		err = asyncLoader.StartRequest(requestID, "other")
+		require.NoError(t, err)
+		responses := map[graphsync.RequestID]metadata.Metadata{
+			requestID: metadata.Metadata{
+				metadata.Item{Link: blks[0].Cid(), BlockPresent: true},
+			},
+		}
+		asyncLoader.ProcessResponse(remotePeer, responses, blks)
+		assertSuccessResponse(ctx, t, asyncLoader.AsyncLoad(requestID, cidlink.Link{Cid: blks[0].Cid()}))
+
+		require.Equal(t, []graphsync.PersistenceOptionUsage{
+			{Name: "another", Transactional: true},
+			{Name: "other", ActiveRequests: 1, BytesWritten: 100},
+		}, asyncLoader.ListPersistenceOptions())
+
+		asyncLoader.CleanupRequest(requestID)
+		require.Equal(t, []graphsync.PersistenceOptionUsage{
+			{Name: "another", Transactional: true},
+			{Name: "other", BytesWritten: 100},
+		}, asyncLoader.ListPersistenceOptions())
+	})
+}
+
+func TestPersistenceOptionQuota(t *testing.T) {
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	st := newStore()
+	otherStore := newStore()
+	withLoader(st, func(ctx context.Context, asyncLoader *AsyncLoader) {
+		err := asyncLoader.SetPersistenceOptionQuota("other", 150)
+		require.EqualError(t, err, "Unknown persistence option")
+		err = asyncLoader.RegisterPersistenceOption("other", otherStore.loader, otherStore.storer)
+		require.NoError(t, err)
+		err = asyncLoader.SetPersistenceOptionQuota("other", 150)
+		require.NoError(t, err)
+
+		requestID := graphsync.RequestID(rand.Int31())
+		err = asyncLoader.StartRequest(requestID, "other")
+		require.NoError(t, err)
+		responses := map[graphsync.RequestID]metadata.Metadata{
+			requestID: metadata.Metadata{
+				metadata.Item{Link: blks[0].Cid(), BlockPresent: true},
+				metadata.Item{Link: blks[1].Cid(), BlockPresent: true},
+			},
+		}
+		asyncLoader.ProcessResponse(remotePeer, responses, blks)
+		assertSuccessResponse(ctx, t, asyncLoader.AsyncLoad(requestID, cidlink.Link{Cid: blks[0].Cid()}))
+
+		// the second block would take the option over its quota
+		var result types.AsyncLoadResult
+		testutil.AssertReceive(ctx, t, asyncLoader.AsyncLoad(requestID, cidlink.Link{Cid: blks[1].Cid()}), &result, "should fail load")
+		var storeFull graphsync.StoreFullErr
+		require.True(t, errors.As(result.Err, &storeFull))
+		require.Equal(t, graphsync.StoreFullErr{PersistenceOption: "other", Quota: 150}, storeFull)
+		otherStore.AssertBlockStored(t, blks[0])
+		_, stored := otherStore.blockstore[cidlink.Link{Cid: blks[1].Cid()}]
+		require.False(t, stored)
+
+		require.Equal(t, []graphsync.PersistenceOptionUsage{
+			{Name: "other", ActiveRequests: 1, BytesWritten: 100, Quota: 150},
+		}, asyncLoader.ListPersistenceOptions())
+	})
+}
+
 func TestAsyncLoadInitialLoadFails(t *testing.T) {
 	st := newStore()
 	withLoader(st, func(ctx context.Context, asyncLoader *AsyncLoader) {
@@ -69,7 +585,7 @@ func TestAsyncLoadInitialLoadFails(t *testing.T) {
 				},
 			},
 		}
-		asyncLoader.ProcessResponse(responses, nil)
+		asyncLoader.ProcessResponse(remotePeer, responses, nil)
 
 		resultChan := asyncLoader.AsyncLoad(requestID, link)
 		assertFailResponse(ctx, t, resultChan)
@@ -111,7 +627,7 @@ func TestAsyncLoadInitialLoadIndeterminateThenSucceeds(t *testing.T) {
 				},
 			},
 		}
-		asyncLoader.ProcessResponse(responses, blocks)
+		asyncLoader.ProcessResponse(remotePeer, responses, blocks)
 		assertSuccessResponse(ctx, t, resultChan)
 		st.AssertLocalLoads(t, 1)
 		st.AssertBlockStored(t, block)
@@ -138,7 +654,7 @@ func TestAsyncLoadInitialLoadIndeterminateThenFails(t *testing.T) {
 				},
 			},
 		}
-		asyncLoader.ProcessResponse(responses, nil)
+		asyncLoader.ProcessResponse(remotePeer, responses, nil)
 		assertFailResponse(ctx, t, resultChan)
 		st.AssertLocalLoads(t, 1)
 	})
@@ -174,7 +690,7 @@ func TestAsyncLoadTwiceLoadsLocallySecondTime(t *testing.T) {
 				},
 			},
 		}
-		asyncLoader.ProcessResponse(responses, blocks)
+		asyncLoader.ProcessResponse(remotePeer, responses, blocks)
 		resultChan := asyncLoader.AsyncLoad(requestID, link)
 
 		assertSuccessResponse(ctx, t, resultChan)
@@ -270,7 +786,7 @@ func TestRequestSplittingSameBlockTwoStores(t *testing.T) {
 				},
 			},
 		}
-		asyncLoader.ProcessResponse(responses, blocks)
+		asyncLoader.ProcessResponse(remotePeer, responses, blocks)
 
 		assertSuccessResponse(ctx, t, resultChan1)
 		assertSuccessResponse(ctx, t, resultChan2)
@@ -279,6 +795,84 @@ func TestRequestSplittingSameBlockTwoStores(t *testing.T) {
 	})
 }
 
+func TestRequestSplittingReadsAndWrites(t *testing.T) {
+	st := newStore()
+	cacheSt := newStore()
+	stagingSt := newStore()
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	cachedLink := cacheSt.Store(t, blks[0])
+	receivedLink := cidlink.Link{Cid: blks[1].Cid()}
+	withLoader(st, func(ctx context.Context, asyncLoader *AsyncLoader) {
+		err := asyncLoader.RegisterPersistenceOption("cache", cacheSt.loader, cacheSt.storer)
+		require.NoError(t, err)
+		err = asyncLoader.RegisterPersistenceOption("staging", stagingSt.loader, stagingSt.storer)
+		require.NoError(t, err)
+		requestID := graphsync.RequestID(rand.Int31())
+		err = asyncLoader.StartRequest(requestID, "cache")
+		require.NoError(t, err)
+		err = asyncLoader.SetWritePersistenceOption(requestID, "staging")
+		require.NoError(t, err)
+
+		assertSuccessResponse(ctx, t, asyncLoader.AsyncLoad(requestID, cachedLink))
+		responses := map[graphsync.RequestID]metadata.Metadata{
+			requestID: metadata.Metadata{
+				metadata.Item{Link: receivedLink.Cid, BlockPresent: true},
+			},
+		}
+		asyncLoader.ProcessResponse(remotePeer, responses, blks[1:])
+		assertSuccessResponse(ctx, t, asyncLoader.AsyncLoad(requestID, receivedLink))
+		stagingSt.AssertBlockStored(t, blks[1])
+		_, stored := cacheSt.blockstore[receivedLink]
+		require.False(t, stored)
+		st.AssertLocalLoads(t, 0)
+
+		err = asyncLoader.UnregisterPersistenceOption("staging")
+		require.EqualError(t, err, "cannot unregister while requests are in progress")
+		asyncLoader.CleanupRequest(requestID)
+		err = asyncLoader.UnregisterPersistenceOption("staging")
+		require.NoError(t, err)
+	})
+}
+
+func TestSetDefaultStore(t *testing.T) {
+	st := newStore()
+	newSt := newStore()
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	withLoader(st, func(ctx context.Context, asyncLoader *AsyncLoader) {
+		oldRequestID := graphsync.RequestID(rand.Int31())
+		err := asyncLoader.StartRequest(oldRequestID, "")
+		require.NoError(t, err)
+
+		err = asyncLoader.SetDefaultStore(newSt.loader, newSt.storer)
+		require.NoError(t, err)
+		newRequestID := graphsync.RequestID(rand.Int31())
+		err = asyncLoader.StartRequest(newRequestID, "")
+		require.NoError(t, err)
+
+		responses := map[graphsync.RequestID]metadata.Metadata{
+			oldRequestID: metadata.Metadata{
+				metadata.Item{Link: blks[0].Cid(), BlockPresent: true},
+			},
+			newRequestID: metadata.Metadata{
+				metadata.Item{Link: blks[1].Cid(), BlockPresent: true},
+			},
+		}
+		asyncLoader.ProcessResponse(remotePeer, responses, blks)
+		assertSuccessResponse(ctx, t, asyncLoader.AsyncLoad(oldRequestID, cidlink.Link{Cid: blks[0].Cid()}))
+		assertSuccessResponse(ctx, t, asyncLoader.AsyncLoad(newRequestID, cidlink.Link{Cid: blks[1].Cid()}))
+
+		// the request in progress finishes with the old store
+		st.AssertBlockStored(t, blks[0])
+		newSt.AssertBlockStored(t, blks[1])
+		_, stored := st.blockstore[cidlink.Link{Cid: blks[1].Cid()}]
+		require.False(t, stored)
+		_, stored = newSt.blockstore[cidlink.Link{Cid: blks[0].Cid()}]
+		require.False(t, stored)
+		asyncLoader.CleanupRequest(oldRequestID)
+		asyncLoader.CleanupRequest(newRequestID)
+	})
+}
+
 func TestRequestSplittingSameBlockOnlyOneResponse(t *testing.T) {
 	st := newStore()
 	otherSt := newStore()
@@ -304,7 +898,7 @@ func TestRequestSplittingSameBlockOnlyOneResponse(t *testing.T) {
 				},
 			},
 		}
-		asyncLoader.ProcessResponse(responses, blocks)
+		asyncLoader.ProcessResponse(remotePeer, responses, blocks)
 		asyncLoader.CompleteResponsesFor(requestID1)
 
 		assertFailResponse(ctx, t, resultChan1)
@@ -313,6 +907,108 @@ func TestRequestSplittingSameBlockOnlyOneResponse(t *testing.T) {
 	})
 }
 
+func TestAsyncLoadStoreWriteFailurePolicies(t *testing.T) {
+	testCases := map[string]struct {
+		policy          graphsync.StoreWriteFailurePolicy
+		fallback        string
+		expectedErr     error
+		storedFallback  bool
+		retrySucceeds   bool
+		failingFallback bool
+	}{
+		"fail request": {
+			policy:      graphsync.StoreWriteFailRequest,
+			expectedErr: graphsync.RequestFailedStoreWriteErr{},
+		},
+		"pause request": {
+			policy:        graphsync.StoreWritePauseRequest,
+			expectedErr:   graphsync.RequestPausedStoreWriteErr{},
+			retrySucceeds: true,
+		},
+		"fall back to alternate store": {
+			policy:         graphsync.StoreWriteFallback,
+			fallback:       "other",
+			storedFallback: true,
+		},
+		"fall back to alternate store that also fails": {
+			policy:          graphsync.StoreWriteFallback,
+			fallback:        "other",
+			failingFallback: true,
+			expectedErr:     graphsync.RequestFailedStoreWriteErr{},
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			blocks := testutil.GenerateBlocksOfSize(1, 100)
+			block := blocks[0]
+			link := cidlink.Link{Cid: block.Cid()}
+			st := newStore()
+			storeFull := true
+			st.storer = failingStorer(st.storer, &storeFull)
+			withLoader(st, func(ctx context.Context, asyncLoader *AsyncLoader) {
+				otherSt := newStore()
+				if data.failingFallback {
+					otherSt.storer = failingStorer(otherSt.storer, &storeFull)
+				}
+				err := asyncLoader.RegisterPersistenceOption("other", otherSt.loader, otherSt.storer)
+				require.NoError(t, err)
+				requestID := graphsync.RequestID(rand.Int31())
+				err = asyncLoader.StartRequest(requestID, "")
+				require.NoError(t, err)
+				err = asyncLoader.SetStoreWriteFailurePolicy(requestID, data.policy, data.fallback)
+				require.NoError(t, err)
+				responses := map[graphsync.RequestID]metadata.Metadata{
+					requestID: metadata.Metadata{
+						metadata.Item{
+							Link:         link.Cid,
+							BlockPresent: true,
+						},
+					},
+				}
+				asyncLoader.ProcessResponse(remotePeer, responses, blocks)
+
+				resultChan := asyncLoader.AsyncLoad(requestID, link)
+				if data.expectedErr != nil {
+					var result types.AsyncLoadResult
+					testutil.AssertReceive(ctx, t, resultChan, &result, "should close response channel with response")
+					require.IsType(t, data.expectedErr, result.Err)
+				} else {
+					assertSuccessResponse(ctx, t, resultChan)
+				}
+				if data.storedFallback {
+					otherSt.AssertBlockStored(t, block)
+				}
+				if data.retrySucceeds {
+					storeFull = false
+					resultChan = asyncLoader.AsyncLoad(requestID, link)
+					assertSuccessResponse(ctx, t, resultChan)
+					st.AssertBlockStored(t, block)
+				}
+			})
+		})
+	}
+}
+
+func TestAsyncLoadFallbackMustBeRegistered(t *testing.T) {
+	st := newStore()
+	withLoader(st, func(ctx context.Context, asyncLoader *AsyncLoader) {
+		requestID := graphsync.RequestID(rand.Int31())
+		err := asyncLoader.StartRequest(requestID, "")
+		require.NoError(t, err)
+		err = asyncLoader.SetStoreWriteFailurePolicy(requestID, graphsync.StoreWriteFallback, "other")
+		require.Error(t, err)
+	})
+}
+
+func failingStorer(storer ipld.Storer, fail *bool) ipld.Storer {
+	return func(lnkCtx ipld.LinkContext) (io.Writer, ipld.StoreCommitter, error) {
+		if *fail {
+			return nil, nil, errors.New("disk full")
+		}
+		return storer(lnkCtx)
+	}
+}
+
 type store struct {
 	internalLoader ipld.Loader
 	storer         ipld.Storer
@@ -321,6 +1017,8 @@ type store struct {
 	called         chan struct{}
 }
 
+var remotePeer = testutil.GeneratePeers(1)[0]
+
 func newStore() *store {
 	blockstore := make(map[ipld.Link][]byte)
 	loader, storer := testutil.NewTestStore(blockstore)
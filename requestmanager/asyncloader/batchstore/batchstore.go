@@ -0,0 +1,168 @@
+package batchstore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log"
+
+	"github.com/ipfs/go-graphsync"
+)
+
+var log = logging.Logger("graphsync")
+
+// maxPendingBytes is the most block data held waiting to be written. It is
+// only reached when writes keep failing, and blocks past it are refused
+const maxPendingBytes = 256 << 20
+
+// StoreBatch writes several blocks to permanent storage at once, such as in a
+// single datastore transaction
+type StoreBatch func([]blocks.Block) error
+
+// BatchStore accumulates verified blocks and writes them in batches once
+// enough blocks or bytes are pending, or when flushed. Blocks waiting to be
+// written can still be read from the batch store. Requests that load pending
+// blocks claim them, and learn whether they were written when they finish
+type BatchStore struct {
+	storeBatch      StoreBatch
+	maxBlocks       int
+	maxBytes        uint64
+	maxPendingBytes uint64
+
+	lk           sync.Mutex
+	pending      []blocks.Block
+	pendingBytes uint64
+	index        map[cid.Cid]blocks.Block
+	owners       map[graphsync.RequestID]struct{}
+}
+
+// New returns a batch store that writes with the given function once maxBlocks
+// blocks or maxBytes bytes are pending. A limit of zero is ignored
+func New(storeBatch StoreBatch, maxBlocks int, maxBytes uint64) *BatchStore {
+	return &BatchStore{
+		storeBatch:      storeBatch,
+		maxBlocks:       maxBlocks,
+		maxBytes:        maxBytes,
+		maxPendingBytes: maxPendingBytes,
+		index:           make(map[cid.Cid]blocks.Block),
+		owners:          make(map[graphsync.RequestID]struct{}),
+	}
+}
+
+// Put adds a block to the pending batch, writing the batch if it is full. If
+// the write fails, the blocks stay pending to be retried with the next write.
+// Put only errors if the block can't be held because too much data is
+// already waiting on failed writes
+func (bs *BatchStore) Put(blk blocks.Block) error {
+	bs.lk.Lock()
+	defer bs.lk.Unlock()
+	if _, ok := bs.index[blk.Cid()]; !ok {
+		size := uint64(len(blk.RawData()))
+		if bs.pendingBytes+size > bs.maxPendingBytes {
+			if err := bs.flushLocked(); err != nil {
+				return fmt.Errorf("%d bytes are waiting to be written: %w", bs.pendingBytes, err)
+			}
+		}
+		bs.pending = append(bs.pending, blk)
+		bs.pendingBytes += size
+		bs.index[blk.Cid()] = blk
+	}
+	if (bs.maxBlocks > 0 && len(bs.pending) >= bs.maxBlocks) ||
+		(bs.maxBytes > 0 && bs.pendingBytes >= bs.maxBytes) {
+		if err := bs.flushLocked(); err != nil {
+			log.Warnf("unable to write batched blocks, will retry: %s", err)
+		}
+	}
+	return nil
+}
+
+// Claim records that the given request loaded a block, if the block is still
+// waiting to be written
+func (bs *BatchStore) Claim(requestID graphsync.RequestID, c cid.Cid) {
+	bs.lk.Lock()
+	defer bs.lk.Unlock()
+	if _, ok := bs.index[c]; ok {
+		bs.owners[requestID] = struct{}{}
+	}
+}
+
+// FinishRequest writes any pending blocks the given request claimed, and
+// returns the error if they could not be written
+func (bs *BatchStore) FinishRequest(requestID graphsync.RequestID) error {
+	bs.lk.Lock()
+	defer bs.lk.Unlock()
+	if _, ok := bs.owners[requestID]; !ok {
+		return nil
+	}
+	delete(bs.owners, requestID)
+	return bs.flushLocked()
+}
+
+// ReleaseRequest forgets the blocks the given request claimed, without
+// writing them
+func (bs *BatchStore) ReleaseRequest(requestID graphsync.RequestID) {
+	bs.lk.Lock()
+	defer bs.lk.Unlock()
+	delete(bs.owners, requestID)
+}
+
+// Get returns the data for a block waiting to be written
+func (bs *BatchStore) Get(c cid.Cid) ([]byte, bool) {
+	bs.lk.Lock()
+	defer bs.lk.Unlock()
+	blk, ok := bs.index[c]
+	if !ok {
+		return nil, false
+	}
+	return blk.RawData(), true
+}
+
+// Flush writes any pending blocks
+func (bs *BatchStore) Flush() error {
+	bs.lk.Lock()
+	defer bs.lk.Unlock()
+	return bs.flushLocked()
+}
+
+func (bs *BatchStore) flushLocked() error {
+	if len(bs.pending) == 0 {
+		return nil
+	}
+	if err := bs.storeBatch(bs.pending); err != nil {
+		return err
+	}
+	bs.pending = nil
+	bs.pendingBytes = 0
+	bs.index = make(map[cid.Cid]blocks.Block)
+	bs.owners = make(map[graphsync.RequestID]struct{})
+	return nil
+}
+
+// Run flushes pending blocks every interval until the context is cancelled,
+// then flushes a final time. If interval is zero, blocks are only flushed when
+// the context is cancelled
+func (bs *BatchStore) Run(ctx context.Context, interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			if err := bs.Flush(); err != nil {
+				log.Errorf("unable to write batched blocks on shutdown: %s", err)
+			}
+			return
+		case <-tick:
+			if err := bs.Flush(); err != nil {
+				log.Warnf("unable to write batched blocks, will retry: %s", err)
+			}
+		}
+	}
+}
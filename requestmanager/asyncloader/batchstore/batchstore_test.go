@@ -0,0 +1,147 @@
+package batchstore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestBatchThresholds(t *testing.T) {
+	var batches [][]blocks.Block
+	storeBatch := func(blks []blocks.Block) error {
+		batches = append(batches, blks)
+		return nil
+	}
+	blks := testutil.GenerateBlocksOfSize(5, 100)
+
+	bs := New(storeBatch, 3, 0)
+	for _, blk := range blks[:2] {
+		require.NoError(t, bs.Put(blk))
+	}
+	require.Empty(t, batches)
+	data, ok := bs.Get(blks[0].Cid())
+	require.True(t, ok)
+	require.Equal(t, blks[0].RawData(), data)
+
+	// adding the same block twice does not grow the batch
+	require.NoError(t, bs.Put(blks[1]))
+	require.Empty(t, batches)
+
+	require.NoError(t, bs.Put(blks[2]))
+	require.Equal(t, [][]blocks.Block{blks[:3]}, batches)
+	_, ok = bs.Get(blks[0].Cid())
+	require.False(t, ok)
+
+	batches = nil
+	bs = New(storeBatch, 0, 250)
+	for _, blk := range blks {
+		require.NoError(t, bs.Put(blk))
+	}
+	require.Equal(t, [][]blocks.Block{blks[:3]}, batches)
+	require.NoError(t, bs.Flush())
+	require.Equal(t, [][]blocks.Block{blks[:3], blks[3:]}, batches)
+}
+
+func TestFailedBatchesRetried(t *testing.T) {
+	fail := true
+	var written []blocks.Block
+	storeBatch := func(blks []blocks.Block) error {
+		if fail {
+			return errors.New("something went wrong")
+		}
+		written = append(written, blks...)
+		return nil
+	}
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+
+	bs := New(storeBatch, 1, 0)
+	require.NoError(t, bs.Put(blks[0]))
+	// blocks from the failed batch stay readable and are written with the next one
+	_, ok := bs.Get(blks[0].Cid())
+	require.True(t, ok)
+	fail = false
+	require.NoError(t, bs.Put(blks[1]))
+	require.Equal(t, blks, written)
+}
+
+func TestFinishRequest(t *testing.T) {
+	fail := true
+	var written []blocks.Block
+	storeBatch := func(blks []blocks.Block) error {
+		if fail {
+			return errors.New("something went wrong")
+		}
+		written = append(written, blks...)
+		return nil
+	}
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	requestID1 := graphsync.RequestID(1)
+	requestID2 := graphsync.RequestID(2)
+	requestID3 := graphsync.RequestID(3)
+
+	bs := New(storeBatch, 0, 0)
+	require.NoError(t, bs.Put(blks[0]))
+	require.NoError(t, bs.Put(blks[1]))
+	bs.Claim(requestID1, blks[0].Cid())
+	bs.Claim(requestID2, blks[1].Cid())
+
+	// every request with blocks in a failed batch learns of the failure
+	require.Error(t, bs.FinishRequest(requestID1))
+	require.Error(t, bs.FinishRequest(requestID2))
+	// requests without blocks in the batch don't
+	require.NoError(t, bs.FinishRequest(requestID3))
+	require.Empty(t, written)
+
+	bs.Claim(requestID1, blks[0].Cid())
+	fail = false
+	require.NoError(t, bs.FinishRequest(requestID1))
+	require.Equal(t, blks, written)
+
+	// written blocks are no longer pending, so they can't be claimed
+	bs.Claim(requestID2, blks[0].Cid())
+	fail = true
+	require.NoError(t, bs.FinishRequest(requestID2))
+}
+
+func TestPendingBytesBounded(t *testing.T) {
+	storeBatch := func(blks []blocks.Block) error {
+		return errors.New("something went wrong")
+	}
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+
+	bs := New(storeBatch, 1, 0)
+	bs.maxPendingBytes = 200
+	require.NoError(t, bs.Put(blks[0]))
+	require.NoError(t, bs.Put(blks[1]))
+	require.Error(t, bs.Put(blks[2]))
+	_, ok := bs.Get(blks[2].Cid())
+	require.False(t, ok)
+}
+
+func TestFlushOnShutdown(t *testing.T) {
+	written := make(chan []blocks.Block, 1)
+	storeBatch := func(blks []blocks.Block) error {
+		written <- blks
+		return nil
+	}
+	blks := testutil.GenerateBlocksOfSize(1, 100)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	bs := New(storeBatch, 0, 0)
+	go bs.Run(ctx, time.Hour)
+	require.NoError(t, bs.Put(blks[0]))
+	cancel()
+
+	timeoutCtx, timeoutCancel := context.WithTimeout(context.Background(), time.Second)
+	defer timeoutCancel()
+	var batch []blocks.Block
+	testutil.AssertReceive(timeoutCtx, t, written, &batch, "batch not written on shutdown")
+	require.Equal(t, blks, batch)
+}
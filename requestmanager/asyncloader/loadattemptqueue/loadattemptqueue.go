@@ -2,6 +2,7 @@ package loadattemptqueue
 
 import (
 	"errors"
+	"time"
 
 	"github.com/ipld/go-ipld-prime"
 
@@ -15,6 +16,7 @@ type LoadRequest struct {
 	requestID  graphsync.RequestID
 	link       ipld.Link
 	resultChan chan types.AsyncLoadResult
+	started    time.Time
 }
 
 // NewLoadRequest returns a new LoadRequest for the given request id, link,
@@ -22,17 +24,22 @@ type LoadRequest struct {
 func NewLoadRequest(requestID graphsync.RequestID,
 	link ipld.Link,
 	resultChan chan types.AsyncLoadResult) LoadRequest {
-	return LoadRequest{requestID, link, resultChan}
+	return LoadRequest{requestID, link, resultChan, time.Now()}
 }
 
 // LoadAttempter attempts to load a link to an array of bytes
 // and returns an async load result
 type LoadAttempter func(graphsync.RequestID, ipld.Link) types.AsyncLoadResult
 
+// ResultObserver is called with each result sent for a load request, the
+// request it was for, and how long after the load was requested it was sent
+type ResultObserver func(requestID graphsync.RequestID, result types.AsyncLoadResult, wait time.Duration)
+
 // LoadAttemptQueue attempts to load using the load attempter, and then can
 // place requests on a retry queue
 type LoadAttemptQueue struct {
 	loadAttempter  LoadAttempter
+	observer       ResultObserver
 	pausedRequests []LoadRequest
 }
 
@@ -43,17 +50,21 @@ func New(loadAttempter LoadAttempter) *LoadAttemptQueue {
 	}
 }
 
+// ObserveResults calls the given observer with each result sent
+func (laq *LoadAttemptQueue) ObserveResults(observer ResultObserver) {
+	laq.observer = observer
+}
+
 // AttemptLoad attempts to loads the given load request, and if retry is true
 // it saves the loadrequest for retrying later
 func (laq *LoadAttemptQueue) AttemptLoad(lr LoadRequest, retry bool) {
 	response := laq.loadAttempter(lr.requestID, lr.link)
 	if response.Err != nil || response.Data != nil {
-		lr.resultChan <- response
-		close(lr.resultChan)
+		laq.sendResult(lr, response)
 		return
 	}
 	if !retry {
-		laq.terminateWithError("No active request", lr.resultChan)
+		laq.terminateWithError("No active request", lr)
 		return
 	}
 	laq.pausedRequests = append(laq.pausedRequests, lr)
@@ -66,13 +77,24 @@ func (laq *LoadAttemptQueue) ClearRequest(requestID graphsync.RequestID) {
 	laq.pausedRequests = nil
 	for _, lr := range pausedRequests {
 		if lr.requestID == requestID {
-			laq.terminateWithError("No active request", lr.resultChan)
+			laq.terminateWithError("No active request", lr)
 		} else {
 			laq.pausedRequests = append(laq.pausedRequests, lr)
 		}
 	}
 }
 
+// PausedLinks returns the links the given request is waiting to load
+func (laq *LoadAttemptQueue) PausedLinks(requestID graphsync.RequestID) []ipld.Link {
+	var links []ipld.Link
+	for _, lr := range laq.pausedRequests {
+		if lr.requestID == requestID {
+			links = append(links, lr.link)
+		}
+	}
+	return links
+}
+
 // RetryLoads attempts loads on all saved load requests that were loaded with
 // retry = true
 func (laq *LoadAttemptQueue) RetryLoads() {
@@ -84,7 +106,14 @@ func (laq *LoadAttemptQueue) RetryLoads() {
 	}
 }
 
-func (laq *LoadAttemptQueue) terminateWithError(errMsg string, resultChan chan<- types.AsyncLoadResult) {
-	resultChan <- types.AsyncLoadResult{Data: nil, Err: errors.New(errMsg)}
-	close(resultChan)
+func (laq *LoadAttemptQueue) terminateWithError(errMsg string, lr LoadRequest) {
+	laq.sendResult(lr, types.AsyncLoadResult{Data: nil, Err: errors.New(errMsg)})
+}
+
+func (laq *LoadAttemptQueue) sendResult(lr LoadRequest, result types.AsyncLoadResult) {
+	if laq.observer != nil {
+		laq.observer(lr.requestID, result, time.Since(lr.started))
+	}
+	lr.resultChan <- result
+	close(lr.resultChan)
 }
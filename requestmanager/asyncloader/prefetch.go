@@ -0,0 +1,115 @@
+package asyncloader
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/ipld/go-ipld-prime"
+
+	"github.com/ipfs/go-graphsync"
+)
+
+// prefetcher reads links announced in response metadata from local storage
+// ahead of the traversal, so a load for a block the responder did not send
+// resolves without waiting on the store
+type prefetcher struct {
+	loader   ipld.Loader
+	workers  chan struct{}
+	maxBytes uint64
+
+	lk        sync.Mutex
+	blocks    map[ipld.Link][]byte
+	pending   map[ipld.Link]struct{}
+	byRequest map[graphsync.RequestID][]ipld.Link
+	bytes     uint64
+}
+
+func newPrefetcher(loader ipld.Loader, workers int, maxBytes uint64) *prefetcher {
+	return &prefetcher{
+		loader:    loader,
+		workers:   make(chan struct{}, workers),
+		maxBytes:  maxBytes,
+		blocks:    make(map[ipld.Link][]byte),
+		pending:   make(map[ipld.Link]struct{}),
+		byRequest: make(map[graphsync.RequestID][]ipld.Link),
+	}
+}
+
+// prefetch starts reading the given link from local storage if a worker is
+// free. size, if known, is used to allocate the read buffer up front
+func (p *prefetcher) prefetch(requestID graphsync.RequestID, link ipld.Link, size uint64) {
+	p.lk.Lock()
+	_, prefetched := p.blocks[link]
+	_, pending := p.pending[link]
+	if prefetched || pending || (size > 0 && p.bytes+size > p.maxBytes) {
+		p.lk.Unlock()
+		return
+	}
+	select {
+	case p.workers <- struct{}{}:
+	default:
+		p.lk.Unlock()
+		return
+	}
+	p.pending[link] = struct{}{}
+	p.byRequest[requestID] = append(p.byRequest[requestID], link)
+	p.lk.Unlock()
+
+	go func() {
+		defer func() { <-p.workers }()
+		data := p.read(link, size)
+		p.lk.Lock()
+		defer p.lk.Unlock()
+		if _, ok := p.pending[link]; !ok {
+			// the request finished while the read was in progress
+			return
+		}
+		delete(p.pending, link)
+		if data == nil || p.bytes+uint64(len(data)) > p.maxBytes {
+			return
+		}
+		p.blocks[link] = data
+		p.bytes += uint64(len(data))
+	}()
+}
+
+func (p *prefetcher) read(link ipld.Link, size uint64) []byte {
+	stream, err := p.loader(link, ipld.LinkContext{})
+	if err != nil || stream == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.Grow(int(size))
+	if _, err := buf.ReadFrom(stream); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// take removes and returns prefetched data for the given link
+func (p *prefetcher) take(link ipld.Link) ([]byte, bool) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	data, ok := p.blocks[link]
+	if !ok {
+		return nil, false
+	}
+	delete(p.blocks, link)
+	p.bytes -= uint64(len(data))
+	return data, true
+}
+
+// finishRequest drops data prefetched for the given request that was never
+// loaded
+func (p *prefetcher) finishRequest(requestID graphsync.RequestID) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	for _, link := range p.byRequest[requestID] {
+		delete(p.pending, link)
+		if data, ok := p.blocks[link]; ok {
+			delete(p.blocks, link)
+			p.bytes -= uint64(len(data))
+		}
+	}
+	delete(p.byRequest, requestID)
+}
@@ -3,11 +3,13 @@ package responsecache
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	blocks "github.com/ipfs/go-block-format"
 	logging "github.com/ipfs/go-log"
 	"github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync"
 	"github.com/ipfs/go-graphsync/linktracker"
@@ -21,10 +23,61 @@ var log = logging.Logger("graphsync")
 type UnverifiedBlockStore interface {
 	PruneBlocks(func(ipld.Link) bool)
 	PruneBlock(ipld.Link)
-	VerifyBlock(ipld.Link) ([]byte, error)
+	VerifyBlockWith(ipld.Link, func([]byte) error) ([]byte, error)
 	AddUnverifiedBlock(ipld.Link, []byte)
 }
 
+// OrphanCounter totals the size of blocks that were dropped without ever
+// being verified, by the peer that sent them. It may be shared between caches
+type OrphanCounter struct {
+	lk    sync.Mutex
+	bytes map[peer.ID]uint64
+}
+
+// NewOrphanCounter returns a new, empty OrphanCounter
+func NewOrphanCounter() *OrphanCounter {
+	return &OrphanCounter{bytes: make(map[peer.ID]uint64)}
+}
+
+// Add records size bytes of orphaned blocks from the given peer
+func (oc *OrphanCounter) Add(p peer.ID, size uint64) {
+	oc.lk.Lock()
+	oc.bytes[p] += size
+	oc.lk.Unlock()
+}
+
+// Bytes returns the total size of orphaned blocks from each peer
+func (oc *OrphanCounter) Bytes() map[peer.ID]uint64 {
+	oc.lk.Lock()
+	defer oc.lk.Unlock()
+	bytes := make(map[peer.ID]uint64, len(oc.bytes))
+	for p, size := range oc.bytes {
+		bytes[p] = size
+	}
+	return bytes
+}
+
+type receivedBlock struct {
+	p        peer.ID
+	size     uint64
+	received time.Time
+}
+
+// BlockInspector inspects a verified block from the given peer before it is
+// written to the store for the given request, rejecting it with an error
+type BlockInspector func(p peer.ID, requestID graphsync.RequestID, link ipld.Link, data []byte) error
+
+// BlockRecorder is called with the peer and request each block written to the
+// store was received from and verified for
+type BlockRecorder func(p peer.ID, requestID graphsync.RequestID, link ipld.Link)
+
+// sharedBlock is a block verified and written for one request that other
+// requests in progress also expect
+type sharedBlock struct {
+	data     []byte
+	loadedBy map[graphsync.RequestID]struct{}
+}
+
 // ResponseCache maintains a store of unverified blocks and response
 // data about links for loading, and prunes blocks as needed.
 type ResponseCache struct {
@@ -32,6 +85,11 @@ type ResponseCache struct {
 
 	linkTracker          *linktracker.LinkTracker
 	unverifiedBlockStore UnverifiedBlockStore
+	received             map[ipld.Link]receivedBlock
+	shared               map[ipld.Link]*sharedBlock
+	orphans              *OrphanCounter
+	inspect              BlockInspector
+	record               BlockRecorder
 }
 
 // New initializes a new ResponseCache using the given unverified block store.
@@ -39,9 +97,31 @@ func New(unverifiedBlockStore UnverifiedBlockStore) *ResponseCache {
 	return &ResponseCache{
 		linkTracker:          linktracker.New(),
 		unverifiedBlockStore: unverifiedBlockStore,
+		received:             make(map[ipld.Link]receivedBlock),
+		shared:               make(map[ipld.Link]*sharedBlock),
 	}
 }
 
+// CountOrphanedBytes adds the size of blocks held by the cache that are
+// dropped without being verified, when their requests finish or they expire,
+// to the given counter
+func (rc *ResponseCache) CountOrphanedBytes(orphans *OrphanCounter) {
+	rc.orphans = orphans
+}
+
+// InspectBlocksWith calls the given function with each block before it is
+// verified and written to the store. Blocks it rejects are dropped, and the
+// load fails with a graphsync.BlockRejectedErr
+func (rc *ResponseCache) InspectBlocksWith(inspect BlockInspector) {
+	rc.inspect = inspect
+}
+
+// RecordStoredBlocksWith calls the given function each time a block is
+// verified and written to the store
+func (rc *ResponseCache) RecordStoredBlocksWith(record BlockRecorder) {
+	rc.record = record
+}
+
 // FinishRequest indicate there is no more need to track blocks tied to this
 // response
 func (rc *ResponseCache) FinishRequest(requestID graphsync.RequestID) {
@@ -49,31 +129,149 @@ func (rc *ResponseCache) FinishRequest(requestID graphsync.RequestID) {
 	rc.linkTracker.FinishRequest(requestID)
 
 	rc.unverifiedBlockStore.PruneBlocks(func(link ipld.Link) bool {
-		return rc.linkTracker.BlockRefCount(link) == 0
+		if rc.linkTracker.BlockRefCount(link) == 0 {
+			rc.orphaned(link)
+			return true
+		}
+		return false
 	})
+	for link, shared := range rc.shared {
+		if len(shared.loadedBy) >= rc.linkTracker.BlockRefCount(link) {
+			delete(rc.shared, link)
+		}
+	}
 	rc.responseCacheLk.Unlock()
 }
 
-// AttemptLoad attempts to laod the given block from the cache
+// PruneExpired drops blocks that have been held for at least ttl without
+// being verified, even if a request in progress still expects them. Blocks
+// expected by any of the given paused requests are kept
+func (rc *ResponseCache) PruneExpired(ttl time.Duration, paused map[graphsync.RequestID]struct{}) {
+	rc.responseCacheLk.Lock()
+	defer rc.responseCacheLk.Unlock()
+	held := make(map[ipld.Link]struct{})
+	for requestID := range paused {
+		for _, link := range rc.linkTracker.LinksWithBlocks(requestID) {
+			held[link] = struct{}{}
+		}
+	}
+	for link, rb := range rc.received {
+		if _, ok := held[link]; ok {
+			continue
+		}
+		if time.Since(rb.received) >= ttl {
+			log.Debugf("Dropping expired unverified block: %s", link.String())
+			rc.unverifiedBlockStore.PruneBlock(link)
+			rc.orphaned(link)
+		}
+	}
+}
+
+// ResetExpiry restarts the expiry of blocks the given request expects, as
+// though they were just received
+func (rc *ResponseCache) ResetExpiry(requestID graphsync.RequestID) {
+	rc.responseCacheLk.Lock()
+	defer rc.responseCacheLk.Unlock()
+	now := time.Now()
+	for _, link := range rc.linkTracker.LinksWithBlocks(requestID) {
+		if rb, ok := rc.received[link]; ok {
+			rb.received = now
+			rc.received[link] = rb
+		}
+	}
+}
+
+func (rc *ResponseCache) orphaned(link ipld.Link) {
+	rb, ok := rc.received[link]
+	if !ok {
+		return
+	}
+	delete(rc.received, link)
+	if rc.orphans != nil {
+		rc.orphans.Add(rb.p, rb.size)
+	}
+}
+
+// BufferedBytes returns the size of blocks held by the cache, not yet
+// verified, that the given request expects
+func (rc *ResponseCache) BufferedBytes(requestID graphsync.RequestID) uint64 {
+	rc.responseCacheLk.RLock()
+	defer rc.responseCacheLk.RUnlock()
+	var total uint64
+	counted := make(map[ipld.Link]struct{})
+	for _, link := range rc.linkTracker.LinksWithBlocks(requestID) {
+		if _, ok := counted[link]; ok {
+			continue
+		}
+		counted[link] = struct{}{}
+		total += rc.received[link].size
+	}
+	return total
+}
+
+// AttemptLoad attempts to laod the given block from the cache. If the block
+// is present but cannot be written to the store, its data is returned along
+// with a graphsync.RequestFailedStoreWriteErr. A block is verified and
+// written once -- if other requests in progress also expect it, its data is
+// kept and handed to them without writing it again
 func (rc *ResponseCache) AttemptLoad(requestID graphsync.RequestID, link ipld.Link) ([]byte, error) {
 	rc.responseCacheLk.Lock()
 	defer rc.responseCacheLk.Unlock()
 	if rc.linkTracker.IsKnownMissingLink(requestID, link) {
 		return nil, fmt.Errorf("Remote Peer Is Missing Block: %s", link.String())
 	}
-	data, _ := rc.unverifiedBlockStore.VerifyBlock(link)
+	if shared, ok := rc.shared[link]; ok {
+		shared.loadedBy[requestID] = struct{}{}
+		if len(shared.loadedBy) >= rc.linkTracker.BlockRefCount(link) {
+			delete(rc.shared, link)
+		}
+		return shared.data, nil
+	}
+	var inspect func([]byte) error
+	if rc.inspect != nil {
+		p := rc.received[link].p
+		inspect = func(data []byte) error {
+			return rc.inspect(p, requestID, link, data)
+		}
+	}
+	data, err := rc.unverifiedBlockStore.VerifyBlockWith(link, inspect)
+	if _, ok := err.(graphsync.RequestFailedStoreWriteErr); ok {
+		return data, err
+	}
+	if _, ok := err.(graphsync.BlockRejectedErr); ok {
+		delete(rc.received, link)
+		return nil, err
+	}
+	if err == nil {
+		if rc.record != nil {
+			rc.record(rc.received[link].p, requestID, link)
+		}
+		delete(rc.received, link)
+		if rc.linkTracker.BlockRefCount(link) > 1 {
+			rc.shared[link] = &sharedBlock{
+				data:     data,
+				loadedBy: map[graphsync.RequestID]struct{}{requestID: {}},
+			}
+		}
+	}
 	return data, nil
 }
 
 // ProcessResponse processes incoming response data, adding unverified blocks,
-// and tracking link metadata from a remote peer
-func (rc *ResponseCache) ProcessResponse(responses map[graphsync.RequestID]metadata.Metadata,
-	blks []blocks.Block) {
+// and tracking link metadata from a remote peer. It returns the blocks that
+// were dropped right away because no request expects them
+func (rc *ResponseCache) ProcessResponse(p peer.ID, responses map[graphsync.RequestID]metadata.Metadata,
+	blks []blocks.Block) []blocks.Block {
 	rc.responseCacheLk.Lock()
 
+	now := time.Now()
 	for _, block := range blks {
 		log.Debugf("Received block from network: %s", block.Cid().String())
-		rc.unverifiedBlockStore.AddUnverifiedBlock(cidlink.Link{Cid: block.Cid()}, block.RawData())
+		link := cidlink.Link{Cid: block.Cid()}
+		rc.unverifiedBlockStore.AddUnverifiedBlock(link, block.RawData())
+		if _, ok := rc.received[link]; !ok {
+			rc.received[link] = receivedBlock{p, uint64(len(block.RawData())), now}
+		}
 	}
 
 	for requestID, md := range responses {
@@ -84,11 +282,16 @@ func (rc *ResponseCache) ProcessResponse(responses map[graphsync.RequestID]metad
 	}
 
 	// prune unused blocks right away
+	var pruned []blocks.Block
 	for _, block := range blks {
-		if rc.linkTracker.BlockRefCount(cidlink.Link{Cid: block.Cid()}) == 0 {
-			rc.unverifiedBlockStore.PruneBlock(cidlink.Link{Cid: block.Cid()})
+		link := cidlink.Link{Cid: block.Cid()}
+		if rc.linkTracker.BlockRefCount(link) == 0 {
+			rc.unverifiedBlockStore.PruneBlock(link)
+			delete(rc.received, link)
+			pruned = append(pruned, block)
 		}
 	}
 
 	rc.responseCacheLk.Unlock()
+	return pruned
 }
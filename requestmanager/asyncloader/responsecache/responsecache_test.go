@@ -4,10 +4,12 @@ import (
 	"fmt"
 	"math/rand"
 	"testing"
+	"time"
 
 	blocks "github.com/ipfs/go-block-format"
 	ipld "github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/stretchr/testify/require"
 
 	"github.com/ipfs/go-graphsync"
@@ -17,6 +19,7 @@ import (
 
 type fakeUnverifiedBlockStore struct {
 	inMemoryBlocks map[ipld.Link][]byte
+	verified       int
 }
 
 func (ubs *fakeUnverifiedBlockStore) AddUnverifiedBlock(lnk ipld.Link, data []byte) {
@@ -35,12 +38,18 @@ func (ubs *fakeUnverifiedBlockStore) PruneBlock(link ipld.Link) {
 	delete(ubs.inMemoryBlocks, link)
 }
 
-func (ubs *fakeUnverifiedBlockStore) VerifyBlock(lnk ipld.Link) ([]byte, error) {
+func (ubs *fakeUnverifiedBlockStore) VerifyBlockWith(lnk ipld.Link, inspect func([]byte) error) ([]byte, error) {
 	data, ok := ubs.inMemoryBlocks[lnk]
 	if !ok {
 		return nil, fmt.Errorf("Block not found")
 	}
 	delete(ubs.inMemoryBlocks, lnk)
+	if inspect != nil {
+		if err := inspect(data); err != nil {
+			return nil, graphsync.BlockRejectedErr{Link: lnk, Err: err}
+		}
+	}
+	ubs.verified++
 	return data, nil
 }
 
@@ -99,8 +108,12 @@ func TestResponseCacheManagingLinks(t *testing.T) {
 		inMemoryBlocks: make(map[ipld.Link][]byte),
 	}
 	responseCache := New(fubs)
+	orphans := NewOrphanCounter()
+	responseCache.CountOrphanedBytes(orphans)
+	p := testutil.GeneratePeers(1)[0]
 
-	responseCache.ProcessResponse(responses, blks)
+	pruned := responseCache.ProcessResponse(p, responses, blks)
+	require.Equal(t, []blocks.Block{blks[2]}, pruned)
 
 	require.Len(t, fubs.blocks(), len(blks)-1, "should prune block with no references")
 	testutil.RefuteContainsBlock(t, fubs.blocks(), blks[2])
@@ -137,10 +150,91 @@ func TestResponseCacheManagingLinks(t *testing.T) {
 	// should remove only block 0, since it now has no refering outstanding requests
 	require.Len(t, fubs.blocks(), len(blks)-4, "should prune block when it is orphaned")
 	testutil.RefuteContainsBlock(t, fubs.blocks(), blks[0])
+	require.Equal(t, map[peer.ID]uint64{p: 100}, orphans.Bytes())
 
 	responseCache.FinishRequest(requestID2)
 	// should remove last block since are no remaining references
 	require.Len(t, fubs.blocks(), 0, "should prune block when it is orphaned")
 	testutil.RefuteContainsBlock(t, fubs.blocks(), blks[3])
+	require.Equal(t, map[peer.ID]uint64{p: 200}, orphans.Bytes())
+}
+
+func TestResponseCachePruneExpired(t *testing.T) {
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	requestID := graphsync.RequestID(rand.Int31())
+	peers := testutil.GeneratePeers(2)
+
+	fubs := &fakeUnverifiedBlockStore{
+		inMemoryBlocks: make(map[ipld.Link][]byte),
+	}
+	responseCache := New(fubs)
+	orphans := NewOrphanCounter()
+	responseCache.CountOrphanedBytes(orphans)
+
+	for i, blk := range blks {
+		responses := map[graphsync.RequestID]metadata.Metadata{
+			requestID: metadata.Metadata{metadata.Item{Link: blk.Cid(), BlockPresent: true}},
+		}
+		responseCache.ProcessResponse(peers[i], responses, []blocks.Block{blk})
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// only the first block has been held for long enough
+	responseCache.PruneExpired(50*time.Millisecond, nil)
+	require.Len(t, fubs.blocks(), 1)
+	testutil.RefuteContainsBlock(t, fubs.blocks(), blks[0])
+	require.Equal(t, map[peer.ID]uint64{peers[0]: 100}, orphans.Bytes())
+
+	// the request is still in progress, so the block is unknown rather than missing
+	data, err := responseCache.AttemptLoad(requestID, cidlink.Link{Cid: blks[0].Cid()})
+	require.NoError(t, err)
+	require.Nil(t, data)
 
+	// blocks expected by paused requests are kept
+	responseCache.PruneExpired(0, map[graphsync.RequestID]struct{}{requestID: {}})
+	require.Len(t, fubs.blocks(), 1)
+
+	// and expire a full ttl after the request resumes
+	responseCache.ResetExpiry(requestID)
+	responseCache.PruneExpired(50*time.Millisecond, nil)
+	require.Len(t, fubs.blocks(), 1)
+
+	responseCache.PruneExpired(0, nil)
+	require.Empty(t, fubs.blocks())
+	require.Equal(t, map[peer.ID]uint64{peers[0]: 100, peers[1]: 100}, orphans.Bytes())
+}
+
+func TestResponseCacheSharesVerifiedBlocks(t *testing.T) {
+	blks := testutil.GenerateBlocksOfSize(1, 100)
+	link := cidlink.Link{Cid: blks[0].Cid()}
+	requestIDs := []graphsync.RequestID{
+		graphsync.RequestID(rand.Int31()),
+		graphsync.RequestID(rand.Int31()),
+		graphsync.RequestID(rand.Int31()),
+	}
+	responses := make(map[graphsync.RequestID]metadata.Metadata)
+	for _, requestID := range requestIDs {
+		responses[requestID] = metadata.Metadata{metadata.Item{Link: blks[0].Cid(), BlockPresent: true}}
+	}
+
+	fubs := &fakeUnverifiedBlockStore{
+		inMemoryBlocks: make(map[ipld.Link][]byte),
+	}
+	responseCache := New(fubs)
+	responseCache.ProcessResponse(testutil.GeneratePeers(1)[0], responses, blks)
+
+	// every request gets the block, but it is verified and written once
+	for _, requestID := range requestIDs[:2] {
+		data, err := responseCache.AttemptLoad(requestID, link)
+		require.NoError(t, err)
+		require.Equal(t, blks[0].RawData(), data)
+	}
+	require.Equal(t, 1, fubs.verified)
+
+	// a request finishing without loading it releases the shared block
+	responseCache.FinishRequest(requestIDs[2])
+	data, err := responseCache.AttemptLoad(requestIDs[0], link)
+	require.NoError(t, err)
+	require.Nil(t, data)
+	require.Equal(t, 1, fubs.verified)
 }
@@ -0,0 +1,106 @@
+package unverifiedblockstore
+
+import (
+	"container/list"
+
+	ipld "github.com/ipld/go-ipld-prime"
+)
+
+// EvictionPolicy chooses which blocks a store holding unverified blocks in
+// memory moves to disk to make room for a new block, once its spill's memory
+// limit is reached. Without a policy, new blocks go straight to disk and
+// blocks already in memory stay there
+type EvictionPolicy interface {
+	// Added is called when a block is held in memory
+	Added(link ipld.Link, size uint64)
+	// Accessed is called when a block held in memory is read
+	Accessed(link ipld.Link)
+	// Removed is called when a block held in memory is verified or pruned
+	Removed(link ipld.Link)
+	// Evict removes and returns the next block to move to disk, or returns
+	// false if no block in memory should be moved
+	Evict() (ipld.Link, bool)
+}
+
+// NewEvictionPolicy returns a new eviction policy for a single store
+type NewEvictionPolicy func() EvictionPolicy
+
+// NewLRUPolicy returns a policy that moves the least recently used block to
+// disk first
+func NewLRUPolicy() EvictionPolicy {
+	return &lruPolicy{
+		order:   list.New(),
+		entries: make(map[ipld.Link]*list.Element),
+	}
+}
+
+type lruPolicy struct {
+	order   *list.List
+	entries map[ipld.Link]*list.Element
+}
+
+func (lp *lruPolicy) Added(link ipld.Link, size uint64) {
+	if element, ok := lp.entries[link]; ok {
+		lp.order.MoveToBack(element)
+		return
+	}
+	lp.entries[link] = lp.order.PushBack(link)
+}
+
+func (lp *lruPolicy) Accessed(link ipld.Link) {
+	if element, ok := lp.entries[link]; ok {
+		lp.order.MoveToBack(element)
+	}
+}
+
+func (lp *lruPolicy) Removed(link ipld.Link) {
+	if element, ok := lp.entries[link]; ok {
+		lp.order.Remove(element)
+		delete(lp.entries, link)
+	}
+}
+
+func (lp *lruPolicy) Evict() (ipld.Link, bool) {
+	element := lp.order.Front()
+	if element == nil {
+		return nil, false
+	}
+	link := lp.order.Remove(element).(ipld.Link)
+	delete(lp.entries, link)
+	return link, true
+}
+
+// NewLargestFirstPolicy returns a policy that moves the largest block in
+// memory to disk first, so memory goes to as many small blocks as possible
+func NewLargestFirstPolicy() EvictionPolicy {
+	return &largestFirstPolicy{sizes: make(map[ipld.Link]uint64)}
+}
+
+type largestFirstPolicy struct {
+	sizes map[ipld.Link]uint64
+}
+
+func (lfp *largestFirstPolicy) Added(link ipld.Link, size uint64) {
+	lfp.sizes[link] = size
+}
+
+func (lfp *largestFirstPolicy) Accessed(link ipld.Link) {}
+
+func (lfp *largestFirstPolicy) Removed(link ipld.Link) {
+	delete(lfp.sizes, link)
+}
+
+func (lfp *largestFirstPolicy) Evict() (ipld.Link, bool) {
+	var largest ipld.Link
+	var largestSize uint64
+	for link, size := range lfp.sizes {
+		if largest == nil || size > largestSize {
+			largest, largestSize = link, size
+		}
+	}
+	if largest == nil {
+		return nil, false
+	}
+	delete(lfp.sizes, largest)
+	return largest, true
+}
@@ -0,0 +1,121 @@
+package unverifiedblockstore
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+)
+
+// SpillStats describes how much unverified block data is held in memory and on
+// disk
+type SpillStats struct {
+	// MemoryLimit is the most unverified block data held in memory
+	MemoryLimit uint64
+	// MemoryUsed is the unverified block data currently held in memory
+	MemoryUsed uint64
+	// DiskUsed is the unverified block data currently spilled to disk
+	DiskUsed uint64
+	// BlocksOnDisk is the number of unverified blocks currently spilled to disk
+	BlocksOnDisk uint64
+	// TotalSpilled is the number of blocks spilled to disk since startup
+	TotalSpilled uint64
+}
+
+// Spill caps the unverified block data stores hold in memory, writing blocks
+// beyond the cap to files in a temporary directory. A single Spill can be
+// shared by several stores, so the cap covers all of them
+type Spill struct {
+	memoryLimit  uint64
+	dir          string
+	memoryUsed   uint64
+	diskUsed     uint64
+	blocksOnDisk uint64
+	totalSpilled uint64
+	newEviction  NewEvictionPolicy
+}
+
+// NewSpill creates a temporary directory inside dir, or the default
+// directory for temporary files if dir is empty, to spill blocks to once
+// stores hold more than memoryLimit bytes
+func NewSpill(memoryLimit uint64, dir string) (*Spill, error) {
+	tempDir, err := ioutil.TempDir(dir, "graphsync-unverified")
+	if err != nil {
+		return nil, err
+	}
+	return &Spill{memoryLimit: memoryLimit, dir: tempDir}, nil
+}
+
+// EvictWith gives each store created with the spill afterwards an eviction
+// policy from newPolicy, so blocks already in memory can be moved to disk to
+// make room for new ones
+func (s *Spill) EvictWith(newPolicy NewEvictionPolicy) {
+	s.newEviction = newPolicy
+}
+
+// Close removes the temporary directory and any blocks left in it
+func (s *Spill) Close() error {
+	return os.RemoveAll(s.dir)
+}
+
+// Stats returns the current memory and disk usage
+func (s *Spill) Stats() SpillStats {
+	return SpillStats{
+		MemoryLimit:  s.memoryLimit,
+		MemoryUsed:   atomic.LoadUint64(&s.memoryUsed),
+		DiskUsed:     atomic.LoadUint64(&s.diskUsed),
+		BlocksOnDisk: atomic.LoadUint64(&s.blocksOnDisk),
+		TotalSpilled: atomic.LoadUint64(&s.totalSpilled),
+	}
+}
+
+// reserveMemory claims memory for a block, returning false if the block would
+// put usage over the limit
+func (s *Spill) reserveMemory(size uint64) bool {
+	for {
+		used := atomic.LoadUint64(&s.memoryUsed)
+		if used+size > s.memoryLimit {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&s.memoryUsed, used, used+size) {
+			return true
+		}
+	}
+}
+
+func (s *Spill) forceReserveMemory(size uint64) {
+	atomic.AddUint64(&s.memoryUsed, size)
+}
+
+func (s *Spill) releaseMemory(size uint64) {
+	atomic.AddUint64(&s.memoryUsed, ^(size - 1))
+}
+
+// write stores a block in a new file, returning its path
+func (s *Spill) write(data []byte) (string, error) {
+	file, err := ioutil.TempFile(s.dir, "block")
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return "", err
+	}
+	atomic.AddUint64(&s.diskUsed, uint64(len(data)))
+	atomic.AddUint64(&s.blocksOnDisk, 1)
+	atomic.AddUint64(&s.totalSpilled, 1)
+	return file.Name(), nil
+}
+
+func (s *Spill) read(path string) ([]byte, error) {
+	return ioutil.ReadFile(path)
+}
+
+func (s *Spill) remove(path string, size uint64) {
+	_ = os.Remove(path)
+	atomic.AddUint64(&s.diskUsed, ^(size - 1))
+	atomic.AddUint64(&s.blocksOnDisk, ^uint64(0))
+}
@@ -2,10 +2,16 @@ package unverifiedblockstore
 
 import (
 	"fmt"
+	"sync/atomic"
 
+	logging "github.com/ipfs/go-log"
 	ipld "github.com/ipld/go-ipld-prime"
+
+	"github.com/ipfs/go-graphsync"
 )
 
+var log = logging.Logger("graphsync")
+
 type settableWriter interface {
 	SetBytes([]byte) error
 }
@@ -14,7 +20,19 @@ type settableWriter interface {
 // that have not been verified to be part of a traversal
 type UnverifiedBlockStore struct {
 	inMemoryBlocks map[ipld.Link][]byte
+	spilledBlocks  map[ipld.Link]spilledBlock
+	spill          *Spill
+	eviction       EvictionPolicy
 	storer         ipld.Storer
+	write          func(ipld.Link, []byte) error
+	bufferedBytes  *uint64
+	writtenBytes   *uint64
+	checkWrite     func(size uint64) error
+}
+
+type spilledBlock struct {
+	path string
+	size uint64
 }
 
 // New initializes a new unverified store with the given storer function for writing
@@ -22,14 +40,113 @@ type UnverifiedBlockStore struct {
 func New(storer ipld.Storer) *UnverifiedBlockStore {
 	return &UnverifiedBlockStore{
 		inMemoryBlocks: make(map[ipld.Link][]byte),
+		spilledBlocks:  make(map[ipld.Link]spilledBlock),
 		storer:         storer,
 	}
 }
 
+// NewWithSpill initializes a new unverified store that holds blocks in memory
+// up to the limit of the given spill, and writes blocks beyond it to disk
+func NewWithSpill(storer ipld.Storer, spill *Spill) *UnverifiedBlockStore {
+	ubs := New(storer)
+	ubs.spill = spill
+	if spill.newEviction != nil {
+		ubs.eviction = spill.newEviction()
+	}
+	return ubs
+}
+
+// WriteWith sets the function verified blocks are written with, in place of
+// writing them with the store's storer
+func (ubs *UnverifiedBlockStore) WriteWith(write func(ipld.Link, []byte) error) {
+	ubs.write = write
+}
+
+// CountBufferedBytes atomically adds the size of blocks added to the store to
+// the given counter, and subtracts it when they are removed. A counter may be
+// shared between several stores
+func (ubs *UnverifiedBlockStore) CountBufferedBytes(bufferedBytes *uint64) {
+	ubs.bufferedBytes = bufferedBytes
+}
+
+// CountWrittenBytes atomically adds the size of each block written to
+// permanent storage to the given counter
+func (ubs *UnverifiedBlockStore) CountWrittenBytes(writtenBytes *uint64) {
+	ubs.writtenBytes = writtenBytes
+}
+
+// CheckWritesWith calls the given function before writing each verified
+// block. If it returns an error, the block is not written and is kept, as if
+// the write failed
+func (ubs *UnverifiedBlockStore) CheckWritesWith(checkWrite func(size uint64) error) {
+	ubs.checkWrite = checkWrite
+}
+
 // AddUnverifiedBlock adds a new unverified block to the in memory cache as it
-// comes in as part of a traversal.
+// comes in as part of a traversal. If the store has a spill and its memory
+// limit is reached, the store's eviction policy, if any, picks blocks to move
+// to disk to make room. Otherwise the block is written to disk instead.
 func (ubs *UnverifiedBlockStore) AddUnverifiedBlock(lnk ipld.Link, data []byte) {
+	if ubs.has(lnk) {
+		return
+	}
+	size := uint64(len(data))
+	if ubs.bufferedBytes != nil {
+		atomic.AddUint64(ubs.bufferedBytes, size)
+	}
+	if ubs.spill == nil {
+		ubs.inMemoryBlocks[lnk] = data
+		return
+	}
+	if ubs.spill.reserveMemory(size) || ubs.evictFor(size) {
+		ubs.holdInMemory(lnk, data)
+		return
+	}
+	path, err := ubs.spill.write(data)
+	if err != nil {
+		log.Warnf("unable to spill block %s to disk, keeping it in memory: %s", lnk, err)
+		ubs.spill.forceReserveMemory(size)
+		ubs.holdInMemory(lnk, data)
+		return
+	}
+	ubs.spilledBlocks[lnk] = spilledBlock{path, size}
+}
+
+func (ubs *UnverifiedBlockStore) holdInMemory(lnk ipld.Link, data []byte) {
 	ubs.inMemoryBlocks[lnk] = data
+	if ubs.eviction != nil {
+		ubs.eviction.Added(lnk, uint64(len(data)))
+	}
+}
+
+// evictFor moves blocks the eviction policy picks to disk until memory for a
+// block of the given size can be reserved, returning true if it was
+func (ubs *UnverifiedBlockStore) evictFor(size uint64) bool {
+	if ubs.eviction == nil || size > ubs.spill.memoryLimit {
+		return false
+	}
+	for {
+		victim, ok := ubs.eviction.Evict()
+		if !ok {
+			return false
+		}
+		data, ok := ubs.inMemoryBlocks[victim]
+		if !ok {
+			continue
+		}
+		path, err := ubs.spill.write(data)
+		if err != nil {
+			log.Warnf("unable to spill block %s to disk, keeping it in memory: %s", victim, err)
+			ubs.eviction.Added(victim, uint64(len(data)))
+			return false
+		}
+		delete(ubs.inMemoryBlocks, victim)
+		ubs.spill.releaseMemory(uint64(len(data)))
+		ubs.spilledBlocks[victim] = spilledBlock{path, uint64(len(data))}
+		if ubs.spill.reserveMemory(size) {
+			return true
+		}
+	}
 }
 
 // PruneBlocks removes blocks from the unverified store without committing them,
@@ -37,27 +154,113 @@ func (ubs *UnverifiedBlockStore) AddUnverifiedBlock(lnk ipld.Link, data []byte)
 func (ubs *UnverifiedBlockStore) PruneBlocks(shouldPrune func(ipld.Link) bool) {
 	for link := range ubs.inMemoryBlocks {
 		if shouldPrune(link) {
-			delete(ubs.inMemoryBlocks, link)
+			ubs.PruneBlock(link)
+		}
+	}
+	for link := range ubs.spilledBlocks {
+		if shouldPrune(link) {
+			ubs.PruneBlock(link)
 		}
 	}
 }
 
 // PruneBlock deletes an individual block from the store
 func (ubs *UnverifiedBlockStore) PruneBlock(link ipld.Link) {
-	delete(ubs.inMemoryBlocks, link)
+	if data, ok := ubs.inMemoryBlocks[link]; ok {
+		delete(ubs.inMemoryBlocks, link)
+		if ubs.spill != nil {
+			ubs.spill.releaseMemory(uint64(len(data)))
+		}
+		if ubs.eviction != nil {
+			ubs.eviction.Removed(link)
+		}
+		ubs.releaseBufferedBytes(uint64(len(data)))
+		return
+	}
+	if spilled, ok := ubs.spilledBlocks[link]; ok {
+		delete(ubs.spilledBlocks, link)
+		ubs.spill.remove(spilled.path, spilled.size)
+		ubs.releaseBufferedBytes(spilled.size)
+	}
+}
+
+func (ubs *UnverifiedBlockStore) releaseBufferedBytes(size uint64) {
+	if ubs.bufferedBytes != nil {
+		atomic.AddUint64(ubs.bufferedBytes, ^(size - 1))
+	}
 }
 
 // VerifyBlock verifies the data for the given link as being part of a traversal,
 // removes it from the unverified store, and writes it to permaneant storage.
+// If the write fails, the block is kept so the write can be retried, and the
+// data is returned along with a graphsync.RequestFailedStoreWriteErr
 func (ubs *UnverifiedBlockStore) VerifyBlock(lnk ipld.Link) ([]byte, error) {
-	data, ok := ubs.inMemoryBlocks[lnk]
+	return ubs.VerifyBlockWith(lnk, nil)
+}
+
+// VerifyBlockWith verifies a block like VerifyBlock, but first passes its data
+// to inspect, if not nil. If inspect returns an error, the block is dropped
+// without being written and a graphsync.BlockRejectedErr is returned
+func (ubs *UnverifiedBlockStore) VerifyBlockWith(lnk ipld.Link, inspect func([]byte) error) ([]byte, error) {
+	data, err := ubs.get(lnk)
+	if err != nil {
+		return nil, err
+	}
+	if inspect != nil {
+		if err := inspect(data); err != nil {
+			ubs.PruneBlock(lnk)
+			return nil, graphsync.BlockRejectedErr{Link: lnk, Err: err}
+		}
+	}
+	if ubs.checkWrite != nil {
+		err = ubs.checkWrite(uint64(len(data)))
+	}
+	if err == nil && ubs.write != nil {
+		err = ubs.write(lnk, data)
+	} else if err == nil {
+		err = WriteBlock(ubs.storer, lnk, data)
+	}
+	if err != nil {
+		return data, graphsync.RequestFailedStoreWriteErr{Link: lnk, Err: err}
+	}
+	if ubs.writtenBytes != nil {
+		atomic.AddUint64(ubs.writtenBytes, uint64(len(data)))
+	}
+	ubs.PruneBlock(lnk)
+	return data, nil
+}
+
+func (ubs *UnverifiedBlockStore) has(lnk ipld.Link) bool {
+	if _, ok := ubs.inMemoryBlocks[lnk]; ok {
+		return true
+	}
+	_, ok := ubs.spilledBlocks[lnk]
+	return ok
+}
+
+func (ubs *UnverifiedBlockStore) get(lnk ipld.Link) ([]byte, error) {
+	if data, ok := ubs.inMemoryBlocks[lnk]; ok {
+		if ubs.eviction != nil {
+			ubs.eviction.Accessed(lnk)
+		}
+		return data, nil
+	}
+	spilled, ok := ubs.spilledBlocks[lnk]
 	if !ok {
 		return nil, fmt.Errorf("Block not found")
 	}
-	delete(ubs.inMemoryBlocks, lnk)
-	buffer, committer, err := ubs.storer(ipld.LinkContext{})
+	data, err := ubs.spill.read(spilled.path)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("reading spilled block: %w", err)
+	}
+	return data, nil
+}
+
+// WriteBlock writes the data for the given link with the given storer
+func WriteBlock(storer ipld.Storer, lnk ipld.Link, data []byte) error {
+	buffer, committer, err := storer(ipld.LinkContext{})
+	if err != nil {
+		return err
 	}
 	if settable, ok := buffer.(settableWriter); ok {
 		err = settable.SetBytes(data)
@@ -65,11 +268,7 @@ func (ubs *UnverifiedBlockStore) VerifyBlock(lnk ipld.Link) ([]byte, error) {
 		_, err = buffer.Write(data)
 	}
 	if err != nil {
-		return nil, err
+		return err
 	}
-	err = committer(lnk)
-	if err != nil {
-		return nil, err
-	}
-	return data, nil
+	return committer(lnk)
 }
@@ -3,8 +3,11 @@ package unverifiedblockstore
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
+	"os"
 	"testing"
 
+	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/stretchr/testify/require"
@@ -44,3 +47,112 @@ func TestVerifyBlockPresent(t *testing.T) {
 	require.Nil(t, data)
 	require.Error(t, err, "block cannot be verified twice")
 }
+
+func TestSpillOverMemoryLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graphsync-spill-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	blocksWritten := make(map[ipld.Link][]byte)
+	_, storer := testutil.NewTestStore(blocksWritten)
+	spill, err := NewSpill(250, dir)
+	require.NoError(t, err)
+	unverifiedBlockStore := NewWithSpill(storer, spill)
+	blks := testutil.GenerateBlocksOfSize(4, 100)
+	for _, block := range blks {
+		unverifiedBlockStore.AddUnverifiedBlock(cidlink.Link{Cid: block.Cid()}, block.RawData())
+	}
+
+	// two blocks fit in memory, the rest go to disk
+	stats := spill.Stats()
+	require.Equal(t, uint64(250), stats.MemoryLimit)
+	require.Equal(t, uint64(200), stats.MemoryUsed)
+	require.Equal(t, uint64(200), stats.DiskUsed)
+	require.Equal(t, uint64(2), stats.BlocksOnDisk)
+	require.Equal(t, uint64(2), stats.TotalSpilled)
+
+	// spilled blocks verify like in memory ones
+	data, err := unverifiedBlockStore.VerifyBlock(cidlink.Link{Cid: blks[3].Cid()})
+	require.NoError(t, err)
+	require.Equal(t, blks[3].RawData(), data)
+	require.Equal(t, blks[3].RawData(), blocksWritten[cidlink.Link{Cid: blks[3].Cid()}])
+	stats = spill.Stats()
+	require.Equal(t, uint64(100), stats.DiskUsed)
+	require.Equal(t, uint64(1), stats.BlocksOnDisk)
+
+	unverifiedBlockStore.PruneBlocks(func(ipld.Link) bool { return true })
+	stats = spill.Stats()
+	require.Equal(t, uint64(0), stats.MemoryUsed)
+	require.Equal(t, uint64(0), stats.DiskUsed)
+	require.Equal(t, uint64(0), stats.BlocksOnDisk)
+	require.Equal(t, uint64(2), stats.TotalSpilled)
+
+	require.NoError(t, spill.Close())
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestSpillEvictionPolicies(t *testing.T) {
+	sizes := []int{100, 60, 100, 80}
+	var blks []blocks.Block
+	for _, size := range sizes {
+		blks = append(blks, testutil.GenerateBlocksOfSize(1, int64(size))[0])
+	}
+	testCases := map[string]struct {
+		newPolicy NewEvictionPolicy
+		inMemory  []blocks.Block
+		onDisk    []blocks.Block
+	}{
+		"no policy": {
+			inMemory: blks[:2],
+			onDisk:   blks[2:],
+		},
+		"least recently used": {
+			newPolicy: NewLRUPolicy,
+			inMemory:  blks[2:],
+			onDisk:    blks[:2],
+		},
+		"largest first": {
+			newPolicy: NewLargestFirstPolicy,
+			inMemory:  []blocks.Block{blks[1], blks[3]},
+			onDisk:    []blocks.Block{blks[0], blks[2]},
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "graphsync-spill-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			blocksWritten := make(map[ipld.Link][]byte)
+			_, storer := testutil.NewTestStore(blocksWritten)
+			spill, err := NewSpill(200, dir)
+			require.NoError(t, err)
+			defer spill.Close()
+			if data.newPolicy != nil {
+				spill.EvictWith(data.newPolicy)
+			}
+			unverifiedBlockStore := NewWithSpill(storer, spill)
+			for _, block := range blks {
+				unverifiedBlockStore.AddUnverifiedBlock(cidlink.Link{Cid: block.Cid()}, block.RawData())
+			}
+			for _, block := range data.inMemory {
+				require.Contains(t, unverifiedBlockStore.inMemoryBlocks, cidlink.Link{Cid: block.Cid()})
+			}
+			for _, block := range data.onDisk {
+				require.Contains(t, unverifiedBlockStore.spilledBlocks, cidlink.Link{Cid: block.Cid()})
+			}
+
+			// every block verifies wherever it is held
+			for _, block := range blks {
+				blockData, err := unverifiedBlockStore.VerifyBlock(cidlink.Link{Cid: block.Cid()})
+				require.NoError(t, err)
+				require.Equal(t, block.RawData(), blockData)
+			}
+			stats := spill.Stats()
+			require.Equal(t, uint64(0), stats.MemoryUsed)
+			require.Equal(t, uint64(0), stats.DiskUsed)
+		})
+	}
+}
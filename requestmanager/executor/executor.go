@@ -26,12 +26,18 @@ type AsyncLoadFn func(graphsync.RequestID, ipld.Link) <-chan types.AsyncLoadResu
 
 // ExecutionEnv are request parameters that last between requests
 type ExecutionEnv struct {
-	Ctx              context.Context
-	SendRequest      func(peer.ID, gsmsg.GraphSyncRequest)
-	RunBlockHooks    func(p peer.ID, response graphsync.ResponseData, blk graphsync.BlockData) error
-	TerminateRequest func(graphsync.RequestID)
-	WaitForMessages  func(ctx context.Context, resumeMessages chan graphsync.ExtensionData) ([]graphsync.ExtensionData, error)
-	Loader           AsyncLoadFn
+	Ctx           context.Context
+	SendRequest   func(peer.ID, gsmsg.GraphSyncRequest)
+	RunBlockHooks func(ctx context.Context, p peer.ID, response graphsync.ResponseData, blk graphsync.BlockData) error
+	// TerminateRequest is called once the request finishes, with the error it
+	// ended with, if any, and the stats for its traversal
+	TerminateRequest func(requestID graphsync.RequestID, err error, stats graphsync.RequestStats)
+	// CompleteTransaction, if set, is called as the request finishes to commit
+	// or roll back the writes it staged
+	CompleteTransaction func(requestID graphsync.RequestID, commit bool) error
+	PauseRequest        func(graphsync.RequestID)
+	WaitForMessages     func(ctx context.Context, resumeMessages chan graphsync.ExtensionData) ([]graphsync.ExtensionData, error)
+	Loader              AsyncLoadFn
 }
 
 // RequestExecution are parameters for a single request execution
@@ -43,8 +49,12 @@ type RequestExecution struct {
 	LastResponse         *atomic.Value
 	DoNotSendCids        *cid.Set
 	NodePrototypeChooser traversal.LinkTargetNodePrototypeChooser
+	Reifier              graphsync.NodeReifier
 	ResumeMessages       chan []graphsync.ExtensionData
 	PauseMessages        chan struct{}
+	// Redirects receives the new root when the responder redirects the request
+	Redirects  <-chan cid.Cid
+	Terminated <-chan struct{}
 }
 
 // Start begins execution of a request in a go routine
@@ -59,8 +69,11 @@ func (ee ExecutionEnv) Start(re RequestExecution) (chan graphsync.ResponseProgre
 		lastResponse:     re.LastResponse,
 		doNotSendCids:    re.DoNotSendCids,
 		nodeStyleChooser: re.NodePrototypeChooser,
+		reifier:          re.Reifier,
 		resumeMessages:   re.ResumeMessages,
 		pauseMessages:    re.PauseMessages,
+		redirects:        re.Redirects,
+		terminated:       re.Terminated,
 		env:              ee,
 	}
 	executor.sendRequest(executor.request)
@@ -77,12 +90,17 @@ type requestExecutor struct {
 	request           gsmsg.GraphSyncRequest
 	lastResponse      *atomic.Value
 	nodeStyleChooser  traversal.LinkTargetNodePrototypeChooser
+	reifier           graphsync.NodeReifier
 	resumeMessages    chan []graphsync.ExtensionData
 	pauseMessages     chan struct{}
+	redirects         <-chan cid.Cid
+	terminated        <-chan struct{}
 	doNotSendCids     *cid.Set
 	env               ExecutionEnv
 	restartNeeded     bool
 	pendingExtensions []graphsync.ExtensionData
+	nextBlockIndex    int64
+	stats             graphsync.RequestStats
 }
 
 func (re *requestExecutor) visitor(tp traversal.Progress, node ipld.Node, tr traversal.VisitReason) error {
@@ -97,14 +115,52 @@ func (re *requestExecutor) visitor(tp traversal.Progress, node ipld.Node, tr tra
 	return nil
 }
 
-func (re *requestExecutor) traverse() error {
-	traverser := ipldutil.TraversalBuilder{
-		Root:     cidlink.Link{Cid: re.request.Root()},
+func (re *requestExecutor) startTraversal(root cid.Cid) ipldutil.Traverser {
+	return ipldutil.TraversalBuilder{
+		Root:     cidlink.Link{Cid: root},
 		Selector: re.request.Selector(),
 		Visitor:  re.visitor,
 		Chooser:  re.nodeStyleChooser,
+		Reifier:  re.reifier,
 	}.Start(re.ctx)
-	defer traverser.Shutdown(context.Background())
+}
+
+// checkRedirect returns the root the responder redirected the request to, if
+// it did so before sending any blocks
+func (re *requestExecutor) checkRedirect() (cid.Cid, bool) {
+	if re.nextBlockIndex > 0 {
+		return cid.Undef, false
+	}
+	select {
+	case root := <-re.redirects:
+		return root, true
+	default:
+		return cid.Undef, false
+	}
+}
+
+// waitForResult waits for a load to finish, or for the responder to redirect
+// the request before it sends any blocks
+func (re *requestExecutor) waitForResult(resultChan <-chan types.AsyncLoadResult) (types.AsyncLoadResult, cid.Cid, bool, error) {
+	redirects := re.redirects
+	if re.nextBlockIndex > 0 {
+		redirects = nil
+	}
+	select {
+	case <-re.ctx.Done():
+		return types.AsyncLoadResult{}, cid.Undef, false, ipldutil.ContextCancelError{}
+	case result := <-resultChan:
+		return result, cid.Undef, false, nil
+	case root := <-redirects:
+		return types.AsyncLoadResult{}, root, true, nil
+	}
+}
+
+func (re *requestExecutor) traverse() error {
+	traverser := re.startTraversal(re.request.Root())
+	defer func() {
+		traverser.Shutdown(context.Background())
+	}()
 	for {
 		isComplete, err := traverser.IsComplete()
 		if isComplete {
@@ -113,6 +169,8 @@ func (re *requestExecutor) traverse() error {
 		lnk, _ := traverser.CurrentRequest()
 		resultChan := re.env.Loader(re.request.ID(), lnk)
 		var result types.AsyncLoadResult
+		redirected := false
+		var newRoot cid.Cid
 		select {
 		case result = <-resultChan:
 		default:
@@ -120,12 +178,34 @@ func (re *requestExecutor) traverse() error {
 			if err != nil {
 				return err
 			}
-			select {
-			case <-re.ctx.Done():
-				return ipldutil.ContextCancelError{}
-			case result = <-resultChan:
+			result, newRoot, redirected, err = re.waitForResult(resultChan)
+			if err != nil {
+				return err
 			}
 		}
+		if !redirected {
+			// the redirect arrives with the first response, ahead of its blocks,
+			// so it is waiting by the time the load for the original root ends
+			newRoot, redirected = re.checkRedirect()
+		}
+		if redirected {
+			// verify the response against the root the responder traversed from
+			traverser.Shutdown(context.Background())
+			traverser = re.startTraversal(newRoot)
+			continue
+		}
+		switch storeErr := result.Err.(type) {
+		case graphsync.RequestFailedStoreWriteErr:
+			re.sendRequest(gsmsg.CancelRequest(re.request.ID()))
+			return storeErr
+		case graphsync.RequestPausedStoreWriteErr:
+			err = re.pauseForStoreWriteFailure(storeErr)
+			if err != nil {
+				return err
+			}
+			// load the same link again, which retries the write
+			continue
+		}
 		err = re.processResult(traverser, lnk, result)
 		if _, ok := err.(hooks.ErrPaused); ok {
 			err = re.waitForResume()
@@ -142,25 +222,49 @@ func (re *requestExecutor) traverse() error {
 	}
 }
 
+// waitForTermination is used in place of a traversal for metadata only
+// requests, where no blocks are sent to traverse
+func (re *requestExecutor) waitForTermination() error {
+	select {
+	case <-re.ctx.Done():
+		return ipldutil.ContextCancelError{}
+	case <-re.terminated:
+		return nil
+	}
+}
+
 func (re *requestExecutor) run() {
-	err := re.traverse()
+	var err error
+	if _, metadataOnly := re.request.Extension(graphsync.ExtensionMetadataOnly); metadataOnly {
+		err = re.waitForTermination()
+	} else {
+		err = re.traverse()
+	}
 	if err != nil {
 		if !isContextErr(err) {
 			select {
 			case <-re.ctx.Done():
 			case re.inProgressErr <- err:
 			}
+		} else {
+			err = graphsync.RequestContextCancelledErr{}
 		}
 	}
+	failed := err != nil
 	select {
 	case networkError := <-re.networkError:
+		failed = true
+		err = networkError
 		select {
 		case re.inProgressErr <- networkError:
 		case <-re.env.Ctx.Done():
 		}
 	default:
 	}
-	re.terminateRequest()
+	if commitErr := re.completeTransaction(!failed); commitErr != nil {
+		err = commitErr
+	}
+	re.terminateRequest(err)
 	close(re.inProgressChan)
 	close(re.inProgressErr)
 }
@@ -169,13 +273,30 @@ func (re *requestExecutor) sendRequest(request gsmsg.GraphSyncRequest) {
 	re.env.SendRequest(re.p, request)
 }
 
-func (re *requestExecutor) terminateRequest() {
-	re.env.TerminateRequest(re.request.ID())
+// completeTransaction commits or rolls back the request's writes, returning
+// the error if a commit fails
+func (re *requestExecutor) completeTransaction(commit bool) error {
+	if re.env.CompleteTransaction == nil {
+		return nil
+	}
+	err := re.env.CompleteTransaction(re.request.ID(), commit)
+	if err != nil && commit {
+		select {
+		case re.inProgressErr <- err:
+		case <-re.env.Ctx.Done():
+		}
+		return err
+	}
+	return nil
+}
+
+func (re *requestExecutor) terminateRequest(err error) {
+	re.env.TerminateRequest(re.request.ID(), err, re.stats)
 }
 
 func (re *requestExecutor) runBlockHooks(blk graphsync.BlockData) error {
 	response := re.lastResponse.Load().(gsmsg.GraphSyncResponse)
-	return re.env.RunBlockHooks(re.p, response, blk)
+	return re.env.RunBlockHooks(re.ctx, re.p, response, blk)
 }
 
 func (re *requestExecutor) waitForResume() error {
@@ -188,6 +309,18 @@ func (re *requestExecutor) waitForResume() error {
 	}
 }
 
+// pauseForStoreWriteFailure pauses the request until it is unpaused by the
+// caller, who is told why on the error channel
+func (re *requestExecutor) pauseForStoreWriteFailure(storeErr graphsync.RequestPausedStoreWriteErr) error {
+	re.env.PauseRequest(re.request.ID())
+	select {
+	case <-re.ctx.Done():
+		return ipldutil.ContextCancelError{}
+	case re.inProgressErr <- storeErr:
+	}
+	return re.waitForResume()
+}
+
 func (re *requestExecutor) onNewBlockWithPause(block graphsync.BlockData) error {
 	err := re.onNewBlock(block)
 	select {
@@ -207,6 +340,8 @@ func (re *requestExecutor) onNewBlock(block graphsync.BlockData) error {
 }
 
 func (re *requestExecutor) processResult(traverser ipldutil.Traverser, link ipld.Link, result types.AsyncLoadResult) error {
+	index := re.nextBlockIndex
+	re.nextBlockIndex++
 	if result.Err != nil {
 		select {
 		case <-re.ctx.Done():
@@ -216,7 +351,12 @@ func (re *requestExecutor) processResult(traverser ipldutil.Traverser, link ipld
 			return nil
 		}
 	}
-	err := re.onNewBlockWithPause(&blockData{link, result.Local, uint64(len(result.Data))})
+	re.stats.Blocks++
+	re.stats.BlockBytes += uint64(len(result.Data))
+	if !result.Local {
+		re.stats.BytesOnWire += uint64(len(result.Data))
+	}
+	err := re.onNewBlockWithPause(&blockData{link, result.Local, uint64(len(result.Data)), index})
 	if err != nil {
 		return err
 	}
@@ -253,6 +393,7 @@ type blockData struct {
 	link  ipld.Link
 	local bool
 	size  uint64
+	index int64
 }
 
 // Link is the link/cid for the block
@@ -272,3 +413,22 @@ func (bd *blockData) BlockSizeOnWire() uint64 {
 	}
 	return bd.size
 }
+
+// Cid is the CID of the block
+func (bd *blockData) Cid() cid.Cid {
+	if cidLink, ok := bd.link.(cidlink.Link); ok {
+		return cidLink.Cid
+	}
+	return cid.Undef
+}
+
+// Index is the position of the block among all links traversed by the request
+func (bd *blockData) Index() int64 {
+	return bd.index
+}
+
+// Deduplicated is true if the block was loaded from the local store rather
+// than received over the network
+func (bd *blockData) Deduplicated() bool {
+	return bd.local
+}
@@ -42,6 +42,13 @@ func TestRequestExecutionBlockChain(t *testing.T) {
 				require.Equal(t, []requestSent{{ree.p, ree.request}}, ree.requestsSent)
 				require.Len(t, ree.blookHooksCalled, 10)
 				require.Equal(t, ree.request.ID(), ree.terminateRequested)
+				require.NoError(t, ree.terminateErr)
+				require.Equal(t, uint64(10), ree.terminateStats.Blocks)
+				var chainSize uint64
+				for _, blk := range tbc.AllBlocks() {
+					chainSize += uint64(len(blk.RawData()))
+				}
+				require.Equal(t, chainSize, ree.terminateStats.BlockBytes)
 				require.True(t, ree.nodeStyleChooserCalled)
 			},
 		},
@@ -57,6 +64,8 @@ func TestRequestExecutionBlockChain(t *testing.T) {
 				require.Equal(t, []requestSent{{ree.p, ree.request}}, ree.requestsSent)
 				require.Len(t, ree.blookHooksCalled, 6)
 				require.Equal(t, ree.request.ID(), ree.terminateRequested)
+				require.EqualError(t, ree.terminateErr, "something went wrong")
+				require.Equal(t, uint64(6), ree.terminateStats.Blocks)
 				require.True(t, ree.nodeStyleChooserCalled)
 			},
 		},
@@ -71,6 +80,7 @@ func TestRequestExecutionBlockChain(t *testing.T) {
 				require.Equal(t, []requestSent{{ree.p, ree.request}}, ree.requestsSent)
 				require.Len(t, ree.blookHooksCalled, 6)
 				require.Equal(t, ree.request.ID(), ree.terminateRequested)
+				require.Equal(t, graphsync.RequestContextCancelledErr{}, ree.terminateErr)
 				require.True(t, ree.nodeStyleChooserCalled)
 			},
 		},
@@ -356,6 +366,8 @@ type requestExecutionEnv struct {
 	requestsSent               []requestSent
 	blookHooksCalled           []blockHookKey
 	terminateRequested         graphsync.RequestID
+	terminateErr               error
+	terminateStats             graphsync.RequestStats
 	nodeStyleChooserCalled     bool
 
 	// deps
@@ -364,8 +376,10 @@ type requestExecutionEnv struct {
 	fal             *testloader.FakeAsyncLoader
 }
 
-func (ree *requestExecutionEnv) terminateRequest(requestID graphsync.RequestID) {
+func (ree *requestExecutionEnv) terminateRequest(requestID graphsync.RequestID, err error, stats graphsync.RequestStats) {
 	ree.terminateRequested = requestID
+	ree.terminateErr = err
+	ree.terminateStats = stats
 }
 
 func (ree *requestExecutionEnv) waitForResume() ([]graphsync.ExtensionData, error) {
@@ -406,7 +420,7 @@ func (ree *requestExecutionEnv) checkPause(requestID graphsync.RequestID, link i
 	}
 }
 
-func (ree *requestExecutionEnv) runBlockHooks(p peer.ID, response graphsync.ResponseData, blk graphsync.BlockData) error {
+func (ree *requestExecutionEnv) runBlockHooks(ctx context.Context, p peer.ID, response graphsync.ResponseData, blk graphsync.BlockData) error {
 	bhk := blockHookKey{p, response.RequestID(), blk.Link()}
 	ree.blookHooksCalled = append(ree.blookHooksCalled, bhk)
 	err := ree.blockHookResults[bhk]
@@ -1,15 +1,17 @@
 package hooks
 
 import (
-	"github.com/hannahhoward/go-pubsub"
+	"context"
+
 	"github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/hookset"
 )
 
 // IncomingBlockHooks is a set of incoming block hooks that can be processed
 type IncomingBlockHooks struct {
-	pubSub *pubsub.PubSub
+	hookSet *hookset.HookSet
 }
 
 type internalBlockHookEvent struct {
@@ -19,26 +21,45 @@ type internalBlockHookEvent struct {
 	rha      *updateHookActions
 }
 
-func blockHookDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
+func blockHookDispatcher(event interface{}, hookFn interface{}, _ graphsync.HookConfig) error {
 	ie := event.(internalBlockHookEvent)
-	hook := subscriberFn.(graphsync.OnIncomingBlockHook)
+	hook := hookFn.(graphsync.OnIncomingBlockHook)
 	hook(ie.p, ie.response, ie.block, ie.rha)
 	return ie.rha.err
 }
 
 // NewBlockHooks returns a new list of incoming request hooks
 func NewBlockHooks() *IncomingBlockHooks {
-	return &IncomingBlockHooks{pubSub: pubsub.New(blockHookDispatcher)}
+	return &IncomingBlockHooks{hookSet: hookset.New(blockHookDispatcher)}
 }
 
 // Register registers an extension to process incoming responses
-func (ibh *IncomingBlockHooks) Register(hook graphsync.OnIncomingBlockHook) graphsync.UnregisterHookFunc {
-	return graphsync.UnregisterHookFunc(ibh.pubSub.Subscribe(hook))
+func (ibh *IncomingBlockHooks) Register(hook graphsync.OnIncomingBlockHook, options ...graphsync.HookOption) graphsync.UnregisterHookFunc {
+	return ibh.hookSet.Register(hook, options...)
+}
+
+// Hooks describes the registered incoming block hooks in the order they run
+func (ibh *IncomingBlockHooks) Hooks() []graphsync.HookInfo {
+	return ibh.hookSet.Hooks(graphsync.HookKindIncomingBlock)
+}
+
+// UseMetrics reports each hook that runs to the given metrics. It should be
+// called before hooks run
+func (ibh *IncomingBlockHooks) UseMetrics(metrics hookset.Metrics) {
+	ibh.hookSet.UseMetrics(graphsync.HookKindIncomingBlock, metrics)
+}
+
+// OnPanic sets a listener for hooks that panic. It should be called before
+// hooks run
+func (ibh *IncomingBlockHooks) OnPanic(listener hookset.PanicListener) {
+	ibh.hookSet.OnPanic(listener)
 }
 
 // ProcessBlockHooks runs response hooks against an incoming response
-func (ibh *IncomingBlockHooks) ProcessBlockHooks(p peer.ID, response graphsync.ResponseData, block graphsync.BlockData) UpdateResult {
-	rha := &updateHookActions{}
-	_ = ibh.pubSub.Publish(internalBlockHookEvent{p, response, block, rha})
+func (ibh *IncomingBlockHooks) ProcessBlockHooks(ctx context.Context, p peer.ID, response graphsync.ResponseData, block graphsync.BlockData) UpdateResult {
+	rha := &updateHookActions{ctx: ctx}
+	if err := ibh.hookSet.Publish(p, internalBlockHookEvent{p, response, block, rha}); err != nil {
+		rha.err = err
+	}
 	return rha.result()
 }
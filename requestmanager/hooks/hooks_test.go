@@ -1,11 +1,13 @@
 package hooks_test
 
 import (
+	"context"
 	"errors"
 	"math/rand"
 	"testing"
 
 	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
 	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	peer "github.com/libp2p/go-libp2p-core/peer"
@@ -17,6 +19,8 @@ import (
 	"github.com/ipfs/go-graphsync/testutil"
 )
 
+type ctxKey struct{}
+
 func TestRequestHookProcessing(t *testing.T) {
 	fakeChooser := func(ipld.Link, ipld.LinkContext) (ipld.NodePrototype, error) {
 		return basicnode.Prototype.Any, nil
@@ -33,6 +37,7 @@ func TestRequestHookProcessing(t *testing.T) {
 	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
 	request := gsmsg.NewRequest(requestID, root, ssb.Matcher().Node(), graphsync.Priority(0), extension)
 	p := testutil.GeneratePeers(1)[0]
+	ctx := context.WithValue(context.Background(), ctxKey{}, "requestctx")
 	testCases := map[string]struct {
 		configure func(t *testing.T, hooks *hooks.OutgoingRequestHooks)
 		assert    func(t *testing.T, result hooks.RequestResult)
@@ -69,6 +74,31 @@ func TestRequestHookProcessing(t *testing.T) {
 				require.Equal(t, "chainstore", result.PersistenceOption)
 			},
 		},
+		"hooks receive request context": {
+			configure: func(t *testing.T, hooks *hooks.OutgoingRequestHooks) {
+				hooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+					hookActions.UsePersistenceOption(hookActions.Context().Value(ctxKey{}).(string))
+				})
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.Equal(t, "requestctx", result.PersistenceOption)
+			},
+		},
+		"hooks share context values": {
+			configure: func(t *testing.T, hooks *hooks.OutgoingRequestHooks) {
+				hooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+					hookActions.SetContextValue(extensionName, "chainstore")
+				}, graphsync.WithPriority(1))
+				hooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+					hookActions.UsePersistenceOption(hookActions.Context().Value(extensionName).(string))
+				})
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.Equal(t, "chainstore", result.PersistenceOption)
+				require.Equal(t, "chainstore", result.Context.Value(extensionName))
+				require.Equal(t, "requestctx", result.Context.Value(ctxKey{}))
+			},
+		},
 		"hooks unregistered": {
 			configure: func(t *testing.T, hooks *hooks.OutgoingRequestHooks) {
 				unregister := hooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
@@ -90,7 +120,7 @@ func TestRequestHookProcessing(t *testing.T) {
 			if data.configure != nil {
 				data.configure(t, hooks)
 			}
-			result := hooks.ProcessRequestHooks(p, request)
+			result := hooks.ProcessRequestHooks(ctx, p, request)
 			if data.assert != nil {
 				data.assert(t, result)
 			}
@@ -187,7 +217,7 @@ func TestBlockHookProcessing(t *testing.T) {
 			if data.configure != nil {
 				data.configure(t, hooks)
 			}
-			result := hooks.ProcessBlockHooks(p, response, blockData)
+			result := hooks.ProcessBlockHooks(context.Background(), p, response, blockData)
 			if data.assert != nil {
 				data.assert(t, result)
 			}
@@ -271,10 +301,63 @@ func TestResponseHookProcessing(t *testing.T) {
 			if data.configure != nil {
 				data.configure(t, hooks)
 			}
-			result := hooks.ProcessResponseHooks(p, response)
+			result := hooks.ProcessResponseHooks(context.Background(), p, response)
 			if data.assert != nil {
 				data.assert(t, result)
 			}
 		})
 	}
 }
+
+func TestBlockStoreHookProcessing(t *testing.T) {
+	requestID := graphsync.RequestID(rand.Int31())
+	p := testutil.GeneratePeers(1)[0]
+	blk := testutil.GenerateBlocksOfSize(1, 100)[0]
+	link := cidlink.Link{Cid: blk.Cid()}
+
+	testCases := map[string]struct {
+		configure func(t *testing.T, hooks *hooks.BlockStoreHooks)
+		assert    func(t *testing.T, err error)
+	}{
+		"no hooks": {
+			assert: func(t *testing.T, err error) {
+				require.NoError(t, err)
+			},
+		},
+		"reject block": {
+			configure: func(t *testing.T, hooks *hooks.BlockStoreHooks) {
+				hooks.Register(func(p peer.ID, requestID graphsync.RequestID, link ipld.Link, data []byte, hookActions graphsync.BlockStoreHookActions) {
+					if len(data) > 50 {
+						hookActions.RejectBlock(errors.New("too big"))
+					}
+				})
+			},
+			assert: func(t *testing.T, err error) {
+				require.EqualError(t, err, "too big")
+			},
+		},
+		"hooks unregistered": {
+			configure: func(t *testing.T, hooks *hooks.BlockStoreHooks) {
+				unregister := hooks.Register(func(p peer.ID, requestID graphsync.RequestID, link ipld.Link, data []byte, hookActions graphsync.BlockStoreHookActions) {
+					hookActions.RejectBlock(errors.New("too big"))
+				})
+				unregister()
+			},
+			assert: func(t *testing.T, err error) {
+				require.NoError(t, err)
+			},
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			hooks := hooks.NewBlockStoreHooks()
+			if data.configure != nil {
+				data.configure(t, hooks)
+			}
+			err := hooks.ProcessBlockStoreHooks(p, requestID, link, blk.RawData())
+			if data.assert != nil {
+				data.assert(t, err)
+			}
+		})
+	}
+}
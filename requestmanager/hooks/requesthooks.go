@@ -1,16 +1,18 @@
 package hooks
 
 import (
-	"github.com/hannahhoward/go-pubsub"
+	"context"
+
 	"github.com/ipld/go-ipld-prime/traversal"
 	peer "github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/hookset"
 )
 
 // OutgoingRequestHooks is a set of incoming request hooks that can be processed
 type OutgoingRequestHooks struct {
-	pubSub *pubsub.PubSub
+	hookSet *hookset.HookSet
 }
 
 type internalRequestHookEvent struct {
@@ -19,9 +21,9 @@ type internalRequestHookEvent struct {
 	hookActions *requestHookActions
 }
 
-func requestHooksDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
+func requestHooksDispatcher(event interface{}, hookFn interface{}, _ graphsync.HookConfig) error {
 	ie := event.(internalRequestHookEvent)
-	hook := subscriberFn.(graphsync.OnOutgoingRequestHook)
+	hook := hookFn.(graphsync.OnOutgoingRequestHook)
 	hook(ie.p, ie.request, ie.hookActions)
 	return nil
 }
@@ -29,40 +31,98 @@ func requestHooksDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn
 // NewRequestHooks returns a new list of incoming request hooks
 func NewRequestHooks() *OutgoingRequestHooks {
 	return &OutgoingRequestHooks{
-		pubSub: pubsub.New(requestHooksDispatcher),
+		hookSet: hookset.New(requestHooksDispatcher),
 	}
 }
 
 // Register registers an extension to process outgoing requests
-func (orh *OutgoingRequestHooks) Register(hook graphsync.OnOutgoingRequestHook) graphsync.UnregisterHookFunc {
-	return graphsync.UnregisterHookFunc(orh.pubSub.Subscribe(hook))
+func (orh *OutgoingRequestHooks) Register(hook graphsync.OnOutgoingRequestHook, options ...graphsync.HookOption) graphsync.UnregisterHookFunc {
+	return orh.hookSet.Register(hook, options...)
+}
+
+// Hooks describes the registered outgoing request hooks in the order they run
+func (orh *OutgoingRequestHooks) Hooks() []graphsync.HookInfo {
+	return orh.hookSet.Hooks(graphsync.HookKindOutgoingRequest)
+}
+
+// UseMetrics reports each hook that runs to the given metrics. It should be
+// called before hooks run
+func (orh *OutgoingRequestHooks) UseMetrics(metrics hookset.Metrics) {
+	orh.hookSet.UseMetrics(graphsync.HookKindOutgoingRequest, metrics)
+}
+
+// OnPanic sets a listener for hooks that panic. It should be called before
+// hooks run
+func (orh *OutgoingRequestHooks) OnPanic(listener hookset.PanicListener) {
+	orh.hookSet.OnPanic(listener)
 }
 
 // RequestResult is the outcome of running requesthooks
 type RequestResult struct {
-	PersistenceOption string
-	CustomChooser     traversal.LinkTargetNodePrototypeChooser
+	// Context is the context of the request, with any values hooks attached
+	Context context.Context
+	// Err is set when a hook panics, failing the request
+	Err                       error
+	PersistenceOption         string
+	CustomChooser             traversal.LinkTargetNodePrototypeChooser
+	Reifier                   graphsync.NodeReifier
+	StoreWriteFailurePolicy   graphsync.StoreWriteFailurePolicy
+	FallbackPersistenceOption string
+	// SplitWrites is set when blocks are written to WritePersistenceOption
+	// rather than PersistenceOption
+	SplitWrites            bool
+	WritePersistenceOption string
+	// CustomPeer is set when the request is sent to a peer other than the one
+	// it was made for
+	CustomPeer peer.ID
 }
 
 // ProcessRequestHooks runs request hooks against an outgoing request
-func (orh *OutgoingRequestHooks) ProcessRequestHooks(p peer.ID, request graphsync.RequestData) RequestResult {
-	rha := &requestHookActions{}
-	_ = orh.pubSub.Publish(internalRequestHookEvent{p, request, rha})
+func (orh *OutgoingRequestHooks) ProcessRequestHooks(ctx context.Context, p peer.ID, request graphsync.RequestData) RequestResult {
+	rha := &requestHookActions{ctx: ctx}
+	if err := orh.hookSet.Publish(p, internalRequestHookEvent{p, request, rha}); err != nil {
+		rha.err = err
+	}
 	return rha.result()
 }
 
 type requestHookActions struct {
-	persistenceOption  string
-	nodeBuilderChooser traversal.LinkTargetNodePrototypeChooser
+	ctx                       context.Context
+	err                       error
+	persistenceOption         string
+	nodeBuilderChooser        traversal.LinkTargetNodePrototypeChooser
+	reifier                   graphsync.NodeReifier
+	storeWriteFailurePolicy   graphsync.StoreWriteFailurePolicy
+	fallbackPersistenceOption string
+	writePersistenceOption    string
+	splitWrites               bool
+	peer                      peer.ID
 }
 
 func (rha *requestHookActions) result() RequestResult {
+	splitWrites := rha.splitWrites && rha.writePersistenceOption != rha.persistenceOption
 	return RequestResult{
-		PersistenceOption: rha.persistenceOption,
-		CustomChooser:     rha.nodeBuilderChooser,
+		Context:                   rha.ctx,
+		Err:                       rha.err,
+		PersistenceOption:         rha.persistenceOption,
+		CustomChooser:             rha.nodeBuilderChooser,
+		Reifier:                   rha.reifier,
+		StoreWriteFailurePolicy:   rha.storeWriteFailurePolicy,
+		FallbackPersistenceOption: rha.fallbackPersistenceOption,
+		SplitWrites:               splitWrites,
+		WritePersistenceOption:    rha.writePersistenceOption,
+		CustomPeer:                rha.peer,
 	}
 }
 
+func (rha *requestHookActions) UsePeer(p peer.ID) {
+	rha.peer = p
+}
+
+func (rha *requestHookActions) SetContextValue(key, value interface{}) {
+	rha.ctx = context.WithValue(rha.ctx, key, value)
+}
+
 func (rha *requestHookActions) UsePersistenceOption(name string) {
 	rha.persistenceOption = name
 }
@@ -70,3 +130,24 @@ func (rha *requestHookActions) UsePersistenceOption(name string) {
 func (rha *requestHookActions) UseLinkTargetNodePrototypeChooser(nodeBuilderChooser traversal.LinkTargetNodePrototypeChooser) {
 	rha.nodeBuilderChooser = nodeBuilderChooser
 }
+
+func (rha *requestHookActions) UseNodeReifier(reifier graphsync.NodeReifier) {
+	rha.reifier = reifier
+}
+
+func (rha *requestHookActions) UseStoreWriteFailurePolicy(policy graphsync.StoreWriteFailurePolicy) {
+	rha.storeWriteFailurePolicy = policy
+}
+
+func (rha *requestHookActions) UseFallbackPersistenceOption(name string) {
+	rha.fallbackPersistenceOption = name
+}
+
+func (rha *requestHookActions) UseWritePersistenceOption(name string) {
+	rha.writePersistenceOption = name
+	rha.splitWrites = true
+}
+
+func (rha *requestHookActions) Context() context.Context {
+	return rha.ctx
+}
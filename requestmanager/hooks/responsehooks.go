@@ -1,10 +1,12 @@
 package hooks
 
 import (
-	"github.com/hannahhoward/go-pubsub"
+	"context"
+
 	"github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/hookset"
 )
 
 // ErrPaused indicates a request should stop processing, but only cause it's paused
@@ -14,7 +16,7 @@ func (e ErrPaused) Error() string { return "request has been paused" }
 
 // IncomingResponseHooks is a set of incoming response hooks that can be processed
 type IncomingResponseHooks struct {
-	pubSub *pubsub.PubSub
+	hookSet *hookset.HookSet
 }
 
 type internalResponseHookEvent struct {
@@ -23,21 +25,38 @@ type internalResponseHookEvent struct {
 	rha      *updateHookActions
 }
 
-func responseHookDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
+func responseHookDispatcher(event interface{}, hookFn interface{}, _ graphsync.HookConfig) error {
 	ie := event.(internalResponseHookEvent)
-	hook := subscriberFn.(graphsync.OnIncomingResponseHook)
+	hook := hookFn.(graphsync.OnIncomingResponseHook)
 	hook(ie.p, ie.response, ie.rha)
 	return ie.rha.err
 }
 
 // NewResponseHooks returns a new list of incoming request hooks
 func NewResponseHooks() *IncomingResponseHooks {
-	return &IncomingResponseHooks{pubSub: pubsub.New(responseHookDispatcher)}
+	return &IncomingResponseHooks{hookSet: hookset.New(responseHookDispatcher)}
 }
 
 // Register registers an extension to process incoming responses
-func (irh *IncomingResponseHooks) Register(hook graphsync.OnIncomingResponseHook) graphsync.UnregisterHookFunc {
-	return graphsync.UnregisterHookFunc(irh.pubSub.Subscribe(hook))
+func (irh *IncomingResponseHooks) Register(hook graphsync.OnIncomingResponseHook, options ...graphsync.HookOption) graphsync.UnregisterHookFunc {
+	return irh.hookSet.Register(hook, options...)
+}
+
+// Hooks describes the registered incoming response hooks in the order they run
+func (irh *IncomingResponseHooks) Hooks() []graphsync.HookInfo {
+	return irh.hookSet.Hooks(graphsync.HookKindIncomingResponse)
+}
+
+// UseMetrics reports each hook that runs to the given metrics. It should be
+// called before hooks run
+func (irh *IncomingResponseHooks) UseMetrics(metrics hookset.Metrics) {
+	irh.hookSet.UseMetrics(graphsync.HookKindIncomingResponse, metrics)
+}
+
+// OnPanic sets a listener for hooks that panic. It should be called before
+// hooks run
+func (irh *IncomingResponseHooks) OnPanic(listener hookset.PanicListener) {
+	irh.hookSet.OnPanic(listener)
 }
 
 // UpdateResult is the outcome of running response hooks
@@ -47,13 +66,16 @@ type UpdateResult struct {
 }
 
 // ProcessResponseHooks runs response hooks against an incoming response
-func (irh *IncomingResponseHooks) ProcessResponseHooks(p peer.ID, response graphsync.ResponseData) UpdateResult {
-	rha := &updateHookActions{}
-	_ = irh.pubSub.Publish(internalResponseHookEvent{p, response, rha})
+func (irh *IncomingResponseHooks) ProcessResponseHooks(ctx context.Context, p peer.ID, response graphsync.ResponseData) UpdateResult {
+	rha := &updateHookActions{ctx: ctx}
+	if err := irh.hookSet.Publish(p, internalResponseHookEvent{p, response, rha}); err != nil {
+		rha.err = err
+	}
 	return rha.result()
 }
 
 type updateHookActions struct {
+	ctx        context.Context
 	err        error
 	extensions []graphsync.ExtensionData
 }
@@ -76,3 +98,7 @@ func (rha *updateHookActions) UpdateRequestWithExtensions(extensions ...graphsyn
 func (rha *updateHookActions) PauseRequest() {
 	rha.err = ErrPaused{}
 }
+
+func (rha *updateHookActions) Context() context.Context {
+	return rha.ctx
+}
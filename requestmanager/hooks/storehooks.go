@@ -0,0 +1,75 @@
+package hooks
+
+import (
+	"github.com/ipld/go-ipld-prime"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/hookset"
+)
+
+// BlockStoreHooks is a set of hooks that inspect verified blocks before they
+// are written to the store
+type BlockStoreHooks struct {
+	hookSet *hookset.HookSet
+}
+
+type internalBlockStoreHookEvent struct {
+	p         peer.ID
+	requestID graphsync.RequestID
+	link      ipld.Link
+	data      []byte
+	bsha      *blockStoreHookActions
+}
+
+func blockStoreHookDispatcher(event interface{}, hookFn interface{}, _ graphsync.HookConfig) error {
+	ie := event.(internalBlockStoreHookEvent)
+	hook := hookFn.(graphsync.OnBlockStoreHook)
+	hook(ie.p, ie.requestID, ie.link, ie.data, ie.bsha)
+	return ie.bsha.err
+}
+
+// NewBlockStoreHooks returns a new list of block store hooks
+func NewBlockStoreHooks() *BlockStoreHooks {
+	return &BlockStoreHooks{hookSet: hookset.New(blockStoreHookDispatcher)}
+}
+
+// Register registers a hook to inspect blocks before they are stored
+func (bsh *BlockStoreHooks) Register(hook graphsync.OnBlockStoreHook, options ...graphsync.HookOption) graphsync.UnregisterHookFunc {
+	return bsh.hookSet.Register(hook, options...)
+}
+
+// Hooks describes the registered block store hooks in the order they run
+func (bsh *BlockStoreHooks) Hooks() []graphsync.HookInfo {
+	return bsh.hookSet.Hooks(graphsync.HookKindBlockStore)
+}
+
+// UseMetrics reports each hook that runs to the given metrics. It should be
+// called before hooks run
+func (bsh *BlockStoreHooks) UseMetrics(metrics hookset.Metrics) {
+	bsh.hookSet.UseMetrics(graphsync.HookKindBlockStore, metrics)
+}
+
+// OnPanic sets a listener for hooks that panic. It should be called before
+// hooks run
+func (bsh *BlockStoreHooks) OnPanic(listener hookset.PanicListener) {
+	bsh.hookSet.OnPanic(listener)
+}
+
+// ProcessBlockStoreHooks runs block store hooks against a verified block, and
+// returns the error the first hook to reject it gave, if any
+func (bsh *BlockStoreHooks) ProcessBlockStoreHooks(p peer.ID, requestID graphsync.RequestID, link ipld.Link, data []byte) error {
+	bsha := &blockStoreHookActions{}
+	if err := bsh.hookSet.Publish(p, internalBlockStoreHookEvent{p, requestID, link, data, bsha}); err != nil {
+		bsha.err = err
+	}
+	return bsha.err
+}
+
+type blockStoreHookActions struct {
+	err error
+}
+
+func (bsha *blockStoreHookActions) RejectBlock(err error) {
+	bsha.err = err
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"sync/atomic"
 
 	blocks "github.com/ipfs/go-block-format"
@@ -11,10 +12,13 @@ import (
 	logging "github.com/ipfs/go-log"
 	"github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/traversal"
 	"github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync"
 	"github.com/ipfs/go-graphsync/cidset"
+	"github.com/ipfs/go-graphsync/compression"
+	"github.com/ipfs/go-graphsync/configlog"
 	"github.com/ipfs/go-graphsync/dedupkey"
 	ipldutil "github.com/ipfs/go-graphsync/ipldutil"
 	"github.com/ipfs/go-graphsync/listeners"
@@ -25,6 +29,7 @@ import (
 	"github.com/ipfs/go-graphsync/requestmanager/executor"
 	"github.com/ipfs/go-graphsync/requestmanager/hooks"
 	"github.com/ipfs/go-graphsync/requestmanager/types"
+	"github.com/ipfs/go-graphsync/rootredirect"
 )
 
 var log = logging.Logger("graphsync")
@@ -38,11 +43,43 @@ type inProgressRequestStatus struct {
 	ctx            context.Context
 	cancelFn       func()
 	p              peer.ID
+	request        gsmsg.GraphSyncRequest
 	networkError   chan error
 	resumeMessages chan []graphsync.ExtensionData
 	pauseMessages  chan struct{}
+	redirects      chan cid.Cid
 	paused         bool
 	lastResponse   atomic.Value
+	terminated     chan struct{}
+	stats          chan<- graphsync.RequestStats
+	config         graphsync.EffectiveConfig
+	relayRecorded  bool
+}
+
+// requestOptions are settings for a request made through one of the request
+// manager's helpers. They take precedence over settings from hooks
+type requestOptions struct {
+	persistenceOption string
+	chooser           traversal.LinkTargetNodePrototypeChooser
+	// stats receives the stats for the request when it finishes, or is closed
+	// if the request fails to start
+	stats chan<- graphsync.RequestStats
+	// contextPersistenceOption is the persistence option from the request
+	// context, used unless a hook chooses one
+	contextPersistenceOption string
+	// priority is the priority from the request context, used in place of the
+	// default priority if hasPriority is set
+	priority    graphsync.Priority
+	hasPriority bool
+}
+
+// markTerminated signals that the responder has sent a final status for
+// the request
+func (ipr *inProgressRequestStatus) markTerminated() {
+	if ipr.terminated != nil {
+		close(ipr.terminated)
+		ipr.terminated = nil
+	}
 }
 
 // PeerHandler is an interface that can send requests to peers
@@ -50,14 +87,25 @@ type PeerHandler interface {
 	SendRequest(p peer.ID, graphSyncRequest gsmsg.GraphSyncRequest, notifees ...notifications.Notifee)
 }
 
+// ConnManager is an interface for protecting connections to peers with
+// requests in progress from being pruned
+type ConnManager interface {
+	Protect(peer.ID, string)
+	Unprotect(peer.ID, string) bool
+}
+
 // AsyncLoader is an interface for loading links asynchronously, returning
 // results as new responses are processed
 type AsyncLoader interface {
 	StartRequest(graphsync.RequestID, string) error
-	ProcessResponse(responses map[graphsync.RequestID]metadata.Metadata,
-		blks []blocks.Block)
+	SetWritePersistenceOption(requestID graphsync.RequestID, writePersistenceOption string) error
+	SetStoreWriteFailurePolicy(requestID graphsync.RequestID, policy graphsync.StoreWriteFailurePolicy, fallbackPersistenceOption string) error
+	ProcessResponse(p peer.ID, responses map[graphsync.RequestID]metadata.Metadata,
+		blks []blocks.Block) []error
 	AsyncLoad(requestID graphsync.RequestID, link ipld.Link) <-chan types.AsyncLoadResult
 	CompleteResponsesFor(requestID graphsync.RequestID)
+	CompleteTransaction(requestID graphsync.RequestID, commit bool) error
+	SetRequestPaused(requestID graphsync.RequestID, paused bool)
 	CleanupRequest(requestID graphsync.RequestID)
 }
 
@@ -77,6 +125,17 @@ type RequestManager struct {
 	responseHooks             ResponseHooks
 	blockHooks                BlockHooks
 	networkErrorListeners     *listeners.NetworkErrorListeners
+	requestSentListeners      *listeners.OutgoingRequestSentListeners
+	completedListeners        *listeners.CompletedRequestListeners
+	blockCompression          []compression.Algorithm
+	defaultPriority           graphsync.Priority
+	defaultChooser            traversal.LinkTargetNodePrototypeChooser
+	configLog                 *configlog.Log
+	connManager               ConnManager
+	isRelayed                 func(peer.ID) bool
+	peerMisbehavingListeners  *listeners.PeerMisbehavingListeners
+	rejectingNewRequests      int32
+	done                      chan struct{}
 }
 
 type requestManagerMessage interface {
@@ -85,17 +144,17 @@ type requestManagerMessage interface {
 
 // RequestHooks run for new requests
 type RequestHooks interface {
-	ProcessRequestHooks(p peer.ID, request graphsync.RequestData) hooks.RequestResult
+	ProcessRequestHooks(ctx context.Context, p peer.ID, request graphsync.RequestData) hooks.RequestResult
 }
 
 // ResponseHooks run for new responses
 type ResponseHooks interface {
-	ProcessResponseHooks(p peer.ID, response graphsync.ResponseData) hooks.UpdateResult
+	ProcessResponseHooks(ctx context.Context, p peer.ID, response graphsync.ResponseData) hooks.UpdateResult
 }
 
 // BlockHooks run for each block loaded
 type BlockHooks interface {
-	ProcessBlockHooks(p peer.ID, response graphsync.ResponseData, block graphsync.BlockData) hooks.UpdateResult
+	ProcessBlockHooks(ctx context.Context, p peer.ID, response graphsync.ResponseData, block graphsync.BlockData) hooks.UpdateResult
 }
 
 // New generates a new request manager from a context, network, and selectorQuerier
@@ -118,9 +177,68 @@ func New(ctx context.Context,
 		responseHooks:             responseHooks,
 		blockHooks:                blockHooks,
 		networkErrorListeners:     networkErrorListeners,
+		defaultPriority:           defaultPriority,
+		done:                      make(chan struct{}),
 	}
 }
 
+// RecordEffectiveConfigs records the effective configuration of each request
+// in the given log. It should be called before Startup
+func (rm *RequestManager) RecordEffectiveConfigs(configLog *configlog.Log) {
+	rm.configLog = configLog
+}
+
+// NotifyMisbehavingPeers reports peers that send blocks not matching their
+// CIDs to the given listeners. It should be called before Startup
+func (rm *RequestManager) NotifyMisbehavingPeers(peerMisbehavingListeners *listeners.PeerMisbehavingListeners) {
+	rm.peerMisbehavingListeners = peerMisbehavingListeners
+}
+
+// AcceptBlockCompression advertises the given compression algorithms on
+// all outgoing requests. It should be called before Startup
+func (rm *RequestManager) AcceptBlockCompression(algorithms []compression.Algorithm) {
+	rm.blockCompression = algorithms
+}
+
+// DefaultPriority sets the priority outgoing requests are sent with. It
+// should be called before Startup
+func (rm *RequestManager) DefaultPriority(priority graphsync.Priority) {
+	rm.defaultPriority = priority
+}
+
+// DefaultNodePrototypeChooser sets the chooser used to build nodes for
+// requests when no hook sets one. It should be called before Startup
+func (rm *RequestManager) DefaultNodePrototypeChooser(chooser traversal.LinkTargetNodePrototypeChooser) {
+	rm.defaultChooser = chooser
+}
+
+// NotifyRequestsSent notifies the given listeners each time a request, update
+// or cancel is written to the network. It should be called before Startup
+func (rm *RequestManager) NotifyRequestsSent(requestSentListeners *listeners.OutgoingRequestSentListeners) {
+	rm.requestSentListeners = requestSentListeners
+}
+
+// NotifyRequestsCompleted notifies the given listeners once each request
+// finishes. It should be called before Startup
+func (rm *RequestManager) NotifyRequestsCompleted(completedListeners *listeners.CompletedRequestListeners) {
+	rm.completedListeners = completedListeners
+}
+
+// ProtectConnections protects the connection to each peer with the given
+// connection manager while requests to it are in progress. It should be called
+// before Startup
+func (rm *RequestManager) ProtectConnections(connManager ConnManager) {
+	rm.connManager = connManager
+}
+
+// DetectRelayedPeers records on the effective configuration of each request
+// whether its peer was only connected through a relay, as reported by
+// isRelayed when the first response arrives. It should be called before
+// Startup
+func (rm *RequestManager) DetectRelayedPeers(isRelayed func(peer.ID) bool) {
+	rm.isRelayed = isRelayed
+}
+
 // SetDelegate specifies who will send messages out to the internet.
 func (rm *RequestManager) SetDelegate(peerHandler PeerHandler) {
 	rm.peerHandler = peerHandler
@@ -137,6 +255,7 @@ type newRequestMessage struct {
 	root                  ipld.Link
 	selector              ipld.Node
 	extensions            []graphsync.ExtensionData
+	options               requestOptions
 	inProgressRequestChan chan<- inProgressRequest
 }
 
@@ -146,27 +265,141 @@ func (rm *RequestManager) SendRequest(ctx context.Context,
 	root ipld.Link,
 	selector ipld.Node,
 	extensions ...graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan error) {
+	_, responses, errs := rm.startRequest(ctx, p, root, selector, requestOptions{}, extensions)
+	return responses, errs
+}
+
+// StartRequest initiates a new GraphSync request to the given peer like
+// SendRequest, returning a handle to follow and control the request
+func (rm *RequestManager) StartRequest(ctx context.Context,
+	p peer.ID,
+	root ipld.Link,
+	selector ipld.Node,
+	extensions ...graphsync.ExtensionData) graphsync.RequestHandle {
+	ctx, cancel := context.WithCancel(ctx)
+	requestID, responses, errs := rm.startRequest(ctx, p, root, selector, requestOptions{}, extensions)
+	return &requestHandle{rm, requestID, responses, errs, cancel}
+}
+
+// FetchToStore sends a request like SendRequest, loading and storing its
+// blocks with the given persistence option, and waits for it to finish. It
+// returns stats for the request along with the first error it ended with
+func (rm *RequestManager) FetchToStore(ctx context.Context,
+	p peer.ID,
+	root ipld.Link,
+	selector ipld.Node,
+	persistenceOption string,
+	extensions ...graphsync.ExtensionData) (graphsync.RequestStats, error) {
+	statsChan := make(chan graphsync.RequestStats, 1)
+	options := requestOptions{persistenceOption: persistenceOption, stats: statsChan}
+	requestID, responses, errs := rm.startRequest(ctx, p, root, selector, options, extensions)
+	var err error
+	for responses != nil || errs != nil {
+		select {
+		case _, ok := <-responses:
+			if !ok {
+				responses = nil
+			}
+		case nextErr, ok := <-errs:
+			if !ok {
+				errs = nil
+			} else if err == nil {
+				err = nextErr
+			}
+		}
+	}
+	if requestID == graphsync.NoRequestID {
+		return graphsync.RequestStats{}, err
+	}
+	select {
+	case stats := <-statsChan:
+		return stats, err
+	case <-rm.ctx.Done():
+		return graphsync.RequestStats{}, err
+	}
+}
+
+// FetchDAG sends a request like SendRequest, building nodes with the given
+// chooser, and waits for it to finish. It returns the root node of the
+// request, or the first error the request ended with
+func (rm *RequestManager) FetchDAG(ctx context.Context,
+	p peer.ID,
+	root ipld.Link,
+	selector ipld.Node,
+	chooser traversal.LinkTargetNodePrototypeChooser,
+	extensions ...graphsync.ExtensionData) (ipld.Node, error) {
+	options := requestOptions{chooser: chooser}
+	_, responses, errs := rm.startRequest(ctx, p, root, selector, options, extensions)
+	var rootNode ipld.Node
+	var err error
+	for responses != nil || errs != nil {
+		select {
+		case response, ok := <-responses:
+			if !ok {
+				responses = nil
+			} else if rootNode == nil && response.Path.String() == "" {
+				rootNode = response.Node
+			}
+		case nextErr, ok := <-errs:
+			if !ok {
+				errs = nil
+			} else if err == nil {
+				err = nextErr
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rootNode == nil {
+		return nil, graphsync.RequestFailedContentNotFoundErr{}
+	}
+	return rootNode, nil
+}
+
+func (rm *RequestManager) startRequest(ctx context.Context,
+	p peer.ID,
+	root ipld.Link,
+	selector ipld.Node,
+	options requestOptions,
+	extensions []graphsync.ExtensionData) (requestID graphsync.RequestID, responses <-chan graphsync.ResponseProgress, errs <-chan error) {
+	requestID = graphsync.NoRequestID
+	if name, ok := graphsync.PersistenceOptionFromContext(ctx); ok {
+		options.contextPersistenceOption = name
+	}
+	if priority, ok := graphsync.RequestPriorityFromContext(ctx); ok {
+		options.priority = priority
+		options.hasPriority = true
+	}
+	if atomic.LoadInt32(&rm.rejectingNewRequests) != 0 {
+		responses, errs = rm.singleErrorResponse(graphsync.RequestFailedClosedErr{})
+		return
+	}
 	if _, err := ipldutil.ParseSelector(selector); err != nil {
-		return rm.singleErrorResponse(fmt.Errorf("Invalid Selector Spec"))
+		responses, errs = rm.singleErrorResponse(fmt.Errorf("Invalid Selector Spec"))
+		return
 	}
 
 	inProgressRequestChan := make(chan inProgressRequest)
 
 	select {
-	case rm.messages <- &newRequestMessage{p, root, selector, extensions, inProgressRequestChan}:
+	case rm.messages <- &newRequestMessage{p, root, selector, extensions, options, inProgressRequestChan}:
 	case <-rm.ctx.Done():
-		return rm.emptyResponse()
+		responses, errs = rm.emptyResponse()
+		return
 	case <-ctx.Done():
-		return rm.emptyResponse()
+		responses, errs = rm.emptyResponse()
+		return
 	}
 	var receivedInProgressRequest inProgressRequest
 	select {
 	case <-rm.ctx.Done():
-		return rm.emptyResponse()
+		responses, errs = rm.emptyResponse()
+		return
 	case receivedInProgressRequest = <-inProgressRequestChan:
 	}
 
-	return rm.rc.collectResponses(ctx,
+	responses, errs = rm.rc.collectResponses(ctx,
 		receivedInProgressRequest.incoming,
 		receivedInProgressRequest.incomingError,
 		func() {
@@ -174,6 +407,7 @@ func (rm *RequestManager) SendRequest(ctx context.Context,
 				receivedInProgressRequest.incoming,
 				receivedInProgressRequest.incomingError)
 		})
+	return receivedInProgressRequest.requestID, responses, errs
 }
 
 func (rm *RequestManager) emptyResponse() (chan graphsync.ResponseProgress, chan error) {
@@ -193,6 +427,38 @@ func (rm *RequestManager) singleErrorResponse(err error) (chan graphsync.Respons
 	return ch, errCh
 }
 
+type requestHandle struct {
+	rm        *RequestManager
+	requestID graphsync.RequestID
+	responses <-chan graphsync.ResponseProgress
+	errs      <-chan error
+	cancel    context.CancelFunc
+}
+
+func (rh *requestHandle) ID() graphsync.RequestID {
+	return rh.requestID
+}
+
+func (rh *requestHandle) Responses() <-chan graphsync.ResponseProgress {
+	return rh.responses
+}
+
+func (rh *requestHandle) Errors() <-chan error {
+	return rh.errs
+}
+
+func (rh *requestHandle) Pause() error {
+	return rh.rm.PauseRequest(rh.requestID)
+}
+
+func (rh *requestHandle) Resume(extensions ...graphsync.ExtensionData) error {
+	return rh.rm.UnpauseRequest(rh.requestID, extensions...)
+}
+
+func (rh *requestHandle) Cancel() {
+	rh.cancel()
+}
+
 type cancelRequestMessage struct {
 	requestID graphsync.RequestID
 	isPause   bool
@@ -262,6 +528,37 @@ func (rm *RequestManager) PauseRequest(requestID graphsync.RequestID) error {
 	return rm.sendSyncMessage(&pauseRequestMessage{requestID, response}, response)
 }
 
+type pendingRequestsMessage struct {
+	response chan []graphsync.RequestInfo
+}
+
+// PendingRequests returns information about the outgoing requests in
+// progress, sorted by ID
+func (rm *RequestManager) PendingRequests() []graphsync.RequestInfo {
+	response := make(chan []graphsync.RequestInfo, 1)
+	select {
+	case rm.messages <- &pendingRequestsMessage{response}:
+	case <-rm.ctx.Done():
+		return nil
+	}
+	select {
+	case requests := <-response:
+		return requests
+	case <-rm.ctx.Done():
+		return nil
+	}
+}
+
+// RequestInfo returns information about an outgoing request in progress
+func (rm *RequestManager) RequestInfo(requestID graphsync.RequestID) (graphsync.RequestInfo, bool) {
+	for _, info := range rm.PendingRequests() {
+		if info.ID == requestID {
+			return info, true
+		}
+	}
+	return graphsync.RequestInfo{}, false
+}
+
 func (rm *RequestManager) sendSyncMessage(message requestManagerMessage, response chan error) error {
 	select {
 	case <-rm.ctx.Done():
@@ -276,6 +573,12 @@ func (rm *RequestManager) sendSyncMessage(message requestManagerMessage, respons
 	}
 }
 
+// RejectNewRequests makes requests started from now on fail immediately
+// with RequestFailedClosedErr, leaving requests in progress untouched
+func (rm *RequestManager) RejectNewRequests() {
+	atomic.StoreInt32(&rm.rejectingNewRequests, 1)
+}
+
 // Startup starts processing for the WantManager.
 func (rm *RequestManager) Startup() {
 	go rm.run()
@@ -286,9 +589,16 @@ func (rm *RequestManager) Shutdown() {
 	rm.cancel()
 }
 
+// Done returns a channel that closes once processing has stopped after
+// Shutdown
+func (rm *RequestManager) Done() <-chan struct{} {
+	return rm.done
+}
+
 func (rm *RequestManager) run() {
 	// NOTE: Do not open any streams or connections from anywhere in this
 	// event loop. Really, just don't do anything likely to block.
+	defer close(rm.done)
 	defer rm.cleanupInProcessRequests()
 
 	for {
@@ -309,40 +619,75 @@ func (rm *RequestManager) cleanupInProcessRequests() {
 
 type terminateRequestMessage struct {
 	requestID graphsync.RequestID
+	err       error
+	stats     graphsync.RequestStats
 }
 
 func (nrm *newRequestMessage) setupRequest(requestID graphsync.RequestID, rm *RequestManager) (chan graphsync.ResponseProgress, chan error) {
-	request, hooksResult, err := rm.validateRequest(requestID, nrm.p, nrm.root, nrm.selector, nrm.extensions)
+	ctx, cancel := context.WithCancel(rm.ctx)
+	request, hooksResult, err := rm.validateRequest(ctx, requestID, nrm.p, nrm.root, nrm.selector, nrm.options, nrm.extensions)
 	if err != nil {
+		cancel()
 		return rm.singleErrorResponse(err)
 	}
+	// hooks may have attached values for later hooks to the context
+	ctx = hooksResult.Context
+	p := nrm.p
+	if hooksResult.CustomPeer != "" {
+		p = hooksResult.CustomPeer
+	}
 	doNotSendCidsData, has := request.Extension(graphsync.ExtensionDoNotSendCIDs)
 	var doNotSendCids *cid.Set
 	if has {
 		doNotSendCids, err = cidset.DecodeCidSet(doNotSendCidsData)
 		if err != nil {
+			cancel()
 			return rm.singleErrorResponse(err)
 		}
 	} else {
 		doNotSendCids = cid.NewSet()
 	}
-	ctx, cancel := context.WithCancel(rm.ctx)
-	p := nrm.p
+	config := graphsync.EffectiveConfig{
+		Peer:                      p,
+		RequestID:                 requestID,
+		Root:                      request.Root(),
+		Priority:                  request.Priority(),
+		Extensions:                request.ExtensionNames(),
+		PersistenceOption:         hooksResult.PersistenceOption,
+		CustomChooser:             hooksResult.CustomChooser != nil,
+		StoreWriteFailurePolicy:   hooksResult.StoreWriteFailurePolicy,
+		FallbackPersistenceOption: hooksResult.FallbackPersistenceOption,
+		WritePersistenceOption:    hooksResult.WritePersistenceOption,
+	}
+	if rm.configLog != nil {
+		rm.configLog.RecordRequest(config)
+	}
 	resumeMessages := make(chan []graphsync.ExtensionData, 1)
 	pauseMessages := make(chan struct{}, 1)
 	networkError := make(chan error, 1)
+	terminated := make(chan struct{})
+	redirects := make(chan cid.Cid, 1)
 	requestStatus := &inProgressRequestStatus{
-		ctx: ctx, cancelFn: cancel, p: p, resumeMessages: resumeMessages, pauseMessages: pauseMessages, networkError: networkError,
+		ctx: ctx, cancelFn: cancel, p: p, request: request, resumeMessages: resumeMessages, pauseMessages: pauseMessages, redirects: redirects, networkError: networkError, terminated: terminated, stats: nrm.options.stats, config: config,
 	}
 	lastResponse := &requestStatus.lastResponse
 	lastResponse.Store(gsmsg.NewResponse(request.ID(), graphsync.RequestAcknowledged))
 	rm.inProgressRequestStatuses[request.ID()] = requestStatus
+	if rm.connManager != nil {
+		rm.connManager.Protect(p, requestTag(request.ID()))
+	}
+	chooser := hooksResult.CustomChooser
+	if chooser == nil {
+		chooser = rm.defaultChooser
+	}
 	incoming, incomingError := executor.ExecutionEnv{
-		Ctx:              rm.ctx,
-		SendRequest:      rm.sendRequest,
-		TerminateRequest: rm.terminateRequest,
-		RunBlockHooks:    rm.processBlockHooks,
-		Loader:           rm.asyncLoader.AsyncLoad,
+		Ctx:                 rm.ctx,
+		SendRequest:         rm.sendRequest,
+		TerminateRequest:    rm.terminateRequest,
+		CompleteTransaction: rm.asyncLoader.CompleteTransaction,
+		RunBlockHooks:       rm.processBlockHooks,
+		PauseRequest:        rm.pauseForStoreWriteFailure,
+		Loader:              rm.asyncLoader.AsyncLoad,
 	}.Start(
 		executor.RequestExecution{
 			Ctx:                  ctx,
@@ -351,9 +696,12 @@ func (nrm *newRequestMessage) setupRequest(requestID graphsync.RequestID, rm *Re
 			NetworkError:         networkError,
 			LastResponse:         lastResponse,
 			DoNotSendCids:        doNotSendCids,
-			NodePrototypeChooser: hooksResult.CustomChooser,
+			NodePrototypeChooser: chooser,
+			Reifier:              hooksResult.Reifier,
 			ResumeMessages:       resumeMessages,
 			PauseMessages:        pauseMessages,
+			Redirects:            redirects,
+			Terminated:           terminated,
 		})
 	return incoming, incomingError
 }
@@ -363,6 +711,10 @@ func (nrm *newRequestMessage) handle(rm *RequestManager) {
 	ipr.requestID = rm.nextRequestID
 	rm.nextRequestID++
 	ipr.incoming, ipr.incomingError = nrm.setupRequest(ipr.requestID, rm)
+	if _, ok := rm.inProgressRequestStatuses[ipr.requestID]; !ok && nrm.options.stats != nil {
+		// the request failed before starting, so it has no stats
+		close(nrm.options.stats)
+	}
 
 	select {
 	case nrm.inProgressRequestChan <- ipr:
@@ -371,8 +723,19 @@ func (nrm *newRequestMessage) handle(rm *RequestManager) {
 }
 
 func (trm *terminateRequestMessage) handle(rm *RequestManager) {
+	requestStatus, ok := rm.inProgressRequestStatuses[trm.requestID]
+	if ok && rm.connManager != nil {
+		rm.connManager.Unprotect(requestStatus.p, requestTag(trm.requestID))
+	}
+	if ok && rm.completedListeners != nil {
+		status := requestStatus.lastResponse.Load().(gsmsg.GraphSyncResponse).Status()
+		rm.completedListeners.NotifyCompletedListeners(requestStatus.p, requestStatus.request, status, trm.err, trm.stats)
+	}
 	delete(rm.inProgressRequestStatuses, trm.requestID)
 	rm.asyncLoader.CleanupRequest(trm.requestID)
+	if ok && requestStatus.stats != nil {
+		requestStatus.stats <- trm.stats
+	}
 }
 
 func (crm *cancelRequestMessage) handle(rm *RequestManager) {
@@ -384,20 +747,46 @@ func (crm *cancelRequestMessage) handle(rm *RequestManager) {
 	rm.sendRequest(inProgressRequestStatus.p, gsmsg.CancelRequest(crm.requestID))
 	if crm.isPause {
 		inProgressRequestStatus.paused = true
+		rm.asyncLoader.SetRequestPaused(crm.requestID, true)
 	} else {
 		inProgressRequestStatus.cancelFn()
 	}
 }
 
 func (prm *processResponseMessage) handle(rm *RequestManager) {
+	rm.recordRelayed(prm.responses, prm.p)
 	filteredResponses := rm.processExtensions(prm.responses, prm.p)
 	filteredResponses = rm.filterResponsesForPeer(filteredResponses, prm.p)
 	rm.updateLastResponses(filteredResponses)
+	rm.processRedirects(filteredResponses)
 	responseMetadata := metadataForResponses(filteredResponses)
-	rm.asyncLoader.ProcessResponse(responseMetadata, prm.blks)
+	mismatches := rm.asyncLoader.ProcessResponse(prm.p, responseMetadata, prm.blks)
+	if rm.peerMisbehavingListeners != nil {
+		for _, err := range mismatches {
+			rm.peerMisbehavingListeners.NotifyPeerMisbehavingListeners(prm.p, err)
+		}
+	}
 	rm.processTerminations(filteredResponses)
 }
 
+// recordRelayed records whether the peer is only connected through a relay on
+// the effective configuration of each request it responds to for the first
+// time, before response hooks run and blocks are loaded
+func (rm *RequestManager) recordRelayed(responses []gsmsg.GraphSyncResponse, p peer.ID) {
+	if rm.configLog == nil || rm.isRelayed == nil {
+		return
+	}
+	for _, response := range responses {
+		requestStatus, ok := rm.inProgressRequestStatuses[response.RequestID()]
+		if !ok || requestStatus.p != p || requestStatus.relayRecorded {
+			continue
+		}
+		requestStatus.relayRecorded = true
+		requestStatus.config.Relayed = rm.isRelayed(p)
+		rm.configLog.RecordRequest(requestStatus.config)
+	}
+}
+
 func (rm *RequestManager) filterResponsesForPeer(responses []gsmsg.GraphSyncResponse, p peer.ID) []gsmsg.GraphSyncResponse {
 	responsesForPeer := make([]gsmsg.GraphSyncResponse, 0, len(responses))
 	for _, response := range responses {
@@ -427,12 +816,43 @@ func (rm *RequestManager) updateLastResponses(responses []gsmsg.GraphSyncRespons
 	}
 }
 
+// processRedirects hands root redirects to the executors for their requests.
+// It runs before blocks for the responses are loaded, so an executor sees the
+// redirect before the load for the original root fails
+func (rm *RequestManager) processRedirects(responses []gsmsg.GraphSyncResponse) {
+	for _, response := range responses {
+		data, has := response.Extension(graphsync.ExtensionRootRedirect)
+		if !has {
+			continue
+		}
+		requestStatus := rm.inProgressRequestStatuses[response.RequestID()]
+		redirect, err := rootredirect.DecodeRedirect(data)
+		if err != nil || !redirect.Original.Equals(requestStatus.request.Root()) {
+			log.Warnf("ignoring invalid root redirect for request %d from %s", response.RequestID(), requestStatus.p)
+			continue
+		}
+		select {
+		case requestStatus.redirects <- redirect.Root:
+		default:
+		}
+	}
+}
+
 func (rm *RequestManager) processExtensionsForResponse(p peer.ID, response gsmsg.GraphSyncResponse) bool {
-	result := rm.responseHooks.ProcessResponseHooks(p, response)
+	ctx := rm.ctx
+	if requestStatus, ok := rm.inProgressRequestStatuses[response.RequestID()]; ok {
+		ctx = requestStatus.ctx
+	}
+	result := rm.responseHooks.ProcessResponseHooks(ctx, p, response)
 	if len(result.Extensions) > 0 {
 		updateRequest := gsmsg.UpdateRequest(response.RequestID(), result.Extensions...)
 		rm.sendRequest(p, updateRequest)
 	}
+	if _, isPause := result.Err.(hooks.ErrPaused); isPause {
+		// the request may already be paused, in which case there is nothing to do
+		_ = (&pauseRequestMessage{id: response.RequestID()}).pause(rm)
+		return true
+	}
 	if result.Err != nil {
 		requestStatus, ok := rm.inProgressRequestStatuses[response.RequestID()]
 		if !ok {
@@ -452,17 +872,22 @@ func (rm *RequestManager) processExtensionsForResponse(p peer.ID, response gsmsg
 
 func (rm *RequestManager) processTerminations(responses []gsmsg.GraphSyncResponse) {
 	for _, response := range responses {
-		if gsmsg.IsTerminalResponseCode(response.Status()) {
-			if gsmsg.IsTerminalFailureCode(response.Status()) {
-				requestStatus := rm.inProgressRequestStatuses[response.RequestID()]
-				responseError := rm.generateResponseErrorFromStatus(response.Status())
-				select {
-				case requestStatus.networkError <- responseError:
-				case <-requestStatus.ctx.Done():
-				}
-				requestStatus.cancelFn()
+		switch response.StatusCategory() {
+		case graphsync.StatusCategoryFailure:
+			requestStatus := rm.inProgressRequestStatuses[response.RequestID()]
+			responseError := rm.generateResponseErrorFromStatus(response.Status())
+			select {
+			case requestStatus.networkError <- responseError:
+			case <-requestStatus.ctx.Done():
 			}
+			requestStatus.cancelFn()
+			requestStatus.markTerminated()
 			rm.asyncLoader.CompleteResponsesFor(response.RequestID())
+		case graphsync.StatusCategorySuccess:
+			rm.inProgressRequestStatuses[response.RequestID()].markTerminated()
+			rm.asyncLoader.CompleteResponsesFor(response.RequestID())
+		case graphsync.StatusCategoryUnknown:
+			log.Warnf("received unrecognized status code %d for request id %d, ignoring", response.Status(), response.RequestID())
 		}
 	}
 }
@@ -479,13 +904,17 @@ func (rm *RequestManager) generateResponseErrorFromStatus(status graphsync.Respo
 		return graphsync.RequestFailedUnknownErr{}
 	case graphsync.RequestCancelled:
 		return graphsync.RequestCancelledErr{}
+	case graphsync.RequestFailedMessageTooLarge:
+		return graphsync.RequestFailedMessageTooLargeErr{}
+	case graphsync.RequestRejected:
+		return graphsync.RequestFailedRejectedErr{}
 	default:
-		return fmt.Errorf("Unknown")
+		return graphsync.RequestFailedUnrecognizedStatusErr{Status: status}
 	}
 }
 
-func (rm *RequestManager) processBlockHooks(p peer.ID, response graphsync.ResponseData, block graphsync.BlockData) error {
-	result := rm.blockHooks.ProcessBlockHooks(p, response, block)
+func (rm *RequestManager) processBlockHooks(ctx context.Context, p peer.ID, response graphsync.ResponseData, block graphsync.BlockData) error {
+	result := rm.blockHooks.ProcessBlockHooks(ctx, p, response, block)
 	if len(result.Extensions) > 0 {
 		updateRequest := gsmsg.UpdateRequest(response.RequestID(), result.Extensions...)
 		rm.sendRequest(p, updateRequest)
@@ -500,14 +929,21 @@ func (rm *RequestManager) processBlockHooks(p peer.ID, response graphsync.Respon
 	return result.Err
 }
 
-func (rm *RequestManager) terminateRequest(requestID graphsync.RequestID) {
+func (rm *RequestManager) pauseForStoreWriteFailure(requestID graphsync.RequestID) {
+	select {
+	case <-rm.ctx.Done():
+	case rm.messages <- &cancelRequestMessage{requestID, true}:
+	}
+}
+
+func (rm *RequestManager) terminateRequest(requestID graphsync.RequestID, err error, stats graphsync.RequestStats) {
 	select {
 	case <-rm.ctx.Done():
-	case rm.messages <- &terminateRequestMessage{requestID}:
+	case rm.messages <- &terminateRequestMessage{requestID, err, stats}:
 	}
 }
 
-func (rm *RequestManager) validateRequest(requestID graphsync.RequestID, p peer.ID, root ipld.Link, selectorSpec ipld.Node, extensions []graphsync.ExtensionData) (gsmsg.GraphSyncRequest, hooks.RequestResult, error) {
+func (rm *RequestManager) validateRequest(ctx context.Context, requestID graphsync.RequestID, p peer.ID, root ipld.Link, selectorSpec ipld.Node, options requestOptions, extensions []graphsync.ExtensionData) (gsmsg.GraphSyncRequest, hooks.RequestResult, error) {
 	_, err := ipldutil.EncodeNode(selectorSpec)
 	if err != nil {
 		return gsmsg.GraphSyncRequest{}, hooks.RequestResult{}, err
@@ -520,8 +956,26 @@ func (rm *RequestManager) validateRequest(requestID graphsync.RequestID, p peer.
 	if !ok {
 		return gsmsg.GraphSyncRequest{}, hooks.RequestResult{}, fmt.Errorf("request failed: link has no cid")
 	}
-	request := gsmsg.NewRequest(requestID, asCidLink.Cid, selectorSpec, defaultPriority, extensions...)
-	hooksResult := rm.requestHooks.ProcessRequestHooks(p, request)
+	// this requestor follows root redirects, so let responders send them
+	extensions = append(extensions[:len(extensions):len(extensions)], graphsync.ExtensionData{Name: graphsync.ExtensionRootRedirect})
+	priority := rm.defaultPriority
+	if options.hasPriority {
+		priority = options.priority
+	}
+	request := gsmsg.NewRequest(requestID, asCidLink.Cid, selectorSpec, priority, extensions...)
+	hooksResult := rm.requestHooks.ProcessRequestHooks(ctx, p, request)
+	if hooksResult.Err != nil {
+		return gsmsg.GraphSyncRequest{}, hooks.RequestResult{}, hooksResult.Err
+	}
+	if hooksResult.PersistenceOption == "" {
+		hooksResult.PersistenceOption = options.contextPersistenceOption
+	}
+	if options.persistenceOption != "" {
+		hooksResult.PersistenceOption = options.persistenceOption
+	}
+	if options.chooser != nil {
+		hooksResult.CustomChooser = options.chooser
+	}
 	if hooksResult.PersistenceOption != "" {
 		dedupData, err := dedupkey.EncodeDedupKey(hooksResult.PersistenceOption)
 		if err != nil {
@@ -534,22 +988,60 @@ func (rm *RequestManager) validateRequest(requestID graphsync.RequestID, p peer.
 			},
 		})
 	}
+	if _, has := request.Extension(graphsync.ExtensionBlockCompression); !has && len(rm.blockCompression) > 0 {
+		compressionData, err := compression.EncodeAlgorithms(rm.blockCompression)
+		if err != nil {
+			return gsmsg.GraphSyncRequest{}, hooks.RequestResult{}, err
+		}
+		request = request.ReplaceExtensions([]graphsync.ExtensionData{
+			{
+				Name: graphsync.ExtensionBlockCompression,
+				Data: compressionData,
+			},
+		})
+	}
 	err = rm.asyncLoader.StartRequest(requestID, hooksResult.PersistenceOption)
 	if err != nil {
 		return gsmsg.GraphSyncRequest{}, hooks.RequestResult{}, err
 	}
+	if hooksResult.SplitWrites {
+		err = rm.asyncLoader.SetWritePersistenceOption(requestID, hooksResult.WritePersistenceOption)
+		if err != nil {
+			rm.asyncLoader.CleanupRequest(requestID)
+			return gsmsg.GraphSyncRequest{}, hooks.RequestResult{}, err
+		}
+	}
+	if hooksResult.StoreWriteFailurePolicy != graphsync.StoreWriteFailRequest {
+		err = rm.asyncLoader.SetStoreWriteFailurePolicy(requestID, hooksResult.StoreWriteFailurePolicy, hooksResult.FallbackPersistenceOption)
+		if err != nil {
+			rm.asyncLoader.CleanupRequest(requestID)
+			return gsmsg.GraphSyncRequest{}, hooks.RequestResult{}, err
+		}
+	}
 	return request, hooksResult, nil
 }
 
+func requestTag(requestID graphsync.RequestID) string {
+	return fmt.Sprintf("graphsync-request-%d", requestID)
+}
+
 type reqSubscriber struct {
 	p                     peer.ID
 	request               gsmsg.GraphSyncRequest
 	networkErrorListeners *listeners.NetworkErrorListeners
+	requestSentListeners  *listeners.OutgoingRequestSentListeners
 }
 
 func (r *reqSubscriber) OnNext(topic notifications.Topic, event notifications.Event) {
 	mqEvt, isMQEvt := event.(messagequeue.Event)
-	if !isMQEvt || mqEvt.Name != messagequeue.Error {
+	if !isMQEvt {
+		return
+	}
+	if mqEvt.Name == messagequeue.Sent && r.requestSentListeners != nil {
+		r.requestSentListeners.NotifyOutgoingRequestSentListeners(r.p, r.request)
+		return
+	}
+	if mqEvt.Name != messagequeue.Error {
 		return
 	}
 
@@ -564,9 +1056,31 @@ func (r reqSubscriber) OnClose(topic notifications.Topic) {
 const requestNetworkError = "request_network_error"
 
 func (rm *RequestManager) sendRequest(p peer.ID, request gsmsg.GraphSyncRequest) {
-	sub := notifications.NewTopicDataSubscriber(&reqSubscriber{p, request, rm.networkErrorListeners})
-	failNotifee := notifications.Notifee{Data: requestNetworkError, Subscriber: sub}
-	rm.peerHandler.SendRequest(p, request, failNotifee)
+	sub := notifications.NewTopicDataSubscriber(&reqSubscriber{p, request, rm.networkErrorListeners, rm.requestSentListeners})
+	notifee := notifications.Notifee{Data: requestNetworkError, Subscriber: sub}
+	rm.peerHandler.SendRequest(p, request, notifee)
+}
+
+func (prm *pendingRequestsMessage) handle(rm *RequestManager) {
+	requests := make([]graphsync.RequestInfo, 0, len(rm.inProgressRequestStatuses))
+	for requestID, requestStatus := range rm.inProgressRequestStatuses {
+		requests = append(requests, graphsync.RequestInfo{
+			ID:         requestID,
+			Peer:       requestStatus.p,
+			Root:       requestStatus.request.Root(),
+			Selector:   requestStatus.request.Selector(),
+			Priority:   requestStatus.request.Priority(),
+			Extensions: requestStatus.request.ExtensionNames(),
+			Paused:     requestStatus.paused,
+		})
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].ID < requests[j].ID
+	})
+	select {
+	case <-rm.ctx.Done():
+	case prm.response <- requests:
+	}
 }
 
 func (urm *unpauseRequestMessage) unpause(rm *RequestManager) error {
@@ -578,6 +1092,7 @@ func (urm *unpauseRequestMessage) unpause(rm *RequestManager) error {
 		return errors.New("request is not paused")
 	}
 	inProgressRequestStatus.paused = false
+	rm.asyncLoader.SetRequestPaused(urm.id, false)
 	select {
 	case <-inProgressRequestStatus.pauseMessages:
 		rm.sendRequest(inProgressRequestStatus.p, gsmsg.UpdateRequest(urm.id, urm.extensions...))
@@ -604,6 +1119,7 @@ func (prm *pauseRequestMessage) pause(rm *RequestManager) error {
 		return errors.New("request is already paused")
 	}
 	inProgressRequestStatus.paused = true
+	rm.asyncLoader.SetRequestPaused(prm.id, true)
 	select {
 	case <-rm.ctx.Done():
 		return errors.New("context cancelled")
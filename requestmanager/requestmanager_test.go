@@ -10,25 +10,30 @@ import (
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/stretchr/testify/require"
 
 	"github.com/ipfs/go-graphsync"
 	"github.com/ipfs/go-graphsync/cidset"
+	"github.com/ipfs/go-graphsync/configlog"
 	"github.com/ipfs/go-graphsync/dedupkey"
 	"github.com/ipfs/go-graphsync/listeners"
 	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/messagequeue"
 	"github.com/ipfs/go-graphsync/metadata"
 	"github.com/ipfs/go-graphsync/notifications"
 	"github.com/ipfs/go-graphsync/requestmanager/hooks"
 	"github.com/ipfs/go-graphsync/requestmanager/testloader"
 	"github.com/ipfs/go-graphsync/requestmanager/types"
+	"github.com/ipfs/go-graphsync/rootredirect"
 	"github.com/ipfs/go-graphsync/testutil"
 )
 
 type requestRecord struct {
-	gsr gsmsg.GraphSyncRequest
-	p   peer.ID
+	gsr      gsmsg.GraphSyncRequest
+	p        peer.ID
+	notifees []notifications.Notifee
 }
 
 type fakePeerHandler struct {
@@ -38,8 +43,9 @@ type fakePeerHandler struct {
 func (fph *fakePeerHandler) SendRequest(p peer.ID,
 	graphSyncRequest gsmsg.GraphSyncRequest, notifees ...notifications.Notifee) {
 	fph.requestRecordChan <- requestRecord{
-		gsr: graphSyncRequest,
-		p:   p,
+		gsr:      graphSyncRequest,
+		p:        p,
+		notifees: notifees,
 	}
 }
 
@@ -101,6 +107,7 @@ func TestNormalSimultaneousFetch(t *testing.T) {
 
 	require.Equal(t, td.blockChain.Selector(), requestRecords[0].gsr.Selector(), "did not encode selector properly")
 	require.Equal(t, blockChain2.Selector(), requestRecords[1].gsr.Selector(), "did not encode selector properly")
+	td.connManager.AssertProtectedWithTags(t, peers[0], requestTag(requestRecords[0].gsr.ID()), requestTag(requestRecords[1].gsr.ID()))
 
 	firstBlocks := append(td.blockChain.AllBlocks(), blockChain2.Blocks(0, 3)...)
 	firstMetadata1 := metadataForBlocks(td.blockChain.AllBlocks(), true)
@@ -154,6 +161,7 @@ func TestNormalSimultaneousFetch(t *testing.T) {
 	blockChain2.VerifyRemainder(requestCtx, returnedResponseChan2, 3)
 	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan1)
 	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan2)
+	td.connManager.RefuteProtected(t, peers[0])
 }
 
 func TestCancelRequestInProgress(t *testing.T) {
@@ -210,6 +218,91 @@ func TestCancelRequestInProgress(t *testing.T) {
 	require.True(t, ok)
 }
 
+func TestRequestHandle(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	handle := td.requestManager.StartRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+
+	rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	require.Equal(t, rr.gsr.ID(), handle.ID())
+
+	firstBlocks := td.blockChain.Blocks(0, 3)
+	firstMetadata := encodedMetadataForBlocks(t, firstBlocks, true)
+	firstResponses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(handle.ID(), graphsync.PartialResponse, firstMetadata),
+	}
+	td.requestManager.ProcessResponses(peers[0], firstResponses, firstBlocks)
+	td.fal.SuccessResponseOn(handle.ID(), firstBlocks)
+	td.blockChain.VerifyResponseRange(requestCtx, handle.Responses(), 0, 3)
+
+	handle.Cancel()
+	rr = readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	require.True(t, rr.gsr.IsCancel())
+	require.Equal(t, handle.ID(), rr.gsr.ID())
+
+	testutil.VerifyEmptyResponse(requestCtx, t, handle.Responses())
+	errors := testutil.CollectErrors(requestCtx, t, handle.Errors())
+	require.Len(t, errors, 1)
+	_, ok := errors[0].(graphsync.RequestContextCancelledErr)
+	require.True(t, ok)
+	require.Error(t, handle.Resume())
+}
+
+func TestRequestHandleInvalidSelector(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	handle := td.requestManager.StartRequest(requestCtx, peers[0], td.blockChain.TipLink, basicnode.NewString("not a selector"))
+	require.Equal(t, graphsync.NoRequestID, handle.ID())
+	testutil.VerifyEmptyResponse(requestCtx, t, handle.Responses())
+	errors := testutil.CollectErrors(requestCtx, t, handle.Errors())
+	require.Len(t, errors, 1)
+}
+
+func TestPendingRequests(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	handle := td.requestManager.StartRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector(), td.extension1)
+	readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)
+
+	pending := td.requestManager.PendingRequests()
+	require.Len(t, pending, 1)
+	info, ok := td.requestManager.RequestInfo(handle.ID())
+	require.True(t, ok)
+	require.Equal(t, pending[0], info)
+	require.Equal(t, handle.ID(), info.ID)
+	require.Equal(t, peers[0], info.Peer)
+	require.Equal(t, td.blockChain.TipLink.(cidlink.Link).Cid, info.Root)
+	require.Contains(t, info.Extensions, td.extensionName1)
+	require.False(t, info.Paused)
+
+	blks := td.blockChain.AllBlocks()
+	responses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(handle.ID(), graphsync.RequestCompletedFull, encodedMetadataForBlocks(t, blks, true)),
+	}
+	td.requestManager.ProcessResponses(peers[0], responses, blks)
+	td.fal.SuccessResponseOn(handle.ID(), blks)
+	td.blockChain.VerifyWholeChain(requestCtx, handle.Responses())
+	testutil.VerifyEmptyErrors(requestCtx, t, handle.Errors())
+
+	require.Eventually(t, func() bool {
+		return len(td.requestManager.PendingRequests()) == 0
+	}, time.Second, 10*time.Millisecond)
+	_, ok = td.requestManager.RequestInfo(handle.ID())
+	require.False(t, ok)
+}
+
 func TestCancelManagerExitsGracefully(t *testing.T) {
 	ctx := context.Background()
 	managerCtx, managerCancel := context.WithCancel(ctx)
@@ -262,6 +355,62 @@ func TestFailedRequest(t *testing.T) {
 	testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan)
 }
 
+func TestRejectedRequest(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	returnedResponseChan, returnedErrorChan := td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+
+	rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	rejectedResponses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestRejected),
+	}
+	td.requestManager.ProcessResponses(peers[0], rejectedResponses, nil)
+
+	var err error
+	testutil.AssertReceive(requestCtx, t, returnedErrorChan, &err, "should receive an error")
+	require.Equal(t, graphsync.RequestFailedRejectedErr{}, err)
+	testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan)
+}
+
+func TestRootRedirect(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	redirectChain := testutil.SetupBlockChain(ctx, t, td.loader, td.storer, 100, 5)
+
+	returnedResponseChan, returnedErrorChan := td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+
+	rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	_, acceptsRedirect := rr.gsr.Extension(graphsync.ExtensionRootRedirect)
+	require.True(t, acceptsRedirect, "should advertise support for root redirects")
+
+	redirectData, err := rootredirect.EncodeRedirect(rootredirect.Redirect{
+		Original: td.blockChain.TipLink.(cidlink.Link).Cid,
+		Root:     redirectChain.TipLink.(cidlink.Link).Cid,
+	})
+	require.NoError(t, err)
+	md := metadataForBlocks(redirectChain.AllBlocks(), true)
+	mdEncoded, err := metadata.EncodeMetadata(md)
+	require.NoError(t, err)
+	responses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedFull,
+			graphsync.ExtensionData{Name: graphsync.ExtensionRootRedirect, Data: redirectData},
+			graphsync.ExtensionData{Name: graphsync.ExtensionMetadata, Data: mdEncoded}),
+	}
+	td.requestManager.ProcessResponses(peers[0], responses, redirectChain.AllBlocks())
+	td.fal.SuccessResponseOn(rr.gsr.ID(), redirectChain.AllBlocks())
+
+	redirectChain.VerifyWholeChain(requestCtx, returnedResponseChan)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan)
+}
+
 func TestLocallyFulfilledFirstRequestFailsLater(t *testing.T) {
 	ctx := context.Background()
 	td := newTestData(ctx, t)
@@ -558,6 +707,8 @@ func TestBlockHooks(t *testing.T) {
 			testutil.AssertReceive(ctx, t, receivedBlocks, &receivedBlock, "did not receive block data")
 			require.Equal(t, blk.Cid(), receivedBlock.Link().(cidlink.Link).Cid)
 			require.Equal(t, uint64(len(blk.RawData())), receivedBlock.BlockSize())
+			require.Equal(t, uint64(len(blk.RawData())), receivedBlock.BlockSizeOnWire())
+			require.False(t, receivedBlock.Deduplicated())
 		}
 
 		nextExpectedData := testutil.RandomBytes(100)
@@ -688,6 +839,260 @@ func TestOutgoingRequestHooks(t *testing.T) {
 	td.fal.VerifyStoreUsed(t, requestRecords[1].gsr.ID(), "")
 }
 
+func TestContextPersistenceOption(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	td.requestHooks.Register(func(p peer.ID, r graphsync.RequestData, ha graphsync.OutgoingRequestHookActions) {
+		if _, has := r.Extension(td.extensionName1); has {
+			ha.UsePersistenceOption("hookstore")
+		}
+	})
+
+	storeCtx := graphsync.WithPersistenceOption(requestCtx, "chainstore")
+	td.requestManager.SendRequest(storeCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	requestRecords := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)
+	td.requestManager.SendRequest(storeCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector(), td.extension1)
+	requestRecords = append(requestRecords, readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)...)
+
+	for i, expectedKey := range []string{"chainstore", "hookstore"} {
+		dedupData, has := requestRecords[i].gsr.Extension(graphsync.ExtensionDeDupByKey)
+		require.True(t, has)
+		key, err := dedupkey.DecodeDedupKey(dedupData)
+		require.NoError(t, err)
+		require.Equal(t, expectedKey, key)
+	}
+}
+
+func TestContextRequestPriority(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	requestRecords := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)
+	priorityCtx := graphsync.WithRequestPriority(requestCtx, graphsync.Priority(10))
+	td.requestManager.SendRequest(priorityCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	requestRecords = append(requestRecords, readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)...)
+
+	require.Equal(t, defaultPriority, requestRecords[0].gsr.Priority())
+	require.Equal(t, graphsync.Priority(10), requestRecords[1].gsr.Priority())
+}
+
+func TestOutgoingRequestHooksRedirectPeer(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(2)
+
+	td.requestHooks.Register(func(p peer.ID, r graphsync.RequestData, ha graphsync.OutgoingRequestHookActions) {
+		ha.UsePeer(peers[1])
+	})
+
+	returnedResponseChan, returnedErrorChan := td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+
+	rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	require.Equal(t, peers[1], rr.p)
+
+	md := metadataForBlocks(td.blockChain.AllBlocks(), true)
+	mdEncoded, err := metadata.EncodeMetadata(md)
+	require.NoError(t, err)
+	responses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedFull, graphsync.ExtensionData{
+			Name: graphsync.ExtensionMetadata,
+			Data: mdEncoded,
+		}),
+	}
+	// responses are only accepted from the peer the request went to
+	td.requestManager.ProcessResponses(peers[1], responses, td.blockChain.AllBlocks())
+	td.fal.SuccessResponseOn(rr.gsr.ID(), td.blockChain.AllBlocks())
+
+	td.blockChain.VerifyWholeChain(requestCtx, returnedResponseChan)
+	testutil.VerifyEmptyErrors(ctx, t, returnedErrorChan)
+}
+
+func TestOutgoingRequestSentListeners(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	requestSentListeners := listeners.NewOutgoingRequestSentListeners()
+	td.requestManager.NotifyRequestsSent(requestSentListeners)
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	td.requestHooks.Register(func(p peer.ID, r graphsync.RequestData, ha graphsync.OutgoingRequestHookActions) {
+		ha.UsePersistenceOption("chainstore")
+	})
+
+	type sentRequest struct {
+		p       peer.ID
+		request graphsync.RequestData
+	}
+	sentRequests := make(chan sentRequest, 1)
+	requestSentListeners.Register(func(p peer.ID, request graphsync.RequestData) {
+		sentRequests <- sentRequest{p, request}
+	})
+
+	_, _ = td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	require.Len(t, rr.notifees, 1)
+
+	notifee := rr.notifees[0]
+	topic := "sent"
+	notifee.Subscriber.AddTopicData(topic, notifee.Data)
+	notifee.Subscriber.OnNext(topic, messagequeue.Event{Name: messagequeue.Queued})
+	notifee.Subscriber.OnNext(topic, messagequeue.Event{Name: messagequeue.Sent})
+
+	var sent sentRequest
+	testutil.AssertReceive(requestCtx, t, sentRequests, &sent, "should notify request sent")
+	require.Equal(t, peers[0], sent.p)
+	require.Equal(t, rr.gsr.ID(), sent.request.ID())
+	dedupData, has := sent.request.Extension(graphsync.ExtensionDeDupByKey)
+	require.True(t, has, "sent request should carry extensions added by hooks")
+	key, err := dedupkey.DecodeDedupKey(dedupData)
+	require.NoError(t, err)
+	require.Equal(t, "chainstore", key)
+	require.Empty(t, sentRequests, "queued event should not notify")
+}
+
+func TestNetworkErrorListeners(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	type networkError struct {
+		p         peer.ID
+		requestID graphsync.RequestID
+		err       error
+	}
+	networkErrors := make(chan networkError, 1)
+	td.networkErrorListeners.Register(func(p peer.ID, request graphsync.RequestData, err error) {
+		networkErrors <- networkError{p, request.ID(), err}
+	})
+
+	_, _ = td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	require.Len(t, rr.notifees, 1)
+
+	notifee := rr.notifees[0]
+	topic := "error"
+	sendErr := errors.New("something went wrong on the wire")
+	notifee.Subscriber.AddTopicData(topic, notifee.Data)
+	notifee.Subscriber.OnNext(topic, messagequeue.Event{Name: messagequeue.Error, Err: sendErr})
+
+	var received networkError
+	testutil.AssertReceive(requestCtx, t, networkErrors, &received, "should notify network error")
+	require.Equal(t, peers[0], received.p)
+	require.Equal(t, rr.gsr.ID(), received.requestID)
+	require.EqualError(t, received.err, sendErr.Error())
+}
+
+func TestRecordsRelayedPeers(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	configLog := configlog.New(10)
+	td.requestManager.RecordEffectiveConfigs(configLog)
+	peers := testutil.GeneratePeers(2)
+	td.requestManager.DetectRelayedPeers(func(p peer.ID) bool { return p == peers[0] })
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	relayedAtHook := make(chan bool, 2)
+	td.responseHooks.Register(func(p peer.ID, response graphsync.ResponseData, hookActions graphsync.IncomingResponseHookActions) {
+		config, _ := configLog.Request(response.RequestID())
+		relayedAtHook <- config.Relayed
+	})
+
+	returnedResponseChan1, returnedErrorChan1 := td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	returnedResponseChan2, returnedErrorChan2 := td.requestManager.SendRequest(requestCtx, peers[1], td.blockChain.TipLink, td.blockChain.Selector())
+	requestRecords := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 2)
+
+	md := encodedMetadataForBlocks(t, td.blockChain.AllBlocks(), true)
+	for _, rr := range requestRecords {
+		responses := []gsmsg.GraphSyncResponse{
+			gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedFull, md),
+		}
+		td.requestManager.ProcessResponses(rr.p, responses, td.blockChain.AllBlocks())
+		td.fal.SuccessResponseOn(rr.gsr.ID(), td.blockChain.AllBlocks())
+
+		// the relayed status is recorded before response hooks run
+		var relayed bool
+		testutil.AssertReceive(requestCtx, t, relayedAtHook, &relayed, "should run response hook")
+		require.Equal(t, rr.p == peers[0], relayed)
+		config, ok := configLog.Request(rr.gsr.ID())
+		require.True(t, ok)
+		require.Equal(t, rr.p == peers[0], config.Relayed)
+	}
+	td.blockChain.VerifyWholeChain(requestCtx, returnedResponseChan1)
+	td.blockChain.VerifyWholeChain(requestCtx, returnedResponseChan2)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan1)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan2)
+}
+
+func TestCompletedRequestListeners(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	completedListeners := listeners.NewCompletedRequestListeners()
+	td.requestManager.NotifyRequestsCompleted(completedListeners)
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	type completedRequest struct {
+		p         peer.ID
+		requestID graphsync.RequestID
+		status    graphsync.ResponseStatusCode
+		err       error
+		stats     graphsync.RequestStats
+	}
+	completedRequests := make(chan completedRequest, 1)
+	completedListeners.Register(func(p peer.ID, request graphsync.RequestData, status graphsync.ResponseStatusCode, err error, stats graphsync.RequestStats) {
+		completedRequests <- completedRequest{p, request.ID(), status, err, stats}
+	})
+
+	returnedResponseChan, returnedErrorChan := td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+
+	md := encodedMetadataForBlocks(t, td.blockChain.AllBlocks(), true)
+	responses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedFull, md),
+	}
+	td.requestManager.ProcessResponses(peers[0], responses, td.blockChain.AllBlocks())
+	td.fal.SuccessResponseOn(rr.gsr.ID(), td.blockChain.AllBlocks())
+
+	td.blockChain.VerifyWholeChain(requestCtx, returnedResponseChan)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan)
+
+	var completed completedRequest
+	testutil.AssertReceive(requestCtx, t, completedRequests, &completed, "should notify request completed")
+	require.Equal(t, peers[0], completed.p)
+	require.Equal(t, rr.gsr.ID(), completed.requestID)
+	require.Equal(t, graphsync.RequestCompletedFull, completed.status)
+	require.NoError(t, completed.err)
+	var chainSize uint64
+	for _, blk := range td.blockChain.AllBlocks() {
+		chainSize += uint64(len(blk.RawData()))
+	}
+	require.Equal(t, uint64(len(td.blockChain.AllBlocks())), completed.stats.Blocks)
+	require.Equal(t, chainSize, completed.stats.BlockBytes)
+	require.Equal(t, chainSize, completed.stats.BytesOnWire)
+}
+
 func TestPauseResume(t *testing.T) {
 	ctx := context.Background()
 	td := newTestData(ctx, t)
@@ -858,6 +1263,67 @@ func TestPauseResumeExternal(t *testing.T) {
 	testutil.VerifyEmptyErrors(ctx, t, returnedErrorChan)
 }
 
+func TestPauseFromResponseHook(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+
+	requestCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	// pause when the responder asks for something in extension data
+	td.responseHooks.Register(func(p peer.ID, responseData graphsync.ResponseData, hookActions graphsync.IncomingResponseHookActions) {
+		if _, has := responseData.Extension(td.extensionName1); has {
+			hookActions.PauseRequest()
+		}
+	})
+
+	returnedResponseChan, returnedErrorChan := td.requestManager.SendRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+
+	rr := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+
+	md := metadataForBlocks(td.blockChain.AllBlocks(), true)
+	mdEncoded, err := metadata.EncodeMetadata(md)
+	require.NoError(t, err)
+	responses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.PartialResponse, graphsync.ExtensionData{
+			Name: graphsync.ExtensionMetadata,
+			Data: mdEncoded,
+		}, td.extension1),
+	}
+	td.requestManager.ProcessResponses(peers[0], responses, td.blockChain.AllBlocks())
+	err = td.requestManager.PauseRequest(rr.gsr.ID())
+	require.EqualError(t, err, "request is already paused")
+	td.fal.SuccessResponseOn(rr.gsr.ID(), td.blockChain.AllBlocks())
+
+	// the pause takes effect at the next block
+	pauseCancel := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	require.True(t, pauseCancel.gsr.IsCancel())
+
+	time.Sleep(100 * time.Millisecond)
+	testutil.AssertChannelEmpty(t, returnedResponseChan, "no response should be sent request is paused")
+	td.fal.CleanupRequest(rr.gsr.ID())
+
+	err = td.requestManager.UnpauseRequest(rr.gsr.ID(), td.extension2)
+	require.NoError(t, err)
+	resumedRequest := readNNetworkRequests(requestCtx, t, td.requestRecordChan, 1)[0]
+	ext2Data, has := resumedRequest.gsr.Extension(td.extensionName2)
+	require.True(t, has)
+	require.Equal(t, td.extensionData2, ext2Data)
+
+	responses = []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedFull, graphsync.ExtensionData{
+			Name: graphsync.ExtensionMetadata,
+			Data: mdEncoded,
+		}),
+	}
+	td.requestManager.ProcessResponses(peers[0], responses, td.blockChain.RemainderBlocks(1))
+	td.fal.SuccessResponseOn(rr.gsr.ID(), td.blockChain.AllBlocks())
+
+	td.blockChain.VerifyRemainder(ctx, returnedResponseChan, 0)
+	testutil.VerifyEmptyErrors(ctx, t, returnedErrorChan)
+}
+
 type testData struct {
 	requestRecordChan     chan requestRecord
 	fph                   *fakePeerHandler
@@ -877,6 +1343,7 @@ type testData struct {
 	extensionData2        []byte
 	extension2            graphsync.ExtensionData
 	networkErrorListeners *listeners.NetworkErrorListeners
+	connManager           *testutil.TestConnManager
 }
 
 func newTestData(ctx context.Context, t *testing.T) *testData {
@@ -889,6 +1356,8 @@ func newTestData(ctx context.Context, t *testing.T) *testData {
 	td.blockHooks = hooks.NewBlockHooks()
 	td.networkErrorListeners = listeners.NewNetworkErrorListeners()
 	td.requestManager = New(ctx, td.fal, td.requestHooks, td.responseHooks, td.blockHooks, td.networkErrorListeners)
+	td.connManager = testutil.NewTestConnManager()
+	td.requestManager.ProtectConnections(td.connManager)
 	td.requestManager.SetDelegate(td.fph)
 	td.requestManager.Startup()
 	td.blockStore = make(map[ipld.Link][]byte)
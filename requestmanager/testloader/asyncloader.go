@@ -8,6 +8,7 @@ import (
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/stretchr/testify/require"
 
 	"github.com/ipfs/go-graphsync"
@@ -58,11 +59,22 @@ func (fal *FakeAsyncLoader) StartRequest(requestID graphsync.RequestID, name str
 	return nil
 }
 
+// SetWritePersistenceOption does nothing, as the fake loader never writes blocks
+func (fal *FakeAsyncLoader) SetWritePersistenceOption(requestID graphsync.RequestID, writePersistenceOption string) error {
+	return nil
+}
+
+// SetStoreWriteFailurePolicy does nothing, as the fake loader never writes blocks
+func (fal *FakeAsyncLoader) SetStoreWriteFailurePolicy(requestID graphsync.RequestID, policy graphsync.StoreWriteFailurePolicy, fallbackPersistenceOption string) error {
+	return nil
+}
+
 // ProcessResponse just records values passed to verify expectations later
-func (fal *FakeAsyncLoader) ProcessResponse(responses map[graphsync.RequestID]metadata.Metadata,
-	blks []blocks.Block) {
+func (fal *FakeAsyncLoader) ProcessResponse(p peer.ID, responses map[graphsync.RequestID]metadata.Metadata,
+	blks []blocks.Block) []error {
 	fal.responses <- responses
 	fal.blks <- blks
+	return nil
 }
 
 // VerifyLastProcessedBlocks verifies the blocks passed to the last call to ProcessResponse
@@ -128,6 +140,14 @@ func (fal *FakeAsyncLoader) AsyncLoad(requestID graphsync.RequestID, link ipld.L
 // CompleteResponsesFor in the case of the test loader does nothing
 func (fal *FakeAsyncLoader) CompleteResponsesFor(requestID graphsync.RequestID) {}
 
+// CompleteTransaction does nothing, as the fake loader never writes blocks
+func (fal *FakeAsyncLoader) CompleteTransaction(requestID graphsync.RequestID, commit bool) error {
+	return nil
+}
+
+// SetRequestPaused in the case of the test loader does nothing
+func (fal *FakeAsyncLoader) SetRequestPaused(requestID graphsync.RequestID, paused bool) {}
+
 // CleanupRequest simulates the effect of cleaning up the request by removing any response channels
 // for the request
 func (fal *FakeAsyncLoader) CleanupRequest(requestID graphsync.RequestID) {
@@ -9,12 +9,18 @@ import (
 func metadataForResponses(responses []gsmsg.GraphSyncResponse) map[graphsync.RequestID]metadata.Metadata {
 	responseMetadata := make(map[graphsync.RequestID]metadata.Metadata, len(responses))
 	for _, response := range responses {
-		mdRaw, found := response.Extension(graphsync.ExtensionMetadata)
+		decode := metadata.DecodeMetadataV2
+		mdRaw, found := response.Extension(graphsync.ExtensionMetadataV2)
+		if !found {
+			// fall back to v1 metadata for peers that do not support v2
+			decode = metadata.DecodeMetadata
+			mdRaw, found = response.Extension(graphsync.ExtensionMetadata)
+		}
 		if !found {
 			log.Warnf("Unable to decode metadata in response for request id: %d", response.RequestID())
 			continue
 		}
-		md, err := metadata.DecodeMetadata(mdRaw)
+		md, err := decode(mdRaw)
 		if err != nil {
 			log.Warnf("Unable to decode metadata in response for request id: %d", response.RequestID())
 			continue
@@ -89,6 +89,13 @@ func (a *Allocator) ReleasePeerMemory(p peer.ID) error {
 	return nil
 }
 
+// AllocatedMemory returns the memory currently allocated across all peers
+func (a *Allocator) AllocatedMemory() uint64 {
+	a.allocLk.Lock()
+	defer a.allocLk.Unlock()
+	return a.total
+}
+
 func (a *Allocator) processPendingAllocations() {
 	for a.peerStatusQueue.Len() > 0 {
 		nextPeer := a.peerStatusQueue.Peek().(*peerStatus)
@@ -1,10 +1,12 @@
 package hooks
 
 import (
-	"github.com/hannahhoward/go-pubsub"
+	"context"
+
 	peer "github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/hookset"
 )
 
 // ErrPaused indicates a request should stop processing, but only cause it's paused
@@ -14,7 +16,7 @@ func (e ErrPaused) Error() string { return "request has been paused" }
 
 // OutgoingBlockHooks is a set of outgoing block hooks that can be processed
 type OutgoingBlockHooks struct {
-	pubSub *pubsub.PubSub
+	hookSet *hookset.HookSet
 }
 
 type internalBlockHookEvent struct {
@@ -24,43 +26,65 @@ type internalBlockHookEvent struct {
 	bha     *blockHookActions
 }
 
-func blockHookDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
+func blockHookDispatcher(event interface{}, hookFn interface{}, _ graphsync.HookConfig) error {
 	ie := event.(internalBlockHookEvent)
-	hook := subscriberFn.(graphsync.OnOutgoingBlockHook)
+	hook := hookFn.(graphsync.OnOutgoingBlockHook)
 	hook(ie.p, ie.request, ie.block, ie.bha)
 	return ie.bha.err
 }
 
 // NewBlockHooks returns a new list of outgoing block hooks
 func NewBlockHooks() *OutgoingBlockHooks {
-	return &OutgoingBlockHooks{pubSub: pubsub.New(blockHookDispatcher)}
+	return &OutgoingBlockHooks{hookSet: hookset.New(blockHookDispatcher)}
 }
 
 // Register registers an hook to process outgoing blocks in a response
-func (obh *OutgoingBlockHooks) Register(hook graphsync.OnOutgoingBlockHook) graphsync.UnregisterHookFunc {
-	return graphsync.UnregisterHookFunc(obh.pubSub.Subscribe(hook))
+func (obh *OutgoingBlockHooks) Register(hook graphsync.OnOutgoingBlockHook, options ...graphsync.HookOption) graphsync.UnregisterHookFunc {
+	return obh.hookSet.Register(hook, options...)
+}
+
+// Hooks describes the registered outgoing block hooks in the order they run
+func (obh *OutgoingBlockHooks) Hooks() []graphsync.HookInfo {
+	return obh.hookSet.Hooks(graphsync.HookKindOutgoingBlock)
+}
+
+// UseMetrics reports each hook that runs to the given metrics. It should be
+// called before hooks run
+func (obh *OutgoingBlockHooks) UseMetrics(metrics hookset.Metrics) {
+	obh.hookSet.UseMetrics(graphsync.HookKindOutgoingBlock, metrics)
+}
+
+// OnPanic sets a listener for hooks that panic. It should be called before
+// hooks run
+func (obh *OutgoingBlockHooks) OnPanic(listener hookset.PanicListener) {
+	obh.hookSet.OnPanic(listener)
 }
 
 // BlockResult is the result of processing block hooks
 type BlockResult struct {
 	Err        error
 	Extensions []graphsync.ExtensionData
+	Skip       bool
 }
 
 // ProcessBlockHooks runs block hooks against a request and block data
-func (obh *OutgoingBlockHooks) ProcessBlockHooks(p peer.ID, request graphsync.RequestData, blockData graphsync.BlockData) BlockResult {
-	bha := &blockHookActions{}
-	_ = obh.pubSub.Publish(internalBlockHookEvent{p, request, blockData, bha})
+func (obh *OutgoingBlockHooks) ProcessBlockHooks(ctx context.Context, p peer.ID, request graphsync.RequestData, blockData graphsync.BlockData) BlockResult {
+	bha := &blockHookActions{ctx: ctx}
+	if err := obh.hookSet.Publish(p, internalBlockHookEvent{p, request, blockData, bha}); err != nil {
+		bha.err = err
+	}
 	return bha.result()
 }
 
 type blockHookActions struct {
+	ctx        context.Context
 	err        error
 	extensions []graphsync.ExtensionData
+	skip       bool
 }
 
 func (bha *blockHookActions) result() BlockResult {
-	return BlockResult{bha.err, bha.extensions}
+	return BlockResult{bha.err, bha.extensions, bha.skip}
 }
 
 func (bha *blockHookActions) SendExtensionData(data graphsync.ExtensionData) {
@@ -74,3 +98,11 @@ func (bha *blockHookActions) TerminateWithError(err error) {
 func (bha *blockHookActions) PauseResponse() {
 	bha.err = ErrPaused{}
 }
+
+func (bha *blockHookActions) SkipBlock() {
+	bha.skip = true
+}
+
+func (bha *blockHookActions) Context() context.Context {
+	return bha.ctx
+}
@@ -1,6 +1,7 @@
 package hooks_test
 
 import (
+	"context"
 	"errors"
 	"io"
 	"math/rand"
@@ -51,7 +52,8 @@ func TestRequestHookProcessing(t *testing.T) {
 		Data: extensionResponseData,
 	}
 
-	root := testutil.GenerateCids(1)[0]
+	cids := testutil.GenerateCids(2)
+	root, redirectRoot := cids[0], cids[1]
 	requestID := graphsync.RequestID(rand.Int31())
 	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
 	request := gsmsg.NewRequest(requestID, root, ssb.Matcher().Node(), graphsync.Priority(0), extension)
@@ -84,6 +86,49 @@ func TestRequestHookProcessing(t *testing.T) {
 				require.NoError(t, result.Err)
 			},
 		},
+		"later hooks can reject a validated request": {
+			configure: func(t *testing.T, requestHooks *hooks.IncomingRequestHooks) {
+				requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+					hookActions.ValidateRequest()
+				}, graphsync.WithPriority(1))
+				requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+					hookActions.TerminateWithError(errors.New("rejected"))
+				})
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.True(t, result.IsValidated)
+				require.EqualError(t, result.Err, "rejected")
+			},
+		},
+		"validating stops later hooks when configured": {
+			configure: func(t *testing.T, requestHooks *hooks.IncomingRequestHooks) {
+				requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+					hookActions.ValidateRequest()
+				}, graphsync.WithPriority(1), graphsync.StopAfterValidation())
+				requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+					hookActions.TerminateWithError(errors.New("rejected"))
+				})
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.True(t, result.IsValidated)
+				require.NoError(t, result.Err)
+			},
+		},
+		"validate and continue runs later hooks": {
+			configure: func(t *testing.T, requestHooks *hooks.IncomingRequestHooks) {
+				requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+					hookActions.ValidateAndContinue()
+				}, graphsync.WithPriority(1), graphsync.StopAfterValidation())
+				requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+					hookActions.SendExtensionData(extensionResponse)
+				})
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.True(t, result.IsValidated)
+				require.Equal(t, []graphsync.ExtensionData{extensionResponse}, result.Extensions)
+				require.NoError(t, result.Err)
+			},
+		},
 		"sending extension data, with validation": {
 			configure: func(t *testing.T, requestHooks *hooks.IncomingRequestHooks) {
 				requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
@@ -118,6 +163,61 @@ func TestRequestHookProcessing(t *testing.T) {
 				require.EqualError(t, result.Err, "something went wrong")
 			},
 		},
+		"hooks redirect the root": {
+			configure: func(t *testing.T, requestHooks *hooks.IncomingRequestHooks) {
+				requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+					hookActions.ValidateRequest()
+					hookActions.UseRoot(redirectRoot)
+				})
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.True(t, result.IsValidated)
+				require.Equal(t, redirectRoot, result.CustomRoot)
+				require.NoError(t, result.Err)
+			},
+		},
+		"hooks replace the selector": {
+			configure: func(t *testing.T, requestHooks *hooks.IncomingRequestHooks) {
+				requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+					hookActions.ValidateRequest()
+					hookActions.UseSelector(ssb.ExploreAll(ssb.Matcher()).Node())
+				})
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.True(t, result.IsValidated)
+				require.Equal(t, ssb.ExploreAll(ssb.Matcher()).Node(), result.CustomSelector)
+				require.NoError(t, result.Err)
+			},
+		},
+		"hooks replace the selector with an invalid one": {
+			configure: func(t *testing.T, requestHooks *hooks.IncomingRequestHooks) {
+				requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+					hookActions.ValidateRequest()
+					hookActions.UseSelector(basicnode.NewString("not a selector"))
+				})
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.Nil(t, result.CustomSelector)
+				require.Error(t, result.Err)
+			},
+		},
+		"hook panics": {
+			configure: func(t *testing.T, requestHooks *hooks.IncomingRequestHooks) {
+				requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+					hookActions.ValidateRequest()
+					panic("something went very wrong")
+				})
+				requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+					hookActions.SendExtensionData(extensionResponse)
+				})
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.Empty(t, result.Extensions)
+				var panicErr graphsync.HookPanicErr
+				require.True(t, errors.As(result.Err, &panicErr))
+				require.Equal(t, "something went very wrong", panicErr.Value)
+			},
+		},
 		"hooks unregistered": {
 			configure: func(t *testing.T, requestHooks *hooks.IncomingRequestHooks) {
 				unregister := requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
@@ -208,7 +308,7 @@ func TestRequestHookProcessing(t *testing.T) {
 			if data.configure != nil {
 				data.configure(t, requestHooks)
 			}
-			result := requestHooks.ProcessRequestHooks(p, request)
+			result := requestHooks.ProcessRequestHooks(context.Background(), p, request)
 			if data.assert != nil {
 				data.assert(t, result)
 			}
@@ -279,6 +379,18 @@ func TestBlockHookProcessing(t *testing.T) {
 				require.EqualError(t, result.Err, hooks.ErrPaused{}.Error())
 			},
 		},
+		"hooks unregistered": {
+			configure: func(t *testing.T, blockHooks *hooks.OutgoingBlockHooks) {
+				unregister := blockHooks.Register(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+					hookActions.SendExtensionData(extensionResponse)
+				})
+				unregister()
+			},
+			assert: func(t *testing.T, result hooks.BlockResult) {
+				require.Empty(t, result.Extensions)
+				require.NoError(t, result.Err)
+			},
+		},
 	}
 	for testCase, data := range testCases {
 		t.Run(testCase, func(t *testing.T) {
@@ -286,7 +398,7 @@ func TestBlockHookProcessing(t *testing.T) {
 			if data.configure != nil {
 				data.configure(t, blockHooks)
 			}
-			result := blockHooks.ProcessBlockHooks(p, request, blockData)
+			result := blockHooks.ProcessBlockHooks(context.Background(), p, request, blockData)
 			if data.assert != nil {
 				data.assert(t, result)
 			}
@@ -372,6 +484,19 @@ func TestUpdateHookProcessing(t *testing.T) {
 				require.True(t, result.Unpause)
 			},
 		},
+		"hooks unregistered": {
+			configure: func(t *testing.T, updateHooks *hooks.RequestUpdatedHooks) {
+				unregister := updateHooks.Register(func(p peer.ID, requestData graphsync.RequestData, updateData graphsync.RequestData, hookActions graphsync.RequestUpdatedHookActions) {
+					hookActions.UnpauseResponse()
+				})
+				unregister()
+			},
+			assert: func(t *testing.T, result hooks.UpdateResult) {
+				require.Empty(t, result.Extensions)
+				require.NoError(t, result.Err)
+				require.False(t, result.Unpause)
+			},
+		},
 	}
 	for testCase, data := range testCases {
 		t.Run(testCase, func(t *testing.T) {
@@ -379,7 +504,7 @@ func TestUpdateHookProcessing(t *testing.T) {
 			if data.configure != nil {
 				data.configure(t, updateHooks)
 			}
-			result := updateHooks.ProcessUpdateHooks(p, request, update)
+			result := updateHooks.ProcessUpdateHooks(context.Background(), p, request, update)
 			if data.assert != nil {
 				data.assert(t, result)
 			}
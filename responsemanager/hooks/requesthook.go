@@ -1,14 +1,18 @@
 package hooks
 
 import (
+	"context"
 	"errors"
+	"time"
 
-	"github.com/hannahhoward/go-pubsub"
+	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-ipld-prime"
 	"github.com/ipld/go-ipld-prime/traversal"
 	peer "github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/hookset"
+	"github.com/ipfs/go-graphsync/ipldutil"
 )
 
 // PersistenceOptions is an interface for getting loaders by name
@@ -19,7 +23,7 @@ type PersistenceOptions interface {
 // IncomingRequestHooks is a set of incoming request hooks that can be processed
 type IncomingRequestHooks struct {
 	persistenceOptions PersistenceOptions
-	pubSub             *pubsub.PubSub
+	hookSet            *hookset.HookSet
 }
 
 type internalRequestHookEvent struct {
@@ -28,10 +32,14 @@ type internalRequestHookEvent struct {
 	rha     *requestHookActions
 }
 
-func requestHookDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
+func requestHookDispatcher(event interface{}, hookFn interface{}, config graphsync.HookConfig) error {
 	ie := event.(internalRequestHookEvent)
-	hook := subscriberFn.(graphsync.OnIncomingRequestHook)
+	hook := hookFn.(graphsync.OnIncomingRequestHook)
+	ie.rha.stopValidated = false
 	hook(ie.p, ie.request, ie.rha)
+	if ie.rha.err == nil && ie.rha.stopValidated && config.StopAfterValidation {
+		return hookset.ErrStop
+	}
 	return ie.rha.err
 }
 
@@ -39,52 +47,107 @@ func requestHookDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn)
 func NewRequestHooks(persistenceOptions PersistenceOptions) *IncomingRequestHooks {
 	return &IncomingRequestHooks{
 		persistenceOptions: persistenceOptions,
-		pubSub:             pubsub.New(requestHookDispatcher),
+		hookSet:            hookset.New(requestHookDispatcher),
 	}
 }
 
 // Register registers an extension to process new incoming requests
-func (irh *IncomingRequestHooks) Register(hook graphsync.OnIncomingRequestHook) graphsync.UnregisterHookFunc {
-	return graphsync.UnregisterHookFunc(irh.pubSub.Subscribe(hook))
+func (irh *IncomingRequestHooks) Register(hook graphsync.OnIncomingRequestHook, options ...graphsync.HookOption) graphsync.UnregisterHookFunc {
+	return irh.hookSet.Register(hook, options...)
+}
+
+// Hooks describes the registered incoming request hooks in the order they run
+func (irh *IncomingRequestHooks) Hooks() []graphsync.HookInfo {
+	return irh.hookSet.Hooks(graphsync.HookKindIncomingRequest)
+}
+
+// UseMetrics reports each hook that runs to the given metrics. It should be
+// called before hooks run
+func (irh *IncomingRequestHooks) UseMetrics(metrics hookset.Metrics) {
+	irh.hookSet.UseMetrics(graphsync.HookKindIncomingRequest, metrics)
+}
+
+// OnPanic sets a listener for hooks that panic. It should be called before
+// hooks run
+func (irh *IncomingRequestHooks) OnPanic(listener hookset.PanicListener) {
+	irh.hookSet.OnPanic(listener)
 }
 
 // RequestResult is the outcome of running requesthooks
 type RequestResult struct {
-	IsValidated   bool
-	IsPaused      bool
-	CustomLoader  ipld.Loader
-	CustomChooser traversal.LinkTargetNodePrototypeChooser
-	Err           error
-	Extensions    []graphsync.ExtensionData
+	// Context is the context of the response, with any values hooks attached
+	Context            context.Context
+	IsValidated        bool
+	IsPaused           bool
+	PersistenceOption  string
+	CustomLoader       ipld.Loader
+	CustomChooser      traversal.LinkTargetNodePrototypeChooser
+	Reifier            graphsync.NodeReifier
+	CustomSelector     ipld.Node
+	CustomRoot         cid.Cid
+	Err                error
+	Extensions         []graphsync.ExtensionData
+	PeriodicExtensions []PeriodicExtension
+	// MaxSendRate is the most bytes per second the response is sent at, or
+	// zero if it isn't limited
+	MaxSendRate uint64
+	SendPacing  time.Duration
+}
+
+// PeriodicExtension is extension data sent at intervals while a response runs
+type PeriodicExtension struct {
+	Blocks   uint64
+	Interval time.Duration
+	Data     func(blocksTraversed uint64) graphsync.ExtensionData
 }
 
 // ProcessRequestHooks runs request hooks against an incoming request
-func (irh *IncomingRequestHooks) ProcessRequestHooks(p peer.ID, request graphsync.RequestData) RequestResult {
+func (irh *IncomingRequestHooks) ProcessRequestHooks(ctx context.Context, p peer.ID, request graphsync.RequestData) RequestResult {
 	ha := &requestHookActions{
+		ctx:                ctx,
 		persistenceOptions: irh.persistenceOptions,
 	}
-	_ = irh.pubSub.Publish(internalRequestHookEvent{p, request, ha})
+	if err := irh.hookSet.Publish(p, internalRequestHookEvent{p, request, ha}); err != nil {
+		ha.err = err
+	}
 	return ha.result()
 }
 
 type requestHookActions struct {
+	ctx                context.Context
 	persistenceOptions PersistenceOptions
 	isValidated        bool
+	stopValidated      bool
 	isPaused           bool
 	err                error
+	persistenceOption  string
 	loader             ipld.Loader
 	chooser            traversal.LinkTargetNodePrototypeChooser
+	reifier            graphsync.NodeReifier
+	selector           ipld.Node
+	root               cid.Cid
 	extensions         []graphsync.ExtensionData
+	periodicExtensions []PeriodicExtension
+	maxSendRate        uint64
+	sendPacing         time.Duration
 }
 
 func (ha *requestHookActions) result() RequestResult {
 	return RequestResult{
-		IsValidated:   ha.isValidated,
-		IsPaused:      ha.isPaused,
-		CustomLoader:  ha.loader,
-		CustomChooser: ha.chooser,
-		Err:           ha.err,
-		Extensions:    ha.extensions,
+		Context:            ha.ctx,
+		IsValidated:        ha.isValidated,
+		IsPaused:           ha.isPaused,
+		PersistenceOption:  ha.persistenceOption,
+		CustomLoader:       ha.loader,
+		CustomChooser:      ha.chooser,
+		Reifier:            ha.reifier,
+		CustomSelector:     ha.selector,
+		CustomRoot:         ha.root,
+		Err:                ha.err,
+		Extensions:         ha.extensions,
+		PeriodicExtensions: ha.periodicExtensions,
+		MaxSendRate:        ha.maxSendRate,
+		SendPacing:         ha.sendPacing,
 	}
 }
 
@@ -92,12 +155,29 @@ func (ha *requestHookActions) SendExtensionData(ext graphsync.ExtensionData) {
 	ha.extensions = append(ha.extensions, ext)
 }
 
+func (ha *requestHookActions) SendExtensionDataPeriodically(blocks uint64, interval time.Duration, data func(blocksTraversed uint64) graphsync.ExtensionData) {
+	if blocks == 0 && interval <= 0 {
+		return
+	}
+	ha.periodicExtensions = append(ha.periodicExtensions, PeriodicExtension{blocks, interval, data})
+}
+
+func (ha *requestHookActions) LimitSendRate(bytesPerSecond uint64, pacing time.Duration) {
+	ha.maxSendRate = bytesPerSecond
+	ha.sendPacing = pacing
+}
+
 func (ha *requestHookActions) TerminateWithError(err error) {
 	ha.err = err
 }
 
 func (ha *requestHookActions) ValidateRequest() {
 	ha.isValidated = true
+	ha.stopValidated = true
+}
+
+func (ha *requestHookActions) ValidateAndContinue() {
+	ha.isValidated = true
 }
 
 func (ha *requestHookActions) UsePersistenceOption(name string) {
@@ -106,6 +186,7 @@ func (ha *requestHookActions) UsePersistenceOption(name string) {
 		ha.TerminateWithError(errors.New("unknown loader option"))
 		return
 	}
+	ha.persistenceOption = name
 	ha.loader = loader
 }
 
@@ -113,6 +194,30 @@ func (ha *requestHookActions) UseLinkTargetNodePrototypeChooser(chooser traversa
 	ha.chooser = chooser
 }
 
+func (ha *requestHookActions) UseNodeReifier(reifier graphsync.NodeReifier) {
+	ha.reifier = reifier
+}
+
+func (ha *requestHookActions) UseRoot(root cid.Cid) {
+	ha.root = root
+}
+
+func (ha *requestHookActions) UseSelector(selector ipld.Node) {
+	if _, err := ipldutil.ParseSelector(selector); err != nil {
+		ha.TerminateWithError(err)
+		return
+	}
+	ha.selector = selector
+}
+
+func (ha *requestHookActions) SetContextValue(key, value interface{}) {
+	ha.ctx = context.WithValue(ha.ctx, key, value)
+}
+
 func (ha *requestHookActions) PauseResponse() {
 	ha.isPaused = true
 }
+
+func (ha *requestHookActions) Context() context.Context {
+	return ha.ctx
+}
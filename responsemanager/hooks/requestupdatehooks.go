@@ -1,15 +1,17 @@
 package hooks
 
 import (
-	"github.com/hannahhoward/go-pubsub"
+	"context"
+
 	peer "github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/hookset"
 )
 
 // RequestUpdatedHooks manages and runs hooks for request updates
 type RequestUpdatedHooks struct {
-	pubSub *pubsub.PubSub
+	hookSet *hookset.HookSet
 }
 
 type internalRequestUpdateEvent struct {
@@ -19,21 +21,38 @@ type internalRequestUpdateEvent struct {
 	uha     *updateHookActions
 }
 
-func updateHookDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
+func updateHookDispatcher(event interface{}, hookFn interface{}, _ graphsync.HookConfig) error {
 	ie := event.(internalRequestUpdateEvent)
-	hook := subscriberFn.(graphsync.OnRequestUpdatedHook)
+	hook := hookFn.(graphsync.OnRequestUpdatedHook)
 	hook(ie.p, ie.request, ie.update, ie.uha)
 	return ie.uha.err
 }
 
 // NewUpdateHooks returns a new list of request updated hooks
 func NewUpdateHooks() *RequestUpdatedHooks {
-	return &RequestUpdatedHooks{pubSub: pubsub.New(updateHookDispatcher)}
+	return &RequestUpdatedHooks{hookSet: hookset.New(updateHookDispatcher)}
 }
 
 // Register registers an hook to process updates to requests
-func (ruh *RequestUpdatedHooks) Register(hook graphsync.OnRequestUpdatedHook) graphsync.UnregisterHookFunc {
-	return graphsync.UnregisterHookFunc(ruh.pubSub.Subscribe(hook))
+func (ruh *RequestUpdatedHooks) Register(hook graphsync.OnRequestUpdatedHook, options ...graphsync.HookOption) graphsync.UnregisterHookFunc {
+	return ruh.hookSet.Register(hook, options...)
+}
+
+// Hooks describes the registered request updated hooks in the order they run
+func (ruh *RequestUpdatedHooks) Hooks() []graphsync.HookInfo {
+	return ruh.hookSet.Hooks(graphsync.HookKindRequestUpdated)
+}
+
+// UseMetrics reports each hook that runs to the given metrics. It should be
+// called before hooks run
+func (ruh *RequestUpdatedHooks) UseMetrics(metrics hookset.Metrics) {
+	ruh.hookSet.UseMetrics(graphsync.HookKindRequestUpdated, metrics)
+}
+
+// OnPanic sets a listener for hooks that panic. It should be called before
+// hooks run
+func (ruh *RequestUpdatedHooks) OnPanic(listener hookset.PanicListener) {
+	ruh.hookSet.OnPanic(listener)
 }
 
 // UpdateResult is the result of running update hooks
@@ -44,13 +63,16 @@ type UpdateResult struct {
 }
 
 // ProcessUpdateHooks runs request hooks against an incoming request
-func (ruh *RequestUpdatedHooks) ProcessUpdateHooks(p peer.ID, request graphsync.RequestData, update graphsync.RequestData) UpdateResult {
-	ha := &updateHookActions{}
-	_ = ruh.pubSub.Publish(internalRequestUpdateEvent{p, request, update, ha})
+func (ruh *RequestUpdatedHooks) ProcessUpdateHooks(ctx context.Context, p peer.ID, request graphsync.RequestData, update graphsync.RequestData) UpdateResult {
+	ha := &updateHookActions{ctx: ctx}
+	if err := ruh.hookSet.Publish(p, internalRequestUpdateEvent{p, request, update, ha}); err != nil {
+		ha.err = err
+	}
 	return ha.result()
 }
 
 type updateHookActions struct {
+	ctx        context.Context
 	err        error
 	unpause    bool
 	extensions []graphsync.ExtensionData
@@ -71,3 +93,7 @@ func (uha *updateHookActions) TerminateWithError(err error) {
 func (uha *updateHookActions) UnpauseResponse() {
 	uha.unpause = true
 }
+
+func (uha *updateHookActions) Context() context.Context {
+	return uha.ctx
+}
@@ -2,27 +2,39 @@ package peerresponsemanager
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log"
 	"github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/compression"
+	"github.com/ipfs/go-graphsync/ipldutil"
 	"github.com/ipfs/go-graphsync/linktracker"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/messagequeue"
+	"github.com/ipfs/go-graphsync/metadata"
 	"github.com/ipfs/go-graphsync/notifications"
 	"github.com/ipfs/go-graphsync/peermanager"
 	"github.com/ipfs/go-graphsync/responsemanager/responsebuilder"
 )
 
 const (
-	// max block size is the maximum size for batching blocks in a single payload
-	maxBlockSize uint64 = 512 * 1024
+	// defaultMaxBlockSize is the default maximum size for batching blocks in a
+	// single payload
+	defaultMaxBlockSize uint64 = 512 * 1024
+	// defaultCompletionBatchDelay is how long to hold a message containing only
+	// request completions by default, so completions for other requests can
+	// join it
+	defaultCompletionBatchDelay = 5 * time.Millisecond
 )
 
 var log = logging.Logger("graphsync")
@@ -56,6 +68,20 @@ type Allocator interface {
 	ReleaseBlockMemory(p peer.ID, amount uint64) error
 }
 
+// Metrics receives gauges describing the backlog of responses queued for a peer,
+// such as for export to Prometheus
+type Metrics interface {
+	// PendingBuilders is the number of responses being assembled but not yet
+	// handed to the message queue
+	PendingBuilders(p peer.ID, count int)
+	// PendingBytes is the total size of blocks in responses not yet handed to the
+	// message queue
+	PendingBytes(p peer.ID, bytes uint64)
+	// MessagesInFlight is the number of messages handed to the message queue
+	// that have not finished sending
+	MessagesInFlight(p peer.ID, count int)
+}
+
 // Transaction is a series of operations that should be send together in a single response
 type Transaction func(PeerResponseTransactionSender) error
 
@@ -65,15 +91,32 @@ type peerResponseSender struct {
 	cancel       context.CancelFunc
 	peerHandler  PeerMessageHandler
 	allocator    Allocator
+	metrics      Metrics
 	outgoingWork chan struct{}
 
+	newLinkTracker func() linktracker.Tracker
+
 	linkTrackerLk       sync.RWMutex
-	linkTracker         *linktracker.LinkTracker
-	altTrackers         map[string]*linktracker.LinkTracker
+	linkTracker         linktracker.Tracker
+	restoredLinks       *linktracker.LinkTracker
+	saveLinkTracker     func([]byte) error
+	altTrackers         map[string]linktracker.Tracker
 	dedupKeys           map[graphsync.RequestID]string
+	requestTrackers     map[graphsync.RequestID]linktracker.Tracker
+	metadataOnly        map[graphsync.RequestID]struct{}
+	metadataV2          map[graphsync.RequestID]struct{}
+	partial             map[graphsync.RequestID]struct{}
+	blockIndexes        map[graphsync.RequestID]int64
+	blockCompression    map[graphsync.RequestID]compression.Algorithm
+	sendRateLimits      map[graphsync.RequestID]*sendRateLimit
 	responseBuildersLk  sync.RWMutex
 	responseBuilders    []*responsebuilder.ResponseBuilder
 	nextBuilderTopic    responsebuilder.Topic
+	separateRequests    bool
+	maxBlockSize        uint64
+	completionDelay     time.Duration
+	requestBuilders     map[graphsync.RequestID]*responsebuilder.ResponseBuilder
+	messagesInFlight    int64
 	queuedMessages      chan responsebuilder.Topic
 	subscriber          *notifications.TopicDataSubscriber
 	allocatorSubscriber *notifications.TopicDataSubscriber
@@ -85,7 +128,50 @@ type peerResponseSender struct {
 type PeerResponseSender interface {
 	peermanager.PeerProcess
 	DedupKey(requestID graphsync.RequestID, key string)
+	// MetadataOnly sends only response metadata and never block data for the
+	// given request
+	MetadataOnly(requestID graphsync.RequestID)
+	// UseMetadataV2 sends response metadata for the given request in the v2
+	// format as well as the v1 format, on every response for the request
+	UseMetadataV2(requestID graphsync.RequestID)
+	// CompletePartial completes the given request with
+	// RequestCompletedPartial even if every block it traversed was sent, for
+	// responses that cover less than the requestor asked for
+	CompletePartial(requestID graphsync.RequestID)
+	// DedupWithinRequest only dedups blocks sent for the given request against
+	// each other, not against blocks sent for other requests
+	DedupWithinRequest(requestID graphsync.RequestID)
+	// UseCompression compresses block payloads sent for the given request with
+	// the given algorithm. Blocks for requests that did not ask for compression
+	// are never sent in the same message
+	UseCompression(requestID graphsync.RequestID, algorithm compression.Algorithm)
+	// SeparateRequests builds responses for each request into their own
+	// messages, so that messages can be sent to the peer over parallel streams
+	// while each request's responses stay in order
+	SeparateRequests()
+	// BatchLimits sets the most block bytes batched into a single message, and
+	// how long a message with only request completions is held for others to
+	// join it. It should be called before any responses are sent
+	BatchLimits(maxBlockSize uint64, completionDelay time.Duration)
 	IgnoreBlocks(requestID graphsync.RequestID, links []ipld.Link)
+	// PersistLinkTracker restores link tracker state saved by an earlier sender
+	// for the peer, if saved is not nil, and saves state with save when
+	// SaveLinkTracker is called or the sender shuts down. A restored request
+	// only skips the blocks it was sent before if it traverses from the same
+	// root; state for requests the peer does not send again is dropped at the
+	// next save. It should be called before any responses are sent
+	PersistLinkTracker(saved []byte, save func([]byte) error) error
+	// SaveLinkTracker saves the state of the link tracker shared by requests
+	// to the peer, or passes nil to save if no request has traversed anything.
+	// Only unbounded link trackers can be saved
+	SaveLinkTracker() error
+	// LimitSendRate paces data sent for the given request to at most
+	// bytesPerSecond, in bursts of at most a pacing interval's worth. Sending
+	// never blocks -- callers check SendDelay and hold off sending more
+	LimitSendRate(requestID graphsync.RequestID, bytesPerSecond uint64, pacing time.Duration)
+	// SendDelay returns how long to wait before sending more data for the given
+	// request keeps it within its send rate, or zero if it can send now
+	SendDelay(requestID graphsync.RequestID) time.Duration
 	SendResponse(
 		requestID graphsync.RequestID,
 		link ipld.Link,
@@ -108,6 +194,10 @@ type PeerResponseTransactionSender interface {
 		link ipld.Link,
 		data []byte,
 	) graphsync.BlockData
+	// SkipBlock marks the block for a link sent earlier in the transaction not
+	// present, so it is left out of the response. It returns the block data
+	// as it is now sent, or nil if no block was sent for the link
+	SkipBlock(link ipld.Link) graphsync.BlockData
 	SendExtensionData(graphsync.ExtensionData)
 	FinishWithCancel()
 	FinishRequest() graphsync.ResponseStatusCode
@@ -117,21 +207,38 @@ type PeerResponseTransactionSender interface {
 }
 
 // NewResponseSender generates a new PeerResponseSender for the given context, peer ID,
-// using the given peer message handler.
-func NewResponseSender(ctx context.Context, p peer.ID, peerHandler PeerMessageHandler, allocator Allocator) PeerResponseSender {
+// using the given peer message handler. Queue gauges are reported to metrics
+// if it is not nil. Link trackers used to dedup blocks are made with
+// newLinkTracker, or are unbounded if it is nil.
+func NewResponseSender(ctx context.Context, p peer.ID, peerHandler PeerMessageHandler, allocator Allocator, metrics Metrics, newLinkTracker func() linktracker.Tracker) PeerResponseSender {
 	ctx, cancel := context.WithCancel(ctx)
+	if newLinkTracker == nil {
+		newLinkTracker = func() linktracker.Tracker { return linktracker.New() }
+	}
 	prs := &peerResponseSender{
-		p:              p,
-		ctx:            ctx,
-		cancel:         cancel,
-		peerHandler:    peerHandler,
-		outgoingWork:   make(chan struct{}, 1),
-		linkTracker:    linktracker.New(),
-		dedupKeys:      make(map[graphsync.RequestID]string),
-		altTrackers:    make(map[string]*linktracker.LinkTracker),
-		queuedMessages: make(chan responsebuilder.Topic, 1),
-		publisher:      notifications.NewPublisher(),
-		allocator:      allocator,
+		p:                p,
+		ctx:              ctx,
+		cancel:           cancel,
+		peerHandler:      peerHandler,
+		outgoingWork:     make(chan struct{}, 1),
+		newLinkTracker:   newLinkTracker,
+		linkTracker:      newLinkTracker(),
+		dedupKeys:        make(map[graphsync.RequestID]string),
+		requestTrackers:  make(map[graphsync.RequestID]linktracker.Tracker),
+		metadataOnly:     make(map[graphsync.RequestID]struct{}),
+		partial:          make(map[graphsync.RequestID]struct{}),
+		metadataV2:       make(map[graphsync.RequestID]struct{}),
+		blockIndexes:     make(map[graphsync.RequestID]int64),
+		blockCompression: make(map[graphsync.RequestID]compression.Algorithm),
+		sendRateLimits:   make(map[graphsync.RequestID]*sendRateLimit),
+		maxBlockSize:     defaultMaxBlockSize,
+		completionDelay:  defaultCompletionBatchDelay,
+		altTrackers:      make(map[string]linktracker.Tracker),
+		requestBuilders:  make(map[graphsync.RequestID]*responsebuilder.ResponseBuilder),
+		queuedMessages:   make(chan responsebuilder.Topic, 1),
+		publisher:        notifications.NewPublisher(),
+		allocator:        allocator,
+		metrics:          metrics,
 	}
 	prs.subscriber = notifications.NewTopicDataSubscriber(&subscriber{prs})
 	prs.allocatorSubscriber = notifications.NewTopicDataSubscriber(&allocatorSubscriber{prs})
@@ -143,7 +250,10 @@ func (prs *peerResponseSender) Startup() {
 	go prs.run()
 }
 
-func (prs *peerResponseSender) getLinkTracker(requestID graphsync.RequestID) *linktracker.LinkTracker {
+func (prs *peerResponseSender) getLinkTracker(requestID graphsync.RequestID) linktracker.Tracker {
+	if linkTracker, ok := prs.requestTrackers[requestID]; ok {
+		return linkTracker
+	}
 	key, ok := prs.dedupKeys[requestID]
 	if ok {
 		return prs.altTrackers[key]
@@ -157,10 +267,71 @@ func (prs *peerResponseSender) DedupKey(requestID graphsync.RequestID, key strin
 	prs.dedupKeys[requestID] = key
 	_, ok := prs.altTrackers[key]
 	if !ok {
-		prs.altTrackers[key] = linktracker.New()
+		prs.altTrackers[key] = prs.newLinkTracker()
 	}
 }
 
+// MetadataOnly gives the request its own link tracker, so that its traversal
+// is still tracked without marking blocks as sent for other requests
+func (prs *peerResponseSender) MetadataOnly(requestID graphsync.RequestID) {
+	prs.linkTrackerLk.Lock()
+	defer prs.linkTrackerLk.Unlock()
+	prs.requestTrackers[requestID] = prs.newLinkTracker()
+	prs.metadataOnly[requestID] = struct{}{}
+}
+
+func (prs *peerResponseSender) UseMetadataV2(requestID graphsync.RequestID) {
+	prs.linkTrackerLk.Lock()
+	defer prs.linkTrackerLk.Unlock()
+	prs.metadataV2[requestID] = struct{}{}
+}
+
+func (prs *peerResponseSender) usesMetadataV2(requestID graphsync.RequestID) bool {
+	prs.linkTrackerLk.RLock()
+	defer prs.linkTrackerLk.RUnlock()
+	_, ok := prs.metadataV2[requestID]
+	return ok
+}
+
+func (prs *peerResponseSender) CompletePartial(requestID graphsync.RequestID) {
+	prs.linkTrackerLk.Lock()
+	defer prs.linkTrackerLk.Unlock()
+	prs.partial[requestID] = struct{}{}
+}
+
+// DedupWithinRequest gives the request its own link tracker, so that it is
+// sent every block it traverses even if another request already sent it
+func (prs *peerResponseSender) DedupWithinRequest(requestID graphsync.RequestID) {
+	prs.linkTrackerLk.Lock()
+	defer prs.linkTrackerLk.Unlock()
+	prs.requestTrackers[requestID] = prs.newLinkTracker()
+}
+
+func (prs *peerResponseSender) UseCompression(requestID graphsync.RequestID, algorithm compression.Algorithm) {
+	prs.linkTrackerLk.Lock()
+	defer prs.linkTrackerLk.Unlock()
+	prs.blockCompression[requestID] = algorithm
+}
+
+func (prs *peerResponseSender) compressionFor(requestID graphsync.RequestID) compression.Algorithm {
+	prs.linkTrackerLk.RLock()
+	defer prs.linkTrackerLk.RUnlock()
+	return prs.blockCompression[requestID]
+}
+
+func (prs *peerResponseSender) SeparateRequests() {
+	prs.responseBuildersLk.Lock()
+	defer prs.responseBuildersLk.Unlock()
+	prs.separateRequests = true
+}
+
+func (prs *peerResponseSender) BatchLimits(maxBlockSize uint64, completionDelay time.Duration) {
+	prs.responseBuildersLk.Lock()
+	defer prs.responseBuildersLk.Unlock()
+	prs.maxBlockSize = maxBlockSize
+	prs.completionDelay = completionDelay
+}
+
 func (prs *peerResponseSender) IgnoreBlocks(requestID graphsync.RequestID, links []ipld.Link) {
 	prs.linkTrackerLk.Lock()
 	linkTracker := prs.getLinkTracker(requestID)
@@ -170,17 +341,110 @@ func (prs *peerResponseSender) IgnoreBlocks(requestID graphsync.RequestID, links
 	prs.linkTrackerLk.Unlock()
 }
 
+func (prs *peerResponseSender) PersistLinkTracker(saved []byte, save func([]byte) error) error {
+	prs.linkTrackerLk.Lock()
+	defer prs.linkTrackerLk.Unlock()
+	prs.saveLinkTracker = save
+	if saved == nil {
+		return nil
+	}
+	restoredLinks, err := linktracker.Decode(saved)
+	if err != nil {
+		return err
+	}
+	prs.restoredLinks = restoredLinks
+	return nil
+}
+
+func (prs *peerResponseSender) SaveLinkTracker() error {
+	prs.linkTrackerLk.RLock()
+	save := prs.saveLinkTracker
+	if save == nil {
+		prs.linkTrackerLk.RUnlock()
+		return nil
+	}
+	linkTracker, ok := prs.linkTracker.(*linktracker.LinkTracker)
+	if !ok {
+		prs.linkTrackerLk.RUnlock()
+		return errors.New("only unbounded link trackers can be saved")
+	}
+	var data []byte
+	var err error
+	if !linkTracker.Empty() {
+		data, err = linkTracker.Encode()
+	}
+	prs.linkTrackerLk.RUnlock()
+	if err != nil {
+		return err
+	}
+	return save(data)
+}
+
+// resumeTraversal carries over the links a request traversed before the
+// link tracker was restored, if the request starts from the same root as it
+// did then. It must be called with linkTrackerLk held
+func (prs *peerResponseSender) resumeTraversal(requestID graphsync.RequestID, root ipld.Link) {
+	if prs.restoredLinks == nil {
+		return
+	}
+	links := prs.restoredLinks.LinksWithBlocks(requestID)
+	if len(links) > 0 && links[0] == root {
+		prs.restoredLinks.MoveRequest(requestID, prs.getLinkTracker(requestID))
+		return
+	}
+	prs.restoredLinks.FinishRequest(requestID)
+}
+
+func (prs *peerResponseSender) LimitSendRate(requestID graphsync.RequestID, bytesPerSecond uint64, pacing time.Duration) {
+	prs.linkTrackerLk.Lock()
+	defer prs.linkTrackerLk.Unlock()
+	if bytesPerSecond == 0 {
+		delete(prs.sendRateLimits, requestID)
+		return
+	}
+	prs.sendRateLimits[requestID] = newSendRateLimit(bytesPerSecond, pacing, time.Now())
+}
+
+func (prs *peerResponseSender) SendDelay(requestID graphsync.RequestID) time.Duration {
+	prs.linkTrackerLk.Lock()
+	defer prs.linkTrackerLk.Unlock()
+	sendRateLimit, ok := prs.sendRateLimits[requestID]
+	if !ok {
+		return 0
+	}
+	return sendRateLimit.reserve(0, time.Now())
+}
+
+// chargeSendRate takes the size of data sent for the given request from its
+// send rate limit, if it has one
+func (prs *peerResponseSender) chargeSendRate(requestID graphsync.RequestID, size uint64) {
+	prs.linkTrackerLk.Lock()
+	defer prs.linkTrackerLk.Unlock()
+	if sendRateLimit, ok := prs.sendRateLimits[requestID]; ok {
+		sendRateLimit.reserve(size, time.Now())
+	}
+}
+
 type responseOperation interface {
 	build(responseBuilder *responsebuilder.ResponseBuilder)
 	size() uint64
 }
 
-func (prs *peerResponseSender) execute(operations []responseOperation, notifees []notifications.Notifee) {
+func (prs *peerResponseSender) execute(requestID graphsync.RequestID, operations []responseOperation, notifees []notifications.Notifee) {
 	size := uint64(0)
 	for _, op := range operations {
 		size += op.size()
 	}
-	if prs.buildResponse(size, func(responseBuilder *responsebuilder.ResponseBuilder) {
+	if size > 0 {
+		prs.chargeSendRate(requestID, size)
+	}
+	metadataV2 := prs.usesMetadataV2(requestID)
+	algorithm := prs.compressionFor(requestID)
+	if prs.buildResponse(requestID, size, algorithm, func(responseBuilder *responsebuilder.ResponseBuilder) {
+		// every response for the request carries the same metadata formats
+		if metadataV2 {
+			responseBuilder.UseMetadataV2(requestID)
+		}
 		for _, op := range operations {
 			op.build(responseBuilder)
 		}
@@ -189,9 +453,13 @@ func (prs *peerResponseSender) execute(operations []responseOperation, notifees
 	}
 }
 
-// Shutdown stops sending messages for a peer
+// Shutdown stops sending messages for a peer, saving the state of its link
+// tracker if it is persisted
 func (prs *peerResponseSender) Shutdown() {
 	prs.cancel()
+	if err := prs.SaveLinkTracker(); err != nil {
+		log.Warnf("unable to save link tracker for peer %s: %s", prs.p, err)
+	}
 }
 
 type extensionOperation struct {
@@ -208,7 +476,7 @@ func (eo extensionOperation) size() uint64 {
 }
 
 func (prs *peerResponseSender) SendExtensionData(requestID graphsync.RequestID, extension graphsync.ExtensionData, notifees ...notifications.Notifee) {
-	prs.execute([]responseOperation{extensionOperation{requestID, extension}}, notifees)
+	prs.execute(requestID, []responseOperation{extensionOperation{requestID, extension}}, notifees)
 }
 
 type peerResponseTransactionSender struct {
@@ -224,6 +492,25 @@ func (prts *peerResponseTransactionSender) SendResponse(link ipld.Link, data []b
 	return op
 }
 
+func (prts *peerResponseTransactionSender) SkipBlock(link ipld.Link) graphsync.BlockData {
+	for i := len(prts.operations) - 1; i >= 0; i-- {
+		op, ok := prts.operations[i].(blockOperation)
+		if !ok || op.link != link || op.data == nil {
+			continue
+		}
+		op.data = nil
+		op.sendBlock = false
+		prts.operations[i] = op
+		prts.prs.linkTrackerLk.Lock()
+		linkTracker := prts.prs.getLinkTracker(prts.requestID)
+		linkTracker.UndoBlockTraversal(prts.requestID, link)
+		linkTracker.RecordLinkTraversal(prts.requestID, link, false)
+		prts.prs.linkTrackerLk.Unlock()
+		return op
+	}
+	return nil
+}
+
 func (prts *peerResponseTransactionSender) SendExtensionData(extension graphsync.ExtensionData) {
 	prts.operations = append(prts.operations, extensionOperation{prts.requestID, extension})
 }
@@ -239,7 +526,7 @@ func (prts *peerResponseTransactionSender) FinishWithError(status graphsync.Resp
 }
 
 func (prts *peerResponseTransactionSender) PauseRequest() {
-	prts.operations = append(prts.operations, statusOperation{prts.requestID, graphsync.RequestPaused})
+	prts.operations = append(prts.operations, statusOperation{prts.requestID, graphsync.RequestPaused, false})
 }
 
 func (prts *peerResponseTransactionSender) FinishWithCancel() {
@@ -257,16 +544,18 @@ func (prs *peerResponseSender) Transaction(requestID graphsync.RequestID, transa
 	}
 	err := transaction(prts)
 	if err == nil {
-		prs.execute(prts.operations, prts.notifees)
+		prs.execute(requestID, prts.operations, prts.notifees)
 	}
 	return err
 }
 
 type blockOperation struct {
-	data      []byte
-	sendBlock bool
-	link      ipld.Link
-	requestID graphsync.RequestID
+	data         []byte
+	sendBlock    bool
+	link         ipld.Link
+	requestID    graphsync.RequestID
+	index        int64
+	deduplicated bool
 }
 
 func (bo blockOperation) build(responseBuilder *responsebuilder.ResponseBuilder) {
@@ -278,7 +567,12 @@ func (bo blockOperation) build(responseBuilder *responsebuilder.ResponseBuilder)
 		}
 		responseBuilder.AddBlock(block)
 	}
-	responseBuilder.AddLink(bo.requestID, bo.link, bo.data != nil)
+	responseBuilder.AddMetadataItem(bo.requestID, metadata.Item{
+		Link:         bo.Cid(),
+		BlockPresent: bo.data != nil,
+		BlockSize:    bo.BlockSize(),
+		Index:        bo.index,
+	})
 }
 
 func (bo blockOperation) Link() ipld.Link {
@@ -296,6 +590,21 @@ func (bo blockOperation) BlockSizeOnWire() uint64 {
 	return bo.BlockSize()
 }
 
+func (bo blockOperation) Cid() cid.Cid {
+	if cidLink, ok := bo.link.(cidlink.Link); ok {
+		return cidLink.Cid
+	}
+	return cid.Undef
+}
+
+func (bo blockOperation) Index() int64 {
+	return bo.index
+}
+
+func (bo blockOperation) Deduplicated() bool {
+	return bo.deduplicated
+}
+
 func (bo blockOperation) size() uint64 {
 	return bo.BlockSizeOnWire()
 }
@@ -304,12 +613,22 @@ func (prs *peerResponseSender) setupBlockOperation(requestID graphsync.RequestID
 	link ipld.Link, data []byte) blockOperation {
 	hasBlock := data != nil
 	prs.linkTrackerLk.Lock()
+	index := prs.blockIndexes[requestID]
+	if index == 0 {
+		prs.resumeTraversal(requestID, link)
+	}
 	linkTracker := prs.getLinkTracker(requestID)
-	sendBlock := hasBlock && linkTracker.BlockRefCount(link) == 0
+	_, metadataOnly := prs.metadataOnly[requestID]
+	deduplicated := hasBlock && linkTracker.BlockRefCount(link) > 0
+	// blocks inlined in identity CIDs are marked present but never sent, as the
+	// requestor can recover them from the CID
+	_, identity := ipldutil.IdentityData(link)
+	sendBlock := hasBlock && !metadataOnly && !deduplicated && !identity
 	linkTracker.RecordLinkTraversal(requestID, link, hasBlock)
+	prs.blockIndexes[requestID] = index + 1
 	prs.linkTrackerLk.Unlock()
 	return blockOperation{
-		data, sendBlock, link, requestID,
+		data, sendBlock, link, requestID, index, deduplicated,
 	}
 }
 
@@ -324,16 +643,22 @@ func (prs *peerResponseSender) SendResponse(
 	notifees ...notifications.Notifee,
 ) graphsync.BlockData {
 	op := prs.setupBlockOperation(requestID, link, data)
-	prs.execute([]responseOperation{op}, notifees)
+	prs.execute(requestID, []responseOperation{op}, notifees)
 	return op
 }
 
 type statusOperation struct {
 	requestID graphsync.RequestID
 	status    graphsync.ResponseStatusCode
+	// metadataV2 is recorded for completions, as the request's settings are
+	// cleared by the time they are built
+	metadataV2 bool
 }
 
 func (fo statusOperation) build(responseBuilder *responsebuilder.ResponseBuilder) {
+	if fo.metadataV2 {
+		responseBuilder.UseMetadataV2(fo.requestID)
+	}
 	responseBuilder.AddResponseCode(fo.requestID, fo.status)
 }
 
@@ -346,6 +671,16 @@ func (prs *peerResponseSender) finishTracking(requestID graphsync.RequestID) boo
 	defer prs.linkTrackerLk.Unlock()
 	linkTracker := prs.getLinkTracker(requestID)
 	allBlocks := linkTracker.FinishRequest(requestID)
+	if _, partial := prs.partial[requestID]; partial {
+		allBlocks = false
+		delete(prs.partial, requestID)
+	}
+	delete(prs.requestTrackers, requestID)
+	delete(prs.metadataOnly, requestID)
+	delete(prs.metadataV2, requestID)
+	delete(prs.blockIndexes, requestID)
+	delete(prs.blockCompression, requestID)
+	delete(prs.sendRateLimits, requestID)
 	key, ok := prs.dedupKeys[requestID]
 	if ok {
 		delete(prs.dedupKeys, requestID)
@@ -364,6 +699,7 @@ func (prs *peerResponseSender) finishTracking(requestID graphsync.RequestID) boo
 }
 
 func (prs *peerResponseSender) setupFinishOperation(requestID graphsync.RequestID) statusOperation {
+	metadataV2 := prs.usesMetadataV2(requestID)
 	isComplete := prs.finishTracking(requestID)
 	var status graphsync.ResponseStatusCode
 	if isComplete {
@@ -371,36 +707,37 @@ func (prs *peerResponseSender) setupFinishOperation(requestID graphsync.RequestI
 	} else {
 		status = graphsync.RequestCompletedPartial
 	}
-	return statusOperation{requestID, status}
+	return statusOperation{requestID, status, metadataV2}
 }
 
 // FinishRequest marks the given requestID as having sent all responses
 func (prs *peerResponseSender) FinishRequest(requestID graphsync.RequestID, notifees ...notifications.Notifee) graphsync.ResponseStatusCode {
 	op := prs.setupFinishOperation(requestID)
-	prs.execute([]responseOperation{op}, notifees)
+	prs.execute(requestID, []responseOperation{op}, notifees)
 	return op.status
 }
 
 func (prs *peerResponseSender) setupFinishWithErrOperation(requestID graphsync.RequestID, status graphsync.ResponseStatusCode) statusOperation {
+	metadataV2 := prs.usesMetadataV2(requestID)
 	prs.finishTracking(requestID)
-	return statusOperation{requestID, status}
+	return statusOperation{requestID, status, metadataV2}
 }
 
 // FinishWithError marks the given requestID as having terminated with an error
 func (prs *peerResponseSender) FinishWithError(requestID graphsync.RequestID, status graphsync.ResponseStatusCode, notifees ...notifications.Notifee) {
 	op := prs.setupFinishWithErrOperation(requestID, status)
-	prs.execute([]responseOperation{op}, notifees)
+	prs.execute(requestID, []responseOperation{op}, notifees)
 }
 
 func (prs *peerResponseSender) PauseRequest(requestID graphsync.RequestID, notifees ...notifications.Notifee) {
-	prs.execute([]responseOperation{statusOperation{requestID, graphsync.RequestPaused}}, notifees)
+	prs.execute(requestID, []responseOperation{statusOperation{requestID, graphsync.RequestPaused, false}}, notifees)
 }
 
 func (prs *peerResponseSender) FinishWithCancel(requestID graphsync.RequestID) {
 	_ = prs.finishTracking(requestID)
 }
 
-func (prs *peerResponseSender) buildResponse(blkSize uint64, buildResponseFn func(*responsebuilder.ResponseBuilder), notifees []notifications.Notifee) bool {
+func (prs *peerResponseSender) buildResponse(requestID graphsync.RequestID, blkSize uint64, algorithm compression.Algorithm, buildResponseFn func(*responsebuilder.ResponseBuilder), notifees []notifications.Notifee) bool {
 	if blkSize > 0 {
 		select {
 		case <-prs.allocator.AllocateBlockMemory(prs.p, blkSize):
@@ -410,27 +747,81 @@ func (prs *peerResponseSender) buildResponse(blkSize uint64, buildResponseFn fun
 	}
 	prs.responseBuildersLk.Lock()
 	defer prs.responseBuildersLk.Unlock()
-	if shouldBeginNewResponse(prs.responseBuilders, blkSize) {
-		topic := prs.nextBuilderTopic
-		prs.nextBuilderTopic++
-		prs.responseBuilders = append(prs.responseBuilders, responsebuilder.New(topic))
+	responseBuilder := prs.currentBuilder(requestID, blkSize, algorithm)
+	if blkSize > 0 && algorithm != "" {
+		responseBuilder.CompressBlocks(requestID, algorithm)
 	}
-	responseBuilder := prs.responseBuilders[len(prs.responseBuilders)-1]
 	buildResponseFn(responseBuilder)
 	for _, notifee := range notifees {
 		notifications.SubscribeWithData(prs.publisher, responseBuilder.Topic(), notifee)
 	}
+	prs.reportPending()
 	return !responseBuilder.Empty()
 }
 
-func shouldBeginNewResponse(responseBuilders []*responsebuilder.ResponseBuilder, blkSize uint64) bool {
+// currentBuilder returns the response builder operations for the given request
+// should be added to, beginning a new one if needed. Blocks compressed with
+// different algorithms, or compressed and uncompressed, never share a builder.
+// It must be called with responseBuildersLk held
+func (prs *peerResponseSender) currentBuilder(requestID graphsync.RequestID, blkSize uint64, algorithm compression.Algorithm) *responsebuilder.ResponseBuilder {
+	if !prs.separateRequests {
+		if shouldBeginNewResponse(prs.responseBuilders, blkSize, prs.maxBlockSize, algorithm) {
+			prs.beginResponse()
+		}
+		return prs.responseBuilders[len(prs.responseBuilders)-1]
+	}
+	responseBuilder, ok := prs.requestBuilders[requestID]
+	if !ok || (blkSize > 0 && (responseBuilder.BlockSize()+blkSize > prs.maxBlockSize || !compressionMatches(responseBuilder, algorithm))) {
+		responseBuilder = prs.beginResponse()
+		prs.requestBuilders[requestID] = responseBuilder
+	}
+	return responseBuilder
+}
+
+func (prs *peerResponseSender) beginResponse() *responsebuilder.ResponseBuilder {
+	topic := prs.nextBuilderTopic
+	prs.nextBuilderTopic++
+	responseBuilder := responsebuilder.New(topic)
+	prs.responseBuilders = append(prs.responseBuilders, responseBuilder)
+	return responseBuilder
+}
+
+// reportPending reports gauges for response builders not yet sent. It must be
+// called with responseBuildersLk held
+func (prs *peerResponseSender) reportPending() {
+	if prs.metrics == nil {
+		return
+	}
+	pendingBytes := uint64(0)
+	for _, builder := range prs.responseBuilders {
+		pendingBytes += builder.BlockSize()
+	}
+	prs.metrics.PendingBuilders(prs.p, len(prs.responseBuilders))
+	prs.metrics.PendingBytes(prs.p, pendingBytes)
+}
+
+func (prs *peerResponseSender) updateMessagesInFlight(delta int64) {
+	messagesInFlight := atomic.AddInt64(&prs.messagesInFlight, delta)
+	if prs.metrics != nil {
+		prs.metrics.MessagesInFlight(prs.p, int(messagesInFlight))
+	}
+}
+
+func shouldBeginNewResponse(responseBuilders []*responsebuilder.ResponseBuilder, blkSize uint64, maxBlockSize uint64, algorithm compression.Algorithm) bool {
 	if len(responseBuilders) == 0 {
 		return true
 	}
 	if blkSize == 0 {
 		return false
 	}
-	return responseBuilders[len(responseBuilders)-1].BlockSize()+blkSize > maxBlockSize
+	last := responseBuilders[len(responseBuilders)-1]
+	return last.BlockSize()+blkSize > maxBlockSize || !compressionMatches(last, algorithm)
+}
+
+// compressionMatches returns whether blocks compressed with the given
+// algorithm can be added to the response builder
+func compressionMatches(responseBuilder *responsebuilder.ResponseBuilder, algorithm compression.Algorithm) bool {
+	return responseBuilder.BlockSize() == 0 || responseBuilder.BlockCompression() == algorithm
 }
 
 func (prs *peerResponseSender) signalWork() {
@@ -444,6 +835,11 @@ func (prs *peerResponseSender) run() {
 	defer func() {
 		prs.publisher.Shutdown()
 		prs.allocator.ReleasePeerMemory(prs.p)
+		if prs.metrics != nil {
+			prs.metrics.PendingBuilders(prs.p, 0)
+			prs.metrics.PendingBytes(prs.p, 0)
+			prs.metrics.MessagesInFlight(prs.p, 0)
+		}
 	}()
 	prs.publisher.Startup()
 	for {
@@ -451,15 +847,41 @@ func (prs *peerResponseSender) run() {
 		case <-prs.ctx.Done():
 			return
 		case <-prs.outgoingWork:
+			if !prs.waitForCompletionBatch() {
+				return
+			}
 			prs.sendResponseMessages()
 		}
 	}
 }
 
+// waitForCompletionBatch delays sending when the only pending content is
+// request completions, so that requests finishing at nearly the same time
+// share a single message. It returns false if the sender shut down while waiting
+func (prs *peerResponseSender) waitForCompletionBatch() bool {
+	prs.responseBuildersLk.RLock()
+	onlyCompletions := len(prs.responseBuilders) == 1 && prs.responseBuilders[0].OnlyCompletions()
+	completionDelay := prs.completionDelay
+	prs.responseBuildersLk.RUnlock()
+	if !onlyCompletions || completionDelay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(completionDelay)
+	defer timer.Stop()
+	select {
+	case <-prs.ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
 func (prs *peerResponseSender) sendResponseMessages() {
 	prs.responseBuildersLk.Lock()
 	builders := prs.responseBuilders
 	prs.responseBuilders = nil
+	prs.requestBuilders = make(map[graphsync.RequestID]*responsebuilder.ResponseBuilder)
+	prs.reportPending()
 	prs.responseBuildersLk.Unlock()
 
 	for _, builder := range builders {
@@ -475,6 +897,7 @@ func (prs *peerResponseSender) sendResponseMessages() {
 			log.Errorf("Unable to assemble GraphSync response: %s", err.Error())
 		}
 
+		prs.updateMessagesInFlight(1)
 		prs.peerHandler.SendResponse(prs.p, responses, blks, notifications.Notifee{
 			Data:       builder.Topic(),
 			Subscriber: prs.subscriber,
@@ -525,6 +948,7 @@ func (s *subscriber) OnNext(topic notifications.Topic, event notifications.Event
 }
 
 func (s *subscriber) OnClose(topic notifications.Topic) {
+	s.prs.updateMessagesInFlight(-1)
 	s.prs.publisher.Close(topic)
 }
 
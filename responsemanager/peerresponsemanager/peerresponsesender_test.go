@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"sync"
 	"testing"
 	"time"
 
@@ -15,8 +16,10 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/compression"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/messagequeue"
+	"github.com/ipfs/go-graphsync/metadata"
 	"github.com/ipfs/go-graphsync/notifications"
 	"github.com/ipfs/go-graphsync/responsemanager/allocator"
 	"github.com/ipfs/go-graphsync/testutil"
@@ -43,7 +46,7 @@ func TestPeerResponseSenderSendsResponses(t *testing.T) {
 	}
 	fph := newFakePeerHandler(ctx, t)
 	allocator := allocator.NewAllocator(1<<30, 1<<30)
-	peerResponseSender := NewResponseSender(ctx, p, fph, allocator)
+	peerResponseSender := NewResponseSender(ctx, p, fph, allocator, nil, nil)
 	peerResponseSender.Startup()
 
 	bd := peerResponseSender.SendResponse(requestID1, links[0], blks[0].RawData(), sendResponseNotifee1)
@@ -113,6 +116,66 @@ func TestPeerResponseSenderSendsResponses(t *testing.T) {
 	finishVerifier2.ExpectClose(ctx, t)
 }
 
+func TestPeerResponseSenderBatchesCompletions(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	p := testutil.GeneratePeers(1)[0]
+	requestID1 := graphsync.RequestID(rand.Int31())
+	requestID2 := graphsync.RequestID(rand.Int31())
+	requestID3 := graphsync.RequestID(rand.Int31())
+	fph := newFakePeerHandler(ctx, t)
+	allocator := allocator.NewAllocator(1<<30, 1<<30)
+	peerResponseSender := NewResponseSender(ctx, p, fph, allocator, nil, nil)
+	peerResponseSender.Startup()
+
+	peerResponseSender.FinishRequest(requestID1)
+	peerResponseSender.FinishWithError(requestID2, graphsync.RequestFailedContentNotFound)
+	peerResponseSender.FinishRequest(requestID3)
+
+	fph.AssertHasMessage("did not send completions")
+	fph.AssertResponses(expectedResponses{
+		requestID1: graphsync.RequestCompletedFull,
+		requestID2: graphsync.RequestFailedContentNotFound,
+		requestID3: graphsync.RequestCompletedFull,
+	})
+	fph.RefuteBlocks()
+}
+
+func TestPeerResponseSenderReportsMetrics(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	p := testutil.GeneratePeers(1)[0]
+	requestID1 := graphsync.RequestID(rand.Int31())
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	links := make([]ipld.Link, 0, len(blks))
+	for _, block := range blks {
+		links = append(links, cidlink.Link{Cid: block.Cid()})
+	}
+	fph := newFakePeerHandler(ctx, t)
+	allocator := allocator.NewAllocator(1<<30, 1<<30)
+	metrics := &fakeMetrics{}
+	peerResponseSender := NewResponseSender(ctx, p, fph, allocator, metrics, nil)
+	peerResponseSender.Startup()
+
+	peerResponseSender.SendResponse(requestID1, links[0], blks[0].RawData())
+	fph.AssertHasMessage("did not send first message")
+	metrics.assertGauges(t, 0, 0, 1)
+
+	// while the first message is in flight, further responses queue up
+	peerResponseSender.SendResponse(requestID1, links[1], blks[1].RawData())
+	peerResponseSender.SendResponse(requestID1, links[2], blks[2].RawData())
+	metrics.assertGauges(t, 1, 200, 1)
+
+	fph.notifySuccess()
+	fph.AssertHasMessage("did not send second message")
+	metrics.assertGauges(t, 0, 0, 1)
+
+	fph.notifySuccess()
+	metrics.assertGauges(t, 0, 0, 0)
+}
+
 func TestPeerResponseSenderSendsVeryLargeBlocksResponses(t *testing.T) {
 
 	p := testutil.GeneratePeers(1)[0]
@@ -128,7 +191,7 @@ func TestPeerResponseSenderSendsVeryLargeBlocksResponses(t *testing.T) {
 	}
 	fph := newFakePeerHandler(ctx, t)
 	allocator := allocator.NewAllocator(1<<30, 1<<30)
-	peerResponseSender := NewResponseSender(ctx, p, fph, allocator)
+	peerResponseSender := NewResponseSender(ctx, p, fph, allocator, nil, nil)
 	peerResponseSender.Startup()
 
 	peerResponseSender.SendResponse(requestID1, links[0], blks[0].RawData())
@@ -189,7 +252,7 @@ func TestPeerResponseSenderSendsExtensionData(t *testing.T) {
 	}
 	fph := newFakePeerHandler(ctx, t)
 	allocator := allocator.NewAllocator(1<<30, 1<<30)
-	peerResponseSender := NewResponseSender(ctx, p, fph, allocator)
+	peerResponseSender := NewResponseSender(ctx, p, fph, allocator, nil, nil)
 	peerResponseSender.Startup()
 
 	peerResponseSender.SendResponse(requestID1, links[0], blks[0].RawData())
@@ -233,7 +296,7 @@ func TestPeerResponseSenderSendsResponsesInTransaction(t *testing.T) {
 	}
 	fph := newFakePeerHandler(ctx, t)
 	allocator := allocator.NewAllocator(1<<30, 1<<30)
-	peerResponseSender := NewResponseSender(ctx, p, fph, allocator)
+	peerResponseSender := NewResponseSender(ctx, p, fph, allocator, nil, nil)
 	peerResponseSender.Startup()
 	notifee, notifeeVerifier := testutil.NewTestNotifee("transaction", 10)
 	err := peerResponseSender.Transaction(requestID1, func(peerResponseSender PeerResponseTransactionSender) error {
@@ -262,6 +325,73 @@ func TestPeerResponseSenderSendsResponsesInTransaction(t *testing.T) {
 	notifeeVerifier.ExpectClose(ctx, t)
 }
 
+func TestPeerResponseSenderSkipBlock(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	p := testutil.GeneratePeers(1)[0]
+	requestID1 := graphsync.RequestID(rand.Int31())
+	requestID2 := graphsync.RequestID(rand.Int31())
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	links := make([]ipld.Link, 0, len(blks))
+	for _, block := range blks {
+		links = append(links, cidlink.Link{Cid: block.Cid()})
+	}
+	fph := newFakePeerHandler(ctx, t)
+	allocator := allocator.NewAllocator(1<<30, 1<<30)
+	peerResponseSender := NewResponseSender(ctx, p, fph, allocator, nil, nil)
+	peerResponseSender.Startup()
+
+	err := peerResponseSender.Transaction(requestID1, func(peerResponseSender PeerResponseTransactionSender) error {
+		peerResponseSender.SendResponse(links[0], blks[0].RawData())
+		skipped := peerResponseSender.SkipBlock(links[0])
+		require.Equal(t, links[0], skipped.Link())
+		require.Zero(t, skipped.BlockSizeOnWire())
+		require.Nil(t, peerResponseSender.SkipBlock(links[1]))
+		peerResponseSender.SendResponse(links[1], blks[1].RawData())
+		peerResponseSender.FinishRequest()
+		return nil
+	})
+	require.NoError(t, err)
+	fph.AssertHasMessage("did not send first message")
+	fph.AssertBlocks(blks[1])
+	fph.AssertResponses(expectedResponses{
+		requestID1: graphsync.RequestCompletedPartial,
+	})
+
+	// a skipped block was never sent, so it is not deduped for other requests
+	bd := peerResponseSender.SendResponse(requestID2, links[0], blks[0].RawData())
+	assertSentOnWire(t, bd, blks[0])
+	require.False(t, bd.Deduplicated())
+}
+
+func TestPeerResponseSenderCompletePartial(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	p := testutil.GeneratePeers(1)[0]
+	requestID1 := graphsync.RequestID(rand.Int31())
+	blks := testutil.GenerateBlocksOfSize(1, 100)
+	fph := newFakePeerHandler(ctx, t)
+	allocator := allocator.NewAllocator(1<<30, 1<<30)
+	peerResponseSender := NewResponseSender(ctx, p, fph, allocator, nil, nil)
+	peerResponseSender.Startup()
+
+	peerResponseSender.CompletePartial(requestID1)
+	err := peerResponseSender.Transaction(requestID1, func(peerResponseSender PeerResponseTransactionSender) error {
+		peerResponseSender.SendResponse(cidlink.Link{Cid: blks[0].Cid()}, blks[0].RawData())
+		// every block was sent, but the response is still partial
+		require.Equal(t, graphsync.RequestCompletedPartial, peerResponseSender.FinishRequest())
+		return nil
+	})
+	require.NoError(t, err)
+	fph.AssertHasMessage("did not send message")
+	fph.AssertBlocks(blks[0])
+	fph.AssertResponses(expectedResponses{
+		requestID1: graphsync.RequestCompletedPartial,
+	})
+}
+
 func TestPeerResponseSenderIgnoreBlocks(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
@@ -276,7 +406,7 @@ func TestPeerResponseSenderIgnoreBlocks(t *testing.T) {
 	}
 	fph := newFakePeerHandler(ctx, t)
 	allocator := allocator.NewAllocator(1<<30, 1<<30)
-	peerResponseSender := NewResponseSender(ctx, p, fph, allocator)
+	peerResponseSender := NewResponseSender(ctx, p, fph, allocator, nil, nil)
 	peerResponseSender.Startup()
 
 	peerResponseSender.IgnoreBlocks(requestID1, links)
@@ -318,6 +448,289 @@ func TestPeerResponseSenderIgnoreBlocks(t *testing.T) {
 
 }
 
+func TestPeerResponseSenderPersistLinkTracker(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	p := testutil.GeneratePeers(1)[0]
+	requestID1 := graphsync.RequestID(rand.Int31())
+	requestID2 := graphsync.RequestID(rand.Int31())
+	blks := testutil.GenerateBlocksOfSize(5, 100)
+	links := make([]ipld.Link, 0, len(blks))
+	for _, block := range blks {
+		links = append(links, cidlink.Link{Cid: block.Cid()})
+	}
+	var saved []byte
+	save := func(data []byte) error {
+		saved = data
+		return nil
+	}
+	fph := newFakePeerHandler(ctx, t)
+	allocator := allocator.NewAllocator(1<<30, 1<<30)
+	peerResponseSender := NewResponseSender(ctx, p, fph, allocator, nil, nil)
+	require.NoError(t, peerResponseSender.PersistLinkTracker(nil, save))
+	peerResponseSender.Startup()
+
+	require.NoError(t, peerResponseSender.SaveLinkTracker())
+	require.Nil(t, saved)
+
+	peerResponseSender.SendResponse(requestID1, links[0], blks[0].RawData())
+	peerResponseSender.SendResponse(requestID1, links[1], blks[1].RawData())
+	peerResponseSender.SendResponse(requestID2, links[3], blks[3].RawData())
+	fph.AssertHasMessage("did not send first message")
+	peerResponseSender.Shutdown()
+	require.NotNil(t, saved)
+
+	// a restarted sender skips blocks the request sent from the same root, but
+	// not blocks sent by a request with the same ID from a different root
+	fph = newFakePeerHandler(ctx, t)
+	peerResponseSender = NewResponseSender(ctx, p, fph, allocator, nil, nil)
+	require.NoError(t, peerResponseSender.PersistLinkTracker(saved, save))
+	peerResponseSender.Startup()
+
+	bd := peerResponseSender.SendResponse(requestID1, links[0], blks[0].RawData())
+	assertSentNotOnWire(t, bd, blks[0])
+	bd = peerResponseSender.SendResponse(requestID1, links[1], blks[1].RawData())
+	assertSentNotOnWire(t, bd, blks[1])
+	bd = peerResponseSender.SendResponse(requestID1, links[2], blks[2].RawData())
+	assertSentOnWire(t, bd, blks[2])
+	bd = peerResponseSender.SendResponse(requestID2, links[4], blks[4].RawData())
+	assertSentOnWire(t, bd, blks[4])
+	bd = peerResponseSender.SendResponse(requestID2, links[3], blks[3].RawData())
+	assertSentOnWire(t, bd, blks[3])
+	peerResponseSender.FinishRequest(requestID1)
+	peerResponseSender.FinishRequest(requestID2)
+
+	require.NoError(t, peerResponseSender.SaveLinkTracker())
+	require.Nil(t, saved)
+
+	require.Error(t, peerResponseSender.PersistLinkTracker([]byte("not a link tracker"), save))
+}
+
+func TestPeerResponseSenderMetadataOnly(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	p := testutil.GeneratePeers(1)[0]
+	requestID1 := graphsync.RequestID(rand.Int31())
+	requestID2 := graphsync.RequestID(rand.Int31())
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	links := make([]ipld.Link, 0, len(blks))
+	for _, block := range blks {
+		links = append(links, cidlink.Link{Cid: block.Cid()})
+	}
+	fph := newFakePeerHandler(ctx, t)
+	allocator := allocator.NewAllocator(1<<30, 1<<30)
+	peerResponseSender := NewResponseSender(ctx, p, fph, allocator, nil, nil)
+	peerResponseSender.Startup()
+
+	peerResponseSender.MetadataOnly(requestID1)
+
+	bd := peerResponseSender.SendResponse(requestID1, links[0], blks[0].RawData())
+	assertSentNotOnWire(t, bd, blks[0])
+
+	fph.AssertHasMessage("did not send first message")
+	fph.RefuteBlocks()
+	fph.AssertResponses(expectedResponses{requestID1: graphsync.PartialResponse})
+	response, err := findResponseForRequestID(fph.lastResponses, requestID1)
+	require.NoError(t, err)
+	mdRaw, found := response.Extension(graphsync.ExtensionMetadata)
+	require.True(t, found)
+	md, err := metadata.DecodeMetadata(mdRaw)
+	require.NoError(t, err)
+	require.Equal(t, metadata.Metadata{{Link: blks[0].Cid(), BlockPresent: true}}, md)
+
+	bd = peerResponseSender.SendResponse(requestID1, links[1], nil)
+	assertNotSent(t, bd, blks[1])
+	// blocks traversed by a metadata only request are not deduped for others
+	bd = peerResponseSender.SendResponse(requestID2, links[0], blks[0].RawData())
+	assertSentOnWire(t, bd, blks[0])
+	peerResponseSender.FinishRequest(requestID1)
+
+	fph.notifySuccess()
+
+	fph.AssertHasMessage("did not send second message")
+	fph.AssertBlocks(blks[0])
+	fph.AssertResponses(expectedResponses{
+		requestID1: graphsync.RequestCompletedPartial,
+		requestID2: graphsync.PartialResponse,
+	})
+}
+
+func TestPeerResponseSenderDedupWithinRequest(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	p := testutil.GeneratePeers(1)[0]
+	requestID1 := graphsync.RequestID(rand.Int31())
+	requestID2 := graphsync.RequestID(rand.Int31())
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	links := make([]ipld.Link, 0, len(blks))
+	for _, block := range blks {
+		links = append(links, cidlink.Link{Cid: block.Cid()})
+	}
+	fph := newFakePeerHandler(ctx, t)
+	allocator := allocator.NewAllocator(1<<30, 1<<30)
+	peerResponseSender := NewResponseSender(ctx, p, fph, allocator, nil, nil)
+	peerResponseSender.Startup()
+
+	peerResponseSender.DedupWithinRequest(requestID2)
+
+	bd := peerResponseSender.SendResponse(requestID1, links[0], blks[0].RawData())
+	assertSentOnWire(t, bd, blks[0])
+
+	fph.AssertHasMessage("did not send first message")
+	fph.AssertBlocks(blks[0])
+
+	// block already sent for another request is sent again
+	bd = peerResponseSender.SendResponse(requestID2, links[0], blks[0].RawData())
+	assertSentOnWire(t, bd, blks[0])
+	// but not twice for the same request
+	bd = peerResponseSender.SendResponse(requestID2, links[0], blks[0].RawData())
+	assertSentNotOnWire(t, bd, blks[0])
+	require.True(t, bd.Deduplicated())
+	require.Equal(t, int64(1), bd.Index())
+	bd = peerResponseSender.SendResponse(requestID2, links[1], blks[1].RawData())
+	assertSentOnWire(t, bd, blks[1])
+	require.False(t, bd.Deduplicated())
+	require.Equal(t, int64(2), bd.Index())
+	require.Equal(t, blks[1].Cid(), bd.Cid())
+	// and blocks it sends are not deduped for other requests
+	bd = peerResponseSender.SendResponse(requestID1, links[1], blks[1].RawData())
+	assertSentOnWire(t, bd, blks[1])
+
+	fph.notifySuccess()
+
+	fph.AssertHasMessage("did not send second message")
+	fph.AssertBlocks(blks[0], blks[1])
+	fph.AssertResponses(expectedResponses{
+		requestID1: graphsync.PartialResponse,
+		requestID2: graphsync.PartialResponse,
+	})
+}
+
+func TestPeerResponseSenderIdentityBlocks(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	p := testutil.GeneratePeers(1)[0]
+	requestID1 := graphsync.RequestID(rand.Int31())
+	identityBlk := testutil.GenerateIdentityBlocks(1, 32)[0]
+	blk := testutil.GenerateBlocksOfSize(1, 100)[0]
+	fph := newFakePeerHandler(ctx, t)
+	allocator := allocator.NewAllocator(1<<30, 1<<30)
+	peerResponseSender := NewResponseSender(ctx, p, fph, allocator, nil, nil)
+	peerResponseSender.Startup()
+
+	bd := peerResponseSender.SendResponse(requestID1, cidlink.Link{Cid: identityBlk.Cid()}, identityBlk.RawData())
+	assertSentNotOnWire(t, bd, identityBlk)
+	require.False(t, bd.Deduplicated())
+	bd = peerResponseSender.SendResponse(requestID1, cidlink.Link{Cid: blk.Cid()}, blk.RawData())
+	assertSentOnWire(t, bd, blk)
+
+	fph.AssertHasMessage("did not send message")
+	fph.AssertBlocks(blk)
+	response, err := findResponseForRequestID(fph.lastResponses, requestID1)
+	require.NoError(t, err)
+	mdRaw, found := response.Extension(graphsync.ExtensionMetadata)
+	require.True(t, found)
+	md, err := metadata.DecodeMetadata(mdRaw)
+	require.NoError(t, err)
+	require.Equal(t, metadata.Metadata{
+		{Link: identityBlk.Cid(), BlockPresent: true},
+		{Link: blk.Cid(), BlockPresent: true},
+	}, md)
+}
+
+func TestPeerResponseSenderSeparateRequests(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	p := testutil.GeneratePeers(1)[0]
+	requestID1 := graphsync.RequestID(rand.Int31())
+	requestID2 := graphsync.RequestID(rand.Int31())
+	blks := testutil.GenerateBlocksOfSize(4, 100)
+	fph := newFakePeerHandler(ctx, t)
+	allocator := allocator.NewAllocator(1<<30, 1<<30)
+	peerResponseSender := NewResponseSender(ctx, p, fph, allocator, nil, nil)
+	peerResponseSender.SeparateRequests()
+	peerResponseSender.Startup()
+
+	bd := peerResponseSender.SendResponse(requestID1, cidlink.Link{Cid: blks[0].Cid()}, blks[0].RawData())
+	assertSentOnWire(t, bd, blks[0])
+	fph.AssertHasMessage("did not send first message")
+	fph.AssertBlocks(blks[0])
+	fph.AssertResponses(expectedResponses{requestID1: graphsync.PartialResponse})
+
+	// interleave responses for both requests while the first message is in flight
+	bd = peerResponseSender.SendResponse(requestID2, cidlink.Link{Cid: blks[1].Cid()}, blks[1].RawData())
+	assertSentOnWire(t, bd, blks[1])
+	bd = peerResponseSender.SendResponse(requestID1, cidlink.Link{Cid: blks[2].Cid()}, blks[2].RawData())
+	assertSentOnWire(t, bd, blks[2])
+	bd = peerResponseSender.SendResponse(requestID2, cidlink.Link{Cid: blks[3].Cid()}, blks[3].RawData())
+	assertSentOnWire(t, bd, blks[3])
+
+	// each request's responses and blocks are sent in a message of their own
+	fph.notifySuccess()
+	fph.AssertHasMessage("did not send second message")
+	fph.AssertBlocks(blks[1], blks[3])
+	fph.AssertResponses(expectedResponses{requestID2: graphsync.PartialResponse})
+
+	fph.notifySuccess()
+	fph.AssertHasMessage("did not send third message")
+	fph.AssertBlocks(blks[2])
+	fph.AssertResponses(expectedResponses{requestID1: graphsync.PartialResponse})
+}
+
+func TestPeerResponseSenderCompressionPerRequest(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	p := testutil.GeneratePeers(1)[0]
+	requestID1 := graphsync.RequestID(rand.Int31())
+	requestID2 := graphsync.RequestID(rand.Int31())
+	blks := testutil.GenerateBlocksOfSize(4, 100)
+	fph := newFakePeerHandler(ctx, t)
+	allocator := allocator.NewAllocator(1<<30, 1<<30)
+	peerResponseSender := NewResponseSender(ctx, p, fph, allocator, nil, nil)
+	peerResponseSender.Startup()
+
+	peerResponseSender.UseCompression(requestID1, compression.Gzip)
+
+	bd := peerResponseSender.SendResponse(requestID1, cidlink.Link{Cid: blks[0].Cid()}, blks[0].RawData())
+	assertSentOnWire(t, bd, blks[0])
+	fph.AssertHasMessage("did not send first message")
+	fph.AssertBlocks(blks[0])
+	response, err := findResponseForRequestID(fph.lastResponses, requestID1)
+	require.NoError(t, err)
+	_, has := response.Extension(graphsync.ExtensionBlockCompression)
+	require.True(t, has)
+
+	// blocks for a request that did not ask for compression never share a
+	// message with compressed blocks
+	bd = peerResponseSender.SendResponse(requestID2, cidlink.Link{Cid: blks[1].Cid()}, blks[1].RawData())
+	assertSentOnWire(t, bd, blks[1])
+	bd = peerResponseSender.SendResponse(requestID1, cidlink.Link{Cid: blks[2].Cid()}, blks[2].RawData())
+	assertSentOnWire(t, bd, blks[2])
+
+	fph.notifySuccess()
+	fph.AssertHasMessage("did not send second message")
+	fph.AssertBlocks(blks[1])
+	fph.AssertResponses(expectedResponses{requestID2: graphsync.PartialResponse})
+	response, err = findResponseForRequestID(fph.lastResponses, requestID2)
+	require.NoError(t, err)
+	_, has = response.Extension(graphsync.ExtensionBlockCompression)
+	require.False(t, has)
+
+	fph.notifySuccess()
+	fph.AssertHasMessage("did not send third message")
+	fph.AssertBlocks(blks[2])
+	response, err = findResponseForRequestID(fph.lastResponses, requestID1)
+	require.NoError(t, err)
+	_, has = response.Extension(graphsync.ExtensionBlockCompression)
+	require.True(t, has)
+}
+
 func TestPeerResponseSenderDupKeys(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
@@ -333,7 +746,7 @@ func TestPeerResponseSenderDupKeys(t *testing.T) {
 	}
 	fph := newFakePeerHandler(ctx, t)
 	allocator := allocator.NewAllocator(1<<30, 1<<30)
-	peerResponseSender := NewResponseSender(ctx, p, fph, allocator)
+	peerResponseSender := NewResponseSender(ctx, p, fph, allocator, nil, nil)
 	peerResponseSender.Startup()
 
 	peerResponseSender.DedupKey(requestID1, "applesauce")
@@ -389,6 +802,40 @@ func TestPeerResponseSenderDupKeys(t *testing.T) {
 
 }
 
+func TestPeerResponseSenderLimitSendRate(t *testing.T) {
+	now := time.Now()
+	sendRateLimit := newSendRateLimit(1000, 100*time.Millisecond, now)
+	require.Equal(t, time.Duration(0), sendRateLimit.reserve(100, now), "a pacing interval's worth goes out at once")
+	require.Equal(t, 50*time.Millisecond, sendRateLimit.reserve(50, now))
+	require.Equal(t, time.Duration(0), sendRateLimit.reserve(50, now.Add(200*time.Millisecond)), "bucket refills over time")
+
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	p := testutil.GeneratePeers(1)[0]
+	requestID1 := graphsync.RequestID(rand.Int31())
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	fph := newFakePeerHandler(ctx, t)
+	allocator := allocator.NewAllocator(1<<30, 1<<30)
+	peerResponseSender := NewResponseSender(ctx, p, fph, allocator, nil, nil)
+	peerResponseSender.Startup()
+	peerResponseSender.LimitSendRate(requestID1, 1000, 100*time.Millisecond)
+
+	peerResponseSender.SendResponse(requestID1, cidlink.Link{Cid: blks[0].Cid()}, blks[0].RawData())
+	require.Equal(t, time.Duration(0), peerResponseSender.SendDelay(requestID1), "a pacing interval's worth goes out at once")
+
+	// sending never blocks, but callers are told to hold off
+	start := time.Now()
+	for _, block := range blks[1:] {
+		peerResponseSender.SendResponse(requestID1, cidlink.Link{Cid: block.Cid()}, block.RawData())
+	}
+	require.Less(t, int64(time.Since(start)), int64(100*time.Millisecond))
+	delay := peerResponseSender.SendDelay(requestID1)
+	require.Greater(t, int64(delay), int64(150*time.Millisecond), "blocks past the first burst are paced")
+	require.LessOrEqual(t, int64(delay), int64(200*time.Millisecond))
+	fph.AssertHasMessage("should send blocks without waiting")
+}
+
 func TestPeerResponseSenderSendsResponsesMemoryPressure(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
@@ -402,7 +849,7 @@ func TestPeerResponseSenderSendsResponsesMemoryPressure(t *testing.T) {
 	}
 	fph := newFakePeerHandler(ctx, t)
 	allocator := allocator.NewAllocator(300, 300)
-	peerResponseSender := NewResponseSender(ctx, p, fph, allocator)
+	peerResponseSender := NewResponseSender(ctx, p, fph, allocator, nil, nil)
 	peerResponseSender.Startup()
 
 	bd := peerResponseSender.SendResponse(requestID1, links[0], blks[0].RawData())
@@ -553,3 +1000,36 @@ func (fph *fakePeerHandler) notifySuccess() {
 func (fph *fakePeerHandler) notifyError() {
 	fph.notifeePublisher.PublishEvents([]notifications.Event{messagequeue.Event{Name: messagequeue.Queued}, messagequeue.Event{Name: messagequeue.Error, Err: errors.New("something went wrong")}})
 }
+
+type fakeMetrics struct {
+	lk               sync.Mutex
+	pendingBuilders  int
+	pendingBytes     uint64
+	messagesInFlight int
+}
+
+func (fm *fakeMetrics) PendingBuilders(p peer.ID, count int) {
+	fm.lk.Lock()
+	defer fm.lk.Unlock()
+	fm.pendingBuilders = count
+}
+
+func (fm *fakeMetrics) PendingBytes(p peer.ID, bytes uint64) {
+	fm.lk.Lock()
+	defer fm.lk.Unlock()
+	fm.pendingBytes = bytes
+}
+
+func (fm *fakeMetrics) MessagesInFlight(p peer.ID, count int) {
+	fm.lk.Lock()
+	defer fm.lk.Unlock()
+	fm.messagesInFlight = count
+}
+
+func (fm *fakeMetrics) assertGauges(t *testing.T, pendingBuilders int, pendingBytes uint64, messagesInFlight int) {
+	require.Eventually(t, func() bool {
+		fm.lk.Lock()
+		defer fm.lk.Unlock()
+		return fm.pendingBuilders == pendingBuilders && fm.pendingBytes == pendingBytes && fm.messagesInFlight == messagesInFlight
+	}, time.Second, 10*time.Millisecond)
+}
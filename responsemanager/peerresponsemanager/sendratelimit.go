@@ -0,0 +1,45 @@
+package peerresponsemanager
+
+import (
+	"time"
+)
+
+const defaultSendPacing = 100 * time.Millisecond
+
+// sendRateLimit is a token bucket that paces the data sent for a single
+// request. Up to a pacing interval's worth of data can go out at once, and
+// anything more waits for the bucket to refill
+type sendRateLimit struct {
+	bytesPerSecond float64
+	burst          float64
+	tokens         float64
+	last           time.Time
+}
+
+func newSendRateLimit(bytesPerSecond uint64, pacing time.Duration, now time.Time) *sendRateLimit {
+	if pacing <= 0 {
+		pacing = defaultSendPacing
+	}
+	burst := float64(bytesPerSecond) * pacing.Seconds()
+	return &sendRateLimit{
+		bytesPerSecond: float64(bytesPerSecond),
+		burst:          burst,
+		tokens:         burst,
+		last:           now,
+	}
+}
+
+// reserve takes size bytes from the bucket at the given time, and returns how
+// long to wait before sending them
+func (srl *sendRateLimit) reserve(size uint64, now time.Time) time.Duration {
+	srl.tokens += now.Sub(srl.last).Seconds() * srl.bytesPerSecond
+	if srl.tokens > srl.burst {
+		srl.tokens = srl.burst
+	}
+	srl.last = now
+	srl.tokens -= float64(size)
+	if srl.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-srl.tokens / srl.bytesPerSecond * float64(time.Second))
+}
@@ -0,0 +1,74 @@
+package responsemanager
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/responsemanager/hooks"
+)
+
+// periodicExtensions tracks extension data request hooks asked to send at
+// intervals during a response. It lives as long as the response, so block
+// counts carry across pauses
+type periodicExtensions struct {
+	extensions      []hooks.PeriodicExtension
+	blocksTraversed uint64
+}
+
+func newPeriodicExtensions(extensions []hooks.PeriodicExtension) *periodicExtensions {
+	if len(extensions) == 0 {
+		return nil
+	}
+	return &periodicExtensions{extensions: extensions}
+}
+
+// blockTraversed records a block traversed by the response and returns the
+// extension data due after it
+func (pe *periodicExtensions) blockTraversed() []graphsync.ExtensionData {
+	if pe == nil {
+		return nil
+	}
+	blocksTraversed := atomic.AddUint64(&pe.blocksTraversed, 1)
+	var due []graphsync.ExtensionData
+	for _, extension := range pe.extensions {
+		if extension.Blocks != 0 && blocksTraversed%extension.Blocks == 0 {
+			due = append(due, extension.Data(blocksTraversed))
+		}
+	}
+	return due
+}
+
+// start sends extension data with the given function at each timed interval,
+// until the returned function is called. Once it returns, nothing more is sent
+func (pe *periodicExtensions) start(send func(graphsync.ExtensionData)) func() {
+	if pe == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, extension := range pe.extensions {
+		if extension.Interval <= 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(extension hooks.PeriodicExtension) {
+			defer wg.Done()
+			ticker := time.NewTicker(extension.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					send(extension.Data(atomic.LoadUint64(&pe.blocksTraversed)))
+				}
+			}
+		}(extension)
+	}
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
@@ -4,15 +4,19 @@ import (
 	"context"
 	"errors"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ipfs/go-cid"
 	ipld "github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/traversal"
 	"github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync"
 	"github.com/ipfs/go-graphsync/cidset"
+	"github.com/ipfs/go-graphsync/compression"
+	"github.com/ipfs/go-graphsync/configlog"
 	"github.com/ipfs/go-graphsync/dedupkey"
 	"github.com/ipfs/go-graphsync/ipldutil"
 	gsmsg "github.com/ipfs/go-graphsync/message"
@@ -20,10 +24,21 @@ import (
 	"github.com/ipfs/go-graphsync/responsemanager/hooks"
 	"github.com/ipfs/go-graphsync/responsemanager/peerresponsemanager"
 	"github.com/ipfs/go-graphsync/responsemanager/runtraversal"
+	"github.com/ipfs/go-graphsync/rootredirect"
 )
 
 var errCancelledByCommand = errors.New("response cancelled by responder")
 
+// errSendRateLimited stops a traversal that has sent as much as its send rate
+// allows, so the worker can move on to other responses until it may send more
+type errSendRateLimited struct {
+	delay time.Duration
+}
+
+func (e errSendRateLimited) Error() string {
+	return "send rate limited"
+}
+
 // TODO: Move this into a seperate module and fully seperate from the ResponseManager
 type queryExecutor struct {
 	requestHooks       RequestHooks
@@ -31,12 +46,17 @@ type queryExecutor struct {
 	updateHooks        UpdateHooks
 	cancelledListeners CancelledListeners
 	peerManager        PeerManager
+	loaderLk           sync.RWMutex
 	loader             ipld.Loader
 	queryQueue         QueryQueue
 	messages           chan responseManagerMessage
 	ctx                context.Context
 	workSignal         chan struct{}
 	ticker             *time.Ticker
+	configLog          *configlog.Log
+	isRelayed          func(peer.ID) bool
+	defaultChooser     traversal.LinkTargetNodePrototypeChooser
+	selectorValidator  func(ipld.Node) error
 }
 
 func (qe *queryExecutor) processQueriesWorker() {
@@ -90,30 +110,50 @@ func (qe *queryExecutor) processQueriesWorker() {
 
 func (qe *queryExecutor) executeTask(key responseKey, taskData responseTaskData) (graphsync.ResponseStatusCode, error) {
 	var err error
+	ctx := taskData.ctx
 	loader := taskData.loader
 	traverser := taskData.traverser
+	periodic := taskData.periodic
 	if loader == nil || traverser == nil {
 		var isPaused bool
-		loader, traverser, isPaused, err = qe.prepareQuery(taskData.ctx, key.p, taskData.request, taskData.signals, taskData.subscriber)
+		ctx, loader, traverser, periodic, isPaused, err = qe.prepareQuery(ctx, key.p, taskData.request, taskData.signals, taskData.subscriber)
 		if err != nil {
 			return graphsync.RequestFailedUnknown, err
 		}
 		select {
 		case <-qe.ctx.Done():
 			return graphsync.RequestFailedUnknown, errors.New("context cancelled")
-		case qe.messages <- &setResponseDataRequest{key, loader, traverser}:
+		case qe.messages <- &setResponseDataRequest{key, ctx, loader, traverser, periodic}:
 		}
 		if isPaused {
 			return graphsync.RequestPaused, hooks.ErrPaused{}
 		}
 	}
-	return qe.executeQuery(key.p, taskData.request, loader, traverser, taskData.signals, taskData.subscriber)
+	return qe.executeQuery(ctx, key.p, taskData.request, loader, traverser, periodic, taskData.signals, taskData.subscriber)
 }
 
 func (qe *queryExecutor) prepareQuery(ctx context.Context,
 	p peer.ID,
-	request gsmsg.GraphSyncRequest, signals signals, sub *notifications.TopicDataSubscriber) (ipld.Loader, ipldutil.Traverser, bool, error) {
-	result := qe.requestHooks.ProcessRequestHooks(p, request)
+	request gsmsg.GraphSyncRequest, signals signals, sub *notifications.TopicDataSubscriber) (context.Context, ipld.Loader, ipldutil.Traverser, *periodicExtensions, bool, error) {
+	result := qe.requestHooks.ProcessRequestHooks(ctx, p, request)
+	// hooks may have attached values for later hooks to the context
+	ctx = result.Context
+	root := request.Root()
+	if result.Err == nil && result.IsValidated && result.CustomRoot.Defined() && !result.CustomRoot.Equals(root) {
+		// a requestor that doesn't follow redirects would verify the response
+		// against the root it asked for and fail, so don't start the response
+		if _, accepts := request.Extension(graphsync.ExtensionRootRedirect); !accepts {
+			result.Err = errors.New("requestor does not accept root redirects")
+		} else if redirectData, err := rootredirect.EncodeRedirect(rootredirect.Redirect{Original: root, Root: result.CustomRoot}); err != nil {
+			result.Err = err
+		} else {
+			result.Extensions = append(result.Extensions, graphsync.ExtensionData{Name: graphsync.ExtensionRootRedirect, Data: redirectData})
+			root = result.CustomRoot
+		}
+	}
+	if result.Err == nil && result.IsValidated && result.CustomSelector != nil {
+		result.Err = qe.narrowSelector(&result)
+	}
 	peerResponseSender := qe.peerManager.SenderForPeer(p)
 	var transactionError error
 	var isPaused bool
@@ -133,28 +173,91 @@ func (qe *queryExecutor) prepareQuery(ctx context.Context,
 		return nil
 	})
 	if err != nil {
-		return nil, nil, false, err
+		return nil, nil, nil, nil, false, err
 	}
 	if transactionError != nil {
-		return nil, nil, false, transactionError
+		return nil, nil, nil, nil, false, transactionError
 	}
 	if err := qe.processDedupByKey(request, peerResponseSender, failNotifee); err != nil {
-		return nil, nil, false, err
+		return nil, nil, nil, nil, false, err
 	}
 	if err := qe.processDoNoSendCids(request, peerResponseSender, failNotifee); err != nil {
-		return nil, nil, false, err
+		return nil, nil, nil, nil, false, err
+	}
+	if err := qe.processBlockCompression(request, peerResponseSender, failNotifee); err != nil {
+		return nil, nil, nil, nil, false, err
+	}
+	if _, has := request.Extension(graphsync.ExtensionMetadataOnly); has {
+		peerResponseSender.MetadataOnly(request.ID())
+	} else if _, has := request.Extension(graphsync.ExtensionDedupWithinRequest); has {
+		peerResponseSender.DedupWithinRequest(request.ID())
+	}
+	if _, has := request.Extension(graphsync.ExtensionMetadataV2); has {
+		peerResponseSender.UseMetadataV2(request.ID())
+	}
+	if result.CustomSelector != nil {
+		peerResponseSender.CompletePartial(request.ID())
+	}
+	if result.MaxSendRate > 0 {
+		peerResponseSender.LimitSendRate(request.ID(), result.MaxSendRate, result.SendPacing)
+	}
+	if qe.configLog != nil {
+		hookExtensions := make([]graphsync.ExtensionName, 0, len(result.Extensions))
+		for _, extension := range result.Extensions {
+			hookExtensions = append(hookExtensions, extension.Name)
+		}
+		qe.configLog.RecordResponse(graphsync.EffectiveConfig{
+			Peer:              p,
+			RequestID:         request.ID(),
+			Root:              root,
+			Priority:          request.Priority(),
+			Extensions:        request.ExtensionNames(),
+			HookExtensions:    hookExtensions,
+			PersistenceOption: result.PersistenceOption,
+			CustomChooser:     result.CustomChooser != nil,
+			CustomSelector:    result.CustomSelector != nil,
+			StartedPaused:     isPaused,
+			Relayed:           qe.isRelayed != nil && qe.isRelayed(p),
+		})
+	}
+	rootLink := cidlink.Link{Cid: root}
+	selector := request.Selector()
+	if result.CustomSelector != nil {
+		selector = result.CustomSelector
+	}
+	chooser := result.CustomChooser
+	if chooser == nil {
+		chooser = qe.defaultChooser
 	}
-	rootLink := cidlink.Link{Cid: request.Root()}
 	traverser := ipldutil.TraversalBuilder{
 		Root:     rootLink,
-		Selector: request.Selector(),
-		Chooser:  result.CustomChooser,
+		Selector: selector,
+		Chooser:  chooser,
+		Reifier:  result.Reifier,
 	}.Start(ctx)
 	loader := result.CustomLoader
 	if loader == nil {
+		qe.loaderLk.RLock()
 		loader = qe.loader
+		qe.loaderLk.RUnlock()
+	}
+	return ctx, loader, traverser, newPeriodicExtensions(result.PeriodicExtensions), isPaused, nil
+}
+
+// narrowSelector checks a selector a hook replaced the requested one with,
+// and tells the requestor about it
+func (qe *queryExecutor) narrowSelector(result *hooks.RequestResult) error {
+	if qe.selectorValidator != nil {
+		if err := qe.selectorValidator(result.CustomSelector); err != nil {
+			return err
+		}
+	}
+	selectorData, err := ipldutil.EncodeNode(result.CustomSelector)
+	if err != nil {
+		return err
 	}
-	return loader, traverser, isPaused, nil
+	result.Extensions = append(result.Extensions, graphsync.ExtensionData{Name: graphsync.ExtensionSelectorNarrowed, Data: selectorData})
+	return nil
 }
 
 func (qe *queryExecutor) processDedupByKey(request gsmsg.GraphSyncRequest, peerResponseSender peerresponsemanager.PeerResponseSender, failNotifee notifications.Notifee) error {
@@ -193,29 +296,61 @@ func (qe *queryExecutor) processDoNoSendCids(request gsmsg.GraphSyncRequest, pee
 	return nil
 }
 
+func (qe *queryExecutor) processBlockCompression(request gsmsg.GraphSyncRequest, peerResponseSender peerresponsemanager.PeerResponseSender, failNotifee notifications.Notifee) error {
+	compressionData, has := request.Extension(graphsync.ExtensionBlockCompression)
+	if !has {
+		return nil
+	}
+	algorithms, err := compression.DecodeAlgorithms(compressionData)
+	if err != nil {
+		peerResponseSender.FinishWithError(request.ID(), graphsync.RequestFailedUnknown, failNotifee)
+		return err
+	}
+	// if we share no algorithms with the requestor, blocks are simply sent uncompressed
+	algorithm, ok := compression.Choose(algorithms)
+	if ok {
+		peerResponseSender.UseCompression(request.ID(), algorithm)
+	}
+	return nil
+}
+
 func (qe *queryExecutor) executeQuery(
+	ctx context.Context,
 	p peer.ID,
 	request gsmsg.GraphSyncRequest,
 	loader ipld.Loader,
 	traverser ipldutil.Traverser,
+	periodic *periodicExtensions,
 	signals signals,
 	sub *notifications.TopicDataSubscriber) (graphsync.ResponseStatusCode, error) {
 	updateChan := make(chan []gsmsg.GraphSyncRequest)
 	peerResponseSender := qe.peerManager.SenderForPeer(p)
-	err := runtraversal.RunTraversal(loader, traverser, func(link ipld.Link, data []byte) error {
+	stopPeriodic := periodic.start(func(extension graphsync.ExtensionData) {
+		peerResponseSender.SendExtensionData(request.ID(), extension)
+	})
+	err := runtraversal.RunTraversal(loader, traverser, func(link ipld.Link, data []byte) (bool, error) {
 		var err error
+		var skipLinks bool
 		_ = peerResponseSender.Transaction(request.ID(), func(transaction peerresponsemanager.PeerResponseTransactionSender) error {
-			err = qe.checkForUpdates(p, request, signals, updateChan, transaction)
+			err = qe.checkForUpdates(ctx, p, request, signals, updateChan, transaction)
 			if _, ok := err.(hooks.ErrPaused); !ok && err != nil {
 				return nil
 			}
 			blockData := transaction.SendResponse(link, data)
-			transaction.AddNotifee(notifications.Notifee{Data: blockData, Subscriber: sub})
 			if blockData.BlockSize() > 0 {
-				result := qe.blockHooks.ProcessBlockHooks(p, request, blockData)
+				result := qe.blockHooks.ProcessBlockHooks(ctx, p, request, blockData)
 				for _, extension := range result.Extensions {
 					transaction.SendExtensionData(extension)
 				}
+				if result.Skip {
+					// listeners see the block as not sent, and the traversal
+					// leaves out everything it links to
+					blockData = transaction.SkipBlock(link)
+					skipLinks = true
+				}
+				for _, extension := range periodic.blockTraversed() {
+					transaction.SendExtensionData(extension)
+				}
 				if _, ok := result.Err.(hooks.ErrPaused); ok {
 					transaction.PauseRequest()
 				}
@@ -223,10 +358,17 @@ func (qe *queryExecutor) executeQuery(
 					err = result.Err
 				}
 			}
+			transaction.AddNotifee(notifications.Notifee{Data: blockData, Subscriber: sub})
 			return nil
 		})
-		return err
+		if err == nil {
+			if delay := peerResponseSender.SendDelay(request.ID()); delay > 0 {
+				err = errSendRateLimited{delay}
+			}
+		}
+		return skipLinks, err
 	})
+	stopPeriodic()
 	var code graphsync.ResponseStatusCode
 	_ = peerResponseSender.Transaction(request.ID(), func(peerResponseSender peerresponsemanager.PeerResponseTransactionSender) error {
 		if err != nil {
@@ -235,6 +377,10 @@ func (qe *queryExecutor) executeQuery(
 				code = graphsync.RequestPaused
 				return nil
 			}
+			if _, isLimited := err.(errSendRateLimited); isLimited {
+				code = graphsync.PartialResponse
+				return nil
+			}
 			if isContextErr(err) {
 				peerResponseSender.FinishWithCancel()
 				code = graphsync.RequestCancelled
@@ -260,6 +406,7 @@ func (qe *queryExecutor) executeQuery(
 }
 
 func (qe *queryExecutor) checkForUpdates(
+	ctx context.Context,
 	p peer.ID,
 	request gsmsg.GraphSyncRequest,
 	signals signals,
@@ -280,7 +427,7 @@ func (qe *queryExecutor) checkForUpdates(
 			select {
 			case updates := <-updateChan:
 				for _, update := range updates {
-					result := qe.updateHooks.ProcessUpdateHooks(p, request, update)
+					result := qe.updateHooks.ProcessUpdateHooks(ctx, p, request, update)
 					for _, extension := range result.Extensions {
 						peerResponseSender.SendExtensionData(extension)
 					}
@@ -6,6 +6,7 @@ import (
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/compression"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/metadata"
 )
@@ -20,6 +21,9 @@ type ResponseBuilder struct {
 	completedResponses map[graphsync.RequestID]graphsync.ResponseStatusCode
 	outgoingResponses  map[graphsync.RequestID]metadata.Metadata
 	extensions         map[graphsync.RequestID][]graphsync.ExtensionData
+	blockCompression   compression.Algorithm
+	compressedRequests map[graphsync.RequestID]struct{}
+	metadataV2         map[graphsync.RequestID]struct{}
 }
 
 // Topic is an identifier for notifications about this response builder
@@ -32,6 +36,8 @@ func New(topic Topic) *ResponseBuilder {
 		completedResponses: make(map[graphsync.RequestID]graphsync.ResponseStatusCode),
 		outgoingResponses:  make(map[graphsync.RequestID]metadata.Metadata),
 		extensions:         make(map[graphsync.RequestID][]graphsync.ExtensionData),
+		compressedRequests: make(map[graphsync.RequestID]struct{}),
+		metadataV2:         make(map[graphsync.RequestID]struct{}),
 	}
 }
 
@@ -46,6 +52,22 @@ func (rb *ResponseBuilder) AddExtensionData(requestID graphsync.RequestID, exten
 	rb.extensions[requestID] = append(rb.extensions[requestID], extension)
 }
 
+// CompressBlocks marks the block payloads in this response to be compressed
+// with the given algorithm when the message is encoded, and declares the
+// algorithm on the response for the given request, which asked for it.
+// Every block in a message is compressed with the same algorithm, so blocks
+// for requests that did not ask for it must go in a different response
+func (rb *ResponseBuilder) CompressBlocks(requestID graphsync.RequestID, algorithm compression.Algorithm) {
+	rb.blockCompression = algorithm
+	rb.compressedRequests[requestID] = struct{}{}
+}
+
+// BlockCompression returns the algorithm block payloads in this response are
+// compressed with, or an empty algorithm if they are not compressed
+func (rb *ResponseBuilder) BlockCompression() compression.Algorithm {
+	return rb.blockCompression
+}
+
 // BlockSize returns the total size of all blocks in this response
 func (rb *ResponseBuilder) BlockSize() uint64 {
 	return rb.blkSize
@@ -54,7 +76,20 @@ func (rb *ResponseBuilder) BlockSize() uint64 {
 // AddLink adds the given link and whether its block is present
 // to the response for the given request ID.
 func (rb *ResponseBuilder) AddLink(requestID graphsync.RequestID, link ipld.Link, blockPresent bool) {
-	rb.outgoingResponses[requestID] = append(rb.outgoingResponses[requestID], metadata.Item{Link: link.(cidlink.Link).Cid, BlockPresent: blockPresent})
+	rb.AddMetadataItem(requestID, metadata.Item{Link: link.(cidlink.Link).Cid, BlockPresent: blockPresent})
+}
+
+// AddMetadataItem adds the given metadata item to the response for the given
+// request ID. Block sizes and traversal order are only sent if the request
+// also uses v2 metadata
+func (rb *ResponseBuilder) AddMetadataItem(requestID graphsync.RequestID, item metadata.Item) {
+	rb.outgoingResponses[requestID] = append(rb.outgoingResponses[requestID], item)
+}
+
+// UseMetadataV2 encodes the metadata for the given request in the v2 format,
+// alongside the v1 format
+func (rb *ResponseBuilder) UseMetadataV2(requestID graphsync.RequestID) {
+	rb.metadataV2[requestID] = struct{}{}
 }
 
 // AddResponseCode marks the given request as completed in the response,
@@ -74,8 +109,34 @@ func (rb *ResponseBuilder) Empty() bool {
 	return len(rb.outgoingBlocks) == 0 && len(rb.outgoingResponses) == 0
 }
 
+// OnlyCompletions returns true if the response contains nothing but terminal
+// status codes, with no blocks, links, or extensions
+func (rb *ResponseBuilder) OnlyCompletions() bool {
+	if len(rb.outgoingBlocks) > 0 || len(rb.outgoingResponses) == 0 {
+		return false
+	}
+	for requestID, links := range rb.outgoingResponses {
+		if len(links) > 0 || len(rb.extensions[requestID]) > 0 {
+			return false
+		}
+		status, ok := rb.completedResponses[requestID]
+		if !ok || !gsmsg.IsTerminalResponseCode(status) {
+			return false
+		}
+	}
+	return true
+}
+
 // Build assembles and encodes response data from the added requests, links, and blocks.
 func (rb *ResponseBuilder) Build() ([]gsmsg.GraphSyncResponse, []blocks.Block, error) {
+	var compressionData []byte
+	if rb.blockCompression != "" && len(rb.outgoingBlocks) > 0 {
+		var err error
+		compressionData, err = compression.EncodeAlgorithm(rb.blockCompression)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 	responses := make([]gsmsg.GraphSyncResponse, 0, len(rb.outgoingResponses))
 	for requestID, linkMap := range rb.outgoingResponses {
 		mdRaw, err := metadata.EncodeMetadata(linkMap)
@@ -86,6 +147,22 @@ func (rb *ResponseBuilder) Build() ([]gsmsg.GraphSyncResponse, []blocks.Block, e
 			Name: graphsync.ExtensionMetadata,
 			Data: mdRaw,
 		})
+		if _, ok := rb.metadataV2[requestID]; ok {
+			mdRawV2, err := metadata.EncodeMetadataV2(linkMap)
+			if err != nil {
+				return nil, nil, err
+			}
+			rb.extensions[requestID] = append(rb.extensions[requestID], graphsync.ExtensionData{
+				Name: graphsync.ExtensionMetadataV2,
+				Data: mdRawV2,
+			})
+		}
+		if _, ok := rb.compressedRequests[requestID]; ok && compressionData != nil {
+			rb.extensions[requestID] = append(rb.extensions[requestID], graphsync.ExtensionData{
+				Name: graphsync.ExtensionBlockCompression,
+				Data: compressionData,
+			})
+		}
 		status, isComplete := rb.completedResponses[requestID]
 		responses = append(responses, gsmsg.NewResponse(requestID, responseCode(status, isComplete), rb.extensions[requestID]...))
 	}
@@ -131,6 +131,53 @@ func TestMessageBuilding(t *testing.T) {
 	}
 }
 
+func TestMessageBuildingMetadataV2(t *testing.T) {
+	rb := New(Topic(0))
+	blocks := testutil.GenerateBlocksOfSize(2, 100)
+	requestID1 := graphsync.RequestID(rand.Int31())
+	requestID2 := graphsync.RequestID(rand.Int31())
+
+	rb.UseMetadataV2(requestID1)
+	rb.AddMetadataItem(requestID1, metadata.Item{Link: blocks[0].Cid(), BlockPresent: true, BlockSize: 100, Index: 0})
+	rb.AddMetadataItem(requestID1, metadata.Item{Link: blocks[1].Cid(), BlockPresent: false, Index: 1})
+	rb.AddMetadataItem(requestID2, metadata.Item{Link: blocks[0].Cid(), BlockPresent: true, BlockSize: 100, Index: 0})
+
+	responses, _, err := rb.Build()
+	require.NoError(t, err)
+	require.Len(t, responses, 2)
+
+	response1, err := findResponseForRequestID(responses, requestID1)
+	require.NoError(t, err)
+	response1MetadataRawV1, found := response1.Extension(graphsync.ExtensionMetadata)
+	require.True(t, found, "v1 metadata should still be sent with v2")
+	response1MetadataV1, err := metadata.DecodeMetadata(response1MetadataRawV1)
+	require.NoError(t, err)
+	require.Equal(t, metadata.Metadata{
+		metadata.Item{Link: blocks[0].Cid(), BlockPresent: true},
+		metadata.Item{Link: blocks[1].Cid(), BlockPresent: false},
+	}, response1MetadataV1)
+	response1MetadataRaw, found := response1.Extension(graphsync.ExtensionMetadataV2)
+	require.True(t, found, "v2 metadata should be included in response")
+	response1Metadata, err := metadata.DecodeMetadataV2(response1MetadataRaw)
+	require.NoError(t, err)
+	require.Equal(t, metadata.Metadata{
+		metadata.Item{Link: blocks[0].Cid(), BlockPresent: true, BlockSize: 100, Index: 0},
+		metadata.Item{Link: blocks[1].Cid(), BlockPresent: false, Index: 1},
+	}, response1Metadata)
+
+	response2, err := findResponseForRequestID(responses, requestID2)
+	require.NoError(t, err)
+	_, found = response2.Extension(graphsync.ExtensionMetadataV2)
+	require.False(t, found, "v2 metadata should only be sent when negotiated")
+	response2MetadataRaw, found := response2.Extension(graphsync.ExtensionMetadata)
+	require.True(t, found, "v1 metadata should be included in response")
+	response2Metadata, err := metadata.DecodeMetadata(response2MetadataRaw)
+	require.NoError(t, err)
+	require.Equal(t, metadata.Metadata{
+		metadata.Item{Link: blocks[0].Cid(), BlockPresent: true},
+	}, response2Metadata)
+}
+
 func findResponseForRequestID(responses []gsmsg.GraphSyncResponse, requestID graphsync.RequestID) (gsmsg.GraphSyncResponse, error) {
 	for _, response := range responses {
 		if response.RequestID() == requestID {
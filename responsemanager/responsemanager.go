@@ -4,14 +4,17 @@ import (
 	"context"
 	"errors"
 	"math"
+	"sync"
 	"time"
 
 	logging "github.com/ipfs/go-log"
 	"github.com/ipfs/go-peertaskqueue/peertask"
 	ipld "github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/traversal"
 	"github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/configlog"
 	"github.com/ipfs/go-graphsync/ipldutil"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/notifications"
@@ -22,7 +25,7 @@ import (
 var log = logging.Logger("graphsync")
 
 const (
-	thawSpeed = time.Millisecond * 100
+	defaultThawSpeed = time.Millisecond * 100
 )
 
 type inProgressResponseStatus struct {
@@ -31,10 +34,15 @@ type inProgressResponseStatus struct {
 	request    gsmsg.GraphSyncRequest
 	loader     ipld.Loader
 	traverser  ipldutil.Traverser
+	periodic   *periodicExtensions
 	signals    signals
 	updates    []gsmsg.GraphSyncRequest
 	isPaused   bool
+	started    bool
 	subscriber *notifications.TopicDataSubscriber
+	// throttled is set while the response waits out its send rate, with no
+	// running traversal
+	throttled *time.Timer
 }
 
 type responseKey struct {
@@ -55,6 +63,7 @@ type responseTaskData struct {
 	request    gsmsg.GraphSyncRequest
 	loader     ipld.Loader
 	traverser  ipldutil.Traverser
+	periodic   *periodicExtensions
 	signals    signals
 }
 
@@ -70,17 +79,17 @@ type QueryQueue interface {
 
 // RequestHooks is an interface for processing request hooks
 type RequestHooks interface {
-	ProcessRequestHooks(p peer.ID, request graphsync.RequestData) hooks.RequestResult
+	ProcessRequestHooks(ctx context.Context, p peer.ID, request graphsync.RequestData) hooks.RequestResult
 }
 
 // BlockHooks is an interface for processing block hooks
 type BlockHooks interface {
-	ProcessBlockHooks(p peer.ID, request graphsync.RequestData, blockData graphsync.BlockData) hooks.BlockResult
+	ProcessBlockHooks(ctx context.Context, p peer.ID, request graphsync.RequestData, blockData graphsync.BlockData) hooks.BlockResult
 }
 
 // UpdateHooks is an interface for processing update hooks
 type UpdateHooks interface {
-	ProcessUpdateHooks(p peer.ID, request graphsync.RequestData, update graphsync.RequestData) hooks.UpdateResult
+	ProcessUpdateHooks(ctx context.Context, p peer.ID, request graphsync.RequestData, update graphsync.RequestData) hooks.UpdateResult
 }
 
 // CompletedListeners is an interface for notifying listeners that responses are complete
@@ -96,6 +105,7 @@ type CancelledListeners interface {
 // BlockSentListeners is an interface for notifying listeners that of a block send occuring over the wire
 type BlockSentListeners interface {
 	NotifyBlockSentListeners(p peer.ID, request graphsync.RequestData, block graphsync.BlockData)
+	NotifyBlocksSentListeners(p peer.ID, request graphsync.RequestData, blocks []graphsync.BlockData)
 }
 
 // NetworkErrorListeners is an interface for notifying listeners that an error occurred sending a data on the wire
@@ -103,6 +113,13 @@ type NetworkErrorListeners interface {
 	NotifyNetworkErrorListeners(p peer.ID, request graphsync.RequestData, err error)
 }
 
+// ConnManager is an interface for protecting connections to peers with
+// responses in progress from being pruned
+type ConnManager interface {
+	Protect(peer.ID, string)
+	Unprotect(peer.ID, string) bool
+}
+
 // PeerManager is an interface that returns sender interfaces for peer responses.
 type PeerManager interface {
 	SenderForPeer(p peer.ID) peerresponsemanager.PeerResponseSender
@@ -129,6 +146,8 @@ type ResponseManager struct {
 	qe                    *queryExecutor
 	inProgressResponses   map[responseKey]*inProgressResponseStatus
 	maxInProcessRequests  uint64
+	connManager           ConnManager
+	done                  chan struct{}
 }
 
 // New creates a new response manager from the given context, loader,
@@ -160,7 +179,7 @@ func New(ctx context.Context,
 		messages:           messages,
 		ctx:                ctx,
 		workSignal:         workSignal,
-		ticker:             time.NewTicker(thawSpeed),
+		ticker:             time.NewTicker(defaultThawSpeed),
 	}
 	return &ResponseManager{
 		ctx:                   ctx,
@@ -177,9 +196,26 @@ func New(ctx context.Context,
 		qe:                    qe,
 		inProgressResponses:   make(map[responseKey]*inProgressResponseStatus),
 		maxInProcessRequests:  maxInProcessRequests,
+		done:                  make(chan struct{}),
 	}
 }
 
+// SetDefaultLoader replaces the loader used for requests that do not choose a
+// persistence option. Responses already started keep using the loader they
+// started with
+func (rm *ResponseManager) SetDefaultLoader(loader ipld.Loader) {
+	rm.qe.loaderLk.Lock()
+	rm.qe.loader = loader
+	rm.qe.loaderLk.Unlock()
+}
+
+// ProtectConnections protects the connection to each peer with the given
+// connection manager while responses to it are in progress. It should be
+// called before Startup
+func (rm *ResponseManager) ProtectConnections(connManager ConnManager) {
+	rm.connManager = connManager
+}
+
 type processRequestMessage struct {
 	p        peer.ID
 	requests []gsmsg.GraphSyncRequest
@@ -232,6 +268,18 @@ func (rm *ResponseManager) CancelResponse(p peer.ID, requestID graphsync.Request
 	return rm.sendSyncMessage(&errorRequestMessage{p, requestID, errCancelledByCommand, response}, response)
 }
 
+type cancelPeerResponsesMessage struct {
+	p        peer.ID
+	response chan error
+}
+
+// CancelResponsesToPeer cancels every queued and in progress response to the
+// given peer
+func (rm *ResponseManager) CancelResponsesToPeer(p peer.ID) error {
+	response := make(chan error, 1)
+	return rm.sendSyncMessage(&cancelPeerResponsesMessage{p, response}, response)
+}
+
 func (rm *ResponseManager) sendSyncMessage(message responseManagerMessage, response chan error) error {
 	select {
 	case <-rm.ctx.Done():
@@ -246,6 +294,27 @@ func (rm *ResponseManager) sendSyncMessage(message responseManagerMessage, respo
 	}
 }
 
+type inProgressResponsesMessage struct {
+	response chan int
+}
+
+// InProgressResponses returns the number of responses queued or in progress,
+// not counting paused responses, which only resume on a request from the peer
+func (rm *ResponseManager) InProgressResponses() int {
+	response := make(chan int, 1)
+	select {
+	case rm.messages <- &inProgressResponsesMessage{response}:
+	case <-rm.ctx.Done():
+		return 0
+	}
+	select {
+	case count := <-response:
+		return count
+	case <-rm.ctx.Done():
+		return 0
+	}
+}
+
 type synchronizeMessage struct {
 	sync chan error
 }
@@ -267,10 +336,16 @@ type finishTaskRequest struct {
 	err    error
 }
 
+type resumeThrottledRequest struct {
+	key responseKey
+}
+
 type setResponseDataRequest struct {
 	key       responseKey
+	ctx       context.Context
 	loader    ipld.Loader
 	traverser ipldutil.Traverser
+	periodic  *periodicExtensions
 }
 
 type responseUpdateRequest struct {
@@ -278,6 +353,38 @@ type responseUpdateRequest struct {
 	updateChan chan []gsmsg.GraphSyncRequest
 }
 
+// RecordEffectiveConfigs records the effective configuration of each response
+// in the given log. It should be called before Startup
+func (rm *ResponseManager) RecordEffectiveConfigs(configLog *configlog.Log) {
+	rm.qe.configLog = configLog
+}
+
+// DetectRelayedPeers records on the effective configuration of each response
+// whether its peer was only connected through a relay, as reported by
+// isRelayed before the first block is sent. It should be called before Startup
+func (rm *ResponseManager) DetectRelayedPeers(isRelayed func(peer.ID) bool) {
+	rm.qe.isRelayed = isRelayed
+}
+
+// SetSelectorValidator sets a check that selectors hooks replace requested
+// selectors with must pass. It should be called before Startup
+func (rm *ResponseManager) SetSelectorValidator(validator func(ipld.Node) error) {
+	rm.qe.selectorValidator = validator
+}
+
+// DefaultNodePrototypeChooser sets the chooser used to build nodes for
+// responses when no hook sets one. It should be called before Startup
+func (rm *ResponseManager) DefaultNodePrototypeChooser(chooser traversal.LinkTargetNodePrototypeChooser) {
+	rm.qe.defaultChooser = chooser
+}
+
+// ThawInterval sets how often peers frozen in the response queue are
+// thawed. It should be called before Startup
+func (rm *ResponseManager) ThawInterval(interval time.Duration) {
+	rm.qe.ticker.Stop()
+	rm.qe.ticker = time.NewTicker(interval)
+}
+
 // Startup starts processing for the WantManager.
 func (rm *ResponseManager) Startup() {
 	go rm.run()
@@ -288,6 +395,22 @@ func (rm *ResponseManager) Shutdown() {
 	rm.cancelFn()
 }
 
+// Done returns a channel that closes once processing has stopped after
+// Shutdown, including the query workers
+func (rm *ResponseManager) Done() <-chan struct{} {
+	return rm.done
+}
+
+func (rm *ResponseManager) unpausedResponses() int {
+	count := 0
+	for _, response := range rm.inProgressResponses {
+		if !response.isPaused {
+			count++
+		}
+	}
+	return count
+}
+
 func (rm *ResponseManager) cleanupInProcessResponses() {
 	for _, response := range rm.inProgressResponses {
 		response.cancelFn()
@@ -295,9 +418,16 @@ func (rm *ResponseManager) cleanupInProcessResponses() {
 }
 
 func (rm *ResponseManager) run() {
+	defer close(rm.done)
+	var workers sync.WaitGroup
+	defer workers.Wait()
 	defer rm.cleanupInProcessResponses()
 	for i := uint64(0); i < rm.maxInProcessRequests; i++ {
-		go rm.qe.processQueriesWorker()
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			rm.qe.processQueriesWorker()
+		}()
 	}
 
 	for {
@@ -324,7 +454,7 @@ func (rm *ResponseManager) processUpdate(key responseKey, update gsmsg.GraphSync
 		}
 		return
 	}
-	result := rm.updateHooks.ProcessUpdateHooks(key.p, response.request, update)
+	result := rm.updateHooks.ProcessUpdateHooks(response.ctx, key.p, response.request, update)
 	peerResponseSender := rm.peerManager.SenderForPeer(key.p)
 	err := peerResponseSender.Transaction(key.requestID, func(transaction peerresponsemanager.PeerResponseTransactionSender) error {
 		for _, extension := range result.Extensions {
@@ -340,8 +470,7 @@ func (rm *ResponseManager) processUpdate(key responseKey, update gsmsg.GraphSync
 		log.Errorf("Error processing update: %s", err)
 	}
 	if result.Err != nil {
-		delete(rm.inProgressResponses, key)
-		response.cancelFn()
+		rm.removeResponse(key, response)
 		return
 	}
 	if result.Unpause {
@@ -388,7 +517,9 @@ func (rm *ResponseManager) abortRequest(p peer.ID, requestID graphsync.RequestID
 		return errors.New("could not find request")
 	}
 
-	if response.isPaused {
+	// responses that are paused, throttled or still queued have no running
+	// traversal to notice the error, so finish them here
+	if response.isPaused || response.throttled != nil || !response.started {
 		peerResponseSender := rm.peerManager.SenderForPeer(key.p)
 		if isContextErr(err) {
 
@@ -397,8 +528,7 @@ func (rm *ResponseManager) abortRequest(p peer.ID, requestID graphsync.RequestID
 		} else if err != errNetworkError {
 			peerResponseSender.FinishWithError(requestID, graphsync.RequestCancelled, notifications.Notifee{Data: graphsync.RequestCancelled, Subscriber: response.subscriber})
 		}
-		delete(rm.inProgressResponses, key)
-		response.cancelFn()
+		rm.removeResponse(key, response)
 		return nil
 	}
 	select {
@@ -441,6 +571,9 @@ func (prm *processRequestMessage) handle(rm *ResponseManager) {
 					errSignal:    make(chan error, 1),
 				},
 			}
+		if rm.connManager != nil {
+			rm.connManager.Protect(key.p, responseTag(key.requestID))
+		}
 		// TODO: Use a better work estimation metric.
 		rm.queryQueue.PushTasks(prm.p, peertask.Task{Topic: key, Priority: int(request.Priority()), Work: 1})
 		select {
@@ -450,11 +583,26 @@ func (prm *processRequestMessage) handle(rm *ResponseManager) {
 	}
 }
 
+// removeResponse stops tracking a response that is finished
+func (rm *ResponseManager) removeResponse(key responseKey, response *inProgressResponseStatus) {
+	delete(rm.inProgressResponses, key)
+	rm.stopThrottling(response)
+	response.cancelFn()
+	if rm.connManager != nil {
+		rm.connManager.Unprotect(key.p, responseTag(key.requestID))
+	}
+}
+
+func responseTag(requestID graphsync.RequestID) string {
+	return fmt.Sprintf("graphsync-response-%d", requestID)
+}
+
 func (rdr *responseDataRequest) handle(rm *ResponseManager) {
 	response, ok := rm.inProgressResponses[rdr.key]
 	var taskData responseTaskData
 	if ok {
-		taskData = responseTaskData{false, response.subscriber, response.ctx, response.request, response.loader, response.traverser, response.signals}
+		response.started = true
+		taskData = responseTaskData{false, response.subscriber, response.ctx, response.request, response.loader, response.traverser, response.periodic, response.signals}
 	} else {
 		taskData = responseTaskData{empty: true}
 	}
@@ -473,11 +621,42 @@ func (ftr *finishTaskRequest) handle(rm *ResponseManager) {
 		response.isPaused = true
 		return
 	}
+	if limited, ok := ftr.err.(errSendRateLimited); ok {
+		// wait off the query worker, so it can send other responses meanwhile
+		key := ftr.key
+		response.throttled = time.AfterFunc(limited.delay, func() {
+			select {
+			case rm.messages <- &resumeThrottledRequest{key}:
+			case <-rm.ctx.Done():
+			}
+		})
+		return
+	}
 	if ftr.err != nil {
 		log.Infof("response failed: %w", ftr.err)
 	}
-	delete(rm.inProgressResponses, ftr.key)
-	response.cancelFn()
+	rm.removeResponse(ftr.key, response)
+}
+
+func (rtr *resumeThrottledRequest) handle(rm *ResponseManager) {
+	response, ok := rm.inProgressResponses[rtr.key]
+	if !ok || response.throttled == nil {
+		return
+	}
+	response.throttled = nil
+	rm.queryQueue.PushTasks(rtr.key.p, peertask.Task{Topic: rtr.key, Priority: int(response.request.Priority()), Work: 1})
+	select {
+	case rm.workSignal <- struct{}{}:
+	default:
+	}
+}
+
+// stopThrottling stops waiting out a response's send rate
+func (rm *ResponseManager) stopThrottling(response *inProgressResponseStatus) {
+	if response.throttled != nil {
+		response.throttled.Stop()
+		response.throttled = nil
+	}
 }
 
 func (srdr *setResponseDataRequest) handle(rm *ResponseManager) {
@@ -485,8 +664,10 @@ func (srdr *setResponseDataRequest) handle(rm *ResponseManager) {
 	if !ok {
 		return
 	}
+	response.ctx = srdr.ctx
 	response.loader = srdr.loader
 	response.traverser = srdr.traverser
+	response.periodic = srdr.periodic
 }
 
 func (rur *responseUpdateRequest) handle(rm *ResponseManager) {
@@ -528,6 +709,13 @@ func (prm *pauseRequestMessage) pauseRequest(rm *ResponseManager) error {
 	if inProgressResponse.isPaused {
 		return errors.New("request is already paused")
 	}
+	if inProgressResponse.throttled != nil {
+		// there is no running traversal to signal, so pause it here
+		rm.stopThrottling(inProgressResponse)
+		inProgressResponse.isPaused = true
+		rm.peerManager.SenderForPeer(prm.p).PauseRequest(prm.requestID)
+		return nil
+	}
 	select {
 	case inProgressResponse.signals.pauseSignal <- struct{}{}:
 	default:
@@ -543,6 +731,25 @@ func (prm *pauseRequestMessage) handle(rm *ResponseManager) {
 	}
 }
 
+func (iprm *inProgressResponsesMessage) handle(rm *ResponseManager) {
+	select {
+	case <-rm.ctx.Done():
+	case iprm.response <- rm.unpausedResponses():
+	}
+}
+
+func (cprm *cancelPeerResponsesMessage) handle(rm *ResponseManager) {
+	for key := range rm.inProgressResponses {
+		if key.p == cprm.p {
+			_ = rm.abortRequest(key.p, key.requestID, errCancelledByCommand)
+		}
+	}
+	select {
+	case <-rm.ctx.Done():
+	case cprm.response <- nil:
+	}
+}
+
 func (crm *errorRequestMessage) handle(rm *ResponseManager) {
 	err := rm.abortRequest(crm.p, crm.requestID, crm.err)
 	select {
@@ -14,18 +14,24 @@ import (
 	ipld "github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/stretchr/testify/require"
 
 	"github.com/ipfs/go-graphsync"
 	"github.com/ipfs/go-graphsync/cidset"
+	"github.com/ipfs/go-graphsync/compression"
+	"github.com/ipfs/go-graphsync/configlog"
 	"github.com/ipfs/go-graphsync/dedupkey"
+	"github.com/ipfs/go-graphsync/ipldutil"
 	"github.com/ipfs/go-graphsync/listeners"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/notifications"
 	"github.com/ipfs/go-graphsync/responsemanager/hooks"
 	"github.com/ipfs/go-graphsync/responsemanager/peerresponsemanager"
 	"github.com/ipfs/go-graphsync/responsemanager/persistenceoptions"
+	"github.com/ipfs/go-graphsync/rootredirect"
 	"github.com/ipfs/go-graphsync/selectorvalidator"
 	"github.com/ipfs/go-graphsync/testutil"
 )
@@ -44,6 +50,7 @@ func TestIncomingQuery(t *testing.T) {
 	for i := 0; i < len(blks); i++ {
 		td.assertSendBlock()
 	}
+	td.connManager.RefuteProtected(t, td.p)
 }
 
 func TestCancellationQueryInProgress(t *testing.T) {
@@ -98,6 +105,8 @@ func TestEarlyCancellation(t *testing.T) {
 	responseManager := td.newResponseManager()
 	responseManager.Startup()
 	responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+	responseManager.synchronize()
+	td.connManager.AssertProtectedWithTags(t, td.p, responseTag(td.requestID))
 
 	// send a cancellation
 	cancelRequests := []gsmsg.GraphSyncRequest{
@@ -106,6 +115,26 @@ func TestEarlyCancellation(t *testing.T) {
 	responseManager.ProcessRequests(td.ctx, td.p, cancelRequests)
 
 	responseManager.synchronize()
+	td.connManager.RefuteProtected(t, td.p)
+
+	// unblock popping from queue
+	td.queryQueue.popWait.Done()
+
+	td.assertNoResponses()
+}
+
+func TestCancelResponsesToPeer(t *testing.T) {
+	td := newTestData(t)
+	defer td.cancel()
+	td.queryQueue.popWait.Add(1)
+	responseManager := td.newResponseManager()
+	responseManager.Startup()
+	responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+
+	// cancel while the response is still queued
+	err := responseManager.CancelResponsesToPeer(td.p)
+	require.NoError(t, err)
+	td.assertCompleteRequestWithFailure()
 
 	// unblock popping from queue
 	td.queryQueue.popWait.Done()
@@ -219,6 +248,167 @@ func TestValidationAndExtensions(t *testing.T) {
 		td.assertReceiveExtensionResponse()
 	})
 
+	t.Run("hooks can limit the send rate", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		responseManager.Startup()
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+			hookActions.LimitSendRate(1<<20, 50*time.Millisecond)
+		})
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		td.assertCompleteRequestWithSuccess()
+		var limit sendRateLimit
+		testutil.AssertReceive(td.ctx, t, td.sendRateLimits, &limit, "should limit send rate")
+		require.Equal(t, sendRateLimit{td.requestID, 1 << 20, 50 * time.Millisecond}, limit)
+	})
+
+	t.Run("throttled responses resume after their send delay", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		responseManager.Startup()
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+		})
+		td.sendDelays <- 50 * time.Millisecond
+		start := time.Now()
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		td.assertCompleteRequestWithSuccess()
+		require.GreaterOrEqual(t, int64(time.Since(start)), int64(50*time.Millisecond), "should wait out the send delay")
+	})
+
+	t.Run("throttled responses can be paused", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		responseManager.Startup()
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+		})
+		td.sendDelays <- time.Minute
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		td.assertSendBlock()
+		require.Eventually(t, func() bool {
+			return responseManager.PauseResponse(td.p, td.requestID) == nil
+		}, time.Second, 10*time.Millisecond)
+		td.assertPausedRequest()
+		err := responseManager.UnpauseResponse(td.p, td.requestID)
+		require.NoError(t, err)
+		td.assertCompleteRequestWithSuccess()
+	})
+
+	t.Run("hooks can redirect the root", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		responseManager.Startup()
+		newRoot := td.blockChain.LinkTipIndex(2).(cidlink.Link).Cid
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+			hookActions.UseRoot(newRoot)
+		})
+		td.requests = []gsmsg.GraphSyncRequest{
+			gsmsg.NewRequest(td.requestID, td.blockChain.TipLink.(cidlink.Link).Cid, td.blockChain.Selector(), graphsync.Priority(0),
+				td.extension, graphsync.ExtensionData{Name: graphsync.ExtensionRootRedirect}),
+		}
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		td.verifyNResponsesOnlyProcessing(td.blockChainLength - 2)
+		td.assertCompleteRequestWithSuccess()
+
+		var receivedExtension sentExtension
+		testutil.AssertReceive(td.ctx, td.t, td.sentExtensions, &receivedExtension, "should send root redirect")
+		require.Equal(t, graphsync.ExtensionRootRedirect, receivedExtension.extension.Name)
+		redirect, err := rootredirect.DecodeRedirect(receivedExtension.extension.Data)
+		require.NoError(t, err)
+		require.Equal(t, td.requests[0].Root(), redirect.Original)
+		require.Equal(t, newRoot, redirect.Root)
+	})
+
+	t.Run("hooks can narrow the selector", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		responseManager.Startup()
+		ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+		narrowed := ssb.Matcher().Node()
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+			hookActions.UseSelector(narrowed)
+		})
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		td.verifyNResponsesOnlyProcessing(1)
+		td.assertCompleteRequestWithSuccess()
+
+		var receivedExtension sentExtension
+		testutil.AssertReceive(td.ctx, td.t, td.sentExtensions, &receivedExtension, "should send narrowed selector")
+		require.Equal(t, graphsync.ExtensionSelectorNarrowed, receivedExtension.extension.Name)
+		expectedData, err := ipldutil.EncodeNode(narrowed)
+		require.NoError(t, err)
+		require.Equal(t, expectedData, receivedExtension.extension.Data)
+	})
+
+	t.Run("narrowed selectors must pass the selector validator", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		responseManager.SetSelectorValidator(func(selector ipld.Node) error {
+			return selectorvalidator.ValidateMaxRecursionDepth(selector, 10)
+		})
+		responseManager.Startup()
+		ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+		tooDeep := ssb.ExploreRecursive(selector.RecursionLimitDepth(100), ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+			hookActions.UseSelector(tooDeep)
+		})
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		td.assertCompleteRequestWithFailure()
+	})
+
+	t.Run("root redirects fail requests that don't accept them", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		responseManager.Startup()
+		newRoot := td.blockChain.LinkTipIndex(2).(cidlink.Link).Cid
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+			hookActions.UseRoot(newRoot)
+		})
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		td.assertCompleteRequestWithFailure()
+	})
+
+	t.Run("records effective configuration", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		configLog := configlog.New(10)
+		responseManager.RecordEffectiveConfigs(configLog)
+		responseManager.DetectRelayedPeers(func(p peer.ID) bool { return p == td.p })
+		responseManager.Startup()
+		err := td.peristenceOptions.Register("chainstore", td.loader)
+		require.NoError(t, err)
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+			hookActions.UsePersistenceOption("chainstore")
+			hookActions.SendExtensionData(td.extensionResponse)
+		})
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		td.assertCompleteRequestWithSuccess()
+
+		config, ok := configLog.Response(td.p, td.requestID)
+		require.True(t, ok)
+		require.Equal(t, td.requests[0].Root(), config.Root)
+		require.Equal(t, "chainstore", config.PersistenceOption)
+		require.Equal(t, []graphsync.ExtensionName{td.extensionName}, config.Extensions)
+		require.Equal(t, []graphsync.ExtensionName{td.extensionName}, config.HookExtensions)
+		require.False(t, config.StartedPaused)
+		require.True(t, config.Relayed)
+	})
+
 	t.Run("hooks can alter the node builder chooser", func(t *testing.T) {
 		td := newTestData(t)
 		defer td.cancel()
@@ -339,6 +529,93 @@ func TestValidationAndExtensions(t *testing.T) {
 			}
 		})
 
+		t.Run("can send extension data periodically", func(t *testing.T) {
+			td := newTestData(t)
+			defer td.cancel()
+			responseManager := td.newResponseManager()
+			responseManager.Startup()
+			td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+				hookActions.ValidateRequest()
+				hookActions.SendExtensionDataPeriodically(2, 0, func(blocksTraversed uint64) graphsync.ExtensionData {
+					return graphsync.ExtensionData{Name: td.extensionName, Data: []byte{byte(blocksTraversed)}}
+				})
+			})
+			responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+			td.assertCompleteRequestWithSuccess()
+			for _, blocksTraversed := range []byte{2, 4} {
+				var receivedExtension sentExtension
+				testutil.AssertReceive(td.ctx, t, td.sentExtensions, &receivedExtension, "should send periodic extension")
+				require.Equal(t, []byte{blocksTraversed}, receivedExtension.extension.Data)
+			}
+			testutil.AssertChannelEmpty(t, td.sentExtensions, "should not send more extensions")
+		})
+
+		t.Run("can send extension data at intervals", func(t *testing.T) {
+			td := newTestData(t)
+			defer td.cancel()
+			responseManager := td.newResponseManager()
+			responseManager.Startup()
+			td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+				hookActions.ValidateRequest()
+				hookActions.SendExtensionDataPeriodically(0, 20*time.Millisecond, func(blocksTraversed uint64) graphsync.ExtensionData {
+					return td.extensionResponse
+				})
+			})
+			slept := false
+			td.blockHooks.Register(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+				if !slept {
+					slept = true
+					time.Sleep(60 * time.Millisecond)
+				}
+			})
+			responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+			td.assertCompleteRequestWithSuccess()
+			td.assertReceiveExtensionResponse()
+		})
+
+		t.Run("can skip blocks", func(t *testing.T) {
+			td := newTestData(t)
+			defer td.cancel()
+			responseManager := td.newResponseManager()
+			responseManager.Startup()
+			td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+				hookActions.ValidateRequest()
+			})
+			skipped := td.blockChain.LinkTipIndex(1)
+			td.blockHooks.Register(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+				if blockData.Link() == skipped {
+					hookActions.SkipBlock()
+				}
+			})
+			responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+			td.assertCompleteRequestWithSuccess()
+			var skippedBlock ipld.Link
+			testutil.AssertReceive(td.ctx, t, td.skippedBlocks, &skippedBlock, "should skip block")
+			require.Equal(t, skipped, skippedBlock)
+			testutil.AssertChannelEmpty(t, td.skippedBlocks, "should not skip other blocks")
+			// the chain is linear, so nothing past the skipped block is traversed
+			require.Len(t, td.sentResponses, 2)
+		})
+
+		t.Run("can read context values set by request hooks", func(t *testing.T) {
+			td := newTestData(t)
+			defer td.cancel()
+			responseManager := td.newResponseManager()
+			responseManager.Startup()
+			td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+				hookActions.ValidateRequest()
+				hookActions.SetContextValue(td.extensionName, td.extensionResponse)
+			})
+			td.blockHooks.Register(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+				hookActions.SendExtensionData(hookActions.Context().Value(td.extensionName).(graphsync.ExtensionData))
+			})
+			responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+			td.assertCompleteRequestWithSuccess()
+			for i := 0; i < td.blockChainLength; i++ {
+				td.assertReceiveExtensionResponse()
+			}
+		})
+
 		t.Run("can send errors", func(t *testing.T) {
 			td := newTestData(t)
 			defer td.cancel()
@@ -742,10 +1019,40 @@ type fakePeerResponseSender struct {
 	pausedRequests       chan pausedRequest
 	cancelledRequests    chan cancelledRequest
 	ignoredLinks         chan []ipld.Link
+	skippedBlocks        chan ipld.Link
+	sendRateLimits       chan sendRateLimit
+	sendDelays           chan time.Duration
 	notifeePublisher     *testutil.MockPublisher
 	dedupKeys            chan string
 }
 
+type sendRateLimit struct {
+	requestID      graphsync.RequestID
+	bytesPerSecond uint64
+	pacing         time.Duration
+}
+
+func (fprs *fakePeerResponseSender) LimitSendRate(requestID graphsync.RequestID, bytesPerSecond uint64, pacing time.Duration) {
+	fprs.sendRateLimits <- sendRateLimit{requestID, bytesPerSecond, pacing}
+}
+
+func (fprs *fakePeerResponseSender) SendDelay(requestID graphsync.RequestID) time.Duration {
+	select {
+	case delay := <-fprs.sendDelays:
+		return delay
+	default:
+		return 0
+	}
+}
+
+func (fprs *fakePeerResponseSender) PersistLinkTracker(saved []byte, save func([]byte) error) error {
+	return nil
+}
+
+func (fprs *fakePeerResponseSender) SaveLinkTracker() error { return nil }
+
+func (fprs *fakePeerResponseSender) BatchLimits(maxBlockSize uint64, completionDelay time.Duration) {}
+
 func (fprs *fakePeerResponseSender) Startup()  {}
 func (fprs *fakePeerResponseSender) Shutdown() {}
 
@@ -762,6 +1069,19 @@ func (fprs *fakePeerResponseSender) DedupKey(requestID graphsync.RequestID, key
 	fprs.dedupKeys <- key
 }
 
+func (fprs *fakePeerResponseSender) UseCompression(requestID graphsync.RequestID, algorithm compression.Algorithm) {
+}
+
+func (fprs *fakePeerResponseSender) MetadataOnly(requestID graphsync.RequestID) {}
+
+func (fprs *fakePeerResponseSender) DedupWithinRequest(requestID graphsync.RequestID) {}
+
+func (fprs *fakePeerResponseSender) UseMetadataV2(requestID graphsync.RequestID) {}
+
+func (fprs *fakePeerResponseSender) CompletePartial(requestID graphsync.RequestID) {}
+
+func (fprs *fakePeerResponseSender) SeparateRequests() {}
+
 func (fbd fakeBlkData) Link() ipld.Link {
 	return fbd.link
 }
@@ -774,6 +1094,18 @@ func (fbd fakeBlkData) BlockSizeOnWire() uint64 {
 	return fbd.size
 }
 
+func (fbd fakeBlkData) Cid() cid.Cid {
+	return fbd.link.(cidlink.Link).Cid
+}
+
+func (fbd fakeBlkData) Index() int64 {
+	return 0
+}
+
+func (fbd fakeBlkData) Deduplicated() bool {
+	return false
+}
+
 func (fprs *fakePeerResponseSender) SendResponse(
 	requestID graphsync.RequestID,
 	link ipld.Link,
@@ -830,6 +1162,11 @@ func (fprts *fakePeerResponseTransactionSender) SendResponse(link ipld.Link, dat
 	return fprts.prs.SendResponse(fprts.requestID, link, data)
 }
 
+func (fprts *fakePeerResponseTransactionSender) SkipBlock(link ipld.Link) graphsync.BlockData {
+	fprts.prs.(*fakePeerResponseSender).skippedBlocks <- link
+	return fakeBlkData{link, 0}
+}
+
 func (fprts *fakePeerResponseTransactionSender) SendExtensionData(extension graphsync.ExtensionData) {
 	fprts.prs.SendExtensionData(fprts.requestID, extension)
 }
@@ -869,6 +1206,9 @@ type testData struct {
 	pausedRequests            chan pausedRequest
 	cancelledRequests         chan cancelledRequest
 	ignoredLinks              chan []ipld.Link
+	skippedBlocks             chan ipld.Link
+	sendRateLimits            chan sendRateLimit
+	sendDelays                chan time.Duration
 	dedupKeys                 chan string
 	peerManager               *fakePeerManager
 	queryQueue                *fakeQueryQueue
@@ -893,9 +1233,11 @@ type testData struct {
 	networkErrorListeners     *listeners.NetworkErrorListeners
 	notifeePublisher          *testutil.MockPublisher
 	blockSends                chan graphsync.BlockData
+	blockBatches              chan []graphsync.BlockData
 	completedResponseStatuses chan graphsync.ResponseStatusCode
 	networkErrorChan          chan error
 	allBlocks                 []blocks.Block
+	connManager               *testutil.TestConnManager
 }
 
 func newTestData(t *testing.T) testData {
@@ -915,8 +1257,12 @@ func newTestData(t *testing.T) testData {
 	td.pausedRequests = make(chan pausedRequest, 1)
 	td.cancelledRequests = make(chan cancelledRequest, 1)
 	td.ignoredLinks = make(chan []ipld.Link, 1)
+	td.skippedBlocks = make(chan ipld.Link, td.blockChainLength)
+	td.sendRateLimits = make(chan sendRateLimit, 1)
+	td.sendDelays = make(chan time.Duration, 1)
 	td.dedupKeys = make(chan string, 1)
 	td.blockSends = make(chan graphsync.BlockData, td.blockChainLength*2)
+	td.blockBatches = make(chan []graphsync.BlockData, td.blockChainLength*2)
 	td.completedResponseStatuses = make(chan graphsync.ResponseStatusCode, 1)
 	td.networkErrorChan = make(chan error, td.blockChainLength*2)
 	td.notifeePublisher = testutil.NewMockPublisher()
@@ -927,6 +1273,9 @@ func newTestData(t *testing.T) testData {
 		pausedRequests:       td.pausedRequests,
 		cancelledRequests:    td.cancelledRequests,
 		ignoredLinks:         td.ignoredLinks,
+		skippedBlocks:        td.skippedBlocks,
+		sendRateLimits:       td.sendRateLimits,
+		sendDelays:           td.sendDelays,
 		dedupKeys:            td.dedupKeys,
 		notifeePublisher:     td.notifeePublisher,
 	}
@@ -977,17 +1326,26 @@ func newTestData(t *testing.T) testData {
 		default:
 		}
 	})
+	td.blockSentListeners.RegisterBatch(func(p peer.ID, requestID graphsync.RequestData, blocks []graphsync.BlockData) {
+		select {
+		case td.blockBatches <- blocks:
+		default:
+		}
+	})
 	td.networkErrorListeners.Register(func(p peer.ID, requestID graphsync.RequestData, err error) {
 		select {
 		case td.networkErrorChan <- err:
 		default:
 		}
 	})
+	td.connManager = testutil.NewTestConnManager()
 	return td
 }
 
 func (td *testData) newResponseManager() *ResponseManager {
-	return New(td.ctx, td.loader, td.peerManager, td.queryQueue, td.requestHooks, td.blockHooks, td.updateHooks, td.completedListeners, td.cancelledListeners, td.blockSentListeners, td.networkErrorListeners, 6)
+	rm := New(td.ctx, td.loader, td.peerManager, td.queryQueue, td.requestHooks, td.blockHooks, td.updateHooks, td.completedListeners, td.cancelledListeners, td.blockSentListeners, td.networkErrorListeners, 6)
+	rm.ProtectConnections(td.connManager)
+	return rm
 }
 
 func (td *testData) alternateLoaderResponseManager() *ResponseManager {
@@ -1086,6 +1444,12 @@ func (td *testData) verifyNResponses(blockCount int) {
 		testutil.AssertDoesReceive(td.ctx, td.t, td.blockSends, "should sent block")
 	}
 	testutil.AssertChannelEmpty(td.t, td.blockSends, "should not send more blocks")
+	if blockCount > 0 {
+		var blockBatch []graphsync.BlockData
+		testutil.AssertReceive(td.ctx, td.t, td.blockBatches, &blockBatch, "should send block batch")
+		require.Len(td.t, blockBatch, blockCount)
+	}
+	testutil.AssertChannelEmpty(td.t, td.blockBatches, "should not send more block batches")
 }
 
 func (td *testData) assertDedupKey(key string) {
@@ -10,11 +10,12 @@ import (
 	"github.com/ipfs/go-graphsync/ipldutil"
 )
 
-// ResponseSender sends responses over the network
+// ResponseSender sends responses over the network. If it returns skipLinks
+// for a loaded block, the traversal doesn't descend into the block's links
 type ResponseSender func(
 	link ipld.Link,
 	data []byte,
-) error
+) (skipLinks bool, err error)
 
 // RunTraversal wraps a given loader with an interceptor that sends loaded
 // blocks out to the network with the given response sender.
@@ -30,25 +31,33 @@ func RunTraversal(
 		lnk, lnkCtx := traverser.CurrentRequest()
 		result, err := loader(lnk, lnkCtx)
 		var data []byte
+		var blockBuffer *bytes.Buffer
 		if err != nil {
 			traverser.Error(traversal.SkipMe{})
 		} else {
-			blockBuffer, ok := result.(*bytes.Buffer)
+			var ok bool
+			blockBuffer, ok = result.(*bytes.Buffer)
 			if !ok {
 				blockBuffer = new(bytes.Buffer)
 				_, err = io.Copy(blockBuffer, result)
 			}
 			if err != nil {
 				traverser.Error(err)
+				blockBuffer = nil
 			} else {
 				data = blockBuffer.Bytes()
-				err = traverser.Advance(blockBuffer)
-				if err != nil {
-					return err
-				}
 			}
 		}
-		err = sendResponse(lnk, data)
+		// the block is sent before the traversal advances past it, so the
+		// sender can decide whether its links are traversed
+		skipLinks, err := sendResponse(lnk, data)
+		if blockBuffer != nil {
+			if skipLinks {
+				traverser.Error(traversal.SkipMe{})
+			} else if advanceErr := traverser.Advance(blockBuffer); advanceErr != nil {
+				return advanceErr
+			}
+		}
 		if err != nil {
 			return err
 		}
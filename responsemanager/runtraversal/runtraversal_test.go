@@ -20,15 +20,20 @@ type fakeResponseKey struct {
 	Data string
 }
 
+type fakeSendResult struct {
+	skipLinks bool
+	err       error
+}
+
 type fakeResponseSender struct {
-	stubbedResponses  map[fakeResponseKey]error
+	stubbedResponses  map[fakeResponseKey]fakeSendResult
 	expectedResponses map[fakeResponseKey]struct{}
 	receivedResponses map[fakeResponseKey]struct{}
 }
 
 func newFakeResponseSender() *fakeResponseSender {
 	return &fakeResponseSender{
-		stubbedResponses:  make(map[fakeResponseKey]error),
+		stubbedResponses:  make(map[fakeResponseKey]fakeSendResult),
 		expectedResponses: make(map[fakeResponseKey]struct{}),
 		receivedResponses: make(map[fakeResponseKey]struct{}),
 	}
@@ -37,12 +42,13 @@ func newFakeResponseSender() *fakeResponseSender {
 func (frs *fakeResponseSender) SendResponse(
 	link ipld.Link,
 	data []byte,
-) error {
+) (bool, error) {
 	frs.receivedResponses[fakeResponseKey{link, string(data)}] = struct{}{}
-	return frs.stubbedResponses[fakeResponseKey{link, string(data)}]
+	result := frs.stubbedResponses[fakeResponseKey{link, string(data)}]
+	return result.skipLinks, result.err
 }
 
-func (frs *fakeResponseSender) expectResponse(link ipld.Link, data []byte, returnVal error) {
+func (frs *fakeResponseSender) expectResponse(link ipld.Link, data []byte, returnVal fakeSendResult) {
 	frs.expectedResponses[fakeResponseKey{link, string(data)}] = struct{}{}
 	frs.stubbedResponses[fakeResponseKey{link, string(data)}] = returnVal
 }
@@ -137,6 +143,8 @@ func TestRunTraversal(t *testing.T) {
 		loadOutcomes         []traverseOutcome
 		loadOutcomesExpected int
 		errorsOnSend         []error
+		skipsOnSend          []bool
+		traverseOutcomes     []traverseOutcome
 		finalError           error
 		expectedError        error
 	}{
@@ -182,6 +190,26 @@ func TestRunTraversal(t *testing.T) {
 				nil, nil, nil,
 			},
 		},
+		"skip on send": {
+			linksToLoad:       links[:3],
+			linkLoadsExpected: 3,
+			loadOutcomes: []traverseOutcome{
+				{false, nil, blks[0].RawData()},
+				{false, nil, blks[1].RawData()},
+				{false, nil, blks[2].RawData()},
+			},
+			errorsOnSend: []error{
+				nil, nil, nil,
+			},
+			skipsOnSend: []bool{
+				false, true, false,
+			},
+			traverseOutcomes: []traverseOutcome{
+				{false, nil, blks[0].RawData()},
+				{true, traversal.SkipMe{}, nil},
+				{false, nil, blks[2].RawData()},
+			},
+		},
 		"error on send": {
 			linksToLoad:       links,
 			linkLoadsExpected: 3,
@@ -202,14 +230,22 @@ func TestRunTraversal(t *testing.T) {
 				expectedLoads: data.linksToLoad[:data.linkLoadsExpected],
 				loadReturns:   data.loadOutcomes,
 			}
+			expectedOutcomes := data.traverseOutcomes
+			if expectedOutcomes == nil {
+				expectedOutcomes = data.loadOutcomes
+			}
 			ft := &fakeTraverser{
 				finalError:       data.finalError,
 				loadedLinks:      data.linksToLoad,
-				expectedOutcomes: data.loadOutcomes,
+				expectedOutcomes: expectedOutcomes,
 			}
 			frs := newFakeResponseSender()
 			for i, err := range data.errorsOnSend {
-				frs.expectResponse(data.linksToLoad[i].link, data.loadOutcomes[i].data, err)
+				result := fakeSendResult{err: err}
+				if data.skipsOnSend != nil {
+					result.skipLinks = data.skipsOnSend[i]
+				}
+				frs.expectResponse(data.linksToLoad[i].link, data.loadOutcomes[i].data, result)
 			}
 			err := RunTraversal(fl.Load, ft, frs.SendResponse)
 			require.Equal(t, data.expectedError, err)
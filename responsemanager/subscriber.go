@@ -3,6 +3,7 @@ package responsemanager
 import (
 	"context"
 	"errors"
+	"sync"
 
 	"github.com/libp2p/go-libp2p-core/peer"
 
@@ -22,6 +23,8 @@ type subscriber struct {
 	blockSentListeners    BlockSentListeners
 	networkErrorListeners NetworkErrorListeners
 	completedListeners    CompletedListeners
+	sentBlocksLk          sync.Mutex
+	sentBlocks            []graphsync.BlockData
 }
 
 func (s *subscriber) OnNext(topic notifications.Topic, event notifications.Event) {
@@ -40,6 +43,9 @@ func (s *subscriber) OnNext(topic notifications.Topic, event notifications.Event
 			}
 		case peerresponsemanager.Sent:
 			s.blockSentListeners.NotifyBlockSentListeners(s.p, s.request, blockData)
+			s.sentBlocksLk.Lock()
+			s.sentBlocks = append(s.sentBlocks, blockData)
+			s.sentBlocksLk.Unlock()
 		}
 		return
 	}
@@ -58,6 +64,16 @@ func (s *subscriber) OnNext(topic notifications.Topic, event notifications.Event
 	}
 }
 
+func (s *subscriber) OnBatchEnd(event notifications.Event) {
+	s.sentBlocksLk.Lock()
+	sentBlocks := s.sentBlocks
+	s.sentBlocks = nil
+	s.sentBlocksLk.Unlock()
+	if len(sentBlocks) > 0 {
+		s.blockSentListeners.NotifyBlocksSentListeners(s.p, s.request, sentBlocks)
+	}
+}
+
 func (s *subscriber) OnClose(topic notifications.Topic) {
 
 }
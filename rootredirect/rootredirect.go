@@ -0,0 +1,64 @@
+package rootredirect
+
+import (
+	"errors"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+
+	"github.com/ipfs/go-graphsync/ipldutil"
+)
+
+// Redirect describes a response that was traversed from a different root
+// than the one requested
+type Redirect struct {
+	// Original is the root the requestor asked for
+	Original cid.Cid
+	// Root is the root the response was traversed from
+	Root cid.Cid
+}
+
+// EncodeRedirect encodes a redirect into bytes for the root-redirect extension
+func EncodeRedirect(redirect Redirect) ([]byte, error) {
+	nd := fluent.MustBuildMap(basicnode.Prototype.Map, 2, func(ma fluent.MapAssembler) {
+		ma.AssembleEntry("Original").AssignLink(cidlink.Link{Cid: redirect.Original})
+		ma.AssembleEntry("Root").AssignLink(cidlink.Link{Cid: redirect.Root})
+	})
+	return ipldutil.EncodeNode(nd)
+}
+
+// DecodeRedirect decodes a redirect from data for the root-redirect extension
+func DecodeRedirect(data []byte) (Redirect, error) {
+	nd, err := ipldutil.DecodeNode(data)
+	if err != nil {
+		return Redirect{}, err
+	}
+	original, err := lookupCid(nd, "Original")
+	if err != nil {
+		return Redirect{}, err
+	}
+	root, err := lookupCid(nd, "Root")
+	if err != nil {
+		return Redirect{}, err
+	}
+	return Redirect{Original: original, Root: root}, nil
+}
+
+func lookupCid(nd ipld.Node, key string) (cid.Cid, error) {
+	value, err := nd.LookupByString(key)
+	if err != nil {
+		return cid.Undef, err
+	}
+	link, err := value.AsLink()
+	if err != nil {
+		return cid.Undef, err
+	}
+	asCidLink, ok := link.(cidlink.Link)
+	if !ok {
+		return cid.Undef, errors.New("contained non CID link")
+	}
+	return asCidLink.Cid, nil
+}
@@ -0,0 +1,19 @@
+package rootredirect
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestDecodeEncodeRedirect(t *testing.T) {
+	cids := testutil.GenerateCids(2)
+	redirect := Redirect{Original: cids[0], Root: cids[1]}
+	encoded, err := EncodeRedirect(redirect)
+	require.NoError(t, err, "encode errored")
+	decoded, err := DecodeRedirect(encoded)
+	require.NoError(t, err, "decode errored")
+	require.Equal(t, redirect, decoded)
+}
@@ -0,0 +1,59 @@
+/*
+Package selectors builds selector specs for common graphsync requests, so
+routine fetches don't need the ipld-prime selector builder.
+
+Selectors combine -- PathThen(path, DAGToDepth(10)) fetches the blocks along
+a path, then the DAG under it up to ten links deep.
+*/
+package selectors
+
+import (
+	ipld "github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+)
+
+// EntireDAG returns a selector for every node reachable from the root,
+// however deep. Responders using the default request validation reject
+// selectors without a recursion limit -- use DAGToDepth for those
+func EntireDAG() ipld.Node {
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	return ssb.ExploreRecursive(selector.RecursionLimitNone(), ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+}
+
+// DAGToDepth returns a selector for every node reachable from the root by
+// following at most depth links
+func DAGToDepth(depth int) ipld.Node {
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	return ssb.ExploreRecursive(selector.RecursionLimitDepth(depth), ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+}
+
+// SingleBlock returns a selector for just the root block
+func SingleBlock() ipld.Node {
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	return ssb.Matcher().Node()
+}
+
+// PathThen returns a selector that follows the given path from the root,
+// loading the blocks along it, then applies the next selector to the node at
+// the end of the path. Path segments are separated by "/"
+func PathThen(path string, next ipld.Node) ipld.Node {
+	segments := ipld.ParsePath(path).Segments()
+	for i := len(segments) - 1; i >= 0; i-- {
+		next = exploreField(segments[i].String(), next)
+	}
+	return next
+}
+
+// exploreField returns a selector that applies next to the given field
+func exploreField(field string, next ipld.Node) ipld.Node {
+	return fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+		na.AssembleEntry(selector.SelectorKey_ExploreFields).CreateMap(1, func(na fluent.MapAssembler) {
+			na.AssembleEntry(selector.SelectorKey_Fields).CreateMap(1, func(na fluent.MapAssembler) {
+				na.AssembleEntry(field).AssignNode(next)
+			})
+		})
+	})
+}
@@ -0,0 +1,61 @@
+package selectors_test
+
+import (
+	"testing"
+
+	ipld "github.com/ipld/go-ipld-prime"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync/ipldutil"
+	"github.com/ipfs/go-graphsync/selectors"
+	"github.com/ipfs/go-graphsync/selectorvalidator"
+)
+
+func TestSelectorsParse(t *testing.T) {
+	testCases := map[string]ipld.Node{
+		"entire DAG":   selectors.EntireDAG(),
+		"DAG to depth": selectors.DAGToDepth(5),
+		"single block": selectors.SingleBlock(),
+		"path then":    selectors.PathThen("Parents/0/Parents", selectors.DAGToDepth(5)),
+	}
+	for testCase, node := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			_, err := ipldutil.ParseSelector(node)
+			require.NoError(t, err)
+			encoded, err := ipldutil.EncodeNode(node)
+			require.NoError(t, err)
+			_, err = ipldutil.DecodeNode(encoded)
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestSelectorsValidation(t *testing.T) {
+	require.Error(t, selectorvalidator.ValidateMaxRecursionDepth(selectors.EntireDAG(), 100))
+	require.NoError(t, selectorvalidator.ValidateMaxRecursionDepth(selectors.DAGToDepth(100), 100))
+	require.Error(t, selectorvalidator.ValidateMaxRecursionDepth(selectors.DAGToDepth(101), 100))
+}
+
+func TestPathThen(t *testing.T) {
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	expected := ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+		efsb.Insert("Parents", ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+			efsb.Insert("0", ssb.ExploreRecursive(selector.RecursionLimitDepth(5), ssb.ExploreAll(ssb.ExploreRecursiveEdge())))
+		}))
+	}).Node()
+	expectedEncoded, err := ipldutil.EncodeNode(expected)
+	require.NoError(t, err)
+
+	encoded, err := ipldutil.EncodeNode(selectors.PathThen("Parents/0", selectors.DAGToDepth(5)))
+	require.NoError(t, err)
+	require.Equal(t, expectedEncoded, encoded)
+
+	encoded, err = ipldutil.EncodeNode(selectors.PathThen("", selectors.SingleBlock()))
+	require.NoError(t, err)
+	singleBlockEncoded, err := ipldutil.EncodeNode(selectors.SingleBlock())
+	require.NoError(t, err)
+	require.Equal(t, singleBlockEncoded, encoded)
+}
@@ -0,0 +1,274 @@
+/*
+Package session groups several requests to the same peer so they behave as one
+transfer. Requests in a session share a dedup key, so the responder tracks the
+blocks sent for all of them together, and later requests ask the responder not
+to send the most recent blocks earlier requests already received. Every request
+in a session is sent with the session's priority, and a session can also cap
+the bytes received across all of its requests. When a session is closed, its
+completed listeners receive a summary of the whole session.
+*/
+package session
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/cidset"
+	"github.com/ipfs/go-graphsync/dedupkey"
+)
+
+// ErrBudgetExceeded is sent on the error channel of a request that was
+// terminated because the session received more than its byte budget
+var ErrBudgetExceeded = errors.New("session byte budget exceeded")
+
+// ErrClosed is returned when making a request on a closed session
+var ErrClosed = errors.New("session closed")
+
+var lastSession uint64
+
+// defaultMaxDoNotSendCIDs is the default number of received blocks later
+// requests in a session ask the responder not to send
+const defaultMaxDoNotSendCIDs = 1024
+
+// Summary totals all the requests made in a session
+type Summary struct {
+	// Peer is the peer requests were made to
+	Peer peer.ID
+	// Requests is the number of requests made
+	Requests int
+	// Succeeded is the number of requests that completed without errors
+	Succeeded int
+	// Failed is the number of requests that completed with errors
+	Failed int
+	// Blocks is the number of blocks received over the wire
+	Blocks uint64
+	// BytesReceived is the total size of blocks received over the wire
+	BytesReceived uint64
+	// Duration is the time from the session being opened to it closing
+	Duration time.Duration
+}
+
+// CompletedListener is called with the summary of a session when it closes
+type CompletedListener func(Summary)
+
+// Session is a group of requests to a single peer
+type Session struct {
+	exchange    graphsync.GraphExchange
+	p           peer.ID
+	key         []byte
+	maxBytes    uint64
+	priority    graphsync.Priority
+	hasPriority bool
+	maxReceived int
+	started     time.Time
+	unregisters []graphsync.UnregisterHookFunc
+	inProgress  sync.WaitGroup
+
+	lk                 sync.Mutex
+	closed             bool
+	requestIDs         map[graphsync.RequestID]struct{}
+	received           *cid.Set
+	receivedOrder      []cid.Cid
+	nextReceived       int
+	summary            Summary
+	completedListeners []CompletedListener
+}
+
+// Option configures a session
+type Option func(*Session)
+
+// MaxBytes caps the total size of blocks received over the wire across all
+// requests in the session. Requests still in progress when the budget is used
+// up are terminated with ErrBudgetExceeded
+func MaxBytes(maxBytes uint64) Option {
+	return func(s *Session) {
+		s.maxBytes = maxBytes
+	}
+}
+
+// Priority sends every request in the session with the given priority, in
+// place of the exchange's default request priority
+func Priority(priority graphsync.Priority) Option {
+	return func(s *Session) {
+		s.priority = priority
+		s.hasPriority = true
+	}
+}
+
+// MaxDoNotSendCIDs caps how many of the blocks received so far later requests
+// ask the responder not to send, so the list sent with each request does not
+// grow with the session. Only the most recently received blocks are listed.
+// With a cap of zero, requests rely on the shared dedup key alone, which only
+// dedups against requests still in progress
+func MaxDoNotSendCIDs(maxCids int) Option {
+	return func(s *Session) {
+		s.maxReceived = maxCids
+	}
+}
+
+// New opens a session for requests to the given peer on the given exchange
+func New(exchange graphsync.GraphExchange, p peer.ID, options ...Option) (*Session, error) {
+	key, err := dedupkey.EncodeDedupKey(fmt.Sprintf("graphsync-session-%d", atomic.AddUint64(&lastSession, 1)))
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{
+		exchange:    exchange,
+		p:           p,
+		key:         key,
+		maxReceived: defaultMaxDoNotSendCIDs,
+		started:     time.Now(),
+		requestIDs:  make(map[graphsync.RequestID]struct{}),
+		received:    cid.NewSet(),
+		summary:     Summary{Peer: p},
+	}
+	for _, option := range options {
+		option(s)
+	}
+	s.unregisters = []graphsync.UnregisterHookFunc{
+		exchange.RegisterOutgoingRequestHook(s.onOutgoingRequest),
+		exchange.RegisterIncomingBlockHook(s.onIncomingBlock),
+	}
+	return s, nil
+}
+
+// RegisterCompletedListener adds a listener called when the session closes
+func (s *Session) RegisterCompletedListener(listener CompletedListener) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.completedListeners = append(s.completedListeners, listener)
+}
+
+// Request makes a request to the session's peer as part of the session
+func (s *Session) Request(ctx context.Context, root ipld.Link, selector ipld.Node, extensions ...graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan error) {
+	s.lk.Lock()
+	if s.closed {
+		s.lk.Unlock()
+		return singleError(ErrClosed)
+	}
+	s.inProgress.Add(1)
+	s.summary.Requests++
+	extensions = append(extensions, graphsync.ExtensionData{Name: graphsync.ExtensionDeDupByKey, Data: s.key})
+	if s.received.Len() > 0 {
+		doNotSendCids, err := cidset.EncodeCidSet(s.received)
+		if err != nil {
+			s.summary.Failed++
+			s.lk.Unlock()
+			s.inProgress.Done()
+			return singleError(err)
+		}
+		extensions = append(extensions, graphsync.ExtensionData{Name: graphsync.ExtensionDoNotSendCIDs, Data: doNotSendCids})
+	}
+	s.lk.Unlock()
+
+	if s.hasPriority {
+		ctx = graphsync.WithRequestPriority(ctx, s.priority)
+	}
+	progress, errs := s.exchange.Request(ctx, s.p, root, selector, extensions...)
+	outgoingErrs := make(chan error)
+	go s.forwardErrors(errs, outgoingErrs)
+	return progress, outgoingErrs
+}
+
+// Close waits for requests in progress to finish, then ends the session,
+// notifying completed listeners and returning the summary
+func (s *Session) Close() Summary {
+	s.lk.Lock()
+	s.closed = true
+	s.lk.Unlock()
+	s.inProgress.Wait()
+	for _, unregister := range s.unregisters {
+		unregister()
+	}
+	s.lk.Lock()
+	s.summary.Duration = time.Since(s.started)
+	summary := s.summary
+	listeners := s.completedListeners
+	s.lk.Unlock()
+	for _, listener := range listeners {
+		listener(summary)
+	}
+	return summary
+}
+
+func (s *Session) forwardErrors(errs <-chan error, outgoingErrs chan<- error) {
+	defer s.inProgress.Done()
+	defer close(outgoingErrs)
+	failed := false
+	for err := range errs {
+		failed = true
+		outgoingErrs <- err
+	}
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if failed {
+		s.summary.Failed++
+	} else {
+		s.summary.Succeeded++
+	}
+}
+
+func (s *Session) onOutgoingRequest(p peer.ID, request graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+	key, ok := request.Extension(graphsync.ExtensionDeDupByKey)
+	if !ok || p != s.p || !bytes.Equal(key, s.key) {
+		return
+	}
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.requestIDs[request.ID()] = struct{}{}
+}
+
+func (s *Session) onIncomingBlock(p peer.ID, response graphsync.ResponseData, block graphsync.BlockData, hookActions graphsync.IncomingBlockHookActions) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if _, ok := s.requestIDs[response.RequestID()]; !ok || p != s.p {
+		return
+	}
+	if asCidLink, ok := block.Link().(cidlink.Link); ok {
+		s.addReceived(asCidLink.Cid)
+	}
+	if block.BlockSizeOnWire() == 0 {
+		return
+	}
+	s.summary.Blocks++
+	s.summary.BytesReceived += block.BlockSizeOnWire()
+	if s.maxBytes > 0 && s.summary.BytesReceived > s.maxBytes {
+		hookActions.TerminateWithError(ErrBudgetExceeded)
+	}
+}
+
+// addReceived records a received block, forgetting the oldest recorded block
+// once maxReceived are recorded. It must be called with lk held
+func (s *Session) addReceived(c cid.Cid) {
+	if s.maxReceived <= 0 || s.received.Has(c) {
+		return
+	}
+	if len(s.receivedOrder) < s.maxReceived {
+		s.receivedOrder = append(s.receivedOrder, c)
+	} else {
+		s.received.Remove(s.receivedOrder[s.nextReceived])
+		s.receivedOrder[s.nextReceived] = c
+		s.nextReceived = (s.nextReceived + 1) % s.maxReceived
+	}
+	s.received.Add(c)
+}
+
+func singleError(err error) (<-chan graphsync.ResponseProgress, <-chan error) {
+	progress := make(chan graphsync.ResponseProgress)
+	errs := make(chan error, 1)
+	errs <- err
+	close(progress)
+	close(errs)
+	return progress, errs
+}
@@ -0,0 +1,188 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/cidset"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+type blockData struct {
+	link       ipld.Link
+	size       uint64
+	sizeOnWire uint64
+}
+
+func (bd blockData) Link() ipld.Link         { return bd.link }
+func (bd blockData) BlockSize() uint64       { return bd.size }
+func (bd blockData) BlockSizeOnWire() uint64 { return bd.sizeOnWire }
+func (bd blockData) Cid() cid.Cid            { return bd.link.(cidlink.Link).Cid }
+func (bd blockData) Index() int64            { return 0 }
+func (bd blockData) Deduplicated() bool      { return false }
+
+type blockHookActions struct {
+	err error
+}
+
+func (bha *blockHookActions) TerminateWithError(err error)                           { bha.err = err }
+func (bha *blockHookActions) UpdateRequestWithExtensions(...graphsync.ExtensionData) {}
+func (bha *blockHookActions) PauseRequest()                                          {}
+func (bha *blockHookActions) Context() context.Context                               { return context.Background() }
+
+// fakeExchange runs the session's hooks as a real exchange would and lets the
+// test decide how each request ends
+type fakeExchange struct {
+	graphsync.GraphExchange
+	nextRequestID  graphsync.RequestID
+	requestHook    graphsync.OnOutgoingRequestHook
+	blockHook      graphsync.OnIncomingBlockHook
+	unregistered   int
+	lastRequest    gsmsg.GraphSyncRequest
+	lastRequestErr chan error
+}
+
+func (fe *fakeExchange) RegisterOutgoingRequestHook(hook graphsync.OnOutgoingRequestHook, options ...graphsync.HookOption) graphsync.UnregisterHookFunc {
+	fe.requestHook = hook
+	return func() { fe.unregistered++ }
+}
+
+func (fe *fakeExchange) RegisterIncomingBlockHook(hook graphsync.OnIncomingBlockHook, options ...graphsync.HookOption) graphsync.UnregisterHookFunc {
+	fe.blockHook = hook
+	return func() { fe.unregistered++ }
+}
+
+func (fe *fakeExchange) Request(ctx context.Context, p peer.ID, root ipld.Link, selector ipld.Node, extensions ...graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan error) {
+	fe.nextRequestID++
+	priority, _ := graphsync.RequestPriorityFromContext(ctx)
+	fe.lastRequest = gsmsg.NewRequest(fe.nextRequestID, root.(cidlink.Link).Cid, selector, priority, extensions...)
+	fe.requestHook(p, fe.lastRequest, nil)
+	progress := make(chan graphsync.ResponseProgress)
+	close(progress)
+	fe.lastRequestErr = make(chan error, 1)
+	return progress, fe.lastRequestErr
+}
+
+func (fe *fakeExchange) receiveBlock(p peer.ID, block blockData) error {
+	actions := &blockHookActions{}
+	fe.blockHook(p, gsmsg.NewResponse(fe.lastRequest.ID(), graphsync.PartialResponse), block, actions)
+	return actions.err
+}
+
+func (fe *fakeExchange) finish(err error) {
+	if err != nil {
+		fe.lastRequestErr <- err
+	}
+	close(fe.lastRequestErr)
+}
+
+func drain(errs <-chan error) []error {
+	var collected []error
+	for err := range errs {
+		collected = append(collected, err)
+	}
+	return collected
+}
+
+func TestSession(t *testing.T) {
+	ctx := context.Background()
+	peers := testutil.GeneratePeers(2)
+	cids := testutil.GenerateCids(3)
+	root := cidlink.Link{Cid: cids[0]}
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	selector := ssb.Matcher().Node()
+	fe := &fakeExchange{}
+
+	s, err := New(fe, peers[0], MaxBytes(250))
+	require.NoError(t, err)
+	var completed []Summary
+	s.RegisterCompletedListener(func(summary Summary) {
+		completed = append(completed, summary)
+	})
+
+	// first request shares the session dedup key and has no cids to skip
+	_, errs := s.Request(ctx, root, selector)
+	key, ok := fe.lastRequest.Extension(graphsync.ExtensionDeDupByKey)
+	require.True(t, ok)
+	_, ok = fe.lastRequest.Extension(graphsync.ExtensionDoNotSendCIDs)
+	require.False(t, ok)
+	require.NoError(t, fe.receiveBlock(peers[0], blockData{cidlink.Link{Cid: cids[1]}, 100, 100}))
+	// blocks from other peers are not part of the session
+	require.NoError(t, fe.receiveBlock(peers[1], blockData{cidlink.Link{Cid: cids[2]}, 1000, 1000}))
+	fe.finish(nil)
+	require.Empty(t, drain(errs))
+
+	// second request skips blocks the first received, and is cut off by the budget
+	_, errs = s.Request(ctx, root, selector)
+	secondKey, _ := fe.lastRequest.Extension(graphsync.ExtensionDeDupByKey)
+	require.Equal(t, key, secondKey)
+	doNotSendData, ok := fe.lastRequest.Extension(graphsync.ExtensionDoNotSendCIDs)
+	require.True(t, ok)
+	doNotSend, err := cidset.DecodeCidSet(doNotSendData)
+	require.NoError(t, err)
+	require.Equal(t, 1, doNotSend.Len())
+	require.True(t, doNotSend.Has(cids[1]))
+	require.NoError(t, fe.receiveBlock(peers[0], blockData{cidlink.Link{Cid: cids[2]}, 100, 100}))
+	require.Equal(t, ErrBudgetExceeded, fe.receiveBlock(peers[0], blockData{cidlink.Link{Cid: cids[0]}, 100, 100}))
+	fe.finish(errors.New("request terminated"))
+	require.Len(t, drain(errs), 1)
+
+	summary := s.Close()
+	require.Equal(t, peers[0], summary.Peer)
+	require.Equal(t, 2, summary.Requests)
+	require.Equal(t, 1, summary.Succeeded)
+	require.Equal(t, 1, summary.Failed)
+	require.Equal(t, uint64(3), summary.Blocks)
+	require.Equal(t, uint64(300), summary.BytesReceived)
+	require.Equal(t, []Summary{summary}, completed)
+	require.Equal(t, 2, fe.unregistered)
+
+	_, errs = s.Request(ctx, root, selector)
+	require.Equal(t, []error{ErrClosed}, drain(errs))
+}
+
+func TestSessionPriorityAndDoNotSendCap(t *testing.T) {
+	ctx := context.Background()
+	p := testutil.GeneratePeers(1)[0]
+	cids := testutil.GenerateCids(4)
+	root := cidlink.Link{Cid: cids[0]}
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	selector := ssb.Matcher().Node()
+	fe := &fakeExchange{}
+
+	s, err := New(fe, p, Priority(graphsync.Priority(7)), MaxDoNotSendCIDs(2))
+	require.NoError(t, err)
+
+	_, errs := s.Request(ctx, root, selector)
+	require.Equal(t, graphsync.Priority(7), fe.lastRequest.Priority())
+	for _, c := range cids[1:] {
+		require.NoError(t, fe.receiveBlock(p, blockData{cidlink.Link{Cid: c}, 100, 100}))
+	}
+	fe.finish(nil)
+	require.Empty(t, drain(errs))
+
+	// only the most recently received blocks are listed
+	_, errs = s.Request(ctx, root, selector)
+	require.Equal(t, graphsync.Priority(7), fe.lastRequest.Priority())
+	doNotSendData, ok := fe.lastRequest.Extension(graphsync.ExtensionDoNotSendCIDs)
+	require.True(t, ok)
+	doNotSend, err := cidset.DecodeCidSet(doNotSendData)
+	require.NoError(t, err)
+	require.Equal(t, 2, doNotSend.Len())
+	require.True(t, doNotSend.Has(cids[2]))
+	require.True(t, doNotSend.Has(cids[3]))
+	fe.finish(nil)
+	require.Empty(t, drain(errs))
+	s.Close()
+}
@@ -0,0 +1,451 @@
+package storeutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/multiformats/go-multihash"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+// ErrNotInCarFile is returned when loading a block that has not been written
+// to a CarFile
+var ErrNotInCarFile = errors.New("block not in CAR file")
+
+// ErrCarFileReadOnly is returned when storing a block in a CarFile opened
+// with OpenCarFile
+var ErrCarFileReadOnly = errors.New("CAR file is read only")
+
+// carV2Pragma is the fixed prefix of a CARv2 file -- a CARv1 style header
+// with version 2
+var carV2Pragma = []byte{0x0a, 0xa1, 0x67, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x02}
+
+// carV2HeaderSize is the size of the CARv2 header that follows the pragma:
+// 16 bytes of characteristics, then data offset, data size and index offset
+const carV2HeaderSize = 40
+
+// multicodecs of the CARv2 index formats that can be read
+const (
+	carIndexSorted          = 0x0400
+	carMultihashIndexSorted = 0x0401
+)
+
+var errCarOutOfBounds = errors.New("CAR file section extends past the end of its data")
+
+type carSection struct {
+	offset int64
+	length int
+}
+
+// CarFile streams blocks into a CARv1 file in the order they are stored. It
+// can be registered as a persistence option so a request writes straight to
+// a CAR file -- blocks are stored in traversal order as they are verified, so
+// the file is in traversal order as well. Blocks already written are
+// indexed in memory so they can be loaded back during the traversal
+type CarFile struct {
+	lk       sync.Mutex
+	file     *os.File
+	readOnly bool
+	offset   int64
+	sections map[cid.Cid]carSection
+	// digests holds the offsets of sections listed in a CARv2 index, by
+	// multihash digest, until they are first loaded
+	digests map[string][]int64
+	dataEnd int64
+}
+
+// CreateCarFile creates (or truncates) a CARv1 file at the given path and
+// writes its header with the given roots
+func CreateCarFile(path string, roots ...cid.Cid) (*CarFile, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	header, err := encodeCarHeader(roots)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	cf := &CarFile{
+		file:     file,
+		sections: make(map[cid.Cid]carSection),
+	}
+	if err := cf.writeSection(header); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return cf, nil
+}
+
+// OpenCarFile opens an existing CARv1 or CARv2 file for reading, so a
+// responder can register it as a persistence option and serve blocks from it
+// without first importing them into a blockstore. A CARv2 file's own index is
+// used to find blocks when it is in a format that can be read; otherwise the
+// file is scanned once to index the offset of each block
+func OpenCarFile(path string) (*CarFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	cf := &CarFile{
+		file:     file,
+		readOnly: true,
+		sections: make(map[cid.Cid]carSection),
+		digests:  make(map[string][]int64),
+	}
+	if err := cf.index(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return cf, nil
+}
+
+func (cf *CarFile) index() error {
+	info, err := cf.file.Stat()
+	if err != nil {
+		return err
+	}
+	dataOffset, dataSize := int64(0), info.Size()
+	var indexOffset int64
+	pragma := make([]byte, len(carV2Pragma))
+	if _, err := cf.file.ReadAt(pragma, 0); err == nil && bytes.Equal(pragma, carV2Pragma) {
+		header := make([]byte, carV2HeaderSize)
+		if _, err := cf.file.ReadAt(header, int64(len(carV2Pragma))); err != nil {
+			return err
+		}
+		dataOffset = int64(binary.LittleEndian.Uint64(header[16:24]))
+		dataSize = int64(binary.LittleEndian.Uint64(header[24:32]))
+		indexOffset = int64(binary.LittleEndian.Uint64(header[32:40]))
+		if dataOffset < 0 || dataSize < 0 || dataOffset > info.Size()-dataSize {
+			return errCarOutOfBounds
+		}
+	}
+	cf.dataEnd = dataOffset + dataSize
+	if indexOffset > 0 {
+		indexed, err := cf.readIndex(dataOffset, indexOffset, info.Size())
+		if err != nil || indexed {
+			return err
+		}
+	}
+	r := &countingReader{r: bufio.NewReader(io.NewSectionReader(cf.file, dataOffset, dataSize))}
+
+	// skip the CARv1 header
+	headerLength, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	if headerLength > uint64(dataSize-r.n) {
+		return errCarOutOfBounds
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, int64(headerLength)); err != nil {
+		return err
+	}
+	for {
+		length, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// check the length before allocating, so a corrupt file can't claim a
+		// huge section
+		if length > uint64(dataSize-r.n) {
+			return errCarOutOfBounds
+		}
+		start := r.n
+		section := make([]byte, length)
+		if _, err := io.ReadFull(r, section); err != nil {
+			return err
+		}
+		n, c, err := cid.CidFromBytes(section)
+		if err != nil {
+			return err
+		}
+		cf.sections[c] = carSection{
+			offset: dataOffset + start + int64(n),
+			length: len(section) - n,
+		}
+	}
+}
+
+// readIndex reads the offset of each block from a CARv2 index, returning
+// false if the index is in a format that can't be read
+func (cf *CarFile) readIndex(dataOffset int64, indexOffset int64, fileSize int64) (bool, error) {
+	if indexOffset < 0 || indexOffset >= fileSize {
+		return false, errCarOutOfBounds
+	}
+	indexSize := fileSize - indexOffset
+	r := &countingReader{r: bufio.NewReader(io.NewSectionReader(cf.file, indexOffset, indexSize))}
+	codec, err := binary.ReadUvarint(r)
+	if err != nil {
+		return false, err
+	}
+	switch codec {
+	case carIndexSorted:
+		if err := cf.readIndexBuckets(r, dataOffset, indexSize); err != nil {
+			return false, err
+		}
+	case carMultihashIndexSorted:
+		var codes int32
+		if err := binary.Read(r, binary.LittleEndian, &codes); err != nil {
+			return false, err
+		}
+		for i := int32(0); i < codes; i++ {
+			var code uint64
+			if err := binary.Read(r, binary.LittleEndian, &code); err != nil {
+				return false, err
+			}
+			if err := cf.readIndexBuckets(r, dataOffset, indexSize); err != nil {
+				return false, err
+			}
+		}
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// readIndexBuckets reads the buckets of a sorted CARv2 index, each holding
+// fixed width entries of a digest followed by the offset of its section
+func (cf *CarFile) readIndexBuckets(r *countingReader, dataOffset int64, indexSize int64) error {
+	var buckets int32
+	if err := binary.Read(r, binary.LittleEndian, &buckets); err != nil {
+		return err
+	}
+	for i := int32(0); i < buckets; i++ {
+		var width uint32
+		if err := binary.Read(r, binary.LittleEndian, &width); err != nil {
+			return err
+		}
+		var length int64
+		if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+			return err
+		}
+		if width <= 8 || length < 0 || length%int64(width) != 0 {
+			return errors.New("invalid CARv2 index")
+		}
+		if int64(width) > indexSize-r.n || length > indexSize-r.n {
+			return errCarOutOfBounds
+		}
+		entry := make([]byte, width)
+		for read := int64(0); read < length; read += int64(width) {
+			if _, err := io.ReadFull(r, entry); err != nil {
+				return err
+			}
+			digestLength := len(entry) - 8
+			offset := int64(binary.LittleEndian.Uint64(entry[digestLength:]))
+			if offset < 0 || offset >= cf.dataEnd-dataOffset {
+				return errCarOutOfBounds
+			}
+			digest := string(entry[:digestLength])
+			cf.digests[digest] = append(cf.digests[digest], dataOffset+offset)
+		}
+	}
+	return nil
+}
+
+// loadIndexed reads the section for the given CID from the offset a CARv2
+// index gives for its digest. It must be called with the lock held
+func (cf *CarFile) loadIndexed(c cid.Cid) (carSection, bool, error) {
+	decoded, err := multihash.Decode(c.Hash())
+	if err != nil {
+		return carSection{}, false, err
+	}
+	for _, offset := range cf.digests[string(decoded.Digest)] {
+		section, ok, err := cf.readSectionFor(c, offset)
+		if err != nil || ok {
+			return section, ok, err
+		}
+	}
+	return carSection{}, false, nil
+}
+
+// readSectionFor reads the section at the given offset, if it holds the given
+// CID. It must be called with the lock held
+func (cf *CarFile) readSectionFor(c cid.Cid, offset int64) (carSection, bool, error) {
+	r := &countingReader{r: bufio.NewReader(io.NewSectionReader(cf.file, offset, cf.dataEnd-offset))}
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return carSection{}, false, err
+	}
+	if length > uint64(cf.dataEnd-offset-r.n) {
+		return carSection{}, false, errCarOutOfBounds
+	}
+	start := r.n
+	// only the CID is read here -- the block itself is read by the loader.
+	// Different CIDs can share a digest, so only a matching CID is used
+	cidBytes := c.Bytes()
+	if length < uint64(len(cidBytes)) {
+		return carSection{}, false, nil
+	}
+	prefix := make([]byte, len(cidBytes))
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return carSection{}, false, err
+	}
+	if !bytes.Equal(prefix, cidBytes) {
+		return carSection{}, false, nil
+	}
+	section := carSection{
+		offset: offset + start + int64(len(cidBytes)),
+		length: int(length) - len(cidBytes),
+	}
+	cf.sections[c] = section
+	return section, true, nil
+}
+
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func (cr *countingReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.n++
+	}
+	return b, err
+}
+
+// Loader returns a loader for blocks already written to the CAR file
+func (cf *CarFile) Loader() ipld.Loader {
+	return func(lnk ipld.Link, lnkCtx ipld.LinkContext) (io.Reader, error) {
+		asCidLink, ok := lnk.(cidlink.Link)
+		if !ok {
+			return nil, fmt.Errorf("Unsupported Link Type")
+		}
+		cf.lk.Lock()
+		defer cf.lk.Unlock()
+		section, ok := cf.sections[asCidLink.Cid]
+		if !ok && len(cf.digests) > 0 {
+			var err error
+			section, ok, err = cf.loadIndexed(asCidLink.Cid)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !ok {
+			return nil, ErrNotInCarFile
+		}
+		data := make([]byte, section.length)
+		if _, err := cf.file.ReadAt(data, section.offset); err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(data), nil
+	}
+}
+
+// Storer returns a storer that appends each committed block to the CAR file.
+// Blocks already in the file are not written again
+func (cf *CarFile) Storer() ipld.Storer {
+	return func(lnkCtx ipld.LinkContext) (io.Writer, ipld.StoreCommitter, error) {
+		var buffer settableBuffer
+		committer := func(lnk ipld.Link) error {
+			asCidLink, ok := lnk.(cidlink.Link)
+			if !ok {
+				return fmt.Errorf("Unsupported Link Type")
+			}
+			cf.lk.Lock()
+			defer cf.lk.Unlock()
+			if cf.readOnly {
+				return ErrCarFileReadOnly
+			}
+			if _, ok := cf.sections[asCidLink.Cid]; ok {
+				return nil
+			}
+			cidBytes := asCidLink.Cid.Bytes()
+			data := buffer.Bytes()
+			section := make([]byte, 0, len(cidBytes)+len(data))
+			section = append(section, cidBytes...)
+			section = append(section, data...)
+			if err := cf.writeSection(section); err != nil {
+				return err
+			}
+			cf.sections[asCidLink.Cid] = carSection{
+				offset: cf.offset - int64(len(data)),
+				length: len(data),
+			}
+			return nil
+		}
+		return &buffer, committer, nil
+	}
+}
+
+// Close syncs and closes the underlying file
+func (cf *CarFile) Close() error {
+	cf.lk.Lock()
+	defer cf.lk.Unlock()
+	if cf.readOnly {
+		return cf.file.Close()
+	}
+	if err := cf.file.Sync(); err != nil {
+		_ = cf.file.Close()
+		return err
+	}
+	return cf.file.Close()
+}
+
+// writeSection writes a varint length prefix followed by data at the end of
+// the file. It must be called with the lock held (or before the CarFile is
+// shared)
+func (cf *CarFile) writeSection(data []byte) error {
+	prefix := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(prefix, uint64(len(data)))
+	if _, err := cf.file.WriteAt(prefix[:n], cf.offset); err != nil {
+		return err
+	}
+	if _, err := cf.file.WriteAt(data, cf.offset+int64(n)); err != nil {
+		return err
+	}
+	cf.offset += int64(n) + int64(len(data))
+	return nil
+}
+
+// encodeCarHeader encodes the dag-cbor map {"roots": [...], "version": 1}
+func encodeCarHeader(roots []cid.Cid) ([]byte, error) {
+	w := new(bytes.Buffer)
+	scratch := make([]byte, 9)
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajMap, 2); err != nil {
+		return nil, err
+	}
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("roots"))); err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, "roots"); err != nil {
+		return nil, err
+	}
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajArray, uint64(len(roots))); err != nil {
+		return nil, err
+	}
+	for _, root := range roots {
+		if err := cbg.WriteCidBuf(scratch, w, root); err != nil {
+			return nil, err
+		}
+	}
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("version"))); err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, "version"); err != nil {
+		return nil, err
+	}
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, 1); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
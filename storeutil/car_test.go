@@ -0,0 +1,240 @@
+package storeutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestCarFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graphsync-car")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.car")
+
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	cf, err := CreateCarFile(path, blks[0].Cid())
+	require.NoError(t, err)
+	loader, storer := cf.Loader(), cf.Storer()
+
+	_, err = loader(cidlink.Link{Cid: blks[0].Cid()}, ipld.LinkContext{})
+	require.EqualError(t, err, ErrNotInCarFile.Error())
+
+	for _, blk := range append(blks, blks[1]) {
+		writer, committer, err := storer(ipld.LinkContext{})
+		require.NoError(t, err)
+		_, err = writer.Write(blk.RawData())
+		require.NoError(t, err)
+		require.NoError(t, committer(cidlink.Link{Cid: blk.Cid()}))
+	}
+
+	for _, blk := range blks {
+		reader, err := loader(cidlink.Link{Cid: blk.Cid()}, ipld.LinkContext{})
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, blk.RawData(), data)
+	}
+	require.NoError(t, cf.Close())
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	r := bufio.NewReader(file)
+	readSection := func() []byte {
+		length, err := binary.ReadUvarint(r)
+		require.NoError(t, err)
+		section := make([]byte, length)
+		_, err = io.ReadFull(r, section)
+		require.NoError(t, err)
+		return section
+	}
+	header := readSection()
+	require.NotEmpty(t, header)
+
+	// sections are in the order blocks were stored, without the duplicate
+	for _, blk := range blks {
+		section := readSection()
+		n, c, err := cid.CidFromBytes(section)
+		require.NoError(t, err)
+		require.Equal(t, blk.Cid(), c)
+		require.Equal(t, blk.RawData(), section[n:])
+	}
+	_, err = binary.ReadUvarint(r)
+	require.Equal(t, io.EOF, err)
+}
+
+func TestOpenCarFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graphsync-car")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	v1Path := filepath.Join(dir, "v1.car")
+
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	cf, err := CreateCarFile(v1Path, blks[0].Cid())
+	require.NoError(t, err)
+	storer := cf.Storer()
+	for _, blk := range blks {
+		writer, committer, err := storer(ipld.LinkContext{})
+		require.NoError(t, err)
+		_, err = writer.Write(blk.RawData())
+		require.NoError(t, err)
+		require.NoError(t, committer(cidlink.Link{Cid: blk.Cid()}))
+	}
+	require.NoError(t, cf.Close())
+
+	// wrap the CARv1 payload in CARv2 files, with an index that can be read
+	// and with one in an unknown format
+	v1Data, err := ioutil.ReadFile(v1Path)
+	require.NoError(t, err)
+	v2Path := filepath.Join(dir, "v2.car")
+	writeCarV2(t, v2Path, v1Data, sortedCarIndex(t, v1Data))
+	unindexedPath := filepath.Join(dir, "v2-unindexed.car")
+	writeCarV2(t, unindexedPath, v1Data, []byte{0x80, 0x0a, 0xff, 0xff})
+
+	cf, err = OpenCarFile(v2Path)
+	require.NoError(t, err)
+	require.Empty(t, cf.sections, "should find blocks with the index rather than scanning")
+	require.Len(t, cf.digests, len(blks))
+	require.NoError(t, cf.Close())
+
+	for _, path := range []string{v1Path, v2Path, unindexedPath} {
+		cf, err := OpenCarFile(path)
+		require.NoError(t, err)
+		loader := cf.Loader()
+		for _, blk := range blks {
+			reader, err := loader(cidlink.Link{Cid: blk.Cid()}, ipld.LinkContext{})
+			require.NoError(t, err)
+			data, err := ioutil.ReadAll(reader)
+			require.NoError(t, err)
+			require.Equal(t, blk.RawData(), data)
+		}
+		_, err = loader(cidlink.Link{Cid: testutil.GenerateBlocksOfSize(1, 100)[0].Cid()}, ipld.LinkContext{})
+		require.EqualError(t, err, ErrNotInCarFile.Error())
+
+		writer, committer, err := cf.Storer()(ipld.LinkContext{})
+		require.NoError(t, err)
+		_, err = writer.Write(blks[0].RawData())
+		require.NoError(t, err)
+		require.EqualError(t, committer(cidlink.Link{Cid: blks[0].Cid()}), ErrCarFileReadOnly.Error())
+		require.NoError(t, cf.Close())
+	}
+}
+
+func TestOpenCarFileOutOfBounds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graphsync-car")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "corrupt.car")
+
+	blks := testutil.GenerateBlocksOfSize(1, 100)
+	cf, err := CreateCarFile(path, blks[0].Cid())
+	require.NoError(t, err)
+	require.NoError(t, cf.Close())
+
+	// a section claiming to be far larger than the file
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	prefix := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(prefix, 1<<40)
+	data = append(data, prefix[:n]...)
+	data = append(data, blks[0].Cid().Bytes()...)
+	require.NoError(t, ioutil.WriteFile(path, data, 0644))
+	_, err = OpenCarFile(path)
+	require.EqualError(t, err, errCarOutOfBounds.Error())
+
+	// a CARv2 data payload past the end of the file
+	v2Path := filepath.Join(dir, "corrupt-v2.car")
+	writeCarV2(t, v2Path, data[:len(data)-n-len(blks[0].Cid().Bytes())], nil)
+	v2Data, err := ioutil.ReadFile(v2Path)
+	require.NoError(t, err)
+	binary.LittleEndian.PutUint64(v2Data[len(carV2Pragma)+24:], uint64(len(v2Data)))
+	require.NoError(t, ioutil.WriteFile(v2Path, v2Data, 0644))
+	_, err = OpenCarFile(v2Path)
+	require.EqualError(t, err, errCarOutOfBounds.Error())
+
+	// an index bucket with entries wider than the rest of the index
+	index := new(bytes.Buffer)
+	index.Write(prefix[:binary.PutUvarint(prefix, carIndexSorted)])
+	require.NoError(t, binary.Write(index, binary.LittleEndian, int32(1)))
+	require.NoError(t, binary.Write(index, binary.LittleEndian, uint32(1<<31)))
+	require.NoError(t, binary.Write(index, binary.LittleEndian, int64(0)))
+	writeCarV2(t, v2Path, data[:len(data)-n-len(blks[0].Cid().Bytes())], index.Bytes())
+	_, err = OpenCarFile(v2Path)
+	require.EqualError(t, err, errCarOutOfBounds.Error())
+}
+
+// writeCarV2 wraps a CARv1 payload in a CARv2 file, followed by the given
+// index if there is one
+func writeCarV2(t *testing.T, path string, v1Data []byte, index []byte) {
+	header := make([]byte, carV2HeaderSize)
+	dataOffset := uint64(len(carV2Pragma) + carV2HeaderSize)
+	binary.LittleEndian.PutUint64(header[16:24], dataOffset)
+	binary.LittleEndian.PutUint64(header[24:32], uint64(len(v1Data)))
+	if index != nil {
+		binary.LittleEndian.PutUint64(header[32:40], dataOffset+uint64(len(v1Data)))
+	}
+	var v2Data []byte
+	v2Data = append(v2Data, carV2Pragma...)
+	v2Data = append(v2Data, header...)
+	v2Data = append(v2Data, v1Data...)
+	v2Data = append(v2Data, index...)
+	require.NoError(t, ioutil.WriteFile(path, v2Data, 0644))
+}
+
+// sortedCarIndex builds a CARv2 IndexSorted index of the sections in a CARv1
+// payload, in a single bucket since every test block uses the same hash
+func sortedCarIndex(t *testing.T, v1Data []byte) []byte {
+	r := bytes.NewReader(v1Data)
+	readSection := func() (int64, []byte, error) {
+		offset := int64(len(v1Data) - r.Len())
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		section := make([]byte, length)
+		_, err = io.ReadFull(r, section)
+		return offset, section, err
+	}
+	_, _, err := readSection()
+	require.NoError(t, err)
+	var entries []byte
+	var width uint32
+	for {
+		offset, section, err := readSection()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		_, c, err := cid.CidFromBytes(section)
+		require.NoError(t, err)
+		decoded, err := multihash.Decode(c.Hash())
+		require.NoError(t, err)
+		width = uint32(len(decoded.Digest) + 8)
+		entries = append(entries, decoded.Digest...)
+		offsetBytes := make([]byte, 8)
+		binary.LittleEndian.PutUint64(offsetBytes, uint64(offset))
+		entries = append(entries, offsetBytes...)
+	}
+	index := new(bytes.Buffer)
+	prefix := make([]byte, binary.MaxVarintLen64)
+	index.Write(prefix[:binary.PutUvarint(prefix, carIndexSorted)])
+	require.NoError(t, binary.Write(index, binary.LittleEndian, int32(1)))
+	require.NoError(t, binary.Write(index, binary.LittleEndian, width))
+	require.NoError(t, binary.Write(index, binary.LittleEndian, int64(len(entries))))
+	index.Write(entries)
+	return index.Bytes()
+}
@@ -0,0 +1,154 @@
+package storeutil
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log"
+	ipld "github.com/ipld/go-ipld-prime"
+
+	"github.com/ipfs/go-graphsync"
+)
+
+var log = logging.Logger("graphsync")
+
+// ErrLazyStoreClosed is returned when loading or storing with a LazyStore
+// after it is closed
+var ErrLazyStoreClosed = errors.New("lazy store closed")
+
+// LazyStore opens a store with a factory the first time a block is loaded or
+// stored, and closes it again once it has been idle for a while, so many
+// persistence options can be registered without keeping all their stores open
+type LazyStore struct {
+	open        graphsync.StoreFactory
+	idleTimeout time.Duration
+
+	lk     sync.Mutex
+	loader ipld.Loader
+	storer ipld.Storer
+	closer io.Closer
+	inUse  int
+	idle   *time.Timer
+	closed bool
+}
+
+// NewLazyStore returns a LazyStore that opens its store with the given
+// factory, and closes it after idleTimeout without loads or stores. If
+// idleTimeout is zero, the store stays open once opened until Close
+func NewLazyStore(open graphsync.StoreFactory, idleTimeout time.Duration) *LazyStore {
+	return &LazyStore{
+		open:        open,
+		idleTimeout: idleTimeout,
+	}
+}
+
+// Loader returns a loader that opens the store if needed. Block data is read
+// in full before returning, so the store can be closed while it is used
+func (ls *LazyStore) Loader() ipld.Loader {
+	return func(lnk ipld.Link, lnkCtx ipld.LinkContext) (io.Reader, error) {
+		loader, _, err := ls.acquire()
+		if err != nil {
+			return nil, err
+		}
+		defer ls.release()
+		reader, err := loader(lnk, lnkCtx)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(data), nil
+	}
+}
+
+// Storer returns a storer that buffers block data, and opens the store if
+// needed when the block is committed
+func (ls *LazyStore) Storer() ipld.Storer {
+	return func(lnkCtx ipld.LinkContext) (io.Writer, ipld.StoreCommitter, error) {
+		var buffer settableBuffer
+		committer := func(lnk ipld.Link) error {
+			_, storer, err := ls.acquire()
+			if err != nil {
+				return err
+			}
+			defer ls.release()
+			return writeBlock(storer, lnk, buffer.Bytes())
+		}
+		return &buffer, committer, nil
+	}
+}
+
+// Close closes the store if it is open. Loads and stores fail afterwards
+func (ls *LazyStore) Close() error {
+	ls.lk.Lock()
+	defer ls.lk.Unlock()
+	ls.closed = true
+	if ls.idle != nil {
+		ls.idle.Stop()
+	}
+	return ls.teardown()
+}
+
+func (ls *LazyStore) acquire() (ipld.Loader, ipld.Storer, error) {
+	ls.lk.Lock()
+	defer ls.lk.Unlock()
+	if ls.closed {
+		return nil, nil, ErrLazyStoreClosed
+	}
+	if ls.loader == nil {
+		loader, storer, closer, err := ls.open()
+		if err != nil {
+			return nil, nil, err
+		}
+		ls.loader, ls.storer, ls.closer = loader, storer, closer
+	}
+	if ls.idle != nil {
+		ls.idle.Stop()
+	}
+	ls.inUse++
+	return ls.loader, ls.storer, nil
+}
+
+func (ls *LazyStore) release() {
+	ls.lk.Lock()
+	defer ls.lk.Unlock()
+	ls.inUse--
+	if ls.inUse > 0 || ls.idleTimeout == 0 || ls.closed {
+		return
+	}
+	if ls.idle == nil {
+		ls.idle = time.AfterFunc(ls.idleTimeout, ls.closeIdle)
+		return
+	}
+	ls.idle.Reset(ls.idleTimeout)
+}
+
+func (ls *LazyStore) closeIdle() {
+	ls.lk.Lock()
+	defer ls.lk.Unlock()
+	if ls.inUse > 0 {
+		return
+	}
+	if err := ls.teardown(); err != nil {
+		log.Warnf("unable to close idle store: %s", err)
+	}
+}
+
+// teardown closes the open store, if any. It must be called with the lock held
+func (ls *LazyStore) teardown() error {
+	if ls.loader == nil {
+		return nil
+	}
+	closer := ls.closer
+	ls.loader, ls.storer, ls.closer = nil, nil, nil
+	if closer == nil {
+		return nil
+	}
+	return closer.Close()
+}
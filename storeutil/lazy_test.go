@@ -0,0 +1,62 @@
+package storeutil
+
+import (
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ipld "github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+type countingCloser struct {
+	closes *int32
+}
+
+func (cc countingCloser) Close() error {
+	atomic.AddInt32(cc.closes, 1)
+	return nil
+}
+
+func TestLazyStore(t *testing.T) {
+	store := make(map[ipld.Link][]byte)
+	var opens, closes int32
+	factory := func() (ipld.Loader, ipld.Storer, io.Closer, error) {
+		atomic.AddInt32(&opens, 1)
+		loader, storer := testutil.NewTestStore(store)
+		return loader, storer, countingCloser{&closes}, nil
+	}
+	lazyStore := NewLazyStore(factory, 50*time.Millisecond)
+	loader, storer := lazyStore.Loader(), lazyStore.Storer()
+	require.Equal(t, int32(0), atomic.LoadInt32(&opens))
+
+	blk := testutil.GenerateBlocksOfSize(1, 100)[0]
+	link := cidlink.Link{Cid: blk.Cid()}
+	writer, committer, err := storer(ipld.LinkContext{})
+	require.NoError(t, err)
+	_, err = writer.Write(blk.RawData())
+	require.NoError(t, err)
+	require.NoError(t, committer(link))
+	require.Equal(t, int32(1), atomic.LoadInt32(&opens))
+
+	// the store is closed once idle, and opened again when next used
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&closes) == 1
+	}, time.Second, 10*time.Millisecond)
+	reader, err := loader(link, ipld.LinkContext{})
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, blk.RawData(), data)
+	require.Equal(t, int32(2), atomic.LoadInt32(&opens))
+
+	require.NoError(t, lazyStore.Close())
+	require.Equal(t, int32(2), atomic.LoadInt32(&closes))
+	_, err = loader(link, ipld.LinkContext{})
+	require.EqualError(t, err, ErrLazyStoreClosed.Error())
+}
@@ -0,0 +1,41 @@
+package storeutil
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-graphsync"
+)
+
+// ProvenanceLog is a graphsync.ProvenanceSink that appends each record to a
+// writer as a line of JSON
+type ProvenanceLog struct {
+	lk      sync.Mutex
+	encoder *json.Encoder
+}
+
+// NewProvenanceLog returns a ProvenanceLog that writes records to w
+func NewProvenanceLog(w io.Writer) *ProvenanceLog {
+	return &ProvenanceLog{encoder: json.NewEncoder(w)}
+}
+
+type provenanceEntry struct {
+	Link      string    `json:"link"`
+	Peer      string    `json:"peer"`
+	RequestID int32     `json:"requestID"`
+	Stored    time.Time `json:"stored"`
+}
+
+// RecordProvenance writes a record to the log
+func (pl *ProvenanceLog) RecordProvenance(bp graphsync.BlockProvenance) error {
+	pl.lk.Lock()
+	defer pl.lk.Unlock()
+	return pl.encoder.Encode(provenanceEntry{
+		Link:      bp.Link.String(),
+		Peer:      bp.Peer.Pretty(),
+		RequestID: int32(bp.RequestID),
+		Stored:    bp.Stored,
+	})
+}
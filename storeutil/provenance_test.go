@@ -0,0 +1,40 @@
+package storeutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestProvenanceLog(t *testing.T) {
+	var buf bytes.Buffer
+	provenanceLog := NewProvenanceLog(&buf)
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	p := testutil.GeneratePeers(1)[0]
+	for i, blk := range blks {
+		err := provenanceLog.RecordProvenance(graphsync.BlockProvenance{
+			Link:      cidlink.Link{Cid: blk.Cid()},
+			Peer:      p,
+			RequestID: graphsync.RequestID(i),
+			Stored:    time.Now(),
+		})
+		require.NoError(t, err)
+	}
+
+	decoder := json.NewDecoder(&buf)
+	for i, blk := range blks {
+		var entry provenanceEntry
+		require.NoError(t, decoder.Decode(&entry))
+		require.Equal(t, blk.Cid().String(), entry.Link)
+		require.Equal(t, p.Pretty(), entry.Peer)
+		require.Equal(t, int32(i), entry.RequestID)
+	}
+	require.False(t, decoder.More())
+}
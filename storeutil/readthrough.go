@@ -0,0 +1,46 @@
+package storeutil
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	ipld "github.com/ipld/go-ipld-prime"
+)
+
+// ReadThroughCache combines a fast cache store with a slower backing store
+// into one loader/storer pair, for use as the default store or a persistence
+// option. Loads try the cache first, then fall back to the backing store and
+// copy what they find into the cache. Stores write to the backing store, then
+// the cache. Failing to write to the cache does not fail a load or store
+func ReadThroughCache(cacheLoader ipld.Loader, cacheStorer ipld.Storer, backingLoader ipld.Loader, backingStorer ipld.Storer) (ipld.Loader, ipld.Storer) {
+	loader := func(lnk ipld.Link, lnkCtx ipld.LinkContext) (io.Reader, error) {
+		reader, err := cacheLoader(lnk, lnkCtx)
+		if err == nil && reader != nil {
+			return reader, nil
+		}
+		reader, err = backingLoader(lnk, lnkCtx)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+		_ = writeBlock(cacheStorer, lnk, data)
+		return bytes.NewReader(data), nil
+	}
+	storer := func(lnkCtx ipld.LinkContext) (io.Writer, ipld.StoreCommitter, error) {
+		var buffer settableBuffer
+		committer := func(lnk ipld.Link) error {
+			data := buffer.Bytes()
+			if err := writeBlock(backingStorer, lnk, data); err != nil {
+				return err
+			}
+			_ = writeBlock(cacheStorer, lnk, data)
+			return nil
+		}
+		return &buffer, committer, nil
+	}
+	return loader, storer
+}
@@ -0,0 +1,52 @@
+package storeutil
+
+import (
+	"io/ioutil"
+	"testing"
+
+	ipld "github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestReadThroughCache(t *testing.T) {
+	cached := make(map[ipld.Link][]byte)
+	cacheLoader, cacheStorer := testutil.NewTestStore(cached)
+	backing := make(map[ipld.Link][]byte)
+	backingLoader, backingStorer := testutil.NewTestStore(backing)
+	loader, storer := ReadThroughCache(cacheLoader, cacheStorer, backingLoader, backingStorer)
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+
+	// loading a block only in the backing store copies it to the cache
+	coldLink := cidlink.Link{Cid: blks[0].Cid()}
+	backing[coldLink] = blks[0].RawData()
+	reader, err := loader(coldLink, ipld.LinkContext{})
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, blks[0].RawData(), data)
+	require.Equal(t, blks[0].RawData(), cached[coldLink])
+
+	// later loads are served from the cache
+	delete(backing, coldLink)
+	reader, err = loader(coldLink, ipld.LinkContext{})
+	require.NoError(t, err)
+	data, err = ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, blks[0].RawData(), data)
+
+	// stores write through to both
+	link := cidlink.Link{Cid: blks[1].Cid()}
+	writer, committer, err := storer(ipld.LinkContext{})
+	require.NoError(t, err)
+	_, err = writer.Write(blks[1].RawData())
+	require.NoError(t, err)
+	require.NoError(t, committer(link))
+	require.Equal(t, blks[1].RawData(), cached[link])
+	require.Equal(t, blks[1].RawData(), backing[link])
+
+	_, err = loader(cidlink.Link{Cid: testutil.GenerateBlocksOfSize(1, 100)[0].Cid()}, ipld.LinkContext{})
+	require.Error(t, err)
+}
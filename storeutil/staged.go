@@ -0,0 +1,102 @@
+package storeutil
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	ipld "github.com/ipld/go-ipld-prime"
+
+	"github.com/ipfs/go-graphsync"
+)
+
+// StagedTransactions returns transactions that hold each request's blocks in
+// memory and write them with the given storer when committed, for use with
+// RegisterTransactionalPersistenceOption on stores without native
+// transactions. Blocks are loaded from the stage first, then the given loader
+func StagedTransactions(loader ipld.Loader, storer ipld.Storer) graphsync.NewStoreTransaction {
+	return func(graphsync.RequestID) (graphsync.StoreTransaction, error) {
+		return &stagedTransaction{
+			loader: loader,
+			storer: storer,
+			staged: make(map[ipld.Link][]byte),
+		}, nil
+	}
+}
+
+type stagedTransaction struct {
+	loader ipld.Loader
+	storer ipld.Storer
+
+	lk     sync.RWMutex
+	staged map[ipld.Link][]byte
+	order  []ipld.Link
+}
+
+func (st *stagedTransaction) Loader() ipld.Loader {
+	return func(lnk ipld.Link, lnkCtx ipld.LinkContext) (io.Reader, error) {
+		st.lk.RLock()
+		data, ok := st.staged[lnk]
+		st.lk.RUnlock()
+		if ok {
+			return bytes.NewReader(data), nil
+		}
+		return st.loader(lnk, lnkCtx)
+	}
+}
+
+func (st *stagedTransaction) Storer() ipld.Storer {
+	return func(lnkCtx ipld.LinkContext) (io.Writer, ipld.StoreCommitter, error) {
+		var buffer settableBuffer
+		committer := func(lnk ipld.Link) error {
+			st.lk.Lock()
+			defer st.lk.Unlock()
+			if _, ok := st.staged[lnk]; !ok {
+				st.order = append(st.order, lnk)
+			}
+			st.staged[lnk] = buffer.Bytes()
+			return nil
+		}
+		return &buffer, committer, nil
+	}
+}
+
+// Commit writes staged blocks in the order they were staged. If a write
+// fails, the blocks not yet written stay staged
+func (st *stagedTransaction) Commit() error {
+	st.lk.Lock()
+	defer st.lk.Unlock()
+	for len(st.order) > 0 {
+		lnk := st.order[0]
+		if err := writeBlock(st.storer, lnk, st.staged[lnk]); err != nil {
+			return err
+		}
+		delete(st.staged, lnk)
+		st.order = st.order[1:]
+	}
+	return nil
+}
+
+func (st *stagedTransaction) Rollback() error {
+	st.lk.Lock()
+	defer st.lk.Unlock()
+	st.staged = make(map[ipld.Link][]byte)
+	st.order = nil
+	return nil
+}
+
+func writeBlock(storer ipld.Storer, lnk ipld.Link, data []byte) error {
+	writer, committer, err := storer(ipld.LinkContext{})
+	if err != nil {
+		return err
+	}
+	if settable, ok := writer.(interface{ SetBytes([]byte) error }); ok {
+		err = settable.SetBytes(data)
+	} else {
+		_, err = writer.Write(data)
+	}
+	if err != nil {
+		return err
+	}
+	return committer(lnk)
+}
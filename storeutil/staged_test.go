@@ -0,0 +1,51 @@
+package storeutil
+
+import (
+	"io/ioutil"
+	"testing"
+
+	ipld "github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestStagedTransactions(t *testing.T) {
+	blocksWritten := make(map[ipld.Link][]byte)
+	loader, storer := testutil.NewTestStore(blocksWritten)
+	newTransaction := StagedTransactions(loader, storer)
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+
+	stage := func(txn graphsync.StoreTransaction, data []byte, lnk ipld.Link) {
+		writer, committer, err := txn.Storer()(ipld.LinkContext{})
+		require.NoError(t, err)
+		_, err = writer.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, committer(lnk))
+	}
+
+	committed, err := newTransaction(graphsync.RequestID(1))
+	require.NoError(t, err)
+	rolledBack, err := newTransaction(graphsync.RequestID(2))
+	require.NoError(t, err)
+	link := cidlink.Link{Cid: blks[0].Cid()}
+	otherLink := cidlink.Link{Cid: blks[1].Cid()}
+	stage(committed, blks[0].RawData(), link)
+	stage(rolledBack, blks[1].RawData(), otherLink)
+
+	// staged blocks load only from their own transaction
+	reader, err := committed.Loader()(link, ipld.LinkContext{})
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, blks[0].RawData(), data)
+	_, err = rolledBack.Loader()(link, ipld.LinkContext{})
+	require.Error(t, err)
+	require.Empty(t, blocksWritten)
+
+	require.NoError(t, committed.Commit())
+	require.NoError(t, rolledBack.Rollback())
+	require.Equal(t, map[ipld.Link][]byte{link: blks[0].RawData()}, blocksWritten)
+}
@@ -47,6 +47,21 @@ func StorerForBlockstore(bs bstore.Blockstore) ipld.Storer {
 	}
 }
 
+// LoaderStorerForBlockstore returns both the loader and the storer for an
+// IPFS blockstore, ready to pass to graphsync.New or RegisterPersistenceOption
+func LoaderStorerForBlockstore(bs bstore.Blockstore) (ipld.Loader, ipld.Storer) {
+	return LoaderForBlockstore(bs), StorerForBlockstore(bs)
+}
+
+// BatchStorerForBlockstore returns a function that writes a batch of blocks to
+// an IPFS blockstore in a single PutMany, for use with the BatchedWrites
+// graphsync option
+func BatchStorerForBlockstore(bs bstore.Blockstore) func([]blocks.Block) error {
+	return func(blks []blocks.Block) error {
+		return bs.PutMany(blks)
+	}
+}
+
 type settableBuffer struct {
 	bytes.Buffer
 	didSetData bool
@@ -42,3 +42,19 @@ func TestStorer(t *testing.T) {
 	_, err = store.Get(blk.Cid())
 	require.NoError(t, err, "Block not written to store")
 }
+
+func TestBatchStorer(t *testing.T) {
+	store := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	blks := testutil.GenerateBlocksOfSize(3, 1000)
+	storeBatch := BatchStorerForBlockstore(store)
+	err := storeBatch(blks)
+	require.NoError(t, err, "Unable to write batch to store")
+	loader, _ := LoaderStorerForBlockstore(store)
+	for _, blk := range blks {
+		data, err := loader(cidlink.Link{Cid: blk.Cid()}, ipld.LinkContext{})
+		require.NoError(t, err, "Block not written to store")
+		bytes, err := ioutil.ReadAll(data)
+		require.NoError(t, err, "Unable to read bytes from reader returned by loader")
+		require.Equal(t, blk.RawData(), bytes)
+	}
+}
@@ -0,0 +1,397 @@
+/*
+Package telemetry collects aggregate transfer statistics from a graphsync
+exchange for performance studies. Only sizes, durations, and status codes are
+recorded -- never CIDs, selectors, extension data, or peer IDs -- and only
+in aggregate. Aggregates alone can still reveal an unusual transfer, so
+NoisySnapshot adds noise calibrated to how much any one transfer can change
+them, for export outside the node.
+
+Collection is opt in: a Collector does nothing until registered with an
+exchange, for instance with the Telemetry option of the graphsync implementation.
+*/
+package telemetry
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+)
+
+// blockSizeBounds are the upper bounds in bytes of block size histogram buckets
+var blockSizeBounds = []uint64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20}
+
+// durationBounds are the upper bounds in milliseconds of duration histogram buckets
+var durationBounds = []uint64{10, 100, 1000, 10000, 60000, 600000}
+
+// Histogram counts values by bucket. Counts has one more entry than Bounds,
+// for values above the last bound
+type Histogram struct {
+	Bounds []uint64 `json:"bounds"`
+	Counts []uint64 `json:"counts"`
+}
+
+func newHistogram(bounds []uint64) Histogram {
+	return Histogram{Bounds: bounds, Counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *Histogram) observe(value uint64) {
+	for i, bound := range h.Bounds {
+		if value <= bound {
+			h.Counts[i]++
+			return
+		}
+	}
+	h.Counts[len(h.Bounds)]++
+}
+
+// TransferStats are aggregate statistics for transfers in one direction
+type TransferStats struct {
+	// Started is the number of transfers begun
+	Started uint64 `json:"started"`
+	// Outcomes counts finished transfers by final status code
+	Outcomes map[string]uint64 `json:"outcomes"`
+	// Blocks is the number of blocks transferred over the wire
+	Blocks uint64 `json:"blocks"`
+	// BytesOnWire is the total size of blocks transferred over the wire
+	BytesOnWire uint64 `json:"bytesOnWire"`
+	// BlockSizes is a histogram of the size in bytes of blocks transferred
+	BlockSizes Histogram `json:"blockSizes"`
+	// Durations is a histogram of the time in milliseconds transfers took to finish
+	Durations Histogram `json:"durations"`
+}
+
+func newTransferStats() TransferStats {
+	return TransferStats{
+		Outcomes:   make(map[string]uint64),
+		BlockSizes: newHistogram(blockSizeBounds),
+		Durations:  newHistogram(durationBounds),
+	}
+}
+
+func (ts TransferStats) clone() TransferStats {
+	cloned := ts
+	cloned.Outcomes = make(map[string]uint64, len(ts.Outcomes))
+	for status, count := range ts.Outcomes {
+		cloned.Outcomes[status] = count
+	}
+	cloned.BlockSizes.Counts = append([]uint64(nil), ts.BlockSizes.Counts...)
+	cloned.Durations.Counts = append([]uint64(nil), ts.Durations.Counts...)
+	return cloned
+}
+
+// outcomeIncomplete counts transfers that ended without a final status, such
+// as requests cancelled locally and responses that hit network errors
+const outcomeIncomplete = "incomplete"
+
+// outcomeOther counts, in noisy snapshots, final statuses not in outcomeKeys,
+// such as status codes from newer versions
+const outcomeOther = "other"
+
+// outcomeKeys are the outcomes noisy snapshots always report, so that which
+// outcomes occurred is not revealed by which keys are present
+var outcomeKeys = []string{
+	strconv.Itoa(int(graphsync.RequestCompletedFull)),
+	strconv.Itoa(int(graphsync.RequestCompletedPartial)),
+	strconv.Itoa(int(graphsync.RequestRejected)),
+	strconv.Itoa(int(graphsync.RequestFailedBusy)),
+	strconv.Itoa(int(graphsync.RequestFailedUnknown)),
+	strconv.Itoa(int(graphsync.RequestFailedLegal)),
+	strconv.Itoa(int(graphsync.RequestFailedContentNotFound)),
+	strconv.Itoa(int(graphsync.RequestCancelled)),
+	strconv.Itoa(int(graphsync.RequestFailedMessageTooLarge)),
+	outcomeIncomplete,
+	outcomeOther,
+}
+
+// noisyGroups is the number of groups of statistics in a snapshot one
+// transfer can change: the six in its direction's TransferStats, and
+// NetworkErrors. The privacy budget is split evenly between them
+const noisyGroups = 7
+
+const (
+	defaultMaxBlocksPerTransfer = 1024
+	defaultMaxBytesPerTransfer  = 16 << 20
+)
+
+// Snapshot is the aggregate statistics collected at a point in time
+type Snapshot struct {
+	// Requests are transfers this node requested
+	Requests TransferStats `json:"requests"`
+	// Responses are transfers this node served
+	Responses TransferStats `json:"responses"`
+	// NetworkErrors is the number of errors sending data over the wire
+	NetworkErrors uint64 `json:"networkErrors"`
+}
+
+// WriteJSON writes the snapshot as JSON
+func (s Snapshot) WriteJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(s)
+}
+
+type transferKey struct {
+	p         peer.ID
+	requestID graphsync.RequestID
+}
+
+// transfer is an in progress transfer, with what it has contributed to the
+// clamped statistics noisy snapshots are made from
+type transfer struct {
+	start        time.Time
+	blocks       uint64
+	bytes        uint64
+	networkError bool
+}
+
+// Collector aggregates transfer statistics from the hooks and listeners of a
+// graphsync exchange
+type Collector struct {
+	lk                   sync.Mutex
+	maxBlocksPerTransfer uint64
+	maxBytesPerTransfer  uint64
+	requests             TransferStats
+	responses            TransferStats
+	networkErrors        uint64
+	// clamped statistics only count blocks and network errors for transfers
+	// within the per transfer limits
+	clampedRequests      TransferStats
+	clampedResponses     TransferStats
+	clampedNetworkErrors uint64
+	// transfers are only held while in progress
+	requestTransfers  map[transferKey]*transfer
+	responseTransfers map[transferKey]*transfer
+}
+
+// NewCollector returns a new collector with no statistics recorded
+func NewCollector() *Collector {
+	return &Collector{
+		maxBlocksPerTransfer: defaultMaxBlocksPerTransfer,
+		maxBytesPerTransfer:  defaultMaxBytesPerTransfer,
+		requests:             newTransferStats(),
+		responses:            newTransferStats(),
+		clampedRequests:      newTransferStats(),
+		clampedResponses:     newTransferStats(),
+		requestTransfers:     make(map[transferKey]*transfer),
+		responseTransfers:    make(map[transferKey]*transfer),
+	}
+}
+
+// LimitContributions sets the most blocks and block bytes of a single transfer
+// counted in noisy snapshots (default 1024 blocks and 16MiB). The noise added
+// to block and byte statistics grows with these limits. It should be called
+// before the collector is registered
+func (c *Collector) LimitContributions(maxBlocks uint64, maxBytes uint64) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.maxBlocksPerTransfer = maxBlocks
+	c.maxBytesPerTransfer = maxBytes
+}
+
+// Register begins collecting statistics from the given exchange, returning a
+// function that stops collection
+func (c *Collector) Register(exchange graphsync.GraphExchange) graphsync.UnregisterHookFunc {
+	unregisters := []graphsync.UnregisterHookFunc{
+		exchange.RegisterOutgoingRequestHook(c.onOutgoingRequest),
+		exchange.RegisterIncomingBlockHook(c.onIncomingBlock),
+		exchange.RegisterCompletedRequestListener(c.onRequestCompleted),
+		exchange.RegisterIncomingRequestHook(c.onIncomingRequest),
+		exchange.RegisterBlockSentListener(c.onBlockSent),
+		exchange.RegisterCompletedResponseListener(c.onResponseCompleted),
+		exchange.RegisterRequestorCancelledListener(c.onRequestorCancelled),
+		exchange.RegisterNetworkErrorListener(c.onNetworkError),
+	}
+	return func() {
+		for _, unregister := range unregisters {
+			unregister()
+		}
+	}
+}
+
+// Snapshot returns the statistics collected so far
+func (c *Collector) Snapshot() Snapshot {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return Snapshot{
+		Requests:      c.requests.clone(),
+		Responses:     c.responses.clone(),
+		NetworkErrors: c.networkErrors,
+	}
+}
+
+// NoisySnapshot returns the statistics collected so far with Laplace noise
+// added, giving epsilon-differential privacy with respect to any single
+// transfer. Each transfer counts once towards started transfers, outcomes,
+// durations and network errors, and blocks past the per transfer limits set
+// with LimitContributions are left out, so the noise for each statistic is
+// scaled to the most one transfer can change it. Smaller epsilon means more
+// privacy and less accuracy
+func (c *Collector) NoisySnapshot(epsilon float64, rng *rand.Rand) Snapshot {
+	c.lk.Lock()
+	snapshot := Snapshot{
+		Requests:      c.clampedRequests.clone(),
+		Responses:     c.clampedResponses.clone(),
+		NetworkErrors: c.clampedNetworkErrors,
+	}
+	maxBlocks := float64(c.maxBlocksPerTransfer)
+	maxBytes := float64(c.maxBytesPerTransfer)
+	c.lk.Unlock()
+
+	noise := func(count uint64, sensitivity float64) uint64 {
+		noisy := float64(count) + laplace(rng, noisyGroups*sensitivity/epsilon)
+		if noisy < 0 {
+			return 0
+		}
+		return uint64(math.Round(noisy))
+	}
+	for _, stats := range []*TransferStats{&snapshot.Requests, &snapshot.Responses} {
+		stats.Started = noise(stats.Started, 1)
+		stats.Blocks = noise(stats.Blocks, maxBlocks)
+		stats.BytesOnWire = noise(stats.BytesOnWire, maxBytes)
+		outcomes := make(map[string]uint64, len(outcomeKeys))
+		for _, key := range outcomeKeys {
+			outcomes[key] = 0
+		}
+		for status, count := range stats.Outcomes {
+			if _, ok := outcomes[status]; ok {
+				outcomes[status] += count
+			} else {
+				outcomes[outcomeOther] += count
+			}
+		}
+		for status, count := range outcomes {
+			outcomes[status] = noise(count, 1)
+		}
+		stats.Outcomes = outcomes
+		for i, count := range stats.BlockSizes.Counts {
+			stats.BlockSizes.Counts[i] = noise(count, maxBlocks)
+		}
+		for i, count := range stats.Durations.Counts {
+			stats.Durations.Counts[i] = noise(count, 1)
+		}
+	}
+	snapshot.NetworkErrors = noise(snapshot.NetworkErrors, 1)
+	return snapshot
+}
+
+func laplace(rng *rand.Rand, scale float64) float64 {
+	u := rng.Float64() - 0.5
+	if u < 0 {
+		return scale * math.Log(1+2*u)
+	}
+	return -scale * math.Log(1-2*u)
+}
+
+func (c *Collector) onOutgoingRequest(p peer.ID, request graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.start(&c.requests, &c.clampedRequests, c.requestTransfers, transferKey{p, request.ID()})
+}
+
+func (c *Collector) onIncomingBlock(p peer.ID, response graphsync.ResponseData, block graphsync.BlockData, hookActions graphsync.IncomingBlockHookActions) {
+	if block.BlockSizeOnWire() == 0 {
+		return
+	}
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.observeBlock(&c.requests, &c.clampedRequests, c.requestTransfers[transferKey{p, response.RequestID()}], block)
+}
+
+// onRequestCompleted runs once for every outgoing request, however it ends
+func (c *Collector) onRequestCompleted(p peer.ID, request graphsync.RequestData, status graphsync.ResponseStatusCode, err error, stats graphsync.RequestStats) {
+	outcome := outcomeIncomplete
+	if gsmsg.IsTerminalResponseCode(status) {
+		outcome = strconv.Itoa(int(status))
+	}
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.finish(&c.requests, &c.clampedRequests, c.requestTransfers, transferKey{p, request.ID()}, outcome)
+}
+
+func (c *Collector) onIncomingRequest(p peer.ID, request graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.start(&c.responses, &c.clampedResponses, c.responseTransfers, transferKey{p, request.ID()})
+}
+
+func (c *Collector) onBlockSent(p peer.ID, request graphsync.RequestData, block graphsync.BlockData) {
+	if block.BlockSizeOnWire() == 0 {
+		return
+	}
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.observeBlock(&c.responses, &c.clampedResponses, c.responseTransfers[transferKey{p, request.ID()}], block)
+}
+
+func (c *Collector) onResponseCompleted(p peer.ID, request graphsync.RequestData, status graphsync.ResponseStatusCode) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.finish(&c.responses, &c.clampedResponses, c.responseTransfers, transferKey{p, request.ID()}, strconv.Itoa(int(status)))
+}
+
+func (c *Collector) onRequestorCancelled(p peer.ID, request graphsync.RequestData) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.finish(&c.responses, &c.clampedResponses, c.responseTransfers, transferKey{p, request.ID()}, strconv.Itoa(int(graphsync.RequestCancelled)))
+}
+
+// onNetworkError counts an error sending data for a request or response. A
+// response that hits a network error is aborted without a final status, so it
+// is finished as incomplete. Outgoing requests finish in onRequestCompleted
+func (c *Collector) onNetworkError(p peer.ID, request graphsync.RequestData, err error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.networkErrors++
+	key := transferKey{p, request.ID()}
+	t, ok := c.responseTransfers[key]
+	if !ok {
+		t, ok = c.requestTransfers[key]
+	}
+	if ok && !t.networkError {
+		t.networkError = true
+		c.clampedNetworkErrors++
+	}
+	c.finish(&c.responses, &c.clampedResponses, c.responseTransfers, key, outcomeIncomplete)
+}
+
+func (c *Collector) start(stats *TransferStats, clamped *TransferStats, transfers map[transferKey]*transfer, key transferKey) {
+	stats.Started++
+	clamped.Started++
+	transfers[key] = &transfer{start: time.Now()}
+}
+
+func (c *Collector) observeBlock(stats *TransferStats, clamped *TransferStats, t *transfer, block graphsync.BlockData) {
+	observeBlock(stats, block)
+	if t == nil || t.blocks >= c.maxBlocksPerTransfer || t.bytes+block.BlockSizeOnWire() > c.maxBytesPerTransfer {
+		return
+	}
+	t.blocks++
+	t.bytes += block.BlockSizeOnWire()
+	observeBlock(clamped, block)
+}
+
+func (c *Collector) finish(stats *TransferStats, clamped *TransferStats, transfers map[transferKey]*transfer, key transferKey, outcome string) {
+	t, ok := transfers[key]
+	if !ok {
+		return
+	}
+	delete(transfers, key)
+	duration := uint64(time.Since(t.start) / time.Millisecond)
+	for _, s := range []*TransferStats{stats, clamped} {
+		s.Outcomes[outcome]++
+		s.Durations.observe(duration)
+	}
+}
+
+func observeBlock(stats *TransferStats, block graphsync.BlockData) {
+	stats.Blocks++
+	stats.BytesOnWire += block.BlockSizeOnWire()
+	stats.BlockSizes.observe(block.BlockSize())
+}
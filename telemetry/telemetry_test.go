@@ -0,0 +1,129 @@
+package telemetry
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+type blockData struct {
+	link       ipld.Link
+	size       uint64
+	sizeOnWire uint64
+}
+
+func (bd blockData) Link() ipld.Link         { return bd.link }
+func (bd blockData) BlockSize() uint64       { return bd.size }
+func (bd blockData) BlockSizeOnWire() uint64 { return bd.sizeOnWire }
+func (bd blockData) Cid() cid.Cid            { return bd.link.(cidlink.Link).Cid }
+func (bd blockData) Index() int64            { return 0 }
+func (bd blockData) Deduplicated() bool      { return false }
+
+func TestCollectsAggregateStats(t *testing.T) {
+	p := testutil.GeneratePeers(1)[0]
+	root := testutil.GenerateCids(1)[0]
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	selector := ssb.Matcher().Node()
+	request1 := gsmsg.NewRequest(graphsync.RequestID(1), root, selector, graphsync.Priority(0))
+	request2 := gsmsg.NewRequest(graphsync.RequestID(2), root, selector, graphsync.Priority(0))
+	link := cidlink.Link{Cid: root}
+
+	c := NewCollector()
+
+	// requestor side
+	c.onOutgoingRequest(p, request1, nil)
+	c.onIncomingBlock(p, gsmsg.NewResponse(request1.ID(), graphsync.PartialResponse), blockData{link, 2000, 2000}, nil)
+	c.onIncomingBlock(p, gsmsg.NewResponse(request1.ID(), graphsync.PartialResponse), blockData{link, 100, 0}, nil)
+	c.onRequestCompleted(p, request1, graphsync.RequestCompletedFull, nil, graphsync.RequestStats{})
+
+	// responder side
+	c.onIncomingRequest(p, request1, nil)
+	c.onIncomingRequest(p, request2, nil)
+	c.onBlockSent(p, request1, blockData{link, 500, 500})
+	c.onResponseCompleted(p, request1, graphsync.RequestFailedContentNotFound)
+	c.onRequestorCancelled(p, request2)
+	c.onNetworkError(p, request1, errors.New("something went wrong"))
+
+	snapshot := c.Snapshot()
+	require.Equal(t, uint64(1), snapshot.Requests.Started)
+	require.Equal(t, map[string]uint64{"20": 1}, snapshot.Requests.Outcomes)
+	require.Equal(t, uint64(1), snapshot.Requests.Blocks)
+	require.Equal(t, uint64(2000), snapshot.Requests.BytesOnWire)
+	require.Equal(t, []uint64{0, 1, 0, 0, 0, 0, 0}, snapshot.Requests.BlockSizes.Counts)
+	require.Equal(t, []uint64{1, 0, 0, 0, 0, 0, 0}, snapshot.Requests.Durations.Counts)
+
+	require.Equal(t, uint64(2), snapshot.Responses.Started)
+	require.Equal(t, map[string]uint64{"34": 1, "35": 1}, snapshot.Responses.Outcomes)
+	require.Equal(t, uint64(1), snapshot.Responses.Blocks)
+	require.Equal(t, uint64(500), snapshot.Responses.BytesOnWire)
+	require.Equal(t, uint64(1), snapshot.NetworkErrors)
+
+	var buf bytes.Buffer
+	require.NoError(t, snapshot.WriteJSON(&buf))
+	require.NotContains(t, buf.String(), p.String())
+	require.NotContains(t, buf.String(), root.String())
+
+	noisy := c.NoisySnapshot(0.5, rand.New(rand.NewSource(1)))
+	require.Len(t, noisy.Requests.BlockSizes.Counts, len(blockSizeBounds)+1)
+	// noisy outcomes always have the same keys, whichever outcomes occurred
+	require.Len(t, noisy.Requests.Outcomes, len(outcomeKeys))
+	require.Len(t, noisy.Responses.Outcomes, len(outcomeKeys))
+	// taking a noisy snapshot does not alter collected stats
+	require.Equal(t, snapshot, c.Snapshot())
+}
+
+func TestFinishesTransfersWithoutFinalStatus(t *testing.T) {
+	p := testutil.GeneratePeers(1)[0]
+	root := testutil.GenerateCids(1)[0]
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	selector := ssb.Matcher().Node()
+	request1 := gsmsg.NewRequest(graphsync.RequestID(1), root, selector, graphsync.Priority(0))
+	request2 := gsmsg.NewRequest(graphsync.RequestID(2), root, selector, graphsync.Priority(0))
+
+	c := NewCollector()
+	c.onOutgoingRequest(p, request1, nil)
+	c.onRequestCompleted(p, request1, graphsync.PartialResponse, graphsync.RequestCancelledErr{}, graphsync.RequestStats{})
+	c.onIncomingRequest(p, request2, nil)
+	c.onNetworkError(p, request2, errors.New("something went wrong"))
+	c.onNetworkError(p, request2, errors.New("something went wrong again"))
+
+	require.Empty(t, c.requestTransfers)
+	require.Empty(t, c.responseTransfers)
+	snapshot := c.Snapshot()
+	require.Equal(t, map[string]uint64{outcomeIncomplete: 1}, snapshot.Requests.Outcomes)
+	require.Equal(t, map[string]uint64{outcomeIncomplete: 1}, snapshot.Responses.Outcomes)
+	require.Equal(t, uint64(2), snapshot.NetworkErrors)
+	require.Equal(t, uint64(1), c.clampedNetworkErrors)
+}
+
+func TestClampsContributionsToNoisySnapshots(t *testing.T) {
+	p := testutil.GeneratePeers(1)[0]
+	root := testutil.GenerateCids(1)[0]
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	selector := ssb.Matcher().Node()
+	request := gsmsg.NewRequest(graphsync.RequestID(1), root, selector, graphsync.Priority(0))
+	link := cidlink.Link{Cid: root}
+
+	c := NewCollector()
+	c.LimitContributions(2, 1000)
+	c.onIncomingRequest(p, request, nil)
+	for i := 0; i < 3; i++ {
+		c.onBlockSent(p, request, blockData{link, 400, 400})
+	}
+
+	require.Equal(t, uint64(3), c.Snapshot().Responses.Blocks)
+	require.Equal(t, uint64(2), c.clampedResponses.Blocks)
+	require.Equal(t, uint64(800), c.clampedResponses.BytesOnWire)
+}
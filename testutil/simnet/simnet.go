@@ -0,0 +1,409 @@
+package simnet
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/connmgr"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	gsnet "github.com/ipfs/go-graphsync/network"
+)
+
+// ErrMessageLost is returned when sending a message that the simulated link
+// drops, as a real stream would be reset
+var ErrMessageLost = errors.New("message lost")
+
+// ErrPartitioned is returned when sending a message to a peer on the other
+// side of a partition
+var ErrPartitioned = errors.New("peers are partitioned")
+
+// ErrUnknownPeer is returned when sending a message to a peer that has no
+// adapter on the network
+var ErrUnknownPeer = errors.New("no such peer in network")
+
+// LinkConfig describes the conditions messages from one peer to another are
+// sent under
+type LinkConfig struct {
+	// Latency is how long each message takes to arrive once transmitted
+	Latency time.Duration
+	// Bandwidth is the number of bytes per second the link transmits, or zero
+	// for no limit. Messages queue behind one another while the link is busy
+	Bandwidth int
+	// LossRate is the probability, from 0 to 1, that sending a message fails
+	LossRate float64
+}
+
+// Network connects in-process graphsync instances, passing messages between
+// them under simulated network conditions. Messages on each link are
+// delivered in the order they were sent.
+type Network struct {
+	lk          sync.Mutex
+	rng         *rand.Rand
+	defaultLink LinkConfig
+	links       map[linkKey]*link
+	nodes       map[peer.ID]*node
+	conns       map[linkKey]struct{}
+	partition   map[peer.ID]int
+}
+
+type linkKey struct {
+	from peer.ID
+	to   peer.ID
+}
+
+// New returns a network where links have the given default conditions
+func New(defaultLink LinkConfig) *Network {
+	return &Network{
+		rng:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		defaultLink: defaultLink,
+		links:       make(map[linkKey]*link),
+		nodes:       make(map[peer.ID]*node),
+		conns:       make(map[linkKey]struct{}),
+	}
+}
+
+// Seed sets the seed for deciding which messages are lost, so tests with
+// loss are repeatable
+func (n *Network) Seed(seed int64) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	n.rng = rand.New(rand.NewSource(seed))
+}
+
+// Adapter returns the GraphSyncNetwork for the given peer on this network
+func (n *Network) Adapter(p peer.ID) gsnet.GraphSyncNetwork {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	nd, ok := n.nodes[p]
+	if !ok {
+		nd = &node{local: p, network: n}
+		n.nodes[p] = nd
+	}
+	return nd
+}
+
+// SetLink sets the conditions for messages sent from one peer to another.
+// Messages already in flight keep the conditions they were sent under
+func (n *Network) SetLink(from peer.ID, to peer.ID, config LinkConfig) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	n.linkLocked(from, to).config = config
+}
+
+// SetLinkBetween sets the conditions for messages sent in both directions
+// between two peers
+func (n *Network) SetLinkBetween(a peer.ID, b peer.ID, config LinkConfig) {
+	n.SetLink(a, b, config)
+	n.SetLink(b, a, config)
+}
+
+// Partition splits peers into the given groups, which cannot reach one
+// another until Heal is called. Connections between groups are closed and
+// messages in flight between them are dropped. Peers not in any group can
+// only reach each other
+func (n *Network) Partition(groups ...[]peer.ID) {
+	n.lk.Lock()
+	partition := make(map[peer.ID]int)
+	for i, group := range groups {
+		for _, p := range group {
+			partition[p] = i + 1
+		}
+	}
+	n.partition = partition
+	var severed []linkKey
+	for conn := range n.conns {
+		if !n.reachableLocked(conn.from, conn.to) {
+			severed = append(severed, conn)
+			delete(n.conns, conn)
+		}
+	}
+	n.lk.Unlock()
+	for _, conn := range severed {
+		n.notifyDisconnected(conn.from, conn.to)
+	}
+}
+
+// Heal removes any partition, so all peers can reach one another again.
+// Peers must reconnect for connections closed by the partition to resume
+func (n *Network) Heal() {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	n.partition = nil
+}
+
+// Disconnect closes the connection between two peers, as if it had dropped
+func (n *Network) Disconnect(a peer.ID, b peer.ID) {
+	n.lk.Lock()
+	key := connKey(a, b)
+	_, ok := n.conns[key]
+	delete(n.conns, key)
+	n.lk.Unlock()
+	if ok {
+		n.notifyDisconnected(key.from, key.to)
+	}
+}
+
+func (n *Network) notifyDisconnected(a peer.ID, b peer.ID) {
+	n.lk.Lock()
+	nodeA, nodeB := n.nodes[a], n.nodes[b]
+	n.lk.Unlock()
+	if nodeA != nil {
+		nodeA.disconnected(b)
+	}
+	if nodeB != nil {
+		nodeB.disconnected(a)
+	}
+}
+
+func (n *Network) reachableLocked(from peer.ID, to peer.ID) bool {
+	return n.partition == nil || n.partition[from] == n.partition[to]
+}
+
+func (n *Network) linkLocked(from peer.ID, to peer.ID) *link {
+	key := linkKey{from, to}
+	l, ok := n.links[key]
+	if !ok {
+		l = &link{network: n, from: from, to: to, config: n.defaultLink}
+		n.links[key] = l
+	}
+	return l
+}
+
+func (n *Network) connect(from peer.ID, to peer.ID) error {
+	n.lk.Lock()
+	remote, ok := n.nodes[to]
+	if !ok {
+		n.lk.Unlock()
+		return ErrUnknownPeer
+	}
+	if !n.reachableLocked(from, to) {
+		n.lk.Unlock()
+		return ErrPartitioned
+	}
+	key := connKey(from, to)
+	if _, ok := n.conns[key]; ok {
+		n.lk.Unlock()
+		return nil
+	}
+	n.conns[key] = struct{}{}
+	local := n.nodes[from]
+	n.lk.Unlock()
+
+	remote.connected(from)
+	local.connected(to)
+	return nil
+}
+
+func (n *Network) send(from peer.ID, to peer.ID, message gsmsg.GraphSyncMessage) error {
+	pbMsg, err := message.ToProto()
+	if err != nil {
+		return err
+	}
+	size := proto.Size(pbMsg)
+	message = message.Clone()
+
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	if _, ok := n.nodes[to]; !ok {
+		return ErrUnknownPeer
+	}
+	if !n.reachableLocked(from, to) {
+		return ErrPartitioned
+	}
+	l := n.linkLocked(from, to)
+	if l.config.LossRate > 0 && n.rng.Float64() < l.config.LossRate {
+		return ErrMessageLost
+	}
+	l.enqueueLocked(message, size)
+	return nil
+}
+
+func (n *Network) deliver(from peer.ID, to peer.ID, message gsmsg.GraphSyncMessage) {
+	n.lk.Lock()
+	receiver := n.nodes[to]
+	reachable := n.reachableLocked(from, to)
+	n.lk.Unlock()
+	if receiver == nil || !reachable {
+		return
+	}
+	receiver.receive(from, message)
+}
+
+func connKey(a peer.ID, b peer.ID) linkKey {
+	if a < b {
+		return linkKey{a, b}
+	}
+	return linkKey{b, a}
+}
+
+type inFlight struct {
+	message   gsmsg.GraphSyncMessage
+	deliverAt time.Time
+}
+
+// link transmits messages from one peer to another in order
+type link struct {
+	network   *Network
+	from      peer.ID
+	to        peer.ID
+	config    LinkConfig
+	busyUntil time.Time
+	queue     []inFlight
+	active    bool
+}
+
+// enqueueLocked must be called with the network lock held
+func (l *link) enqueueLocked(message gsmsg.GraphSyncMessage, size int) {
+	start := time.Now()
+	if l.busyUntil.After(start) {
+		start = l.busyUntil
+	}
+	transmitted := start
+	if l.config.Bandwidth > 0 {
+		transmitted = start.Add(time.Duration(size) * time.Second / time.Duration(l.config.Bandwidth))
+	}
+	l.busyUntil = transmitted
+	l.queue = append(l.queue, inFlight{message, transmitted.Add(l.config.Latency)})
+	if !l.active {
+		l.active = true
+		go l.run()
+	}
+}
+
+func (l *link) run() {
+	for {
+		l.network.lk.Lock()
+		if len(l.queue) == 0 {
+			l.active = false
+			l.network.lk.Unlock()
+			return
+		}
+		next := l.queue[0]
+		l.queue = l.queue[1:]
+		l.network.lk.Unlock()
+
+		time.Sleep(time.Until(next.deliverAt))
+		l.network.deliver(l.from, l.to, next.message)
+	}
+}
+
+// node is a single peer's view of the network
+type node struct {
+	local    peer.ID
+	network  *Network
+	lk       sync.RWMutex
+	receiver gsnet.Receiver
+}
+
+var _ gsnet.GraphSyncNetwork = (*node)(nil)
+
+func (nd *node) getReceiver() gsnet.Receiver {
+	nd.lk.RLock()
+	defer nd.lk.RUnlock()
+	return nd.receiver
+}
+
+func (nd *node) receive(from peer.ID, message gsmsg.GraphSyncMessage) {
+	if receiver := nd.getReceiver(); receiver != nil {
+		receiver.ReceiveMessage(context.TODO(), from, message)
+	}
+}
+
+func (nd *node) connected(p peer.ID) {
+	if receiver := nd.getReceiver(); receiver != nil {
+		receiver.Connected(p)
+	}
+}
+
+func (nd *node) disconnected(p peer.ID) {
+	if receiver := nd.getReceiver(); receiver != nil {
+		receiver.Disconnected(p)
+	}
+}
+
+// SendMessage sends a message to the given peer
+func (nd *node) SendMessage(ctx context.Context, p peer.ID, message gsmsg.GraphSyncMessage) error {
+	return nd.network.send(nd.local, p, message)
+}
+
+// SetDelegate registers the Receiver to handle messages sent to this peer
+func (nd *node) SetDelegate(r gsnet.Receiver) {
+	nd.lk.Lock()
+	defer nd.lk.Unlock()
+	nd.receiver = r
+}
+
+// Stop removes the Receiver, so messages sent to this peer are dropped
+func (nd *node) Stop() {
+	nd.lk.Lock()
+	defer nd.lk.Unlock()
+	nd.receiver = nil
+}
+
+// ConnectTo connects to the given peer unless it is partitioned from this one
+func (nd *node) ConnectTo(_ context.Context, p peer.ID) error {
+	return nd.network.connect(nd.local, p)
+}
+
+// NewMessageSender connects to the given peer and returns a sender for it
+func (nd *node) NewMessageSender(ctx context.Context, p peer.ID) (gsnet.MessageSender, error) {
+	if err := nd.ConnectTo(ctx, p); err != nil {
+		return nil, err
+	}
+	return &messageSender{nd, p}, nil
+}
+
+// AddDialHints does nothing, as peers on the simulated network are reached
+// without addresses
+func (nd *node) AddDialHints(p peer.ID, addrs []ma.Multiaddr) {}
+
+// IsRelayed always returns false, as peers on the simulated network are
+// connected directly
+func (nd *node) IsRelayed(p peer.ID) bool {
+	return false
+}
+
+// WireStats always returns empty stats, as messages on the simulated network
+// are passed without being encoded
+func (nd *node) WireStats(p peer.ID) gsnet.WireStats {
+	return gsnet.WireStats{}
+}
+
+// ProtocolVersion always returns false, as messages on the simulated network
+// are passed in memory rather than over a negotiated protocol
+func (nd *node) ProtocolVersion(p peer.ID) (protocol.ID, bool) {
+	return "", false
+}
+
+// SupportedExtensions always returns false, as peers on the simulated network
+// do not advertise extensions
+func (nd *node) SupportedExtensions(p peer.ID) ([]graphsync.ExtensionName, bool) {
+	return nil, false
+}
+
+// ConnectionManager returns a connection manager that does nothing, as
+// connections on the simulated network are never pruned
+func (nd *node) ConnectionManager() gsnet.ConnManager {
+	return connmgr.NullConnMgr{}
+}
+
+type messageSender struct {
+	nd *node
+	p  peer.ID
+}
+
+func (ms *messageSender) SendMsg(ctx context.Context, message gsmsg.GraphSyncMessage) error {
+	return ms.nd.SendMessage(ctx, ms.p, message)
+}
+
+func (ms *messageSender) Close() error { return nil }
+func (ms *messageSender) Reset() error { return nil }
@@ -0,0 +1,150 @@
+package simnet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+type received struct {
+	from    peer.ID
+	message gsmsg.GraphSyncMessage
+	at      time.Time
+}
+
+type testReceiver struct {
+	messages     chan received
+	disconnected chan peer.ID
+}
+
+func newTestReceiver() *testReceiver {
+	return &testReceiver{
+		messages:     make(chan received, 16),
+		disconnected: make(chan peer.ID, 16),
+	}
+}
+
+func (tr *testReceiver) ReceiveMessage(ctx context.Context, sender peer.ID, incoming gsmsg.GraphSyncMessage) {
+	tr.messages <- received{sender, incoming, time.Now()}
+}
+
+func (tr *testReceiver) ReceiveError(err error) {}
+
+func (tr *testReceiver) Connected(p peer.ID) {}
+
+func (tr *testReceiver) Disconnected(p peer.ID) {
+	tr.disconnected <- p
+}
+
+func blockMessage(data string) gsmsg.GraphSyncMessage {
+	message := gsmsg.New()
+	message.AddBlock(blocks.NewBlock([]byte(data)))
+	return message
+}
+
+func TestLatencyAndOrdering(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	peers := testutil.GeneratePeers(2)
+	net := New(LinkConfig{Latency: 50 * time.Millisecond})
+	sender := net.Adapter(peers[0])
+	receiver := newTestReceiver()
+	net.Adapter(peers[1]).SetDelegate(receiver)
+
+	start := time.Now()
+	require.NoError(t, sender.SendMessage(ctx, peers[1], blockMessage("first")))
+	require.NoError(t, sender.SendMessage(ctx, peers[1], blockMessage("second")))
+
+	for _, expected := range []string{"first", "second"} {
+		var r received
+		testutil.AssertReceive(ctx, t, receiver.messages, &r, "message not received")
+		require.Equal(t, peers[0], r.from)
+		require.Equal(t, expected, string(r.message.Blocks()[0].RawData()))
+		require.True(t, r.at.Sub(start) >= 50*time.Millisecond)
+	}
+}
+
+func TestBandwidthCap(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	peers := testutil.GeneratePeers(2)
+	net := New(LinkConfig{})
+	// roughly 1000 bytes per message at 10000 bytes/sec takes ~100ms each
+	net.SetLink(peers[0], peers[1], LinkConfig{Bandwidth: 10000})
+	sender := net.Adapter(peers[0])
+	receiver := newTestReceiver()
+	net.Adapter(peers[1]).SetDelegate(receiver)
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		message := gsmsg.New()
+		message.AddBlock(testutil.GenerateBlocksOfSize(1, 1000)[0])
+		require.NoError(t, sender.SendMessage(ctx, peers[1], message))
+	}
+	var r received
+	testutil.AssertReceive(ctx, t, receiver.messages, &r, "message not received")
+	testutil.AssertReceive(ctx, t, receiver.messages, &r, "message not received")
+	require.True(t, r.at.Sub(start) >= 200*time.Millisecond)
+}
+
+func TestPacketLoss(t *testing.T) {
+	ctx := context.Background()
+	peers := testutil.GeneratePeers(2)
+	net := New(LinkConfig{LossRate: 1})
+	sender := net.Adapter(peers[0])
+	net.Adapter(peers[1]).SetDelegate(newTestReceiver())
+
+	err := sender.SendMessage(ctx, peers[1], blockMessage("lost"))
+	require.Equal(t, ErrMessageLost, err)
+
+	net.SetLinkBetween(peers[0], peers[1], LinkConfig{})
+	require.NoError(t, sender.SendMessage(ctx, peers[1], blockMessage("sent")))
+}
+
+func TestPartition(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	peers := testutil.GeneratePeers(3)
+	net := New(LinkConfig{})
+	receivers := make([]*testReceiver, len(peers))
+	for i, p := range peers {
+		receivers[i] = newTestReceiver()
+		net.Adapter(p).SetDelegate(receivers[i])
+	}
+	require.NoError(t, net.Adapter(peers[0]).ConnectTo(ctx, peers[1]))
+	require.NoError(t, net.Adapter(peers[0]).ConnectTo(ctx, peers[2]))
+
+	net.Partition([]peer.ID{peers[0], peers[1]}, []peer.ID{peers[2]})
+
+	// the connection across the partition is closed on both sides
+	var p peer.ID
+	testutil.AssertReceive(ctx, t, receivers[0].disconnected, &p, "disconnect not received")
+	require.Equal(t, peers[2], p)
+	testutil.AssertReceive(ctx, t, receivers[2].disconnected, &p, "disconnect not received")
+	require.Equal(t, peers[0], p)
+
+	require.Equal(t, ErrPartitioned, net.Adapter(peers[0]).SendMessage(ctx, peers[2], blockMessage("blocked")))
+	require.Equal(t, ErrPartitioned, net.Adapter(peers[2]).ConnectTo(ctx, peers[0]))
+	require.NoError(t, net.Adapter(peers[0]).SendMessage(ctx, peers[1], blockMessage("allowed")))
+	var r received
+	testutil.AssertReceive(ctx, t, receivers[1].messages, &r, "message not received")
+
+	net.Heal()
+	require.NoError(t, net.Adapter(peers[2]).ConnectTo(ctx, peers[0]))
+	require.NoError(t, net.Adapter(peers[0]).SendMessage(ctx, peers[2], blockMessage("healed")))
+	testutil.AssertReceive(ctx, t, receivers[2].messages, &r, "message not received")
+	require.Equal(t, "healed", string(r.message.Blocks()[0].RawData()))
+}
@@ -0,0 +1,79 @@
+package testutil
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+// TestConnManager implements a connection manager that records protected
+// connections for testing
+type TestConnManager struct {
+	lk             sync.RWMutex
+	protectedConns map[peer.ID][]string
+}
+
+// NewTestConnManager returns a new TestConnManager
+func NewTestConnManager() *TestConnManager {
+	return &TestConnManager{protectedConns: make(map[peer.ID][]string)}
+}
+
+// Protect protects the connection to the given peer with the given tag
+func (tcm *TestConnManager) Protect(p peer.ID, tag string) {
+	tcm.lk.Lock()
+	defer tcm.lk.Unlock()
+	for _, existing := range tcm.protectedConns[p] {
+		if existing == tag {
+			return
+		}
+	}
+	tcm.protectedConns[p] = append(tcm.protectedConns[p], tag)
+}
+
+// Unprotect removes the given tag's protection from the connection to the
+// given peer, returning whether the connection is still protected
+func (tcm *TestConnManager) Unprotect(p peer.ID, tag string) bool {
+	tcm.lk.Lock()
+	defer tcm.lk.Unlock()
+	tags := tcm.protectedConns[p]
+	for i, existing := range tags {
+		if existing == tag {
+			tags = append(tags[:i], tags[i+1:]...)
+			break
+		}
+	}
+	if len(tags) == 0 {
+		delete(tcm.protectedConns, p)
+		return false
+	}
+	tcm.protectedConns[p] = tags
+	return true
+}
+
+// AssertProtected asserts the connection to the given peer is protected
+func (tcm *TestConnManager) AssertProtected(t testing.TB, p peer.ID) {
+	tcm.lk.RLock()
+	defer tcm.lk.RUnlock()
+	require.NotEmpty(t, tcm.protectedConns[p], "connection should be protected")
+}
+
+// AssertProtectedWithTags asserts the connection to the given peer is
+// protected with exactly the given tags
+func (tcm *TestConnManager) AssertProtectedWithTags(t testing.TB, p peer.ID, tags ...string) {
+	tcm.lk.RLock()
+	defer tcm.lk.RUnlock()
+	require.ElementsMatch(t, tags, tcm.protectedConns[p], "connection should be protected with tags")
+}
+
+// RefuteProtected eventually asserts the connection to the given peer is no
+// longer protected
+func (tcm *TestConnManager) RefuteProtected(t testing.TB, p peer.ID) {
+	require.Eventually(t, func() bool {
+		tcm.lk.RLock()
+		defer tcm.lk.RUnlock()
+		return len(tcm.protectedConns[p]) == 0
+	}, time.Second, 10*time.Millisecond, "connection should not be protected")
+}
@@ -110,18 +110,32 @@ func (mp *MockPublisher) AddNotifees(notifees []notifications.Notifee) {
 func (mp *MockPublisher) PublishMatchingEvents(shouldPublish func(notifications.TopicData) bool, events []notifications.Event) {
 	mp.notifeesLk.Lock()
 	var newNotifees []notifications.Notifee
+	var batchSubscribers []notifications.BatchSubscriber
+	seen := make(map[*notifications.TopicDataSubscriber]struct{})
 	for _, notifee := range mp.notifees {
 		if shouldPublish(notifee.Data) {
 			for _, ev := range events {
 				notifee.Subscriber.Subscriber.OnNext(notifee.Data, ev)
 			}
 			notifee.Subscriber.Subscriber.OnClose(notifee.Data)
+			if _, ok := seen[notifee.Subscriber]; ok {
+				continue
+			}
+			seen[notifee.Subscriber] = struct{}{}
+			if batchSubscriber, ok := notifee.Subscriber.Subscriber.(notifications.BatchSubscriber); ok {
+				batchSubscribers = append(batchSubscribers, batchSubscriber)
+			}
 		} else {
 			newNotifees = append(newNotifees, notifee)
 		}
 	}
 	mp.notifees = newNotifees
 	mp.notifeesLk.Unlock()
+	for _, batchSubscriber := range batchSubscribers {
+		for _, ev := range events {
+			batchSubscriber.OnBatchEnd(ev)
+		}
+	}
 }
 
 func (mp *MockPublisher) PublishEvents(events []notifications.Event) {
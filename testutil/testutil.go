@@ -15,6 +15,7 @@ import (
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	random "github.com/jbenet/go-random"
 	"github.com/libp2p/go-libp2p-core/peer"
+	mh "github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/require"
 
 	"github.com/ipfs/go-graphsync"
@@ -45,6 +46,20 @@ func GenerateBlocksOfSize(n int, size int64) []blocks.Block {
 	return generatedBlocks
 }
 
+// GenerateIdentityBlocks generates n blocks of the given size whose data is
+// inlined in an identity multihash CID
+func GenerateIdentityBlocks(n int, size int64) []blocks.Block {
+	generatedBlocks := make([]blocks.Block, 0, n)
+	for i := 0; i < n; i++ {
+		data := RandomBytes(size)
+		mhash, _ := mh.Sum(data, mh.IDENTITY, -1)
+		c := cid.NewCidV1(cid.Raw, mhash)
+		b, _ := blocks.NewBlockWithCid(data, c)
+		generatedBlocks = append(generatedBlocks, b)
+	}
+	return generatedBlocks
+}
+
 // GenerateCids produces n content identifiers.
 func GenerateCids(n int) []cid.Cid {
 	cids := make([]cid.Cid, 0, n)
@@ -245,6 +260,18 @@ func (fbd fakeBlkData) BlockSizeOnWire() uint64 {
 	return fbd.size
 }
 
+func (fbd fakeBlkData) Cid() cid.Cid {
+	return fbd.link.(cidlink.Link).Cid
+}
+
+func (fbd fakeBlkData) Index() int64 {
+	return 0
+}
+
+func (fbd fakeBlkData) Deduplicated() bool {
+	return false
+}
+
 // NewFakeBlockData returns a fake block that matches the block data interface
 func NewFakeBlockData() graphsync.BlockData {
 	return &fakeBlkData{